@@ -64,8 +64,22 @@ var ModuleV2 = fx.Options(
 		metrics.NewSvc,
 		iam.New,
 		info.New,
-		func(ps *iam.ArmoryCloudPrincipalService) server.AuthService {
-			return ps
-		},
+		newAuthService,
 	),
 )
+
+type authServiceParameters struct {
+	fx.In
+
+	Principals        *iam.ArmoryCloudPrincipalService
+	Config            iam.Configuration
+	SpinnakerResolver iam.SpinnakerIdentityResolver `optional:"true"`
+}
+
+// newAuthService verifies bearer tokens with the principal service, and Spinnaker identities too when enabled
+func newAuthService(p authServiceParameters) (server.AuthService, error) {
+	if !p.Config.Spinnaker.Enabled {
+		return p.Principals, nil
+	}
+	return iam.NewSpinnakerVerifier(p.Principals, p.Config.Spinnaker, p.SpinnakerResolver)
+}
@@ -0,0 +1,524 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package audit keeps tamper-evident audit trails in blob storage, without a separate service:
+//
+//	audit:
+//	  prefix: audit/deployments
+//	  flushInterval: 1m
+//
+//	err := sink.Write(ctx, audit.Record{Action: "deployment.cancel", Resource: deployment.ID})
+//
+// Records are chained, the hash of each record covers the hash of the record before it, so a record that is changed, removed
+// or reordered breaks the chain from there on, see Verify. Records are buffered and written in segments of JSON lines, encrypted
+// with the crypto.Encrypter when crypto.Module is provided. Every AnchorInterval the sequence and hash of the head of the chain
+// are logged and its sequence is reported by the audit.anchor.sequence gauge, so the trail can be checked against anchors kept
+// outside of the bucket
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/crypto"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordsMetric  = "audit.records"
+	segmentsMetric = "audit.segments"
+	anchorMetric   = "audit.anchor.sequence"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+
+	headKey           = "head.json"
+	segmentsPrefix    = "segments/"
+	encryptedMetadata = "encrypted"
+
+	defaultPrefix            = "audit"
+	defaultFlushInterval     = time.Minute
+	defaultMaxSegmentRecords = 1000
+	defaultMaxBuffered       = 100_000
+	defaultAnchorInterval    = time.Hour
+)
+
+var (
+	// ErrBufferFull the sink already buffers MaxBuffered records, the blob store isn't keeping up or is failing
+	ErrBufferFull = errors.New("audit buffer is full")
+	// ErrInvalidRecord the record has no action or actor
+	ErrInvalidRecord = errors.New("invalid audit record")
+	// ErrChainBroken a record of the trail doesn't match the hash chain, it was changed, removed or reordered
+	ErrChainBroken = errors.New("audit chain broken")
+)
+
+type (
+	Configuration struct {
+		// Prefix the key prefix of the trail in the blob.Store, defaults to audit
+		Prefix string
+		// FlushInterval how often buffered records are written, defaults to 1m
+		FlushInterval time.Duration
+		// MaxSegmentRecords the max records per segment, a segment is written right away once it is full. Defaults to 1000
+		MaxSegmentRecords int
+		// MaxBuffered the max records waiting to be written, Write fails with ErrBufferFull beyond it. Defaults to 100000
+		MaxBuffered int
+		// AnchorInterval how often the head of the chain is logged, defaults to 1h
+		AnchorInterval time.Duration
+	}
+
+	// Record an auditable action
+	Record struct {
+		// Time when the action happened, defaults to now
+		Time time.Time `json:"time"`
+		// Actor defaults to the name of the principal of the context
+		Actor string `json:"actor"`
+		// Org defaults to the org of the principal of the context
+		Org      string         `json:"org,omitempty"`
+		Action   string         `json:"action"`
+		Resource string         `json:"resource,omitempty"`
+		Details  map[string]any `json:"details,omitempty"`
+	}
+
+	// Sink receives audit records
+	Sink interface {
+		Write(ctx context.Context, record Record) error
+	}
+
+	// Entry a record of the trail, the hash covers the sequence, the hash of the previous entry and the record as it is stored
+	Entry struct {
+		Sequence     uint64          `json:"sequence"`
+		PreviousHash string          `json:"previousHash"`
+		Hash         string          `json:"hash"`
+		Record       json.RawMessage `json:"record"`
+	}
+
+	// Anchor the sequence and hash of the head of a chain
+	Anchor struct {
+		Sequence uint64 `json:"sequence"`
+		Hash     string `json:"hash"`
+	}
+
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    Configuration `optional:"true"`
+		Store     blob.Store
+		// Encrypter encrypts the segments when provided, see crypto.Module
+		Encrypter *crypto.Encrypter `optional:"true"`
+		Log       *zap.SugaredLogger
+		Metrics   metrics.MetricsSvc `optional:"true"`
+		Clock     clock.Clock        `optional:"true"`
+	}
+
+	// BlobSink chains audit records and writes them to a blob.Store
+	BlobSink struct {
+		config    Configuration
+		store     blob.Store
+		encrypter *crypto.Encrypter
+		log       *zap.SugaredLogger
+		metrics   metrics.MetricsSvc
+		clock     clock.Clock
+
+		mu     sync.Mutex
+		head   Anchor
+		buffer []Entry
+		full   chan struct{}
+		// flushMu held while segments are written, written is the head of the chain that is stored and anchored the last one logged
+		flushMu  sync.Mutex
+		written  Anchor
+		anchored Anchor
+	}
+)
+
+var Module = fx.Module(
+	"audit",
+	fx.Provide(New, func(s *BlobSink) Sink { return s }),
+)
+
+// New creates the BlobSink of the configuration, buffered records are written from when the application starts until it stops
+func New(p Parameters) (*BlobSink, error) {
+	s, err := NewBlobSink(context.Background(), p.Config, p.Store, p.Encrypter, p.Log, p.Metrics, p.Clock)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				s.run(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(stopCtx context.Context) error {
+			cancel()
+			<-done
+			if err := s.Flush(stopCtx); err != nil {
+				s.log.Errorw("Failed to write the buffered audit records before stopping", "error", err, "buffered", s.Buffered())
+			}
+			s.anchor()
+			return nil
+		},
+	})
+	return s, nil
+}
+
+// NewBlobSink creates a BlobSink that continues the chain stored under the prefix of the configuration
+func NewBlobSink(ctx context.Context, config Configuration, store blob.Store, encrypter *crypto.Encrypter, log *zap.SugaredLogger, ms metrics.MetricsSvc, c clock.Clock) (*BlobSink, error) {
+	s := &BlobSink{
+		config:    config.withDefaults(),
+		store:     store,
+		encrypter: encrypter,
+		log:       log,
+		metrics:   ms,
+		clock:     clock.OrDefault(c),
+		full:      make(chan struct{}, 1),
+	}
+	head, err := s.readHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the head of the audit trail: %w", err)
+	}
+	s.head, s.written, s.anchored = head, head, head
+	return s, nil
+}
+
+// Write chains the record to the trail and buffers it to be written
+func (s *BlobSink) Write(ctx context.Context, record Record) error {
+	if principal, err := iam.ExtractPrincipalFromContext(ctx); err == nil {
+		if record.Actor == "" {
+			record.Actor = principal.Name
+		}
+		if record.Org == "" {
+			record.Org = principal.OrgId
+		}
+	}
+	if record.Action == "" || record.Actor == "" {
+		return fmt.Errorf("%w: action %q, actor %q", ErrInvalidRecord, record.Action, record.Actor)
+	}
+	if record.Time.IsZero() {
+		record.Time = s.clock.Now()
+	}
+	record.Time = record.Time.UTC()
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buffer) >= s.config.MaxBuffered {
+		s.count(recordsMetric, outcomeFailure, 1)
+		return ErrBufferFull
+	}
+	entry := Entry{Sequence: s.head.Sequence + 1, PreviousHash: s.head.Hash, Record: payload}
+	entry.Hash = entry.hash()
+	s.head = Anchor{Sequence: entry.Sequence, Hash: entry.Hash}
+	s.buffer = append(s.buffer, entry)
+	s.count(recordsMetric, outcomeSuccess, 1)
+
+	if len(s.buffer) >= s.config.MaxSegmentRecords {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered records in segments, until they are all written or a write fails
+func (s *BlobSink) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		segment := s.buffer[:min(len(s.buffer), s.config.MaxSegmentRecords)]
+		s.mu.Unlock()
+		if len(segment) == 0 {
+			return nil
+		}
+
+		if err := s.writeSegment(ctx, segment); err != nil {
+			s.count(segmentsMetric, outcomeFailure, 1)
+			return err
+		}
+		s.count(segmentsMetric, outcomeSuccess, 1)
+
+		s.mu.Lock()
+		s.buffer = s.buffer[len(segment):]
+		s.mu.Unlock()
+	}
+}
+
+// Buffered the number of records waiting to be written
+func (s *BlobSink) Buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buffer)
+}
+
+// Head the head of the chain that is written to the blob.Store
+func (s *BlobSink) Head() Anchor {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.written
+}
+
+func (s *BlobSink) run(ctx context.Context) {
+	flush := s.clock.NewTicker(s.config.FlushInterval)
+	defer flush.Stop()
+	anchor := s.clock.NewTicker(s.config.AnchorInterval)
+	defer anchor.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-anchor.C():
+			s.anchor()
+			continue
+		case <-flush.C():
+		case <-s.full:
+		}
+		if err := s.Flush(ctx); err != nil && ctx.Err() == nil {
+			s.log.Warnw("Failed to write audit records, they will be retried", "error", err, "buffered", s.Buffered())
+		}
+	}
+}
+
+// writeSegment writes the entries as a segment keyed by their first sequence, then the new head of the chain
+func (s *BlobSink) writeSegment(ctx context.Context, segment []Entry) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range segment {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	last := segment[len(segment)-1]
+	key := s.key(segmentsPrefix + fmt.Sprintf("%020d.jsonl", segment[0].Sequence))
+	metadata := map[string]string{
+		"first-sequence": strconv.FormatUint(segment[0].Sequence, 10),
+		"last-sequence":  strconv.FormatUint(last.Sequence, 10),
+		"hash":           last.Hash,
+	}
+	content := body.Bytes()
+	if s.encrypter != nil {
+		// the key is authenticated, so a segment can't be moved to another position of the trail
+		envelope, err := s.encrypter.Encrypt(ctx, content, []byte(key))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt audit segment: %w", err)
+		}
+		if content, err = json.Marshal(envelope); err != nil {
+			return err
+		}
+		metadata[encryptedMetadata] = "true"
+	}
+	if _, err := s.store.Put(ctx, key, bytes.NewReader(content), blob.PutOptions{ContentType: "application/json", Metadata: metadata}); err != nil {
+		return err
+	}
+
+	head, err := json.Marshal(Anchor{Sequence: last.Sequence, Hash: last.Hash})
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Put(ctx, s.key(headKey), bytes.NewReader(head), blob.PutOptions{ContentType: "application/json"}); err != nil {
+		return err
+	}
+	s.written = Anchor{Sequence: last.Sequence, Hash: last.Hash}
+	return nil
+}
+
+// anchor logs the head of the chain that is written, unless it didn't move since the last anchor
+func (s *BlobSink) anchor() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.written == s.anchored {
+		return
+	}
+	s.anchored = s.written
+	s.log.Infow("Audit trail anchor", "prefix", s.config.Prefix, "sequence", s.written.Sequence, "hash", s.written.Hash)
+	if s.metrics != nil {
+		s.metrics.Gauge(anchorMetric).Update(float64(s.written.Sequence))
+	}
+}
+
+func (s *BlobSink) readHead(ctx context.Context) (Anchor, error) {
+	object, err := s.store.Get(ctx, s.key(headKey))
+	if errors.Is(err, blob.ErrNotFound) {
+		return Anchor{}, nil
+	}
+	if err != nil {
+		return Anchor{}, err
+	}
+	defer object.Body.Close()
+	var head Anchor
+	err = json.NewDecoder(object.Body).Decode(&head)
+	return head, err
+}
+
+func (s *BlobSink) key(name string) string {
+	return path.Join(s.config.Prefix, name)
+}
+
+func (s *BlobSink) count(metric string, outcome string, n int64) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.CounterWithTags(metric, map[string]string{"outcome": outcome}).Inc(n)
+}
+
+// Verify reads the trail stored under the prefix and checks that every entry is chained to the one before it, and that the
+// chain goes through the anchors, such as those that were logged. Returns the head of the chain, wrapped ErrChainBroken
+// errors name the first entry that doesn't match
+func Verify(ctx context.Context, store blob.Store, prefix string, encrypter *crypto.Encrypter, anchors ...Anchor) (Anchor, error) {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	expected := map[uint64]string{}
+	for _, anchor := range anchors {
+		expected[anchor.Sequence] = anchor.Hash
+	}
+
+	var head Anchor
+	cursor := ""
+	for {
+		page, err := store.List(ctx, blob.ListOptions{Prefix: path.Join(prefix, segmentsPrefix) + "/", Cursor: cursor})
+		if err != nil {
+			return head, err
+		}
+		for _, object := range page.Objects {
+			entries, err := readSegment(ctx, store, object.Key, encrypter)
+			if err != nil {
+				return head, fmt.Errorf("failed to read audit segment %s: %w", object.Key, err)
+			}
+			for _, entry := range entries {
+				switch {
+				case entry.Sequence != head.Sequence+1:
+					return head, fmt.Errorf("%w: expected sequence %d, got %d", ErrChainBroken, head.Sequence+1, entry.Sequence)
+				case entry.PreviousHash != head.Hash || entry.Hash != entry.hash():
+					return head, fmt.Errorf("%w: at sequence %d", ErrChainBroken, entry.Sequence)
+				}
+				if hash, ok := expected[entry.Sequence]; ok && hash != entry.Hash {
+					return head, fmt.Errorf("%w: at sequence %d, which doesn't match its anchor", ErrChainBroken, entry.Sequence)
+				}
+				delete(expected, entry.Sequence)
+				head = Anchor{Sequence: entry.Sequence, Hash: entry.Hash}
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	for sequence := range expected {
+		if sequence > 0 {
+			return head, fmt.Errorf("%w: the trail ends at sequence %d, before the anchor at sequence %d", ErrChainBroken, head.Sequence, sequence)
+		}
+	}
+	return head, nil
+}
+
+func readSegment(ctx context.Context, store blob.Store, key string, encrypter *crypto.Encrypter) ([]Entry, error) {
+	object, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	content, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, err
+	}
+	if object.Metadata[encryptedMetadata] == "true" {
+		if encrypter == nil {
+			return nil, errors.New("the segment is encrypted, an Encrypter is required")
+		}
+		var envelope crypto.Envelope
+		if err := json.Unmarshal(content, &envelope); err != nil {
+			return nil, err
+		}
+		if content, err = encrypter.Decrypt(ctx, &envelope, []byte(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (e Entry) hash() string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%d\n%s\n", e.Sequence, e.PreviousHash)
+	_, _ = h.Write(e.Record)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.Prefix == "" {
+		c.Prefix = defaultPrefix
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.MaxSegmentRecords <= 0 {
+		c.MaxSegmentRecords = defaultMaxSegmentRecords
+	}
+	if c.MaxBuffered <= 0 {
+		c.MaxBuffered = defaultMaxBuffered
+	}
+	if c.AnchorInterval <= 0 {
+		c.AnchorInterval = defaultAnchorInterval
+	}
+	return c
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/crypto"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type memoryStore struct {
+	blob.Store
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	failWith error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}, metadata: map[string]map[string]string{}}
+}
+
+func (m *memoryStore) Put(_ context.Context, key string, body io.Reader, opts blob.PutOptions) (*blob.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failWith != nil {
+		return nil, m.failWith
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[key] = content
+	m.metadata[key] = opts.Metadata
+	return &blob.ObjectInfo{Key: key, Size: int64(len(content))}, nil
+}
+
+func (m *memoryStore) Get(_ context.Context, key string) (*blob.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return &blob.Object{
+		ObjectInfo: blob.ObjectInfo{Key: key, Size: int64(len(content)), Metadata: m.metadata[key]},
+		Body:       io.NopCloser(bytes.NewReader(content)),
+	}, nil
+}
+
+func (m *memoryStore) List(_ context.Context, opts blob.ListOptions) (*blob.ListResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := &blob.ListResult{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, opts.Prefix) {
+			result.Objects = append(result.Objects, blob.ObjectInfo{Key: key})
+		}
+	}
+	sort.Slice(result.Objects, func(i, j int) bool { return result.Objects[i].Key < result.Objects[j].Key })
+	return result, nil
+}
+
+var auditStart = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestSink(t *testing.T, store blob.Store, encrypter *crypto.Encrypter) *BlobSink {
+	s, err := NewBlobSink(context.Background(), Configuration{MaxSegmentRecords: 2}, store, encrypter, zap.NewNop().Sugar(), nil, clock.NewFake(auditStart))
+	require.NoError(t, err)
+	return s
+}
+
+func TestBlobSinkChainsRecords(t *testing.T) {
+	store := newMemoryStore()
+	s := newTestSink(t, store, nil)
+	ctx := iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{Name: "user@example.com", OrgId: "org-1"})
+
+	for _, action := range []string{"deployment.start", "deployment.cancel", "deployment.delete"} {
+		require.NoError(t, s.Write(ctx, Record{Action: action, Details: map[string]any{"id": 9007199254740993}}))
+	}
+	assert.ErrorIs(t, s.Write(context.Background(), Record{Action: "deployment.start"}), ErrInvalidRecord)
+	assert.Equal(t, Anchor{}, s.Head(), "records are only written once flushed")
+
+	require.NoError(t, s.Flush(ctx))
+	assert.Equal(t, 0, s.Buffered())
+	assert.Len(t, store.objects, 3, "two segments and the head")
+	assert.Equal(t, "3", store.metadata["audit/segments/00000000000000000003.jsonl"]["first-sequence"])
+
+	head, err := Verify(ctx, store, "", nil, s.Head())
+	require.NoError(t, err)
+	assert.Equal(t, s.Head(), head)
+	assert.Equal(t, uint64(3), head.Sequence)
+
+	resumed := newTestSink(t, store, nil)
+	require.NoError(t, resumed.Write(ctx, Record{Action: "deployment.start"}))
+	require.NoError(t, resumed.Flush(ctx))
+	head, err = Verify(ctx, store, "", nil, s.Head())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), head.Sequence, "a new sink continues the chain")
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	store := newMemoryStore()
+	s := newTestSink(t, store, nil)
+	ctx := context.Background()
+	for _, actor := range []string{"alice", "bob", "carol"} {
+		require.NoError(t, s.Write(ctx, Record{Actor: actor, Action: "rbac.grant"}))
+	}
+	require.NoError(t, s.Flush(ctx))
+	anchor := s.Head()
+
+	key := "audit/segments/00000000000000000001.jsonl"
+	original := store.objects[key]
+	store.objects[key] = bytes.Replace(original, []byte("bob"), []byte("eve"), 1)
+	_, err := Verify(ctx, store, "audit", nil)
+	assert.ErrorIs(t, err, ErrChainBroken)
+	assert.ErrorContains(t, err, "at sequence 2")
+
+	store.objects[key] = original
+	delete(store.objects, "audit/segments/00000000000000000003.jsonl")
+	_, err = Verify(ctx, store, "audit", nil)
+	assert.NoError(t, err, "a truncated trail is only detected with an anchor")
+	_, err = Verify(ctx, store, "audit", nil, anchor)
+	assert.ErrorIs(t, err, ErrChainBroken)
+}
+
+func TestBlobSinkEncryptsSegments(t *testing.T) {
+	keyring, err := crypto.NewLocalKeyring(crypto.LocalConfiguration{
+		PrimaryKeyID: "2023",
+		Keys:         map[string]string{"2023": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))},
+	})
+	require.NoError(t, err)
+	encrypter := crypto.New(keyring)
+
+	store := newMemoryStore()
+	s := newTestSink(t, store, encrypter)
+	ctx := context.Background()
+	require.NoError(t, s.Write(ctx, Record{Actor: "alice", Action: "secret.read"}))
+	require.NoError(t, s.Flush(ctx))
+
+	segment := store.objects["audit/segments/00000000000000000001.jsonl"]
+	assert.NotContains(t, string(segment), "secret.read")
+	_, err = Verify(ctx, store, "audit", nil)
+	assert.Error(t, err, "encrypted segments can't be verified without the Encrypter")
+	head, err := Verify(ctx, store, "audit", encrypter)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), head.Sequence)
+}
+
+func TestBlobSinkKeepsRecordsOfFailedWrites(t *testing.T) {
+	store := newMemoryStore()
+	s := newTestSink(t, store, nil)
+	ctx := context.Background()
+	require.NoError(t, s.Write(ctx, Record{Actor: "alice", Action: "rbac.grant"}))
+
+	store.failWith = errors.New("unavailable")
+	assert.Error(t, s.Flush(ctx))
+	assert.Equal(t, 1, s.Buffered())
+
+	store.failWith = nil
+	require.NoError(t, s.Flush(ctx))
+	assert.Equal(t, 0, s.Buffered())
+	_, err := Verify(ctx, store, "audit", nil, s.Head())
+	assert.NoError(t, err)
+}
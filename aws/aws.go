@@ -0,0 +1,195 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package aws provides a shared AWS SDK v2 configuration, and the clients built from it, via fx.
+// Every client gets the same region, credentials, retry behaviour, tracing and metrics.
+package aws
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/logging"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/secrets"
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/samber/lo"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	RetryModeStandard = "standard"
+	RetryModeAdaptive = "adaptive"
+
+	defaultMaxAttempts = 3
+)
+
+// Configuration the settings shared by every AWS client
+type Configuration struct {
+	// Region the AWS region, when not set the default AWS region resolution is used
+	Region string
+	// Endpoint optional endpoint override, such as a localstack url
+	Endpoint string
+	// AccessKeyID optional static access key, when not set the default AWS credentials chain is used.
+	// This can be an encrypted secret, ex: encrypted:secrets-manager!r:us-west-2!s:aws-keys!k:id
+	AccessKeyID string
+	// SecretAccessKey the secret for AccessKeyID, this can be an encrypted secret
+	SecretAccessKey string
+	// AssumeRole optional role to assume using the base credentials
+	AssumeRole AssumeRoleConfiguration
+	// RetryMode standard or adaptive, defaults to adaptive which also rate limits attempts once AWS starts throttling
+	RetryMode string
+	// MaxAttempts the maximum number of attempts per request including the first, defaults to 3
+	MaxAttempts int
+}
+
+// AssumeRoleConfiguration configures role assumption via STS
+type AssumeRoleConfiguration struct {
+	// RoleARN the role to assume, role assumption is disabled when empty
+	RoleARN string
+	// ExternalID optional external id required by the role's trust policy
+	ExternalID string
+	// SessionName optional session name, defaults to one generated by the SDK
+	SessionName string
+}
+
+type configParameters struct {
+	fx.In
+
+	Config  Configuration
+	Log     *zap.SugaredLogger
+	Metrics metrics.MetricsSvc `optional:"true"`
+}
+
+// Module provides an aws.Config and the S3 and STS clients built from it, it requires a Configuration to be provided
+var Module = fx.Module("aws",
+	fx.Provide(
+		func(p configParameters) (awssdk.Config, error) {
+			return NewConfig(context.Background(), p.Config, p.Log, p.Metrics)
+		},
+		NewS3Client,
+		NewSTSClient,
+	),
+)
+
+// NewConfig loads the shared AWS config, ms may be nil
+func NewConfig(ctx context.Context, c Configuration, log *zap.SugaredLogger, ms metrics.MetricsSvc) (awssdk.Config, error) {
+	maxAttempts := c.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithLogger(logging.AwsLoggerFromZapLogger(log, lo.ToPtr("aws"))),
+		config.WithRetryer(func() awssdk.Retryer {
+			withMaxAttempts := func(o *retry.StandardOptions) {
+				o.MaxAttempts = maxAttempts
+			}
+			if c.RetryMode == RetryModeStandard {
+				return retry.NewStandard(withMaxAttempts)
+			}
+			return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+				o.StandardOptions = append(o.StandardOptions, withMaxAttempts)
+			})
+		}),
+		config.WithAPIOptions([]func(*middleware.Stack) error{
+			instrumentation(ms),
+		}),
+	}
+
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+
+	if c.Endpoint != "" {
+		opts = append(opts, config.WithEndpointResolverWithOptions(awssdk.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...any) (awssdk.Endpoint, error) {
+				return awssdk.Endpoint{
+					URL:               c.Endpoint,
+					PartitionID:       "aws",
+					HostnameImmutable: true,
+					SigningRegion:     region,
+				}, nil
+			},
+		)))
+	}
+
+	if c.AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(awssdk.NewCredentialsCache(secretCredentials(c.AccessKeyID, c.SecretAccessKey))))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return awssdk.Config{}, err
+	}
+
+	if c.AssumeRole.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), c.AssumeRole.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			if c.AssumeRole.ExternalID != "" {
+				o.ExternalID = lo.ToPtr(c.AssumeRole.ExternalID)
+			}
+			if c.AssumeRole.SessionName != "" {
+				o.RoleSessionName = c.AssumeRole.SessionName
+			}
+		})
+		cfg.Credentials = awssdk.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+func NewS3Client(cfg awssdk.Config) *s3.Client {
+	return s3.NewFromConfig(cfg)
+}
+
+func NewSTSClient(cfg awssdk.Config) *sts.Client {
+	return sts.NewFromConfig(cfg)
+}
+
+// secretCredentials resolves the keys through the secrets engines when they are first needed, rather than at startup
+func secretCredentials(accessKeyID, secretAccessKey string) awssdk.CredentialsProvider {
+	return awssdk.CredentialsProviderFunc(func(ctx context.Context) (awssdk.Credentials, error) {
+		id, err := decrypt(ctx, accessKeyID)
+		if err != nil {
+			return awssdk.Credentials{}, err
+		}
+		secret, err := decrypt(ctx, secretAccessKey)
+		if err != nil {
+			return awssdk.Credentials{}, err
+		}
+		return awssdk.Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			Source:          "go-commons/aws",
+		}, nil
+	})
+}
+
+func decrypt(ctx context.Context, value string) (string, error) {
+	if !secrets.IsEncryptedSecret(value) {
+		return value, nil
+	}
+	d, err := secrets.NewDecrypter(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	return d.Decrypt()
+}
@@ -0,0 +1,53 @@
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/armory-io/go-commons/metrics"
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestNewConfig(t *testing.T) {
+	var attempts atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDEXAMPLE/"), "encrypted credentials should be resolved")
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().TimerWithTags(requestsMetric, map[string]string{
+		"service":   "S3",
+		"operation": "HeadBucket",
+		"outcome":   "SUCCESS",
+	}).Return(scope.Timer(requestsMetric))
+
+	cfg, err := NewConfig(context.Background(), Configuration{
+		Region:          "us-west-2",
+		Endpoint:        s.URL,
+		AccessKeyID:     "encrypted:noop!AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		MaxAttempts:     3,
+	}, zap.S(), ms)
+	assert.NoError(t, err)
+
+	_, err = NewS3Client(cfg).HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: awssdk.String("bucket")})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), attempts.Load(), "5xx responses should be retried up to MaxAttempts")
+	assert.Len(t, scope.Snapshot().Timers(), 1)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/metrics"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	instrumentationName = "github.com/armory-io/go-commons/aws"
+	requestsMetric      = "aws.client.requests"
+)
+
+// instrumentation adds a span and a timer around every operation, the span covers all retry attempts.
+// It is added after the SDK's own initialize middleware, which is what records the service and operation names
+func instrumentation(ms metrics.MetricsSvc) func(*middleware.Stack) error {
+	tracer := otel.Tracer(instrumentationName)
+
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("GoCommonsInstrumentation", func(
+			ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			service := awsmiddleware.GetServiceID(ctx)
+			operation := awsmiddleware.GetOperationName(ctx)
+
+			ctx, span := tracer.Start(ctx, fmt.Sprintf("%s.%s", service, operation),
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("rpc.system", "aws-api"),
+					attribute.String("rpc.service", service),
+					attribute.String("rpc.method", operation),
+					attribute.String("aws.region", awsmiddleware.GetRegion(ctx)),
+				),
+			)
+			defer span.End()
+
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+
+			outcome := "SUCCESS"
+			if err != nil {
+				outcome = "ERROR"
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			if ms != nil {
+				ms.TimerWithTags(requestsMetric, map[string]string{
+					"service":   service,
+					"operation": operation,
+					"outcome":   outcome,
+				}).Record(time.Since(start))
+			}
+			return out, metadata, err
+		}), middleware.After)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package banner logs a single structured summary of what an application started with and adds it to /info.
+// It is opt-in, add banner.Module to the application's fx options
+package banner
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/envutils"
+	"github.com/armory-io/go-commons/logging"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultDependencyPrefix = "github.com/armory-io/"
+	gitSHAEnvVar            = "GIT_SHA"
+)
+
+type (
+	Configuration struct {
+		// Dependencies module path prefixes of the dependencies whose versions are reported, defaults to github.com/armory-io/
+		Dependencies []string `yaml:"dependencies"`
+	}
+
+	// Summary what the application started with
+	Summary struct {
+		Name         string            `json:"name"`
+		Version      string            `json:"version"`
+		Environment  string            `json:"environment"`
+		GitSHA       string            `json:"gitSha,omitempty"`
+		GoVersion    string            `json:"goVersion,omitempty"`
+		Profiles     []string          `json:"profiles"`
+		Ports        map[string]uint32 `json:"ports,omitempty"`
+		Modules      []string          `json:"modules"`
+		Dependencies map[string]string `json:"dependencies"`
+	}
+
+	parameters struct {
+		fx.In
+
+		Lifecycle     fx.Lifecycle
+		Log           *zap.SugaredLogger
+		Metadata      metadata.ApplicationMetadata
+		Info          *info.InfoService    `optional:"true"`
+		Server        server.Configuration `optional:"true"`
+		Configuration Configuration        `optional:"true"`
+	}
+
+	// contributor adds the summary to /info once the application has started
+	contributor struct {
+		mu      sync.RWMutex
+		summary *Summary
+	}
+)
+
+var Module = fx.Module("banner", fx.Invoke(register))
+
+func register(p parameters) {
+	c := &contributor{}
+	if p.Info != nil {
+		p.Info.AddInfoContributor(c)
+	}
+
+	p.Lifecycle.Append(fx.Hook{
+		// modules are only known once every constructor and invoke has run, which is the case by the time hooks start
+		OnStart: func(ctx context.Context) error {
+			buildInfo, _ := debug.ReadBuildInfo()
+			summary := summarize(p.Metadata, p.Server, p.Configuration, buildInfo, logging.FxModules(), typesafeconfig.ActiveProfiles())
+
+			c.mu.Lock()
+			c.summary = &summary
+			c.mu.Unlock()
+
+			p.Log.Infow("Application starting",
+				"name", summary.Name,
+				"version", summary.Version,
+				"environment", summary.Environment,
+				"gitSha", summary.GitSHA,
+				"goVersion", summary.GoVersion,
+				"profiles", summary.Profiles,
+				"ports", summary.Ports,
+				"modules", summary.Modules,
+				"dependencies", summary.Dependencies,
+			)
+			return nil
+		},
+	})
+}
+
+func (c *contributor) Contribute(builder *info.InfoBuilder) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.summary != nil {
+		builder.WithDetail("startup", c.summary)
+	}
+}
+
+func summarize(
+	md metadata.ApplicationMetadata,
+	serverConfig server.Configuration,
+	config Configuration,
+	buildInfo *debug.BuildInfo,
+	modules []string,
+	profiles []string,
+) Summary {
+	summary := Summary{
+		Name:         md.Name,
+		Version:      md.Version,
+		Environment:  md.Environment,
+		GitSHA:       envutils.GetEnvVarOrDefault(gitSHAEnvVar, ""),
+		Profiles:     profiles,
+		Modules:      modules,
+		Dependencies: map[string]string{},
+	}
+	if summary.Profiles == nil {
+		summary.Profiles = []string{}
+	}
+	if summary.Modules == nil {
+		summary.Modules = []string{}
+	}
+
+	if serverConfig.HTTP.Port != 0 {
+		summary.Ports = map[string]uint32{"http": serverConfig.HTTP.Port, "management": serverConfig.HTTP.Port}
+		// without a management port the management endpoints are served by the http server
+		if serverConfig.Management.Port != 0 {
+			summary.Ports["management"] = serverConfig.Management.Port
+		}
+	}
+
+	if buildInfo == nil {
+		return summary
+	}
+	summary.GoVersion = buildInfo.GoVersion
+	if summary.GitSHA == "" {
+		summary.GitSHA = gitSHA(buildInfo)
+	}
+
+	prefixes := config.Dependencies
+	if len(prefixes) == 0 {
+		prefixes = []string{defaultDependencyPrefix}
+	}
+	for _, dep := range buildInfo.Deps {
+		for _, prefix := range prefixes {
+			if !strings.HasPrefix(dep.Path, prefix) {
+				continue
+			}
+			version := dep.Version
+			if dep.Replace != nil {
+				version = dep.Replace.Path + "@" + dep.Replace.Version
+			}
+			summary.Dependencies[dep.Path] = version
+			break
+		}
+	}
+	return summary
+}
+
+// gitSHA the revision the binary was built from, suffixed with -dirty when the working tree had changes
+func gitSHA(buildInfo *debug.BuildInfo) string {
+	settings := map[string]string{}
+	for _, s := range buildInfo.Settings {
+		settings[s.Key] = s.Value
+	}
+	revision := settings["vcs.revision"]
+	if revision != "" && settings["vcs.modified"] == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
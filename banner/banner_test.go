@@ -0,0 +1,73 @@
+package banner
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/armory-io/go-commons/http"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/server"
+	"github.com/stretchr/testify/assert"
+)
+
+var buildInfo = &debug.BuildInfo{
+	GoVersion: "go1.20.5",
+	Deps: []*debug.Module{
+		{Path: "github.com/armory-io/go-commons", Version: "v0.0.0-20230601"},
+		{Path: "github.com/armory-io/lib", Version: "v1.0.0", Replace: &debug.Module{Path: "../lib"}},
+		{Path: "go.uber.org/fx", Version: "v1.17.1"},
+	},
+	Settings: []debug.BuildSetting{
+		{Key: "vcs.revision", Value: "5bcaf07"},
+		{Key: "vcs.modified", Value: "true"},
+	},
+}
+
+func TestSummarize(t *testing.T) {
+	t.Setenv(gitSHAEnvVar, "")
+	md := metadata.ApplicationMetadata{Name: "cloud-api", Version: "1.2.3", Environment: "staging"}
+	serverConfig := server.Configuration{HTTP: http.HTTP{Port: 3000}, Management: http.HTTP{Port: 3001}}
+
+	summary := summarize(md, serverConfig, Configuration{}, buildInfo, []string{"sql", "tenancy"}, []string{"prod"})
+
+	assert.Equal(t, Summary{
+		Name:        "cloud-api",
+		Version:     "1.2.3",
+		Environment: "staging",
+		GitSHA:      "5bcaf07-dirty",
+		GoVersion:   "go1.20.5",
+		Profiles:    []string{"prod"},
+		Ports:       map[string]uint32{"http": 3000, "management": 3001},
+		Modules:     []string{"sql", "tenancy"},
+		Dependencies: map[string]string{
+			"github.com/armory-io/go-commons": "v0.0.0-20230601",
+			"github.com/armory-io/lib":        "../lib@",
+		},
+	}, summary)
+}
+
+func TestSummarizeDefaults(t *testing.T) {
+	t.Setenv(gitSHAEnvVar, "abc123")
+	serverConfig := server.Configuration{HTTP: http.HTTP{Port: 3000}}
+
+	summary := summarize(metadata.ApplicationMetadata{}, serverConfig, Configuration{Dependencies: []string{"go.uber.org/"}}, buildInfo, nil, nil)
+
+	assert.Equal(t, "abc123", summary.GitSHA, "the env var takes precedence over the build info")
+	assert.Equal(t, map[string]uint32{"http": 3000, "management": 3000}, summary.Ports)
+	assert.Equal(t, map[string]string{"go.uber.org/fx": "v1.17.1"}, summary.Dependencies)
+	assert.Empty(t, summary.Profiles)
+	assert.NotNil(t, summary.Modules)
+
+	assert.Nil(t, summarize(metadata.ApplicationMetadata{}, server.Configuration{}, Configuration{}, nil, nil, nil).Ports)
+}
+
+func TestContribute(t *testing.T) {
+	is := &info.InfoService{}
+	c := &contributor{}
+	is.AddInfoContributor(c)
+	assert.NotContains(t, *is.GetInfoContent(), "startup", "nothing is contributed before the application starts")
+
+	c.summary = &Summary{Name: "cloud-api"}
+	assert.Equal(t, c.summary, (*is.GetInfoContent())["startup"])
+}
@@ -0,0 +1,451 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-retryablehttp"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureAPIVersion     = "2020-12-06"
+	azureBlockSize      = 4 << 20
+	azureMetadataPrefix = "x-ms-meta-"
+	azureSASTimeFormat  = "2006-01-02T15:04:05Z"
+)
+
+type (
+	// azureStore talks to the Azure Blob Storage REST API directly using shared key authorization
+	azureStore struct {
+		client     *http.Client
+		endpoint   *url.URL
+		account    string
+		key        []byte
+		container  string
+		encryption Encryption
+	}
+
+	azureListResponse struct {
+		Blobs struct {
+			Blob []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+					ContentType   string `xml:"Content-Type"`
+					Etag          string `xml:"Etag"`
+				} `xml:"Properties"`
+			} `xml:"Blob"`
+		} `xml:"Blobs"`
+		NextMarker string `xml:"NextMarker"`
+	}
+
+	azureBlockList struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+
+	logAdapter struct {
+		*zap.SugaredLogger
+	}
+)
+
+func newAzureStore(c Configuration, log *zap.SugaredLogger) (Store, error) {
+	if c.Azure.AccountName == "" {
+		return nil, errors.New("blob.azure.accountName is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(c.Azure.AccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("blob.azure.accountKey must be base64 encoded: %w", err)
+	}
+	if c.Encryption.Mode == EncryptionCustomer {
+		if _, err := decodeCustomerKey(c.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	rawEndpoint := c.Azure.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://%s.blob.core.windows.net", c.Azure.AccountName)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(rawEndpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob.azure.endpoint: %w", err)
+	}
+
+	retryMax := c.Azure.MaxRetryAttempts
+	if retryMax <= 0 {
+		retryMax = 3
+	}
+	rc := &retryablehttp.Client{
+		HTTPClient:   cleanhttp.DefaultPooledClient(),
+		Logger:       &logAdapter{SugaredLogger: log},
+		RetryWaitMin: 100 * time.Millisecond,
+		RetryWaitMax: 2 * time.Second,
+		RetryMax:     retryMax,
+		CheckRetry:   retryablehttp.DefaultRetryPolicy,
+		Backoff:      retryablehttp.DefaultBackoff,
+	}
+
+	return &azureStore{
+		client:     rc.StandardClient(),
+		endpoint:   endpoint,
+		account:    c.Azure.AccountName,
+		key:        key,
+		container:  c.Bucket,
+		encryption: c.Encryption,
+	}, nil
+}
+
+func (la *logAdapter) Printf(msg string, args ...any) {
+	la.Debugf(msg, args...)
+}
+
+func (a *azureStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	contentType, body := resolveContentType(key, opts.ContentType, body)
+
+	headers := http.Header{}
+	headers.Set("x-ms-blob-content-type", contentType)
+	for k, v := range opts.Metadata {
+		headers.Set(azureMetadataPrefix+k, v)
+	}
+
+	block, eof, err := readChunk(body, azureBlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *http.Response
+	size := int64(len(block))
+	if eof {
+		headers.Set("x-ms-blob-type", "BlockBlob")
+		res, err = a.do(ctx, http.MethodPut, a.blobPath(key), nil, headers, block)
+	} else {
+		var ids []string
+		for i := 0; len(block) > 0; i++ {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+			blockRes, err := a.do(ctx, http.MethodPut, a.blobPath(key), url.Values{"comp": {"block"}, "blockid": {id}}, http.Header{}, block)
+			if err != nil {
+				return nil, err
+			}
+			_ = blockRes.Body.Close()
+			ids = append(ids, id)
+
+			if eof {
+				break
+			}
+			if block, eof, err = readChunk(body, azureBlockSize); err != nil {
+				return nil, err
+			}
+			size += int64(len(block))
+		}
+		list, err := xml.Marshal(azureBlockList{Latest: ids})
+		if err != nil {
+			return nil, err
+		}
+		res, err = a.do(ctx, http.MethodPut, a.blobPath(key), url.Values{"comp": {"blocklist"}}, headers, append([]byte(xml.Header), list...))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ContentType:  contentType,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: lastModified,
+		Metadata:     opts.Metadata,
+	}, nil
+}
+
+func (a *azureStore) Get(ctx context.Context, key string) (*Object, error) {
+	return a.GetRange(ctx, key, ByteRange{})
+}
+
+func (a *azureStore) GetRange(ctx context.Context, key string, r ByteRange) (*Object, error) {
+	headers := http.Header{}
+	if header := r.header(); header != "" {
+		headers.Set("x-ms-range", header)
+	}
+	res, err := a.do(ctx, http.MethodGet, a.blobPath(key), nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		ObjectInfo: a.objectInfo(key, res.Header),
+		Body:       res.Body,
+	}, nil
+}
+
+func (a *azureStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	res, err := a.do(ctx, http.MethodHead, a.blobPath(key), nil, http.Header{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = res.Body.Close()
+	info := a.objectInfo(key, res.Header)
+	return &info, nil
+}
+
+func (a *azureStore) objectInfo(key string, header http.Header) ObjectInfo {
+	contentLength, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	lastModified, _ := http.ParseTime(header.Get("Last-Modified"))
+	metadata := map[string]string{}
+	for k := range header {
+		if name, ok := cutPrefixFold(k, azureMetadataPrefix); ok {
+			metadata[name] = header.Get(k)
+		}
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         objectSize(header.Get("Content-Range"), contentLength),
+		ContentType:  header.Get("Content-Type"),
+		ETag:         header.Get("ETag"),
+		LastModified: lastModified,
+		Metadata:     metadata,
+	}
+}
+
+func (a *azureStore) List(ctx context.Context, opts ListOptions) (*ListResult, error) {
+	query := url.Values{
+		"restype":    {"container"},
+		"comp":       {"list"},
+		"maxresults": {strconv.Itoa(opts.limit())},
+	}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Cursor != "" {
+		query.Set("marker", opts.Cursor)
+	}
+
+	res, err := a.do(ctx, http.MethodGet, "/"+a.container, query, http.Header{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var list azureListResponse
+	if err := xml.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{NextCursor: list.NextMarker}
+	for _, b := range list.Blobs.Blob {
+		lastModified, _ := http.ParseTime(b.Properties.LastModified)
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          b.Name,
+			Size:         b.Properties.ContentLength,
+			ContentType:  b.Properties.ContentType,
+			ETag:         b.Properties.Etag,
+			LastModified: lastModified,
+		})
+	}
+	return result, nil
+}
+
+// SignedURL creates a service SAS for the blob, see https://learn.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (a *azureStore) SignedURL(_ context.Context, key string, opts SignedURLOptions) (string, error) {
+	var permissions string
+	switch opts.method() {
+	case http.MethodGet, http.MethodHead:
+		permissions = "r"
+	case http.MethodPut:
+		permissions = "cw"
+	case http.MethodDelete:
+		permissions = "d"
+	default:
+		return "", fmt.Errorf("signed urls do not support method %s", opts.method())
+	}
+
+	expiry := time.Now().UTC().Add(opts.expires()).Format(azureSASTimeFormat)
+	protocol := "https"
+	if a.endpoint.Scheme != "https" {
+		protocol = "https,http"
+	}
+	scope := ""
+	if a.encryption.Mode == EncryptionKMS {
+		scope = a.encryption.KMSKeyID
+	}
+
+	stringToSign := strings.Join([]string{
+		permissions,
+		"", // signed start
+		expiry,
+		fmt.Sprintf("/blob/%s/%s/%s", a.account, a.container, key),
+		"", // signed identifier
+		"", // signed ip
+		protocol,
+		azureAPIVersion,
+		"b", // signed resource
+		"",  // signed snapshot time
+		scope,
+		"", "", "", "", "", // response header overrides
+	}, "\n")
+
+	query := url.Values{
+		"sv":  {azureAPIVersion},
+		"sr":  {"b"},
+		"sp":  {permissions},
+		"se":  {expiry},
+		"spr": {protocol},
+		"sig": {a.sign(stringToSign)},
+	}
+	if scope != "" {
+		query.Set("ses", scope)
+	}
+
+	u := *a.endpoint
+	u.Path += a.blobPath(key)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (a *azureStore) blobPath(key string) string {
+	return fmt.Sprintf("/%s/%s", a.container, key)
+}
+
+func (a *azureStore) do(ctx context.Context, method string, path string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u := *a.endpoint
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	a.applyEncryption(method, query, req.Header)
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.account, a.sign(a.stringToSign(req))))
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound && (method == http.MethodGet || method == http.MethodHead) && query.Get("comp") == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, strings.TrimPrefix(path, "/"+a.container+"/"))
+	}
+	errorBodyBytes, _ := io.ReadAll(res.Body)
+	return nil, fmt.Errorf("azure blob request failed, status code: '%d', body: '%s'", res.StatusCode, string(errorBodyBytes))
+}
+
+func (a *azureStore) applyEncryption(method string, query url.Values, headers http.Header) {
+	switch a.encryption.Mode {
+	case EncryptionKMS:
+		// encryption scopes only apply to writes
+		if method == http.MethodPut && a.encryption.KMSKeyID != "" {
+			headers.Set("x-ms-encryption-scope", a.encryption.KMSKeyID)
+		}
+	case EncryptionCustomer:
+		// listing blobs does not accept customer provided keys
+		if query.Get("restype") == "container" {
+			return
+		}
+		// validated when the store was created
+		key, _ := decodeCustomerKey(a.encryption)
+		sum := sha256.Sum256(key)
+		headers.Set("x-ms-encryption-key", a.encryption.CustomerKey)
+		headers.Set("x-ms-encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		headers.Set("x-ms-encryption-algorithm", "AES256")
+	}
+}
+
+// stringToSign builds the shared key signature payload, see https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (a *azureStore) stringToSign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var canonicalHeaders []string
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-ms-") {
+			canonicalHeaders = append(canonicalHeaders, fmt.Sprintf("%s:%s\n", name, strings.TrimSpace(strings.Join(v, ","))))
+		}
+	}
+	slices.Sort(canonicalHeaders)
+
+	var resource strings.Builder
+	resource.WriteString("/" + a.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	names := maps.Keys(query)
+	slices.Sort(names)
+	for _, name := range names {
+		values := query[name]
+		slices.Sort(values)
+		resource.WriteString(fmt.Sprintf("\n%s:%s", strings.ToLower(name), strings.Join(values, ",")))
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(canonicalHeaders, "") + resource.String(),
+	}, "\n")
+}
+
+func (a *azureStore) sign(stringToSign string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.ToLower(s[len(prefix):]), true
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package blob provides a provider agnostic object storage client with S3, GCS and Azure Blob Storage implementations.
+//
+// Credentials are read from the Configuration, so any value can be an encrypted secret that typesafeconfig resolves, e.g.
+//
+//	blob:
+//	  provider: s3
+//	  bucket: my-bucket
+//	  s3:
+//	    region: us-west-2
+//	    accessKeyId: encrypted:secrets-manager!r:us-west-2!s:my-secret!k:accessKeyId
+//	    secretAccessKey: encrypted:secrets-manager!r:us-west-2!s:my-secret!k:secretAccessKey
+package blob
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	armorys3 "github.com/armory-io/go-commons/s3"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProviderS3    = "s3"
+	ProviderGCS   = "gcs"
+	ProviderAzure = "azure"
+
+	// EncryptionManaged encrypts objects with keys managed by the storage provider (SSE-S3, Google-managed keys, Microsoft-managed keys)
+	EncryptionManaged EncryptionMode = "managed"
+	// EncryptionKMS encrypts objects with the key identified by Encryption.KMSKeyID (SSE-KMS, Cloud KMS, Azure encryption scope)
+	EncryptionKMS EncryptionMode = "kms"
+	// EncryptionCustomer encrypts objects with the base64 encoded AES-256 key in Encryption.CustomerKey (SSE-C, CSEK, CPK)
+	EncryptionCustomer EncryptionMode = "customer"
+
+	defaultSignedURLExpiry = 15 * time.Minute
+	defaultListLimit       = 1000
+)
+
+var (
+	ErrNotFound            = errors.New("blob not found")
+	ErrUnsupportedProvider = errors.New("unsupported blob provider")
+)
+
+type (
+	// Store a provider agnostic object storage client
+	Store interface {
+		// Put streams body to the object stored at key, the body is read until io.EOF and large bodies are uploaded in parts
+		Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*ObjectInfo, error)
+		// Get opens a streaming reader for the object stored at key, callers must close Object.Body.
+		// Returns ErrNotFound if the object does not exist
+		Get(ctx context.Context, key string) (*Object, error)
+		// GetRange opens a streaming reader for a byte range of the object stored at key, callers must close Object.Body.
+		// Object.Size is always the size of the whole object. Returns ErrNotFound if the object does not exist
+		GetRange(ctx context.Context, key string, r ByteRange) (*Object, error)
+		// Stat returns the ObjectInfo of the object stored at key without reading its content.
+		// Returns ErrNotFound if the object does not exist
+		Stat(ctx context.Context, key string) (*ObjectInfo, error)
+		// List returns a page of objects, use ListResult.NextCursor to request the following page
+		List(ctx context.Context, opts ListOptions) (*ListResult, error)
+		// SignedURL returns a time limited URL that grants access to the object stored at key without credentials
+		SignedURL(ctx context.Context, key string, opts SignedURLOptions) (string, error)
+	}
+
+	Configuration struct {
+		// Provider one of s3, gcs or azure
+		Provider string
+		// Bucket the bucket, or container for azure, that objects are stored in
+		Bucket     string
+		S3         armorys3.Configuration
+		GCS        GCSConfiguration
+		Azure      AzureConfiguration
+		Encryption Encryption
+	}
+
+	GCSConfiguration struct {
+		// CredentialsJSON optional service account key, when not set application default credentials are used
+		CredentialsJSON string
+	}
+
+	AzureConfiguration struct {
+		AccountName string
+		// AccountKey the base64 encoded shared key of the storage account
+		AccountKey string
+		// Endpoint overrides the blob service endpoint, defaults to https://<AccountName>.blob.core.windows.net
+		Endpoint         string
+		MaxRetryAttempts int
+	}
+
+	EncryptionMode string
+
+	// Encryption server side encryption options applied to every object written and read by the Store
+	Encryption struct {
+		Mode EncryptionMode
+		// KMSKeyID the KMS key ARN/id for s3, the Cloud KMS key name for gcs or the encryption scope for azure
+		KMSKeyID string
+		// CustomerKey a base64 encoded AES-256 key, required when Mode is customer
+		CustomerKey string
+	}
+
+	PutOptions struct {
+		// ContentType if not set it is inferred from the key's extension, then by sniffing the first 512 bytes of the body
+		ContentType string
+		// Metadata user defined metadata stored with the object
+		Metadata map[string]string
+	}
+
+	ListOptions struct {
+		Prefix string
+		// Cursor the NextCursor of a previous ListResult
+		Cursor string
+		// Limit the max number of objects per page, defaults to 1000
+		Limit int
+	}
+
+	ListResult struct {
+		Objects    []ObjectInfo
+		NextCursor string
+	}
+
+	SignedURLOptions struct {
+		// Method the HTTP method the URL is valid for, defaults to GET
+		Method string
+		// Expires how long the URL is valid for, defaults to 15 minutes
+		Expires time.Duration
+	}
+
+	ByteRange struct {
+		Offset int64
+		// Length the number of bytes to read, a value <= 0 reads until the end of the object
+		Length int64
+	}
+
+	ObjectInfo struct {
+		Key          string
+		Size         int64
+		ContentType  string
+		ETag         string
+		LastModified time.Time
+		Metadata     map[string]string
+	}
+
+	Object struct {
+		ObjectInfo
+		Body io.ReadCloser
+	}
+)
+
+// New creates a Store for the configured provider
+func New(ctx context.Context, c Configuration, log *zap.SugaredLogger) (Store, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("blob.bucket is required")
+	}
+	switch strings.ToLower(c.Provider) {
+	case ProviderS3:
+		return newS3Store(ctx, c, log)
+	case ProviderGCS:
+		return newGCSStore(ctx, c)
+	case ProviderAzure:
+		return newAzureStore(c, log)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProvider, c.Provider)
+	}
+}
+
+var Module = fx.Module("blob", fx.Provide(New))
+
+func (o SignedURLOptions) method() string {
+	if o.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(o.Method)
+}
+
+func (o SignedURLOptions) expires() time.Duration {
+	if o.Expires <= 0 {
+		return defaultSignedURLExpiry
+	}
+	return o.Expires
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultListLimit
+	}
+	return o.Limit
+}
+
+// header formats the range as an HTTP Range header value, or an empty string when the whole object is requested
+func (r ByteRange) header() string {
+	switch {
+	case r.Offset <= 0 && r.Length <= 0:
+		return ""
+	case r.Length <= 0:
+		return fmt.Sprintf("bytes=%d-", r.Offset)
+	default:
+		return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+	}
+}
+
+// objectSize extracts the complete object size from a Content-Range response header, i.e. bytes 0-9/100
+func objectSize(contentRange string, contentLength int64) int64 {
+	_, total, found := strings.Cut(contentRange, "/")
+	if !found {
+		return contentLength
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return contentLength
+	}
+	return size
+}
+
+// resolveContentType determines the content type of the body without consuming it, the returned reader must be used in place of body
+func resolveContentType(key string, contentType string, body io.Reader) (string, io.Reader) {
+	if contentType != "" {
+		return contentType, body
+	}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct, body
+	}
+	buffered := bufio.NewReaderSize(body, 512)
+	// Peek returns what is available alongside io.EOF for small bodies, which is still enough to sniff
+	sniff, _ := buffered.Peek(512)
+	return http.DetectContentType(sniff), buffered
+}
+
+// readChunk reads up to size bytes from r, eof is true when r has no more data after the returned chunk
+func readChunk(r io.Reader, size int) ([]byte, bool, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return buf[:n], true, nil
+	case err != nil:
+		return nil, false, err
+	}
+	return buf, false, nil
+}
+
+func decodeCustomerKey(e Encryption) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(e.CustomerKey)
+	if err != nil {
+		return nil, fmt.Errorf("blob.encryption.customerKey must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("blob.encryption.customerKey must be a 256 bit key, got %d bits", len(key)*8)
+	}
+	return key, nil
+}
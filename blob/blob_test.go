@@ -0,0 +1,244 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResolveContentType(t *testing.T) {
+	cases := map[string]struct {
+		key         string
+		contentType string
+		body        string
+		expected    string
+	}{
+		"explicit content type wins": {
+			key:         "data.json",
+			contentType: "application/x-custom",
+			body:        "{}",
+			expected:    "application/x-custom",
+		},
+		"inferred from extension": {
+			key:      "data.json",
+			body:     "{}",
+			expected: "application/json",
+		},
+		"sniffed from body": {
+			key:      "no-extension",
+			body:     "<html><body>hi</body></html>",
+			expected: "text/html; charset=utf-8",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			ct, body := resolveContentType(c.key, c.contentType, strings.NewReader(c.body))
+			assert.Equal(t, c.expected, ct)
+
+			read, err := io.ReadAll(body)
+			assert.NoError(t, err)
+			assert.Equal(t, c.body, string(read), "the body should not be consumed")
+		})
+	}
+}
+
+func TestReadChunk(t *testing.T) {
+	r := strings.NewReader("abcdefg")
+
+	chunk, eof, err := readChunk(r, 4)
+	assert.NoError(t, err)
+	assert.False(t, eof)
+	assert.Equal(t, "abcd", string(chunk))
+
+	chunk, eof, err = readChunk(r, 4)
+	assert.NoError(t, err)
+	assert.True(t, eof)
+	assert.Equal(t, "efg", string(chunk))
+}
+
+func TestDecodeCustomerKey(t *testing.T) {
+	_, err := decodeCustomerKey(Encryption{CustomerKey: "not base64!"})
+	assert.Error(t, err)
+
+	_, err = decodeCustomerKey(Encryption{CustomerKey: base64.StdEncoding.EncodeToString([]byte("too short"))})
+	assert.ErrorContains(t, err, "256 bit")
+
+	key, err := decodeCustomerKey(Encryption{CustomerKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))})
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+}
+
+func TestByteRangeHeader(t *testing.T) {
+	assert.Equal(t, "", ByteRange{}.header())
+	assert.Equal(t, "bytes=10-", ByteRange{Offset: 10}.header())
+	assert.Equal(t, "bytes=10-19", ByteRange{Offset: 10, Length: 10}.header())
+	assert.Equal(t, int64(100), objectSize("bytes 0-9/100", 10))
+	assert.Equal(t, int64(10), objectSize("", 10))
+}
+
+func TestNewUnsupportedProvider(t *testing.T) {
+	_, err := New(context.Background(), Configuration{Provider: "ftp", Bucket: "bucket"}, zap.S())
+	assert.ErrorIs(t, err, ErrUnsupportedProvider)
+}
+
+// fakeAzure a minimal in memory implementation of the Azure Blob Storage REST API
+type fakeAzure struct {
+	t      *testing.T
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	types  map[string]string
+	blocks map[string][]byte
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	assert.True(f.t, strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey account:"))
+	assert.Equal(f.t, azureAPIVersion, r.Header.Get("x-ms-version"))
+
+	name := strings.TrimPrefix(r.URL.Path, "/container/")
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		f.blocks[query.Get("blockid")] = body
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list azureBlockList
+		assert.NoError(f.t, xml.Unmarshal(body, &list))
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, f.blocks[id]...)
+		}
+		f.blobs[name] = blob
+		f.types[name] = r.Header.Get("x-ms-blob-content-type")
+	case r.Method == http.MethodPut:
+		assert.Equal(f.t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+		f.blobs[name] = body
+		f.types[name] = r.Header.Get("x-ms-blob-content-type")
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet && query.Get("comp") == "list":
+		_, _ = fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+		for n, b := range f.blobs {
+			if strings.HasPrefix(n, query.Get("prefix")) {
+				_, _ = fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length></Properties></Blob>`, n, len(b))
+			}
+		}
+		_, _ = fmt.Fprint(w, `</Blobs><NextMarker /></EnumerationResults>`)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		blob, ok := f.blobs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[name])
+		w.Header().Set("x-ms-meta-owner", "armory")
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end); err == nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(blob)))
+			w.WriteHeader(http.StatusPartialContent)
+			blob = blob[start : end+1]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		_, _ = w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newFakeAzureStore(t *testing.T) Store {
+	s := httptest.NewServer(&fakeAzure{t: t, blobs: map[string][]byte{}, types: map[string]string{}, blocks: map[string][]byte{}})
+	t.Cleanup(s.Close)
+
+	store, err := New(context.Background(), Configuration{
+		Provider: ProviderAzure,
+		Bucket:   "container",
+		Azure: AzureConfiguration{
+			AccountName:      "account",
+			AccountKey:       base64.StdEncoding.EncodeToString([]byte("secret")),
+			Endpoint:         s.URL,
+			MaxRetryAttempts: 1,
+		},
+	}, zap.S())
+	assert.NoError(t, err)
+	return store
+}
+
+func TestAzureStore(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeAzureStore(t)
+
+	info, err := store.Put(ctx, "small/config.json", strings.NewReader(`{"hello":"world"}`), PutOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(17), info.Size)
+	assert.Equal(t, "application/json", info.ContentType)
+
+	large := bytes.Repeat([]byte("a"), azureBlockSize*2+10)
+	info, err = store.Put(ctx, "large/blob", bytes.NewReader(large), PutOptions{ContentType: "application/octet-stream"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(large)), info.Size)
+
+	obj, err := store.Get(ctx, "large/blob")
+	assert.NoError(t, err)
+	read, err := io.ReadAll(obj.Body)
+	assert.NoError(t, err)
+	_ = obj.Body.Close()
+	assert.Equal(t, large, read)
+	assert.Equal(t, "application/octet-stream", obj.ContentType)
+	assert.Equal(t, map[string]string{"owner": "armory"}, obj.Metadata)
+
+	_, err = store.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.Stat(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	stat, err := store.Stat(ctx, "small/config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(17), stat.Size)
+
+	obj, err = store.GetRange(ctx, "small/config.json", ByteRange{Offset: 2, Length: 5})
+	assert.NoError(t, err)
+	read, err = io.ReadAll(obj.Body)
+	assert.NoError(t, err)
+	_ = obj.Body.Close()
+	assert.Equal(t, "hello", string(read))
+	assert.Equal(t, int64(17), obj.Size, "size should be the size of the whole object")
+
+	list, err := store.List(ctx, ListOptions{Prefix: "small/"})
+	assert.NoError(t, err)
+	assert.Len(t, list.Objects, 1)
+	assert.Equal(t, "small/config.json", list.Objects[0].Key)
+	assert.Empty(t, list.NextCursor)
+}
+
+func TestAzureSignedURL(t *testing.T) {
+	store := newFakeAzureStore(t)
+
+	signed, err := store.SignedURL(context.Background(), "path/to/blob", SignedURLOptions{})
+	assert.NoError(t, err)
+
+	u, err := url.Parse(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "/container/path/to/blob", u.Path)
+	assert.Equal(t, "r", u.Query().Get("sp"))
+	assert.Equal(t, "b", u.Query().Get("sr"))
+	assert.NotEmpty(t, u.Query().Get("sig"))
+
+	_, err = store.SignedURL(context.Background(), "path/to/blob", SignedURLOptions{Method: http.MethodPatch})
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package blob
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/samber/lo"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
+	"time"
+)
+
+type gcsStore struct {
+	client     *storage.Client
+	bucket     *storage.BucketHandle
+	encryption Encryption
+}
+
+func newGCSStore(ctx context.Context, c Configuration) (Store, error) {
+	var opts []option.ClientOption
+	if c.GCS.CredentialsJSON != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(c.GCS.CredentialsJSON)))
+	}
+	if c.Encryption.Mode == EncryptionCustomer {
+		if _, err := decodeCustomerKey(c.Encryption); err != nil {
+			return nil, err
+		}
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCS client: %w", err)
+	}
+	return &gcsStore{
+		client:     client,
+		bucket:     client.Bucket(c.Bucket),
+		encryption: c.Encryption,
+	}, nil
+}
+
+func (g *gcsStore) object(key string) *storage.ObjectHandle {
+	o := g.bucket.Object(key)
+	if g.encryption.Mode == EncryptionCustomer {
+		// validated when the store was created
+		customerKey, _ := decodeCustomerKey(g.encryption)
+		o = o.Key(customerKey)
+	}
+	return o
+}
+
+func (g *gcsStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	contentType, body := resolveContentType(key, opts.ContentType, body)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := g.object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Metadata = opts.Metadata
+	if g.encryption.Mode == EncryptionKMS {
+		w.KMSKeyName = g.encryption.KMSKeyID
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		// cancelling the context before Close aborts the upload
+		cancel()
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	attrs := w.Attrs()
+	return &ObjectInfo{
+		Key:          key,
+		Size:         attrs.Size,
+		ContentType:  attrs.ContentType,
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+		Metadata:     attrs.Metadata,
+	}, nil
+}
+
+func (g *gcsStore) Get(ctx context.Context, key string) (*Object, error) {
+	return g.GetRange(ctx, key, ByteRange{})
+}
+
+func (g *gcsStore) GetRange(ctx context.Context, key string, br ByteRange) (*Object, error) {
+	length := br.Length
+	if length <= 0 {
+		length = -1
+	}
+	r, err := g.object(key).NewRangeReader(ctx, br.Offset, length)
+	if err != nil {
+		return nil, g.mapError(key, err)
+	}
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:          key,
+			Size:         r.Attrs.Size,
+			ContentType:  r.Attrs.ContentType,
+			LastModified: r.Attrs.LastModified,
+		},
+		Body: r,
+	}, nil
+}
+
+func (g *gcsStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	attrs, err := g.object(key).Attrs(ctx)
+	if err != nil {
+		return nil, g.mapError(key, err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         attrs.Size,
+		ContentType:  attrs.ContentType,
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+		Metadata:     attrs.Metadata,
+	}, nil
+}
+
+func (g *gcsStore) List(ctx context.Context, opts ListOptions) (*ListResult, error) {
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: opts.Prefix})
+	var attrs []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, opts.limit(), opts.Cursor).NextPage(&attrs)
+	if err != nil {
+		return nil, err
+	}
+	return &ListResult{
+		Objects: lo.Map(attrs, func(a *storage.ObjectAttrs, _ int) ObjectInfo {
+			return ObjectInfo{
+				Key:          a.Name,
+				Size:         a.Size,
+				ContentType:  a.ContentType,
+				ETag:         a.Etag,
+				LastModified: a.Updated,
+				Metadata:     a.Metadata,
+			}
+		}),
+		NextCursor: next,
+	}, nil
+}
+
+func (g *gcsStore) SignedURL(_ context.Context, key string, opts SignedURLOptions) (string, error) {
+	return g.bucket.SignedURL(key, &storage.SignedURLOptions{
+		Method:  opts.method(),
+		Expires: time.Now().Add(opts.expires()),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+func (g *gcsStore) mapError(key string, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	armorys3 "github.com/armory-io/go-commons/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+// s3PartSize is the minimum part size S3 accepts for multipart uploads
+const s3PartSize = 5 << 20
+
+type s3Store struct {
+	client     *s3.Client
+	bucket     string
+	encryption Encryption
+	log        *zap.SugaredLogger
+}
+
+func newS3Store(ctx context.Context, c Configuration, log *zap.SugaredLogger) (Store, error) {
+	client, err := armorys3.New(ctx, c.S3, log)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client:     client,
+		bucket:     c.Bucket,
+		encryption: c.Encryption,
+		log:        log,
+	}, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	contentType, body := resolveContentType(key, opts.ContentType, body)
+
+	part, eof, err := readChunk(body, s3PartSize)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ObjectInfo{
+		Key:         key,
+		ContentType: contentType,
+		Metadata:    opts.Metadata,
+	}
+
+	if eof {
+		input := &s3.PutObjectInput{
+			Bucket:        &s.bucket,
+			Key:           &key,
+			Body:          bytes.NewReader(part),
+			ContentLength: int64(len(part)),
+			ContentType:   &contentType,
+			Metadata:      opts.Metadata,
+		}
+		if err := s.applyPutEncryption(input); err != nil {
+			return nil, err
+		}
+		out, err := s.client.PutObject(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		info.Size = int64(len(part))
+		info.ETag = lo.FromPtr(out.ETag)
+		return info, nil
+	}
+
+	size, etag, err := s.multipartUpload(ctx, key, contentType, opts.Metadata, part, body)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = size
+	info.ETag = etag
+	return info, nil
+}
+
+func (s *s3Store) multipartUpload(ctx context.Context, key string, contentType string, metadata map[string]string, first []byte, body io.Reader) (int64, string, error) {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		ContentType: &contentType,
+		Metadata:    metadata,
+	}
+	if err := s.applyCreateMultipartEncryption(createInput); err != nil {
+		return 0, "", err
+	}
+	upload, err := s.client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return 0, "", err
+	}
+
+	abort := func(cause error) (int64, string, error) {
+		if _, err := s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   &s.bucket,
+			Key:      &key,
+			UploadId: upload.UploadId,
+		}); err != nil {
+			s.log.Warnf("failed to abort multipart upload for %s: %s", key, err)
+		}
+		return 0, "", cause
+	}
+
+	var (
+		parts []types.CompletedPart
+		size  int64
+		part  = first
+		eof   bool
+	)
+	for partNumber := int32(1); ; partNumber++ {
+		input := &s3.UploadPartInput{
+			Bucket:        &s.bucket,
+			Key:           &key,
+			UploadId:      upload.UploadId,
+			PartNumber:    partNumber,
+			Body:          bytes.NewReader(part),
+			ContentLength: int64(len(part)),
+		}
+		s.applyUploadPartEncryption(input)
+		out, err := s.client.UploadPart(ctx, input)
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: partNumber})
+		size += int64(len(part))
+
+		if eof {
+			break
+		}
+		if part, eof, err = readChunk(body, s3PartSize); err != nil {
+			return abort(err)
+		}
+		if len(part) == 0 {
+			break
+		}
+	}
+
+	out, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return size, lo.FromPtr(out.ETag), nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (*Object, error) {
+	return s.GetRange(ctx, key, ByteRange{})
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, r ByteRange) (*Object, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+	if header := r.header(); header != "" {
+		input.Range = &header
+	}
+	if s.encryption.Mode == EncryptionCustomer {
+		algorithm, customerKey, keyMD5, err := s.customerKey()
+		if err != nil {
+			return nil, err
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = algorithm, customerKey, keyMD5
+	}
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, s.mapError(key, err)
+	}
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:          key,
+			Size:         objectSize(lo.FromPtr(out.ContentRange), out.ContentLength),
+			ContentType:  lo.FromPtr(out.ContentType),
+			ETag:         lo.FromPtr(out.ETag),
+			LastModified: lo.FromPtr(out.LastModified),
+			Metadata:     out.Metadata,
+		},
+		Body: out.Body,
+	}, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+	if s.encryption.Mode == EncryptionCustomer {
+		algorithm, customerKey, keyMD5, err := s.customerKey()
+		if err != nil {
+			return nil, err
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = algorithm, customerKey, keyMD5
+	}
+	out, err := s.client.HeadObject(ctx, input)
+	if err != nil {
+		return nil, s.mapError(key, err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         out.ContentLength,
+		ContentType:  lo.FromPtr(out.ContentType),
+		ETag:         lo.FromPtr(out.ETag),
+		LastModified: lo.FromPtr(out.LastModified),
+		Metadata:     out.Metadata,
+	}, nil
+}
+
+func (s *s3Store) List(ctx context.Context, opts ListOptions) (*ListResult, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &s.bucket,
+		MaxKeys: int32(opts.limit()),
+	}
+	if opts.Prefix != "" {
+		input.Prefix = &opts.Prefix
+	}
+	if opts.Cursor != "" {
+		input.ContinuationToken = &opts.Cursor
+	}
+	out, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	result := &ListResult{
+		Objects: lo.Map(out.Contents, func(o types.Object, _ int) ObjectInfo {
+			return ObjectInfo{
+				Key:          lo.FromPtr(o.Key),
+				Size:         o.Size,
+				ETag:         lo.FromPtr(o.ETag),
+				LastModified: lo.FromPtr(o.LastModified),
+			}
+		}),
+	}
+	if out.IsTruncated {
+		result.NextCursor = lo.FromPtr(out.NextContinuationToken)
+	}
+	return result, nil
+}
+
+func (s *s3Store) SignedURL(ctx context.Context, key string, opts SignedURLOptions) (string, error) {
+	presigner := s3.NewPresignClient(s.client, s3.WithPresignExpires(opts.expires()))
+	switch opts.method() {
+	case http.MethodGet:
+		req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+		if err != nil {
+			return "", err
+		}
+		return req.URL, nil
+	case http.MethodPut:
+		req, err := presigner.PresignPutObject(ctx, &s3.PutObjectInput{Bucket: &s.bucket, Key: &key})
+		if err != nil {
+			return "", err
+		}
+		return req.URL, nil
+	default:
+		return "", fmt.Errorf("signed urls do not support method %s", opts.method())
+	}
+}
+
+func (s *s3Store) applyPutEncryption(input *s3.PutObjectInput) error {
+	switch s.encryption.Mode {
+	case EncryptionManaged:
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	case EncryptionKMS:
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = s.kmsKeyID()
+	case EncryptionCustomer:
+		algorithm, key, keyMD5, err := s.customerKey()
+		if err != nil {
+			return err
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = algorithm, key, keyMD5
+	}
+	return nil
+}
+
+func (s *s3Store) applyCreateMultipartEncryption(input *s3.CreateMultipartUploadInput) error {
+	switch s.encryption.Mode {
+	case EncryptionManaged:
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	case EncryptionKMS:
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = s.kmsKeyID()
+	case EncryptionCustomer:
+		algorithm, key, keyMD5, err := s.customerKey()
+		if err != nil {
+			return err
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = algorithm, key, keyMD5
+	}
+	return nil
+}
+
+func (s *s3Store) applyUploadPartEncryption(input *s3.UploadPartInput) {
+	if s.encryption.Mode == EncryptionCustomer {
+		// the key was already validated when the upload was created
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5, _ = s.customerKey()
+	}
+}
+
+func (s *s3Store) kmsKeyID() *string {
+	if s.encryption.KMSKeyID == "" {
+		// fall back to the AWS managed aws/s3 key
+		return nil
+	}
+	return &s.encryption.KMSKeyID
+}
+
+func (s *s3Store) customerKey() (*string, *string, *string, error) {
+	raw, err := decodeCustomerKey(s.encryption)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sum := md5.Sum(raw)
+	return lo.ToPtr("AES256"), lo.ToPtr(s.encryption.CustomerKey), lo.ToPtr(base64.StdEncoding.EncodeToString(sum[:])), nil
+}
+
+func (s *s3Store) mapError(key string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
+}
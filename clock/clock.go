@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package clock puts the time package behind an interface, so that time dependent behaviour can be controlled in tests with a Fake.
+package clock
+
+import (
+	"go.uber.org/fx"
+	"time"
+)
+
+type (
+	// Clock the subset of the time package that reads the current time or waits on it
+	Clock interface {
+		Now() time.Time
+		Since(t time.Time) time.Duration
+		Until(t time.Time) time.Duration
+		After(d time.Duration) <-chan time.Time
+		Sleep(d time.Duration)
+		NewTimer(d time.Duration) Timer
+		NewTicker(d time.Duration) Ticker
+	}
+
+	// Timer see time.Timer
+	Timer interface {
+		C() <-chan time.Time
+		Stop() bool
+		Reset(d time.Duration) bool
+	}
+
+	// Ticker see time.Ticker
+	Ticker interface {
+		C() <-chan time.Time
+		Stop()
+		Reset(d time.Duration)
+	}
+
+	realClock struct{}
+
+	realTimer struct {
+		*time.Timer
+	}
+
+	realTicker struct {
+		*time.Ticker
+	}
+)
+
+// Module provides the real Clock, tests can replace it with fx.Replace(clock.NewFake(...))
+var Module = fx.Module("clock", fx.Provide(New))
+
+// New returns a Clock backed by the time package
+func New() Clock {
+	return realClock{}
+}
+
+// OrDefault returns c, or the real Clock when c is nil. Useful for optional fx dependencies
+func OrDefault(c Clock) Clock {
+	if c == nil {
+		return New()
+	}
+	return c
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) Until(t time.Time) time.Duration {
+	return time.Until(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
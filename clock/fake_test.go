@@ -0,0 +1,75 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeTimer(t *testing.T) {
+	c := NewFake(start)
+	timer := c.NewTimer(time.Minute)
+
+	c.Advance(59 * time.Second)
+	assert.Len(t, timer.C(), 0)
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-timer.C())
+	assert.False(t, timer.Stop(), "a fired timer can't be stopped")
+
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+	c.Advance(time.Hour)
+	assert.Len(t, timer.C(), 0)
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := NewFake(start)
+	ticker := c.NewTicker(10 * time.Second)
+
+	c.Advance(10 * time.Second)
+	assert.Equal(t, start.Add(10*time.Second), <-ticker.C())
+
+	// ticks are dropped while the receiver isn't reading
+	c.Advance(35 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C())
+	assert.Len(t, ticker.C(), 0)
+
+	c.Advance(5 * time.Second)
+	assert.Equal(t, start.Add(50*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	assert.Len(t, ticker.C(), 0)
+	assert.Equal(t, 0, c.Waiters())
+}
+
+func TestFakeSleep(t *testing.T) {
+	c := NewFake(start)
+	done := make(chan time.Time)
+	go func() {
+		c.Sleep(time.Hour)
+		done <- c.Now()
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(30 * time.Minute)
+	select {
+	case <-done:
+		t.Fatal("sleep returned before the clock reached its deadline")
+	default:
+	}
+
+	c.Set(start.Add(2 * time.Hour))
+	assert.Equal(t, start.Add(2*time.Hour), <-done)
+	assert.Equal(t, time.Hour, c.Since(start.Add(time.Hour)))
+}
+
+func TestOrDefault(t *testing.T) {
+	assert.Equal(t, New(), OrDefault(nil))
+	fake := NewFake(start)
+	assert.Same(t, fake, OrDefault(fake))
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package configsnapshot keeps the configuration of the last successful start, and logs what changed since then on the next
+// one, so operators can see which configuration change accompanied a bad deploy:
+//
+//	snapshot := &typesafeconfig.Snapshot{}
+//	config, err := typesafeconfig.ResolveConfiguration[Configuration](log, typesafeconfig.WithSnapshot(snapshot))
+//	...
+//	fx.New(
+//		fx.Supply(snapshot),
+//		application.ModuleV2,
+//		configsnapshot.Module,
+//	)
+//
+// The snapshot is saved once the hooks appended before the module's started, so it should come after the other modules.
+// Snapshots are kept in a file by default, provide a Store to keep them elsewhere, such as in a database
+package configsnapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/diff"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultFileName = "config-snapshot.json"
+
+type (
+	Configuration struct {
+		// File the file the snapshot of the last successful start is kept in, defaults to config-snapshot.json in the temporary directory
+		File string
+	}
+
+	// Record the snapshot of a successful start
+	Record struct {
+		Snapshot  typesafeconfig.Snapshot `json:"snapshot"`
+		Version   string                  `json:"version,omitempty"`
+		StartedAt time.Time               `json:"startedAt"`
+	}
+
+	// Store keeps the record of the last successful start
+	Store interface {
+		// Load the record of the last successful start, nil when there is none
+		Load(ctx context.Context) (*Record, error)
+		Save(ctx context.Context, record Record) error
+	}
+
+	// FileStore keeps the record in a JSON file
+	FileStore struct {
+		Path string
+	}
+
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Log       *zap.SugaredLogger
+		// Snapshot the snapshot recorded with typesafeconfig.WithSnapshot, nothing is kept without one
+		Snapshot *typesafeconfig.Snapshot     `optional:"true"`
+		Config   Configuration                `optional:"true"`
+		Store    Store                        `optional:"true"`
+		Metadata metadata.ApplicationMetadata `optional:"true"`
+		Clock    clock.Clock                  `optional:"true"`
+	}
+
+	// Recorder compares the configuration with the one of the last successful start and saves it once the application started
+	Recorder struct {
+		snapshot *typesafeconfig.Snapshot
+		previous *Record
+		changes  []diff.Change
+	}
+
+	infoDetail struct {
+		Hash string `json:"hash"`
+		// PreviousHash the hash of the configuration of the last successful start
+		PreviousHash    string        `json:"previousHash,omitempty"`
+		PreviousVersion string        `json:"previousVersion,omitempty"`
+		Changes         []diff.Change `json:"changes,omitempty"`
+	}
+)
+
+var Module = fx.Module(
+	"configsnapshot",
+	fx.Provide(New, InfoContributor),
+	fx.Invoke(func(*Recorder) {}),
+)
+
+// New logs the changes since the last successful start and saves the snapshot once the application started
+func New(p Parameters) *Recorder {
+	r := &Recorder{snapshot: p.Snapshot}
+	if p.Snapshot == nil {
+		p.Log.Warn("No configuration snapshot was provided, use typesafeconfig.WithSnapshot to record it")
+		return r
+	}
+
+	store := p.Store
+	if store == nil {
+		path := p.Config.File
+		if path == "" {
+			path = filepath.Join(os.TempDir(), defaultFileName)
+		}
+		store = &FileStore{Path: path}
+	}
+
+	previous, err := store.Load(context.Background())
+	switch {
+	case err != nil:
+		p.Log.Warnw("Failed to load the configuration snapshot of the last successful start", "error", err)
+	case previous == nil:
+		p.Log.Infow("No configuration snapshot of a previous successful start", "configHash", p.Snapshot.Hash)
+	case previous.Snapshot.Hash == p.Snapshot.Hash:
+		p.Log.Infow("Configuration unchanged since the last successful start", "configHash", p.Snapshot.Hash, "previousVersion", previous.Version)
+	default:
+		r.previous = previous
+		r.changes = p.Snapshot.Changes(&previous.Snapshot)
+		p.Log.Warnw("Configuration changed since the last successful start",
+			"configHash", p.Snapshot.Hash,
+			"previousConfigHash", previous.Snapshot.Hash,
+			"previousVersion", previous.Version,
+			"previousStartedAt", previous.StartedAt,
+			"added", paths(r.changes, diff.OpAdd),
+			"removed", paths(r.changes, diff.OpRemove),
+			"changed", changed(r.changes),
+		)
+	}
+
+	c := clock.OrDefault(p.Clock)
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			record := Record{Snapshot: *p.Snapshot, Version: p.Metadata.Version, StartedAt: c.Now()}
+			if err := store.Save(ctx, record); err != nil {
+				// a start isn't failed because its configuration couldn't be kept
+				p.Log.Warnw("Failed to save the configuration snapshot", "error", err)
+			}
+			return nil
+		},
+	})
+	return r
+}
+
+// InfoContributor lists the configuration hash and the changes since the last successful start at the /info endpoint
+func InfoContributor(r *Recorder) info.InfoContributorOut {
+	return info.InfoContributorOut{InfoContributor: r}
+}
+
+func (r *Recorder) Contribute(builder *info.InfoBuilder) {
+	if r.snapshot == nil {
+		return
+	}
+	detail := infoDetail{Hash: r.snapshot.Hash, Changes: r.changes}
+	if r.previous != nil {
+		detail.PreviousHash = r.previous.Snapshot.Hash
+		detail.PreviousVersion = r.previous.Version
+	}
+	builder.WithDetail("configuration", detail)
+}
+
+// Changes the changes since the last successful start, nil when there were none or there was no previous start
+func (r *Recorder) Changes() []diff.Change {
+	return r.changes
+}
+
+func (s *FileStore) Load(_ context.Context) (*Record, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Save writes the record to a temporary file that replaces the previous one, so a crash never leaves a partial record
+func (s *FileStore) Save(_ context.Context, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+func paths(changes []diff.Change, op diff.Op) []string {
+	var matching []string
+	for _, change := range changes {
+		if change.Op == op {
+			matching = append(matching, change.Path)
+		}
+	}
+	return matching
+}
+
+func changed(changes []diff.Change) []diff.Change {
+	var replaced []diff.Change
+	for _, change := range changes {
+		if change.Op == diff.OpReplace {
+			replaced = append(replaced, change)
+		}
+	}
+	return replaced
+}
@@ -0,0 +1,66 @@
+package configsnapshot
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/diff"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func start(t *testing.T, store Store, version string, snapshot *typesafeconfig.Snapshot) (*Recorder, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	lc := fxtest.NewLifecycle(t)
+	r := New(Parameters{
+		Lifecycle: lc,
+		Log:       zap.New(core).Sugar(),
+		Snapshot:  snapshot,
+		Store:     store,
+		Metadata:  metadata.ApplicationMetadata{Version: version},
+		Clock:     clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)),
+	})
+	lc.RequireStart()
+	return r, logs
+}
+
+func TestRecorder(t *testing.T) {
+	store := &FileStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	first := &typesafeconfig.Snapshot{Hash: "a", Values: map[string]string{"replicas": "2", "database.password": "sha256:1"}, Sensitive: []string{"database.password"}}
+
+	r, logs := start(t, store, "1.0.0", first)
+	assert.Nil(t, r.Changes())
+	assert.Equal(t, 1, logs.FilterMessage("No configuration snapshot of a previous successful start").Len())
+
+	_, logs = start(t, store, "1.0.1", first)
+	assert.Equal(t, 1, logs.FilterMessage("Configuration unchanged since the last successful start").Len())
+
+	second := &typesafeconfig.Snapshot{Hash: "b", Values: map[string]string{"replicas": "3", "database.password": "sha256:2"}, Sensitive: []string{"database.password"}}
+	r, logs = start(t, store, "1.1.0", second)
+	assert.Equal(t, []diff.Change{
+		{Path: "database.password", Op: diff.OpReplace, From: diff.Masked, To: diff.Masked},
+		{Path: "replicas", Op: diff.OpReplace, From: "2", To: "3"},
+	}, r.Changes())
+	changed := logs.FilterMessage("Configuration changed since the last successful start").All()
+	require.Len(t, changed, 1)
+	assert.Equal(t, "1.0.1", changed[0].ContextMap()["previousVersion"])
+
+	record, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "b", record.Snapshot.Hash)
+	assert.Equal(t, "1.1.0", record.Version)
+}
+
+func TestRecorderWithoutSnapshot(t *testing.T) {
+	r, logs := start(t, &FileStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}, "1.0.0", nil)
+	assert.Nil(t, r.Changes())
+	assert.Equal(t, 1, logs.FilterMessageSnippet("typesafeconfig.WithSnapshot").Len())
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package crypto provides envelope encryption for data at rest.
+//
+// Every value is encrypted with a fresh AES-256-GCM data key, the data key is then wrapped by a key encryption key
+// held by KMS, Vault transit or a local keyring and stored alongside the ciphertext in an Envelope.
+// Rotating the key encryption key only requires re-wrapping the data keys, see Encrypter.Rotate.
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go.uber.org/fx"
+	"io"
+	"strings"
+)
+
+const (
+	ProviderLocal        = "local"
+	ProviderVaultTransit = "vault-transit"
+	ProviderKMS          = "kms"
+
+	envelopeVersion = 1
+	dataKeySize     = 32
+)
+
+var (
+	ErrUnsupportedProvider = errors.New("unsupported key provider")
+	ErrUnknownKey          = errors.New("unknown key encryption key")
+	ErrUnsupportedVersion  = errors.New("unsupported envelope version")
+)
+
+type (
+	// KeyWrapper wraps and unwraps data keys with a key encryption key that never leaves the provider
+	KeyWrapper interface {
+		// WrapKey encrypts the data key with the current key encryption key and returns its id along with the wrapped key
+		WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+		// UnwrapKey decrypts a data key previously wrapped by the key encryption key identified by keyID
+		UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+	}
+
+	// Envelope an encrypted value along with the wrapped data key needed to decrypt it
+	Envelope struct {
+		Version    int    `json:"v"`
+		KeyID      string `json:"kid"`
+		WrappedKey []byte `json:"wk"`
+		// Ciphertext the GCM nonce followed by the sealed value
+		Ciphertext []byte `json:"ct"`
+	}
+
+	// Encrypter performs envelope encryption with the configured KeyWrapper
+	Encrypter struct {
+		wrapper KeyWrapper
+	}
+
+	Configuration struct {
+		// Provider one of local, vault-transit or kms
+		Provider     string
+		Local        LocalConfiguration
+		VaultTransit VaultTransitConfiguration
+		KMS          KMSConfiguration
+	}
+)
+
+var Module = fx.Module(
+	"crypto",
+	fx.Provide(NewKeyWrapper, New),
+	fx.Invoke(SetDefault),
+)
+
+// NewKeyWrapper creates the KeyWrapper for the configured provider
+func NewKeyWrapper(c Configuration) (KeyWrapper, error) {
+	switch strings.ToLower(c.Provider) {
+	case ProviderLocal:
+		return NewLocalKeyring(c.Local)
+	case ProviderVaultTransit:
+		return NewVaultTransit(c.VaultTransit)
+	case ProviderKMS:
+		return NewKMS(c.KMS)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProvider, c.Provider)
+	}
+}
+
+func New(wrapper KeyWrapper) *Encrypter {
+	return &Encrypter{wrapper: wrapper}
+}
+
+// Encrypt seals plaintext with a new data key, associatedData is authenticated but not encrypted and must be supplied again to Decrypt
+func (e *Encrypter) Encrypt(ctx context.Context, plaintext []byte, associatedData []byte) (*Envelope, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataKey, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := e.wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &Envelope{
+		Version:    envelopeVersion,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+func (e *Encrypter) Decrypt(ctx context.Context, envelope *Envelope, associatedData []byte) ([]byte, error) {
+	if envelope.Version != envelopeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, envelope.Version)
+	}
+
+	dataKey, err := e.wrapper.UnwrapKey(ctx, envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return open(dataKey, envelope.Ciphertext, associatedData)
+}
+
+// Rotate re-wraps the data key of the envelope with the current key encryption key, the ciphertext is left untouched
+func (e *Encrypter) Rotate(ctx context.Context, envelope *Envelope) (*Envelope, error) {
+	dataKey, err := e.wrapper.UnwrapKey(ctx, envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	keyID, wrapped, err := e.wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &Envelope{
+		Version:    envelope.Version,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Ciphertext: envelope.Ciphertext,
+	}, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM, prefixing the result with the random nonce
+func seal(key []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func open(key []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, associatedData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newLocalEncrypter(t *testing.T, primary string) *Encrypter {
+	keyring, err := NewLocalKeyring(LocalConfiguration{
+		PrimaryKeyID: primary,
+		Keys:         map[string]string{"2022": key(1), "2023": key(2)},
+	})
+	assert.NoError(t, err)
+	return New(keyring)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+	e := newLocalEncrypter(t, "2022")
+
+	envelope, err := e.Encrypt(ctx, []byte("hunter2"), []byte("user-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2022", envelope.KeyID)
+	assert.NotContains(t, string(envelope.Ciphertext), "hunter2")
+
+	plaintext, err := e.Decrypt(ctx, envelope, []byte("user-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", string(plaintext))
+
+	_, err = e.Decrypt(ctx, envelope, []byte("user-2"))
+	assert.Error(t, err, "associated data must match")
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	envelope, err := newLocalEncrypter(t, "2022").Encrypt(ctx, []byte("hunter2"), nil)
+	assert.NoError(t, err)
+
+	rotated, err := newLocalEncrypter(t, "2023").Rotate(ctx, envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "2023", rotated.KeyID)
+	assert.Equal(t, envelope.Ciphertext, rotated.Ciphertext, "rotation only re-wraps the data key")
+
+	keyring, err := NewLocalKeyring(LocalConfiguration{PrimaryKeyID: "2023", Keys: map[string]string{"2023": key(2)}})
+	assert.NoError(t, err)
+	plaintext, err := New(keyring).Decrypt(ctx, rotated, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", string(plaintext))
+
+	_, err = New(keyring).Decrypt(ctx, envelope, nil)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestNewLocalKeyringValidation(t *testing.T) {
+	_, err := NewLocalKeyring(LocalConfiguration{PrimaryKeyID: "missing", Keys: map[string]string{"2022": key(1)}})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = NewLocalKeyring(LocalConfiguration{PrimaryKeyID: "short", Keys: map[string]string{"short": base64.StdEncoding.EncodeToString([]byte("short"))}})
+	assert.ErrorContains(t, err, "256 bit")
+}
+
+type credentials struct {
+	Username string
+	Password Field[map[string]string]
+}
+
+func TestField(t *testing.T) {
+	SetDefault(newLocalEncrypter(t, "2022"))
+	t.Cleanup(func() { SetDefault(nil) })
+
+	original := credentials{Username: "admin", Password: NewField(map[string]string{"token": "hunter2"})}
+	data, err := json.Marshal(original)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+
+	var decoded credentials
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "hunter2", decoded.Password.Plaintext["token"])
+	assert.Equal(t, "2022", decoded.Password.Envelope().KeyID)
+
+	var valuer driver.Valuer = original.Password
+	value, err := valuer.Value()
+	assert.NoError(t, err)
+
+	var scanned Field[map[string]string]
+	assert.NoError(t, scanned.Scan(value))
+	assert.Equal(t, original.Password.Plaintext, scanned.Plaintext)
+
+	assert.NoError(t, scanned.Scan(nil), "nullable columns are scanned")
+	assert.Nil(t, scanned.Plaintext)
+	assert.Nil(t, scanned.Envelope())
+}
+
+func TestFieldWithoutDefault(t *testing.T) {
+	_, err := json.Marshal(NewField("value"))
+	assert.ErrorIs(t, err, ErrNoDefaultEncrypter)
+}
+
+func TestVaultTransit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/customer-data":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]}})
+		case "/v1/transit/decrypt/customer-data":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"plaintext": strings.TrimPrefix(body["ciphertext"], "vault:v1:")}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	wrapper, err := NewKeyWrapper(Configuration{
+		Provider:     ProviderVaultTransit,
+		VaultTransit: VaultTransitConfiguration{Address: s.URL, Token: "token", KeyName: "customer-data"},
+	})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	e := New(wrapper)
+	envelope, err := e.Encrypt(ctx, []byte("hunter2"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "customer-data", envelope.KeyID)
+	assert.True(t, strings.HasPrefix(string(envelope.WrappedKey), "vault:v1:"))
+
+	plaintext, err := e.Decrypt(ctx, envelope, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", string(plaintext))
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	ErrNoDefaultEncrypter = errors.New("no default encrypter, provide crypto.Module or call crypto.SetDefault")
+
+	defaultEncrypter atomic.Pointer[Encrypter]
+)
+
+// Field holds a value that is encrypted whenever it is marshaled to JSON or written to SQL, and decrypted when it is read back.
+// It uses the default Encrypter, which crypto.Module sets.
+//
+//	type Credentials struct {
+//		ID       string
+//		Password crypto.Field[string] `boil:"password"`
+//	}
+type Field[T any] struct {
+	Plaintext T
+	// envelope the envelope the value was read from, nil for values that have not been persisted
+	envelope *Envelope
+}
+
+// SetDefault sets the Encrypter used by Field
+func SetDefault(e *Encrypter) {
+	defaultEncrypter.Store(e)
+}
+
+func NewField[T any](value T) Field[T] {
+	return Field[T]{Plaintext: value}
+}
+
+// Envelope returns the envelope the field was read from, so callers can check its KeyID when rotating keys
+func (f Field[T]) Envelope() *Envelope {
+	return f.envelope
+}
+
+func (f Field[T]) MarshalJSON() ([]byte, error) {
+	envelope, err := f.encrypt()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+func (f *Field[T]) UnmarshalJSON(data []byte) error {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	return f.decrypt(&envelope)
+}
+
+// Value implements driver.Valuer, the envelope is stored as JSON
+func (f Field[T]) Value() (driver.Value, error) {
+	envelope, err := f.encrypt()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// Scan implements sql.Scanner, NULL is scanned as the zero value
+func (f *Field[T]) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*f = Field[T]{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into crypto.Field", src)
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	return f.decrypt(&envelope)
+}
+
+func (f Field[T]) encrypt() (*Envelope, error) {
+	e := defaultEncrypter.Load()
+	if e == nil {
+		return nil, ErrNoDefaultEncrypter
+	}
+	plaintext, err := json.Marshal(f.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return e.Encrypt(context.Background(), plaintext, nil)
+}
+
+func (f *Field[T]) decrypt(envelope *Envelope) error {
+	e := defaultEncrypter.Load()
+	if e == nil {
+		return ErrNoDefaultEncrypter
+	}
+	plaintext, err := e.Decrypt(context.Background(), envelope, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(plaintext, &f.Plaintext); err != nil {
+		return err
+	}
+	f.envelope = envelope
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/voynich"
+	"github.com/hashicorp/vault/api"
+	"strings"
+)
+
+const defaultTransitMount = "transit"
+
+type (
+	LocalConfiguration struct {
+		// PrimaryKeyID the id of the key used to wrap new data keys, the remaining keys are only used to unwrap existing data keys
+		PrimaryKeyID string
+		// Keys base64 encoded AES-256 key encryption keys by id, use encrypted secrets rather than plaintext keys
+		Keys map[string]string
+	}
+
+	VaultTransitConfiguration struct {
+		Address string
+		Token   string
+		// MountPath where the transit secrets engine is mounted, defaults to transit
+		MountPath string
+		// KeyName the name of the transit key, rotating it in Vault is picked up by Encrypter.Rotate
+		KeyName string
+	}
+
+	KMSConfiguration struct {
+		// CMKARNs the ARNs of the customer master keys data keys are wrapped with
+		CMKARNs []string
+		// ContextKey and ContextValue are bound to the wrapped keys as the KMS encryption context
+		ContextKey   string
+		ContextValue string
+	}
+
+	// LocalKeyring wraps data keys with AES-256-GCM key encryption keys held in memory, suitable for local development and tests
+	LocalKeyring struct {
+		primaryKeyID string
+		keys         map[string][]byte
+	}
+
+	// VaultTransit wraps data keys with a key in Vault's transit secrets engine
+	VaultTransit struct {
+		logical *api.Logical
+		mount   string
+		keyName string
+	}
+
+	// KMS wraps data keys with AWS KMS through the voynich sidecar
+	KMS struct {
+		client *voynich.Client
+		config KMSConfiguration
+	}
+)
+
+func NewLocalKeyring(c LocalConfiguration) (*LocalKeyring, error) {
+	if _, ok := c.Keys[c.PrimaryKeyID]; !ok {
+		return nil, fmt.Errorf("%w: primary key %q is not in crypto.local.keys", ErrUnknownKey, c.PrimaryKeyID)
+	}
+	keys := make(map[string][]byte, len(c.Keys))
+	for id, encoded := range c.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("crypto.local.keys.%s must be base64 encoded: %w", id, err)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("crypto.local.keys.%s must be a 256 bit key, got %d bits", id, len(key)*8)
+		}
+		keys[id] = key
+	}
+	return &LocalKeyring{primaryKeyID: c.PrimaryKeyID, keys: keys}, nil
+}
+
+func (l *LocalKeyring) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(l.keys[l.primaryKeyID], dataKey, []byte(l.primaryKeyID))
+	return l.primaryKeyID, wrapped, err
+}
+
+func (l *LocalKeyring) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := l.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+func NewVaultTransit(c VaultTransitConfiguration) (*VaultTransit, error) {
+	if c.KeyName == "" {
+		return nil, errors.New("crypto.vaultTransit.keyName is required")
+	}
+	config := api.DefaultConfig()
+	if c.Address != "" {
+		config.Address = c.Address
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create vault client: %w", err)
+	}
+	if c.Token != "" {
+		client.SetToken(c.Token)
+	}
+
+	mount := strings.Trim(c.MountPath, "/")
+	if mount == "" {
+		mount = defaultTransitMount
+	}
+	return &VaultTransit{logical: client.Logical(), mount: mount, keyName: c.KeyName}, nil
+}
+
+func (v *VaultTransit) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	secret, err := v.logical.WriteWithContext(ctx, fmt.Sprintf("%s/encrypt/%s", v.mount, v.keyName), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	ciphertext, err := stringFromSecret(secret, "ciphertext")
+	if err != nil {
+		return "", nil, err
+	}
+	return v.keyName, []byte(ciphertext), nil
+}
+
+func (v *VaultTransit) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	secret, err := v.logical.WriteWithContext(ctx, fmt.Sprintf("%s/decrypt/%s", v.mount, keyID), map[string]interface{}{
+		"ciphertext": string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := stringFromSecret(secret, "plaintext")
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func stringFromSecret(secret *api.Secret, key string) (string, error) {
+	if secret == nil || secret.Data == nil {
+		return "", errors.New("vault transit returned an empty response")
+	}
+	value, ok := secret.Data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault transit response is missing %s", key)
+	}
+	return value, nil
+}
+
+func NewKMS(c KMSConfiguration) (*KMS, error) {
+	if len(c.CMKARNs) == 0 {
+		return nil, errors.New("crypto.kms.cmkARNs is required")
+	}
+	return &KMS{client: voynich.New(), config: c}, nil
+}
+
+func (k *KMS) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := k.client.Encrypt(dataKey, k.config.CMKARNs, k.config.ContextKey, k.config.ContextValue)
+	return strings.Join(k.config.CMKARNs, ","), wrapped, err
+}
+
+// UnwrapKey the wrapped key identifies its CMK, so keyID is informational only
+func (k *KMS) UnwrapKey(_ context.Context, _ string, wrapped []byte) ([]byte, error) {
+	return k.client.Decrypt(wrapped, k.config.ContextKey, k.config.ContextValue)
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ctxutil provides typed context keys, so values stored in a context by one module can be read by another without
+// sharing private key types or repeating type assertions.
+package ctxutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// Key a typed context key, declare keys once as package level variables with NewKey.
+	// Keys are compared by identity, two keys with the same name are distinct
+	//
+	//	var tenantKey = ctxutil.NewKey[Tenant]("tenancy.tenant")
+	//
+	//	ctx = tenantKey.WithValue(ctx, tenant)
+	//	tenant, ok := tenantKey.Value(ctx)
+	Key[T any] struct {
+		name string
+	}
+
+	// KeyInfo describes a declared key
+	KeyInfo struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	// Valuer is satisfied by context.Context and by other context types, such as the temporal workflow.Context
+	Valuer interface {
+		Value(key any) any
+	}
+
+	// Recording the names of the keys that were set on a context, see WithRecording
+	Recording struct {
+		mu   sync.Mutex
+		keys map[string]struct{}
+	}
+
+	recordingKey struct{}
+)
+
+var (
+	debug atomic.Bool
+
+	declaredMu sync.Mutex
+	declared   []KeyInfo
+)
+
+// NewKey declares a typed context key, the name is used for diagnostics and should be prefixed with the declaring package
+func NewKey[T any](name string) *Key[T] {
+	var zero T
+	declaredMu.Lock()
+	defer declaredMu.Unlock()
+	declared = append(declared, KeyInfo{Name: name, Type: fmt.Sprintf("%T", &zero)[1:]})
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// WithValue returns a copy of ctx that carries the value
+func (k *Key[T]) WithValue(ctx context.Context, value T) context.Context {
+	k.record(ctx)
+	return context.WithValue(ctx, k, value)
+}
+
+// Value returns the value stored under the key and whether it was present
+func (k *Key[T]) Value(ctx Valuer) (T, bool) {
+	v, ok := ctx.Value(k).(T)
+	return v, ok
+}
+
+// ValueOrDefault returns the value stored under the key, or fallback when it isn't present
+func (k *Key[T]) ValueOrDefault(ctx Valuer, fallback T) T {
+	if v, ok := k.Value(ctx); ok {
+		return v
+	}
+	return fallback
+}
+
+// Record notes that the key was set on a context, for context types other than context.Context that can't use WithValue
+func (k *Key[T]) Record(ctx Valuer) {
+	k.record(ctx)
+}
+
+func (k *Key[T]) record(ctx Valuer) {
+	if !debug.Load() {
+		return
+	}
+	if r, ok := ctx.Value(recordingKey{}).(*Recording); ok {
+		r.mu.Lock()
+		r.keys[k.name] = struct{}{}
+		r.mu.Unlock()
+	}
+}
+
+// EnableDebug turns key recording on or off, while it is off WithRecording is a no-op
+func EnableDebug(enabled bool) {
+	debug.Store(enabled)
+}
+
+// DebugEnabled reports whether key recording is on
+func DebugEnabled() bool {
+	return debug.Load()
+}
+
+// WithRecording returns a copy of ctx that records the keys set on it, and on any context derived from it.
+// The returned Recording is nil when debug mode is off
+func WithRecording(ctx context.Context) (context.Context, *Recording) {
+	if !debug.Load() {
+		return ctx, nil
+	}
+	r := &Recording{keys: map[string]struct{}{}}
+	return context.WithValue(ctx, recordingKey{}, r), r
+}
+
+// Keys the sorted names of the keys that were set
+func (r *Recording) Keys() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.keys))
+	for k := range r.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DeclaredKeys every key declared with NewKey, sorted by name
+func DeclaredKeys() []KeyInfo {
+	declaredMu.Lock()
+	defer declaredMu.Unlock()
+	keys := make([]KeyInfo, len(declared))
+	copy(keys, declared)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
@@ -0,0 +1,60 @@
+package ctxutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tenant struct {
+	OrgID string
+}
+
+var (
+	tenantKey  = NewKey[tenant]("ctxutil.test.tenant")
+	orgKey     = NewKey[string]("ctxutil.test.org")
+	shadowKey  = NewKey[string]("ctxutil.test.org")
+	pointerKey = NewKey[*tenant]("ctxutil.test.pointer")
+)
+
+func TestKey(t *testing.T) {
+	ctx := tenantKey.WithValue(context.Background(), tenant{OrgID: "org-1"})
+	ctx = orgKey.WithValue(ctx, "org-2")
+
+	v, ok := tenantKey.Value(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "org-1", v.OrgID)
+
+	org, ok := orgKey.Value(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "org-2", org)
+
+	_, ok = shadowKey.Value(ctx)
+	assert.False(t, ok, "keys with the same name must not collide")
+
+	p, ok := pointerKey.Value(ctx)
+	assert.False(t, ok)
+	assert.Nil(t, p)
+	assert.Equal(t, "fallback", shadowKey.ValueOrDefault(ctx, "fallback"))
+}
+
+func TestRecording(t *testing.T) {
+	ctx, recording := WithRecording(context.Background())
+	assert.Nil(t, recording, "recording is off unless debug is enabled")
+	orgKey.WithValue(ctx, "org")
+
+	EnableDebug(true)
+	t.Cleanup(func() { EnableDebug(false) })
+
+	ctx, recording = WithRecording(context.Background())
+	derived := tenantKey.WithValue(ctx, tenant{})
+	orgKey.WithValue(derived, "org")
+	orgKey.WithValue(derived, "org")
+	assert.Equal(t, []string{"ctxutil.test.org", "ctxutil.test.tenant"}, recording.Keys())
+}
+
+func TestDeclaredKeys(t *testing.T) {
+	assert.Contains(t, DeclaredKeys(), KeyInfo{Name: "ctxutil.test.tenant", Type: "ctxutil.tenant"})
+	assert.Contains(t, DeclaredKeys(), KeyInfo{Name: "ctxutil.test.pointer", Type: "*ctxutil.tenant"})
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cursor encodes keyset pagination positions as opaque, tamper proof strings.
+//
+// A cursor is the unpadded base64url encoding of a version byte, the expiry in unix seconds, the JSON encoded key
+// and an HMAC-SHA256 over all of them. Clients can't read or forge the key, so services can put anything in it,
+// i.e. the sort column values and id of the last item of a page.
+package cursor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"go.uber.org/fx"
+	"time"
+)
+
+const (
+	version    = 1
+	defaultTTL = 24 * time.Hour
+	// headerSize the version byte followed by the expiry
+	headerSize = 1 + 8
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrExpiredCursor = errors.New("expired cursor")
+	ErrNoKeys        = errors.New("no cursor signing keys configured")
+)
+
+type (
+	Configuration struct {
+		// Keys HMAC secrets, the first signs new cursors while all of them are accepted, so that keys can be rotated
+		// without invalidating the cursors clients hold
+		Keys []string
+		// TTL how long a cursor is valid, defaults to 24 hours
+		TTL time.Duration
+	}
+
+	// Signer signs and verifies cursors
+	Signer struct {
+		keys  [][]byte
+		ttl   time.Duration
+		clock clock.Clock
+	}
+
+	// Page a page of items along with the cursor of the next one, which is empty on the last page
+	Page[T any] struct {
+		Items      []T    `json:"items"`
+		NextCursor string `json:"nextCursor,omitempty"`
+	}
+)
+
+type signerParameters struct {
+	fx.In
+	Config Configuration
+	Clock  clock.Clock `optional:"true"`
+}
+
+// Module provides a Signer from the Configuration
+var Module = fx.Module("cursor",
+	fx.Provide(func(p signerParameters) (*Signer, error) {
+		return NewSigner(p.Config, clock.OrDefault(p.Clock))
+	}),
+)
+
+// NewSigner creates a Signer with the configured keys
+func NewSigner(config Configuration, c clock.Clock) (*Signer, error) {
+	if len(config.Keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	keys := make([][]byte, 0, len(config.Keys))
+	for i, key := range config.Keys {
+		if key == "" {
+			return nil, fmt.Errorf("cursor signing key %d is empty", i)
+		}
+		keys = append(keys, []byte(key))
+	}
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &Signer{keys: keys, ttl: ttl, clock: c}, nil
+}
+
+// Encode signs key into an opaque cursor that expires after the configured TTL
+func Encode[K any](s *Signer, key K) (string, error) {
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, headerSize, headerSize+len(payload)+sha256.Size)
+	message[0] = version
+	binary.BigEndian.PutUint64(message[1:headerSize], uint64(s.clock.Now().Add(s.ttl).Unix()))
+	message = append(message, payload...)
+	message = append(message, sign(s.keys[0], message)...)
+	return base64.RawURLEncoding.EncodeToString(message), nil
+}
+
+// Decode verifies the cursor and returns its key. Cursors that were tampered with or signed by an unknown key fail with ErrInvalidCursor,
+// cursors past their expiry with ErrExpiredCursor
+func Decode[K any](s *Signer, cursor string) (K, error) {
+	var key K
+	message, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(message) < headerSize+sha256.Size {
+		return key, ErrInvalidCursor
+	}
+	signed, signature := message[:len(message)-sha256.Size], message[len(message)-sha256.Size:]
+	if !s.verify(signed, signature) || signed[0] != version {
+		return key, ErrInvalidCursor
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(signed[1:headerSize])), 0)
+	if !s.clock.Now().Before(expiresAt) {
+		return key, ErrExpiredCursor
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(signed[headerSize:]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&key); err != nil {
+		return key, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	return key, nil
+}
+
+// NewPage builds a page from items fetched with a limit of limit+1, the extra item only tells whether there is a next page
+// and is dropped. The next cursor is the key of the last item of the page
+func NewPage[T any, K any](s *Signer, items []T, limit int, keyOf func(T) K) (Page[T], error) {
+	if len(items) <= limit {
+		return Page[T]{Items: items}, nil
+	}
+	items = items[:limit]
+	if limit == 0 {
+		return Page[T]{Items: items}, nil
+	}
+	next, err := Encode(s, keyOf(items[limit-1]))
+	if err != nil {
+		return Page[T]{}, err
+	}
+	return Page[T]{Items: items, NextCursor: next}, nil
+}
+
+func (s *Signer) verify(message []byte, signature []byte) bool {
+	for _, key := range s.keys {
+		if hmac.Equal(sign(key, message), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cursor
+
+import (
+	"encoding/base64"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type deploymentKey struct {
+	CreatedAt time.Time `json:"c"`
+	ID        string    `json:"i"`
+}
+
+func newTestSigner(t *testing.T, c clock.Clock, keys ...string) *Signer {
+	s, err := NewSigner(Configuration{Keys: keys, TTL: time.Hour}, c)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestEncodeDecode(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestSigner(t, fake, "secret")
+	key := deploymentKey{CreatedAt: fake.Now(), ID: "dep_1"}
+
+	cursor, err := Encode(s, key)
+	assert.NoError(t, err)
+	decoded, err := Decode[deploymentKey](s, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	fake.Advance(time.Hour)
+	_, err = Decode[deploymentKey](s, cursor)
+	assert.ErrorIs(t, err, ErrExpiredCursor)
+}
+
+func TestDecodeRejectsTamperedCursors(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestSigner(t, fake, "secret")
+	cursor, err := Encode(s, deploymentKey{ID: "dep_1"})
+	assert.NoError(t, err)
+
+	raw, _ := base64.RawURLEncoding.DecodeString(cursor)
+	raw[headerSize+2] ^= 0x01
+	cases := map[string]string{
+		"tampered":     base64.RawURLEncoding.EncodeToString(raw),
+		"not base64":   "%%%",
+		"too short":    "AAAA",
+		"unknown key":  must(Encode(newTestSigner(t, fake, "other"), deploymentKey{ID: "dep_1"})),
+		"empty cursor": "",
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode[deploymentKey](s, c)
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	old := newTestSigner(t, fake, "old")
+	rotated := newTestSigner(t, fake, "new", "old")
+
+	cursor, err := Encode(old, deploymentKey{ID: "dep_1"})
+	assert.NoError(t, err)
+	decoded, err := Decode[deploymentKey](rotated, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, "dep_1", decoded.ID)
+}
+
+func TestNewPage(t *testing.T) {
+	s := newTestSigner(t, clock.New(), "secret")
+	keyOf := func(id string) deploymentKey { return deploymentKey{ID: id} }
+
+	page, err := NewPage(s, []string{"a", "b", "c"}, 2, keyOf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, page.Items)
+	next, err := Decode[deploymentKey](s, page.NextCursor)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", next.ID)
+
+	page, err = NewPage(s, []string{"a", "b"}, 2, keyOf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, page.Items)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestNewSignerRequiresKeys(t *testing.T) {
+	_, err := NewSigner(Configuration{}, clock.New())
+	assert.ErrorIs(t, err, ErrNoKeys)
+}
+
+func must(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package devmocks serves canned responses for the downstreams of a service that are unreachable while developing locally,
+// so a service with many dependencies can be run without all of them. Fixtures are files of an embedded directory, one
+// directory per downstream, then per method, then the path of the request:
+//
+//	fixtures/billing/GET/invoices/_.json    answers GET /invoices/{any id} of the billing downstream
+//	fixtures/billing/POST/invoices.json     answers POST /invoices
+//
+// A path segment named _ matches any segment, exact names are preferred. Fixtures are only served when a request to the
+// downstream fails to connect, and only when the environment or an active profile is dev:
+//
+//	//go:embed fixtures
+//	var fixtures embed.FS
+//
+//	fx.New(
+//		devmocks.Module,
+//		fx.Supply(devmocks.Fixtures{FS: fixtures}),
+//	)
+//
+//	devMocks:
+//	  enabled: true
+//	  downstreams:
+//	    billing: billing.dev.armory.io
+package devmocks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/envutils"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// MockHeader is set on every mocked response, ex: X-Armory-Dev-Mock: billing/GET/invoices/_.json
+	MockHeader = "X-Armory-Dev-Mock"
+
+	defaultDirectory = "fixtures"
+	wildcardSegment  = "_"
+	indexFixture     = "index"
+)
+
+var Module = fx.Module("devmocks", fx.Provide(New))
+
+type (
+	Configuration struct {
+		// Enabled serves the fixtures of unreachable downstreams, only honoured when the environment or an active profile is dev
+		Enabled bool
+		// Downstreams the hosts of the downstreams that may be mocked by name, ex: billing: billing.dev.armory.io. A host without a
+		// port matches any port. The fixtures of a downstream are in the directory of its name
+		Downstreams map[string]string
+		// Directory the directory of the fixtures in the Fixtures file system, defaults to fixtures
+		Directory string
+	}
+
+	// Fixtures the file system the fixtures are read from, typically an embed.FS
+	Fixtures struct {
+		FS fs.FS
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config   Configuration `optional:"true"`
+		Fixtures Fixtures      `optional:"true"`
+		Metadata metadata.ApplicationMetadata
+		Log      *zap.SugaredLogger
+	}
+
+	// Mocks serves the fixtures of the downstreams, nil when mocking is disabled
+	Mocks struct {
+		fixtures fs.FS
+		hosts    map[string]string
+		log      *zap.SugaredLogger
+		// announced the downstreams whose first mocked response was logged
+		announced sync.Map
+	}
+
+	roundTripper struct {
+		mocks *Mocks
+		base  http.RoundTripper
+	}
+)
+
+// New creates the Mocks of the configuration, nil when mocking is disabled or the environment isn't a dev one
+func New(params Parameters) (*Mocks, error) {
+	config := params.Config
+	if !config.Enabled {
+		return nil, nil
+	}
+	if !envutils.IsDev(params.Metadata.Environment, typesafeconfig.ActiveProfiles()) {
+		params.Log.Warnw("Downstream mocks are only available in dev environments and have been disabled", "environment", params.Metadata.Environment)
+		return nil, nil
+	}
+	if params.Fixtures.FS == nil {
+		return nil, errors.New("downstream mocks are enabled but no devmocks.Fixtures were provided")
+	}
+	directory := config.Directory
+	if directory == "" {
+		directory = defaultDirectory
+	}
+	fixtures, err := fs.Sub(params.Fixtures.FS, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mocks{fixtures: fixtures, hosts: map[string]string{}, log: params.Log}
+	for name, host := range config.Downstreams {
+		m.hosts[strings.ToLower(strings.TrimSpace(host))] = name
+	}
+	params.Log.Warnw("Downstream mocks are enabled, unreachable downstreams are answered with fixtures", "downstreams", config.Downstreams)
+	return m, nil
+}
+
+// RoundTripper serves fixtures for the requests to the configured downstreams that fail to connect, base is returned as is when m is nil
+func (m *Mocks) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return base
+	}
+	return &roundTripper{mocks: m, base: base}
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.base.RoundTrip(req)
+	if err == nil || !unreachable(err) {
+		return res, err
+	}
+	downstream, ok := r.mocks.downstreamOf(req.URL)
+	if !ok {
+		return res, err
+	}
+	fixture, ok := r.mocks.find(downstream, req.Method, req.URL.Path)
+	if !ok {
+		r.mocks.log.Warnw("Downstream is unreachable and has no fixture for the request", "downstream", downstream, "method", req.Method, "path", req.URL.Path)
+		return res, err
+	}
+	body, readErr := fs.ReadFile(r.mocks.fixtures, fixture)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read fixture %s: %w", fixture, readErr)
+	}
+
+	if _, announced := r.mocks.announced.LoadOrStore(downstream, true); !announced {
+		r.mocks.log.Warnw("Downstream is unreachable, answering its requests with fixtures", "downstream", downstream, "cause", err.Error())
+	}
+	r.mocks.log.Infow("Mocked downstream response", "downstream", downstream, "method", req.Method, "path", req.URL.Path, "fixture", fixture)
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	header := http.Header{}
+	header.Set(MockHeader, fixture)
+	if contentType := mime.TypeByExtension(path.Ext(fixture)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// downstreamOf the name of the downstream of the url, by its host and port or else only its host
+func (m *Mocks) downstreamOf(u *neturl.URL) (string, bool) {
+	if name, ok := m.hosts[strings.ToLower(u.Host)]; ok {
+		return name, true
+	}
+	name, ok := m.hosts[strings.ToLower(u.Hostname())]
+	return name, ok
+}
+
+// find the fixture of a request, preferring exact path segments over wildcards
+func (m *Mocks) find(downstream string, method string, urlPath string) (string, bool) {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(segments) == 1 && segments[0] == "" {
+		segments = []string{indexFixture}
+	}
+	return m.match(path.Join(downstream, strings.ToUpper(method)), segments)
+}
+
+func (m *Mocks) match(dir string, segments []string) (string, bool) {
+	entries, err := fs.ReadDir(m.fixtures, dir)
+	if err != nil {
+		return "", false
+	}
+	for _, candidate := range []string{segments[0], wildcardSegment} {
+		for _, entry := range entries {
+			name := entry.Name()
+			if len(segments) > 1 {
+				if entry.IsDir() && name == candidate {
+					if fixture, ok := m.match(path.Join(dir, name), segments[1:]); ok {
+						return fixture, true
+					}
+				}
+				continue
+			}
+			if !entry.IsDir() && strings.TrimSuffix(name, path.Ext(name)) == candidate {
+				return path.Join(dir, name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// unreachable whether the request failed to connect to the downstream, rather than the downstream failing to answer it
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
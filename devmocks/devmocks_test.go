@@ -0,0 +1,136 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package devmocks
+
+import (
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+var fixtures = fstest.MapFS{
+	"fixtures/billing/GET/invoices/_.json":         {Data: []byte(`{"id":"any"}`)},
+	"fixtures/billing/GET/invoices/inv-1.json":     {Data: []byte(`{"id":"inv-1"}`)},
+	"fixtures/billing/GET/invoices/_/lines/_.json": {Data: []byte(`{"line":1}`)},
+	"fixtures/billing/POST/invoices.json":          {Data: []byte(`{"id":"created"}`)},
+	"fixtures/billing/GET/index.txt":               {Data: []byte(`billing`)},
+}
+
+// unreachableHost the address of a port nothing listens on
+func unreachableHost(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+func TestMocks(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	host := unreachableHost(t)
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("live"))
+	}))
+	defer reachable.Close()
+
+	mocks, err := New(Parameters{
+		Config: Configuration{
+			Enabled: true,
+			Downstreams: map[string]string{
+				"billing":  host,
+				"accounts": reachable.Listener.Addr().String(),
+			},
+		},
+		Fixtures: Fixtures{FS: fixtures},
+		Metadata: metadata.ApplicationMetadata{Environment: "local"},
+		Log:      zap.New(core).Sugar(),
+	})
+	require.NoError(t, err)
+	require.NotNil(t, mocks)
+	client := &http.Client{Transport: mocks.RoundTripper(cleanhttp.DefaultTransport())}
+
+	call := func(method, url string) (*http.Response, string, error) {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(body), nil
+	}
+
+	for path, expected := range map[string]string{
+		"/invoices/inv-1":         `{"id":"inv-1"}`,
+		"/invoices/inv-2":         `{"id":"any"}`,
+		"/invoices/inv-2/lines/3": `{"line":1}`,
+		"/":                       `billing`,
+	} {
+		res, body, err := call(http.MethodGet, "http://"+host+path)
+		require.NoError(t, err, path)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, expected, body, path)
+		assert.NotEmpty(t, res.Header.Get(MockHeader))
+	}
+	res, body, err := call(http.MethodPost, "http://"+host+"/invoices")
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":"created"}`, body)
+	assert.Equal(t, "billing/POST/invoices.json", res.Header.Get(MockHeader))
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	_, _, err = call(http.MethodDelete, "http://"+host+"/invoices/inv-1")
+	assert.Error(t, err, "requests without a fixture fail as they would without mocks")
+
+	res, body, err = call(http.MethodGet, reachable.URL+"/invoices/inv-1")
+	require.NoError(t, err)
+	assert.Equal(t, "live", body, "reachable downstreams aren't mocked")
+	assert.Empty(t, res.Header.Get(MockHeader))
+
+	assert.Equal(t, 1, logs.FilterMessage("Downstream is unreachable, answering its requests with fixtures").Len(), "mocks are announced once per downstream")
+	assert.Equal(t, 5, logs.FilterMessage("Mocked downstream response").Len())
+}
+
+func TestMocksOnlyInDevEnvironments(t *testing.T) {
+	params := Parameters{
+		Config:   Configuration{Enabled: true},
+		Fixtures: Fixtures{FS: fixtures},
+		Metadata: metadata.ApplicationMetadata{Environment: "prod"},
+		Log:      zap.NewNop().Sugar(),
+	}
+	mocks, err := New(params)
+	require.NoError(t, err)
+	assert.Nil(t, mocks)
+	transport := cleanhttp.DefaultTransport()
+	assert.Same(t, transport, mocks.RoundTripper(transport), "nil mocks don't wrap transports")
+
+	params.Metadata.Environment = "dev"
+	params.Fixtures = Fixtures{}
+	_, err = New(params)
+	assert.EqualError(t, err, "downstream mocks are enabled but no devmocks.Fixtures were provided")
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package diff compares two versions of a value and lists what changed, for audit events and change history APIs.
+//
+// Paths use the JSON names of fields, so they match what API clients see: spec.replicas, labels.app, containers[0].image.
+// Fields tagged diff:"-" are not compared, fields tagged diff:"sensitive" or sensitive:"true" (see the redact package) are
+// reported as changed without their values:
+//
+//	type Credentials struct {
+//		User     string `json:"user"`
+//		Password string `json:"password" sensitive:"true"`
+//		Cache    []byte `json:"-"`
+//	}
+package diff
+
+import (
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/armory-io/go-commons/redact"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	OpAdd     Op = "add"
+	OpRemove  Op = "remove"
+	OpReplace Op = "replace"
+
+	// Masked replaces the values of sensitive fields
+	Masked = redact.Masked
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	valuerType        = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+type (
+	// Op how a value changed, the names follow JSON Patch
+	Op string
+
+	// Change a value that was added, removed or replaced
+	Change struct {
+		Path string `json:"path"`
+		Op   Op     `json:"op"`
+		// From the previous value, nil when the value was added
+		From any `json:"from,omitempty"`
+		// To the new value, nil when the value was removed
+		To any `json:"to,omitempty"`
+	}
+
+	// Option customizes a comparison
+	Option func(*differ)
+
+	differ struct {
+		ignored map[string]bool
+		changes []Change
+	}
+)
+
+// Ignore skips the values at the paths, and everything below them
+func Ignore(paths ...string) Option {
+	return func(d *differ) {
+		for _, path := range paths {
+			d.ignored[path] = true
+		}
+	}
+}
+
+// Compare lists the changes from before to after, in the order of the fields of structs and the sorted keys of maps.
+// Either value can be nil, in which case everything in the other one was added or removed
+func Compare(before, after any, options ...Option) []Change {
+	d := &differ{ignored: map[string]bool{}}
+	for _, option := range options {
+		option(d)
+	}
+	d.compare("", reflect.ValueOf(before), reflect.ValueOf(after))
+	return d.changes
+}
+
+// Paths the paths of the changes
+func Paths(changes []Change) []string {
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	return paths
+}
+
+// compare walks before and after together, an invalid value means the value is absent on that side
+func (d *differ) compare(path string, before, after reflect.Value) {
+	if d.ignored[path] {
+		return
+	}
+	before, after = indirect(before), indirect(after)
+	if !before.IsValid() && !after.IsValid() {
+		return
+	}
+
+	if before.IsValid() && after.IsValid() && before.Type() != after.Type() || isLeaf(before) || isLeaf(after) {
+		d.compareLeaf(path, before, after)
+		return
+	}
+
+	switch value(before, after).Kind() {
+	case reflect.Struct:
+		d.compareStructs(path, before, after)
+	case reflect.Map:
+		d.compareMaps(path, before, after)
+	case reflect.Slice, reflect.Array:
+		d.compareSlices(path, before, after)
+	default:
+		d.compareLeaf(path, before, after)
+	}
+}
+
+func (d *differ) compareStructs(path string, before, after reflect.Value) {
+	t := value(before, after).Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+		b, a := fieldValue(before, i), fieldValue(after, i)
+		// embedded structs without a JSON name are flattened into their parent, like encoding/json does
+		if name == "" {
+			d.compare(path, b, a)
+			continue
+		}
+		fieldPath := join(path, name)
+		if field.Tag.Get("diff") == "sensitive" || redact.IsSensitive(field) {
+			d.compareSensitive(fieldPath, b, a)
+			continue
+		}
+		d.compare(fieldPath, b, a)
+	}
+}
+
+func (d *differ) compareMaps(path string, before, after reflect.Value) {
+	keys := map[string]reflect.Value{}
+	for _, m := range []reflect.Value{before, after} {
+		if !m.IsValid() {
+			continue
+		}
+		for _, key := range m.MapKeys() {
+			keys[fmt.Sprint(key.Interface())] = key
+		}
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := keys[name]
+		d.compare(join(path, name), mapValue(before, key), mapValue(after, key))
+	}
+}
+
+func (d *differ) compareSlices(path string, before, after reflect.Value) {
+	length := 0
+	for _, s := range []reflect.Value{before, after} {
+		if s.IsValid() && s.Len() > length {
+			length = s.Len()
+		}
+	}
+	for i := 0; i < length; i++ {
+		d.compare(fmt.Sprintf("%s[%d]", path, i), index(before, i), index(after, i))
+	}
+}
+
+func (d *differ) compareLeaf(path string, before, after reflect.Value) {
+	switch {
+	case !before.IsValid():
+		d.changes = append(d.changes, Change{Path: path, Op: OpAdd, To: after.Interface()})
+	case !after.IsValid():
+		d.changes = append(d.changes, Change{Path: path, Op: OpRemove, From: before.Interface()})
+	case !equal(before, after):
+		d.changes = append(d.changes, Change{Path: path, Op: OpReplace, From: before.Interface(), To: after.Interface()})
+	}
+}
+
+// compareSensitive records that a sensitive value changed without recording the values
+func (d *differ) compareSensitive(path string, before, after reflect.Value) {
+	before, after = indirect(before), indirect(after)
+	switch {
+	case !before.IsValid() && !after.IsValid():
+	case !before.IsValid():
+		d.changes = append(d.changes, Change{Path: path, Op: OpAdd, To: Masked})
+	case !after.IsValid():
+		d.changes = append(d.changes, Change{Path: path, Op: OpRemove, From: Masked})
+	case !equal(before, after):
+		d.changes = append(d.changes, Change{Path: path, Op: OpReplace, From: Masked, To: Masked})
+	}
+}
+
+// isLeaf whether v is compared as a whole, values that marshal themselves such as null.String, sql.NullString or time.Time
+// are leaves because their fields don't mean anything to API clients
+func isLeaf(v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	t := v.Type()
+	if t == timeType || t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return true
+	}
+	for _, leaf := range []reflect.Type{jsonMarshalerType, textMarshalerType, valuerType} {
+		if t.Implements(leaf) || reflect.PointerTo(t).Implements(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(before, after reflect.Value) bool {
+	if before.Type() != after.Type() {
+		return false
+	}
+	if before.Type() == timeType {
+		return before.Interface().(time.Time).Equal(after.Interface().(time.Time))
+	}
+	if isLeaf(before) && before.Kind() != reflect.Slice {
+		b, errB := json.Marshal(before.Interface())
+		a, errA := json.Marshal(after.Interface())
+		if errB == nil && errA == nil {
+			return string(b) == string(a)
+		}
+	}
+	return reflect.DeepEqual(before.Interface(), after.Interface())
+}
+
+// indirect dereferences pointers and interfaces, nil ones become invalid values
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// fieldName the JSON name of an exported field, empty for embedded structs that are flattened, false for skipped fields
+func fieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" || field.Tag.Get("diff") == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" && field.Anonymous && indirectType(field.Type).Kind() == reflect.Struct {
+		// the exported fields of unexported embedded structs are still accessible
+		return "", field.IsExported() || field.Type.Kind() == reflect.Struct
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, field.IsExported()
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func value(before, after reflect.Value) reflect.Value {
+	if before.IsValid() {
+		return before
+	}
+	return after
+}
+
+func fieldValue(v reflect.Value, i int) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	return v.Field(i)
+}
+
+func mapValue(m reflect.Value, key reflect.Value) reflect.Value {
+	if !m.IsValid() {
+		return m
+	}
+	return m.MapIndex(key)
+}
+
+func index(s reflect.Value, i int) reflect.Value {
+	if !s.IsValid() || i >= s.Len() {
+		return reflect.Value{}
+	}
+	return s.Index(i)
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diff
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type (
+	metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+
+	container struct {
+		Image string `json:"image"`
+	}
+
+	deployment struct {
+		metadata
+		Replicas   *int           `json:"replicas"`
+		Containers []container    `json:"containers"`
+		Token      string         `json:"token" diff:"sensitive"`
+		UpdatedAt  time.Time      `json:"updatedAt"`
+		Owner      sql.NullString `json:"owner"`
+		Internal   string         `json:"internal" diff:"-"`
+		Cache      string         `json:"-"`
+		notes      string
+	}
+)
+
+func TestCompare(t *testing.T) {
+	one, three := 1, 3
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	before := deployment{
+		metadata:   metadata{Name: "web", Labels: map[string]string{"app": "web", "team": "a"}},
+		Replicas:   &one,
+		Containers: []container{{Image: "nginx:1"}},
+		Token:      "secret-1",
+		UpdatedAt:  now,
+		Internal:   "x",
+		Cache:      "x",
+		notes:      "x",
+	}
+	after := deployment{
+		metadata:   metadata{Name: "web", Labels: map[string]string{"app": "web", "tier": "frontend"}},
+		Replicas:   &three,
+		Containers: []container{{Image: "nginx:2"}, {Image: "envoy:1"}},
+		Token:      "secret-2",
+		UpdatedAt:  now.In(time.FixedZone("CEST", 2*60*60)),
+		Owner:      sql.NullString{String: "team-a", Valid: true},
+		Internal:   "y",
+		Cache:      "y",
+		notes:      "y",
+	}
+
+	assert.Equal(t, []Change{
+		{Path: "labels.team", Op: OpRemove, From: "a"},
+		{Path: "labels.tier", Op: OpAdd, To: "frontend"},
+		{Path: "replicas", Op: OpReplace, From: 1, To: 3},
+		{Path: "containers[0].image", Op: OpReplace, From: "nginx:1", To: "nginx:2"},
+		{Path: "containers[1].image", Op: OpAdd, To: "envoy:1"},
+		{Path: "token", Op: OpReplace, From: Masked, To: Masked},
+		{Path: "owner", Op: OpReplace, From: sql.NullString{}, To: sql.NullString{String: "team-a", Valid: true}},
+	}, Compare(before, after))
+}
+
+func TestCompareNil(t *testing.T) {
+	assert.Empty(t, Compare(nil, nil))
+	assert.Empty(t, Compare(&deployment{}, &deployment{}))
+
+	changes := Compare(nil, &metadata{Name: "web"})
+	assert.Equal(t, []Change{{Path: "name", Op: OpAdd, To: "web"}}, changes)
+
+	changes = Compare(&deployment{Token: "secret"}, nil)
+	assert.Contains(t, changes, Change{Path: "token", Op: OpRemove, From: Masked})
+}
+
+func TestIgnore(t *testing.T) {
+	changes := Compare(
+		metadata{Name: "web", Labels: map[string]string{"app": "web"}},
+		metadata{Name: "api", Labels: map[string]string{"app": "api"}},
+		Ignore("labels"),
+	)
+	assert.Equal(t, []string{"name"}, Paths(changes))
+}
+
+func TestCompareSensitiveTag(t *testing.T) {
+	type credentials struct {
+		User     string `json:"user"`
+		Password string `json:"password" sensitive:"true"`
+	}
+	changes := Compare(credentials{User: "admin", Password: "one"}, credentials{User: "admin", Password: "two"})
+	assert.Equal(t, []Change{{Path: "password", Op: OpReplace, From: Masked, To: Masked}}, changes)
+}
@@ -0,0 +1,426 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package downstream applies the resilience policy of the dependencies of a service, a timeout, a bulkhead that limits
+// concurrent calls and a circuit breaker, declared by name in one place instead of literals scattered across call sites:
+//
+//	downstreams:
+//	  default:
+//	    timeout: 10s
+//	  dependencies:
+//	    billing:
+//	      timeout: 2s
+//	      maxConcurrency: 20
+//	      circuit:
+//	        failureThreshold: 5
+//	        openDuration: 30s
+//
+// Calls are wrapped with the policy of their dependency, HTTP clients with Dependency.RoundTripper and anything else,
+// such as SQL queries or temporal clients, with Call or Do:
+//
+//	billing := downstreams.Get("billing")
+//	httpClient.Transport = billing.RoundTripper(httpClient.Transport)
+//
+//	invoice, err := downstream.Do(ctx, downstreams.Get("mysql"), func(ctx context.Context) (*models.Invoice, error) {
+//		return models.FindInvoice(ctx, db, id)
+//	})
+package downstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	callsMetric = "downstream.calls"
+
+	outcomeSuccess      = "success"
+	outcomeFailure      = "failure"
+	outcomeTimeout      = "timeout"
+	outcomeBulkheadFull = "bulkheadFull"
+	outcomeCircuitOpen  = "circuitOpen"
+
+	defaultOpenDuration = 30 * time.Second
+)
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var (
+	// ErrBulkheadFull the dependency already has MaxConcurrency calls in flight
+	ErrBulkheadFull = errors.New("downstream bulkhead is full")
+	// ErrCircuitOpen the dependency has failed too often, calls are rejected until the circuit lets a trial call through
+	ErrCircuitOpen = errors.New("downstream circuit is open")
+)
+
+type (
+	Configuration struct {
+		// Default the policy of dependencies that aren't declared, no limits unless set
+		Default Policy
+		// Dependencies the policies of the dependencies of the service by name
+		Dependencies map[string]Policy
+	}
+
+	// Policy how the calls to a dependency are limited, the zero value doesn't limit them at all
+	Policy struct {
+		// Timeout the deadline of every call, 0 for none
+		Timeout time.Duration
+		// MaxConcurrency the calls that may be in flight at once, 0 for no limit
+		MaxConcurrency int
+		// MaxWait how long a call waits for one of the MaxConcurrency slots before it is rejected with ErrBulkheadFull, 0 rejects it right away
+		MaxWait time.Duration
+		// Circuit when to stop calling a failing dependency
+		Circuit CircuitConfiguration
+	}
+
+	// CircuitConfiguration a circuit opens after FailureThreshold consecutive failures and rejects calls with ErrCircuitOpen.
+	// After OpenDuration a single trial call is let through, which closes the circuit if it succeeds and opens it again if it doesn't
+	CircuitConfiguration struct {
+		// FailureThreshold the consecutive failures that open the circuit, 0 disables the circuit
+		FailureThreshold int
+		// OpenDuration how long the circuit stays open before a trial call, defaults to 30s
+		OpenDuration time.Duration
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config  Configuration `optional:"true"`
+		Log     *zap.SugaredLogger
+		Metrics metrics.MetricsSvc `optional:"true"`
+		Clock   clock.Clock        `optional:"true"`
+	}
+
+	// Downstreams the dependencies of the service, each with the state of its bulkhead and circuit
+	Downstreams struct {
+		config       Configuration
+		log          *zap.SugaredLogger
+		metrics      metrics.MetricsSvc
+		clock        clock.Clock
+		mu           sync.Mutex
+		dependencies map[string]*Dependency
+	}
+
+	// Dependency a named dependency that calls are made to with its Policy
+	Dependency struct {
+		name    string
+		policy  Policy
+		slots   chan struct{}
+		circuit *circuit
+		log     *zap.SugaredLogger
+		metrics metrics.MetricsSvc
+		clock   clock.Clock
+	}
+
+	circuitState int
+
+	circuit struct {
+		config   CircuitConfiguration
+		clock    clock.Clock
+		mu       sync.Mutex
+		state    circuitState
+		failures int
+		openedAt time.Time
+		// trial whether the trial call of a half open circuit is in flight
+		trial bool
+	}
+
+	roundTripper struct {
+		dependency *Dependency
+		base       http.RoundTripper
+	}
+
+	// cancelOnClose cancels the timeout of an HTTP call once its body is closed, rather than when the round trip returns
+	cancelOnClose struct {
+		io.ReadCloser
+		cancel context.CancelFunc
+	}
+
+	// statusError a response that counts as a failure of the dependency
+	statusError struct {
+		status int
+	}
+)
+
+var Module = fx.Module("downstream", fx.Provide(New))
+
+// New creates the Downstreams of the configuration
+func New(p Parameters) *Downstreams {
+	return &Downstreams{
+		config:       p.Config,
+		log:          p.Log,
+		metrics:      p.Metrics,
+		clock:        clock.OrDefault(p.Clock),
+		dependencies: make(map[string]*Dependency),
+	}
+}
+
+// Get the dependency with the name, dependencies that aren't declared get the default policy.
+// Every call for a name shares the same bulkhead and circuit
+func (d *Downstreams) Get(name string) *Dependency {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dependency, ok := d.dependencies[name]; ok {
+		return dependency
+	}
+
+	policy, ok := d.config.Dependencies[name]
+	if !ok {
+		policy = d.config.Default
+		d.log.Debugw("downstream dependency is not declared, using the default policy", "downstream", name)
+	}
+	dependency := &Dependency{
+		name:    name,
+		policy:  policy,
+		log:     d.log,
+		metrics: d.metrics,
+		clock:   d.clock,
+	}
+	if policy.MaxConcurrency > 0 {
+		dependency.slots = make(chan struct{}, policy.MaxConcurrency)
+	}
+	if policy.Circuit.FailureThreshold > 0 {
+		dependency.circuit = newCircuit(policy.Circuit, d.clock)
+	}
+	d.dependencies[name] = dependency
+	return dependency
+}
+
+// Do calls fn with the policy of the dependency, see Dependency.Call
+func Do[T any](ctx context.Context, dependency *Dependency, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	err := dependency.Call(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	})
+	return result, err
+}
+
+// Name the name the dependency was declared with
+func (d *Dependency) Name() string {
+	return d.name
+}
+
+// Call calls fn with the policy of the dependency. It returns ErrBulkheadFull or ErrCircuitOpen without calling fn when the
+// dependency can't take the call, otherwise the error of fn. Errors of fn count as failures of the dependency, unless ctx
+// was canceled by the caller
+func (d *Dependency) Call(ctx context.Context, fn func(ctx context.Context) error) error {
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if d.policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.policy.Timeout)
+		defer cancel()
+	}
+	err = fn(ctx)
+	d.done(ctx, err)
+	return err
+}
+
+// RoundTripper wraps base, or http.DefaultTransport if it is nil, so that requests are made with the policy of the dependency.
+// Responses with a 5xx status code count as failures of the dependency but are returned as is
+func (d *Dependency) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &roundTripper{dependency: d, base: base}
+}
+
+func (r *roundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	d := r.dependency
+	ctx := request.Context()
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cancel := context.CancelFunc(func() {})
+	if d.policy.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d.policy.Timeout)
+		request = request.WithContext(ctx)
+	}
+	response, err := r.base.RoundTrip(request)
+	if err != nil {
+		cancel()
+		d.done(ctx, err)
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		d.done(ctx, &statusError{status: response.StatusCode})
+	} else {
+		d.done(ctx, nil)
+	}
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// acquire takes a slot of the bulkhead and checks the circuit, the returned func gives the slot back
+func (d *Dependency) acquire(ctx context.Context) (func(), error) {
+	if d.circuit != nil && !d.circuit.allow() {
+		d.record(outcomeCircuitOpen)
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, d.name)
+	}
+
+	if d.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-d.slots }
+	select {
+	case d.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if d.policy.MaxWait > 0 {
+		timer := d.clock.NewTimer(d.policy.MaxWait)
+		defer timer.Stop()
+		select {
+		case d.slots <- struct{}{}:
+			return release, nil
+		case <-ctx.Done():
+			d.abandonTrial()
+			return nil, ctx.Err()
+		case <-timer.C():
+		}
+	}
+	d.abandonTrial()
+	d.record(outcomeBulkheadFull)
+	return nil, fmt.Errorf("%w: %s has %d calls in flight", ErrBulkheadFull, d.name, d.policy.MaxConcurrency)
+}
+
+// done records the outcome of a call
+func (d *Dependency) done(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		d.record(outcomeSuccess)
+	case errors.Is(ctx.Err(), context.Canceled):
+		// the caller gave up, which says nothing about the dependency
+		d.abandonTrial()
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		d.record(outcomeTimeout)
+	default:
+		d.record(outcomeFailure)
+	}
+
+	if d.circuit == nil {
+		return
+	}
+	if opened := d.circuit.done(err == nil); opened {
+		d.log.Warnw("downstream circuit opened", "downstream", d.name, "error", err)
+	}
+}
+
+func (d *Dependency) abandonTrial() {
+	if d.circuit != nil {
+		d.circuit.abandonTrial()
+	}
+}
+
+func (d *Dependency) record(outcome string) {
+	if d.metrics == nil {
+		return
+	}
+	d.metrics.CounterWithTags(callsMetric, map[string]string{
+		"downstream": d.name,
+		"outcome":    outcome,
+	}).Inc(1)
+}
+
+func newCircuit(config CircuitConfiguration, c clock.Clock) *circuit {
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaultOpenDuration
+	}
+	return &circuit{config: config, clock: c}
+}
+
+// allow whether a call may be made, a half open circuit allows a single trial call
+func (c *circuit) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if c.clock.Since(c.openedAt) < c.config.OpenDuration {
+			return false
+		}
+		c.state = circuitHalfOpen
+		c.trial = true
+		return true
+	case circuitHalfOpen:
+		if c.trial {
+			return false
+		}
+		c.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the outcome of an allowed call, it returns true when the call opened the circuit
+func (c *circuit) done(success bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+	if success {
+		c.state = circuitClosed
+		c.failures = 0
+		return false
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.config.FailureThreshold {
+		opened := c.state != circuitOpen
+		c.state = circuitOpen
+		c.openedAt = c.clock.Now()
+		return opened
+	}
+	return false
+}
+
+// abandonTrial lets another call be the trial call of a half open circuit when the trial call was never made or its caller gave up
+func (c *circuit) abandonTrial() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("downstream responded with %d", e.status)
+}
@@ -0,0 +1,178 @@
+package downstream
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newDownstreams(t *testing.T, config Configuration, c clock.Clock) (*Downstreams, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(callsMetric, gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	return New(Parameters{Config: config, Log: zap.NewNop().Sugar(), Metrics: ms, Clock: c}), scope
+}
+
+func outcomes(scope tally.TestScope) map[string]int64 {
+	counts := map[string]int64{}
+	for _, counter := range scope.Snapshot().Counters() {
+		counts[counter.Tags()["outcome"]] += counter.Value()
+	}
+	return counts
+}
+
+func TestTimeout(t *testing.T) {
+	downstreams, scope := newDownstreams(t, Configuration{Default: Policy{Timeout: 10 * time.Millisecond}}, nil)
+
+	err := downstreams.Get("billing").Call(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	invoice, err := Do(context.Background(), downstreams.Get("billing"), func(ctx context.Context) (string, error) {
+		return "invoice", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "invoice", invoice)
+	assert.Equal(t, map[string]int64{outcomeTimeout: 1, outcomeSuccess: 1}, outcomes(scope))
+}
+
+func TestBulkhead(t *testing.T) {
+	downstreams, scope := newDownstreams(t, Configuration{Dependencies: map[string]Policy{
+		"billing": {MaxConcurrency: 1},
+	}}, nil)
+	billing := downstreams.Get("billing")
+	assert.Same(t, billing, downstreams.Get("billing"), "calls to a dependency share its bulkhead")
+
+	inFlight, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = billing.Call(context.Background(), func(context.Context) error {
+			close(inFlight)
+			<-release
+			return nil
+		})
+	}()
+	<-inFlight
+
+	called := false
+	err := billing.Call(context.Background(), func(context.Context) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrBulkheadFull)
+	assert.EqualError(t, err, "downstream bulkhead is full: billing has 1 calls in flight")
+	assert.False(t, called)
+
+	assert.NoError(t, downstreams.Get("search").Call(context.Background(), func(context.Context) error { return nil }),
+		"dependencies without a policy aren't limited")
+	close(release)
+	assert.Equal(t, int64(1), outcomes(scope)[outcomeBulkheadFull])
+}
+
+func TestBulkheadWait(t *testing.T) {
+	fake := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	downstreams, _ := newDownstreams(t, Configuration{Default: Policy{MaxConcurrency: 1, MaxWait: time.Second}}, fake)
+	billing := downstreams.Get("billing")
+
+	inFlight, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = billing.Call(context.Background(), func(context.Context) error {
+			close(inFlight)
+			<-release
+			return nil
+		})
+	}()
+	<-inFlight
+
+	result := make(chan error)
+	go func() {
+		result <- billing.Call(context.Background(), func(context.Context) error { return nil })
+	}()
+	close(release)
+	assert.NoError(t, <-result, "waiting calls get the slot once it is given back")
+}
+
+func TestCircuit(t *testing.T) {
+	fake := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	downstreams, scope := newDownstreams(t, Configuration{Dependencies: map[string]Policy{
+		"billing": {Circuit: CircuitConfiguration{FailureThreshold: 2, OpenDuration: time.Minute}},
+	}}, fake)
+	billing := downstreams.Get("billing")
+	failure := errors.New("unavailable")
+	calls := 0
+	call := func(err error) error {
+		return billing.Call(context.Background(), func(context.Context) error {
+			calls++
+			return err
+		})
+	}
+
+	assert.Equal(t, failure, call(failure))
+	assert.NoError(t, call(nil), "successes reset the consecutive failures")
+	assert.Equal(t, failure, call(failure))
+	assert.Equal(t, failure, call(failure))
+	assert.ErrorIs(t, call(nil), ErrCircuitOpen)
+	assert.Equal(t, 4, calls)
+
+	fake.Advance(time.Minute)
+	assert.Equal(t, failure, call(failure), "a failed trial call opens the circuit again")
+	assert.ErrorIs(t, call(nil), ErrCircuitOpen)
+
+	fake.Advance(time.Minute)
+	assert.NoError(t, call(nil))
+	assert.NoError(t, call(nil), "a successful trial call closes the circuit")
+	assert.Equal(t, 7, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		_ = billing.Call(ctx, func(ctx context.Context) error { return ctx.Err() })
+	}
+	assert.NoError(t, call(nil), "calls the caller gave up on aren't failures")
+	assert.Equal(t, map[string]int64{outcomeFailure: 4, outcomeSuccess: 4, outcomeCircuitOpen: 2}, outcomes(scope))
+}
+
+func TestRoundTripper(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	downstreams, scope := newDownstreams(t, Configuration{Default: Policy{
+		Timeout: time.Second,
+		Circuit: CircuitConfiguration{FailureThreshold: 1},
+	}}, nil)
+	client := &http.Client{Transport: downstreams.Get("billing").RoundTripper(nil)}
+
+	response, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode, "5xx responses are returned as is")
+	_ = response.Body.Close()
+
+	status = http.StatusOK
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrCircuitOpen, "5xx responses count as failures")
+
+	response, err = (&http.Client{Transport: downstreams.Get("search").RoundTripper(nil)}).Get(server.URL)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err, "the body can be read after the round trip returned")
+	assert.Equal(t, "body", string(body))
+	_ = response.Body.Close()
+	assert.Equal(t, map[string]int64{outcomeFailure: 1, outcomeCircuitOpen: 1, outcomeSuccess: 1}, outcomes(scope))
+}
@@ -27,9 +27,13 @@ const (
 	armoryReplicaSetName     = "ARMORY_REPLICA_SET_NAME"
 	armoryApplicationVersion = "ARMORY_APPLICATION_VERSION"
 	armoryDeploymentId       = "ARMORY_DEPLOYMENT_ID"
+	armoryRegion             = "ARMORY_REGION"
+	armoryPartition          = "ARMORY_PARTITION"
 	applicationName          = "APPLICATION_NAME"
 	applicationEnv           = "APPLICATION_ENVIRONMENT"
 	applicationVersion       = "APPLICATION_VERSION"
+	applicationRegion        = "APPLICATION_REGION"
+	applicationPartition     = "APPLICATION_PARTITION"
 	LoggerType               = "LOGGER_TYPE"
 	LoggerLevel              = "LOGGER_LEVEL"
 	local                    = "local"
@@ -100,3 +104,36 @@ func GetDeploymentId() string {
 	}
 	return depId
 }
+
+// GetRegion returns the value of APPLICATION_REGION or ARMORY_REGION, the region the application is serving, else an empty string
+func GetRegion() string {
+	region := os.Getenv(applicationRegion)
+	if region == "" {
+		region = os.Getenv(armoryRegion)
+	}
+	return strings.ToLower(region)
+}
+
+// GetPartition returns the value of APPLICATION_PARTITION or ARMORY_PARTITION, the isolated set of regions the application belongs to
+// such as a commercial or government cloud, else an empty string
+func GetPartition() string {
+	partition := os.Getenv(applicationPartition)
+	if partition == "" {
+		partition = os.Getenv(armoryPartition)
+	}
+	return strings.ToLower(partition)
+}
+
+// IsDev whether the environment or one of the profiles is local, dev or development and neither is a prod one. Features that
+// expose internals, such as extended errors, downstream mocks and store inspection, are only enabled when it is
+func IsDev(environment string, profiles []string) bool {
+	dev := false
+	for _, name := range append([]string{environment}, profiles...) {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "prod") {
+			return false
+		}
+		dev = dev || name == local || name == "dev" || name == "development"
+	}
+	return dev
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package envutils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsDev(t *testing.T) {
+	cases := []struct {
+		environment string
+		profiles    []string
+		dev         bool
+	}{
+		{environment: "local", dev: true},
+		{environment: "Development", dev: true},
+		{profiles: []string{"dev"}, dev: true},
+		{environment: "staging", profiles: []string{"dev"}, dev: true},
+		{environment: "staging"},
+		{environment: ""},
+		{environment: "production", profiles: []string{"dev"}},
+		{environment: "local", profiles: []string{"prod"}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.dev, IsDev(c.environment, c.profiles), "%s %v", c.environment, c.profiles)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cache caches the responses of outbound GET requests following the semantics of a private cache of RFC 9111, so
+// frequently polled endpoints such as agent metadata and JWKS are only requested again once their responses are stale, and then
+// revalidated with their ETag or Last-Modified when they have one:
+//
+//	fx.New(
+//		cache.Module,
+//		client.Module,
+//	)
+//
+//	httpClientCache:
+//	  enabled: true
+//	  maxEntries: 1000
+//
+// Responses are stored in memory unless a Store is provided, they are only stored when they have an explicit or heuristic
+// freshness lifetime or a validator.
+package cache
+
+import (
+	"bytes"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"go.uber.org/fx"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// StatusHeader is set on the responses of cached requests, ex: X-Armory-Cache: HIT
+	StatusHeader = "X-Armory-Cache"
+
+	StatusHit         = "HIT"
+	StatusMiss        = "MISS"
+	StatusRevalidated = "REVALIDATED"
+
+	requestsMetric = "http.client.cache.requests"
+
+	outcomeBypass = "bypass"
+
+	defaultMaxEntries    = 1000
+	defaultMaxEntryBytes = 1 << 20
+	// maxHeuristicFreshness caps the freshness of responses that only have a Last-Modified date
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+var (
+	Module = fx.Module("httpcache", fx.Provide(New))
+
+	// heuristicallyCacheable the statuses of responses that can be stored without explicit freshness, RFC 9110 section 15.1
+	heuristicallyCacheable = map[int]bool{
+		http.StatusOK:                   true,
+		http.StatusNonAuthoritativeInfo: true,
+		http.StatusNoContent:            true,
+		http.StatusMultipleChoices:      true,
+		http.StatusMovedPermanently:     true,
+		http.StatusPermanentRedirect:    true,
+		http.StatusNotFound:             true,
+		http.StatusMethodNotAllowed:     true,
+		http.StatusGone:                 true,
+		http.StatusRequestURITooLong:    true,
+		http.StatusNotImplemented:       true,
+	}
+)
+
+type (
+	Configuration struct {
+		// Enabled caches the responses of the GET requests of the HTTP clients of the core package
+		Enabled bool
+		// MaxEntries the number of responses kept by the in memory store, the least recently used are evicted first. Defaults to 1000
+		MaxEntries int
+		// MaxEntryBytes the size of the largest body that is stored, defaults to 1MB
+		MaxEntryBytes int
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config  Configuration      `optional:"true"`
+		Store   Store              `optional:"true"`
+		Metrics metrics.MetricsSvc `optional:"true"`
+		Clock   clock.Clock        `optional:"true"`
+	}
+
+	// Cache the responses of outbound requests, nil when caching is disabled
+	Cache struct {
+		store         Store
+		maxEntryBytes int
+		metrics       metrics.MetricsSvc
+		clock         clock.Clock
+	}
+
+	roundTripper struct {
+		cache *Cache
+		base  http.RoundTripper
+	}
+
+	cacheControl map[string]string
+)
+
+// New creates the Cache of the configuration, nil when caching is disabled. Responses are stored in memory unless a Store is provided
+func New(params Parameters) *Cache {
+	config := params.Config
+	if !config.Enabled {
+		return nil
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultMaxEntries
+	}
+	if config.MaxEntryBytes <= 0 {
+		config.MaxEntryBytes = defaultMaxEntryBytes
+	}
+	store := params.Store
+	if store == nil {
+		store = NewMemoryStore(config.MaxEntries)
+	}
+	return &Cache{store: store, maxEntryBytes: config.MaxEntryBytes, metrics: params.Metrics, clock: clock.OrDefault(params.Clock)}
+}
+
+// RoundTripper wraps base to answer requests from the cache, base is returned as is when caching is disabled
+func (c *Cache) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return base
+	}
+	return &roundTripper{cache: c, base: base}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := rt.cache
+	ctx := req.Context()
+	key := cacheKey(req)
+	if req.Method != http.MethodGet {
+		res, err := rt.base.RoundTrip(req)
+		// successful unsafe requests invalidate the stored response of their target, RFC 9111 section 4.4
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && res.StatusCode < 400 {
+			c.store.Delete(ctx, key)
+		}
+		return res, err
+	}
+
+	requestCC := parseCacheControl(req.Header)
+	if requestCC.has("no-store") || req.Header.Get("Range") != "" || hasConditions(req.Header) {
+		c.record(req, outcomeBypass)
+		return rt.base.RoundTrip(req)
+	}
+
+	now := c.clock.Now()
+	entry, ok := c.store.Get(ctx, key)
+	if ok && !entry.matches(req) {
+		entry, ok = nil, false
+	}
+	if ok && entry.fresh(now, requestCC) {
+		c.record(req, StatusHit)
+		return entry.response(req, now, StatusHit), nil
+	}
+
+	outgoing := req
+	if ok && entry.hasValidators() {
+		outgoing = req.Clone(ctx)
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outgoing.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outgoing.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	res, err := rt.base.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	respondedAt := c.clock.Now()
+
+	if outgoing != req && res.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		entry = entry.refreshed(res.Header, now, respondedAt)
+		c.store.Set(ctx, key, entry)
+		c.record(req, StatusRevalidated)
+		return entry.response(req, respondedAt, StatusRevalidated), nil
+	}
+
+	c.record(req, StatusMiss)
+	res.Header.Set(StatusHeader, StatusMiss)
+	if !storable(res) {
+		return res, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, int64(c.maxEntryBytes)+1))
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, err
+	}
+	if len(body) > c.maxEntryBytes {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	_ = res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := res.Header.Clone()
+	header.Del(StatusHeader)
+	c.store.Set(ctx, key, &Entry{
+		StatusCode:  res.StatusCode,
+		Header:      header,
+		Body:        body,
+		VaryHeader:  varyHeader(req, res.Header),
+		RequestedAt: now,
+		RespondedAt: respondedAt,
+	})
+	return res, nil
+}
+
+func (c *Cache) record(req *http.Request, outcome string) {
+	if c.metrics == nil {
+		return
+	}
+	c.metrics.CounterWithTags(requestsMetric, map[string]string{"host": req.URL.Host, "outcome": strings.ToLower(outcome)}).Inc(1)
+}
+
+// cacheKey the key of the responses of the target of the request
+func cacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+// hasConditions whether the caller validates a response of its own, its request is sent as is
+func hasConditions(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+}
+
+// storable whether the response may be stored, RFC 9111 section 3
+func storable(res *http.Response) bool {
+	if !heuristicallyCacheable[res.StatusCode] {
+		return false
+	}
+	cc := parseCacheControl(res.Header)
+	if cc.has("no-store") || strings.TrimSpace(res.Header.Get("Vary")) == "*" {
+		return false
+	}
+	return cc.has("max-age") || res.Header.Get("Expires") != "" || res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != ""
+}
+
+// varyHeader the values of the request headers the response varies on
+func varyHeader(req *http.Request, header http.Header) http.Header {
+	vary := http.Header{}
+	for _, names := range header.Values("Vary") {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	return vary
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds the delta-seconds argument of the directive, false when it is missing or invalid
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
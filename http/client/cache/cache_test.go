@@ -0,0 +1,205 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type origin struct {
+	requests []*http.Request
+	respond  func(req *http.Request) *http.Response
+}
+
+func (o *origin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.requests = append(o.requests, req)
+	return o.respond(req), nil
+}
+
+func respond(status int, body string, header ...string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+	for i := 0; i+1 < len(header); i += 2 {
+		res.Header.Add(header[i], header[i+1])
+	}
+	return res
+}
+
+func newTestCache(t *testing.T, fake *clock.Fake, o *origin) (*http.Client, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	c := New(Parameters{Config: Configuration{Enabled: true, MaxEntryBytes: 16}, Metrics: ms, Clock: fake})
+	return &http.Client{Transport: c.RoundTripper(o)}, scope
+}
+
+func get(t *testing.T, client *http.Client, url string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestCacheFreshnessAndRevalidation(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	o := &origin{respond: func(req *http.Request) *http.Response {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return respond(http.StatusNotModified, "", "ETag", `"v1"`, "Cache-Control", "max-age=60")
+		}
+		return respond(http.StatusOK, "keys", "ETag", `"v1"`, "Cache-Control", "max-age=60")
+	}}
+	client, scope := newTestCache(t, fake, o)
+	url := "http://agents.internal/.well-known/jwks.json"
+
+	res, body := get(t, client, url)
+	assert.Equal(t, StatusMiss, res.Header.Get(StatusHeader))
+	assert.Equal(t, "keys", body)
+
+	fake.Advance(30 * time.Second)
+	res, body = get(t, client, url)
+	assert.Equal(t, StatusHit, res.Header.Get(StatusHeader))
+	assert.Equal(t, "30", res.Header.Get("Age"))
+	assert.Equal(t, "keys", body)
+	assert.Len(t, o.requests, 1, "fresh responses are served from the cache")
+
+	res, _ = get(t, client, url, "Cache-Control", "max-age=10")
+	assert.Equal(t, StatusRevalidated, res.Header.Get(StatusHeader), "the request may ask for fresher responses")
+
+	fake.Advance(61 * time.Second)
+	res, body = get(t, client, url)
+	assert.Equal(t, StatusRevalidated, res.Header.Get(StatusHeader))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "keys", body)
+	require.Len(t, o.requests, 3)
+	assert.Equal(t, `"v1"`, o.requests[2].Header.Get("If-None-Match"), "stale responses are revalidated with their validators")
+
+	res, _ = get(t, client, url)
+	assert.Equal(t, StatusHit, res.Header.Get(StatusHeader), "revalidated responses are fresh again")
+
+	counters := scope.Snapshot().Counters()
+	assert.Equal(t, int64(2), counters[requestsMetric+"+host=agents.internal,outcome=hit"].Value())
+	assert.Equal(t, int64(1), counters[requestsMetric+"+host=agents.internal,outcome=miss"].Value())
+	assert.Equal(t, int64(2), counters[requestsMetric+"+host=agents.internal,outcome=revalidated"].Value())
+}
+
+func TestCacheStorability(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	lastModified := fake.Now().Add(-10 * time.Hour).Format(http.TimeFormat)
+	o := &origin{respond: func(req *http.Request) *http.Response {
+		switch req.URL.Path {
+		case "/no-store":
+			return respond(http.StatusOK, "secret", "Cache-Control", "no-store, max-age=60")
+		case "/no-validators":
+			return respond(http.StatusOK, "plain")
+		case "/large":
+			return respond(http.StatusOK, strings.Repeat("x", 32), "Cache-Control", "max-age=60")
+		case "/heuristic":
+			return respond(http.StatusOK, "metadata", "Last-Modified", lastModified, "Date", fake.Now().Format(http.TimeFormat))
+		case "/vary":
+			return respond(http.StatusOK, req.Header.Get("Accept"), "Cache-Control", "max-age=60", "Vary", "Accept")
+		default:
+			return respond(http.StatusInternalServerError, "", "Cache-Control", "max-age=60")
+		}
+	}}
+	client, _ := newTestCache(t, fake, o)
+
+	for _, path := range []string{"/no-store", "/no-validators", "/error"} {
+		get(t, client, "http://agents.internal"+path)
+		res, _ := get(t, client, "http://agents.internal"+path)
+		assert.Equal(t, StatusMiss, res.Header.Get(StatusHeader), path)
+	}
+
+	get(t, client, "http://agents.internal/large")
+	res, body := get(t, client, "http://agents.internal/large")
+	assert.Equal(t, StatusMiss, res.Header.Get(StatusHeader), "bodies above the max entry size aren't stored")
+	assert.Len(t, body, 32, "they are still read in full")
+
+	get(t, client, "http://agents.internal/heuristic")
+	fake.Advance(59 * time.Minute)
+	res, _ = get(t, client, "http://agents.internal/heuristic")
+	assert.Equal(t, StatusHit, res.Header.Get(StatusHeader), "responses with a Last-Modified date are fresh for a tenth of their age")
+
+	get(t, client, "http://agents.internal/vary", "Accept", "application/json")
+	res, body = get(t, client, "http://agents.internal/vary", "Accept", "application/yaml")
+	assert.Equal(t, StatusMiss, res.Header.Get(StatusHeader), "requests with other values of the Vary headers aren't answered")
+	assert.Equal(t, "application/yaml", body)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	o := &origin{respond: func(req *http.Request) *http.Response {
+		return respond(http.StatusOK, "agent", "Cache-Control", "max-age=60")
+	}}
+	client, _ := newTestCache(t, fake, o)
+	url := "http://agents.internal/agents/1"
+
+	get(t, client, url)
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader("agent"))
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+
+	res, _ = get(t, client, url)
+	assert.Equal(t, StatusMiss, res.Header.Get(StatusHeader), "successful unsafe requests invalidate the stored response")
+	res, _ = get(t, client, url, "Cache-Control", "no-store")
+	assert.Empty(t, res.Header.Get(StatusHeader), "requests that can't be stored bypass the cache")
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(2)
+	store.Set(ctx, "a", &Entry{StatusCode: 1})
+	store.Set(ctx, "b", &Entry{StatusCode: 2})
+	_, _ = store.Get(ctx, "a")
+	store.Set(ctx, "c", &Entry{StatusCode: 3})
+
+	_, ok := store.Get(ctx, "b")
+	assert.False(t, ok, "the least recently used entry is evicted")
+	entry, ok := store.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, entry.StatusCode)
+
+	store.Delete(ctx, "a")
+	_, ok = store.Get(ctx, "a")
+	assert.False(t, ok)
+}
+
+func TestNew(t *testing.T) {
+	assert.Nil(t, New(Parameters{}), "caching is disabled by default")
+	base := &origin{}
+	assert.Same(t, base, (*Cache)(nil).RoundTripper(base))
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Store keeps the responses of the cache by the URL of their request. Entries are shared between requests and must not be
+	// modified once they are set
+	Store interface {
+		Get(ctx context.Context, key string) (*Entry, bool)
+		Set(ctx context.Context, key string, entry *Entry)
+		Delete(ctx context.Context, key string)
+	}
+
+	// Entry a stored response
+	Entry struct {
+		StatusCode int         `json:"statusCode"`
+		Header     http.Header `json:"header"`
+		Body       []byte      `json:"body"`
+		// VaryHeader the values of the request headers named by the Vary header of the response, the entry only answers requests
+		// with the same values
+		VaryHeader http.Header `json:"varyHeader,omitempty"`
+		// RequestedAt when the request the response answered was sent
+		RequestedAt time.Time `json:"requestedAt"`
+		// RespondedAt when the response was received
+		RespondedAt time.Time `json:"respondedAt"`
+	}
+
+	// memoryStore keeps a bounded number of entries in memory, evicting the least recently used
+	memoryStore struct {
+		mu         sync.Mutex
+		maxEntries int
+		entries    map[string]*list.Element
+		lru        *list.List
+	}
+
+	memoryEntry struct {
+		key   string
+		entry *Entry
+	}
+)
+
+// NewMemoryStore creates a Store keeping up to maxEntries responses in memory
+func NewMemoryStore(maxEntries int) Store {
+	return &memoryStore{maxEntries: maxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(element)
+	return element.Value.(*memoryEntry).entry, true
+}
+
+func (s *memoryStore) Set(_ context.Context, key string, entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		element.Value.(*memoryEntry).entry = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, entry: entry})
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+func (s *memoryStore) Delete(_ context.Context, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+	}
+}
+
+// matches whether the request has the values of the headers the response varies on
+func (e *Entry) matches(req *http.Request) bool {
+	for name, values := range e.VaryHeader {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// fresh whether the entry can answer the request without being validated, RFC 9111 section 4.2
+func (e *Entry) fresh(now time.Time, requestCC cacheControl) bool {
+	cc := parseCacheControl(e.Header)
+	if cc.has("no-cache") || requestCC.has("no-cache") {
+		return false
+	}
+	lifetime := e.lifetime(cc)
+	if maxAge, ok := requestCC.seconds("max-age"); ok && maxAge < lifetime {
+		lifetime = maxAge
+	}
+	if minFresh, ok := requestCC.seconds("min-fresh"); ok {
+		lifetime -= minFresh
+	}
+	return e.age(now) < lifetime
+}
+
+// lifetime the freshness lifetime of the response, from its max-age, its Expires date or heuristically from its Last-Modified date
+func (e *Entry) lifetime(cc cacheControl) time.Duration {
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		// invalid dates, such as 0, mean the response already expired
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicFreshness {
+			lifetime = maxHeuristicFreshness
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// age the current age of the response, RFC 9111 section 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := e.RespondedAt.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + e.RespondedAt.Sub(e.RequestedAt)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.RespondedAt)
+}
+
+// date the Date of the response, when it was received without one
+func (e *Entry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.RespondedAt
+}
+
+// refreshed a copy of the entry updated with the headers of the 304 response that validated it, RFC 9111 section 3.2
+func (e *Entry) refreshed(header http.Header, requestedAt time.Time, respondedAt time.Time) *Entry {
+	refreshed := *e
+	refreshed.Header = e.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" || name == StatusHeader {
+			continue
+		}
+		refreshed.Header[name] = values
+	}
+	refreshed.RequestedAt = requestedAt
+	refreshed.RespondedAt = respondedAt
+	return &refreshed
+}
+
+// response the stored response as the answer to the request
+func (e *Entry) response(req *http.Request, now time.Time, status string) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	header.Set(StatusHeader, status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
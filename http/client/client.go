@@ -22,7 +22,11 @@ type (
 // NewAuthenticatedHTTPClient creates an http.Client that propagates OpenTelemetry trace headers and authenticates its requests
 // with a bearer token header.
 func NewAuthenticatedHTTPClient(supplier tokenSupplier, tracingConfig opentelemetry.Configuration) *http.Client {
-	c := core.NewHTTPClient(core.Parameters{Tracing: tracingConfig})
+	return newAuthenticatedHTTPClient(supplier, core.Parameters{Tracing: tracingConfig})
+}
+
+func newAuthenticatedHTTPClient(supplier tokenSupplier, params core.Parameters) *http.Client {
+	c := core.NewHTTPClient(params)
 
 	c.Transport = &bearerTokenRoundTripper{
 		tokenSupplier: supplier,
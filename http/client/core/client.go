@@ -1,6 +1,9 @@
 package core
 
 import (
+	"github.com/armory-io/go-commons/devmocks"
+	"github.com/armory-io/go-commons/http/client/cache"
+	"github.com/armory-io/go-commons/http/proxy"
 	"github.com/armory-io/go-commons/opentelemetry"
 	"github.com/hashicorp/go-cleanhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -11,12 +14,23 @@ import (
 type (
 	Parameters struct {
 		Tracing opentelemetry.Configuration `optional:"true"`
+		// Proxy routes requests through the configured outbound proxies, when not set the proxies of the environment are used
+		Proxy *proxy.Router `optional:"true"`
+		// Mocks answers the requests to unreachable downstreams with fixtures while developing locally, see devmocks
+		Mocks *devmocks.Mocks `optional:"true"`
+		// Cache answers GET requests with the stored responses that are still fresh, see cache
+		Cache *cache.Cache `optional:"true"`
 	}
 )
 
 // NewRoundTripper creates an http.RoundTripper that propagates OpenTelemetry trace headers.
 func NewRoundTripper(params Parameters) http.RoundTripper {
-	base := cleanhttp.DefaultTransport()
+	var base http.RoundTripper = cleanhttp.DefaultTransport()
+	if params.Proxy != nil {
+		base = params.Proxy.Transport(cleanhttp.DefaultTransport())
+	}
+	base = params.Mocks.RoundTripper(base)
+	base = params.Cache.RoundTripper(base)
 
 	if params.Tracing.Push.Enabled {
 		return otelhttp.NewTransport(
@@ -1,6 +1,10 @@
 package client
 
 import (
+	"github.com/armory-io/go-commons/devmocks"
+	"github.com/armory-io/go-commons/http/client/cache"
+	"github.com/armory-io/go-commons/http/client/core"
+	"github.com/armory-io/go-commons/http/proxy"
 	"github.com/armory-io/go-commons/oidc"
 	"github.com/armory-io/go-commons/opentelemetry"
 	"go.uber.org/fx"
@@ -12,10 +16,13 @@ type authenticatedHTTPClientParameters struct {
 
 	Identity *oidc.AccessTokenSupplier
 	Tracing  opentelemetry.Configuration `optional:"true"`
+	Proxy    *proxy.Router               `optional:"true"`
+	Mocks    *devmocks.Mocks             `optional:"true"`
+	Cache    *cache.Cache                `optional:"true"`
 }
 
 var Module = fx.Module("armory-http",
 	fx.Provide(func(params authenticatedHTTPClientParameters) *http.Client {
-		return NewAuthenticatedHTTPClient(params.Identity, params.Tracing)
+		return newAuthenticatedHTTPClient(params.Identity, core.Parameters{Tracing: params.Tracing, Proxy: params.Proxy, Mocks: params.Mocks, Cache: params.Cache})
 	}),
 )
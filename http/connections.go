@@ -0,0 +1,89 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+type (
+	// ConnectionStats the connections of a server
+	ConnectionStats struct {
+		// Accepted the number of connections accepted since the server started
+		Accepted uint64
+		// Active the number of open connections that are not idle, including new connections that haven't sent a request yet
+		Active int64
+		// Idle the number of open keep-alive connections waiting for a request
+		Idle int64
+	}
+
+	// ConnectionListener is called after a connection changes to state with the updated stats of the server
+	ConnectionListener func(state http.ConnState, stats ConnectionStats)
+
+	// connectionTracker counts connections from the http.Server ConnState callback, which only reports the new state of a connection,
+	// so the previous state of every open connection is remembered
+	connectionTracker struct {
+		mu        sync.Mutex
+		states    map[net.Conn]http.ConnState
+		current   ConnectionStats
+		listeners []ConnectionListener
+	}
+)
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{states: make(map[net.Conn]http.ConnState)}
+}
+
+func (t *connectionTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	previous, open := t.states[conn]
+	if previous == http.StateIdle && open {
+		t.current.Idle--
+	} else if open {
+		t.current.Active--
+	}
+
+	switch state {
+	case http.StateNew:
+		t.current.Accepted++
+		t.current.Active++
+		t.states[conn] = state
+	case http.StateActive:
+		t.current.Active++
+		t.states[conn] = state
+	case http.StateIdle:
+		t.current.Idle++
+		t.states[conn] = state
+	default:
+		// closed and hijacked connections are no longer managed by the server
+		delete(t.states, conn)
+	}
+	stats := t.current
+	t.mu.Unlock()
+
+	for _, listener := range t.listeners {
+		listener(state, stats)
+	}
+}
+
+func (t *connectionTracker) stats() ConnectionStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
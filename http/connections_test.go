@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tracker := newConnectionTracker()
+	var notified []http.ConnState
+	tracker.listeners = append(tracker.listeners, func(state http.ConnState, _ ConnectionStats) {
+		notified = append(notified, state)
+	})
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	tracker.track(first, http.StateNew)
+	tracker.track(second, http.StateNew)
+	assert.Equal(t, ConnectionStats{Accepted: 2, Active: 2}, tracker.stats())
+
+	tracker.track(first, http.StateActive)
+	tracker.track(first, http.StateIdle)
+	assert.Equal(t, ConnectionStats{Accepted: 2, Active: 1, Idle: 1}, tracker.stats())
+
+	tracker.track(first, http.StateClosed)
+	tracker.track(second, http.StateHijacked)
+	assert.Equal(t, ConnectionStats{Accepted: 2}, tracker.stats())
+	assert.Len(t, notified, 6)
+}
+
+func TestConnectionsWithDefaults(t *testing.T) {
+	defaulted := Connections{}.withDefaults()
+	assert.Equal(t, defaultReadHeaderTimeout, defaulted.ReadHeaderTimeout)
+	assert.Equal(t, defaultIdleTimeout, defaulted.IdleTimeout)
+	assert.Equal(t, http.DefaultMaxHeaderBytes, defaulted.MaxHeaderBytes)
+	assert.Zero(t, defaulted.ReadTimeout)
+
+	configured := Connections{ReadHeaderTimeout: time.Second, MaxHeaderBytes: 1024}.withDefaults()
+	assert.Equal(t, time.Second, configured.ReadHeaderTimeout)
+	assert.Equal(t, 1024, configured.MaxHeaderBytes)
+}
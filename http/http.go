@@ -21,8 +21,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"time"
 )
 
 const (
@@ -43,6 +45,30 @@ type (
 		Host   string
 		Port   uint32
 		SSL    SSL
+		// Connections timeouts, limits and socket options of the connections accepted by the server
+		Connections Connections
+	}
+
+	// Connections the connection settings of a server, the zero value uses safe defaults that mitigate slow clients
+	Connections struct {
+		// ReadHeaderTimeout how long a client has to send the request headers, defaults to 10 seconds
+		ReadHeaderTimeout time.Duration
+		// ReadTimeout how long a client has to send the whole request, including the body. Disabled by default so that large uploads work
+		ReadTimeout time.Duration
+		// WriteTimeout how long a handler has to write the response. Disabled by default so that streaming and long polling responses work
+		WriteTimeout time.Duration
+		// IdleTimeout how long an idle keep-alive connection is kept open, defaults to 2 minutes
+		IdleTimeout time.Duration
+		// MaxHeaderBytes the maximum size of the request headers, defaults to 1MiB
+		MaxHeaderBytes int
+		// DisableKeepAlives close connections after each response instead of reusing them
+		DisableKeepAlives bool
+		// TCPKeepAlive the interval of TCP keep-alive probes, defaults to 15 seconds, a negative value disables them
+		TCPKeepAlive time.Duration
+		// Backlog the length of the queue of connections waiting to be accepted, defaults to the operating system's limit
+		Backlog int
+		// ReusePort sets SO_REUSEPORT so that several processes can listen on the same port
+		ReusePort bool
 	}
 
 	SSL struct {
@@ -64,18 +90,25 @@ type (
 	ClientAuthType string
 
 	Server struct {
-		config Configuration
-		server *http.Server
+		config      Configuration
+		server      *http.Server
+		connections *connectionTracker
 	}
 )
 
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
 func (s Configuration) GetAddr() string {
 	return fmt.Sprintf("%s:%d", s.HTTP.Host, s.HTTP.Port)
 }
 
 func NewServer(config Configuration) *Server {
 	return &Server{
-		config: config,
+		config:      config,
+		connections: newConnectionTracker(),
 	}
 }
 
@@ -91,12 +124,73 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
+// OnConnectionStateChange registers a listener that is called whenever a connection changes state, i.e. to record connection metrics.
+// It must be registered before the server is started
+func (s *Server) OnConnectionStateChange(listener ConnectionListener) {
+	s.connections.listeners = append(s.connections.listeners, listener)
+}
+
+// ConnectionStats the connections of the server
+func (s *Server) ConnectionStats() ConnectionStats {
+	return s.connections.stats()
+}
+
 func (s *Server) startHttp(router http.Handler) error {
-	s.server = &http.Server{
-		Addr:    s.config.GetAddr(),
-		Handler: router,
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.server = s.newHTTPServer(router)
+	return s.server.Serve(listener)
+}
+
+func (s *Server) newHTTPServer(router http.Handler) *http.Server {
+	connections := s.config.HTTP.Connections.withDefaults()
+	server := &http.Server{
+		Addr:              s.config.GetAddr(),
+		Handler:           router,
+		ReadHeaderTimeout: connections.ReadHeaderTimeout,
+		ReadTimeout:       connections.ReadTimeout,
+		WriteTimeout:      connections.WriteTimeout,
+		IdleTimeout:       connections.IdleTimeout,
+		MaxHeaderBytes:    connections.MaxHeaderBytes,
+		ConnState:         s.connections.track,
+	}
+	server.SetKeepAlivesEnabled(!connections.DisableKeepAlives)
+	return server
+}
+
+// listen opens the listener with the configured socket options
+func (s *Server) listen() (net.Listener, error) {
+	connections := s.config.HTTP.Connections
+	lc := net.ListenConfig{KeepAlive: connections.TCPKeepAlive}
+	if connections.ReusePort {
+		lc.Control = reusePort
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", s.config.GetAddr())
+	if err != nil {
+		return nil, err
 	}
-	return s.server.ListenAndServe()
+	if connections.Backlog > 0 {
+		if err := setBacklog(listener, connections.Backlog); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func (c Connections) withDefaults() Connections {
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	return c
 }
 
 func (s *Server) startTls(router http.Handler) error {
@@ -128,14 +222,15 @@ func (s *Server) startTls(router http.Handler) error {
 	}
 
 	// Create a Server instance to listen on port 8443 with the TLS config
-	s.server = &http.Server{
-		Addr:      s.config.GetAddr(),
-		Handler:   router,
-		TLSConfig: tlsConfig,
-	}
+	s.server = s.newHTTPServer(router)
+	s.server.TLSConfig = tlsConfig
 
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
 	// Listen to HTTPS connections with the server certificate and wait
-	return s.server.ListenAndServeTLS("", "")
+	return s.server.ServeTLS(listener, "", "")
 }
 
 func (s *Server) getClientCertMode() tls.ClientAuthType {
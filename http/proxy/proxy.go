@@ -0,0 +1,301 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy routes the outbound requests of the HTTP clients of a service through corporate proxies, honoring the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, with overrides per destination:
+//
+//	proxy:
+//	  httpsProxy: http://proxy.corp.example.com:3128
+//	  noProxy: [.internal.example.com, 10.0.0.0/8]
+//	  overrides:
+//	    - hosts: [api.github.com]
+//	      proxy: direct
+//	    - hosts: [*.cluster.local]
+//	      route: agent
+//
+// Destinations can be routed through transports the service sets up at runtime, such as a wormhole session:
+//
+//	session, err := wormholeService.NewRotatingSession(ctx, agentGroup, wormhole.RotatingSessionOptions{})
+//	router.SetRoute("agent", session.Transport())
+//
+// The HTTP clients of http/client/core, and so the clients built on them, use the Router provided by Module
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/fx"
+	"golang.org/x/net/http/httpproxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Direct the proxy of overrides whose destinations are never proxied
+const Direct = "direct"
+
+// ErrRouteNotSet a request matched an override whose route wasn't set with Router.SetRoute
+var ErrRouteNotSet = errors.New("proxy route not set")
+
+type (
+	Configuration struct {
+		// HTTPProxy the proxy of http requests, defaults to HTTP_PROXY
+		HTTPProxy string
+		// HTTPSProxy the proxy of https requests, defaults to HTTPS_PROXY
+		HTTPSProxy string
+		// NoProxy destinations that are never proxied, in addition to NO_PROXY. Entries are hosts that also match their subdomains,
+		// domains starting with . or *. that only match subdomains, IPs, CIDRs, any of them with a :port, or * for every destination
+		NoProxy []string
+		// IgnoreEnvironment ignores HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+		IgnoreEnvironment bool
+		// Overrides how requests to specific destinations are routed, the first override matching a destination applies
+		Overrides []Override
+	}
+
+	// Override routes the requests to Hosts through Proxy, or through the transport set for Route
+	Override struct {
+		// Hosts the destinations of the override, with the patterns of Configuration.NoProxy
+		Hosts []string
+		// Proxy the URL of the proxy of the destinations, or direct to not proxy them
+		Proxy string
+		// Route the name of the transport that handles the requests to the destinations, see Router.SetRoute
+		Route string
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config Configuration `optional:"true"`
+	}
+
+	// Router picks the proxy, or route, of every outbound request
+	Router struct {
+		defaults  *httpproxy.Config
+		overrides []override
+
+		mu     sync.RWMutex
+		routes map[string]http.RoundTripper
+	}
+
+	override struct {
+		hosts []hostMatcher
+		proxy *url.URL
+		route string
+	}
+
+	hostMatcher struct {
+		all    bool
+		ipNet  *net.IPNet
+		ip     net.IP
+		domain string
+		// subdomainsOnly the pattern started with . or *.
+		subdomainsOnly bool
+		port           string
+	}
+
+	routingTransport struct {
+		router *Router
+		base   http.RoundTripper
+	}
+)
+
+var Module = fx.Module("proxy", fx.Provide(New))
+
+// New creates the Router of the configuration
+func New(p Parameters) (*Router, error) {
+	c := p.Config
+	defaults := &httpproxy.Config{}
+	if !c.IgnoreEnvironment {
+		defaults = httpproxy.FromEnvironment()
+	}
+	if c.HTTPProxy != "" {
+		defaults.HTTPProxy = c.HTTPProxy
+	}
+	if c.HTTPSProxy != "" {
+		defaults.HTTPSProxy = c.HTTPSProxy
+	}
+	if len(c.NoProxy) > 0 {
+		defaults.NoProxy = strings.Trim(defaults.NoProxy+","+strings.Join(c.NoProxy, ","), ",")
+	}
+	for _, proxy := range []string{defaults.HTTPProxy, defaults.HTTPSProxy} {
+		if _, err := parseProxy(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &Router{defaults: defaults, routes: map[string]http.RoundTripper{}}
+	for i, o := range c.Overrides {
+		if len(o.Hosts) == 0 {
+			return nil, fmt.Errorf("proxy override %d has no hosts", i)
+		}
+		if (o.Proxy == "") == (o.Route == "") {
+			return nil, fmt.Errorf("proxy override %d must have either a proxy or a route", i)
+		}
+		parsed := override{route: o.Route}
+		for _, host := range o.Hosts {
+			m, err := parseHostMatcher(host)
+			if err != nil {
+				return nil, fmt.Errorf("proxy override %d: %w", i, err)
+			}
+			parsed.hosts = append(parsed.hosts, m)
+		}
+		if o.Proxy != "" && !strings.EqualFold(o.Proxy, Direct) {
+			proxy, err := parseProxy(o.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("proxy override %d: %w", i, err)
+			}
+			parsed.proxy = proxy
+		}
+		r.overrides = append(r.overrides, parsed)
+	}
+	return r, nil
+}
+
+// SetRoute sets the transport of the overrides with the route name, such as the transport of a wormhole session
+func (r *Router) SetRoute(name string, transport http.RoundTripper) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[name] = transport
+}
+
+// RemoveRoute removes the transport of the route name, requests to its destinations fail with ErrRouteNotSet until it is set again
+func (r *Router) RemoveRoute(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, name)
+}
+
+// ProxyFunc the proxy of requests, for http.Transport.Proxy. Requests of routed destinations aren't proxied by it
+func (r *Router) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	defaults := r.defaults.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		if o := r.match(req.URL); o != nil {
+			return o.proxy, nil
+		}
+		return defaults(req.URL)
+	}
+}
+
+// Transport returns a transport that proxies the requests of base with ProxyFunc, and hands the requests of routed destinations
+// to their routes
+func (r *Router) Transport(base *http.Transport) http.RoundTripper {
+	proxied := base.Clone()
+	proxied.Proxy = r.ProxyFunc()
+	for _, o := range r.overrides {
+		if o.route != "" {
+			return &routingTransport{router: r, base: proxied}
+		}
+	}
+	return proxied
+}
+
+func (t *routingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := t.router.match(req.URL)
+	if o == nil || o.route == "" {
+		return t.base.RoundTrip(req)
+	}
+	t.router.mu.RLock()
+	route, ok := t.router.routes[o.route]
+	t.router.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q for %s", ErrRouteNotSet, o.route, req.URL.Host)
+	}
+	return route.RoundTrip(req)
+}
+
+func (r *Router) match(u *url.URL) *override {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	for i := range r.overrides {
+		for _, m := range r.overrides[i].hosts {
+			if m.matches(strings.ToLower(host), port) {
+				return &r.overrides[i]
+			}
+		}
+	}
+	return nil
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	raw := proxy
+	if !strings.Contains(raw, "://") {
+		// proxies are commonly given without a scheme, ex: proxy.corp.example.com:3128
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q", proxy)
+	}
+	return u, nil
+}
+
+func parseHostMatcher(pattern string) (hostMatcher, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*" {
+		return hostMatcher{all: true}, nil
+	}
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		return hostMatcher{ipNet: ipNet}, nil
+	}
+	m := hostMatcher{}
+	host := pattern
+	if h, port, err := net.SplitHostPort(pattern); err == nil {
+		host, m.port = h, port
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		m.ip = ip
+		return m, nil
+	}
+	if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+		m.subdomainsOnly = true
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	}
+	if host == "" || strings.ContainsAny(host, "/*") {
+		return m, fmt.Errorf("invalid host pattern %q", pattern)
+	}
+	m.domain = host
+	return m, nil
+}
+
+func (m hostMatcher) matches(host string, port string) bool {
+	if m.all {
+		return true
+	}
+	if m.port != "" && m.port != port {
+		return false
+	}
+	if m.ipNet != nil || m.ip != nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		if m.ipNet != nil {
+			return m.ipNet.Contains(ip)
+		}
+		return m.ip.Equal(ip)
+	}
+	if strings.HasSuffix(host, "."+m.domain) {
+		return true
+	}
+	return !m.subdomainsOnly && host == m.domain
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyFunc(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://env-proxy:3128")
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("NO_PROXY", "env.example.com")
+
+	router, err := New(Parameters{Config: Configuration{
+		HTTPSProxy: "corp-proxy:3128",
+		NoProxy:    []string{".internal.example.com", "10.0.0.0/8"},
+		Overrides: []Override{
+			{Hosts: []string{"api.github.com"}, Proxy: Direct},
+			{Hosts: []string{"*.partner.com:8443"}, Proxy: "http://partner-proxy:8080"},
+			{Hosts: []string{"cluster.local"}, Route: "agent"},
+		},
+	}})
+	require.NoError(t, err)
+	proxyFunc := router.ProxyFunc()
+
+	cases := []struct {
+		url      string
+		expected string
+	}{
+		{url: "http://deployments.example.com", expected: "http://env-proxy:3128"},
+		{url: "https://deployments.example.com", expected: "http://corp-proxy:3128"},
+		{url: "https://env.example.com", expected: ""},
+		{url: "https://svc.internal.example.com", expected: ""},
+		{url: "https://internal.example.com", expected: "http://corp-proxy:3128"},
+		{url: "https://10.1.2.3", expected: ""},
+		{url: "https://api.github.com", expected: ""},
+		{url: "https://api.partner.com:8443", expected: "http://partner-proxy:8080"},
+		{url: "https://api.partner.com", expected: "http://corp-proxy:3128"},
+		{url: "https://kube.cluster.local", expected: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			u, err := proxyFunc(&http.Request{URL: mustParse(t, c.url)})
+			require.NoError(t, err)
+			if c.expected == "" {
+				assert.Nil(t, u)
+			} else {
+				require.NotNil(t, u)
+				assert.Equal(t, c.expected, u.String())
+			}
+		})
+	}
+}
+
+func TestIgnoreEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+	router, err := New(Parameters{Config: Configuration{IgnoreEnvironment: true}})
+	require.NoError(t, err)
+
+	u, err := router.ProxyFunc()(&http.Request{URL: mustParse(t, "https://deployments.example.com")})
+	require.NoError(t, err)
+	assert.Nil(t, u)
+}
+
+func TestTransportRoutes(t *testing.T) {
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "proxy")
+		w.Header().Set("X-Target", r.URL.String())
+	}))
+	defer proxied.Close()
+
+	router, err := New(Parameters{Config: Configuration{
+		IgnoreEnvironment: true,
+		HTTPProxy:         proxied.URL,
+		Overrides:         []Override{{Hosts: []string{"kube.cluster.local"}, Route: "agent"}},
+	}})
+	require.NoError(t, err)
+	client := &http.Client{Transport: router.Transport(http.DefaultTransport.(*http.Transport))}
+
+	res, err := client.Get("http://deployments.example.com/api")
+	require.NoError(t, err)
+	assert.Equal(t, "proxy", res.Header.Get("Via"))
+	assert.Equal(t, "http://deployments.example.com/api", res.Header.Get("X-Target"))
+
+	_, err = client.Get("http://kube.cluster.local/api")
+	assert.ErrorIs(t, err, ErrRouteNotSet)
+
+	router.SetRoute("agent", roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusTeapot, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	}))
+	res, err = client.Get("http://kube.cluster.local/api")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, res.StatusCode)
+
+	router.RemoveRoute("agent")
+	_, err = client.Get("http://kube.cluster.local/api")
+	assert.ErrorIs(t, err, ErrRouteNotSet)
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	cases := map[string]Configuration{
+		"proxy override 0 has no hosts":                        {Overrides: []Override{{Proxy: Direct}}},
+		"proxy override 0 must have either a proxy or a route": {Overrides: []Override{{Hosts: []string{"a.com"}, Proxy: Direct, Route: "agent"}}},
+		`proxy override 0: invalid host pattern "*.*.com"`:     {Overrides: []Override{{Hosts: []string{"*.*.com"}, Proxy: Direct}}},
+		`invalid proxy "http://"`:                              {IgnoreEnvironment: true, HTTPProxy: "http://"},
+	}
+	for expected, config := range cases {
+		_, err := New(Parameters{Config: config})
+		assert.EqualError(t, err, expected)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package reverseproxy
+
+import (
+	"github.com/hashicorp/go-retryablehttp"
+	"net/http"
+)
+
+// retryingTransport retries idempotent requests, other requests are sent once since the upstream may have acted on them
+type retryingTransport struct {
+	base     http.RoundTripper
+	retrying http.RoundTripper
+}
+
+func newRetryingTransport(base http.RoundTripper, config Configuration) *retryingTransport {
+	rc := &retryablehttp.Client{
+		HTTPClient: &http.Client{
+			Transport: base,
+			// redirects are for the caller to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		RetryWaitMin: config.RetryWaitMin,
+		RetryWaitMax: config.RetryWaitMax,
+		RetryMax:     config.MaxRetries,
+		CheckRetry:   retryablehttp.DefaultRetryPolicy,
+		Backoff:      retryablehttp.DefaultBackoff,
+		// return the last upstream response rather than an error once retries are exhausted
+		ErrorHandler: retryablehttp.PassthroughErrorHandler,
+	}
+	return &retryingTransport{
+		base:     base,
+		retrying: &retryablehttp.RoundTripper{Client: rc},
+	}
+}
+
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isIdempotent(req.Method) {
+		// the retrying transport sends requests with an http.Client, which rejects the server side RequestURI the proxy copies
+		req = req.WithContext(req.Context())
+		req.RequestURI = ""
+		return t.retrying.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
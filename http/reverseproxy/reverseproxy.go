@@ -0,0 +1,321 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package reverseproxy forwards requests under path prefixes to upstream services, gate style, for services that front OSS Spinnaker components.
+// A Proxy is an http.Handler, serve it from a controller with server.IControllerHTTPHandlers
+//
+//	func (c *gateController) HTTPHandlers() []server.HTTPHandlerConfig {
+//		return []server.HTTPHandlerConfig{{Prefix: "/spinnaker", Handler: c.proxy}}
+//	}
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/http/client/core"
+	"github.com/armory-io/go-commons/iam"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// SpinnakerUserHeader the header Spinnaker services read the calling user from
+	SpinnakerUserHeader = "X-Spinnaker-User"
+	// CacheStatusHeader is set to HIT on responses served from the ResponseCache
+	CacheStatusHeader = "X-Cache"
+
+	disabledHeader           = "-"
+	defaultMaxRetries        = 3
+	defaultRetryWaitMin      = 100 * time.Millisecond
+	defaultRetryWaitMax      = 2 * time.Second
+	defaultMaxCacheBodyBytes = 1 << 20
+)
+
+// cacheKeyKey the ResponseCache key of a proxied request, the response is cached under it
+var cacheKeyKey = ctxutil.NewKey[string]("reverseproxy.cacheKey")
+
+type (
+	Configuration struct {
+		// Routes the path prefixes that are proxied, the longest matching prefix wins
+		Routes []Route `yaml:"routes"`
+		// PrincipalHeader the header the name of the principal is forwarded in, defaults to X-Spinnaker-User. Set to - to disable.
+		// The header is always removed from incoming requests so callers can't impersonate other users
+		PrincipalHeader string `yaml:"principalHeader"`
+		// MaxRetries how many times idempotent requests are retried on connection errors and 5xx responses, defaults to 3
+		MaxRetries int `yaml:"maxRetries"`
+		// RetryWaitMin the initial backoff between retries, defaults to 100ms
+		RetryWaitMin time.Duration `yaml:"retryWaitMin"`
+		// RetryWaitMax the longest backoff between retries, defaults to 2s
+		RetryWaitMax time.Duration `yaml:"retryWaitMax"`
+		// MaxCacheBodyBytes responses with larger bodies are not cached, defaults to 1MiB
+		MaxCacheBodyBytes int64 `yaml:"maxCacheBodyBytes"`
+	}
+
+	// Route forwards requests under Prefix to Upstream, the prefix is replaced by the path of the upstream URL
+	Route struct {
+		Prefix   string `yaml:"prefix"`
+		Upstream string `yaml:"upstream"`
+		// SetRequestHeaders headers set on requests sent upstream
+		SetRequestHeaders map[string]string `yaml:"setRequestHeaders"`
+		// RemoveRequestHeaders headers removed from requests sent upstream
+		RemoveRequestHeaders []string `yaml:"removeRequestHeaders"`
+		// SetResponseHeaders headers set on responses returned to the caller
+		SetResponseHeaders map[string]string `yaml:"setResponseHeaders"`
+		// RemoveResponseHeaders headers removed from responses returned to the caller
+		RemoveResponseHeaders []string `yaml:"removeResponseHeaders"`
+	}
+
+	// ResponseCache caches upstream responses, implementations decide how long entries live
+	ResponseCache interface {
+		Get(ctx context.Context, key string) (*CachedResponse, bool)
+		Set(ctx context.Context, key string, response *CachedResponse)
+	}
+
+	CachedResponse struct {
+		StatusCode int
+		Header     http.Header
+		Body       []byte
+	}
+
+	// CacheKeyFn returns the cache key of a request, or false when the request must not be served from or stored in the cache
+	CacheKeyFn func(r *http.Request) (string, bool)
+
+	Parameters struct {
+		Configuration Configuration
+		Log           *zap.SugaredLogger
+		// Transport the transport requests are sent upstream with, defaults to one that propagates trace headers
+		Transport http.RoundTripper
+		// Cache optional response cache
+		Cache ResponseCache
+		// CacheKey optional, defaults to DefaultCacheKey
+		CacheKey CacheKeyFn
+	}
+
+	// Proxy an http.Handler that forwards requests to the upstream of the matching Route
+	Proxy struct {
+		routes          []*route
+		principalHeader string
+		maxCacheBytes   int64
+		cache           ResponseCache
+		cacheKey        CacheKeyFn
+		log             *zap.SugaredLogger
+	}
+
+	route struct {
+		Route
+		proxy *httputil.ReverseProxy
+	}
+)
+
+// New creates a Proxy, failing when a route has no prefix or an invalid upstream
+func New(params Parameters) (*Proxy, error) {
+	config := params.Configuration.withDefaults()
+	p := &Proxy{
+		principalHeader: config.PrincipalHeader,
+		maxCacheBytes:   config.MaxCacheBodyBytes,
+		cache:           params.Cache,
+		cacheKey:        params.CacheKey,
+		log:             params.Log,
+	}
+	if p.cacheKey == nil {
+		p.cacheKey = DefaultCacheKey(config.PrincipalHeader)
+	}
+
+	base := params.Transport
+	if base == nil {
+		base = core.NewRoundTripper(core.Parameters{})
+	}
+	transport := newRetryingTransport(base, config)
+
+	for _, r := range config.Routes {
+		prefix := "/" + strings.Trim(r.Prefix, "/")
+		if prefix == "/" {
+			return nil, fmt.Errorf("reverseproxy: route for %q must have a prefix", r.Upstream)
+		}
+		upstream, err := url.Parse(r.Upstream)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return nil, fmt.Errorf("reverseproxy: route %s has an invalid upstream %q", prefix, r.Upstream)
+		}
+		r.Prefix = prefix
+
+		rt := &route{Route: r}
+		rt.proxy = &httputil.ReverseProxy{
+			Rewrite:        p.rewrite(rt, upstream),
+			Transport:      transport,
+			ModifyResponse: p.modifyResponse(rt),
+			ErrorHandler:   p.handleError(rt),
+		}
+		p.routes = append(p.routes, rt)
+	}
+	sort.Slice(p.routes, func(i, j int) bool { return len(p.routes[i].Prefix) > len(p.routes[j].Prefix) })
+	return p, nil
+}
+
+// DefaultCacheKey caches GET requests per user, keyed on the path, query and the principal header
+func DefaultCacheKey(principalHeader string) CacheKeyFn {
+	return func(r *http.Request) (string, bool) {
+		if r.Method != http.MethodGet {
+			return "", false
+		}
+		user := ""
+		if p, err := iam.ExtractPrincipalFromContext(r.Context()); err == nil && principalHeader != disabledHeader {
+			user = p.Name
+		}
+		return user + "|" + r.URL.RequestURI(), true
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := p.match(r.URL.Path)
+	if rt == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if p.cache != nil {
+		if key, ok := p.cacheKey(r); ok {
+			if cached, hit := p.cache.Get(r.Context(), key); hit {
+				writeCached(w, rt, cached)
+				return
+			}
+			r = r.WithContext(cacheKeyKey.WithValue(r.Context(), key))
+		}
+	}
+	rt.proxy.ServeHTTP(w, r)
+}
+
+func (p *Proxy) match(path string) *route {
+	for _, rt := range p.routes {
+		if path == rt.Prefix || strings.HasPrefix(path, rt.Prefix+"/") {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) rewrite(rt *route, upstream *url.URL) func(*httputil.ProxyRequest) {
+	return func(pr *httputil.ProxyRequest) {
+		pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, rt.Prefix)
+		pr.Out.URL.RawPath = ""
+		pr.SetURL(upstream)
+		pr.SetXForwarded()
+		pr.Out.Host = upstream.Host
+
+		if p.principalHeader != disabledHeader {
+			pr.Out.Header.Del(p.principalHeader)
+			if principal, err := iam.ExtractPrincipalFromContext(pr.In.Context()); err == nil {
+				pr.Out.Header.Set(p.principalHeader, principal.Name)
+			}
+		}
+		for _, header := range rt.RemoveRequestHeaders {
+			pr.Out.Header.Del(header)
+		}
+		for header, value := range rt.SetRequestHeaders {
+			pr.Out.Header.Set(header, value)
+		}
+	}
+}
+
+func (p *Proxy) modifyResponse(rt *route) func(*http.Response) error {
+	return func(res *http.Response) error {
+		rewriteResponseHeaders(res.Header, rt)
+
+		key, ok := cacheKeyKey.Value(res.Request.Context())
+		if !ok || !p.cacheable(res) {
+			return nil
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, p.maxCacheBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) > p.maxCacheBytes {
+			// too big to cache, stream what was read followed by the rest of the body
+			res.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), res.Body), Closer: res.Body}
+			return nil
+		}
+		_ = res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		p.cache.Set(res.Request.Context(), key, &CachedResponse{StatusCode: res.StatusCode, Header: res.Header.Clone(), Body: body})
+		return nil
+	}
+}
+
+func (p *Proxy) cacheable(res *http.Response) bool {
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	cacheControl := strings.ToLower(strings.Join(res.Header.Values("Cache-Control"), ","))
+	return !strings.Contains(cacheControl, "no-store") && res.Header.Get("Set-Cookie") == ""
+}
+
+func (p *Proxy) handleError(rt *route) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if p.log != nil {
+			p.log.Warnw("failed to proxy request", "prefix", rt.Prefix, "upstream", rt.Upstream, "uri", r.URL.RequestURI(), "error", err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+func writeCached(w http.ResponseWriter, rt *route, cached *CachedResponse) {
+	for header, values := range cached.Header {
+		w.Header()[header] = append([]string(nil), values...)
+	}
+	w.Header().Set(CacheStatusHeader, "HIT")
+	w.WriteHeader(cached.StatusCode)
+	_, _ = w.Write(cached.Body)
+}
+
+func rewriteResponseHeaders(header http.Header, rt *route) {
+	for _, name := range rt.RemoveResponseHeaders {
+		header.Del(name)
+	}
+	for name, value := range rt.SetResponseHeaders {
+		header.Set(name, value)
+	}
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.PrincipalHeader == "" {
+		c.PrincipalHeader = SpinnakerUserHeader
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryWaitMin == 0 {
+		c.RetryWaitMin = defaultRetryWaitMin
+	}
+	if c.RetryWaitMax == 0 {
+		c.RetryWaitMax = defaultRetryWaitMax
+	}
+	if c.MaxCacheBodyBytes == 0 {
+		c.MaxCacheBodyBytes = defaultMaxCacheBodyBytes
+	}
+	return c
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,156 @@
+package reverseproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[string]*CachedResponse
+}
+
+func (m *mapCache) Get(_ context.Context, key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.entries[key]
+	return r, ok
+}
+
+func (m *mapCache) Set(_ context.Context, key string, response *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = response
+}
+
+func newTestProxy(t *testing.T, upstream string, cache ResponseCache) *Proxy {
+	p, err := New(Parameters{
+		Configuration: Configuration{
+			Routes: []Route{
+				{
+					Prefix:                "/gate",
+					Upstream:              upstream + "/api",
+					SetRequestHeaders:     map[string]string{"X-Source": "proxy"},
+					RemoveRequestHeaders:  []string{"Authorization"},
+					SetResponseHeaders:    map[string]string{"X-Proxied": "true"},
+					RemoveResponseHeaders: []string{"Server"},
+				},
+				{Prefix: "/gate/front50", Upstream: upstream + "/front50"},
+			},
+			RetryWaitMin: time.Millisecond,
+			RetryWaitMax: time.Millisecond,
+		},
+		Log:   zap.NewNop().Sugar(),
+		Cache: cache,
+	})
+	assert.NoError(t, err)
+	return p
+}
+
+func serve(p *Proxy, method string, target string, user string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader("body"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if user != "" {
+		req = req.WithContext(iam.WithPrincipal(req.Context(), iam.ArmoryCloudPrincipal{Name: user}))
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyRewritesRequests(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("Server", "gate")
+		_, _ = io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, upstream.URL, nil)
+
+	w := serve(p, http.MethodGet, "/gate/applications?expand=true", "user@example.com", map[string]string{
+		SpinnakerUserHeader: "admin",
+		"Authorization":     "Bearer abc",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/api/applications?expand=true", w.Body.String())
+	assert.Equal(t, "user@example.com", received.Header.Get(SpinnakerUserHeader), "the principal replaces a caller supplied user")
+	assert.Equal(t, "proxy", received.Header.Get("X-Source"))
+	assert.Empty(t, received.Header.Get("Authorization"))
+	assert.Equal(t, "true", w.Header().Get("X-Proxied"))
+	assert.Empty(t, w.Header().Get("Server"))
+
+	serve(p, http.MethodGet, "/gate/applications", "", map[string]string{SpinnakerUserHeader: "admin"})
+	assert.Empty(t, received.Header.Get(SpinnakerUserHeader), "callers can't impersonate users")
+
+	assert.Equal(t, "/front50/pipelines", serve(p, http.MethodGet, "/gate/front50/pipelines", "", nil).Body.String(), "the longest prefix wins")
+	assert.Equal(t, http.StatusNotFound, serve(p, http.MethodGet, "/gates", "", nil).Code)
+}
+
+func TestProxyRetriesIdempotentRequests(t *testing.T) {
+	var attempts atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if attempts.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, upstream.URL, nil)
+
+	w := serve(p, http.MethodPut, "/gate/pipelines/1", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body", w.Body.String(), "the body is replayed on retries")
+	assert.Equal(t, int32(2), attempts.Load())
+
+	attempts.Store(0)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(p, http.MethodPost, "/gate/pipelines", "", nil).Code)
+	assert.Equal(t, int32(1), attempts.Load(), "non idempotent requests are not retried")
+}
+
+func TestProxyCachesResponses(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Has("nostore") {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		_, _ = io.WriteString(w, r.Header.Get(SpinnakerUserHeader))
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, upstream.URL, &mapCache{entries: map[string]*CachedResponse{}})
+
+	assert.Equal(t, "alice", serve(p, http.MethodGet, "/gate/applications", "alice", nil).Body.String())
+	cached := serve(p, http.MethodGet, "/gate/applications", "alice", nil)
+	assert.Equal(t, "alice", cached.Body.String())
+	assert.Equal(t, "HIT", cached.Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(1), calls.Load())
+
+	assert.Equal(t, "bob", serve(p, http.MethodGet, "/gate/applications", "bob", nil).Body.String(), "responses are cached per user")
+	serve(p, http.MethodGet, "/gate/applications?nostore", "bob", nil)
+	serve(p, http.MethodGet, "/gate/applications?nostore", "bob", nil)
+	serve(p, http.MethodPost, "/gate/applications", "bob", nil)
+	assert.Equal(t, int32(5), calls.Load())
+}
+
+func TestNewValidatesRoutes(t *testing.T) {
+	_, err := New(Parameters{Configuration: Configuration{Routes: []Route{{Prefix: "/", Upstream: "http://gate"}}}})
+	assert.Error(t, err)
+	_, err = New(Parameters{Configuration: Configuration{Routes: []Route{{Prefix: "/gate", Upstream: "gate:8084"}}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+//go:build !unix
+
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errSocketOptionUnsupported = errors.New("socket option is not supported on this platform")
+
+func reusePort(_, _ string, _ syscall.RawConn) error {
+	return errSocketOptionUnsupported
+}
+
+func setBacklog(_ net.Listener, _ int) error {
+	return errSocketOptionUnsupported
+}
@@ -17,7 +17,6 @@
 package iam
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	armoryhttp "github.com/armory-io/go-commons/http"
@@ -42,7 +41,7 @@ func AuthMiddleware(ps *ArmoryCloudPrincipalService) func(handler http.Handler)
 				return
 			}
 
-			requestWithPrincipal := r.WithContext(context.WithValue(r.Context(), principalContextKey{}, *p))
+			requestWithPrincipal := r.WithContext(principalKey.WithValue(r.Context(), *p))
 			next.ServeHTTP(w, requestWithPrincipal)
 		})
 	}
@@ -17,7 +17,6 @@
 package iam
 
 import (
-	"context"
 	"fmt"
 	armoryhttp "github.com/armory-io/go-commons/http"
 	"github.com/gin-gonic/gin"
@@ -50,7 +49,7 @@ func GinAuthMiddleware(ps *ArmoryCloudPrincipalService, allowWithoutAuthList []s
 			return
 		}
 
-		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), principalContextKey{}, *p))
+		c.Request = c.Request.WithContext(principalKey.WithValue(c.Request.Context(), *p))
 	}
 }
 
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iam
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/ctxutil"
+	"net/http"
+)
+
+// impersonation a request authorized by the proxied authorization header, whose principal is the effective principal of the
+// request. The actual principal is the one of the authorization header of the proxy, nil when it couldn't be verified
+type impersonation struct {
+	actual *ArmoryCloudPrincipal
+}
+
+var impersonationKey = ctxutil.NewKey[impersonation]("iam.impersonation")
+
+// ExtractImpersonatorBearerToken the authorization header of the proxy that made a request on behalf of another principal with the
+// proxied authorization header, false when the request isn't proxied or the proxy didn't authorize itself
+func ExtractImpersonatorBearerToken(r *http.Request) (string, bool) {
+	if r.Header.Get(proxiedAuthorizationHeader) == "" {
+		return "", false
+	}
+	auth := r.Header.Get(authorizationHeader)
+	return auth, auth != ""
+}
+
+// IsProxiedRequest whether the request is authorized by the proxied authorization header rather than its authorization header
+func IsProxiedRequest(r *http.Request) bool {
+	return r.Header.Get(proxiedAuthorizationHeader) != ""
+}
+
+// WithImpersonation marks the context of a proxied request as impersonated, actual is the principal of the proxy if known
+func WithImpersonation(ctx context.Context, actual *ArmoryCloudPrincipal) context.Context {
+	return impersonationKey.WithValue(ctx, impersonation{actual: actual})
+}
+
+// IsImpersonated whether the principal of the context is impersonated by another principal
+func IsImpersonated(ctx valuer) bool {
+	_, ok := impersonationKey.Value(ctx)
+	return ok
+}
+
+// ExtractEffectivePrincipalFromContext the principal the request is made on behalf of, the same as ExtractPrincipalFromContext
+func ExtractEffectivePrincipalFromContext(ctx valuer) (*ArmoryCloudPrincipal, error) {
+	return ExtractPrincipalFromContext(ctx)
+}
+
+// ExtractActualPrincipalFromContext the principal that made the request, which is the principal impersonating the effective
+// principal of impersonated requests. ErrNoPrincipal is returned for impersonated requests whose actual principal is unknown
+func ExtractActualPrincipalFromContext(ctx valuer) (*ArmoryCloudPrincipal, error) {
+	i, ok := impersonationKey.Value(ctx)
+	if !ok {
+		return ExtractPrincipalFromContext(ctx)
+	}
+	if i.actual == nil {
+		return nil, ErrNoPrincipal
+	}
+	actual := *i.actual
+	return &actual, nil
+}
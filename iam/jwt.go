@@ -30,6 +30,7 @@ const (
 	subject         = "sub"
 	issuer          = "iss"
 	authorizedParty = "azp"
+	audience        = "aud"
 )
 
 type JwtFetcher interface {
@@ -87,6 +88,9 @@ func (j *JwtToken) Fetch(token []byte) (interface{}, interface{}, error) {
 	if provided {
 		untypedPrincipal.(map[string]interface{})[authorizedParty] = azp
 	}
+	if aud := parsedJwt.Audience(); len(aud) > 0 {
+		untypedPrincipal.(map[string]interface{})[audience] = aud
+	}
 
 	scopes, _ := parsedJwt.Get(scopeClaim)
 
@@ -52,10 +52,14 @@ type ArmoryCloudPrincipal struct {
 	// AuthorizedParty OPTIONAL. Authorized party - the party to which the ID Token was issued. If present, it MUST contain the OAuth 2.0 Client ID of this party. This Claim is only needed when the ID Token has
 	// a single audience value and that audience is different from the authorized party. It MAY be included even when the authorized party is the same as the sole audience. The azp value is a case-sensitive string containing a StringOrURI value.
 	AuthorizedParty string `json:"azp"`
+	// Audience the "aud" (audience) claim identifies the recipients that the JWT is intended for
+	Audience []string `json:"aud,omitempty"`
 	// Scopes A list of scopes that was set by the authorization server such as use:adminApi
 	Scopes []string `json:"scopes"`
 	// Roles List of groups that a principal belongs to
 	Roles []string `json:"roles"`
+	// StepUp the recent step-up authentication of the principal, nil unless the request proved one, see WithStepUp
+	StepUp *StepUp `json:"-"`
 }
 
 func (p *ArmoryCloudPrincipal) Tenant() string {
@@ -95,9 +99,10 @@ func (p *ArmoryCloudPrincipal) ToJson() string {
 }
 
 func WithPrincipal(ctx context.Context, principal ArmoryCloudPrincipal) context.Context {
-	return context.WithValue(ctx, principalContextKey{}, principal)
+	return principalKey.WithValue(ctx, principal)
 }
 
 func WithPrincipalWorkflow(ctx workflow.Context, principal ArmoryCloudPrincipal) workflow.Context {
-	return workflow.WithValue(ctx, principalContextKey{}, principal)
+	principalKey.Record(ctx)
+	return workflow.WithValue(ctx, principalKey, principal)
 }
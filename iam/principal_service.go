@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
 	"github.com/gin-gonic/gin"
 	"github.com/mitchellh/mapstructure"
 	"net/http"
@@ -38,7 +39,7 @@ var (
 	ErrNoPrincipal  = errors.New("unable to extract armory principal from request")
 )
 
-type principalContextKey struct{}
+var principalKey = ctxutil.NewKey[ArmoryCloudPrincipal]("iam.principal")
 
 type ArmoryCloudPrincipalService struct {
 	JwtFetcher JwtFetcher
@@ -67,7 +68,7 @@ type valuer interface {
 // ExtractPrincipalFromContext can be used by any handler or downstream middleware of the ArmoryCloudPrincipalMiddleware
 // to get the encoded principal for manual verification of scopes.
 func ExtractPrincipalFromContext(ctx valuer) (*ArmoryCloudPrincipal, error) {
-	v, ok := ctx.Value(principalContextKey{}).(ArmoryCloudPrincipal)
+	v, ok := principalKey.Value(ctx)
 	if !ok {
 		return nil, ErrNoPrincipal
 	}
@@ -98,7 +99,7 @@ func (a *ArmoryCloudPrincipalService) VerifyPrincipalAndSetContext(tokenOrRawHea
 
 // DangerouslyWriteUnverifiedPrincipalToContext is exposed for easily injecting stub principals into context for testing
 func DangerouslyWriteUnverifiedPrincipalToContext(c context.Context, principal *ArmoryCloudPrincipal) context.Context {
-	return context.WithValue(c, principalContextKey{}, *principal)
+	return principalKey.WithValue(c, *principal)
 }
 
 func (a *ArmoryCloudPrincipalService) ExtractAndVerifyPrincipalFromTokenString(token string) (*ArmoryCloudPrincipal, error) {
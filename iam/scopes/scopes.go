@@ -23,6 +23,7 @@ const (
 	ResourceTenant       Resource = "tenant"
 	ResourceOrganization Resource = "organization"
 	ResourceAgentHub     Resource = "agentHub"
+	ResourceDebug        Resource = "debug"
 	ResourceStar         Resource = "*"
 
 	PermissionFull Permission = "full"
@@ -33,6 +34,8 @@ var (
 	ScopeTenantAdmin           = mustScope(TypeAPI, ResourceTenant, PermissionFull)
 	ScopeDeploymentsFullAccess = mustScope(TypeAPI, ResourceDeployment, PermissionFull)
 	ScopeRemoteNetworkAgent    = mustScope(TypeAPI, ResourceAgentHub, PermissionFull)
+	// ScopeDebug grants support engineers the cause chains of error responses, see serr.Cause
+	ScopeDebug = mustScope(TypeAPI, ResourceDebug, PermissionFull)
 
 	types       = []Type{TypeAPI, TypeAccount, TypeTargetGroup}
 	permissions = []Permission{PermissionFull}
@@ -130,7 +133,7 @@ func (v validator) validatePermission(p Permission) error {
 }
 
 func (v validator) validateResourceForAPIType(r Resource) error {
-	if !oneOf([]Resource{ResourceDeployment, ResourceTenant, ResourceOrganization, ResourceAgentHub}, r) {
+	if !oneOf([]Resource{ResourceDeployment, ResourceTenant, ResourceOrganization, ResourceAgentHub, ResourceDebug}, r) {
 		return fmt.Errorf("%w: invalid resource for api type: %q", v.baseError, r)
 	}
 	return nil
@@ -19,6 +19,8 @@ package iam
 type Configuration struct {
 	JWT            JWT      `yaml:"jwt"`
 	RequiredScopes []string `yaml:"requiredScopes"`
+	// Spinnaker accepts the identities of Spinnaker services on requests without a bearer token, see SpinnakerConfiguration
+	Spinnaker SpinnakerConfiguration `yaml:"spinnaker"`
 }
 
 type JWT struct {
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"strings"
+)
+
+const (
+	// SpinnakerUserHeader the header Spinnaker services identify the calling user or service account with, as Fiat does
+	SpinnakerUserHeader = "X-Spinnaker-User"
+	// SpinnakerAccountsHeader the comma separated accounts of the calling user of Spinnaker services
+	SpinnakerAccountsHeader = "X-Spinnaker-Accounts"
+	// SpinnakerIssuer the issuer of the principals of Spinnaker identities
+	SpinnakerIssuer = "spinnaker"
+)
+
+var (
+	ErrUnknownSpinnakerIdentity = errors.New("unknown spinnaker identity")
+	// ErrUntrustedSpinnakerSource the Spinnaker identity was sent from an address other than the TrustedSources
+	ErrUntrustedSpinnakerSource = errors.New("spinnaker identity sent from an untrusted address")
+)
+
+type (
+	// SpinnakerConfiguration the Spinnaker identities accepted on requests without a bearer token, so OSS Spinnaker services of
+	// hybrid deployments can call services through the same middleware. The header is trusted as is, like Fiat does, so the
+	// services must only be reachable by Spinnaker when it is enabled
+	SpinnakerConfiguration struct {
+		Enabled bool `yaml:"enabled"`
+		// Header the header of the identity, defaults to X-Spinnaker-User
+		Header string `yaml:"header"`
+		// Users the identities accepted, required unless a SpinnakerIdentityResolver is provided, in which case it is ignored
+		Users []string `yaml:"users"`
+		// TrustedSources the IPs or CIDRs the identity header is accepted from, the Spinnaker services or the proxies in front of
+		// the service, as with the trusted proxies of server.ClientIPConfiguration. Defaults to any address
+		TrustedSources []string `yaml:"trustedSources"`
+		// OrgId and EnvId the tenant of the principals, unless a SpinnakerIdentityResolver provides them
+		OrgId string `yaml:"orgId"`
+		EnvId string `yaml:"envId"`
+		// Scopes the synthetic scopes granted to the principals of Spinnaker identities
+		Scopes []string `yaml:"scopes"`
+	}
+
+	// SpinnakerIdentity the user or service account a Spinnaker service calls on behalf of
+	SpinnakerIdentity struct {
+		User     string
+		Accounts []string
+	}
+
+	// SpinnakerIdentityResolver maps Spinnaker identities to principals, i.e. to look up the tenant of a service account.
+	// ErrUnknownSpinnakerIdentity rejects the identity
+	SpinnakerIdentityResolver interface {
+		ResolveSpinnakerIdentity(ctx context.Context, identity SpinnakerIdentity) (*ArmoryCloudPrincipal, error)
+	}
+
+	principalVerifier interface {
+		VerifyPrincipalAndSetContext(tokenOrRawHeader string, c *gin.Context) error
+	}
+
+	// SpinnakerVerifier verifies bearer tokens with the principal service, and maps the Spinnaker identities of requests without
+	// one into principals
+	SpinnakerVerifier struct {
+		principals principalVerifier
+		config     SpinnakerConfiguration
+		resolver   SpinnakerIdentityResolver
+		users      map[string]bool
+		trusted    []*net.IPNet
+	}
+)
+
+// NewSpinnakerVerifier creates a SpinnakerVerifier, the resolver is optional
+func NewSpinnakerVerifier(principals *ArmoryCloudPrincipalService, config SpinnakerConfiguration, resolver SpinnakerIdentityResolver) (*SpinnakerVerifier, error) {
+	return newSpinnakerVerifier(principals, config, resolver)
+}
+
+func newSpinnakerVerifier(principals principalVerifier, config SpinnakerConfiguration, resolver SpinnakerIdentityResolver) (*SpinnakerVerifier, error) {
+	if resolver == nil && config.OrgId == "" {
+		return nil, errors.New("spinnaker identities require an orgId or a SpinnakerIdentityResolver")
+	}
+	// the header is trusted as is, so without a resolver only the listed identities may be claimed
+	if resolver == nil && len(config.Users) == 0 {
+		return nil, errors.New("spinnaker identities require users or a SpinnakerIdentityResolver")
+	}
+	if config.Header == "" {
+		config.Header = SpinnakerUserHeader
+	}
+	users := make(map[string]bool, len(config.Users))
+	for _, user := range config.Users {
+		users[user] = true
+	}
+	v := &SpinnakerVerifier{principals: principals, config: config, resolver: resolver, users: users}
+	for _, source := range config.TrustedSources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted spinnaker source %q: %w", source, err)
+		}
+		v.trusted = append(v.trusted, network)
+	}
+	return v, nil
+}
+
+func (v *SpinnakerVerifier) VerifyPrincipalAndSetContext(tokenOrRawHeader string, c *gin.Context) error {
+	return v.principals.VerifyPrincipalAndSetContext(tokenOrRawHeader, c)
+}
+
+// VerifyRequestAndSetContext sets the principal of the Spinnaker identity of requests without a bearer token, false when the
+// request has a bearer token or no Spinnaker identity
+func (v *SpinnakerVerifier) VerifyRequestAndSetContext(c *gin.Context) (bool, error) {
+	if c.GetHeader(authorizationHeader) != "" || c.GetHeader(proxiedAuthorizationHeader) != "" {
+		return false, nil
+	}
+	user := strings.TrimSpace(c.GetHeader(v.config.Header))
+	if user == "" {
+		return false, nil
+	}
+	if !v.trustedSource(c.Request.RemoteAddr) {
+		return true, fmt.Errorf("%w: %s", ErrUntrustedSpinnakerSource, c.Request.RemoteAddr)
+	}
+	identity := SpinnakerIdentity{User: user}
+	for _, account := range strings.Split(c.GetHeader(SpinnakerAccountsHeader), ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			identity.Accounts = append(identity.Accounts, account)
+		}
+	}
+
+	principal, err := v.principal(c.Request.Context(), identity)
+	if err != nil {
+		return true, err
+	}
+	c.Request = c.Request.WithContext(principalKey.WithValue(c.Request.Context(), *principal))
+	return true, nil
+}
+
+// trustedSource whether the identity header may be accepted from the peer address of the request
+func (v *SpinnakerVerifier) trustedSource(remoteAddr string) bool {
+	if len(v.trusted) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range v.trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *SpinnakerVerifier) principal(ctx context.Context, identity SpinnakerIdentity) (*ArmoryCloudPrincipal, error) {
+	var principal ArmoryCloudPrincipal
+	if v.resolver != nil {
+		resolved, err := v.resolver.ResolveSpinnakerIdentity(ctx, identity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve spinnaker identity %s: %w", identity.User, err)
+		}
+		principal = *resolved
+	} else {
+		if !v.users[identity.User] {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSpinnakerIdentity, identity.User)
+		}
+		principal = ArmoryCloudPrincipal{
+			// Spinnaker identities only get the scopes they are granted, users are trusted with every scope by UnsafeHasScope
+			Type:    Machine,
+			Name:    identity.User,
+			Subject: identity.User,
+			OrgId:   v.config.OrgId,
+			EnvId:   v.config.EnvId,
+		}
+	}
+	if principal.Issuer == "" {
+		principal.Issuer = SpinnakerIssuer
+	}
+	principal.Scopes = append(append([]string{}, principal.Scopes...), v.config.Scopes...)
+	return &principal, nil
+}
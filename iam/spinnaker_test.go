@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iam
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type spinnakerResolverFunc func(ctx context.Context, identity SpinnakerIdentity) (*ArmoryCloudPrincipal, error)
+
+func (f spinnakerResolverFunc) ResolveSpinnakerIdentity(ctx context.Context, identity SpinnakerIdentity) (*ArmoryCloudPrincipal, error) {
+	return f(ctx, identity)
+}
+
+func spinnakerContext(headers map[string]string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	for name, value := range headers {
+		c.Request.Header.Set(name, value)
+	}
+	return c
+}
+
+func TestSpinnakerVerifier(t *testing.T) {
+	v, err := newSpinnakerVerifier(nil, SpinnakerConfiguration{
+		Enabled: true,
+		Users:   []string{"deployer@managed-service-account"},
+		OrgId:   "org-1",
+		EnvId:   "env-1",
+		Scopes:  []string{"api:deploy:full"},
+	}, nil)
+	require.NoError(t, err)
+
+	c := spinnakerContext(map[string]string{SpinnakerUserHeader: "deployer@managed-service-account", SpinnakerAccountsHeader: "prod, staging"})
+	handled, err := v.VerifyRequestAndSetContext(c)
+	assert.True(t, handled)
+	require.NoError(t, err)
+	principal, err := ExtractPrincipalFromContext(c.Request.Context())
+	require.NoError(t, err)
+	assert.Equal(t, ArmoryCloudPrincipal{
+		Type:    Machine,
+		Name:    "deployer@managed-service-account",
+		Subject: "deployer@managed-service-account",
+		Issuer:  SpinnakerIssuer,
+		OrgId:   "org-1",
+		EnvId:   "env-1",
+		Scopes:  []string{"api:deploy:full"},
+	}, *principal)
+
+	handled, err = v.VerifyRequestAndSetContext(spinnakerContext(map[string]string{SpinnakerUserHeader: "anonymous"}))
+	assert.True(t, handled)
+	assert.ErrorIs(t, err, ErrUnknownSpinnakerIdentity)
+
+	handled, _ = v.VerifyRequestAndSetContext(spinnakerContext(map[string]string{SpinnakerUserHeader: "deployer@managed-service-account", "Authorization": "Bearer token"}))
+	assert.False(t, handled, "bearer tokens take precedence")
+	handled, _ = v.VerifyRequestAndSetContext(spinnakerContext(nil))
+	assert.False(t, handled)
+}
+
+func TestSpinnakerVerifierResolver(t *testing.T) {
+	v, err := newSpinnakerVerifier(nil, SpinnakerConfiguration{Enabled: true, Header: "X-Fiat-User", Scopes: []string{"api:read"}}, spinnakerResolverFunc(
+		func(ctx context.Context, identity SpinnakerIdentity) (*ArmoryCloudPrincipal, error) {
+			if identity.User != "alice" {
+				return nil, ErrUnknownSpinnakerIdentity
+			}
+			return &ArmoryCloudPrincipal{Type: User, Name: identity.User, OrgId: "org-2", Roles: identity.Accounts, Scopes: []string{"api:write"}}, nil
+		}))
+	require.NoError(t, err)
+
+	c := spinnakerContext(map[string]string{"X-Fiat-User": "alice", SpinnakerAccountsHeader: "prod"})
+	handled, err := v.VerifyRequestAndSetContext(c)
+	assert.True(t, handled)
+	require.NoError(t, err)
+	principal, err := ExtractPrincipalFromContext(c.Request.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "org-2", principal.OrgId)
+	assert.Equal(t, []string{"prod"}, principal.Roles)
+	assert.Equal(t, []string{"api:write", "api:read"}, principal.Scopes)
+	assert.Equal(t, SpinnakerIssuer, principal.Issuer)
+
+	_, err = v.VerifyRequestAndSetContext(spinnakerContext(map[string]string{"X-Fiat-User": "bob"}))
+	assert.True(t, errors.Is(err, ErrUnknownSpinnakerIdentity))
+
+	_, err = newSpinnakerVerifier(nil, SpinnakerConfiguration{Enabled: true}, nil)
+	assert.EqualError(t, err, "spinnaker identities require an orgId or a SpinnakerIdentityResolver")
+	_, err = newSpinnakerVerifier(nil, SpinnakerConfiguration{Enabled: true, OrgId: "org-1"}, nil)
+	assert.EqualError(t, err, "spinnaker identities require users or a SpinnakerIdentityResolver", "any identity could be claimed")
+}
+
+func TestSpinnakerVerifierTrustedSources(t *testing.T) {
+	v, err := newSpinnakerVerifier(nil, SpinnakerConfiguration{Enabled: true, Users: []string{"deployer"}, OrgId: "org-1", TrustedSources: []string{"10.0.0.0/8", "192.168.1.5"}}, nil)
+	require.NoError(t, err)
+
+	for addr, trusted := range map[string]bool{"10.1.2.3:5000": true, "192.168.1.5:5000": true, "192.168.1.6:5000": false, "203.0.113.9:5000": false} {
+		c := spinnakerContext(map[string]string{SpinnakerUserHeader: "deployer"})
+		c.Request.RemoteAddr = addr
+		handled, err := v.VerifyRequestAndSetContext(c)
+		assert.True(t, handled, addr)
+		if trusted {
+			assert.NoError(t, err, addr)
+		} else {
+			assert.ErrorIs(t, err, ErrUntrustedSpinnakerSource, addr)
+		}
+	}
+
+	_, err = newSpinnakerVerifier(nil, SpinnakerConfiguration{Enabled: true, Users: []string{"deployer"}, OrgId: "org-1", TrustedSources: []string{"10.0.0/8"}}, nil)
+	assert.Error(t, err)
+}
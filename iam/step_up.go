@@ -0,0 +1,50 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iam
+
+import (
+	"context"
+	"time"
+)
+
+// StepUp a recent authentication of the principal with a second factor, such as a WebAuthn assertion, that handlers of
+// dangerous actions can require on top of the bearer token of the request
+type StepUp struct {
+	// Method how the principal authenticated, ex: webauthn
+	Method string `json:"method"`
+	// CredentialID the id of the credential the principal authenticated with
+	CredentialID string `json:"credentialId"`
+	// AuthenticatedAt when the principal authenticated
+	AuthenticatedAt time.Time `json:"authenticatedAt"`
+	// UserVerified whether the authenticator verified the user, with a PIN or biometrics, rather than only their presence
+	UserVerified bool `json:"userVerified"`
+}
+
+// WithStepUp records the step-up authentication onto the principal of the context, ErrNoPrincipal is returned when there isn't one
+func WithStepUp(ctx context.Context, stepUp StepUp) (context.Context, error) {
+	principal, ok := principalKey.Value(ctx)
+	if !ok {
+		return ctx, ErrNoPrincipal
+	}
+	principal.StepUp = &stepUp
+	return principalKey.WithValue(ctx, principal), nil
+}
+
+// SteppedUpWithin whether the principal authenticated with a second factor no longer than maxAge before now
+func (p *ArmoryCloudPrincipal) SteppedUpWithin(maxAge time.Duration, now time.Time) bool {
+	return p.StepUp != nil && !p.StepUp.AuthenticatedAt.After(now) && now.Sub(p.StepUp.AuthenticatedAt) <= maxAge
+}
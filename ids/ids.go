@@ -0,0 +1,308 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ids generates prefixed, time sortable identifiers such as dep_01GQ3WQ4N8AXTZ6PXKBZ3YCX2M.
+// The part after the prefix is a ULID, 48 bits of millisecond timestamp followed by 80 random bits in Crockford base32,
+// so IDs sort by creation time both as strings and in database indexes.
+package ids
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"go.uber.org/fx"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	separator = "_"
+	// encodedLength the length of the ULID part of an id
+	encodedLength = 26
+	crockford     = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var (
+	ErrInvalidID = errors.New("invalid id")
+
+	prefixPattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,15}$`)
+	decoding      [256]byte
+
+	defaultGenerator = NewGenerator(clock.New(), rand.Reader)
+)
+
+func init() {
+	for i := range decoding {
+		decoding[i] = 0xFF
+	}
+	for i := 0; i < len(crockford); i++ {
+		c := crockford[i]
+		decoding[c] = byte(i)
+		if c >= 'A' && c <= 'Z' {
+			decoding[c+('a'-'A')] = byte(i)
+		}
+	}
+}
+
+type (
+	// Prefixer declares the prefix of an ID type
+	//
+	//	type deployment struct{}
+	//
+	//	func (deployment) Prefix() string { return "dep" }
+	//
+	//	type DeploymentID = ids.ID[deployment]
+	Prefixer interface {
+		Prefix() string
+	}
+
+	// ID a type safe prefixed id, the zero value is an empty id.
+	// IDs marshal to JSON as strings and are stored in SQL as strings, reading an id with a different prefix fails
+	ID[T Prefixer] struct {
+		value string
+	}
+
+	// Generator creates ULIDs, ids created in the same millisecond by a Generator are monotonically increasing
+	Generator struct {
+		mu       sync.Mutex
+		clock    clock.Clock
+		entropy  io.Reader
+		lastMs   uint64
+		lastRand [10]byte
+	}
+)
+
+type generatorParameters struct {
+	fx.In
+	Clock clock.Clock `optional:"true"`
+}
+
+// Module provides a Generator, using the clock.Clock if one is provided, and registers the prefixed_id validation
+// with the server's validator when there is one
+var Module = fx.Module("ids",
+	fx.Provide(func(p generatorParameters) *Generator {
+		return NewGenerator(clock.OrDefault(p.Clock), rand.Reader)
+	}),
+	fx.Invoke(func(p validationParameters) error {
+		if p.Validator == nil {
+			return nil
+		}
+		return RegisterValidations(p.Validator)
+	}),
+)
+
+// NewGenerator returns a Generator that reads the time from c and randomness from entropy
+func NewGenerator(c clock.Clock, entropy io.Reader) *Generator {
+	return &Generator{clock: c, entropy: entropy}
+}
+
+// New creates an id of type T with the default generator
+func New[T Prefixer]() ID[T] {
+	return NewWith[T](defaultGenerator)
+}
+
+// NewWith creates an id of type T with g
+func NewWith[T Prefixer](g *Generator) ID[T] {
+	return ID[T]{value: prefix[T]() + separator + g.ulid()}
+}
+
+// NewString creates an untyped prefixed id, for callers that don't have an ID type
+func NewString(prefix string) string {
+	if !prefixPattern.MatchString(prefix) {
+		panic(fmt.Sprintf("ids: invalid prefix %q", prefix))
+	}
+	return prefix + separator + defaultGenerator.ulid()
+}
+
+// Parse validates s as an id of type T
+func Parse[T Prefixer](s string) (ID[T], error) {
+	if err := Validate(s, prefix[T]()); err != nil {
+		return ID[T]{}, err
+	}
+	return ID[T]{value: s}, nil
+}
+
+// MustParse is Parse that panics on invalid ids, for constants and tests
+func MustParse[T Prefixer](s string) ID[T] {
+	id, err := Parse[T](s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// Validate checks that s is a well-formed id, and when prefix is not empty that it has that prefix
+func Validate(s string, prefix string) error {
+	if len(s) <= encodedLength+len(separator) {
+		return fmt.Errorf("%w: %q is too short", ErrInvalidID, s)
+	}
+	p, encoded := s[:len(s)-encodedLength-len(separator)], s[len(s)-encodedLength:]
+	if s[len(p):len(p)+len(separator)] != separator || !prefixPattern.MatchString(p) {
+		return fmt.Errorf("%w: %q does not have a valid prefix", ErrInvalidID, s)
+	}
+	if prefix != "" && p != prefix {
+		return fmt.Errorf("%w: expected prefix %q but got %q", ErrInvalidID, prefix, p)
+	}
+	if _, err := decode(encoded); err != nil {
+		return fmt.Errorf("%w: %q %s", ErrInvalidID, s, err.Error())
+	}
+	return nil
+}
+
+func prefix[T Prefixer]() string {
+	var t T
+	p := t.Prefix()
+	if !prefixPattern.MatchString(p) {
+		panic(fmt.Sprintf("ids: invalid prefix %q for %T", p, t))
+	}
+	return p
+}
+
+func (id ID[T]) String() string {
+	return id.value
+}
+
+func (id ID[T]) IsZero() bool {
+	return id.value == ""
+}
+
+// Time the time the id was created, to the millisecond
+func (id ID[T]) Time() time.Time {
+	if id.IsZero() {
+		return time.Time{}
+	}
+	b, _ := decode(id.value[len(id.value)-encodedLength:])
+	ms := uint64(b[0])<<40 | uint64(b[1])<<32 | uint64(b[2])<<24 | uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+	return time.UnixMilli(int64(ms)).UTC()
+}
+
+func (id ID[T]) MarshalText() ([]byte, error) {
+	return []byte(id.value), nil
+}
+
+func (id *ID[T]) UnmarshalText(data []byte) error {
+	if len(data) == 0 {
+		*id = ID[T]{}
+		return nil
+	}
+	parsed, err := Parse[T](string(data))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, a zero id is stored as NULL
+func (id ID[T]) Value() (driver.Value, error) {
+	if id.IsZero() {
+		return nil, nil
+	}
+	return id.value, nil
+}
+
+// Scan implements sql.Scanner
+func (id *ID[T]) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*id = ID[T]{}
+		return nil
+	case string:
+		return id.UnmarshalText([]byte(v))
+	case []byte:
+		return id.UnmarshalText(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ids.ID", src)
+	}
+}
+
+func (g *Generator) ulid() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.clock.Now().UnixMilli())
+	if ms == g.lastMs {
+		// increment the previous random bits so ids created within the same millisecond still sort in creation order
+		for i := len(g.lastRand) - 1; i >= 0; i-- {
+			g.lastRand[i]++
+			if g.lastRand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		if _, err := io.ReadFull(g.entropy, g.lastRand[:]); err != nil {
+			panic(fmt.Sprintf("ids: failed to read entropy: %s", err))
+		}
+		g.lastMs = ms
+	}
+
+	var b [16]byte
+	b[0], b[1], b[2], b[3], b[4], b[5] = byte(ms>>40), byte(ms>>32), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+	copy(b[6:], g.lastRand[:])
+	return encode(b)
+}
+
+// encode the 128 bits as 26 base32 characters, the first character only carries 3 bits
+func encode(b [16]byte) string {
+	out := make([]byte, encodedLength)
+	// treat the id as a 130 bit big endian number, 2 leading zero bits followed by the 128 bits of b
+	for i := encodedLength - 1; i >= 0; i-- {
+		bit := (encodedLength - 1 - i) * 5 // offset of the lowest bit of this character from the end
+		var v uint16
+		for j := 0; j < 5; j++ {
+			pos := bit + j
+			if pos >= 128 {
+				break
+			}
+			if b[15-pos/8]&(1<<(pos%8)) != 0 {
+				v |= 1 << j
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out)
+}
+
+func decode(s string) ([16]byte, error) {
+	var b [16]byte
+	if len(s) != encodedLength {
+		return b, errors.New("has the wrong length")
+	}
+	if decoding[s[0]] > 7 {
+		return b, errors.New("overflows 128 bits")
+	}
+	for i := encodedLength - 1; i >= 0; i-- {
+		v := decoding[s[i]]
+		if v == 0xFF {
+			return b, fmt.Errorf("contains an invalid character %q", s[i])
+		}
+		bit := (encodedLength - 1 - i) * 5
+		for j := 0; j < 5; j++ {
+			pos := bit + j
+			if pos >= 128 {
+				break
+			}
+			if v&(1<<j) != 0 {
+				b[15-pos/8] |= 1 << (pos % 8)
+			}
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,123 @@
+package ids
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+)
+
+type deployment struct{}
+
+func (deployment) Prefix() string { return "dep" }
+
+type target struct{}
+
+func (target) Prefix() string { return "tgt" }
+
+type (
+	DeploymentID = ID[deployment]
+	TargetID     = ID[target]
+)
+
+func TestNew(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 123e6, time.UTC)
+	fake := clock.NewFake(now)
+	g := NewGenerator(fake, bytes.NewReader(bytes.Repeat([]byte{0xFF, 0x01}, 100)))
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		id := NewWith[deployment](g)
+		assert.True(t, strings.HasPrefix(id.String(), "dep_"))
+		assert.Len(t, id.String(), len("dep_")+26)
+		assert.Equal(t, now, id.Time())
+		created = append(created, id.String())
+	}
+	fake.Advance(time.Millisecond)
+	created = append(created, NewWith[deployment](g).String())
+
+	assert.True(t, sort.StringsAreSorted(created), "ids must sort in creation order: %v", created)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var b [16]byte
+	for i := range b {
+		b[i] = byte(i * 17)
+	}
+	decoded, err := decode(encode(b))
+	assert.NoError(t, err)
+	assert.Equal(t, b, decoded)
+
+	max := [16]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	assert.Equal(t, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encode(max))
+}
+
+func TestParse(t *testing.T) {
+	id := New[deployment]()
+
+	parsed, err := Parse[deployment](id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, parsed)
+
+	lower, err := Parse[deployment](strings.ToLower(id.String()))
+	assert.NoError(t, err, "decoding is case insensitive")
+	assert.Equal(t, id.Time(), lower.Time())
+
+	_, err = Parse[target](id.String())
+	assert.ErrorIs(t, err, ErrInvalidID)
+
+	for _, invalid := range []string{"", "dep_", "dep01H00000000000000000000000", "dep_8ZZZZZZZZZZZZZZZZZZZZZZZZZ", "dep_0000000000000000000000000U", "DEP_01H0000000000000000000000"} {
+		_, err = Parse[deployment](invalid)
+		assert.ErrorIs(t, err, ErrInvalidID, invalid)
+	}
+}
+
+func TestMarshaling(t *testing.T) {
+	type resource struct {
+		ID     DeploymentID `json:"id"`
+		Target TargetID     `json:"target"`
+	}
+	original := resource{ID: New[deployment](), Target: New[target]()}
+
+	data, err := json.Marshal(original)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"id":"dep_`)
+
+	var decoded resource
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, original, decoded)
+
+	swapped := strings.Replace(string(data), `"id":"dep_`, `"id":"tgt_`, 1)
+	assert.ErrorIs(t, json.Unmarshal([]byte(swapped), &decoded), ErrInvalidID)
+
+	value, err := original.ID.Value()
+	assert.NoError(t, err)
+	var scanned DeploymentID
+	assert.NoError(t, scanned.Scan(value))
+	assert.Equal(t, original.ID, scanned)
+
+	value, err = DeploymentID{}.Value()
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestValidation(t *testing.T) {
+	v := validator.New()
+	assert.NoError(t, RegisterValidations(v))
+
+	type request struct {
+		TargetID string `validate:"required,prefixed_id=tgt"`
+		AnyID    string `validate:"omitempty,prefixed_id"`
+	}
+
+	assert.NoError(t, v.Struct(request{TargetID: New[target]().String()}))
+	assert.NoError(t, v.Struct(request{TargetID: New[target]().String(), AnyID: NewString("evt")}))
+	assert.Error(t, v.Struct(request{TargetID: New[deployment]().String()}))
+	assert.Error(t, v.Struct(request{TargetID: "tgt_nope"}))
+}
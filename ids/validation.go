@@ -0,0 +1,42 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ids
+
+import (
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/fx"
+)
+
+// ValidationTag validates that a string field is a prefixed id, optionally with a specific prefix.
+// Fields typed as ID are validated when they are unmarshalled and don't need the tag
+//
+//	type CreateDeploymentRequest struct {
+//		TargetID string `json:"targetId" validate:"required,prefixed_id=tgt"`
+//	}
+const ValidationTag = "prefixed_id"
+
+type validationParameters struct {
+	fx.In
+	Validator *validator.Validate `optional:"true"`
+}
+
+// RegisterValidations registers the prefixed_id validation tag
+func RegisterValidations(v *validator.Validate) error {
+	return v.RegisterValidation(ValidationTag, func(fl validator.FieldLevel) bool {
+		return Validate(fl.Field().String(), fl.Param()) == nil
+	})
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package impex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type (
+	// rowReader reads the rows of a staged file one at a time. A row that can't be decoded is returned with its errors, io.EOF
+	// after the last row and any other error when the file itself can't be read any further
+	rowReader[T any] interface {
+		next() (T, []RowError, error)
+	}
+
+	// rowWriter writes the rows of an export, close completes the file
+	rowWriter[T any] interface {
+		write(row T) error
+		close() error
+	}
+
+	// column a field of the rows, named by its csv tag, its json tag or its name
+	column struct {
+		name  string
+		index []int
+	}
+
+	csvReader[T any] struct {
+		reader  *csv.Reader
+		columns map[string]column
+		header  []string
+		row     int64
+	}
+
+	// jsonReader reads a JSON array of rows or JSON lines, a row per line
+	jsonReader[T any] struct {
+		decoder *json.Decoder
+		lines   *bufio.Scanner
+		row     int64
+	}
+
+	csvWriter[T any] struct {
+		writer  *csv.Writer
+		columns []column
+		header  bool
+	}
+
+	jsonWriter[T any] struct {
+		w       io.Writer
+		encoder *json.Encoder
+		rows    int64
+	}
+)
+
+// columnsOf the columns of the exported fields of struct t, the fields of embedded structs are promoted
+func columnsOf(t reflect.Type) []column {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var columns []column
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for _, promoted := range columnsOf(field.Type) {
+				columns = append(columns, column{name: promoted.name, index: append([]int{i}, promoted.index...)})
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		for _, tag := range []string{"csv", "json"} {
+			if n, _, _ := strings.Cut(field.Tag.Get(tag), ","); n != "" {
+				name = n
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		columns = append(columns, column{name: name, index: []int{i}})
+	}
+	return columns
+}
+
+// columnOfField the column of the struct field named name, used to name the fields of validation errors
+func columnOfField(t reflect.Type, name string) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for _, c := range columnsOf(t) {
+		if t.FieldByIndex(c.index).Name == name {
+			return c.name
+		}
+	}
+	return name
+}
+
+func newCSVReader[T any](r io.Reader) *csvReader[T] {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	columns := map[string]column{}
+	for _, c := range columnsOf(reflect.TypeOf((*T)(nil)).Elem()) {
+		columns[strings.ToLower(c.name)] = c
+	}
+	return &csvReader[T]{reader: reader, columns: columns}
+}
+
+func (r *csvReader[T]) next() (T, []RowError, error) {
+	var row T
+	if r.header == nil {
+		header, err := r.reader.Read()
+		if err != nil {
+			return row, nil, err
+		}
+		r.header = make([]string, len(header))
+		for i, name := range header {
+			r.header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		}
+	}
+	// rows with a field count other than the header's are still decoded, missing fields are left empty
+	record, err := r.reader.Read()
+	if err != nil {
+		return row, nil, err
+	}
+	r.row++
+
+	value := reflect.ValueOf(&row).Elem()
+	var errs []RowError
+	for i, cell := range record {
+		if i >= len(r.header) || cell == "" {
+			continue
+		}
+		c, ok := r.columns[r.header[i]]
+		if !ok {
+			continue
+		}
+		if err := decodeCell(cell, value.FieldByIndex(c.index)); err != nil {
+			errs = append(errs, RowError{Row: r.row, Field: c.name, Message: fmt.Sprintf("%q is not a valid %s", cell, value.FieldByIndex(c.index).Type())})
+		}
+	}
+	return row, errs, nil
+}
+
+// decodeCell converts the text of a cell to the type of the field, times are RFC 3339 and durations Go durations such as 1m30s
+func decodeCell(cell string, field reflect.Value) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           field.Addr().Interface(),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(cell)
+}
+
+func newJSONReader[T any](r io.Reader) (*jsonReader[T], error) {
+	buffered := bufio.NewReader(r)
+	for {
+		b, err := buffered.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = buffered.ReadByte()
+			continue
+		case '[':
+			decoder := json.NewDecoder(buffered)
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return &jsonReader[T]{decoder: decoder}, nil
+		}
+		lines := bufio.NewScanner(buffered)
+		lines.Buffer(make([]byte, 64*1024), maxJSONLine)
+		return &jsonReader[T]{lines: lines}, nil
+	}
+}
+
+func (r *jsonReader[T]) next() (T, []RowError, error) {
+	var row T
+	var raw []byte
+	if r.decoder != nil {
+		if !r.decoder.More() {
+			return row, nil, io.EOF
+		}
+		var message json.RawMessage
+		// a syntax error leaves the decoder nowhere to continue from, it fails the job
+		if err := r.decoder.Decode(&message); err != nil {
+			return row, nil, err
+		}
+		raw = message
+	} else {
+		for len(bytes.TrimSpace(raw)) == 0 {
+			if !r.lines.Scan() {
+				if err := r.lines.Err(); err != nil {
+					return row, nil, err
+				}
+				return row, nil, io.EOF
+			}
+			raw = r.lines.Bytes()
+		}
+	}
+	r.row++
+
+	if err := json.Unmarshal(raw, &row); err != nil {
+		rowErr := RowError{Row: r.row, Message: err.Error()}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			rowErr.Field = typeErr.Field
+			rowErr.Message = fmt.Sprintf("%s is not a valid %s", typeErr.Value, typeErr.Type)
+		}
+		return row, []RowError{rowErr}, nil
+	}
+	return row, nil, nil
+}
+
+func newCSVWriter[T any](w io.Writer) *csvWriter[T] {
+	return &csvWriter[T]{writer: csv.NewWriter(w), columns: columnsOf(reflect.TypeOf((*T)(nil)).Elem())}
+}
+
+func (w *csvWriter[T]) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	names := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		names[i] = c.name
+	}
+	return w.writer.Write(names)
+}
+
+func (w *csvWriter[T]) write(row T) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	value := reflect.ValueOf(row)
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+	record := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		cell, err := encodeCell(value, c.index)
+		if err != nil {
+			return fmt.Errorf("failed to encode column %s: %w", c.name, err)
+		}
+		record[i] = cell
+	}
+	return w.writer.Write(record)
+}
+
+// encodeCell the text of a field, times are RFC 3339 and values that aren't scalars are JSON encoded
+func encodeCell(value reflect.Value, index []int) (string, error) {
+	field, err := value.FieldByIndexErr(index)
+	if err != nil {
+		// a nil embedded pointer
+		return "", nil
+	}
+	for field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return "", nil
+		}
+		field = field.Elem()
+	}
+	switch v := field.Interface().(type) {
+	case time.Time:
+		if v.IsZero() {
+			return "", nil
+		}
+		return v.Format(time.RFC3339), nil
+	case time.Duration:
+		return v.String(), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	switch field.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Interface:
+		b, err := json.Marshal(field.Interface())
+		return string(b), err
+	default:
+		return fmt.Sprint(field.Interface()), nil
+	}
+}
+
+func (w *csvWriter[T]) close() error {
+	// an export without rows still has a header
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func newJSONWriter[T any](w io.Writer) *jsonWriter[T] {
+	return &jsonWriter[T]{w: w, encoder: json.NewEncoder(w)}
+}
+
+// write adds the row to a JSON array, the array is opened by the first row so that an export without rows is still []
+func (w *jsonWriter[T]) write(row T) error {
+	separator := ",\n"
+	if w.rows == 0 {
+		separator = "[\n"
+	}
+	if _, err := io.WriteString(w.w, separator); err != nil {
+		return err
+	}
+	w.rows++
+	// Encode ends each row with a newline, which the separator of the next row follows
+	return w.encoder.Encode(row)
+}
+
+func (w *jsonWriter[T]) close() error {
+	closing := "]\n"
+	if w.rows == 0 {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(w.w, closing)
+	return err
+}
@@ -0,0 +1,546 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package impex runs CSV and JSON import and export jobs of any size, staging their files in blob storage:
+//
+//	impex:
+//	  prefix: impex/deployments
+//	  chunkSize: 500
+//
+//	job := impex.Job{ID: operationID, Format: impex.FormatCSV}
+//	if _, err := jobs.Stage(ctx, job, upload); err != nil { ... }
+//	result, err := impex.Import(ctx, jobs, job, func(ctx context.Context, rows []impex.Row[Deployment]) ([]impex.RowError, error) {
+//		return nil, repository.SaveAll(ctx, rows)
+//	})
+//
+// Staged files are parsed as they are read, so rows are never all in memory. Each row is decoded and validated with its
+// validate tags, rows that fail are left out and their errors collected into a CSV report that is uploaded next to the
+// staged file, the valid rows are handed to the job in chunks. Progress is reported after every chunk to the ProgressReporter,
+// which is backed by the async operations of the application when one is provided
+package impex
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/validation"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"path"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FormatCSV  Format = "csv"
+	FormatJSON Format = "json"
+
+	KindImport Kind = "import"
+	KindExport Kind = "export"
+
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+
+	rowsMetric = "impex.rows"
+	jobsMetric = "impex.jobs"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+
+	reportName = "errors.csv"
+
+	defaultPrefix            = "impex"
+	defaultChunkSize         = 500
+	defaultMaxReportedErrors = 10_000
+	defaultURLExpiry         = time.Hour
+	// maxJSONLine the longest JSON line a row can be
+	maxJSONLine = 4 * 1024 * 1024
+)
+
+var (
+	// ErrInvalidJob the job has no id or its format isn't csv or json
+	ErrInvalidJob = errors.New("invalid impex job")
+)
+
+type (
+	Format string
+	Kind   string
+	State  string
+
+	Configuration struct {
+		// Prefix the key prefix of the files of the jobs in the blob.Store, defaults to impex
+		Prefix string
+		// ChunkSize the rows handed to an import at once, and between progress reports. Defaults to 500
+		ChunkSize int
+		// MaxReportedErrors the row errors listed in the report of a job, the rows that failed are all counted. Defaults to 10000
+		MaxReportedErrors int
+		// URLExpiry how long the signed URLs of reports and exports are valid for, defaults to 1h
+		URLExpiry time.Duration
+	}
+
+	// Job the files of a job are stored under its id, such as the id of the async operation that runs it
+	Job struct {
+		ID     string
+		Format Format
+	}
+
+	// Row a row of an import, Number counts the rows of the file from 1 not including the header of a CSV file
+	Row[T any] struct {
+		Number int64
+		Value  T
+	}
+
+	// RowError a row that couldn't be imported, Field is the column or JSON field at fault when there is one
+	RowError struct {
+		Row     int64  `json:"row"`
+		Field   string `json:"field,omitempty"`
+		Message string `json:"message"`
+	}
+
+	// ChunkHandler imports a chunk of valid rows, the returned row errors are added to the report while an error fails the job
+	ChunkHandler[T any] func(ctx context.Context, rows []Row[T]) ([]RowError, error)
+
+	// Producer emits the rows of an export in order, an error returned by emit must be returned as is
+	Producer[T any] func(ctx context.Context, emit func(row T) error) error
+
+	// Progress the state of a job, reported after every chunk and once it is done
+	Progress struct {
+		JobID string `json:"jobId"`
+		Kind  Kind   `json:"kind"`
+		State State  `json:"state"`
+		// Processed the rows read by an import or written by an export so far, Failed the rows of an import that weren't imported
+		Processed int64 `json:"processed"`
+		Failed    int64 `json:"failed"`
+		// BytesRead and BytesTotal the part of the staged file an import read, to estimate how far along it is
+		BytesRead  int64 `json:"bytesRead,omitempty"`
+		BytesTotal int64 `json:"bytesTotal,omitempty"`
+		// ReportKey the key of the report of the rows that failed, OutputKey the key of the file of an export
+		ReportKey string    `json:"reportKey,omitempty"`
+		OutputKey string    `json:"outputKey,omitempty"`
+		Error     string    `json:"error,omitempty"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}
+
+	// Result the final progress of a job, with signed URLs to download its report and output
+	Result struct {
+		Progress
+		ReportURL string `json:"reportUrl,omitempty"`
+		OutputURL string `json:"outputUrl,omitempty"`
+	}
+
+	// ProgressReporter receives the progress of jobs, such as the async operations subsystem of an application
+	ProgressReporter interface {
+		Report(ctx context.Context, progress Progress) error
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config Configuration `optional:"true"`
+		Store  blob.Store
+		// Progress receives the progress of jobs when provided, such as the async operations of the application
+		Progress ProgressReporter `optional:"true"`
+		// Validator validates rows, defaults to a validator with the tags of the validation package
+		Validator *validator.Validate `optional:"true"`
+		Log       *zap.SugaredLogger
+		Metrics   metrics.MetricsSvc `optional:"true"`
+		Clock     clock.Clock        `optional:"true"`
+	}
+
+	// Jobs runs the imports and exports of a blob.Store, see Import and Export
+	Jobs struct {
+		config   Configuration
+		store    blob.Store
+		progress ProgressReporter
+		validate *validator.Validate
+		log      *zap.SugaredLogger
+		metrics  metrics.MetricsSvc
+		clock    clock.Clock
+	}
+
+	// tracker keeps the progress of a running job
+	tracker struct {
+		jobs     *Jobs
+		progress Progress
+		errors   []RowError
+		read     *countingReader
+	}
+
+	countingReader struct {
+		r io.Reader
+		n atomic.Int64
+	}
+)
+
+var Module = fx.Module("impex", fx.Provide(New))
+
+// New creates the Jobs of the configuration
+func New(p Parameters) (*Jobs, error) {
+	validate := p.Validator
+	if validate == nil {
+		validate = validator.New()
+		if err := validation.Register(validate, validation.Validations()...); err != nil {
+			return nil, err
+		}
+	}
+	return &Jobs{
+		config:   p.Config.withDefaults(),
+		store:    p.Store,
+		progress: p.Progress,
+		validate: validate,
+		log:      p.Log,
+		metrics:  p.Metrics,
+		clock:    clock.OrDefault(p.Clock),
+	}, nil
+}
+
+// Stage uploads the file of an import, it is streamed to the blob.Store rather than buffered. Returns the key of the file
+func (j *Jobs) Stage(ctx context.Context, job Job, body io.Reader) (string, error) {
+	if err := job.validate(); err != nil {
+		return "", err
+	}
+	key := j.key(job, "source."+string(job.Format))
+	if _, err := j.store.Put(ctx, key, body, blob.PutOptions{ContentType: job.Format.contentType()}); err != nil {
+		return "", fmt.Errorf("failed to stage the file of %s: %w", job.ID, err)
+	}
+	return key, nil
+}
+
+// Import reads the file staged for the job and hands its valid rows to handle in chunks. The result lists the rows that failed
+// in a report, an error is returned along with the result when the job itself failed
+func Import[T any](ctx context.Context, j *Jobs, job Job, handle ChunkHandler[T]) (*Result, error) {
+	if err := job.validate(); err != nil {
+		return nil, err
+	}
+	t := j.start(ctx, job, KindImport)
+	if err := importRows(ctx, t, job, handle); err != nil {
+		return t.fail(ctx, err)
+	}
+	return t.succeed(ctx)
+}
+
+func importRows[T any](ctx context.Context, t *tracker, job Job, handle ChunkHandler[T]) error {
+	j := t.jobs
+	rowType := reflect.TypeOf((*T)(nil)).Elem()
+	if job.Format == FormatCSV && rowType.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: the rows of csv files must be structs, not %s", ErrInvalidJob, rowType)
+	}
+	object, err := j.store.Get(ctx, j.key(job, "source."+string(job.Format)))
+	if err != nil {
+		return fmt.Errorf("failed to read the staged file: %w", err)
+	}
+	defer object.Body.Close()
+	t.read = &countingReader{r: object.Body}
+	t.progress.BytesTotal = object.Size
+
+	var rows rowReader[T]
+	if job.Format == FormatCSV {
+		rows = newCSVReader[T](t.read)
+	} else if rows, err = newJSONReader[T](t.read); errors.Is(err, io.EOF) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read the staged file: %w", err)
+	}
+
+	chunk := make([]Row[T], 0, j.config.ChunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		errs, err := handle(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		t.processed(int64(len(chunk)), errs)
+		chunk = chunk[:0]
+		t.report(ctx)
+		return nil
+	}
+	for {
+		value, errs, err := rows.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read row %d of the staged file: %w", t.progress.Processed+int64(len(chunk))+1, err)
+		}
+		number := t.progress.Processed + int64(len(chunk)) + 1
+		if len(errs) == 0 {
+			errs = j.validateRow(number, value)
+		}
+		if len(errs) > 0 {
+			// rows that fail are counted right away, the ones before them in the chunk are counted once it is handled
+			t.failed(errs)
+			continue
+		}
+		chunk = append(chunk, Row[T]{Number: number, Value: value})
+		if len(chunk) == j.config.ChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// Export writes the rows produce emits to the file of the job, streaming it to the blob.Store as they are emitted
+func Export[T any](ctx context.Context, j *Jobs, job Job, produce Producer[T]) (*Result, error) {
+	if err := job.validate(); err != nil {
+		return nil, err
+	}
+	t := j.start(ctx, job, KindExport)
+	key := j.key(job, "export."+string(job.Format))
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := j.store.Put(ctx, key, pr, blob.PutOptions{ContentType: job.Format.contentType()})
+		// unblocks the producer when the upload fails before the file is complete
+		_ = pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	var rows rowWriter[T]
+	if job.Format == FormatCSV {
+		rows = newCSVWriter[T](pw)
+	} else {
+		rows = newJSONWriter[T](pw)
+	}
+	err := produce(ctx, func(row T) error {
+		if err := rows.write(row); err != nil {
+			return err
+		}
+		t.progress.Processed++
+		if t.progress.Processed%int64(j.config.ChunkSize) == 0 {
+			t.report(ctx)
+		}
+		return nil
+	})
+	if err == nil {
+		err = rows.close()
+	}
+	_ = pw.CloseWithError(err)
+	if uploadErr := <-uploaded; err == nil && uploadErr != nil {
+		err = fmt.Errorf("failed to upload the export: %w", uploadErr)
+	}
+	if err != nil {
+		return t.fail(ctx, err)
+	}
+	t.progress.OutputKey = key
+	return t.succeed(ctx)
+}
+
+// validateRow the errors of the validate tags of the row, rows that aren't structs aren't validated
+func (j *Jobs) validateRow(number int64, row any) []RowError {
+	t := reflect.TypeOf(row)
+	if t == nil || reflect.Indirect(reflect.ValueOf(row)).Kind() != reflect.Struct {
+		return nil
+	}
+	err := j.validate.Struct(row)
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		return nil
+	}
+	errs := make([]RowError, len(fieldErrors))
+	for i, fe := range fieldErrors {
+		errs[i] = RowError{Row: number, Field: columnOfField(t, fe.StructField()), Message: validation.Message(j.validate, fe)}
+	}
+	return errs
+}
+
+func (j *Jobs) start(ctx context.Context, job Job, kind Kind) *tracker {
+	t := &tracker{jobs: j, progress: Progress{JobID: job.ID, Kind: kind, State: StateRunning}}
+	t.report(ctx)
+	return t
+}
+
+func (j *Jobs) key(job Job, name string) string {
+	return path.Join(j.config.Prefix, job.ID, name)
+}
+
+// signedURL a URL to download the file stored at key, empty when the store can't sign one
+func (j *Jobs) signedURL(ctx context.Context, key string) string {
+	url, err := j.store.SignedURL(ctx, key, blob.SignedURLOptions{Expires: j.config.URLExpiry})
+	if err != nil {
+		j.log.Warnw("Failed to sign the URL of an impex file", "key", key, "error", err)
+		return ""
+	}
+	return url
+}
+
+func (j *Jobs) count(metric string, kind Kind, outcome string, n int64) {
+	if j.metrics == nil || n == 0 {
+		return
+	}
+	j.metrics.CounterWithTags(metric, map[string]string{"kind": string(kind), "outcome": outcome}).Inc(n)
+}
+
+// processed counts the rows of a handled chunk, some of which the handler may have failed
+func (t *tracker) processed(n int64, errs []RowError) {
+	failed := map[int64]bool{}
+	for _, err := range errs {
+		failed[err.Row] = true
+	}
+	t.progress.Processed += n - int64(len(failed))
+	t.jobs.count(rowsMetric, t.progress.Kind, outcomeSuccess, n-int64(len(failed)))
+	t.failed(errs)
+}
+
+// failed counts the rows of the errors and collects the errors for the report
+func (t *tracker) failed(errs []RowError) {
+	rows := map[int64]bool{}
+	for _, err := range errs {
+		rows[err.Row] = true
+	}
+	t.progress.Processed += int64(len(rows))
+	t.progress.Failed += int64(len(rows))
+	t.jobs.count(rowsMetric, t.progress.Kind, outcomeFailure, int64(len(rows)))
+	if room := t.jobs.config.MaxReportedErrors - len(t.errors); room > 0 {
+		if len(errs) > room {
+			errs = errs[:room]
+		}
+		t.errors = append(t.errors, errs...)
+	}
+}
+
+// report sends the progress to the ProgressReporter, a job isn't failed because its progress can't be reported
+func (t *tracker) report(ctx context.Context) {
+	if t.read != nil {
+		t.progress.BytesRead = t.read.n.Load()
+	}
+	t.progress.UpdatedAt = t.jobs.clock.Now()
+	if t.jobs.progress == nil {
+		return
+	}
+	if err := t.jobs.progress.Report(ctx, t.progress); err != nil {
+		t.jobs.log.Warnw("Failed to report the progress of an impex job", "jobId", t.progress.JobID, "kind", t.progress.Kind, "error", err)
+	}
+}
+
+func (t *tracker) succeed(ctx context.Context) (*Result, error) {
+	result, err := t.finish(ctx)
+	if err != nil {
+		return t.fail(ctx, err)
+	}
+	t.progress.State = StateSucceeded
+	result.Progress = t.progress
+	t.report(ctx)
+	t.jobs.count(jobsMetric, t.progress.Kind, outcomeSuccess, 1)
+	return result, nil
+}
+
+func (t *tracker) fail(ctx context.Context, cause error) (*Result, error) {
+	result, err := t.finish(ctx)
+	if err != nil {
+		t.jobs.log.Errorw("Failed to upload the report of a failed impex job", "jobId", t.progress.JobID, "error", err)
+	}
+	t.progress.State = StateFailed
+	t.progress.Error = cause.Error()
+	result.Progress = t.progress
+	t.report(ctx)
+	t.jobs.count(jobsMetric, t.progress.Kind, outcomeFailure, 1)
+	return result, fmt.Errorf("impex %s %s failed: %w", t.progress.Kind, t.progress.JobID, cause)
+}
+
+// finish uploads the report of the rows that failed and signs the URLs of the files of the job
+func (t *tracker) finish(ctx context.Context) (*Result, error) {
+	result := &Result{}
+	if t.progress.OutputKey != "" {
+		result.OutputURL = t.jobs.signedURL(ctx, t.progress.OutputKey)
+	}
+	if len(t.errors) == 0 {
+		return result, nil
+	}
+	var report bytes.Buffer
+	w := csv.NewWriter(&report)
+	_ = w.Write([]string{"row", "field", "message"})
+	for _, err := range t.errors {
+		_ = w.Write([]string{strconv.FormatInt(err.Row, 10), err.Field, err.Message})
+	}
+	w.Flush()
+	key := path.Join(t.jobs.config.Prefix, t.progress.JobID, reportName)
+	// the report of a canceled job is still uploaded, so the rows that failed are reported
+	uploadCtx := ctx
+	if ctx.Err() != nil {
+		uploadCtx = context.Background()
+	}
+	if _, err := t.jobs.store.Put(uploadCtx, key, &report, blob.PutOptions{ContentType: FormatCSV.contentType()}); err != nil {
+		return result, fmt.Errorf("failed to upload the error report: %w", err)
+	}
+	t.progress.ReportKey = key
+	result.ReportURL = t.jobs.signedURL(ctx, key)
+	return result, nil
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Error formats the row error as it is listed in reports
+func (e RowError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("row %d: %s", e.Row, e.Message)
+	}
+	return fmt.Sprintf("row %d, %s: %s", e.Row, e.Field, e.Message)
+}
+
+func (j Job) validate() error {
+	if j.ID == "" || path.Base(j.ID) != j.ID {
+		return fmt.Errorf("%w: id %q must be a single path segment", ErrInvalidJob, j.ID)
+	}
+	if j.Format != FormatCSV && j.Format != FormatJSON {
+		return fmt.Errorf("%w: format %q must be %s or %s", ErrInvalidJob, j.Format, FormatCSV, FormatJSON)
+	}
+	return nil
+}
+
+func (f Format) contentType() string {
+	if f == FormatCSV {
+		return "text/csv"
+	}
+	return "application/json"
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.Prefix == "" {
+		c.Prefix = defaultPrefix
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = defaultChunkSize
+	}
+	if c.MaxReportedErrors <= 0 {
+		c.MaxReportedErrors = defaultMaxReportedErrors
+	}
+	if c.URLExpiry <= 0 {
+		c.URLExpiry = defaultURLExpiry
+	}
+	return c
+}
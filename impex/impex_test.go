@@ -0,0 +1,255 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package impex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	memoryStore struct {
+		blob.Store
+		mu      sync.Mutex
+		objects map[string][]byte
+	}
+
+	progressLog struct {
+		reports []Progress
+	}
+
+	deployment struct {
+		Name      string        `json:"name" validate:"required"`
+		Replicas  int           `json:"replicas" validate:"gte=1"`
+		Timeout   time.Duration `csv:"timeout" json:"timeout"`
+		CreatedAt time.Time     `json:"createdAt"`
+		Labels    []string      `json:"labels,omitempty"`
+		internal  string
+	}
+)
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}}
+}
+
+func (m *memoryStore) Put(_ context.Context, key string, body io.Reader, _ blob.PutOptions) (*blob.ObjectInfo, error) {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = content
+	return &blob.ObjectInfo{Key: key, Size: int64(len(content))}, nil
+}
+
+func (m *memoryStore) Get(_ context.Context, key string) (*blob.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return &blob.Object{ObjectInfo: blob.ObjectInfo{Key: key, Size: int64(len(content))}, Body: io.NopCloser(bytes.NewReader(content))}, nil
+}
+
+func (m *memoryStore) SignedURL(_ context.Context, key string, _ blob.SignedURLOptions) (string, error) {
+	return "https://blobs.example.com/" + key, nil
+}
+
+func (p *progressLog) Report(_ context.Context, progress Progress) error {
+	p.reports = append(p.reports, progress)
+	return nil
+}
+
+func newTestJobs(t *testing.T, store blob.Store, progress ProgressReporter) *Jobs {
+	jobs, err := New(Parameters{
+		Config:   Configuration{ChunkSize: 2},
+		Store:    store,
+		Progress: progress,
+		Log:      zap.NewNop().Sugar(),
+		Clock:    clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)),
+	})
+	require.NoError(t, err)
+	return jobs
+}
+
+func TestImportCSV(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	progress := &progressLog{}
+	jobs := newTestJobs(t, store, progress)
+	job := Job{ID: "op-1", Format: FormatCSV}
+
+	key, err := jobs.Stage(ctx, job, strings.NewReader("\ufeffName,replicas,timeout,createdAt,unknown\n"+
+		"api,3,1m,2023-01-02T03:04:05Z,x\n"+
+		",2,,,\n"+
+		"worker,many,,,\n"+
+		"cron,1\n"+
+		"web,0,,,\n"+
+		"proxy,1,,,\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "impex/op-1/source.csv", key)
+
+	var imported []Row[deployment]
+	result, err := Import(ctx, jobs, job, func(ctx context.Context, rows []Row[deployment]) ([]RowError, error) {
+		var errs []RowError
+		for _, row := range rows {
+			if row.Value.Name == "proxy" {
+				errs = append(errs, RowError{Row: row.Number, Message: "proxy already exists"})
+				continue
+			}
+			imported = append(imported, row)
+		}
+		return errs, nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, imported, 2)
+	assert.Equal(t, Row[deployment]{Number: 1, Value: deployment{Name: "api", Replicas: 3, Timeout: time.Minute, CreatedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}}, imported[0])
+	assert.Equal(t, Row[deployment]{Number: 4, Value: deployment{Name: "cron", Replicas: 1}}, imported[1], "rows with missing fields are decoded")
+
+	assert.Equal(t, StateSucceeded, result.State)
+	assert.Equal(t, int64(6), result.Processed)
+	assert.Equal(t, int64(4), result.Failed)
+	assert.Equal(t, "impex/op-1/errors.csv", result.ReportKey)
+	assert.Equal(t, "https://blobs.example.com/impex/op-1/errors.csv", result.ReportURL)
+	assert.Equal(t, result.BytesTotal, result.BytesRead)
+	assert.Equal(t, `row,field,message
+2,name,Key: 'deployment.Name' Error:Field validation for 'Name' failed on the 'required' tag
+3,replicas,"""many"" is not a valid int"
+5,replicas,Key: 'deployment.Replicas' Error:Field validation for 'Replicas' failed on the 'gte' tag
+6,,proxy already exists
+`, string(store.objects[result.ReportKey]))
+
+	require.NotEmpty(t, progress.reports)
+	assert.Equal(t, StateRunning, progress.reports[0].State)
+	assert.Equal(t, result.Progress, progress.reports[len(progress.reports)-1])
+}
+
+func TestImportJSON(t *testing.T) {
+	ctx := context.Background()
+	for name, content := range map[string]string{
+		"array": `[{"name": "api", "replicas": 2}, {"name": "worker", "replicas": "2"}, {"replicas": 1}]`,
+		"lines": "{\"name\": \"api\", \"replicas\": 2}\n\n{\"name\": \"worker\", \"replicas\": \"2\"}\n{\"replicas\": 1}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newMemoryStore()
+			jobs := newTestJobs(t, store, nil)
+			job := Job{ID: "op-" + name, Format: FormatJSON}
+			_, err := jobs.Stage(ctx, job, strings.NewReader(content))
+			require.NoError(t, err)
+
+			var names []string
+			result, err := Import(ctx, jobs, job, func(ctx context.Context, rows []Row[deployment]) ([]RowError, error) {
+				for _, row := range rows {
+					names = append(names, row.Value.Name)
+				}
+				return nil, nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"api"}, names)
+			assert.Equal(t, int64(3), result.Processed)
+			assert.Equal(t, int64(2), result.Failed)
+			assert.Contains(t, string(store.objects[result.ReportKey]), "2,replicas,string is not a valid int")
+		})
+	}
+}
+
+func TestImportFailure(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	progress := &progressLog{}
+	jobs := newTestJobs(t, store, progress)
+	job := Job{ID: "op-1", Format: FormatCSV}
+	_, err := jobs.Stage(ctx, job, strings.NewReader("name,replicas\napi,0\nworker,1\n"))
+	require.NoError(t, err)
+
+	result, err := Import(ctx, jobs, job, func(ctx context.Context, rows []Row[deployment]) ([]RowError, error) {
+		return nil, errors.New("database is unavailable")
+	})
+	assert.EqualError(t, err, "impex import op-1 failed: database is unavailable")
+	assert.Equal(t, StateFailed, result.State)
+	assert.Equal(t, "database is unavailable", result.Error)
+	assert.NotEmpty(t, result.ReportURL, "the rows that failed before the job did are still reported")
+
+	_, err = Import(ctx, jobs, Job{ID: "op-2", Format: FormatCSV}, func(ctx context.Context, rows []Row[deployment]) ([]RowError, error) {
+		return nil, nil
+	})
+	assert.ErrorIs(t, err, blob.ErrNotFound, "jobs without a staged file fail")
+
+	_, err = jobs.Stage(ctx, Job{ID: "../op", Format: FormatCSV}, strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrInvalidJob)
+	_, err = jobs.Stage(ctx, Job{ID: "op-3", Format: "xml"}, strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrInvalidJob)
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	rows := []deployment{
+		{Name: "api", Replicas: 2, Timeout: time.Minute, Labels: []string{"team=cd"}},
+		{Name: "worker, batch", Replicas: 1, CreatedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Name: "cron", Replicas: 1},
+	}
+	produce := func(ctx context.Context, emit func(row deployment) error) error {
+		for _, row := range rows {
+			if err := emit(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	store := newMemoryStore()
+	progress := &progressLog{}
+	jobs := newTestJobs(t, store, progress)
+	result, err := Export(ctx, jobs, Job{ID: "op-1", Format: FormatCSV}, produce)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), result.Processed)
+	assert.Equal(t, "impex/op-1/export.csv", result.OutputKey)
+	assert.Equal(t, "https://blobs.example.com/impex/op-1/export.csv", result.OutputURL)
+	assert.Equal(t, `name,replicas,timeout,createdAt,labels
+api,2,1m0s,,"[""team=cd""]"
+"worker, batch",1,0s,2023-01-02T03:04:05Z,null
+cron,1,0s,,null
+`, string(store.objects[result.OutputKey]))
+	assert.Len(t, progress.reports, 3, "started, after a chunk of rows and done")
+
+	result, err = Export(ctx, jobs, Job{ID: "op-2", Format: FormatJSON}, produce)
+	require.NoError(t, err)
+	var exported []deployment
+	require.NoError(t, json.Unmarshal(store.objects[result.OutputKey], &exported))
+	assert.Equal(t, rows, exported)
+
+	result, err = Export(ctx, jobs, Job{ID: "op-3", Format: FormatJSON}, func(ctx context.Context, emit func(row deployment) error) error {
+		return errors.New("query failed")
+	})
+	assert.EqualError(t, err, "impex export op-3 failed: query failed")
+	assert.Equal(t, StateFailed, result.State)
+}
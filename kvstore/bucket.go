@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// Bucket the values of type T of a bucket of the store, marshaled as JSON
+	Bucket[T any] struct {
+		store *Store
+		name  string
+	}
+
+	// PutOption customizes how a value is put
+	PutOption func(*putOptions)
+
+	putOptions struct {
+		ttl time.Duration
+	}
+)
+
+// NewBucket the bucket with the name, buckets are created as values are put in them
+func NewBucket[T any](store *Store, name string) *Bucket[T] {
+	return &Bucket[T]{store: store, name: name}
+}
+
+// WithTTL expires the value after ttl, expired values are no longer returned and are removed when the store is opened and every Configuration.ExpiryInterval
+func WithTTL(ttl time.Duration) PutOption {
+	return func(o *putOptions) {
+		o.ttl = ttl
+	}
+}
+
+// Get the value of the key, false when there is none or it expired
+func (b *Bucket[T]) Get(key string) (T, bool, error) {
+	var value T
+	raw, ok, err := b.store.get(b.name, key)
+	if err != nil || !ok {
+		return value, false, err
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, false, fmt.Errorf("kvstore: failed to unmarshal %s/%s: %w", b.name, key, err)
+	}
+	return value, true, nil
+}
+
+// Put sets the value of the key, replacing any previous value and TTL
+func (b *Bucket[T]) Put(key string, value T, options ...PutOption) error {
+	o := &putOptions{}
+	for _, option := range options {
+		option(o)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("kvstore: failed to marshal %s/%s: %w", b.name, key, err)
+	}
+	return b.store.put(b.name, key, raw, o.ttl)
+}
+
+// Delete removes the value of the key, if any
+func (b *Bucket[T]) Delete(key string) error {
+	return b.store.delete(b.name, key)
+}
+
+// Keys the sorted keys of the values of the bucket that haven't expired, nil when the store can't be read
+func (b *Bucket[T]) Keys() []string {
+	entries, err := b.store.entries(b.name)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// All the values of the bucket that haven't expired, by key
+func (b *Bucket[T]) All() (map[string]T, error) {
+	entries, err := b.store.entries(b.name)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]T, len(entries))
+	for key, raw := range entries {
+		var value T
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("kvstore: failed to unmarshal %s/%s: %w", b.name, key, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/envutils"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+type (
+	Configuration struct {
+		// Path the bbolt file the store is persisted to, defaults to data.kv in the working directory
+		Path string
+		// SyncWrites flushes every change to disk before returning
+		SyncWrites bool
+		// ExpiryInterval how often the values that expired are removed from the file, defaults to an hour
+		ExpiryInterval time.Duration
+		// Inspect serves the buckets and their values at the kvstore endpoint of the management server to authenticated principals.
+		// It is only honoured when the environment or an active profile is dev, see envutils.IsDev
+		Inspect bool
+	}
+
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    Configuration `optional:"true"`
+		Clock     clock.Clock   `optional:"true"`
+		Log       *zap.SugaredLogger
+	}
+
+	InspectionParameters struct {
+		fx.In
+
+		Store    *Store
+		Config   Configuration                `optional:"true"`
+		Metadata metadata.ApplicationMetadata `optional:"true"`
+		Log      *zap.SugaredLogger
+	}
+
+	inspectionController struct {
+		store   *Store
+		enabled bool
+	}
+
+	bucketArgument struct {
+		Bucket string `mapstructure:"bucket"`
+	}
+)
+
+var Module = fx.Module(
+	"kvstore",
+	fx.Provide(New, NewInspectionController),
+)
+
+// New opens the store of the configuration, expired values are removed every ExpiryInterval while the application runs and the
+// store is closed when it stops
+func New(p Parameters) (*Store, error) {
+	store, err := Open(p.Config.Path, Options{SyncWrites: p.Config.SyncWrites, Clock: p.Clock})
+	if err != nil {
+		return nil, err
+	}
+	interval := p.Config.ExpiryInterval
+	if interval <= 0 {
+		interval = defaultExpiryInterval
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				ticker := store.clock.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C():
+						if err := store.removeExpired(); err != nil {
+							p.Log.Warnw("Failed to remove the expired values of the kvstore", "error", err)
+						}
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(stop)
+			<-done
+			return store.Close()
+		},
+	})
+	return store, nil
+}
+
+// NewInspectionController serves the contents of the store when Configuration.Inspect is set, in dev environments
+func NewInspectionController(p InspectionParameters) server.ManagementController {
+	enabled := p.Config.Inspect
+	if enabled && !envutils.IsDev(p.Metadata.Environment, typesafeconfig.ActiveProfiles()) {
+		p.Log.Warnw("The kvstore inspection endpoint is only served in dev environments and has been disabled", "environment", p.Metadata.Environment)
+		enabled = false
+	}
+	return server.ManagementController{Controller: &inspectionController{store: p.Store, enabled: enabled}}
+}
+
+func (c *inspectionController) Handlers() []server.Handler {
+	if !c.enabled {
+		return nil
+	}
+	return []server.Handler{
+		server.NewHandler(c.buckets, server.HandlerConfig{
+			Path:   "kvstore",
+			Method: http.MethodGet,
+		}),
+		server.NewHandler(c.bucket, server.HandlerConfig{
+			Path:   "kvstore/:bucket",
+			Method: http.MethodGet,
+		}),
+	}
+}
+
+func (c *inspectionController) buckets(_ context.Context, _ server.Void) (*server.Response[[]string], serr.Error) {
+	return server.SimpleResponse(c.store.Buckets()), nil
+}
+
+func (c *inspectionController) bucket(ctx context.Context, _ server.Void) (*server.Response[map[string]json.RawMessage], serr.Error) {
+	arg, err := server.ExtractPathParamsFromRequestContext[bucketArgument](ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, rerr := c.store.entries(arg.Bucket)
+	if rerr != nil {
+		return nil, serr.NewSimpleError("Failed to read the bucket", rerr)
+	}
+	return server.SimpleResponse(entries), nil
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kvstore is a small embedded key-value store for agents, CLIs and small services that need local persistence without a
+// database. Values are persisted to a bbolt file, one bbolt bucket per bucket of the store, and are read and written through typed
+// buckets:
+//
+//	fx.New(
+//		kvstore.Module,
+//		fx.Invoke(func(store *kvstore.Store) error {
+//			checkpoints := kvstore.NewBucket[Checkpoint](store, "checkpoints")
+//			return checkpoints.Put("deployments", Checkpoint{Cursor: cursor}, kvstore.WithTTL(24*time.Hour))
+//		}),
+//	)
+//
+//	kvstore:
+//	  path: /var/lib/agent/state.kv
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultPath = "data.kv"
+	// lockTimeout how long Open waits for another process to release the file
+	lockTimeout = time.Second
+	// defaultExpiryInterval how often the module removes expired values, see Configuration.ExpiryInterval
+	defaultExpiryInterval = time.Hour
+)
+
+// ErrClosed the store was closed
+var ErrClosed = errors.New("kvstore: store is closed")
+
+type (
+	// Store the values of every bucket, persisted to a bbolt file. Values are read from the file as they are needed, so the
+	// memory used by the store doesn't grow with the values it holds beyond the pages the OS keeps mapped
+	Store struct {
+		db    *bolt.DB
+		clock clock.Clock
+	}
+
+	// stored a value along with when it expires, as it is persisted
+	stored struct {
+		Value     json.RawMessage `json:"value"`
+		ExpiresAt *time.Time      `json:"expiresAt,omitempty"`
+	}
+
+	// Options how a store is opened
+	Options struct {
+		// SyncWrites flushes every change to disk before returning, otherwise changes are handed to the OS and can be lost, or
+		// leave the file corrupted, if the host crashes
+		SyncWrites bool
+		Clock      clock.Clock
+	}
+)
+
+// Open opens the store persisted in the file at path, creating it when it doesn't exist. Values that expired are removed, New also
+// removes them every Configuration.ExpiryInterval
+func Open(path string, options Options) (*Store, error) {
+	if path == "" {
+		path = defaultPath
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: lockTimeout, NoSync: !options.SyncWrites})
+	if err != nil {
+		return nil, fmt.Errorf("kvstore: failed to open %s: %w", path, err)
+	}
+	s := &Store{db: db, clock: clock.OrDefault(options.Clock)}
+	if err := s.removeExpired(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("kvstore: failed to load %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Close closes the file of the store, the store can't be used afterwards
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Buckets the names of the buckets that have values, nil when the store can't be read
+func (s *Store) Buckets() []string {
+	var names []string
+	now := s.clock.Now()
+	_ = s.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			err := b.ForEach(func(_, v []byte) error {
+				if e, err := unmarshalStored(v); err == nil && !e.expired(now) {
+					names = append(names, string(name))
+					return errStop
+				}
+				return nil
+			})
+			if errors.Is(err, errStop) {
+				return nil
+			}
+			return err
+		})
+	})
+	return names
+}
+
+// errStop ends a ForEach early
+var errStop = errors.New("stop")
+
+func (s *Store) get(bucket string, key string) (json.RawMessage, bool, error) {
+	var value json.RawMessage
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		e, err := unmarshalStored(v)
+		if err != nil {
+			return fmt.Errorf("kvstore: failed to unmarshal %s/%s: %w", bucket, key, err)
+		}
+		if !e.expired(s.clock.Now()) {
+			value = e.Value
+		}
+		return nil
+	})
+	return value, value != nil, err
+}
+
+// entries the values of the bucket that haven't expired, by key
+func (s *Store) entries(bucket string) (map[string]json.RawMessage, error) {
+	values := map[string]json.RawMessage{}
+	now := s.clock.Now()
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			e, err := unmarshalStored(v)
+			if err != nil {
+				return fmt.Errorf("kvstore: failed to unmarshal %s/%s: %w", bucket, k, err)
+			}
+			if !e.expired(now) {
+				values[string(k)] = e.Value
+			}
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (s *Store) put(bucket string, key string, value json.RawMessage, ttl time.Duration) error {
+	e := stored{Value: value}
+	if ttl > 0 {
+		expiresAt := s.clock.Now().Add(ttl)
+		e.ExpiresAt = &expiresAt
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *Store) delete(bucket string, key string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// removeExpired deletes the values that expired from every bucket
+func (s *Store) removeExpired() error {
+	now := s.clock.Now()
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			// keys can't be deleted while the bucket is iterated
+			var expired [][]byte
+			if err := b.ForEach(func(k, v []byte) error {
+				if e, err := unmarshalStored(v); err == nil && e.expired(now) {
+					expired = append(expired, k)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	return closedError(s.db.View(fn))
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	return closedError(s.db.Update(fn))
+}
+
+func closedError(err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return ErrClosed
+	}
+	return err
+}
+
+func unmarshalStored(data []byte) (stored, error) {
+	var e stored
+	err := json.Unmarshal(data, &e)
+	return e, err
+}
+
+func (e stored) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
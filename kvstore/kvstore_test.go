@@ -0,0 +1,148 @@
+package kvstore
+
+import (
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type checkpoint struct {
+	Cursor string `json:"cursor"`
+}
+
+func TestBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.kv")
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	store, err := Open(path, Options{Clock: fake})
+	require.NoError(t, err)
+
+	checkpoints := NewBucket[checkpoint](store, "checkpoints")
+	require.NoError(t, checkpoints.Put("deployments", checkpoint{Cursor: "a"}))
+	require.NoError(t, checkpoints.Put("deployments", checkpoint{Cursor: "b"}))
+	require.NoError(t, checkpoints.Put("events", checkpoint{Cursor: "c"}, WithTTL(time.Hour)))
+	require.NoError(t, checkpoints.Put("removed", checkpoint{Cursor: "d"}))
+	require.NoError(t, checkpoints.Delete("removed"))
+	require.NoError(t, NewBucket[int](store, "counters").Put("retries", 3))
+
+	value, ok, err := checkpoints.Get("deployments")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, checkpoint{Cursor: "b"}, value)
+	assert.Equal(t, []string{"deployments", "events"}, checkpoints.Keys())
+	assert.Equal(t, []string{"checkpoints", "counters"}, store.Buckets())
+
+	fake.Advance(time.Hour)
+	_, ok, err = checkpoints.Get("events")
+	require.NoError(t, err)
+	assert.False(t, ok, "expired values aren't returned")
+	require.NoError(t, store.Close())
+	assert.ErrorIs(t, checkpoints.Put("deployments", checkpoint{}), ErrClosed)
+
+	reopened, err := Open(path, Options{Clock: fake})
+	require.NoError(t, err)
+	defer reopened.Close()
+	all, err := NewBucket[checkpoint](reopened, "checkpoints").All()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]checkpoint{"deployments": {Cursor: "b"}}, all)
+	retries, _, err := NewBucket[int](reopened, "counters").Get("retries")
+	require.NoError(t, err)
+	assert.Equal(t, 3, retries)
+}
+
+func TestRemoveExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.kv")
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	store, err := Open(path, Options{Clock: fake})
+	require.NoError(t, err)
+	counters := NewBucket[int](store, "counters")
+	require.NoError(t, counters.Put("retries", 3, WithTTL(time.Hour)))
+	require.NoError(t, counters.Put("failures", 1))
+	require.NoError(t, store.Close())
+
+	fake.Advance(time.Hour)
+	reopened, err := Open(path, Options{Clock: fake})
+	require.NoError(t, err)
+	defer reopened.Close()
+	var keys []string
+	require.NoError(t, reopened.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("counters")).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}))
+	assert.Equal(t, []string{"failures"}, keys, "expired values are removed from the file")
+}
+
+func TestExpiryInterval(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	lc := fxtest.NewLifecycle(t)
+	store, err := New(Parameters{
+		Lifecycle: lc,
+		Config:    Configuration{Path: filepath.Join(t.TempDir(), "state.kv"), ExpiryInterval: time.Minute},
+		Clock:     fake,
+		Log:       zap.NewNop().Sugar(),
+	})
+	require.NoError(t, err)
+	counters := NewBucket[int](store, "counters")
+	require.NoError(t, counters.Put("retries", 3, WithTTL(30*time.Second)))
+	require.NoError(t, counters.Put("failures", 1))
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		var keys []string
+		_ = store.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("counters")).ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		})
+		return len(keys) == 1 && keys[0] == "failures"
+	}, time.Second, 10*time.Millisecond, "expired values are removed while the store is open")
+}
+
+func TestEmptyBucket(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "state.kv"), Options{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	counters := NewBucket[int](store, "counters")
+	require.NoError(t, counters.Delete("retries"), "deleting from a bucket that doesn't exist is a no-op")
+	require.NoError(t, counters.Put("retries", 3))
+	require.NoError(t, counters.Delete("retries"))
+	assert.Empty(t, store.Buckets(), "buckets without values aren't listed")
+	assert.Empty(t, counters.Keys())
+}
+
+func TestNewInspectionController(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "state.kv"), Options{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	handlers := func(environment string) []server.Handler {
+		return NewInspectionController(InspectionParameters{
+			Store:    store,
+			Config:   Configuration{Inspect: true},
+			Metadata: metadata.ApplicationMetadata{Environment: environment},
+			Log:      zap.NewNop().Sugar(),
+		}).Controller.Handlers()
+	}
+	for _, environment := range []string{"", "staging", "qa", "prod"} {
+		assert.Empty(t, handlers(environment), "the store isn't inspected in %q environments", environment)
+	}
+	served := handlers("dev")
+	require.Len(t, served, 2)
+	for _, h := range served {
+		assert.False(t, h.Config().AuthOptOut, "inspection requires a principal")
+	}
+}
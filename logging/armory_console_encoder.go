@@ -19,6 +19,7 @@ package logging
 import (
 	"fmt"
 	"github.com/armory-io/go-commons/bufferpool"
+	"github.com/armory-io/go-commons/redact"
 	"github.com/fatih/color"
 	"github.com/samber/lo"
 	"go.uber.org/zap/buffer"
@@ -142,7 +143,7 @@ func (c *consoleEncoder) AddUintptr(key string, value uintptr) {
 }
 
 func (c *consoleEncoder) AddReflected(key string, value interface{}) error {
-	return c.m.AddReflected(key, value)
+	return c.m.AddReflected(key, redact.Value(value))
 }
 
 func (c *consoleEncoder) OpenNamespace(key string) {
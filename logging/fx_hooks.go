@@ -0,0 +1,68 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// fxStopHooks the OnStop hooks fx ran or is running, in the order they were started
+var fxStopHooks = &hookRecorder{}
+
+type (
+	// FxHook an fx lifecycle hook that ran, or is still running
+	FxHook struct {
+		// Function the name of the hook function
+		Function string
+		// Caller the function that appended the hook to the lifecycle
+		Caller  string
+		Runtime time.Duration
+		Err     error
+		// Running the hook hasn't returned, it is stuck when the lifecycle timed out
+		Running bool
+	}
+
+	hookRecorder struct {
+		mu    sync.Mutex
+		hooks []FxHook
+	}
+)
+
+// FxStopHooks the OnStop hooks that fx ran, or is running, so far
+func FxStopHooks() []FxHook {
+	fxStopHooks.mu.Lock()
+	defer fxStopHooks.mu.Unlock()
+	return append([]FxHook(nil), fxStopHooks.hooks...)
+}
+
+func (r *hookRecorder) executing(function string, caller string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, FxHook{Function: function, Caller: caller, Running: true})
+}
+
+func (r *hookRecorder) executed(function string, caller string, runtime time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.hooks) - 1; i >= 0; i-- {
+		if h := &r.hooks[i]; h.Running && h.Function == function && h.Caller == caller {
+			h.Running, h.Runtime, h.Err = false, runtime, err
+			return
+		}
+	}
+}
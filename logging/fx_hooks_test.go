@@ -0,0 +1,23 @@
+package logging
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/fx/fxevent"
+	"testing"
+	"time"
+)
+
+func TestModuleRecordingLoggerRecordsStopHooks(t *testing.T) {
+	before := len(FxStopHooks())
+	logger := moduleRecordingLogger{Logger: fxevent.NopLogger}
+
+	logger.LogEvent(&fxevent.OnStopExecuting{FunctionName: "server.stop", CallerName: "server.configure"})
+	logger.LogEvent(&fxevent.OnStopExecuting{FunctionName: "kvstore.close", CallerName: "kvstore.New"})
+	logger.LogEvent(&fxevent.OnStopExecuted{FunctionName: "server.stop", CallerName: "server.configure", Runtime: time.Second, Err: errors.New("boom")})
+
+	assert.Equal(t, []FxHook{
+		{Function: "server.stop", Caller: "server.configure", Runtime: time.Second, Err: errors.New("boom")},
+		{Function: "kvstore.close", Caller: "kvstore.New", Running: true},
+	}, FxStopHooks()[before:])
+}
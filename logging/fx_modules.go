@@ -0,0 +1,76 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"go.uber.org/fx/fxevent"
+	"sync"
+)
+
+// fxModules the names of the fx modules that supplied, provided, decorated or invoked something, in the order fx reported them
+var fxModules = &moduleRecorder{seen: map[string]bool{}}
+
+type (
+	moduleRecorder struct {
+		mu    sync.Mutex
+		seen  map[string]bool
+		names []string
+	}
+
+	// moduleRecordingLogger records the modules named in fx events, and the OnStop hooks run, before passing the events on
+	moduleRecordingLogger struct {
+		fxevent.Logger
+	}
+)
+
+// FxModules the names of the fx.Module's that have been wired into the application so far.
+// Modules built with fx.Options have no name and are not included
+func FxModules() []string {
+	fxModules.mu.Lock()
+	defer fxModules.mu.Unlock()
+	return append([]string(nil), fxModules.names...)
+}
+
+func (l moduleRecordingLogger) LogEvent(event fxevent.Event) {
+	switch e := event.(type) {
+	case *fxevent.Supplied:
+		fxModules.record(e.ModuleName)
+	case *fxevent.Provided:
+		fxModules.record(e.ModuleName)
+	case *fxevent.Decorated:
+		fxModules.record(e.ModuleName)
+	case *fxevent.Invoked:
+		fxModules.record(e.ModuleName)
+	case *fxevent.OnStopExecuting:
+		fxStopHooks.executing(e.FunctionName, e.CallerName)
+	case *fxevent.OnStopExecuted:
+		fxStopHooks.executed(e.FunctionName, e.CallerName, e.Runtime, e.Err)
+	}
+	l.Logger.LogEvent(event)
+}
+
+func (r *moduleRecorder) record(name string) {
+	if name == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.seen[name] {
+		r.seen[name] = true
+		r.names = append(r.names, name)
+	}
+}
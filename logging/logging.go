@@ -32,6 +32,8 @@ const (
 	environment     = "environment"
 	replicaSet      = "replicaset"
 	hostname        = "hostname"
+	region          = "region"
+	partition       = "partition"
 )
 
 func ArmoryLoggerProvider(appMd metadata.ApplicationMetadata) (*zap.Logger, error) {
@@ -64,7 +66,9 @@ func ArmoryLoggerProvider(appMd metadata.ApplicationMetadata) (*zap.Logger, erro
 func createJSONLogger(appMd metadata.ApplicationMetadata, loggerOptions []zap.Option) (*zap.Logger, error) {
 	baseLogFields := getProductionLoggerFields(appMd)
 	loggerOptions = append(loggerOptions, zap.Fields(baseLogFields...))
-	return zap.NewProductionConfig().Build(loggerOptions...)
+	config := zap.NewProductionConfig()
+	config.Encoding = redactingJSONEncoding
+	return config.Build(loggerOptions...)
 }
 
 func getProductionLoggerFields(appMd metadata.ApplicationMetadata) []zap.Field {
@@ -74,6 +78,8 @@ func getProductionLoggerFields(appMd metadata.ApplicationMetadata) []zap.Field {
 	baseLogFields = appendFieldIfPresent(replicaSet, appMd.Replicaset, baseLogFields)
 	baseLogFields = appendFieldIfPresent(hostname, appMd.Hostname, baseLogFields)
 	baseLogFields = appendFieldIfPresent(version, appMd.Version, baseLogFields)
+	baseLogFields = appendFieldIfPresent(region, appMd.Region, baseLogFields)
+	baseLogFields = appendFieldIfPresent(partition, appMd.Partition, baseLogFields)
 	return baseLogFields
 }
 
@@ -126,10 +132,11 @@ func appendFieldIfPresent(key string, value string, fields []zap.Field) []zap.Fi
 
 var Module = fx.Options(
 	fx.Provide(ArmoryLoggerProvider),
+	fx.Decorate(decorateWithSpanEvents),
 	fx.Provide(func(log *zap.Logger) *zap.SugaredLogger {
 		return log.Sugar()
 	}),
 	fx.WithLogger(func(logger *zap.Logger) fxevent.Logger {
-		return &fxevent.ZapLogger{Logger: logger}
+		return moduleRecordingLogger{Logger: &fxevent.ZapLogger{Logger: logger}}
 	}),
 )
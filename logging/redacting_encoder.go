@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"github.com/armory-io/go-commons/redact"
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactingJSONEncoding the zap encoding of the JSON logger, JSON with the sensitive fields of reflected values masked
+const redactingJSONEncoding = "armory-json"
+
+func init() {
+	if err := zap.RegisterEncoder(redactingJSONEncoding, func(config zapcore.EncoderConfig) (zapcore.Encoder, error) {
+		return redactingEncoder{zapcore.NewJSONEncoder(config)}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// redactingEncoder masks the sensitive fields of reflected values, see the redact package
+type redactingEncoder struct {
+	zapcore.Encoder
+}
+
+func (e redactingEncoder) AddReflected(key string, value any) error {
+	return e.Encoder.AddReflected(key, redact.Value(value))
+}
+
+func (e redactingEncoder) Clone() zapcore.Encoder {
+	return redactingEncoder{e.Encoder.Clone()}
+}
+
+func (e redactingEncoder) EncodeEntry(entry zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	redacted := fields
+	for i, field := range fields {
+		if field.Type != zapcore.ReflectType {
+			continue
+		}
+		if &redacted[0] == &fields[0] {
+			// the fields are shared with the other cores of the logger
+			redacted = append([]zapcore.Field(nil), fields...)
+		}
+		redacted[i].Interface = redact.Value(field.Interface)
+	}
+	return e.Encoder.EncodeEntry(entry, redacted)
+}
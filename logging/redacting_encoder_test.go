@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password" sensitive:"true"`
+}
+
+func TestRedactingEncoder(t *testing.T) {
+	var out bytes.Buffer
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	log := zap.New(zapcore.NewCore(redactingEncoder{zapcore.NewJSONEncoder(config)}, zapcore.AddSync(&out), zap.InfoLevel))
+
+	log.With(zap.Any("default", credentials{User: "admin", Password: "hunter1"})).
+		Info("Connecting", zap.Any("credentials", credentials{User: "admin", Password: "hunter2"}))
+
+	assert.JSONEq(t, `{
+		"level": "info",
+		"msg": "Connecting",
+		"default": {"user": "admin", "password": "[MASKED]"},
+		"credentials": {"user": "admin", "password": "[MASKED]"}
+	}`, out.String())
+}
+
+func TestConsoleEncoderRedacts(t *testing.T) {
+	enc := NewArmoryDevConsoleEncoder(true)
+	buf, err := enc.EncodeEntry(zapcore.Entry{Message: "Connecting"}, []zapcore.Field{zap.Any("credentials", credentials{User: "admin", Password: "hunter2"})})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.Contains(t, buf.String(), "[MASKED]")
+}
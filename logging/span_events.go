@@ -0,0 +1,199 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	spanFieldKey          = "otel.span"
+	spanEventName         = "log"
+	spanEventSeverityAttr = "log.severity"
+	spanEventMessageAttr  = "log.message"
+)
+
+var defaultSpanEventFields = []string{"errorID", "error", "status", "src", "method", "uri"}
+
+type (
+	// SpanEventsConfiguration configures mirroring of log entries as events on the active trace span,
+	// so that trace viewers can show log context inline with the span that produced it.
+	SpanEventsConfiguration struct {
+		// Enabled if set to true log entries at or above Level are added as span events
+		Enabled bool
+		// Level the minimum level that is mirrored to the span, defaults to warn
+		Level string
+		// AllowedFields the log fields that are copied to the span event as attributes, defaults to errorID, error, status, src, method and uri
+		AllowedFields []string
+	}
+
+	spanEventsParameters struct {
+		fx.In
+
+		Logger        *zap.Logger
+		Configuration SpanEventsConfiguration `optional:"true"`
+	}
+
+	spanEventsCore struct {
+		zapcore.Core
+		level         zapcore.Level
+		allowedFields []string
+		span          trace.Span
+		fields        []zapcore.Field
+	}
+)
+
+// SpanField returns a field that carries the active span from the given context, loggers that have this field
+// attached will mirror their entries to the span when span events are enabled. The field is never encoded.
+func SpanField(ctx context.Context) zap.Field {
+	return zap.Field{
+		Key:       spanFieldKey,
+		Type:      zapcore.SkipType,
+		Interface: trace.SpanFromContext(ctx),
+	}
+}
+
+// WithSpanEvents returns a zap.Option that wraps the logger core so that entries are mirrored as span events
+func WithSpanEvents(config SpanEventsConfiguration) zap.Option {
+	return zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return NewSpanEventsCore(core, config)
+	})
+}
+
+// NewSpanEventsCore wraps the given core, entries at or above the configured level that carry a SpanField are
+// added as events to that span, with the message, severity and allowed fields as attributes.
+func NewSpanEventsCore(core zapcore.Core, config SpanEventsConfiguration) zapcore.Core {
+	level, err := zapcore.ParseLevel(config.Level)
+	if err != nil || config.Level == "" {
+		level = zapcore.WarnLevel
+	}
+	allowedFields := config.AllowedFields
+	if len(allowedFields) == 0 {
+		allowedFields = defaultSpanEventFields
+	}
+	return &spanEventsCore{
+		Core:          core,
+		level:         level,
+		allowedFields: allowedFields,
+	}
+}
+
+func (s *spanEventsCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &spanEventsCore{
+		Core:          s.Core.With(fields),
+		level:         s.level,
+		allowedFields: s.allowedFields,
+		span:          s.span,
+		fields:        append(slices.Clone(s.fields), s.filterFields(fields)...),
+	}
+	if span := findSpan(fields); span != nil {
+		clone.span = span
+	}
+	return clone
+}
+
+func (s *spanEventsCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if s.Enabled(entry.Level) {
+		return checked.AddCore(entry, s)
+	}
+	return checked
+}
+
+func (s *spanEventsCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if entry.Level >= s.level {
+		span := s.span
+		if found := findSpan(fields); found != nil {
+			span = found
+		}
+		if span != nil && span.IsRecording() {
+			span.AddEvent(spanEventName, trace.WithTimestamp(entry.Time), trace.WithAttributes(s.attributes(entry, fields)...))
+		}
+	}
+	return s.Core.Write(entry, fields)
+}
+
+func (s *spanEventsCore) attributes(entry zapcore.Entry, fields []zapcore.Field) []attribute.KeyValue {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range s.fields {
+		field.AddTo(enc)
+	}
+	for _, field := range s.filterFields(fields) {
+		field.AddTo(enc)
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String(spanEventSeverityAttr, entry.Level.String()),
+		attribute.String(spanEventMessageAttr, entry.Message),
+	}
+	for key, value := range enc.Fields {
+		attrs = append(attrs, toAttribute(key, value))
+	}
+	return attrs
+}
+
+func (s *spanEventsCore) filterFields(fields []zapcore.Field) []zapcore.Field {
+	var allowed []zapcore.Field
+	for _, field := range fields {
+		if slices.Contains(s.allowedFields, field.Key) {
+			allowed = append(allowed, field)
+		}
+	}
+	return allowed
+}
+
+func findSpan(fields []zapcore.Field) trace.Span {
+	for _, field := range fields {
+		if field.Key != spanFieldKey || field.Type != zapcore.SkipType {
+			continue
+		}
+		if span, ok := field.Interface.(trace.Span); ok {
+			return span
+		}
+	}
+	return nil
+}
+
+func toAttribute(key string, value any) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+func decorateWithSpanEvents(params spanEventsParameters) *zap.Logger {
+	if !params.Configuration.Enabled {
+		return params.Logger
+	}
+	return params.Logger.WithOptions(WithSpanEvents(params.Configuration))
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestSpanEventsCore(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+
+	observed, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(NewSpanEventsCore(observed, SpanEventsConfiguration{
+		Enabled:       true,
+		AllowedFields: []string{"errorID", "error"},
+	})).Sugar()
+
+	requestLogger := logger.With(SpanField(ctx), "errorID", "some-error-id", "secret", "do-not-copy")
+	requestLogger.Info("not mirrored")
+	requestLogger.Warnw("mirrored", "error", errors.New("boom"))
+	span.End()
+
+	assert.Equal(t, 2, logs.Len(), "the wrapped core should still receive every entry")
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	events := spans[0].Events()
+	assert.Len(t, events, 1)
+
+	attrs := map[string]string{}
+	for _, attr := range events[0].Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	assert.Equal(t, "warn", attrs[spanEventSeverityAttr])
+	assert.Equal(t, "mirrored", attrs[spanEventMessageAttr])
+	assert.Equal(t, "some-error-id", attrs["errorID"])
+	assert.Equal(t, "boom", attrs["error"])
+	assert.NotContains(t, attrs, "secret")
+}
+
+func TestSpanEventsCoreWithoutSpan(t *testing.T) {
+	observed, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(NewSpanEventsCore(observed, SpanEventsConfiguration{Enabled: true, Level: "error"}))
+
+	logger.Error("no span attached")
+	assert.Equal(t, 1, logs.Len())
+}
@@ -15,6 +15,8 @@ type ApplicationMetadata struct {
 	DeploymentId string `json:"deploymentId,omitempty"`
 	Hostname     string `json:"hostname,omitempty"`
 	InstanceId   string `json:"instanceId"`
+	Region       string `json:"region,omitempty"`
+	Partition    string `json:"partition,omitempty"`
 
 	LoggingType  string `json:"-"`
 	LoggingLevel string `json:"-"`
@@ -33,6 +35,8 @@ func ApplicationMetadataProvider() ApplicationMetadata {
 		DeploymentId: envutils.GetDeploymentId(),
 		Hostname:     hostname,
 		InstanceId:   uuid.NewString(),
+		Region:       envutils.GetRegion(),
+		Partition:    envutils.GetPartition(),
 
 		LoggingType:  envutils.GetApplicationLoggingType(),
 		LoggingLevel: envutils.GetApplicationLoggingLevel(),
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metering
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader the header the Key of an event is sent with in Kafka messages
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+type (
+	HTTPConfiguration struct {
+		// Endpoint the URL batches of events are POSTed to as {"events": [...]}
+		Endpoint string
+		// Token sent as a bearer token when set
+		Token string
+		// Timeout of every export, defaults to 30s
+		Timeout time.Duration
+	}
+
+	// HTTPExporter POSTs batches of events to an endpoint. 4xx responses other than 408 and 429 reject the batch
+	HTTPExporter struct {
+		config HTTPConfiguration
+		client *http.Client
+	}
+
+	// KafkaMessage a message for a KafkaProducer
+	KafkaMessage struct {
+		Key     []byte
+		Value   []byte
+		Headers map[string]string
+	}
+
+	// KafkaProducer produces messages to a topic with the Kafka client of the service, it must only return once the brokers
+	// acknowledged the messages
+	KafkaProducer interface {
+		Produce(ctx context.Context, topic string, messages []KafkaMessage) error
+	}
+
+	// KafkaExporter produces an event per message, keyed by org so the usage of an org stays ordered within its partition
+	KafkaExporter struct {
+		producer KafkaProducer
+		topic    string
+	}
+
+	httpBatch struct {
+		Events []Event `json:"events"`
+	}
+)
+
+// NewHTTPExporter creates the exporter of the configuration
+func NewHTTPExporter(config HTTPConfiguration) *HTTPExporter {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultHTTPTimeout
+	}
+	return &HTTPExporter{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+func (e *HTTPExporter) Export(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(httpBatch{Events: events})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.config.Token)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s responded %d: %s", ErrRejected, e.config.Endpoint, res.StatusCode, message)
+	default:
+		return fmt.Errorf("%s responded %d: %s", e.config.Endpoint, res.StatusCode, message)
+	}
+}
+
+// NewKafkaExporter creates an exporter that produces events to the topic
+func NewKafkaExporter(producer KafkaProducer, topic string) *KafkaExporter {
+	return &KafkaExporter{producer: producer, topic: topic}
+}
+
+func (e *KafkaExporter) Export(ctx context.Context, events []Event) error {
+	messages := make([]KafkaMessage, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		messages = append(messages, KafkaMessage{
+			Key:     []byte(event.Org),
+			Value:   value,
+			Headers: map[string]string{IdempotencyKeyHeader: event.Key},
+		})
+	}
+	return e.producer.Produce(ctx, e.topic, messages)
+}
@@ -0,0 +1,458 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metering records the billable usage of orgs, such as deployments or agent minutes, and delivers it to the billing
+// pipeline in batches:
+//
+//	metering:
+//	  http:
+//	    endpoint: https://billing.cloud.armory.io/usage
+//	  spool: true
+//
+//	err := meter.Record(ctx, metering.Event{Key: "deployment-" + deployment.ID, Metric: "deployments", Quantity: 1})
+//
+// Events are buffered locally and exported by a background loop until the exporter accepts them, so delivery is at least once.
+// Events with the same Key are only recorded once within the DeduplicationWindow, the key is exported with the event so the
+// receiver can drop the duplicates of retried batches. With Spool the buffer and the keys seen are kept in the kvstore, so
+// events survive restarts
+package metering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/ids"
+	"github.com/armory-io/go-commons/kvstore"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/shutdown"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	eventsMetric   = "metering.events"
+	bufferedMetric = "metering.buffered"
+	exportMetric   = "metering.export"
+
+	outcomeRecorded  = "recorded"
+	outcomeDuplicate = "duplicate"
+	outcomeDropped   = "dropped"
+	outcomeExported  = "exported"
+	outcomeRejected  = "rejected"
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+
+	pendingBucket = "metering.pending"
+	seenBucket    = "metering.seen"
+
+	defaultFlushInterval       = 10 * time.Second
+	defaultBatchSize           = 500
+	defaultMaxBuffered         = 100_000
+	defaultDeduplicationWindow = 24 * time.Hour
+	defaultMaxBackoff          = 5 * time.Minute
+)
+
+var (
+	// ErrBufferFull the meter already buffers MaxBuffered events, the exporter isn't keeping up or is failing
+	ErrBufferFull = errors.New("metering buffer is full")
+	// ErrInvalidEvent the event is missing its org or metric, or has a negative quantity
+	ErrInvalidEvent = errors.New("invalid metering event")
+	// ErrRejected exporters wrap the errors of batches that will never be accepted, such as malformed batches, so they are dropped
+	// instead of retried
+	ErrRejected = errors.New("metering batch rejected")
+)
+
+type (
+	Configuration struct {
+		// HTTP exports events to an HTTP endpoint, used when no Exporter is provided
+		HTTP HTTPConfiguration
+		// FlushInterval how often buffered events are exported, defaults to 10s
+		FlushInterval time.Duration
+		// BatchSize the max events per export, a batch is exported right away once it is full. Defaults to 500
+		BatchSize int
+		// MaxBuffered the max events waiting to be exported, Record fails with ErrBufferFull beyond it. Defaults to 100000
+		MaxBuffered int
+		// DeduplicationWindow how long the keys of recorded events are remembered, defaults to 24h
+		DeduplicationWindow time.Duration
+		// MaxBackoff the max wait between failed exports, the wait doubles from FlushInterval. Defaults to 5m
+		MaxBackoff time.Duration
+		// Spool keeps the buffered events and the keys seen in the kvstore, so they survive restarts. Requires the kvstore module
+		Spool bool
+	}
+
+	// Event the usage of a metric by an org
+	Event struct {
+		// Key deduplicates the event, such as the id of what is billed. Generated when empty, the event is then never deduplicated
+		Key string `json:"key"`
+		// Org defaults to the org of the principal of the context
+		Org      string  `json:"org"`
+		Metric   string  `json:"metric"`
+		Quantity float64 `json:"quantity"`
+		// Timestamp when the usage happened, defaults to now
+		Timestamp  time.Time         `json:"timestamp"`
+		Dimensions map[string]string `json:"dimensions,omitempty"`
+	}
+
+	// Exporter delivers batches of events to the billing pipeline. Failed batches are retried, wrap errors with ErrRejected for
+	// batches that should be dropped instead
+	Exporter interface {
+		Export(ctx context.Context, events []Event) error
+	}
+
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    Configuration  `optional:"true"`
+		Exporter  Exporter       `optional:"true"`
+		Store     *kvstore.Store `optional:"true"`
+		Log       *zap.SugaredLogger
+		Metrics   metrics.MetricsSvc `optional:"true"`
+		Clock     clock.Clock        `optional:"true"`
+		Shutdown  *shutdown.Recorder `optional:"true"`
+	}
+
+	// Meter buffers usage events and exports them
+	Meter struct {
+		config   Configuration
+		exporter Exporter
+		log      *zap.SugaredLogger
+		metrics  metrics.MetricsSvc
+		clock    clock.Clock
+		pending  *kvstore.Bucket[Event]
+		seen     *kvstore.Bucket[bool]
+
+		mu       sync.Mutex
+		buffer   []Event
+		keys     map[string]time.Time
+		full     chan struct{}
+		flushMu  sync.Mutex
+		failures int
+		retryAt  time.Time
+	}
+)
+
+var Module = fx.Module("metering", fx.Provide(New))
+
+// New creates the meter of the configuration, the events buffered are exported from when the application starts until it stops
+func New(p Parameters) (*Meter, error) {
+	m, err := newMeter(p)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				m.run(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(stopCtx context.Context) error {
+			cancel()
+			<-done
+			buffered := m.Buffered()
+			if err := m.Flush(stopCtx); err != nil {
+				m.log.Warnw("Failed to export the buffered metering events before stopping", "error", err, "buffered", m.Buffered())
+			}
+			p.Shutdown.Record("metering.eventsFlushed", buffered-m.Buffered())
+			p.Shutdown.Record("metering.eventsRemaining", m.Buffered())
+			return nil
+		},
+	})
+	return m, nil
+}
+
+func newMeter(p Parameters) (*Meter, error) {
+	config := p.Config.withDefaults()
+	exporter := p.Exporter
+	if exporter == nil {
+		if config.HTTP.Endpoint == "" {
+			return nil, errors.New("metering requires an Exporter or metering.http.endpoint")
+		}
+		exporter = NewHTTPExporter(config.HTTP)
+	}
+
+	m := &Meter{
+		config:   config,
+		exporter: exporter,
+		log:      p.Log,
+		metrics:  p.Metrics,
+		clock:    clock.OrDefault(p.Clock),
+		keys:     map[string]time.Time{},
+		full:     make(chan struct{}, 1),
+	}
+	if config.Spool {
+		if p.Store == nil {
+			return nil, errors.New("metering.spool requires the kvstore module")
+		}
+		m.pending = kvstore.NewBucket[Event](p.Store, pendingBucket)
+		m.seen = kvstore.NewBucket[bool](p.Store, seenBucket)
+		if err := m.restore(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Record buffers the usage event for export. Events whose Key was already recorded within the DeduplicationWindow are ignored
+func (m *Meter) Record(ctx context.Context, event Event) error {
+	if event.Org == "" {
+		if principal, err := iam.ExtractPrincipalFromContext(ctx); err == nil {
+			event.Org = principal.OrgId
+		}
+	}
+	if event.Org == "" || event.Metric == "" || event.Quantity < 0 {
+		return fmt.Errorf("%w: org %q, metric %q, quantity %v", ErrInvalidEvent, event.Org, event.Metric, event.Quantity)
+	}
+	if event.Key == "" {
+		event.Key = ids.NewString("usage")
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = m.clock.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	duplicate, err := m.isDuplicate(event.Key)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		m.count(event.Metric, outcomeDuplicate, 1)
+		return nil
+	}
+	if len(m.buffer) >= m.config.MaxBuffered {
+		m.count(event.Metric, outcomeDropped, 1)
+		return ErrBufferFull
+	}
+
+	if m.pending != nil {
+		if err := m.pending.Put(event.Key, event); err != nil {
+			return err
+		}
+		if err := m.seen.Put(event.Key, true, kvstore.WithTTL(m.config.DeduplicationWindow)); err != nil {
+			return err
+		}
+	}
+	m.keys[event.Key] = m.clock.Now().Add(m.config.DeduplicationWindow)
+	m.buffer = append(m.buffer, event)
+	m.count(event.Metric, outcomeRecorded, 1)
+	m.gauge()
+
+	if len(m.buffer) >= m.config.BatchSize {
+		select {
+		case m.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush exports the buffered events in batches, until they are all exported or an export fails
+func (m *Meter) Flush(ctx context.Context) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	for {
+		m.mu.Lock()
+		batch := m.buffer[:min(len(m.buffer), m.config.BatchSize)]
+		m.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		start := m.clock.Now()
+		err := m.exporter.Export(ctx, batch)
+		m.timer(err, m.clock.Since(start))
+		if err != nil && !errors.Is(err, ErrRejected) {
+			m.mu.Lock()
+			m.failures++
+			m.retryAt = m.clock.Now().Add(m.backoff())
+			m.mu.Unlock()
+			return err
+		}
+
+		outcome := outcomeExported
+		if err != nil {
+			outcome = outcomeRejected
+			m.log.Errorw("Dropping the metering events the exporter rejected", "error", err, "events", len(batch))
+		}
+		if err := m.remove(batch, outcome); err != nil {
+			return err
+		}
+	}
+}
+
+// Buffered the number of events waiting to be exported
+func (m *Meter) Buffered() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buffer)
+}
+
+func (m *Meter) run(ctx context.Context) {
+	ticker := m.clock.NewTicker(m.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		case <-m.full:
+		}
+
+		m.mu.Lock()
+		waiting := m.clock.Now().Before(m.retryAt)
+		m.mu.Unlock()
+		if waiting {
+			continue
+		}
+		if err := m.Flush(ctx); err != nil && ctx.Err() == nil {
+			m.log.Warnw("Failed to export metering events, they will be retried", "error", err, "buffered", m.Buffered())
+		}
+		m.forgetExpiredKeys()
+	}
+}
+
+// remove takes the exported batch, which is always the head of the buffer, out of the buffer
+func (m *Meter) remove(batch []Event, outcome string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buffer = m.buffer[len(batch):]
+	m.failures = 0
+	m.retryAt = time.Time{}
+	for _, event := range batch {
+		m.count(event.Metric, outcome, 1)
+		if m.pending != nil {
+			if err := m.pending.Delete(event.Key); err != nil {
+				return err
+			}
+		}
+	}
+	m.gauge()
+	return nil
+}
+
+func (m *Meter) isDuplicate(key string) (bool, error) {
+	if expires, ok := m.keys[key]; ok && m.clock.Now().Before(expires) {
+		return true, nil
+	}
+	if m.seen == nil {
+		return false, nil
+	}
+	_, seen, err := m.seen.Get(key)
+	return seen, err
+}
+
+func (m *Meter) forgetExpiredKeys() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	for key, expires := range m.keys {
+		if !now.Before(expires) {
+			delete(m.keys, key)
+		}
+	}
+}
+
+// restore buffers the events a previous run spooled but didn't export, oldest first
+func (m *Meter) restore() error {
+	spooled, err := m.pending.All()
+	if err != nil {
+		return err
+	}
+	for _, event := range spooled {
+		m.buffer = append(m.buffer, event)
+	}
+	sort.SliceStable(m.buffer, func(i, j int) bool {
+		return m.buffer[i].Timestamp.Before(m.buffer[j].Timestamp)
+	})
+	if len(m.buffer) > 0 {
+		m.log.Infow("Restored spooled metering events", "events", len(m.buffer))
+	}
+	return nil
+}
+
+func (m *Meter) backoff() time.Duration {
+	backoff := m.config.FlushInterval
+	for i := 1; i < m.failures && backoff < m.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > m.config.MaxBackoff {
+		return m.config.MaxBackoff
+	}
+	return backoff
+}
+
+func (m *Meter) count(metric string, outcome string, n int64) {
+	if m.metrics == nil {
+		return
+	}
+	m.metrics.CounterWithTags(eventsMetric, map[string]string{"metric": metric, "outcome": outcome}).Inc(n)
+}
+
+func (m *Meter) gauge() {
+	if m.metrics == nil {
+		return
+	}
+	m.metrics.Gauge(bufferedMetric).Update(float64(len(m.buffer)))
+}
+
+func (m *Meter) timer(err error, elapsed time.Duration) {
+	if m.metrics == nil {
+		return
+	}
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+	m.metrics.TimerWithTags(exportMetric, map[string]string{"outcome": outcome}).Record(elapsed)
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.MaxBuffered <= 0 {
+		c.MaxBuffered = defaultMaxBuffered
+	}
+	if c.DeduplicationWindow <= 0 {
+		c.DeduplicationWindow = defaultDeduplicationWindow
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	return c
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,196 @@
+package metering
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/kvstore"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeExporter struct {
+	mu       sync.Mutex
+	batches  [][]Event
+	failWith error
+}
+
+func (e *fakeExporter) Export(_ context.Context, events []Event) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failWith != nil {
+		return e.failWith
+	}
+	e.batches = append(e.batches, append([]Event(nil), events...))
+	return nil
+}
+
+func newTestMeter(t *testing.T, config Configuration, exporter Exporter, store *kvstore.Store) (*Meter, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(eventsMetric, gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	ms.EXPECT().Gauge(bufferedMetric).AnyTimes().DoAndReturn(scope.Gauge)
+	ms.EXPECT().TimerWithTags(exportMetric, gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Timer {
+		return scope.Tagged(tags).Timer(name)
+	})
+	m, err := newMeter(Parameters{
+		Config:   config,
+		Exporter: exporter,
+		Store:    store,
+		Log:      zap.NewNop().Sugar(),
+		Metrics:  ms,
+		Clock:    clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)),
+	})
+	require.NoError(t, err)
+	return m, scope
+}
+
+func counts(scope tally.TestScope) map[string]int64 {
+	out := map[string]int64{}
+	for _, counter := range scope.Snapshot().Counters() {
+		out[counter.Tags()["outcome"]] += counter.Value()
+	}
+	return out
+}
+
+func TestRecordAndFlush(t *testing.T) {
+	exporter := &fakeExporter{}
+	m, scope := newTestMeter(t, Configuration{BatchSize: 2}, exporter, nil)
+	ctx := iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{OrgId: "org-1"})
+
+	require.NoError(t, m.Record(ctx, Event{Key: "deployment-1", Metric: "deployments", Quantity: 1}))
+	require.NoError(t, m.Record(ctx, Event{Key: "deployment-1", Metric: "deployments", Quantity: 1}), "duplicates are ignored")
+	require.NoError(t, m.Record(ctx, Event{Key: "deployment-2", Metric: "deployments", Quantity: 1}))
+	require.NoError(t, m.Record(context.Background(), Event{Org: "org-2", Metric: "agentMinutes", Quantity: 30}))
+	assert.ErrorIs(t, m.Record(context.Background(), Event{Metric: "deployments", Quantity: 1}), ErrInvalidEvent, "events need an org")
+	assert.ErrorIs(t, m.Record(ctx, Event{Metric: "deployments", Quantity: -1}), ErrInvalidEvent)
+	assert.Equal(t, 3, m.Buffered())
+
+	require.NoError(t, m.Flush(context.Background()))
+	assert.Equal(t, 0, m.Buffered())
+	require.Len(t, exporter.batches, 2, "events are exported in batches of BatchSize")
+	first := exporter.batches[0][0]
+	assert.Equal(t, "org-1", first.Org, "the org defaults to the org of the principal")
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), first.Timestamp)
+	assert.NotEmpty(t, exporter.batches[1][0].Key, "keys are generated")
+	assert.Equal(t, map[string]int64{outcomeRecorded: 3, outcomeDuplicate: 1, outcomeExported: 3}, counts(scope))
+
+	require.NoError(t, m.Record(ctx, Event{Key: "deployment-1", Metric: "deployments", Quantity: 1}))
+	assert.Equal(t, 0, m.Buffered(), "keys are remembered after the events are exported")
+}
+
+func TestFailedExportsAreRetried(t *testing.T) {
+	exporter := &fakeExporter{failWith: errors.New("unavailable")}
+	m, scope := newTestMeter(t, Configuration{MaxBuffered: 2}, exporter, nil)
+
+	require.NoError(t, m.Record(context.Background(), Event{Org: "org-1", Metric: "deployments", Quantity: 1}))
+	require.NoError(t, m.Record(context.Background(), Event{Org: "org-1", Metric: "deployments", Quantity: 1}))
+	assert.ErrorIs(t, m.Record(context.Background(), Event{Org: "org-1", Metric: "deployments", Quantity: 1}), ErrBufferFull)
+
+	assert.EqualError(t, m.Flush(context.Background()), "unavailable")
+	assert.Equal(t, 2, m.Buffered(), "events are kept until they are exported")
+	assert.Equal(t, 10*time.Second, m.backoff())
+	require.Error(t, m.Flush(context.Background()))
+	assert.Equal(t, 20*time.Second, m.backoff(), "the wait between failed exports doubles")
+
+	exporter.failWith = nil
+	require.NoError(t, m.Flush(context.Background()))
+	assert.Equal(t, 0, m.Buffered())
+	assert.Equal(t, 10*time.Second, m.backoff())
+	assert.Equal(t, map[string]int64{outcomeRecorded: 2, outcomeDropped: 1, outcomeExported: 2}, counts(scope))
+
+	exporter.failWith = fmt.Errorf("%w: malformed", ErrRejected)
+	require.NoError(t, m.Record(context.Background(), Event{Org: "org-1", Metric: "deployments", Quantity: 1}))
+	require.NoError(t, m.Flush(context.Background()), "rejected batches aren't retried")
+	assert.Equal(t, 0, m.Buffered())
+	assert.Equal(t, int64(1), counts(scope)[outcomeRejected])
+}
+
+func TestSpoolSurvivesRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.kv")
+	store, err := kvstore.Open(path, kvstore.Options{})
+	require.NoError(t, err)
+	exporter := &fakeExporter{failWith: errors.New("unavailable")}
+	m, _ := newTestMeter(t, Configuration{Spool: true}, exporter, store)
+	require.NoError(t, m.Record(context.Background(), Event{Key: "b", Org: "org-1", Metric: "deployments", Quantity: 1, Timestamp: time.Unix(2, 0)}))
+	require.NoError(t, m.Record(context.Background(), Event{Key: "a", Org: "org-1", Metric: "deployments", Quantity: 1, Timestamp: time.Unix(1, 0)}))
+	require.Error(t, m.Flush(context.Background()))
+	require.NoError(t, store.Close())
+
+	store, err = kvstore.Open(path, kvstore.Options{})
+	require.NoError(t, err)
+	defer store.Close()
+	exporter.failWith = nil
+	m, _ = newTestMeter(t, Configuration{Spool: true}, exporter, store)
+	assert.Equal(t, 2, m.Buffered())
+	require.NoError(t, m.Record(context.Background(), Event{Key: "a", Org: "org-1", Metric: "deployments", Quantity: 1}))
+	assert.Equal(t, 2, m.Buffered(), "keys seen before the restart are deduplicated")
+
+	require.NoError(t, m.Flush(context.Background()))
+	require.Len(t, exporter.batches, 1)
+	assert.Equal(t, "a", exporter.batches[0][0].Key, "spooled events are exported oldest first")
+	assert.Empty(t, kvstore.NewBucket[Event](store, pendingBucket).Keys())
+
+	_, err = newMeter(Parameters{Config: Configuration{Spool: true}, Exporter: exporter, Log: zap.NewNop().Sugar()})
+	assert.EqualError(t, err, "metering.spool requires the kvstore module")
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var status int
+	var received httpBatch
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	exporter := NewHTTPExporter(HTTPConfiguration{Endpoint: srv.URL, Token: "token"})
+	events := []Event{{Key: "a", Org: "org-1", Metric: "deployments", Quantity: 1}}
+
+	status = http.StatusAccepted
+	require.NoError(t, exporter.Export(context.Background(), events))
+	assert.Equal(t, "a", received.Events[0].Key)
+
+	status = http.StatusBadRequest
+	assert.ErrorIs(t, exporter.Export(context.Background(), events), ErrRejected)
+
+	status = http.StatusTooManyRequests
+	err := exporter.Export(context.Background(), events)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRejected, "throttled batches are retried")
+}
+
+type fakeProducer struct {
+	topic    string
+	messages []KafkaMessage
+}
+
+func (p *fakeProducer) Produce(_ context.Context, topic string, messages []KafkaMessage) error {
+	p.topic, p.messages = topic, messages
+	return nil
+}
+
+func TestKafkaExporter(t *testing.T) {
+	producer := &fakeProducer{}
+	require.NoError(t, NewKafkaExporter(producer, "usage").Export(context.Background(), []Event{{Key: "a", Org: "org-1", Metric: "deployments", Quantity: 1}}))
+
+	assert.Equal(t, "usage", producer.topic)
+	require.Len(t, producer.messages, 1)
+	assert.Equal(t, []byte("org-1"), producer.messages[0].Key)
+	assert.Equal(t, map[string]string{IdempotencyKeyHeader: "a"}, producer.messages[0].Headers)
+}
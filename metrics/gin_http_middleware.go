@@ -22,6 +22,9 @@ import (
 	"time"
 )
 
+// statusClientClosedRequest the status the server records for requests whose client disconnected before they were answered
+const statusClientClosedRequest = 499
+
 func GinHTTPMiddleware(metrics MetricsSvc) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -31,6 +34,8 @@ func GinHTTPMiddleware(metrics MetricsSvc) gin.HandlerFunc {
 		outcome := "UNKNOWN"
 		if statusCode >= 200 && statusCode < 300 {
 			outcome = "SUCCESS"
+		} else if statusCode == statusClientClosedRequest {
+			outcome = "CLIENT_CLOSED_REQUEST"
 		} else if statusCode >= 400 && statusCode < 500 {
 			outcome = "CLIENT_ERROR"
 		} else if statusCode >= 500 {
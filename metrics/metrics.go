@@ -73,6 +73,8 @@ func NewSvc(lc fx.Lifecycle, app metadata.ApplicationMetadata) MetricsSvc {
 			"environment":  app.Environment,
 			"replicaset":   app.Replicaset,
 			"deploymentId": app.DeploymentId,
+			"region":       app.Region,
+			"partition":    app.Partition,
 		},
 	}
 	scope, closer := tally.NewRootScope(scopeOpts, time.Second)
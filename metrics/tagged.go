@@ -0,0 +1,89 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import "github.com/uber-go/tally/v4"
+
+// taggedMetrics a MetricsSvc that adds its tags to every metric, the tags of a metric take precedence
+type taggedMetrics struct {
+	svc  MetricsSvc
+	tags map[string]string
+}
+
+// Tagged returns a MetricsSvc that adds the tags to every metric of svc
+func Tagged(svc MetricsSvc, tags map[string]string) MetricsSvc {
+	return &taggedMetrics{svc: svc, tags: tags}
+}
+
+func (t *taggedMetrics) with(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(t.tags)+len(tags))
+	for k, v := range t.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (t *taggedMetrics) GetRootScope() tally.Scope {
+	return t.svc.GetRootScope()
+}
+
+func (t *taggedMetrics) Counter(name string) tally.Counter {
+	return t.svc.CounterWithTags(name, t.tags)
+}
+
+func (t *taggedMetrics) CounterWithTags(name string, tags map[string]string) tally.Counter {
+	return t.svc.CounterWithTags(name, t.with(tags))
+}
+
+func (t *taggedMetrics) Gauge(name string) tally.Gauge {
+	return t.svc.GaugeWithTags(name, t.tags)
+}
+
+func (t *taggedMetrics) GaugeWithTags(name string, tags map[string]string) tally.Gauge {
+	return t.svc.GaugeWithTags(name, t.with(tags))
+}
+
+func (t *taggedMetrics) Timer(name string) tally.Timer {
+	return t.svc.TimerWithTags(name, t.tags)
+}
+
+func (t *taggedMetrics) TimerWithTags(name string, tags map[string]string) tally.Timer {
+	return t.svc.TimerWithTags(name, t.with(tags))
+}
+
+func (t *taggedMetrics) Histogram(name string, buckets tally.Buckets) tally.Histogram {
+	return t.svc.HistogramWithTags(name, buckets, t.tags)
+}
+
+func (t *taggedMetrics) HistogramWithTags(name string, buckets tally.Buckets, tags map[string]string) tally.Histogram {
+	return t.svc.HistogramWithTags(name, buckets, t.with(tags))
+}
+
+func (t *taggedMetrics) Tagged(tags map[string]string) tally.Scope {
+	return t.svc.Tagged(t.with(tags))
+}
+
+func (t *taggedMetrics) SubScope(name string) tally.Scope {
+	return t.svc.Tagged(t.tags).SubScope(name)
+}
+
+func (t *taggedMetrics) Capabilities() tally.Capabilities {
+	return t.svc.Capabilities()
+}
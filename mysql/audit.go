@@ -0,0 +1,315 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/diff"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/fx"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCreatedAtColumn = "created_at"
+	defaultUpdatedAtColumn = "updated_at"
+	defaultDeletedAtColumn = "deleted_at"
+	defaultCreatedByColumn = "created_by"
+	defaultUpdatedByColumn = "updated_by"
+	defaultDeletedByColumn = "deleted_by"
+)
+
+type (
+	// AuditConfiguration the names of the audit columns, models don't need to have all of them, missing columns are skipped
+	AuditConfiguration struct {
+		// CreatedAtColumn defaults to created_at
+		CreatedAtColumn string `yaml:"createdAtColumn"`
+		// UpdatedAtColumn defaults to updated_at
+		UpdatedAtColumn string `yaml:"updatedAtColumn"`
+		// DeletedAtColumn defaults to deleted_at, the column sqlboiler filters on when models are generated with --add-soft-deletes
+		DeletedAtColumn string `yaml:"deletedAtColumn"`
+		// CreatedByColumn defaults to created_by
+		CreatedByColumn string `yaml:"createdByColumn"`
+		// UpdatedByColumn defaults to updated_by
+		UpdatedByColumn string `yaml:"updatedByColumn"`
+		// DeletedByColumn defaults to deleted_by
+		DeletedByColumn string `yaml:"deletedByColumn"`
+	}
+
+	// Auditor stamps the audit columns of sqlboiler models with the time and the actor of the context.
+	// Register it on generated models with RegisterAuditHooks so every insert, update and upsert is stamped,
+	// and soft delete rows with Auditor.SoftDelete
+	Auditor struct {
+		config AuditConfiguration
+		clock  clock.Clock
+		fields sync.Map // reflect.Type -> *auditFields
+	}
+
+	AuditorParameters struct {
+		fx.In
+
+		Configuration AuditConfiguration `optional:"true"`
+		Clock         clock.Clock        `optional:"true"`
+	}
+
+	// Updatable is implemented by every sqlboiler model
+	Updatable interface {
+		Update(ctx context.Context, exec boil.ContextExecutor, columns boil.Columns) (int64, error)
+	}
+
+	// auditFields the struct field indexes of the audit columns of a model type, nil when the model doesn't have the column
+	auditFields struct {
+		createdAt, updatedAt, deletedAt []int
+		createdBy, updatedBy, deletedBy []int
+	}
+)
+
+var actorKey = ctxutil.NewKey[string]("mysql.actor")
+
+// NewAuditor creates an Auditor, using the clock.Clock if one is provided
+func NewAuditor(params AuditorParameters) *Auditor {
+	return &Auditor{
+		config: params.Configuration.withDefaults(),
+		clock:  clock.OrDefault(params.Clock),
+	}
+}
+
+// WithActor overrides the actor that is recorded on mutations, for background jobs and other code that runs without a principal
+func WithActor(ctx context.Context, actor string) context.Context {
+	return actorKey.WithValue(ctx, actor)
+}
+
+// Actor the actor that is recorded on mutations, the actor set with WithActor or else the name of the principal of the context.
+// Empty when there is neither
+func Actor(ctx context.Context) string {
+	if actor, ok := actorKey.Value(ctx); ok {
+		return actor
+	}
+	if principal, err := iam.ExtractPrincipalFromContext(ctx); err == nil {
+		return principal.Name
+	}
+	return ""
+}
+
+// RegisterAuditHooks registers the Auditor as a before insert, update and upsert hook of a generated model
+//
+//	mysql.RegisterAuditHooks(auditor, models.AddDeploymentHook)
+//
+// Hooks are not run by the bulk UpdateAll and DeleteAll methods or when boil.SkipHooks is used
+func RegisterAuditHooks[T any, H ~func(context.Context, boil.ContextExecutor, *T) error](a *Auditor, add func(boil.HookPoint, H)) {
+	add(boil.BeforeInsertHook, func(ctx context.Context, _ boil.ContextExecutor, o *T) error {
+		return a.BeforeInsert(ctx, o)
+	})
+	add(boil.BeforeUpdateHook, func(ctx context.Context, _ boil.ContextExecutor, o *T) error {
+		return a.BeforeUpdate(ctx, o)
+	})
+	add(boil.BeforeUpsertHook, func(ctx context.Context, _ boil.ContextExecutor, o *T) error {
+		return a.BeforeInsert(ctx, o)
+	})
+}
+
+// BeforeInsert sets the created and updated columns of model, a created at time that is already set is kept
+func (a *Auditor) BeforeInsert(ctx context.Context, model any) error {
+	v, fields, err := a.inspect(model)
+	if err != nil {
+		return err
+	}
+	now, actor := a.now(), Actor(ctx)
+	if f := fields.createdAt; f != nil && v.FieldByIndex(f).IsZero() {
+		if err := setTime(v.FieldByIndex(f), now); err != nil {
+			return err
+		}
+	}
+	if err := setActor(v, fields.createdBy, actor); err != nil {
+		return err
+	}
+	return a.stampUpdated(v, fields, now, actor)
+}
+
+// BeforeUpdate sets the updated columns of model
+func (a *Auditor) BeforeUpdate(ctx context.Context, model any) error {
+	v, fields, err := a.inspect(model)
+	if err != nil {
+		return err
+	}
+	return a.stampUpdated(v, fields, a.now(), Actor(ctx))
+}
+
+// SoftDelete sets the deleted and updated columns of model and saves only those columns.
+// It fails when the model has no deleted at column
+func (a *Auditor) SoftDelete(ctx context.Context, exec boil.ContextExecutor, model Updatable) error {
+	v, fields, err := a.inspect(model)
+	if err != nil {
+		return err
+	}
+	if fields.deletedAt == nil {
+		return fmt.Errorf("mysql: %s has no %s column and can't be soft deleted", v.Type().Name(), a.config.DeletedAtColumn)
+	}
+
+	now, actor := a.now(), Actor(ctx)
+	if err := setTime(v.FieldByIndex(fields.deletedAt), now); err != nil {
+		return err
+	}
+	columns := []string{a.config.DeletedAtColumn}
+	if fields.deletedBy != nil {
+		if err := setActor(v, fields.deletedBy, actor); err != nil {
+			return err
+		}
+		columns = append(columns, a.config.DeletedByColumn)
+	}
+	if fields.updatedAt != nil {
+		columns = append(columns, a.config.UpdatedAtColumn)
+	}
+	if fields.updatedBy != nil {
+		columns = append(columns, a.config.UpdatedByColumn)
+	}
+
+	// the update hook stamps the updated columns when it is registered, stamp them here too for models without hooks
+	if err := a.stampUpdated(v, fields, now, actor); err != nil {
+		return err
+	}
+	_, err = model.Update(ctx, exec, boil.Whitelist(columns...))
+	return err
+}
+
+// IsDeleted reports whether model has been soft deleted
+func (a *Auditor) IsDeleted(model any) bool {
+	v, fields, err := a.inspect(model)
+	if err != nil || fields.deletedAt == nil {
+		return false
+	}
+	return !v.FieldByIndex(fields.deletedAt).IsZero()
+}
+
+// NotDeleted returns a predicate that excludes soft deleted rows, usable with raw SQL or sqlboiler, i.e. qm.Where(auditor.NotDeleted()).
+// Models generated with --add-soft-deletes already exclude them unless qm.WithDeleted is used
+func (a *Auditor) NotDeleted() string {
+	return a.config.DeletedAtColumn + " IS NULL"
+}
+
+// Diff the changes between two versions of a model for audit events and change history, leaving out the audit columns
+// since they change on every update. Model fields are named after their columns, see diff.Compare
+func (a *Auditor) Diff(before, after any, options ...diff.Option) []diff.Change {
+	ignored := diff.Ignore(
+		a.config.CreatedAtColumn, a.config.UpdatedAtColumn, a.config.DeletedAtColumn,
+		a.config.CreatedByColumn, a.config.UpdatedByColumn, a.config.DeletedByColumn,
+	)
+	return diff.Compare(before, after, append([]diff.Option{ignored}, options...)...)
+}
+
+func (a *Auditor) now() time.Time {
+	// sqlboiler stores times in boil.GetLocation, match it so stamped and generated times agree
+	return a.clock.Now().In(boil.GetLocation())
+}
+
+func (a *Auditor) stampUpdated(v reflect.Value, fields *auditFields, now time.Time, actor string) error {
+	if fields.updatedAt != nil {
+		if err := setTime(v.FieldByIndex(fields.updatedAt), now); err != nil {
+			return err
+		}
+	}
+	return setActor(v, fields.updatedBy, actor)
+}
+
+// inspect returns the struct that model points to and the fields of its audit columns
+func (a *Auditor) inspect(model any) (reflect.Value, *auditFields, error) {
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, nil, fmt.Errorf("mysql: audited models must be non-nil struct pointers, got %T", model)
+	}
+	v = v.Elem()
+	if cached, ok := a.fields.Load(v.Type()); ok {
+		return v, cached.(*auditFields), nil
+	}
+
+	byColumn := map[string][]int{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if column, ok := field.Tag.Lookup("boil"); ok && field.IsExported() {
+			byColumn[column] = field.Index
+		}
+	}
+	fields := &auditFields{
+		createdAt: byColumn[a.config.CreatedAtColumn],
+		updatedAt: byColumn[a.config.UpdatedAtColumn],
+		deletedAt: byColumn[a.config.DeletedAtColumn],
+		createdBy: byColumn[a.config.CreatedByColumn],
+		updatedBy: byColumn[a.config.UpdatedByColumn],
+		deletedBy: byColumn[a.config.DeletedByColumn],
+	}
+	a.fields.Store(v.Type(), fields)
+	return v, fields, nil
+}
+
+// setTime sets a time.Time field or a nullable time field such as null.Time or sql.NullTime
+func setTime(field reflect.Value, t time.Time) error {
+	if field.Type() == reflect.TypeOf(t) {
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+	return scan(field, t)
+}
+
+// setActor sets a string field or a nullable string field such as null.String, nothing is recorded without an actor
+func setActor(v reflect.Value, index []int, actor string) error {
+	if index == nil || actor == "" {
+		return nil
+	}
+	field := v.FieldByIndex(index)
+	if field.Kind() == reflect.String {
+		field.SetString(actor)
+		return nil
+	}
+	return scan(field, actor)
+}
+
+func scan(field reflect.Value, value any) error {
+	scanner, ok := field.Addr().Interface().(sql.Scanner)
+	if !ok {
+		return fmt.Errorf("mysql: can't set audit column of type %s", field.Type())
+	}
+	return scanner.Scan(value)
+}
+
+func (c AuditConfiguration) withDefaults() AuditConfiguration {
+	if c.CreatedAtColumn == "" {
+		c.CreatedAtColumn = defaultCreatedAtColumn
+	}
+	if c.UpdatedAtColumn == "" {
+		c.UpdatedAtColumn = defaultUpdatedAtColumn
+	}
+	if c.DeletedAtColumn == "" {
+		c.DeletedAtColumn = defaultDeletedAtColumn
+	}
+	if c.CreatedByColumn == "" {
+		c.CreatedByColumn = defaultCreatedByColumn
+	}
+	if c.UpdatedByColumn == "" {
+		c.UpdatedByColumn = defaultUpdatedByColumn
+	}
+	if c.DeletedByColumn == "" {
+		c.DeletedByColumn = defaultDeletedByColumn
+	}
+	return c
+}
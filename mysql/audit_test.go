@@ -0,0 +1,138 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/diff"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+)
+
+type (
+	auditedModel struct {
+		ID        string         `boil:"id"`
+		CreatedAt time.Time      `boil:"created_at"`
+		UpdatedAt time.Time      `boil:"updated_at"`
+		DeletedAt sql.NullTime   `boil:"deleted_at"`
+		CreatedBy string         `boil:"created_by"`
+		UpdatedBy sql.NullString `boil:"updated_by"`
+		DeletedBy sql.NullString `boil:"deleted_by"`
+
+		updatedColumns boil.Columns
+	}
+
+	auditedModelHook func(context.Context, boil.ContextExecutor, *auditedModel) error
+
+	timestampsOnly struct {
+		CreatedAt time.Time `boil:"created_at"`
+	}
+)
+
+func (m *auditedModel) Update(_ context.Context, _ boil.ContextExecutor, columns boil.Columns) (int64, error) {
+	m.updatedColumns = columns
+	return 1, nil
+}
+
+var auditStart = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestAuditor() (*Auditor, *clock.Fake) {
+	fake := clock.NewFake(auditStart)
+	return NewAuditor(AuditorParameters{Clock: fake}), fake
+}
+
+func TestAuditorStampsMutations(t *testing.T) {
+	auditor, fake := newTestAuditor()
+	ctx := iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{Name: "user@example.com"})
+
+	hooks := map[boil.HookPoint]auditedModelHook{}
+	RegisterAuditHooks(auditor, func(point boil.HookPoint, hook auditedModelHook) {
+		hooks[point] = hook
+	})
+	assert.Len(t, hooks, 3)
+
+	m := &auditedModel{ID: "1"}
+	assert.NoError(t, hooks[boil.BeforeInsertHook](ctx, nil, m))
+	assert.Equal(t, auditStart, m.CreatedAt.UTC())
+	assert.Equal(t, auditStart, m.UpdatedAt.UTC())
+	assert.Equal(t, "user@example.com", m.CreatedBy)
+	assert.Equal(t, sql.NullString{String: "user@example.com", Valid: true}, m.UpdatedBy)
+	assert.False(t, m.DeletedAt.Valid)
+
+	fake.Advance(time.Hour)
+	jobCtx := WithActor(ctx, "cleanup-job")
+	assert.NoError(t, hooks[boil.BeforeUpdateHook](jobCtx, nil, m))
+	assert.Equal(t, auditStart, m.CreatedAt.UTC())
+	assert.Equal(t, auditStart.Add(time.Hour), m.UpdatedAt.UTC())
+	assert.Equal(t, "user@example.com", m.CreatedBy)
+	assert.Equal(t, "cleanup-job", m.UpdatedBy.String)
+
+	assert.NoError(t, hooks[boil.BeforeUpsertHook](ctx, nil, m), "upserts keep the created at time")
+	assert.Equal(t, auditStart, m.CreatedAt.UTC())
+}
+
+func TestAuditorSoftDelete(t *testing.T) {
+	auditor, fake := newTestAuditor()
+	fake.Advance(time.Minute)
+
+	m := &auditedModel{ID: "1"}
+	assert.False(t, auditor.IsDeleted(m))
+	assert.NoError(t, auditor.SoftDelete(WithActor(context.Background(), "admin"), nil, m))
+
+	assert.True(t, auditor.IsDeleted(m))
+	assert.Equal(t, auditStart.Add(time.Minute), m.DeletedAt.Time.UTC())
+	assert.Equal(t, "admin", m.DeletedBy.String)
+	assert.Equal(t, boil.Whitelist("deleted_at", "deleted_by", "updated_at", "updated_by"), m.updatedColumns)
+	assert.Equal(t, "deleted_at IS NULL", auditor.NotDeleted())
+
+	assert.Error(t, auditor.SoftDelete(context.Background(), nil, &timestampsWithUpdate{}))
+}
+
+func TestAuditorSkipsMissingColumns(t *testing.T) {
+	auditor, _ := newTestAuditor()
+
+	m := &timestampsOnly{}
+	assert.NoError(t, auditor.BeforeInsert(context.Background(), m))
+	assert.Equal(t, auditStart, m.CreatedAt.UTC())
+
+	assert.Error(t, auditor.BeforeInsert(context.Background(), timestampsOnly{}))
+}
+
+func TestAuditorColumnNames(t *testing.T) {
+	type renamed struct {
+		Removed sql.NullTime `boil:"removed_at"`
+	}
+	auditor := NewAuditor(AuditorParameters{Configuration: AuditConfiguration{DeletedAtColumn: "removed_at"}})
+
+	assert.Equal(t, "removed_at IS NULL", auditor.NotDeleted())
+	assert.False(t, auditor.IsDeleted(&renamed{}))
+	assert.True(t, auditor.IsDeleted(&renamed{Removed: sql.NullTime{Time: time.Now(), Valid: true}}))
+}
+
+type timestampsWithUpdate struct {
+	timestampsOnly
+}
+
+func (*timestampsWithUpdate) Update(context.Context, boil.ContextExecutor, boil.Columns) (int64, error) {
+	return 0, nil
+}
+
+func TestAuditorDiff(t *testing.T) {
+	type deployment struct {
+		ID        string    `boil:"id" json:"id"`
+		Replicas  int       `boil:"replicas" json:"replicas"`
+		UpdatedAt time.Time `boil:"updated_at" json:"updated_at"`
+		UpdatedBy string    `boil:"updated_by" json:"updated_by"`
+	}
+	auditor, _ := newTestAuditor()
+
+	changes := auditor.Diff(
+		&deployment{ID: "1", Replicas: 1, UpdatedAt: auditStart, UpdatedBy: "a"},
+		&deployment{ID: "1", Replicas: 2, UpdatedAt: auditStart.Add(time.Hour), UpdatedBy: "b"},
+	)
+	assert.Equal(t, []string{"replicas"}, diff.Paths(changes))
+}
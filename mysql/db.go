@@ -38,14 +38,18 @@ type Parameters struct {
 func New(
 	params Parameters,
 ) (*sql.DB, error) {
-	config := params.Configuration
-	tracing := params.Tracing
-	meterProvider := params.MeterProvider
-
-	conn, err := config.ConnectionUrl(false)
+	conn, err := params.Configuration.ConnectionUrl(false)
 	if err != nil {
 		return nil, err
 	}
+	return open(params, conn)
+}
+
+// open connects to the database of the DSN with the tracing, metrics and pool settings of the parameters
+func open(params Parameters, conn string) (*sql.DB, error) {
+	config := params.Configuration
+	tracing := params.Tracing
+	meterProvider := params.MeterProvider
 
 	var options []otelsql.Option
 	if tracing.Push.Enabled {
@@ -56,6 +56,8 @@ type (
 		MaxOpenConnections int       `yaml:"maxOpenConnections"`
 		MaxIdleConnections int       `yaml:"maxIdleConnections"`
 		MigrationPath      string    `yaml:"migrationPath"`
+		// TenantRouting routes the transaction scopes of orgs to their own schema or database, see TenantRoutingModule
+		TenantRouting TenantRoutingConfiguration `yaml:"tenantRouting"`
 	}
 
 	MDuration struct {
@@ -21,5 +21,6 @@ import "go.uber.org/fx"
 var Module = fx.Module(
 	"sql",
 	fx.Provide(New),
+	fx.Provide(NewAuditor),
 	fx.Invoke(NewMigrator),
 )
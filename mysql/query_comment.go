@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+// commentingExecutor appends a comment naming the scope and the trace to every query, so slow query logs and the
+// performance schema can be tied back to the operation and trace that issued the query
+type commentingExecutor struct {
+	boil.ContextExecutor
+	// ctx the context of the scope, for the queries executed without a context
+	ctx   context.Context
+	scope string
+}
+
+// WithName names the transaction scope, queries executed in it are tagged with a comment such as
+// /* scope:create-deployment trace:4bf92f3577b34da6a3ce929d0e0e4736 */. Child scopes inherit the name of their parent
+// unless they are named themselves. Names are restricted to letters, digits, dots, dashes and underscores, anything else is
+// replaced with a dash
+func WithName(name string) TransactionScopeOption {
+	return func(o *transactionScopeOptions) {
+		o.name = sanitizeScopeName(name)
+	}
+}
+
+// commentQueries wraps db so its queries are tagged with the scope name, db is returned as is when the scope has no name
+func commentQueries(ctx context.Context, scope string, db boil.ContextExecutor) boil.ContextExecutor {
+	if scope == "" {
+		return db
+	}
+	return &commentingExecutor{ContextExecutor: db, ctx: ctx, scope: scope}
+}
+
+func (e *commentingExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.ContextExecutor.Exec(e.comment(e.ctx, query), args...)
+}
+
+func (e *commentingExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.ContextExecutor.Query(e.comment(e.ctx, query), args...)
+}
+
+func (e *commentingExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return e.ContextExecutor.QueryRow(e.comment(e.ctx, query), args...)
+}
+
+func (e *commentingExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return e.ContextExecutor.ExecContext(ctx, e.comment(ctx, query), args...)
+}
+
+func (e *commentingExecutor) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return e.ContextExecutor.QueryContext(ctx, e.comment(ctx, query), args...)
+}
+
+func (e *commentingExecutor) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return e.ContextExecutor.QueryRowContext(ctx, e.comment(ctx, query), args...)
+}
+
+// comment appends the comment to the query, before a trailing semicolon would make it a statement of its own
+func (e *commentingExecutor) comment(ctx context.Context, query string) string {
+	var comment strings.Builder
+	comment.WriteString(" /* scope:")
+	comment.WriteString(e.scope)
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		comment.WriteString(" trace:")
+		comment.WriteString(span.TraceID().String())
+	}
+	comment.WriteString(" */")
+	return strings.TrimRight(strings.TrimSpace(query), ";") + comment.String()
+}
+
+// sanitizeScopeName keeps names from closing the comment or spanning lines
+func sanitizeScopeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '-'
+		}
+	}, strings.TrimSpace(name))
+}
@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"testing"
+)
+
+// recordingExecutor records the queries it is given
+type recordingExecutor struct {
+	boil.ContextExecutor
+	queries []string
+}
+
+func (r *recordingExecutor) Exec(query string, _ ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	return nil, nil
+}
+
+func (r *recordingExecutor) ExecContext(_ context.Context, query string, _ ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	return nil, nil
+}
+
+func TestCommentQueries(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	traced := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+
+	recorder := &recordingExecutor{}
+	db := commentQueries(context.Background(), "create-deployment", recorder)
+	_, _ = db.Exec("insert into deployments(id) values (?);")
+	_, _ = db.ExecContext(traced, "update deployments set status = ?")
+
+	assert.Equal(t, []string{
+		"insert into deployments(id) values (?) /* scope:create-deployment */",
+		"update deployments set status = ? /* scope:create-deployment trace:4bf92f3577b34da6a3ce929d0e0e4736 */",
+	}, recorder.queries)
+
+	assert.Same(t, recorder, commentQueries(context.Background(), "", recorder), "queries of unnamed scopes are left alone")
+	assert.Equal(t, "evil----drop-table", sanitizeScopeName("evil */\ndrop table"))
+}
+
+func TestScopeNames(t *testing.T) {
+	db, _ := newCountingDB(t)
+	builder := NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar()})
+
+	scopeOf := func(db boil.ContextExecutor) string {
+		if commenting, ok := db.(*commentingExecutor); ok {
+			return commenting.scope
+		}
+		return ""
+	}
+
+	var parent, inherited, named string
+	wrapper, err := builder(context.Background(), sql.LevelDefault, WithName("create-deployment"))
+	assert.NoError(t, err)
+	assert.NoError(t, wrapper(func(ctx context.Context, db boil.ContextExecutor) error {
+		parent = scopeOf(db)
+		child, err := builder(ctx, sql.LevelDefault)
+		assert.NoError(t, err)
+		assert.NoError(t, child(func(_ context.Context, db boil.ContextExecutor) error {
+			inherited = scopeOf(db)
+			return nil
+		}))
+		child, err = builder(ctx, sql.LevelDefault, WithName("audit"))
+		assert.NoError(t, err)
+		return child(func(_ context.Context, db boil.ContextExecutor) error {
+			named = scopeOf(db)
+			return nil
+		})
+	}))
+	assert.Equal(t, "create-deployment", parent)
+	assert.Equal(t, "create-deployment", inherited)
+	assert.Equal(t, "audit", named)
+
+	wrapper, err = builder(context.Background(), sql.LevelDefault)
+	assert.NoError(t, err)
+	assert.NoError(t, wrapper(func(_ context.Context, db boil.ContextExecutor) error {
+		_, isTx := db.(*sql.Tx)
+		assert.True(t, isTx, "unnamed scopes get the transaction itself")
+		return nil
+	}))
+}
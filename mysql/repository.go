@@ -0,0 +1,237 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/drivers"
+	"github.com/volatiletech/sqlboiler/v4/queries"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"sort"
+	"strings"
+)
+
+const defaultIDColumn = "id"
+
+type (
+	// Table describes the table of a sqlboiler model to the repository helpers FindByID, List and Table.Mods
+	Table struct {
+		// Name the name of the table
+		Name string
+		// IDColumn the primary key column, defaults to id
+		IDColumn string
+		// Fields maps the field names callers filter and sort on to their columns, other fields are rejected
+		Fields map[string]string
+		// DefaultSort the sort of lists that don't ask for one, ex: -createdAt
+		DefaultSort string
+	}
+
+	// ListParameters the filters, sort and page of a list. The mapstructure tags let handlers take them as nested query
+	// parameters, ex: ?filter[status]=ACTIVE,PAUSED&sort=-createdAt,name&limit=20
+	ListParameters struct {
+		// Filter the value each field must have, a comma separated value matches any of its values
+		Filter map[string]string `mapstructure:"filter"`
+		// Sort comma separated fields, each ascending unless prefixed with -
+		Sort string `mapstructure:"sort"`
+		// Limit the maximum number of rows, 0 for no limit
+		Limit int `mapstructure:"limit"`
+		// Offset the number of rows to skip
+		Offset int `mapstructure:"offset"`
+	}
+
+	// SortField a field of a sort, see ParseSort
+	SortField struct {
+		Field      string
+		Descending bool
+	}
+
+	// Upserter is implemented by every sqlboiler model generated for MySQL
+	Upserter interface {
+		Upsert(ctx context.Context, exec boil.ContextExecutor, updateColumns, insertColumns boil.Columns) error
+	}
+)
+
+var (
+	// ErrInvalidListParameters the filter, sort or page of a list is invalid, usually the fault of the caller
+	ErrInvalidListParameters = errors.New("invalid list parameters")
+
+	// mysqlDialect the dialect sqlboiler generates for MySQL models
+	mysqlDialect = drivers.Dialect{LQ: '`', RQ: '`', UseLastInsertID: true}
+)
+
+// FindByID loads the row of the table with the id into T, a sqlboiler model or any struct with boil tags.
+// Returns sql.ErrNoRows when there is no such row, like the Find functions of generated models
+func FindByID[T any](ctx context.Context, exec boil.ContextExecutor, table Table, id any, mods ...qm.QueryMod) (*T, error) {
+	q := table.query(append([]qm.QueryMod{qm.Where(quote(table.idColumn())+" = ?", id)}, mods...)...)
+
+	var result T
+	if err := q.Bind(ctx, exec, &result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, sql.ErrNoRows
+		}
+		return nil, fmt.Errorf("mysql: unable to find %s %v: %w", table.Name, id, err)
+	}
+	return &result, nil
+}
+
+// List loads the rows of the table that match the parameters into T, a sqlboiler model or any struct with boil tags.
+// Extra mods are applied after the parameters, i.e. the tenant predicate of tenancy.Where
+//
+//	deployments, err := mysql.List[models.Deployment](ctx, db, deploymentsTable, params, qm.Where(clause, args...))
+//
+// Errors caused by the parameters wrap ErrInvalidListParameters
+func List[T any](ctx context.Context, exec boil.ContextExecutor, table Table, params ListParameters, mods ...qm.QueryMod) ([]*T, error) {
+	listMods, err := table.Mods(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*T
+	if err := table.query(append(listMods, mods...)...).Bind(ctx, exec, &result); err != nil {
+		return nil, fmt.Errorf("mysql: unable to list %s: %w", table.Name, err)
+	}
+	return result, nil
+}
+
+// UpsertBatch upserts the models in a single transaction scope, which joins the transaction of the context if there is one,
+// so either every model is saved or none are. The columns are passed to the Upsert method of every model
+func UpsertBatch[T Upserter](ctx context.Context, builder TransactionScopeBuilder, models []T, updateColumns, insertColumns boil.Columns, options ...TransactionScopeOption) error {
+	if len(models) == 0 {
+		return nil
+	}
+	scope, err := builder(ctx, sql.LevelDefault, options...)
+	if err != nil {
+		return err
+	}
+	return scope(func(ctx context.Context, exec boil.ContextExecutor) error {
+		for i, model := range models {
+			if err := model.Upsert(ctx, exec, updateColumns, insertColumns); err != nil {
+				return fmt.Errorf("mysql: unable to upsert model %d of %d: %w", i+1, len(models), err)
+			}
+		}
+		return nil
+	})
+}
+
+// Mods turns the parameters into query mods, for use with the query functions of generated models:
+//
+//	mods, err := deploymentsTable.Mods(params)
+//	deployments, err := models.Deployments(mods...).All(ctx, db)
+func (t Table) Mods(params ListParameters) ([]qm.QueryMod, error) {
+	var mods []qm.QueryMod
+
+	fields := make([]string, 0, len(params.Filter))
+	for field := range params.Filter {
+		fields = append(fields, field)
+	}
+	// sorted so the same parameters always build the same query
+	sort.Strings(fields)
+	for _, field := range fields {
+		column, err := t.column(field)
+		if err != nil {
+			return nil, err
+		}
+		values := strings.Split(params.Filter[field], ",")
+		if len(values) == 1 {
+			mods = append(mods, qm.Where(quote(column)+" = ?", values[0]))
+			continue
+		}
+		args := make([]interface{}, len(values))
+		for i, value := range values {
+			args[i] = value
+		}
+		mods = append(mods, qm.WhereIn(quote(column)+" IN ?", args...))
+	}
+
+	order := params.Sort
+	if order == "" {
+		order = t.DefaultSort
+	}
+	sortFields, err := ParseSort(order)
+	if err != nil {
+		return nil, err
+	}
+	for _, sortField := range sortFields {
+		column, err := t.column(sortField.Field)
+		if err != nil {
+			return nil, err
+		}
+		if sortField.Descending {
+			mods = append(mods, qm.OrderBy(quote(column)+" DESC"))
+		} else {
+			mods = append(mods, qm.OrderBy(quote(column)+" ASC"))
+		}
+	}
+
+	if params.Limit < 0 || params.Offset < 0 {
+		return nil, fmt.Errorf("%w: limit and offset can't be negative", ErrInvalidListParameters)
+	}
+	if params.Limit > 0 {
+		mods = append(mods, qm.Limit(params.Limit))
+	}
+	if params.Offset > 0 {
+		mods = append(mods, qm.Offset(params.Offset))
+	}
+	return mods, nil
+}
+
+// ParseSort parses comma separated fields, each ascending unless prefixed with -, ex: -createdAt,name
+func ParseSort(order string) ([]SortField, error) {
+	if strings.TrimSpace(order) == "" {
+		return nil, nil
+	}
+	var fields []SortField
+	for _, part := range strings.Split(order, ",") {
+		part = strings.TrimSpace(part)
+		field := SortField{Field: strings.TrimPrefix(part, "-"), Descending: strings.HasPrefix(part, "-")}
+		if field.Field == "" {
+			return nil, fmt.Errorf("%w: malformed sort %q", ErrInvalidListParameters, order)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func (t Table) query(mods ...qm.QueryMod) *queries.Query {
+	q := &queries.Query{}
+	queries.SetDialect(q, &mysqlDialect)
+	qm.Apply(q, append([]qm.QueryMod{qm.From(quote(t.Name))}, mods...)...)
+	return q
+}
+
+func (t Table) idColumn() string {
+	if t.IDColumn == "" {
+		return defaultIDColumn
+	}
+	return t.IDColumn
+}
+
+func (t Table) column(field string) (string, error) {
+	column, ok := t.Fields[field]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown field %s", ErrInvalidListParameters, field)
+	}
+	return column, nil
+}
+
+func quote(identifier string) string {
+	return "`" + strings.ReplaceAll(identifier, "`", "``") + "`"
+}
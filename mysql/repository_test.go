@@ -0,0 +1,122 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"github.com/volatiletech/sqlboiler/v4/queries"
+	"github.com/volatiletech/sqlboiler/v4/queries/qm"
+	"go.uber.org/zap"
+	"testing"
+)
+
+var deploymentsTable = Table{
+	Name:        "deployments",
+	Fields:      map[string]string{"status": "status", "createdAt": "created_at", "name": "name"},
+	DefaultSort: "-createdAt",
+}
+
+func TestTableMods(t *testing.T) {
+	cases := []struct {
+		name         string
+		params       ListParameters
+		expectedSQL  string
+		expectedArgs []interface{}
+		expectedErr  string
+	}{
+		{
+			name:        "default sort",
+			expectedSQL: "SELECT * FROM `deployments` ORDER BY `created_at` DESC;",
+		},
+		{
+			name:         "filters, sort and page",
+			params:       ListParameters{Filter: map[string]string{"status": "ACTIVE,PAUSED", "name": "api"}, Sort: "name,-createdAt", Limit: 20, Offset: 40},
+			expectedSQL:  "SELECT * FROM `deployments` WHERE (`name` = ?) AND (`status` IN (?,?)) ORDER BY `name` ASC, `created_at` DESC LIMIT 20 OFFSET 40;",
+			expectedArgs: []interface{}{"api", "ACTIVE", "PAUSED"},
+		},
+		{
+			name:        "unknown filter field",
+			params:      ListParameters{Filter: map[string]string{"password": "hunter2"}},
+			expectedErr: "invalid list parameters: unknown field password",
+		},
+		{
+			name:        "unknown sort field",
+			params:      ListParameters{Sort: "id"},
+			expectedErr: "invalid list parameters: unknown field id",
+		},
+		{
+			name:        "malformed sort",
+			params:      ListParameters{Sort: "name,,-"},
+			expectedErr: `invalid list parameters: malformed sort "name,,-"`,
+		},
+		{
+			name:        "negative limit",
+			params:      ListParameters{Limit: -1},
+			expectedErr: "invalid list parameters: limit and offset can't be negative",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mods, err := deploymentsTable.Mods(c.params)
+			if c.expectedErr != "" {
+				assert.EqualError(t, err, c.expectedErr)
+				assert.True(t, errors.Is(err, ErrInvalidListParameters))
+				return
+			}
+			assert.NoError(t, err)
+			sql, args := queries.BuildQuery(deploymentsTable.query(mods...))
+			assert.Equal(t, c.expectedSQL, sql)
+			assert.Equal(t, c.expectedArgs, args)
+		})
+	}
+}
+
+func TestFindByIDQuery(t *testing.T) {
+	table := Table{Name: "deployments", IDColumn: "deployment_id"}
+	sql, args := queries.BuildQuery(table.query(qm.Where("`deployment_id` = ?", "d-1"), qm.Where("`org_id` = ?", "o-1")))
+	assert.Equal(t, "SELECT * FROM `deployments` WHERE (`deployment_id` = ?) AND (`org_id` = ?);", sql)
+	assert.Equal(t, []interface{}{"d-1", "o-1"}, args)
+	assert.Equal(t, "id", Table{}.idColumn())
+}
+
+func TestParseSort(t *testing.T) {
+	fields, err := ParseSort(" -createdAt, name ")
+	assert.NoError(t, err)
+	assert.Equal(t, []SortField{{Field: "createdAt", Descending: true}, {Field: "name"}}, fields)
+
+	fields, err = ParseSort("")
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+}
+
+type fakeModel struct {
+	upserted bool
+	err      error
+}
+
+func (f *fakeModel) Upsert(context.Context, boil.ContextExecutor, boil.Columns, boil.Columns) error {
+	f.upserted = f.err == nil
+	return f.err
+}
+
+func TestUpsertBatch(t *testing.T) {
+	db, d := newCountingDB(t)
+	builder := NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar()})
+
+	models := []*fakeModel{{}, {}}
+	assert.NoError(t, UpsertBatch(context.Background(), builder, models, boil.Infer(), boil.Infer()))
+	assert.True(t, models[0].upserted && models[1].upserted)
+	assert.Equal(t, int32(1), d.commits.Load())
+
+	failure := errors.New("duplicate")
+	models = []*fakeModel{{}, {err: failure}, {}}
+	err := UpsertBatch(context.Background(), builder, models, boil.Infer(), boil.Infer())
+	assert.ErrorIs(t, err, failure)
+	assert.EqualError(t, err, "mysql: unable to upsert model 2 of 3: duplicate")
+	assert.False(t, models[2].upserted)
+	assert.Equal(t, int32(1), d.commits.Load(), "a failed batch is rolled back")
+
+	assert.NoError(t, UpsertBatch[*fakeModel](context.Background(), builder, nil, boil.Infer(), boil.Infer()))
+	assert.Equal(t, int32(2), d.begins.Load(), "empty batches don't begin a transaction")
+}
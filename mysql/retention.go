@@ -0,0 +1,285 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RetentionGroupName the fx value group of the retention policies
+	RetentionGroupName = "retention-policies"
+
+	defaultRetentionInterval   = time.Hour
+	defaultRetentionBatchSize  = 1000
+	defaultRetentionBatchDelay = 100 * time.Millisecond
+
+	retentionDeletedMetric  = "mysql.retention.deleted"
+	retentionFailuresMetric = "mysql.retention.failures"
+)
+
+type (
+	// RetentionPolicy how long the rows of a table are kept
+	RetentionPolicy struct {
+		Table string `yaml:"table"`
+		// TimestampColumn the column rows expire by, defaults to created_at
+		TimestampColumn string `yaml:"timestampColumn"`
+		// Age rows whose timestamp is older than Age are deleted
+		Age time.Duration `yaml:"age"`
+		// BatchSize the rows deleted per transaction, defaults to 1000
+		BatchSize int `yaml:"batchSize"`
+		// Condition an optional SQL condition rows must also match to be deleted, i.e. status = 'COMPLETED'
+		Condition string `yaml:"condition"`
+	}
+
+	// RetentionConfiguration the retention job, policies are configured here or provided with ProvideRetentionPolicies
+	RetentionConfiguration struct {
+		Enabled bool `yaml:"enabled"`
+		// Interval how often expired rows are deleted, defaults to 1 hour
+		Interval time.Duration `yaml:"interval"`
+		// BatchDelay the wait between batches so deleting doesn't starve the database, defaults to 100ms
+		BatchDelay time.Duration `yaml:"batchDelay"`
+		// DryRun only counts and logs the expired rows
+		DryRun   bool              `yaml:"dryRun"`
+		Policies []RetentionPolicy `yaml:"policies"`
+	}
+
+	RetentionParameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    RetentionConfiguration `optional:"true"`
+		Policies  []RetentionPolicy      `group:"retention-policies"`
+		Builder   TransactionScopeBuilder
+		Log       *zap.SugaredLogger
+		// Metrics counts the rows deleted by table in mysql.retention.deleted, and the failed runs in mysql.retention.failures
+		Metrics metrics.MetricsSvc `optional:"true"`
+		Clock   clock.Clock        `optional:"true"`
+	}
+
+	// RetentionJob deletes the expired rows of the tables of the policies in batches, each batch in its own transaction scope.
+	// Running it on every replica is safe, replicas delete different batches or nothing
+	RetentionJob struct {
+		config   RetentionConfiguration
+		policies []RetentionPolicy
+		builder  TransactionScopeBuilder
+		log      *zap.SugaredLogger
+		metrics  metrics.MetricsSvc
+		clock    clock.Clock
+	}
+)
+
+// RetentionModule runs the retention job every Interval when it is enabled
+var RetentionModule = fx.Module(
+	"mysqlRetention",
+	fx.Provide(NewRetentionJob),
+	fx.Invoke(func(*RetentionJob) {}),
+)
+
+// ProvideRetentionPolicies adds policies to the fx group
+func ProvideRetentionPolicies(policies ...RetentionPolicy) fx.Option {
+	options := make([]fx.Option, 0, len(policies))
+	for _, policy := range policies {
+		policy := policy
+		options = append(options, fx.Provide(fx.Annotate(
+			func() RetentionPolicy { return policy },
+			fx.ResultTags(`group:"`+RetentionGroupName+`"`),
+		)))
+	}
+	return fx.Options(options...)
+}
+
+// NewRetentionJob creates the job of the configured and provided policies and runs it until the application stops, nil when disabled
+func NewRetentionJob(p RetentionParameters) (*RetentionJob, error) {
+	if !p.Config.Enabled {
+		return nil, nil
+	}
+	job, err := newRetentionJob(p.Config, append(append([]RetentionPolicy{}, p.Config.Policies...), p.Policies...), p.Builder, p.Log, p.Metrics, p.Clock)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				job.run(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-done
+			return nil
+		},
+	})
+	return job, nil
+}
+
+func newRetentionJob(config RetentionConfiguration, policies []RetentionPolicy, builder TransactionScopeBuilder, log *zap.SugaredLogger, ms metrics.MetricsSvc, c clock.Clock) (*RetentionJob, error) {
+	if config.Interval <= 0 {
+		config.Interval = defaultRetentionInterval
+	}
+	if config.BatchDelay <= 0 {
+		config.BatchDelay = defaultRetentionBatchDelay
+	}
+	tables := make(map[string]bool, len(policies))
+	for i, policy := range policies {
+		if policy.Table == "" || policy.Age <= 0 {
+			return nil, errors.New("retention policies must have a table and a positive age")
+		}
+		if tables[policy.Table] {
+			return nil, fmt.Errorf("duplicate retention policy for table %s", policy.Table)
+		}
+		tables[policy.Table] = true
+		if policy.TimestampColumn == "" {
+			policies[i].TimestampColumn = defaultCreatedAtColumn
+		}
+		if policy.BatchSize <= 0 {
+			policies[i].BatchSize = defaultRetentionBatchSize
+		}
+	}
+	return &RetentionJob{
+		config:   config,
+		policies: policies,
+		builder:  builder,
+		log:      log,
+		metrics:  ms,
+		clock:    clock.OrDefault(c),
+	}, nil
+}
+
+func (j *RetentionJob) run(ctx context.Context) {
+	ticker := j.clock.NewTicker(j.config.Interval)
+	defer ticker.Stop()
+	for {
+		j.Apply(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Apply deletes the expired rows of every policy, or counts them in dry-run mode. A policy that fails doesn't stop the others
+func (j *RetentionJob) Apply(ctx context.Context) {
+	for _, policy := range j.policies {
+		if ctx.Err() != nil {
+			return
+		}
+		log := j.log.With("table", policy.Table, "dryRun", j.config.DryRun)
+		cutoff := j.clock.Now().Add(-policy.Age)
+		var deleted int64
+		var err error
+		if j.config.DryRun {
+			deleted, err = j.count(ctx, policy, cutoff)
+		} else {
+			deleted, err = j.delete(ctx, policy, cutoff)
+		}
+		if deleted > 0 && j.metrics != nil {
+			j.metrics.CounterWithTags(retentionDeletedMetric, map[string]string{"table": policy.Table, "dryRun": strconv.FormatBool(j.config.DryRun)}).Inc(deleted)
+		}
+		if err != nil {
+			if j.metrics != nil {
+				j.metrics.CounterWithTags(retentionFailuresMetric, map[string]string{"table": policy.Table}).Inc(1)
+			}
+			log.Errorw("Failed to apply the retention policy", "deleted", deleted, "error", err)
+			continue
+		}
+		if j.config.DryRun {
+			log.Infow("Rows would be deleted by the retention policy", "expired", deleted, "cutoff", cutoff)
+		} else if deleted > 0 {
+			log.Infow("Deleted expired rows", "deleted", deleted, "cutoff", cutoff)
+		}
+	}
+}
+
+// delete deletes the expired rows in batches until a batch comes up short
+func (j *RetentionJob) delete(ctx context.Context, policy RetentionPolicy, cutoff time.Time) (int64, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s ORDER BY %s LIMIT %d", quoteTable(policy.Table), policy.where(), quote(policy.TimestampColumn), policy.BatchSize)
+	var total int64
+	for {
+		var affected int64
+		scope, err := j.builder(ctx, sql.LevelDefault, WithName("retention."+policy.Table), WithRetry(RetryPolicy{}))
+		if err != nil {
+			return total, err
+		}
+		if err := scope(func(ctx context.Context, db boil.ContextExecutor) error {
+			result, err := db.ExecContext(ctx, query, cutoff)
+			if err != nil {
+				return err
+			}
+			affected, err = result.RowsAffected()
+			return err
+		}); err != nil {
+			return total, err
+		}
+		total += affected
+		if affected < int64(policy.BatchSize) {
+			return total, nil
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-j.clock.After(j.config.BatchDelay):
+		}
+	}
+}
+
+func (j *RetentionJob) count(ctx context.Context, policy RetentionPolicy, cutoff time.Time) (int64, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", quoteTable(policy.Table), policy.where())
+	var count int64
+	scope, err := j.builder(ctx, sql.LevelDefault, WithName("retention."+policy.Table))
+	if err != nil {
+		return 0, err
+	}
+	err = scope(func(ctx context.Context, db boil.ContextExecutor) error {
+		return db.QueryRowContext(ctx, query, cutoff).Scan(&count)
+	})
+	return count, err
+}
+
+func (p RetentionPolicy) where() string {
+	where := quote(p.TimestampColumn) + " < ?"
+	if p.Condition != "" {
+		where += " AND (" + p.Condition + ")"
+	}
+	return where
+}
+
+// quoteTable quotes a table name that may be qualified by its schema
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = quote(part)
+	}
+	return strings.Join(parts, ".")
+}
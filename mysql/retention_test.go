@@ -0,0 +1,147 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expiringDriver a database/sql driver of a table with expired rows, deletes remove up to batchSize of them
+type (
+	expiringDriver struct {
+		mu        sync.Mutex
+		expired   int64
+		batchSize int64
+		queries   []string
+		args      []driver.NamedValue
+		commits   int
+	}
+	expiringConn  struct{ d *expiringDriver }
+	expiringCount struct{ count *int64 }
+)
+
+func (d *expiringDriver) Open(string) (driver.Conn, error) { return expiringConn{d}, nil }
+
+func (c expiringConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (c expiringConn) Close() error                        { return nil }
+func (c expiringConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c expiringConn) Commit() error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.commits++
+	return nil
+}
+func (c expiringConn) Rollback() error { return nil }
+
+func (c expiringConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.queries, c.d.args = append(c.d.queries, query), args
+	deleted := c.d.batchSize
+	if c.d.expired < deleted {
+		deleted = c.d.expired
+	}
+	c.d.expired -= deleted
+	return driver.RowsAffected(deleted), nil
+}
+
+func (c expiringConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.queries, c.d.args = append(c.d.queries, query), args
+	count := c.d.expired
+	return &expiringCount{count: &count}, nil
+}
+
+func (r *expiringCount) Columns() []string { return []string{"count"} }
+func (r *expiringCount) Close() error      { return nil }
+func (r *expiringCount) Next(dest []driver.Value) error {
+	if r.count == nil {
+		return io.EOF
+	}
+	dest[0], r.count = *r.count, nil
+	return nil
+}
+
+func TestRetentionJob(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dryRun=%t", dryRun), func(t *testing.T) {
+			d := &expiringDriver{expired: 5, batchSize: 2}
+			name := fmt.Sprintf("expiring-%d", driverCount.Add(1))
+			sql.Register(name, d)
+			db, err := sql.Open(name, "")
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = db.Close() })
+
+			scope := tally.NewTestScope("", nil)
+			ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+			ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+				return scope.Tagged(tags).Counter(name)
+			})
+			fake := clock.NewFake(now)
+			builder := NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar()})
+			job, err := newRetentionJob(RetentionConfiguration{Enabled: true, DryRun: dryRun}, []RetentionPolicy{
+				{Table: "audit.events", Age: 24 * time.Hour, BatchSize: 2, Condition: "archived = 1"},
+			}, builder, zap.NewNop().Sugar(), ms, fake)
+			require.NoError(t, err)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				job.Apply(context.Background())
+			}()
+			if !dryRun {
+				// full batches wait for the batch delay before the next one
+				for i := 0; i < 2; i++ {
+					fake.BlockUntil(1)
+					fake.Advance(defaultRetentionBatchDelay)
+				}
+			}
+			<-done
+
+			var deleted int64
+			for _, counter := range scope.Snapshot().Counters() {
+				if counter.Name() == retentionDeletedMetric {
+					assert.Equal(t, fmt.Sprint(dryRun), counter.Tags()["dryRun"])
+					assert.Equal(t, "audit.events", counter.Tags()["table"])
+					deleted += counter.Value()
+				}
+			}
+			assert.Equal(t, int64(5), deleted)
+			assert.Equal(t, now.Add(-24*time.Hour), d.args[0].Value)
+			if dryRun {
+				assert.Equal(t, []string{"SELECT COUNT(*) FROM `audit`.`events` WHERE `created_at` < ? AND (archived = 1) /* scope:retention.audit.events */"}, d.queries)
+				assert.Equal(t, int64(5), d.expired, "dry runs don't delete")
+				return
+			}
+			assert.Len(t, d.queries, 3)
+			assert.Equal(t, "DELETE FROM `audit`.`events` WHERE `created_at` < ? AND (archived = 1) ORDER BY `created_at` LIMIT 2 /* scope:retention.audit.events */", d.queries[0])
+			assert.Equal(t, 3, d.commits, "each batch is deleted in its own transaction")
+			assert.Equal(t, int64(0), d.expired)
+		})
+	}
+}
+
+func TestRetentionJobValidation(t *testing.T) {
+	for name, policies := range map[string][]RetentionPolicy{
+		"no table":  {{Age: time.Hour}},
+		"no age":    {{Table: "events"}},
+		"duplicate": {{Table: "events", Age: time.Hour}, {Table: "events", Age: 2 * time.Hour}},
+	} {
+		_, err := newRetentionJob(RetentionConfiguration{}, policies, nil, zap.NewNop().Sugar(), nil, nil)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/go-sql-driver/mysql"
+	"math/rand"
+	"time"
+)
+
+const (
+	errDeadlock        = 1213
+	errLockWaitTimeout = 1205
+
+	reasonDeadlock        = "deadlock"
+	reasonLockWaitTimeout = "lockWaitTimeout"
+
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+
+	retriesMetric          = "mysql.transaction.retries"
+	retriesExhaustedMetric = "mysql.transaction.retries.exhausted"
+)
+
+type (
+	// RetryPolicy how a transaction scope is retried after a deadlock or lock wait timeout, the zero value uses the defaults
+	RetryPolicy struct {
+		// MaxAttempts the attempts including the first one, defaults to 3
+		MaxAttempts int
+		// InitialBackoff the wait before the first retry, doubled for every retry after it. Defaults to 50ms
+		InitialBackoff time.Duration
+		// MaxBackoff caps the wait between attempts, defaults to 1s
+		MaxBackoff time.Duration
+	}
+
+	// retryRecorder waits between attempts and counts the retries
+	retryRecorder struct {
+		metrics metrics.MetricsSvc
+		clock   clock.Clock
+	}
+)
+
+// jitter a random duration in [0, n), a var so tests can make backoffs predictable
+var jitter = func(n time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(n)))
+}
+
+// WithRetry retries the whole scope, in a new transaction, when it fails with a deadlock (1213) or lock wait timeout (1205).
+// The handler of the scope is run again from the start, so it must not have side effects outside the transaction:
+//
+//	scope, err := txScopeBuilder(ctx, sql.LevelReadCommitted, mysql.WithRetry(mysql.RetryPolicy{}))
+//
+// Retries are counted by the mysql.transaction.retries metric, and scopes that still fail after the last attempt by
+// mysql.transaction.retries.exhausted. Retrying child scopes has no effect, they are retried along with their parent
+func WithRetry(policy RetryPolicy) TransactionScopeOption {
+	return func(o *transactionScopeOptions) {
+		o.retry = &policy
+	}
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+// backoff the wait after the attempt failed, half of it is random so that the transactions that deadlocked don't collide again
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + jitter(d/2+1)
+}
+
+// retryReason whether the error is worth retrying the transaction for
+func retryReason(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return "", false
+	}
+	switch mysqlErr.Number {
+	case errDeadlock:
+		return reasonDeadlock, true
+	case errLockWaitTimeout:
+		return reasonLockWaitTimeout, true
+	default:
+		return "", false
+	}
+}
+
+func newRetryRecorder(ms metrics.MetricsSvc, c clock.Clock) *retryRecorder {
+	return &retryRecorder{metrics: ms, clock: c}
+}
+
+// wait counts the retry and waits for the backoff, returning early with the error of ctx when it is done
+func (r *retryRecorder) wait(ctx context.Context, reason string, backoff time.Duration) error {
+	if r.metrics != nil {
+		r.metrics.CounterWithTags(retriesMetric, map[string]string{"reason": reason}).Inc(1)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.clock.After(backoff):
+		return nil
+	}
+}
+
+func (r *retryRecorder) exhausted(reason string) {
+	if r.metrics != nil {
+		r.metrics.CounterWithTags(retriesExhaustedMetric, map[string]string{"reason": reason}).Inc(1)
+	}
+}
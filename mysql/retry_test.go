@@ -0,0 +1,150 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/mock/gomock"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDriver a database/sql driver that only counts transactions
+type (
+	countingDriver struct {
+		begins, commits, rollbacks atomic.Int32
+	}
+	countingConn struct{ d *countingDriver }
+	countingTx   struct{ d *countingDriver }
+)
+
+func (d *countingDriver) Open(string) (driver.Conn, error) { return countingConn{d}, nil }
+
+func (c countingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c countingConn) Close() error                        { return nil }
+func (c countingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+func (c countingConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.d.begins.Add(1)
+	return countingTx{c.d}, nil
+}
+
+func (t countingTx) Commit() error   { t.d.commits.Add(1); return nil }
+func (t countingTx) Rollback() error { t.d.rollbacks.Add(1); return nil }
+
+var driverCount atomic.Int32
+
+func newCountingDB(t *testing.T) (*sql.DB, *countingDriver) {
+	d := &countingDriver{}
+	name := fmt.Sprintf("counting-%d", driverCount.Add(1))
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db, d
+}
+
+func TestTransactionScopeRetry(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: errDeadlock, Message: "Deadlock found when trying to get lock"}
+	policy := RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	cases := []struct {
+		name             string
+		failures         int
+		err              error
+		options          []TransactionScopeOption
+		expectedErr      error
+		expectedAttempts int
+		retries          int64
+		exhausted        int64
+	}{
+		{name: "retried until it succeeds", failures: 2, err: deadlock, options: []TransactionScopeOption{WithRetry(policy)}, expectedAttempts: 3, retries: 2},
+		{name: "lock wait timeouts are retried", failures: 1, err: fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: errLockWaitTimeout}), options: []TransactionScopeOption{WithRetry(policy)}, expectedAttempts: 2, retries: 1},
+		{name: "gives up after the last attempt", failures: 5, err: deadlock, options: []TransactionScopeOption{WithRetry(policy)}, expectedErr: deadlock, expectedAttempts: 3, retries: 2, exhausted: 1},
+		{name: "other errors aren't retried", failures: 1, err: &mysql.MySQLError{Number: 1062}, options: []TransactionScopeOption{WithRetry(policy)}, expectedErr: &mysql.MySQLError{Number: 1062}, expectedAttempts: 1},
+		{name: "scopes aren't retried by default", failures: 1, err: deadlock, expectedErr: deadlock, expectedAttempts: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, d := newCountingDB(t)
+			scope := tally.NewTestScope("", nil)
+			ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+			ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+				return scope.Tagged(tags).Counter(name)
+			})
+			builder := NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar(), Metrics: ms})
+
+			wrapper, err := builder(context.Background(), sql.LevelReadCommitted, c.options...)
+			assert.NoError(t, err)
+			attempts := 0
+			err = wrapper(func(ctx context.Context, _ boil.ContextExecutor) error {
+				attempts++
+				// child scopes run in the transaction of the attempt and leave retrying to the parent
+				child, err := builder(ctx, sql.LevelReadCommitted, WithRetry(policy))
+				assert.NoError(t, err)
+				return child(func(context.Context, boil.ContextExecutor) error {
+					if attempts <= c.failures {
+						return c.err
+					}
+					return nil
+				})
+			})
+
+			assert.Equal(t, c.expectedErr, err)
+			assert.Equal(t, c.expectedAttempts, attempts)
+			assert.Equal(t, int32(c.expectedAttempts), d.begins.Load())
+			assert.Equal(t, lo.Ternary[int32](c.expectedErr == nil, 1, 0), d.commits.Load())
+
+			counters := scope.Snapshot().Counters()
+			var retries, exhausted int64
+			for _, counter := range counters {
+				switch counter.Name() {
+				case retriesMetric:
+					retries += counter.Value()
+				case retriesExhaustedMetric:
+					exhausted += counter.Value()
+				}
+			}
+			assert.Equal(t, c.retries, retries)
+			assert.Equal(t, c.exhausted, exhausted)
+		})
+	}
+}
+
+func TestTransactionScopeRetryStopsWithContext(t *testing.T) {
+	db, d := newCountingDB(t)
+	builder := NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar()})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wrapper, err := builder(ctx, sql.LevelDefault, WithRetry(RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour}))
+	assert.NoError(t, err)
+	err = wrapper(func(context.Context, boil.ContextExecutor) error {
+		cancel()
+		return &mysql.MySQLError{Number: errDeadlock}
+	})
+	assert.Equal(t, &mysql.MySQLError{Number: errDeadlock}, err)
+	assert.Equal(t, int32(1), d.begins.Load())
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(j func(time.Duration) time.Duration) { jitter = j }(jitter)
+	jitter = func(n time.Duration) time.Duration { return n - 1 }
+
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(10))
+	assert.Equal(t, 3, (&RetryPolicy{}).maxAttempts())
+}
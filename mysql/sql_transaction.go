@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
 	"github.com/samber/lo"
 	"github.com/volatiletech/sqlboiler/v4/boil"
 	"go.uber.org/fx"
@@ -14,53 +16,103 @@ import (
 type (
 	InTransactionHandler    func(ctx context.Context, db boil.ContextExecutor) error
 	TransactionScopeWrapper func(executeInTx InTransactionHandler) error
-	TransactionScopeBuilder func(ctx context.Context, txIsolationLevel sql.IsolationLevel) (TransactionScopeWrapper, error)
+	TransactionScopeBuilder func(ctx context.Context, txIsolationLevel sql.IsolationLevel, options ...TransactionScopeOption) (TransactionScopeWrapper, error)
+
+	// TransactionScopeOption customizes a transaction scope, see WithRetry and WithName
+	TransactionScopeOption func(*transactionScopeOptions)
+
+	transactionScopeOptions struct {
+		retry *RetryPolicy
+		name  string
+		// tenant the org the scope was routed for, see TenantRouter
+		tenant string
+	}
+
+	// TransactionScopeParameters the dependencies of the transaction scope builder, metrics and the clock are optional
+	TransactionScopeParameters struct {
+		fx.In
+		DB      *sql.DB
+		Log     *zap.SugaredLogger
+		Metrics metrics.MetricsSvc `optional:"true"`
+		Clock   clock.Clock        `optional:"true"`
+	}
 
 	contextWithTx struct {
 		context.Context
 		tx       *sql.Tx
 		isClosed bool
+		// scope the name of the scope, see WithName
+		scope string
+		// tenant the org the transaction was routed for, see TenantRouter
+		tenant string
 	}
 )
 
 var (
 	ErrTxAlreadyClosed = errors.New("transaction is already closed")
-	TxModule           = fx.Module(
+	// ErrCrossTenantScope a scope of one org was opened within the transaction of another, or of a transaction that wasn't routed
+	ErrCrossTenantScope = errors.New("transaction scope can not be shared across tenants")
+	TxModule            = fx.Module(
 		"mysqlTx",
-		fx.Provide(InitializeModule),
+		fx.Provide(NewTransactionScopeBuilder),
 	)
 )
 
 func InitializeModule(db *sql.DB, log *zap.SugaredLogger) TransactionScopeBuilder {
+	return NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: log})
+}
+
+// NewTransactionScopeBuilder creates the builder of transaction scopes, see WithRetry to retry scopes that hit a deadlock
+func NewTransactionScopeBuilder(p TransactionScopeParameters) TransactionScopeBuilder {
+	db, log := p.DB, p.Log
+	retries := newRetryRecorder(p.Metrics, clock.OrDefault(p.Clock))
+
+	return func(ctx context.Context, isolationLevel sql.IsolationLevel, options ...TransactionScopeOption) (TransactionScopeWrapper, error) {
+		scopeOptions := &transactionScopeOptions{}
+		for _, option := range options {
+			option(scopeOptions)
+		}
 
-	return func(ctx context.Context, isolationLevel sql.IsolationLevel) (TransactionScopeWrapper, error) {
 		var targetCtx contextWithTx
+		txOptions := &sql.TxOptions{
+			Isolation: isolationLevel,
+			ReadOnly:  false,
+		}
+		begin := func() error {
+			tx, err := db.BeginTx(ctx, txOptions)
+			if err != nil {
+				log.Errorf("could not initialize db transaction: %v", err)
+				return err
+			}
+			targetCtx.tx = tx
+			targetCtx.isClosed = false
+			return nil
+		}
 
 		txCtx, isInParentScope := ctx.(contextWithTx)
 
 		if isInParentScope {
+			if scopeOptions.tenant != txCtx.tenant {
+				return nil, ErrCrossTenantScope
+			}
 			log.Debugf("creating child transaction scope")
 			targetCtx = txCtx
 		} else {
 			log.Debugf("creating parent transaction scope")
-			tx, err := db.BeginTx(ctx, &sql.TxOptions{
-				Isolation: isolationLevel,
-				ReadOnly:  false,
-			})
-
-			if err != nil {
-				log.Errorf("could not initialize db transaction: %v", err)
-				return nil, err
+			targetCtx = contextWithTx{Context: ctx, tenant: scopeOptions.tenant}
+			if scopeOptions.tenant != "" {
+				// contexts derived from the one of the transaction no longer are a contextWithTx, but still carry its tenant
+				targetCtx.Context = txTenantKey.WithValue(ctx, scopeOptions.tenant)
 			}
-
-			targetCtx = contextWithTx{
-				Context:  ctx,
-				tx:       tx,
-				isClosed: false,
+			if err := begin(); err != nil {
+				return nil, err
 			}
 
 			runtime.SetFinalizer(&targetCtx, buildTxFinalizer(log))
 		}
+		if scopeOptions.name != "" {
+			targetCtx.scope = scopeOptions.name
+		}
 
 		return func(executeInTx InTransactionHandler) error {
 			if targetCtx.isClosed {
@@ -68,16 +120,37 @@ func InitializeModule(db *sql.DB, log *zap.SugaredLogger) TransactionScopeBuilde
 				return ErrTxAlreadyClosed
 			}
 
-			err := executeInTx(targetCtx, targetCtx.tx)
-			if !isInParentScope {
+			if isInParentScope {
+				// child scopes are retried along with their parent scope
+				err := executeInTx(targetCtx, commentQueries(targetCtx, targetCtx.scope, targetCtx.tx))
+				log.Debugf("child tx scope completed - result %s", lo.Ternary(err == nil, "COMMIT", "ROLLBACK"))
+				return err
+			}
+
+			for attempt := 1; ; attempt++ {
+				err := executeInTx(targetCtx, commentQueries(targetCtx, targetCtx.scope, targetCtx.tx))
 				targetCtx.isClosed = true
 				log.Debugf("about to complete tx - result %s", lo.Ternary(err == nil, "COMMIT", "ROLLBACK"))
 
 				innerErr := lo.IfF(err == nil, targetCtx.tx.Commit).ElseF(targetCtx.tx.Rollback)
-				return lo.Ternary(innerErr != nil, innerErr, err)
+				err = lo.Ternary(innerErr != nil, innerErr, err)
+
+				reason, retryable := retryReason(err)
+				if !retryable || scopeOptions.retry == nil {
+					return err
+				}
+				if attempt >= scopeOptions.retry.maxAttempts() {
+					retries.exhausted(reason)
+					return err
+				}
+				log.Warnf("transaction failed with a %s, retrying the scope (attempt %d of %d): %v", reason, attempt+1, scopeOptions.retry.maxAttempts(), err)
+				if waitErr := retries.wait(ctx, reason, scopeOptions.retry.backoff(attempt)); waitErr != nil {
+					return err
+				}
+				if beginErr := begin(); beginErr != nil {
+					return beginErr
+				}
 			}
-			log.Debugf("child tx scope completed - result %s", lo.Ternary(err == nil, "COMMIT", "ROLLBACK"))
-			return err
 		}, nil
 	}
 }
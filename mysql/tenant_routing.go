@@ -0,0 +1,307 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/opentelemetry"
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxOpenTenants    = 50
+	defaultDirectoryCacheTTL = 5 * time.Minute
+)
+
+type (
+	// TenantRoutingConfiguration the schema or database of each org
+	TenantRoutingConfiguration struct {
+		// Tenants the database of each org id, either the name of a schema on the server of Connection, ex: tenant_acme, or the DSN
+		// of another server, ex: user:password@tcp(db-eu:3306)/acme. Orgs without one use the shared database unless a TenantDirectory
+		// provides theirs
+		Tenants map[string]string `yaml:"tenants"`
+		// RejectUnknownTenants fails the scopes of orgs without a database with ErrUnknownTenant, rather than using the shared database
+		RejectUnknownTenants bool `yaml:"rejectUnknownTenants"`
+		// MaxOpenTenants the tenant connection pools kept open at once, the least recently used one is closed beyond it. Defaults to 50
+		MaxOpenTenants int `yaml:"maxOpenTenants"`
+		// DirectoryCacheTTL how long the databases resolved by the TenantDirectory are cached, defaults to 5m
+		DirectoryCacheTTL MDuration `yaml:"directoryCacheTTL"`
+	}
+
+	// TenantDirectory looks up the databases of orgs that aren't configured, such as from a directory service
+	TenantDirectory interface {
+		// DatabaseOf the schema or DSN of the org, see TenantRoutingConfiguration.Tenants. Empty when the org uses the shared database
+		DatabaseOf(ctx context.Context, orgID string) (string, error)
+	}
+
+	// TenantRouterParameters the dependencies of the TenantRouter, the directory, metrics and the clock are optional
+	TenantRouterParameters struct {
+		fx.In
+
+		Lifecycle     fx.Lifecycle
+		Configuration Configuration
+		Tracing       opentelemetry.Configuration
+		MeterProvider *metric.MeterProvider `optional:"true"`
+		DB            *sql.DB
+		Log           *zap.SugaredLogger
+		Directory     TenantDirectory    `optional:"true"`
+		Metrics       metrics.MetricsSvc `optional:"true"`
+		Clock         clock.Clock        `optional:"true"`
+	}
+
+	// TenantRouter routes transaction scopes to the database of the org of their context, keeping a connection pool per database
+	TenantRouter struct {
+		config    TenantRoutingConfiguration
+		base      Configuration
+		directory TenantDirectory
+		clock     clock.Clock
+		log       *zap.SugaredLogger
+		shared    TransactionScopeBuilder
+		// open connects to a DSN, newBuilder creates the builder of the scopes of a connection pool
+		open       func(dsn string) (*sql.DB, error)
+		newBuilder func(db *sql.DB) TransactionScopeBuilder
+
+		mu    sync.Mutex
+		pools map[string]*list.Element
+		// lru the open pools, most recently used first
+		lru      *list.List
+		resolved map[string]resolvedTenant
+		closed   bool
+	}
+
+	tenantPool struct {
+		dsn     string
+		db      *sql.DB
+		builder TransactionScopeBuilder
+	}
+
+	// resolvedTenant a database resolved by the TenantDirectory
+	resolvedTenant struct {
+		database string
+		expires  time.Time
+	}
+)
+
+var (
+	// ErrUnknownTenant the org of the context has no database, see TenantRoutingConfiguration.RejectUnknownTenants
+	ErrUnknownTenant = errors.New("no database is configured for the tenant")
+
+	// TenantRoutingModule provides a TransactionScopeBuilder that routes scopes to the database of the org of their context, use
+	// it instead of TxModule
+	TenantRoutingModule = fx.Module(
+		"mysqlTenantRouting",
+		fx.Provide(NewTenantRouter),
+		fx.Provide(func(r *TenantRouter) TransactionScopeBuilder { return r.TransactionScopeBuilder }),
+	)
+
+	tenantOrgKey = ctxutil.NewKey[string]("mysql.tenantOrg")
+	// txTenantKey the org of the routed transaction a context was derived from
+	txTenantKey = ctxutil.NewKey[string]("mysql.txTenant")
+)
+
+// NewTenantRouter creates the TenantRouter of the configuration, its connection pools are closed when the application stops
+func NewTenantRouter(params TenantRouterParameters) (*TenantRouter, error) {
+	config := params.Configuration.TenantRouting
+	if config.MaxOpenTenants <= 0 {
+		config.MaxOpenTenants = defaultMaxOpenTenants
+	}
+	if config.DirectoryCacheTTL.Duration <= 0 {
+		config.DirectoryCacheTTL.Duration = defaultDirectoryCacheTTL
+	}
+	for org, database := range config.Tenants {
+		if _, err := params.Configuration.tenantDSN(database); err != nil {
+			return nil, fmt.Errorf("invalid database of tenant %s: %w", org, err)
+		}
+	}
+
+	newBuilder := func(db *sql.DB) TransactionScopeBuilder {
+		return NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: params.Log, Metrics: params.Metrics, Clock: params.Clock})
+	}
+	r := &TenantRouter{
+		config:    config,
+		base:      params.Configuration,
+		directory: params.Directory,
+		clock:     clock.OrDefault(params.Clock),
+		log:       params.Log,
+		shared:    newBuilder(params.DB),
+		open: func(dsn string) (*sql.DB, error) {
+			return open(Parameters{Configuration: params.Configuration, Tracing: params.Tracing, MeterProvider: params.MeterProvider}, dsn)
+		},
+		newBuilder: newBuilder,
+		pools:      map[string]*list.Element{},
+		lru:        list.New(),
+		resolved:   map[string]resolvedTenant{},
+	}
+	params.Lifecycle.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return r.Close()
+		},
+	})
+	return r, nil
+}
+
+// WithTenantOrg routes the scopes of the context to the database of the org, for background jobs and other code that runs
+// without a principal. Otherwise scopes are routed by the org of the principal of the context
+func WithTenantOrg(ctx context.Context, orgID string) context.Context {
+	return tenantOrgKey.WithValue(ctx, orgID)
+}
+
+// TenantOrg the org the scopes of the context are routed for, empty when there is none
+func TenantOrg(ctx context.Context) string {
+	if org, ok := tenantOrgKey.Value(ctx); ok {
+		return org
+	}
+	if principal, err := iam.ExtractPrincipalFromContext(ctx); err == nil {
+		return principal.OrgId
+	}
+	return ""
+}
+
+// TransactionScopeBuilder builds the scopes of the database of the org of the context, scopes without an org use the shared database.
+// Child scopes must be of the org of their parent, or fail with ErrCrossTenantScope, as they share its transaction
+func (r *TenantRouter) TransactionScopeBuilder(ctx context.Context, isolationLevel sql.IsolationLevel, options ...TransactionScopeOption) (TransactionScopeWrapper, error) {
+	org := TenantOrg(ctx)
+	if org == "" {
+		if _, ok := txTenantKey.Value(ctx); ok {
+			return nil, ErrCrossTenantScope
+		}
+		return r.shared(ctx, isolationLevel, options...)
+	}
+	if tenant, ok := txTenantKey.Value(ctx); ok && tenant != org {
+		return nil, ErrCrossTenantScope
+	}
+	builder, err := r.builderOf(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	return builder(ctx, isolationLevel, append(options, func(o *transactionScopeOptions) {
+		o.tenant = org
+	})...)
+}
+
+// Close closes the connection pools of the tenants, the shared database is closed by its owner
+func (r *TenantRouter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	var errs []error
+	for e := r.lru.Front(); e != nil; e = e.Next() {
+		errs = append(errs, e.Value.(*tenantPool).db.Close())
+	}
+	r.pools, r.lru = map[string]*list.Element{}, list.New()
+	return errors.Join(errs...)
+}
+
+func (r *TenantRouter) builderOf(ctx context.Context, org string) (TransactionScopeBuilder, error) {
+	database, err := r.databaseOf(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	if database == "" {
+		if r.config.RejectUnknownTenants {
+			return nil, ErrUnknownTenant
+		}
+		return r.shared, nil
+	}
+	dsn, err := r.base.tenantDSN(database)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errors.New("tenant router is closed")
+	}
+	if e, ok := r.pools[dsn]; ok {
+		r.lru.MoveToFront(e)
+		return e.Value.(*tenantPool).builder, nil
+	}
+	db, err := r.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool := &tenantPool{dsn: dsn, db: db, builder: r.newBuilder(db)}
+	r.pools[dsn] = r.lru.PushFront(pool)
+	for r.lru.Len() > r.config.MaxOpenTenants {
+		// transactions in flight finish on the connections they hold, the pool closes them once they are released
+		evicted := r.lru.Remove(r.lru.Back()).(*tenantPool)
+		delete(r.pools, evicted.dsn)
+		if err := evicted.db.Close(); err != nil {
+			r.log.Warnw("Failed to close the connection pool of a tenant database", "error", err)
+		}
+	}
+	return pool.builder, nil
+}
+
+// databaseOf the configured database of the org, or else the one the directory resolved
+func (r *TenantRouter) databaseOf(ctx context.Context, org string) (string, error) {
+	if database, ok := r.config.Tenants[org]; ok {
+		return database, nil
+	}
+	if r.directory == nil {
+		return "", nil
+	}
+
+	r.mu.Lock()
+	resolved, ok := r.resolved[org]
+	r.mu.Unlock()
+	if ok && r.clock.Now().Before(resolved.expires) {
+		return resolved.database, nil
+	}
+	database, err := r.directory.DatabaseOf(ctx, org)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the database of tenant %s: %w", org, err)
+	}
+	r.mu.Lock()
+	r.resolved[org] = resolvedTenant{database: database, expires: r.clock.Now().Add(r.config.DirectoryCacheTTL.Duration)}
+	r.mu.Unlock()
+	return database, nil
+}
+
+// tenantDSN the DSN of a tenant database, a schema name is a database on the server of Connection with the credentials of User
+func (d *Configuration) tenantDSN(database string) (string, error) {
+	if !strings.Contains(database, "/") {
+		cfg, err := mysql.ParseDSN(d.Connection)
+		if err != nil {
+			return "", err
+		}
+		cfg.User, cfg.Passwd, cfg.DBName = d.User, d.Password, database
+		cfg.ParseTime = true
+		return cfg.FormatDSN(), nil
+	}
+	cfg, err := mysql.ParseDSN(database)
+	if err != nil {
+		return "", err
+	}
+	cfg.ParseTime = true
+	return cfg.FormatDSN(), nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mysql
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+type fakeTenantDirectory struct {
+	databases map[string]string
+	lookups   int
+}
+
+func (d *fakeTenantDirectory) DatabaseOf(_ context.Context, orgID string) (string, error) {
+	d.lookups++
+	if orgID == "unreachable" {
+		return "", errors.New("directory unavailable")
+	}
+	return d.databases[orgID], nil
+}
+
+func newTestTenantRouter(t *testing.T, config TenantRoutingConfiguration, directory TenantDirectory, c clock.Clock) (*TenantRouter, map[string]*countingDriver, *countingDriver) {
+	log := zap.NewNop().Sugar()
+	shared, sharedDriver := newCountingDB(t)
+	drivers := map[string]*countingDriver{}
+	newBuilder := func(db *sql.DB) TransactionScopeBuilder {
+		return NewTransactionScopeBuilder(TransactionScopeParameters{DB: db, Log: log})
+	}
+	if config.MaxOpenTenants == 0 {
+		config.MaxOpenTenants = defaultMaxOpenTenants
+	}
+	config.DirectoryCacheTTL.Duration = time.Minute
+	r := &TenantRouter{
+		config:    config,
+		base:      Configuration{Connection: "tcp(db:3306)/shared", User: "app", Password: "secret"},
+		directory: directory,
+		clock:     c,
+		log:       log,
+		shared:    newBuilder(shared),
+		open: func(dsn string) (*sql.DB, error) {
+			db, d := newCountingDB(t)
+			drivers[dsn] = d
+			return db, nil
+		},
+		newBuilder: newBuilder,
+		pools:      map[string]*list.Element{},
+		lru:        list.New(),
+		resolved:   map[string]resolvedTenant{},
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r, drivers, sharedDriver
+}
+
+func inScope(t *testing.T, r *TenantRouter, ctx context.Context) error {
+	scope, err := r.TransactionScopeBuilder(ctx, sql.LevelDefault)
+	if err != nil {
+		return err
+	}
+	return scope(func(context.Context, boil.ContextExecutor) error { return nil })
+}
+
+func orgContext(org string) context.Context {
+	return iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{OrgId: org})
+}
+
+func TestTenantRouter(t *testing.T) {
+	directory := &fakeTenantDirectory{databases: map[string]string{"globex": "tenant_globex"}}
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	r, drivers, shared := newTestTenantRouter(t, TenantRoutingConfiguration{
+		Tenants: map[string]string{
+			"acme":    "tenant_acme",
+			"initech": "reporting:hunter2@tcp(db-eu:3306)/initech",
+		},
+	}, directory, fake)
+
+	require.NoError(t, inScope(t, r, orgContext("acme")))
+	require.NoError(t, inScope(t, r, orgContext("acme")))
+	require.NoError(t, inScope(t, r, WithTenantOrg(context.Background(), "initech")))
+	require.NoError(t, inScope(t, r, orgContext("globex")))
+	require.NoError(t, inScope(t, r, orgContext("globex")))
+	require.NoError(t, inScope(t, r, orgContext("hooli")))
+	require.NoError(t, inScope(t, r, context.Background()))
+
+	acme := drivers["app:secret@tcp(db:3306)/tenant_acme?parseTime=true"]
+	require.NotNil(t, acme, "schemas are databases on the server of the connection")
+	assert.Equal(t, int32(2), acme.commits.Load(), "tenant connection pools are reused")
+	require.NotNil(t, drivers["reporting:hunter2@tcp(db-eu:3306)/initech?parseTime=true"])
+	require.NotNil(t, drivers["app:secret@tcp(db:3306)/tenant_globex?parseTime=true"])
+	assert.Len(t, drivers, 3)
+	assert.Equal(t, int32(2), shared.commits.Load(), "orgs without a database and scopes without an org use the shared database")
+
+	assert.Equal(t, 2, directory.lookups, "the databases of the directory are cached")
+	fake.Advance(2 * time.Minute)
+	require.NoError(t, inScope(t, r, orgContext("globex")))
+	assert.Equal(t, 3, directory.lookups)
+	assert.ErrorContains(t, inScope(t, r, orgContext("unreachable")), "directory unavailable")
+
+	r.config.RejectUnknownTenants = true
+	assert.ErrorIs(t, inScope(t, r, orgContext("hooli")), ErrUnknownTenant)
+}
+
+func TestTenantRouterEvictsPools(t *testing.T) {
+	r, drivers, _ := newTestTenantRouter(t, TenantRoutingConfiguration{
+		Tenants:        map[string]string{"acme": "tenant_acme", "globex": "tenant_globex", "initech": "tenant_initech"},
+		MaxOpenTenants: 2,
+	}, nil, clock.NewFake(time.Now()))
+
+	for _, org := range []string{"acme", "globex", "acme", "initech"} {
+		require.NoError(t, inScope(t, r, orgContext(org)))
+	}
+	assert.Equal(t, 2, r.lru.Len())
+	_, ok := r.pools["app:secret@tcp(db:3306)/tenant_globex?parseTime=true"]
+	assert.False(t, ok, "the least recently used pool is closed")
+
+	require.NoError(t, inScope(t, r, orgContext("globex")))
+	assert.Len(t, drivers, 3, "drivers are keyed by dsn, reopening replaces the closed pool")
+}
+
+func TestTenantRouterCrossTenantScopes(t *testing.T) {
+	r, _, _ := newTestTenantRouter(t, TenantRoutingConfiguration{
+		Tenants: map[string]string{"acme": "tenant_acme", "globex": "tenant_acme"},
+	}, nil, clock.NewFake(time.Now()))
+
+	parent, err := r.TransactionScopeBuilder(orgContext("acme"), sql.LevelDefault)
+	require.NoError(t, err)
+	err = parent(func(ctx context.Context, _ boil.ContextExecutor) error {
+		child, err := r.TransactionScopeBuilder(ctx, sql.LevelDefault)
+		require.NoError(t, err, "child scopes of the same org share the transaction")
+		require.NoError(t, child(func(context.Context, boil.ContextExecutor) error { return nil }))
+
+		_, err = r.TransactionScopeBuilder(WithTenantOrg(ctx, "globex"), sql.LevelDefault)
+		assert.ErrorIs(t, err, ErrCrossTenantScope, "even when the orgs share a database")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTenantDSN(t *testing.T) {
+	config := Configuration{Connection: "tcp(db:3306)/shared", User: "app", Password: "secret"}
+	dsn, err := config.tenantDSN("tenant_acme")
+	require.NoError(t, err)
+	assert.Equal(t, "app:secret@tcp(db:3306)/tenant_acme?parseTime=true", dsn)
+
+	_, err = config.tenantDSN("not a dsn/")
+	assert.Error(t, err)
+}
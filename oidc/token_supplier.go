@@ -20,7 +20,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/armory-io/go-commons/clock"
 	clientcore "github.com/armory-io/go-commons/http/client/core"
+	"github.com/armory-io/go-commons/http/proxy"
 	"github.com/armory-io/go-commons/opentelemetry"
 	"go.uber.org/fx"
 	"math/rand"
@@ -56,6 +58,8 @@ type (
 
 		Config  AccessTokenSupplierConfig
 		Tracing opentelemetry.Configuration `optional:"true"`
+		Clock   clock.Clock                 `optional:"true"`
+		Proxy   *proxy.Router               `optional:"true"`
 	}
 
 	AccessTokenSupplier struct {
@@ -64,6 +68,7 @@ type (
 		accessToken *AccessToken
 		config      AccessTokenSupplierConfig
 		http        *http.Client
+		clock       clock.Clock
 	}
 )
 
@@ -71,7 +76,8 @@ func NewAccessTokenSupplier(params AccessTokenSupplierParameters) *AccessTokenSu
 	return &AccessTokenSupplier{
 		mu:     &sync.Mutex{},
 		config: params.Config,
-		http:   clientcore.NewHTTPClient(clientcore.Parameters{Tracing: params.Tracing}),
+		http:   clientcore.NewHTTPClient(clientcore.Parameters{Tracing: params.Tracing, Proxy: params.Proxy}),
+		clock:  clock.OrDefault(params.Clock),
 	}
 }
 
@@ -100,7 +106,7 @@ func (s *AccessTokenSupplier) getAccessToken(ctx context.Context) (*AccessToken,
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.accessToken == nil || time.Now().After(s.accessToken.expiresAt) {
+	if s.accessToken == nil || s.clock.Now().After(s.accessToken.expiresAt) {
 		token, err := s.fetchNewAccessToken(ctx)
 		if err != nil {
 			return nil, err
@@ -137,7 +143,7 @@ func (s *AccessTokenSupplier) fetchNewAccessToken(ctx context.Context) (*AccessT
 
 	expiresIn := time.Duration(rand.Int31n(accessTokenResponse.ExpiresIn)) * time.Second
 	leeway := time.Second * 120
-	expiresAt := time.Now().Add(expiresIn - leeway)
+	expiresAt := s.clock.Now().Add(expiresIn - leeway)
 
 	return &AccessToken{
 		AccessToken: accessTokenResponse.AccessToken,
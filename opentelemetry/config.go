@@ -25,6 +25,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
@@ -39,6 +40,9 @@ import (
 	"time"
 )
 
+// cloudPartitionKey the partition of the region, semconv has no attribute for it
+const cloudPartitionKey = attribute.Key("cloud.partition")
+
 type (
 	PushConfiguration struct {
 		Enabled  bool
@@ -172,16 +176,21 @@ func NewResource(
 	ctx context.Context,
 	app metadata.ApplicationMetadata,
 ) (*resource.Resource, error) {
-	return resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String(app.Name),
-			semconv.ServiceVersionKey.String(app.Version),
-			semconv.ServiceNamespaceKey.String("cdaas"),
-			semconv.ServiceInstanceIDKey.String(app.Hostname),
-			semconv.DeploymentEnvironmentKey.String(app.Environment),
-			semconv.TelemetrySDKLanguageGo,
-		),
-	)
+	attributes := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(app.Name),
+		semconv.ServiceVersionKey.String(app.Version),
+		semconv.ServiceNamespaceKey.String("cdaas"),
+		semconv.ServiceInstanceIDKey.String(app.Hostname),
+		semconv.DeploymentEnvironmentKey.String(app.Environment),
+		semconv.TelemetrySDKLanguageGo,
+	}
+	if app.Region != "" {
+		attributes = append(attributes, semconv.CloudRegionKey.String(app.Region))
+	}
+	if app.Partition != "" {
+		attributes = append(attributes, cloudPartitionKey.String(app.Partition))
+	}
+	return resource.New(ctx, resource.WithAttributes(attributes...))
 }
 
 var Module = fx.Options(
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package opentelemetry
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	instrumentationName = "github.com/armory-io/go-commons/opentelemetry"
+	traceIdField        = "trace.id"
+	spanIdField         = "span.id"
+)
+
+// traceContext W3C trace context, the same propagation InitTracing sets up for the http server and clients
+var traceContext = propagation.TraceContext{}
+
+// InjectTraceContext writes the trace context of ctx to the carrier, such as the attributes of a message or the columns of a scheduled job
+func InjectTraceContext(ctx context.Context, carrier propagation.TextMapCarrier) {
+	traceContext.Inject(ctx, carrier)
+}
+
+// TraceContextHeaders the trace context of ctx as traceparent and tracestate entries, empty when ctx has no span
+func TraceContextHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier
+}
+
+// ExtractTraceContext returns a context with the trace context of the carrier as its remote parent
+func ExtractTraceContext(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return traceContext.Extract(ctx, carrier)
+}
+
+// StartConsumerSpan starts the span of handling a message, as a child of the trace the carrier was injected from:
+//
+//	ctx, span := opentelemetry.StartConsumerSpan(ctx, "deployments.process", propagation.MapCarrier(message.Attributes))
+//	defer span.End()
+//	log := opentelemetry.WithTraceLogging(ctx, logger)
+func StartConsumerSpan(ctx context.Context, name string, carrier propagation.TextMapCarrier, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ExtractTraceContext(ctx, carrier), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes...),
+	)
+}
+
+// StartJobSpan starts the span of a scheduled job run. Runs start their own trace, linked to the trace the job was scheduled from
+// when the carrier has one, since a run can happen long after it was scheduled. The carrier may be nil
+func StartJobSpan(ctx context.Context, name string, carrier propagation.TextMapCarrier, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attributes...),
+	}
+	if carrier != nil {
+		if scheduled := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), carrier)); scheduled.IsValid() {
+			options = append(options, trace.WithLinks(trace.Link{SpanContext: scheduled}))
+		}
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name, options...)
+}
+
+// TraceLoggingMetadata the trace.id and span.id logging fields of the span of ctx, the fields the http server adds to request loggers.
+// Empty when ctx has no span
+func TraceLoggingMetadata(ctx context.Context) map[string]string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return map[string]string{}
+	}
+	return map[string]string{
+		traceIdField: spanContext.TraceID().String(),
+		spanIdField:  spanContext.SpanID().String(),
+	}
+}
+
+// WithTraceLogging returns the logger with the trace.id and span.id fields of the span of ctx
+func WithTraceLogging(ctx context.Context, logger *zap.SugaredLogger) *zap.SugaredLogger {
+	var fields []any
+	for k, v := range TraceLoggingMetadata(ctx) {
+		fields = append(fields, k, v)
+	}
+	return logger.With(fields...)
+}
@@ -0,0 +1,88 @@
+package opentelemetry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func withRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestConsumerSpanContinuesTrace(t *testing.T) {
+	recorder := withRecorder(t)
+
+	ctx, producer := otel.Tracer("test").Start(context.Background(), "publish")
+	headers := TraceContextHeaders(ctx)
+	producer.End()
+	require.Contains(t, headers, "traceparent")
+
+	ctx, span := StartConsumerSpan(context.Background(), "process", propagation.MapCarrier(headers), attribute.String("messaging.system", "sqs"))
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	consumer := spans[1]
+	assert.Equal(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+	assert.Equal(t, producer.SpanContext().SpanID(), consumer.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+	assert.Contains(t, consumer.Attributes(), attribute.String("messaging.system", "sqs"))
+	assert.Equal(t, map[string]string{
+		"trace.id": consumer.SpanContext().TraceID().String(),
+		"span.id":  consumer.SpanContext().SpanID().String(),
+	}, TraceLoggingMetadata(ctx))
+}
+
+func TestJobSpanLinksScheduler(t *testing.T) {
+	recorder := withRecorder(t)
+
+	ctx, scheduler := otel.Tracer("test").Start(context.Background(), "schedule")
+	carrier := propagation.MapCarrier{}
+	InjectTraceContext(ctx, carrier)
+	scheduler.End()
+
+	_, run := StartJobSpan(ctx, "cleanup", carrier)
+	run.End()
+	_, unscheduled := StartJobSpan(context.Background(), "cleanup", nil)
+	unscheduled.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.NotEqual(t, scheduler.SpanContext().TraceID(), spans[1].SpanContext().TraceID(), "runs start their own trace")
+	require.Len(t, spans[1].Links(), 1)
+	assert.Equal(t, scheduler.SpanContext().SpanID(), spans[1].Links()[0].SpanContext.SpanID())
+	assert.Empty(t, spans[2].Links())
+}
+
+func TestWithTraceLogging(t *testing.T) {
+	withRecorder(t)
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(core).Sugar()
+
+	WithTraceLogging(context.Background(), logger).Info("no span")
+	ctx, span := otel.Tracer("test").Start(context.Background(), "job")
+	defer span.End()
+	WithTraceLogging(ctx, logger).Info("in span")
+
+	entries := logs.All()
+	assert.Empty(t, entries[0].ContextMap())
+	assert.Equal(t, map[string]any{
+		"trace.id": span.SpanContext().TraceID().String(),
+		"span.id":  span.SpanContext().SpanID().String(),
+	}, entries[1].ContextMap())
+}
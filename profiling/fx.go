@@ -0,0 +1,140 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package profiling
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/server/serr"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+type (
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    Configuration `optional:"true"`
+		Metadata  metadata.ApplicationMetadata
+		// Sink ships the profiles when provided, instead of the blob.Store or the IngestURL
+		Sink   Sink         `optional:"true"`
+		Store  blob.Store   `optional:"true"`
+		Client *http.Client `optional:"true"`
+		Log    *zap.SugaredLogger
+		// Metrics counts the profiles captured by type and outcome in the profiling.capture metric
+		Metrics metrics.MetricsSvc `optional:"true"`
+		Clock   clock.Clock        `optional:"true"`
+	}
+
+	// CaptureResponse the profiles being captured
+	CaptureResponse struct {
+		Profiles []string `json:"profiles"`
+	}
+
+	captureController struct {
+		profiler *Profiler
+		log      *zap.SugaredLogger
+		// capture captures in the background, so the response doesn't wait for the CPU profile
+		capture func()
+	}
+)
+
+var Module = fx.Module(
+	"profiling",
+	fx.Provide(New, NewCaptureController),
+)
+
+// New creates the Profiler of the configuration and captures profiles every Interval until the application stops, nil when disabled
+func New(p Parameters) (*Profiler, error) {
+	if !p.Config.Enabled {
+		return nil, nil
+	}
+	sink := p.Sink
+	switch {
+	case sink != nil:
+	case p.Config.IngestURL != "":
+		sink = &IngestSink{URL: p.Config.IngestURL, Client: p.Client}
+	case p.Store != nil:
+		sink = &BlobSink{Store: p.Store, Prefix: p.Config.withDefaults().Prefix}
+	default:
+		return nil, errors.New("profiling requires an ingestUrl, a blob.Store or a Sink")
+	}
+	profiler, err := NewProfiler(p.Config, sink, p.Metadata, p.Log, p.Metrics, p.Clock)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				profiler.Run(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-done
+			return nil
+		},
+	})
+	return profiler, nil
+}
+
+// NewCaptureController captures profiles on demand with a POST to the profiling endpoint of the management server
+func NewCaptureController(profiler *Profiler, log *zap.SugaredLogger) server.ManagementController {
+	c := &captureController{profiler: profiler, log: log}
+	c.capture = func() {
+		if err := profiler.Capture(context.Background()); err != nil {
+			log.Warnw("Failed to capture profiles on demand", "error", err)
+		}
+	}
+	return server.ManagementController{Controller: c}
+}
+
+func (c *captureController) Handlers() []server.Handler {
+	if c.profiler == nil {
+		return nil
+	}
+	return []server.Handler{
+		server.NewHandler(c.captureProfiles, server.HandlerConfig{
+			Path:       "profiling",
+			Method:     http.MethodPost,
+			AuthOptOut: true,
+			StatusCode: http.StatusAccepted,
+		}),
+	}
+}
+
+func (c *captureController) captureProfiles(_ context.Context, _ server.Void) (*server.Response[CaptureResponse], serr.Error) {
+	// checked up front so a capture already in progress is reported, Capture checks again as it starts
+	if !c.profiler.capturing.TryLock() {
+		return nil, serr.NewSimpleErrorWithStatusCode("Profiles are already being captured", http.StatusConflict, ErrCaptureInProgress)
+	}
+	c.profiler.capturing.Unlock()
+	go c.capture()
+	return server.SimpleResponse(CaptureResponse{Profiles: c.profiler.config.Profiles}), nil
+}
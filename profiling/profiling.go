@@ -0,0 +1,328 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package profiling captures runtime profiles of the application every Interval, and on demand at the profiling endpoint of the
+// management server, and ships them to a blob store or a pprof ingest endpoint, for continuous profiling without a sidecar:
+//
+//	profiling:
+//	  enabled: true
+//	  interval: 10m
+//	  profiles: [cpu, heap, goroutine]
+//	  ingestUrl: https://profiles.armory.io/ingest
+//
+// Without an IngestURL profiles are stored in the blob.Store of the application under Prefix. Profiles are labeled with the
+// application metadata, so they can be told apart by service, version, environment, region and host
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/metrics"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProfileCPU       = "cpu"
+	ProfileHeap      = "heap"
+	ProfileAllocs    = "allocs"
+	ProfileGoroutine = "goroutine"
+	ProfileMutex     = "mutex"
+	ProfileBlock     = "block"
+
+	captureMetric = "profiling.capture"
+
+	defaultInterval    = 10 * time.Minute
+	defaultCPUDuration = 10 * time.Second
+	defaultPrefix      = "profiles"
+)
+
+var (
+	// ErrCaptureInProgress profiles are already being captured
+	ErrCaptureInProgress = errors.New("profiles are already being captured")
+
+	defaultProfiles = []string{ProfileCPU, ProfileHeap}
+)
+
+type (
+	Configuration struct {
+		Enabled bool
+		// Interval how often profiles are captured, defaults to 10m. Profiles are only captured on demand when it is negative
+		Interval time.Duration
+		// CPUDuration how long the CPU is profiled for, defaults to 10s
+		CPUDuration time.Duration
+		// Profiles any of cpu, heap, allocs, goroutine, mutex and block, defaults to cpu and heap
+		Profiles []string
+		// Prefix the key prefix of the profiles stored in the blob.Store, defaults to profiles
+		Prefix string
+		// IngestURL ships profiles to a Pyroscope compatible ingest endpoint instead of the blob.Store
+		IngestURL string
+		// Timeout of shipping a profile, defaults to 30s
+		Timeout time.Duration
+	}
+
+	// Profile a captured runtime profile, in the gzipped protobuf format of pprof
+	Profile struct {
+		Type   string
+		Start  time.Time
+		End    time.Time
+		Data   []byte
+		Labels map[string]string
+	}
+
+	// Sink ships profiles
+	Sink interface {
+		Ship(ctx context.Context, profile Profile) error
+	}
+
+	// BlobSink stores profiles in a blob.Store at <prefix>/<app>/<env>/<type>/<host>-<start>.pb.gz, with their labels as metadata
+	BlobSink struct {
+		Store  blob.Store
+		Prefix string
+	}
+
+	// IngestSink posts profiles to a Pyroscope compatible ingest endpoint
+	IngestSink struct {
+		URL    string
+		Client *http.Client
+	}
+
+	// Profiler captures profiles and ships them to its Sink
+	Profiler struct {
+		config  Configuration
+		sink    Sink
+		labels  map[string]string
+		log     *zap.SugaredLogger
+		metrics metrics.MetricsSvc
+		clock   clock.Clock
+
+		// capturing held while profiles are captured, captures don't overlap
+		capturing sync.Mutex
+	}
+)
+
+// NewProfiler creates a Profiler that ships the profiles of the configuration to sink, labeled with the application metadata
+func NewProfiler(config Configuration, sink Sink, md metadata.ApplicationMetadata, log *zap.SugaredLogger, ms metrics.MetricsSvc, c clock.Clock) (*Profiler, error) {
+	config = config.withDefaults()
+	for _, profile := range config.Profiles {
+		if profile != ProfileCPU && pprof.Lookup(profile) == nil {
+			return nil, fmt.Errorf("unknown profile %q, expected any of cpu, heap, allocs, goroutine, mutex and block", profile)
+		}
+	}
+	return &Profiler{
+		config:  config,
+		sink:    sink,
+		labels:  labelsOf(md),
+		log:     log,
+		metrics: ms,
+		clock:   clock.OrDefault(c),
+	}, nil
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+	if c.CPUDuration <= 0 {
+		c.CPUDuration = defaultCPUDuration
+	}
+	if len(c.Profiles) == 0 {
+		c.Profiles = defaultProfiles
+	}
+	if c.Prefix == "" {
+		c.Prefix = defaultPrefix
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	return c
+}
+
+func labelsOf(md metadata.ApplicationMetadata) map[string]string {
+	labels := map[string]string{}
+	for k, v := range map[string]string{
+		"service":     md.Name,
+		"version":     md.Version,
+		"environment": md.Environment,
+		"region":      md.Region,
+		"hostname":    md.Hostname,
+	} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// Run captures profiles every Interval until ctx is done
+func (p *Profiler) Run(ctx context.Context) {
+	if p.config.Interval < 0 {
+		return
+	}
+	ticker := p.clock.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := p.Capture(ctx); err != nil && !errors.Is(err, ErrCaptureInProgress) && ctx.Err() == nil {
+				p.log.Warnw("Failed to capture profiles", "error", err)
+			}
+		}
+	}
+}
+
+// Capture captures the configured profiles and ships them, returns ErrCaptureInProgress when profiles are already being captured
+func (p *Profiler) Capture(ctx context.Context) error {
+	if !p.capturing.TryLock() {
+		return ErrCaptureInProgress
+	}
+	defer p.capturing.Unlock()
+
+	var errs []error
+	for _, profileType := range p.config.Profiles {
+		if err := p.captureAndShip(ctx, profileType); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", profileType, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Profiler) captureAndShip(ctx context.Context, profileType string) error {
+	profile, err := p.capture(ctx, profileType)
+	if err == nil {
+		shipCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+		err = p.sink.Ship(shipCtx, *profile)
+		cancel()
+	}
+	outcome := "shipped"
+	if err != nil {
+		outcome = "failed"
+	}
+	if p.metrics != nil {
+		p.metrics.CounterWithTags(captureMetric, map[string]string{"type": profileType, "outcome": outcome}).Inc(1)
+	}
+	return err
+}
+
+func (p *Profiler) capture(ctx context.Context, profileType string) (*Profile, error) {
+	profile := &Profile{Type: profileType, Start: p.clock.Now(), Labels: p.labels}
+	var buf bytes.Buffer
+	if profileType == ProfileCPU {
+		// fails when the CPU is already profiled, i.e. at the pprof endpoint of the management server
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			return nil, err
+		}
+		timer := p.clock.NewTimer(p.config.CPUDuration)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		pprof.StopCPUProfile()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	} else if err := pprof.Lookup(profileType).WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	profile.End, profile.Data = p.clock.Now(), buf.Bytes()
+	return profile, nil
+}
+
+func (s *BlobSink) Ship(ctx context.Context, profile Profile) error {
+	key := path.Join(
+		s.Prefix,
+		valueOr(profile.Labels["service"], "unknown"),
+		valueOr(profile.Labels["environment"], "unknown"),
+		profile.Type,
+		fmt.Sprintf("%s-%s.pb.gz", valueOr(profile.Labels["hostname"], "unknown"), profile.Start.UTC().Format("20060102T150405Z")),
+	)
+	metadata := map[string]string{"type": profile.Type, "start": profile.Start.UTC().Format(time.RFC3339), "end": profile.End.UTC().Format(time.RFC3339)}
+	for k, v := range profile.Labels {
+		metadata[k] = v
+	}
+	_, err := s.Store.Put(ctx, key, bytes.NewReader(profile.Data), blob.PutOptions{ContentType: "application/octet-stream", Metadata: metadata})
+	return err
+}
+
+// Ship posts the profile with the name and labels of the application in the format of Pyroscope, ex:
+// ?name=deploy-engine.cpu{environment=prod,hostname=deploy-engine-abc}&from=1700000000&until=1700000010&format=pprof
+func (s *IngestSink) Ship(ctx context.Context, profile Profile) error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("name", ingestName(profile))
+	query.Set("from", fmt.Sprint(profile.Start.Unix()))
+	query.Set("until", fmt.Sprint(profile.End.Unix()))
+	query.Set("format", "pprof")
+	query.Set("spyName", "gospy")
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(profile.Data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s responded %d: %s", s.URL, res.StatusCode, message)
+	}
+	return nil
+}
+
+func ingestName(profile Profile) string {
+	labels := make([]string, 0, len(profile.Labels))
+	for k, v := range profile.Labels {
+		if k != "service" {
+			labels = append(labels, k+"="+v)
+		}
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%s.%s{%s}", valueOr(profile.Labels["service"], "unknown"), profile.Type, strings.Join(labels, ","))
+}
+
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
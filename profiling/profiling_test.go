@@ -0,0 +1,124 @@
+package profiling
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeSink struct {
+	mu       sync.Mutex
+	profiles []Profile
+	err      error
+}
+
+func (s *fakeSink) Ship(_ context.Context, profile Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles = append(s.profiles, profile)
+	return s.err
+}
+
+func (s *fakeSink) types() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var types []string
+	for _, p := range s.profiles {
+		types = append(types, p.Type)
+	}
+	return types
+}
+
+var testMetadata = metadata.ApplicationMetadata{Name: "deploy-engine", Environment: "staging", Hostname: "deploy-engine-abc"}
+
+func TestCapture(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &fakeSink{}
+	profiler, err := NewProfiler(Configuration{Profiles: []string{ProfileCPU, ProfileHeap, ProfileGoroutine}}, sink, testMetadata, zap.NewNop().Sugar(), nil, fake)
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() { done <- profiler.Capture(context.Background()) }()
+	fake.BlockUntil(1)
+	assert.ErrorIs(t, profiler.Capture(context.Background()), ErrCaptureInProgress, "captures don't overlap")
+	fake.Advance(defaultCPUDuration)
+	require.NoError(t, <-done)
+
+	assert.Equal(t, []string{ProfileCPU, ProfileHeap, ProfileGoroutine}, sink.types())
+	cpu := sink.profiles[0]
+	assert.Equal(t, defaultCPUDuration, cpu.End.Sub(cpu.Start))
+	assert.Equal(t, map[string]string{"service": "deploy-engine", "environment": "staging", "hostname": "deploy-engine-abc"}, cpu.Labels)
+	for _, p := range sink.profiles {
+		assert.Equal(t, []byte{0x1f, 0x8b}, p.Data[:2], "profiles are gzipped protobufs")
+	}
+}
+
+func TestCaptureReportsEveryFailure(t *testing.T) {
+	sink := &fakeSink{err: errors.New("unavailable")}
+	profiler, err := NewProfiler(Configuration{Profiles: []string{ProfileHeap, ProfileGoroutine}}, sink, testMetadata, zap.NewNop().Sugar(), nil, nil)
+	require.NoError(t, err)
+
+	err = profiler.Capture(context.Background())
+	assert.EqualError(t, err, "heap: unavailable\ngoroutine: unavailable")
+	assert.Len(t, sink.types(), 2)
+}
+
+func TestUnknownProfile(t *testing.T) {
+	_, err := NewProfiler(Configuration{Profiles: []string{"threads"}}, &fakeSink{}, testMetadata, zap.NewNop().Sugar(), nil, nil)
+	assert.EqualError(t, err, `unknown profile "threads", expected any of cpu, heap, allocs, goroutine, mutex and block`)
+}
+
+func TestIngestSink(t *testing.T) {
+	var query map[string][]string
+	var body []byte
+	ingest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer ingest.Close()
+
+	start := time.Unix(1700000000, 0)
+	err := (&IngestSink{URL: ingest.URL + "/ingest"}).Ship(context.Background(), Profile{
+		Type:   ProfileHeap,
+		Start:  start,
+		End:    start.Add(10 * time.Second),
+		Data:   []byte("profile"),
+		Labels: labelsOf(testMetadata),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "deploy-engine.heap{environment=staging,hostname=deploy-engine-abc}", query["name"][0])
+	assert.Equal(t, "1700000000", query["from"][0])
+	assert.Equal(t, "1700000010", query["until"][0])
+	assert.Equal(t, "pprof", query["format"][0])
+	assert.Equal(t, "profile", string(body))
+}
+
+func TestCaptureController(t *testing.T) {
+	profiler, err := NewProfiler(Configuration{Profiles: []string{ProfileHeap}}, &fakeSink{}, testMetadata, zap.NewNop().Sugar(), nil, nil)
+	require.NoError(t, err)
+	captured := make(chan struct{})
+	c := &captureController{profiler: profiler, capture: func() { close(captured) }}
+
+	res, apiErr := c.captureProfiles(context.Background(), struct{}{})
+	require.Nil(t, apiErr)
+	assert.Equal(t, []string{ProfileHeap}, res.Body.Profiles)
+	<-captured
+
+	profiler.capturing.Lock()
+	_, apiErr = c.captureProfiles(context.Background(), struct{}{})
+	require.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusConflict, apiErr.Errors()[0].HttpStatusCode)
+
+	assert.Empty(t, (&captureController{}).Handlers(), "disabled profiling serves no endpoint")
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redact masks the struct fields tagged sensitive:"true" before values reach a sink, so secrets and PII stay out of
+// logs, audit events, error metadata and request snapshots:
+//
+//	type Credentials struct {
+//		User     string `json:"user"`
+//		Password string `json:"password" sensitive:"true"`
+//	}
+//
+// Values with sensitive fields are rendered as the maps and slices of their JSON form, keyed by the JSON names of fields,
+// with Masked in place of sensitive values. Values without any are returned as is.
+package redact
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Tag the struct tag of sensitive fields
+	Tag = "sensitive"
+	// Masked replaces the values of sensitive fields
+	Masked = "[MASKED]"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	anyType           = reflect.TypeOf((*any)(nil)).Elem()
+
+	// sensitiveTypes reflect.Type -> bool, whether values of the type may hold sensitive fields
+	sensitiveTypes sync.Map
+)
+
+// IsSensitive whether the field is tagged sensitive:"true"
+func IsSensitive(field reflect.StructField) bool {
+	sensitive, _ := strconv.ParseBool(field.Tag.Get(Tag))
+	return sensitive
+}
+
+// Value v with its sensitive fields masked, v itself when it has none
+func Value(v any) any {
+	if v == nil {
+		return nil
+	}
+	redacted, _ := value(reflect.ValueOf(v))
+	return redacted
+}
+
+// value the redacted form of v and whether it differs from v
+func value(v reflect.Value) (any, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	if !mayBeSensitive(v.Type()) {
+		return v.Interface(), false
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return v.Interface(), false
+		}
+		redacted, changed := value(v.Elem())
+		if !changed {
+			return v.Interface(), false
+		}
+		return redacted, true
+	case reflect.Struct:
+		fields := map[string]any{}
+		addFields(fields, v)
+		return fields, true
+	case reflect.Map:
+		if v.IsNil() {
+			return v.Interface(), false
+		}
+		redacted := reflect.MakeMapWithSize(reflect.MapOf(v.Type().Key(), anyType), v.Len())
+		changed := false
+		for iter := v.MapRange(); iter.Next(); {
+			item, itemChanged := value(iter.Value())
+			changed = changed || itemChanged
+			redacted.SetMapIndex(iter.Key(), reflect.ValueOf(&item).Elem())
+		}
+		if !changed {
+			return v.Interface(), false
+		}
+		return redacted.Interface(), true
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v.Interface(), false
+		}
+		redacted := make([]any, v.Len())
+		changed := false
+		for i := range redacted {
+			var itemChanged bool
+			redacted[i], itemChanged = value(v.Index(i))
+			changed = changed || itemChanged
+		}
+		if !changed {
+			return v.Interface(), false
+		}
+		return redacted, true
+	default:
+		return v.Interface(), false
+	}
+}
+
+// addFields adds the fields of the struct v to fields by JSON name, the fields of embedded structs are promoted as encoding/json does
+func addFields(fields map[string]any, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				addFields(fields, fv)
+				continue
+			}
+		}
+		if omitEmpty && fv.IsZero() {
+			continue
+		}
+		if IsSensitive(field) {
+			fields[name] = Masked
+			continue
+		}
+		fields[name], _ = value(fv)
+	}
+}
+
+func jsonName(field reflect.StructField) (string, bool, bool) {
+	if !field.IsExported() && !field.Anonymous {
+		return "", false, false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(options, "omitempty"), true
+}
+
+// mayBeSensitive whether values of t may hold sensitive fields, always true for interfaces whose dynamic values are only known at runtime
+func mayBeSensitive(t reflect.Type) bool {
+	if sensitive, ok := sensitiveTypes.Load(t); ok {
+		return sensitive.(bool)
+	}
+	sensitive := inspect(t, map[reflect.Type]bool{})
+	sensitiveTypes.Store(t, sensitive)
+	return sensitive
+}
+
+// inspect whether values of t may hold sensitive fields, types being inspected further up a recursive type don't count
+func inspect(t reflect.Type, inspecting map[reflect.Type]bool) bool {
+	if inspecting[t] {
+		return false
+	}
+	inspecting[t] = true
+	defer delete(inspecting, t)
+
+	if t.Kind() != reflect.Interface && (t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)) {
+		// types that marshal themselves are rendered as they choose
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return inspect(t.Elem(), inspecting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if _, _, ok := jsonName(field); !ok {
+				continue
+			}
+			if IsSensitive(field) || inspect(field.Type, inspecting) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redact
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type (
+	credentials struct {
+		User     string `json:"user"`
+		Password string `json:"password" sensitive:"true"`
+		APIKey   string `json:"apiKey,omitempty" sensitive:"true"`
+	}
+
+	audited struct {
+		UpdatedAt time.Time `json:"updatedAt"`
+	}
+
+	account struct {
+		audited
+		Name        string                 `json:"name"`
+		Credentials *credentials           `json:"credentials,omitempty"`
+		Backups     []credentials          `json:"backups"`
+		ByRegion    map[string]credentials `json:"byRegion"`
+		Internal    string                 `json:"-"`
+		Children    []account              `json:"children,omitempty"`
+	}
+
+	plain struct {
+		Name string `json:"name"`
+	}
+)
+
+func TestValue(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	redacted := Value(account{
+		audited:     audited{UpdatedAt: now},
+		Name:        "prod",
+		Credentials: &credentials{User: "admin", Password: "hunter2"},
+		Backups:     []credentials{{User: "backup", Password: "hunter3", APIKey: "key"}},
+		ByRegion:    map[string]credentials{"us-east": {User: "east", Password: "hunter4"}},
+		Internal:    "internal",
+		Children:    []account{{Name: "child", Credentials: &credentials{User: "child", Password: "hunter5"}}},
+	})
+
+	b, err := json.Marshal(redacted)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"updatedAt": "2023-06-01T12:00:00Z",
+		"name": "prod",
+		"credentials": {"user": "admin", "password": "[MASKED]"},
+		"backups": [{"user": "backup", "password": "[MASKED]", "apiKey": "[MASKED]"}],
+		"byRegion": {"us-east": {"user": "east", "password": "[MASKED]"}},
+		"children": [{"updatedAt": "0001-01-01T00:00:00Z", "name": "child", "credentials": {"user": "child", "password": "[MASKED]"}, "backups": null, "byRegion": null}]
+	}`, string(b))
+}
+
+func TestValueWithoutSensitiveFields(t *testing.T) {
+	p := &plain{Name: "prod"}
+	assert.Same(t, p, Value(p), "values without sensitive fields are returned as is")
+	assert.Nil(t, Value(nil))
+
+	metadata := map[string]any{"id": 7, "plain": plain{Name: "prod"}}
+	assert.Equal(t, metadata, Value(metadata))
+	assert.Equal(t, map[string]any{"id": 7, "credentials": map[string]any{"user": "admin", "password": Masked}},
+		Value(map[string]any{"id": 7, "credentials": credentials{User: "admin", Password: "hunter2"}}))
+}
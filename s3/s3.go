@@ -11,9 +11,13 @@ import (
 )
 
 type Configuration struct {
-	Region              string
-	Endpoint            string
-	MaxRetryAttempts    int
+	Region           string
+	Endpoint         string
+	MaxRetryAttempts int
+	// AccessKeyID optional static access key, when not set the default AWS credentials chain is used
+	AccessKeyID string
+	// SecretAccessKey the secret for AccessKeyID, this can be an encrypted secret resolved by typesafeconfig
+	SecretAccessKey     string
 	credentialsProvider aws.CredentialsProvider
 }
 
@@ -44,6 +48,8 @@ func New(
 
 	if c.credentialsProvider != nil {
 		opts = append(opts, config.WithCredentialsProvider(c.credentialsProvider))
+	} else if c.AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(staticCredentials(c.AccessKeyID, c.SecretAccessKey)))
 	}
 
 	ac, err := config.LoadDefaultConfig(ctx, opts...)
@@ -53,3 +59,13 @@ func New(
 
 	return s3.NewFromConfig(ac), nil
 }
+
+func staticCredentials(accessKeyID, secretAccessKey string) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			Source:          "go-commons/s3",
+		}, nil
+	})
+}
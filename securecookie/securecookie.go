@@ -0,0 +1,265 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package securecookie encrypts and authenticates values stored in cookies, such as the state of an OAuth flow or a CSRF token.
+//
+// Values are sealed with AES-256-GCM under the primary key and bound to the cookie name, so a cookie can't be replayed under
+// another name. Cookies name the key they were sealed with, keys are rotated by adding a new primary key and keeping the
+// previous ones until the cookies sealed with them have expired:
+//
+//	securecookie:
+//	  primaryKeyId: "2023-06"
+//	  keys:
+//	    "2023-06": encrypted:k8s!n:cookie-keys!k:2023-06
+//	    "2023-01": encrypted:k8s!n:cookie-keys!k:2023-01
+//	  maxAge: 10m
+package securecookie
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"go.uber.org/fx"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	keySize        = 32
+	timestampSize  = 8
+	version        = "v1"
+	separator      = "."
+	defaultMaxAge  = 24 * time.Hour
+	maxCookieBytes = 4096
+)
+
+var (
+	ErrUnknownKey = errors.New("cookie was sealed with an unknown key")
+	ErrInvalid    = errors.New("cookie is malformed or has been tampered with")
+	ErrExpired    = errors.New("cookie has expired")
+	ErrTooLarge   = errors.New("cookie exceeds 4096 bytes")
+)
+
+type (
+	Configuration struct {
+		// PrimaryKeyID the id of the key new cookies are sealed with, the remaining keys only open cookies sealed before a rotation
+		PrimaryKeyID string
+		// Keys base64 encoded 256 bit keys by id, use encrypted secrets rather than plaintext keys. Ids can't contain dots
+		Keys map[string]string
+		// MaxAge how long a cookie is accepted after it was sealed, and its Max-Age attribute. Defaults to 24 hours
+		MaxAge time.Duration
+		// Path the Path attribute of cookies, defaults to /
+		Path string
+		// Domain the Domain attribute of cookies, defaults to the host of the request
+		Domain string
+		// Insecure drops the Secure attribute so cookies are sent over plain HTTP, for local development only
+		Insecure bool
+		// SameSite one of lax, strict or none, defaults to lax which lets cookies survive the redirect back from an identity provider
+		SameSite string
+	}
+
+	Parameters struct {
+		fx.In
+		Config Configuration
+		Clock  clock.Clock `optional:"true"`
+	}
+
+	// Codec seals values into cookies and opens them again
+	Codec struct {
+		primaryKeyID string
+		keys         map[string]cipher.AEAD
+		maxAge       time.Duration
+		path         string
+		domain       string
+		secure       bool
+		sameSite     http.SameSite
+		clock        clock.Clock
+	}
+)
+
+var Module = fx.Module("securecookie", fx.Provide(New))
+
+func New(p Parameters) (*Codec, error) {
+	return NewCodec(p.Config, p.Clock)
+}
+
+// NewCodec creates a Codec outside of fx, c may be nil to use the real clock
+func NewCodec(config Configuration, c clock.Clock) (*Codec, error) {
+	if _, ok := config.Keys[config.PrimaryKeyID]; !ok {
+		return nil, fmt.Errorf("%w: primary key %q is not in securecookie.keys", ErrUnknownKey, config.PrimaryKeyID)
+	}
+	sameSite, err := parseSameSite(config.SameSite)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := &Codec{
+		primaryKeyID: config.PrimaryKeyID,
+		keys:         make(map[string]cipher.AEAD, len(config.Keys)),
+		maxAge:       config.MaxAge,
+		path:         config.Path,
+		domain:       config.Domain,
+		secure:       !config.Insecure,
+		sameSite:     sameSite,
+		clock:        clock.OrDefault(c),
+	}
+	if codec.maxAge <= 0 {
+		codec.maxAge = defaultMaxAge
+	}
+	if codec.path == "" {
+		codec.path = "/"
+	}
+	for id, encoded := range config.Keys {
+		if id == "" || strings.Contains(id, separator) {
+			return nil, fmt.Errorf("securecookie.keys has an invalid id %q, ids must be non empty and can't contain dots", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("securecookie.keys.%s must be base64 encoded: %w", id, err)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("securecookie.keys.%s must be a 256 bit key, got %d bits", id, len(key)*8)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		codec.keys[id] = aead
+	}
+	return codec, nil
+}
+
+// Encode seals the JSON encoding of value for the cookie called name
+func (c *Codec) Encode(name string, value any) (string, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, timestampSize, timestampSize+len(payload))
+	binary.BigEndian.PutUint64(plaintext, uint64(c.clock.Now().Unix()))
+	plaintext = append(plaintext, payload...)
+
+	aead := c.keys[c.primaryKeyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, associatedData(c.primaryKeyID, name))
+
+	encoded := strings.Join([]string{version, c.primaryKeyID, base64.RawURLEncoding.EncodeToString(sealed)}, separator)
+	if len(name)+len(encoded) > maxCookieBytes {
+		return "", ErrTooLarge
+	}
+	return encoded, nil
+}
+
+// Decode opens a value sealed by Encode for the cookie called name into dst, cookies older than MaxAge are rejected with ErrExpired
+func (c *Codec) Decode(name string, encoded string, dst any) error {
+	parts := strings.Split(encoded, separator)
+	if len(parts) != 3 || parts[0] != version {
+		return ErrInvalid
+	}
+	keyID := parts[1]
+	aead, ok := c.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return ErrInvalid
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], associatedData(keyID, name))
+	if err != nil || len(plaintext) < timestampSize {
+		return ErrInvalid
+	}
+
+	sealedAt := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if c.clock.Since(sealedAt) > c.maxAge {
+		return ErrExpired
+	}
+	return json.Unmarshal(plaintext[timestampSize:], dst)
+}
+
+// SetCookie seals value into an HttpOnly cookie called name
+func (c *Codec) SetCookie(w http.ResponseWriter, name string, value any) error {
+	encoded, err := c.Encode(name, value)
+	if err != nil {
+		return err
+	}
+	cookie := c.cookie(name, encoded)
+	cookie.MaxAge = int(c.maxAge.Seconds())
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// ReadCookie opens the cookie called name of the request into dst, http.ErrNoCookie is returned when there is no such cookie
+func (c *Codec) ReadCookie(r *http.Request, name string, dst any) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return c.Decode(name, cookie.Value, dst)
+}
+
+// ClearCookie tells the client to delete the cookie called name, i.e. once the OAuth state it held has been used
+func (c *Codec) ClearCookie(w http.ResponseWriter, name string) {
+	cookie := c.cookie(name, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+func (c *Codec) cookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     c.path,
+		Domain:   c.domain,
+		Secure:   c.secure,
+		HttpOnly: true,
+		SameSite: c.sameSite,
+	}
+}
+
+// associatedData binds the sealed value to the key and the cookie name
+func associatedData(keyID string, name string) []byte {
+	return bytes.Join([][]byte{[]byte(version), []byte(keyID), []byte(name)}, []byte(separator))
+}
+
+func parseSameSite(sameSite string) (http.SameSite, error) {
+	switch strings.ToLower(sameSite) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("securecookie.sameSite must be one of lax, strict or none, got %q", sameSite)
+	}
+}
@@ -0,0 +1,118 @@
+package securecookie
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type oauthState struct {
+	State    string `json:"state"`
+	Redirect string `json:"redirect"`
+}
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newCodec(t *testing.T, primary string, c clock.Clock) *Codec {
+	codec, err := NewCodec(Configuration{
+		PrimaryKeyID: primary,
+		Keys:         map[string]string{"2022": key(1), "2023": key(2)},
+		MaxAge:       10 * time.Minute,
+	}, c)
+	assert.NoError(t, err)
+	return codec
+}
+
+func TestEncodeDecode(t *testing.T) {
+	codec := newCodec(t, "2022", nil)
+
+	encoded, err := codec.Encode("oauth_state", oauthState{State: "abc", Redirect: "/deployments"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "v1.2022."))
+	assert.NotContains(t, encoded, "deployments")
+
+	var state oauthState
+	assert.NoError(t, codec.Decode("oauth_state", encoded, &state))
+	assert.Equal(t, oauthState{State: "abc", Redirect: "/deployments"}, state)
+
+	assert.ErrorIs(t, codec.Decode("csrf", encoded, &state), ErrInvalid, "cookies are bound to their name")
+	assert.ErrorIs(t, codec.Decode("oauth_state", encoded[:len(encoded)-2]+"AA", &state), ErrInvalid)
+	assert.ErrorIs(t, codec.Decode("oauth_state", "garbage", &state), ErrInvalid)
+	assert.ErrorIs(t, codec.Decode("oauth_state", strings.Replace(encoded, "2022", "2021", 1), &state), ErrUnknownKey)
+}
+
+func TestKeyRotation(t *testing.T) {
+	encoded, err := newCodec(t, "2022", nil).Encode("csrf", "token")
+	assert.NoError(t, err)
+
+	var token string
+	assert.NoError(t, newCodec(t, "2023", nil).Decode("csrf", encoded, &token), "cookies sealed with a previous key still open")
+	assert.Equal(t, "token", token)
+
+	retired, err := NewCodec(Configuration{PrimaryKeyID: "2023", Keys: map[string]string{"2023": key(2)}}, nil)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, retired.Decode("csrf", encoded, &token), ErrUnknownKey)
+}
+
+func TestMaxAge(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	codec := newCodec(t, "2022", fake)
+	encoded, err := codec.Encode("csrf", "token")
+	assert.NoError(t, err)
+
+	var token string
+	fake.Advance(10 * time.Minute)
+	assert.NoError(t, codec.Decode("csrf", encoded, &token))
+	fake.Advance(time.Second)
+	assert.ErrorIs(t, codec.Decode("csrf", encoded, &token), ErrExpired)
+}
+
+func TestCookies(t *testing.T) {
+	codec := newCodec(t, "2022", nil)
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, codec.SetCookie(w, "oauth_state", oauthState{State: "abc"}))
+	cookie := w.Result().Cookies()[0]
+	assert.Equal(t, "/", cookie.Path)
+	assert.Equal(t, 600, cookie.MaxAge)
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	r := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	r.AddCookie(cookie)
+	var state oauthState
+	assert.NoError(t, codec.ReadCookie(r, "oauth_state", &state))
+	assert.Equal(t, "abc", state.State)
+	assert.True(t, errors.Is(codec.ReadCookie(r, "csrf", &state), http.ErrNoCookie))
+
+	w = httptest.NewRecorder()
+	codec.ClearCookie(w, "oauth_state")
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+	_, err := codec.Encode("big", strings.Repeat("x", maxCookieBytes))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	for name, config := range map[string]Configuration{
+		"missing primary key": {PrimaryKeyID: "2024", Keys: map[string]string{"2023": key(2)}},
+		"short key":           {PrimaryKeyID: "2023", Keys: map[string]string{"2023": base64.StdEncoding.EncodeToString([]byte("short"))}},
+		"dotted id":           {PrimaryKeyID: "2023.1", Keys: map[string]string{"2023.1": key(2)}},
+		"same site":           {PrimaryKeyID: "2023", Keys: map[string]string{"2023": key(2)}, SameSite: "sometimes"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewCodec(config, nil)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	allocatedBytesSample   = "/gc/heap/allocs:bytes"
+	allocatedObjectsSample = "/gc/heap/allocs:objects"
+	heapObjectsSample      = "/memory/classes/heap/objects:bytes"
+
+	allocationOutlierMetric = "http.server.request.allocationOutliers"
+
+	defaultAllocationSampleEvery  = 100
+	defaultAllocationThreshold    = 16 << 20
+	defaultAllocationPollInterval = 10 * time.Millisecond
+)
+
+type (
+	// AllocationAccountingConfiguration estimates the memory a sample of the requests allocate with runtime/metrics, to find the
+	// handlers responsible for GC pressure. Requests that allocated more than Threshold are logged with their route and counted by
+	// the http.server.request.allocationOutliers metric.
+	//
+	// The runtime only counts the allocations of the whole process, so the allocations of the requests handled at the same time as
+	// a sampled one are added to it. The requests in flight are logged along with each outlier to tell them apart
+	AllocationAccountingConfiguration struct {
+		Enabled bool
+		// SampleEvery one request in every SampleEvery is measured, defaults to 100
+		SampleEvery int
+		// Threshold the bytes a request must allocate to be logged, defaults to 16MB
+		Threshold int
+		// PollInterval how often the heap is read while a sampled request is handled to find its peak, defaults to 10ms
+		PollInterval time.Duration
+	}
+
+	// allocationAccounting measures the sampled requests of a server
+	allocationAccounting struct {
+		name     string
+		config   AllocationAccountingConfiguration
+		clock    clock.Clock
+		ms       metrics.MetricsSvc
+		log      *zap.SugaredLogger
+		requests atomic.Int64
+		inFlight atomic.Int64
+		// read the allocation counters of the process, replaced in tests
+		read func() allocationSnapshot
+	}
+
+	allocationSnapshot struct {
+		bytes   uint64
+		objects uint64
+		heap    uint64
+	}
+)
+
+// newAllocationAccounting the accounting of the server, nil when disabled
+func newAllocationAccounting(name string, config AllocationAccountingConfiguration, c clock.Clock, ms metrics.MetricsSvc, log *zap.SugaredLogger) *allocationAccounting {
+	if !config.Enabled {
+		return nil
+	}
+	if config.SampleEvery <= 0 {
+		config.SampleEvery = defaultAllocationSampleEvery
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = defaultAllocationThreshold
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultAllocationPollInterval
+	}
+	return &allocationAccounting{name: name, config: config, clock: clock.OrDefault(c), ms: ms, log: log, read: readAllocations}
+}
+
+func readAllocations() allocationSnapshot {
+	samples := []rtmetrics.Sample{{Name: allocatedBytesSample}, {Name: allocatedObjectsSample}, {Name: heapObjectsSample}}
+	rtmetrics.Read(samples)
+	var s allocationSnapshot
+	for i, v := range []*uint64{&s.bytes, &s.objects, &s.heap} {
+		if samples[i].Value.Kind() == rtmetrics.KindUint64 {
+			*v = samples[i].Value.Uint64()
+		}
+	}
+	return s
+}
+
+// middleware measures one request in every SampleEvery, polling the heap while it is handled
+func (a *allocationAccounting) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		concurrent := a.inFlight.Add(1)
+		defer a.inFlight.Add(-1)
+		if a.requests.Add(1)%int64(a.config.SampleEvery) != 0 {
+			c.Next()
+			return
+		}
+
+		start := a.read()
+		peak := start.heap
+		stop := make(chan struct{})
+		polled := make(chan uint64)
+		go func() {
+			ticker := a.clock.NewTicker(a.config.PollInterval)
+			defer ticker.Stop()
+			highest := start.heap
+			for {
+				select {
+				case <-ticker.C():
+					if heap := a.read().heap; heap > highest {
+						highest = heap
+					}
+				case <-stop:
+					polled <- highest
+					return
+				}
+			}
+		}()
+		c.Next()
+		close(stop)
+		if highest := <-polled; highest > peak {
+			peak = highest
+		}
+		end := a.read()
+		if end.heap > peak {
+			peak = end.heap
+		}
+
+		allocated := end.bytes - start.bytes
+		if allocated < uint64(a.config.Threshold) {
+			return
+		}
+		route := c.FullPath()
+		a.ms.CounterWithTags(allocationOutlierMetric, map[string]string{"server": a.name, "method": c.Request.Method, "uri": route}).Inc(1)
+		a.log.Warnw("Request allocated more memory than the allocation threshold",
+			"method", c.Request.Method,
+			"uri", route,
+			"allocatedBytes", allocated,
+			"allocatedObjects", end.objects-start.objects,
+			"peakHeapGrowthBytes", peak-start.heap,
+			"requestsInFlight", concurrent,
+		)
+	}
+}
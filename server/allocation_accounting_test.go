@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAllocationAccounting(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	core, logs := observer.New(zapcore.WarnLevel)
+	a := newAllocationAccounting("http", AllocationAccountingConfiguration{Enabled: true, SampleEvery: 2, Threshold: 1000}, clock.NewFake(time.Now()), ms, zap.New(core).Sugar())
+
+	var counters allocationSnapshot
+	reads := 0
+	a.read = func() allocationSnapshot {
+		reads++
+		return counters
+	}
+	g := gin.New()
+	g.Use(a.middleware())
+	g.GET("/deployments/:id", func(c *gin.Context) {
+		allocated := uint64(10)
+		if c.Query("large") != "" {
+			allocated = 5000
+		}
+		counters.bytes += allocated
+		counters.objects += 3
+		counters.heap += allocated / 2
+		c.Status(http.StatusOK)
+	})
+	serve := func(query string) {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/deployments/dep-1"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	serve("?large=true")
+	assert.Zero(t, reads, "requests that aren't sampled aren't measured")
+	serve("")
+	assert.Equal(t, 2, reads)
+	assert.Zero(t, logs.Len(), "requests under the threshold aren't logged")
+
+	serve("")
+	serve("?large=true")
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "/deployments/:id", fields["uri"])
+	assert.Equal(t, uint64(5000), fields["allocatedBytes"])
+	assert.Equal(t, uint64(3), fields["allocatedObjects"])
+	assert.Equal(t, uint64(2500), fields["peakHeapGrowthBytes"])
+	assert.Equal(t, int64(1), fields["requestsInFlight"])
+	assert.Equal(t, int64(1), scope.Snapshot().Counters()[allocationOutlierMetric+"+method=GET,server=http,uri=/deployments/:id"].Value())
+}
+
+func TestAllocationAccountingDisabled(t *testing.T) {
+	assert.Nil(t, newAllocationAccounting("http", AllocationAccountingConfiguration{}, nil, nil, zap.NewNop().Sugar()))
+
+	a := newAllocationAccounting("http", AllocationAccountingConfiguration{Enabled: true}, nil, nil, zap.NewNop().Sugar())
+	assert.Equal(t, AllocationAccountingConfiguration{Enabled: true, SampleEvery: 100, Threshold: 16 << 20, PollInterval: 10 * time.Millisecond}, a.config)
+	assert.NotZero(t, readAllocations().bytes, "the allocations of the process are read from runtime/metrics")
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/gin-gonic/gin"
+	"sort"
+	"strings"
+)
+
+type (
+	// APIGroupConfiguration the settings shared by the routes of every controller of an API product, such as deployments or rbac, so they
+	// aren't repeated on each controller. Settings of a handler take precedence over those of its group
+	APIGroupConfiguration struct {
+		// Prefix prepended to the paths of the controllers of the group, before their own IControllerPrefix
+		Prefix string `json:"prefix,omitempty"`
+		// MaxConcurrent and MaxQueued the defaults of the handlers of the group, see HandlerConfig.MaxConcurrent
+		MaxConcurrent int `json:"maxConcurrent,omitempty"`
+		MaxQueued     int `json:"maxQueued,omitempty"`
+		// Deprecation marks every handler of the group that isn't deprecated on its own as deprecated, see HandlerConfig.Deprecation
+		Deprecation *Deprecation `json:"deprecation,omitempty"`
+		// RequiredScopes the scopes principals must have to call the handlers of the group that don't opt out of auth
+		RequiredScopes []string `json:"requiredScopes,omitempty"`
+		// RequireSignature when true every handler of the group requires a signed request, see RequestSigningConfiguration
+		RequireSignature bool `json:"requireSignature,omitempty"`
+		// AllowedOrigins the origins, such as https://app.example.com, browsers may send cross-origin requests to the group from
+		AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	}
+
+	// IControllerAPIGroup an IController can implement this interface to join the named API group, see APIGroupConfiguration
+	IControllerAPIGroup interface {
+		APIGroup() string
+	}
+
+	// apiGroups the configured API groups and the controllers that joined them, listed at the /info endpoint
+	apiGroups struct {
+		groups      map[string]*apiGroup
+		controllers map[string][]string
+	}
+
+	apiGroup struct {
+		name    string
+		config  APIGroupConfiguration
+		origins map[string]bool
+	}
+)
+
+// newAPIGroups validates that every controller joins a configured group, nil when no group is configured or joined
+func newAPIGroups(config map[string]APIGroupConfiguration, controllers []IController) (*apiGroups, error) {
+	g := &apiGroups{groups: make(map[string]*apiGroup, len(config)), controllers: map[string][]string{}}
+	for name, groupConfig := range config {
+		group := &apiGroup{name: name, config: groupConfig, origins: map[string]bool{}}
+		for _, origin := range groupConfig.AllowedOrigins {
+			group.origins[normalizeOrigin(origin)] = true
+		}
+		g.groups[name] = group
+	}
+	for _, controller := range controllers {
+		c, ok := controller.(IControllerAPIGroup)
+		if !ok || c.APIGroup() == "" {
+			continue
+		}
+		if g.groups[c.APIGroup()] == nil {
+			return nil, fmt.Errorf("controller %T joins API group %q which is not configured", controller, c.APIGroup())
+		}
+		g.controllers[c.APIGroup()] = append(g.controllers[c.APIGroup()], typeName(controller))
+	}
+	if len(g.groups) == 0 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// of the group the controller joined, nil when it joined none
+func (g *apiGroups) of(controller IController) *apiGroup {
+	if g == nil {
+		return nil
+	}
+	if c, ok := controller.(IControllerAPIGroup); ok {
+		return g.groups[c.APIGroup()]
+	}
+	return nil
+}
+
+func (g *apiGroups) Contribute(builder *info.InfoBuilder) {
+	groups := make(map[string]any, len(g.groups))
+	for name, group := range g.groups {
+		controllers := g.controllers[name]
+		sort.Strings(controllers)
+		groups[name] = map[string]any{
+			"settings":    group.config,
+			"controllers": controllers,
+		}
+	}
+	builder.WithDetails(map[string]any{"apiGroups": groups})
+}
+
+// apply makes the settings of the group the defaults of the handler, which must be done before its handler func is created
+func (g *apiGroup) apply(handler *handlerDTO) {
+	if g == nil {
+		return
+	}
+	handler.APIGroup = g.name
+	handler.apiGroup = g
+	if prefix := normalizePrefix(g.config.Prefix); prefix != "" {
+		handler.Path = strings.TrimSuffix(prefix+"/"+strings.TrimPrefix(handler.Path, "/"), "/")
+	}
+	if handler.MaxConcurrent == 0 {
+		handler.MaxConcurrent = g.config.MaxConcurrent
+		handler.MaxQueued = g.config.MaxQueued
+	}
+	if handler.Deprecation == nil {
+		handler.Deprecation = g.config.Deprecation
+	}
+	handler.RequireSignature = handler.RequireSignature || g.config.RequireSignature
+}
+
+// authZValidator requires the scopes of the group, nil when it has none
+func (g *apiGroup) authZValidator() AuthZValidatorV2Fn {
+	if g == nil || len(g.config.RequiredScopes) == 0 {
+		return nil
+	}
+	return func(_ context.Context, p *iam.ArmoryCloudPrincipal) (string, bool) {
+		for _, scope := range g.config.RequiredScopes {
+			if !p.HasScope(scope) {
+				return fmt.Sprintf("the %s API requires the %s scope", g.name, scope), false
+			}
+		}
+		return "", true
+	}
+}
+
+// wrap allows cross-origin requests from the origins of the group
+func (g *apiGroup) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if g == nil || len(g.origins) == 0 {
+		return next
+	}
+	return func(c *gin.Context) {
+		if origin := c.GetHeader("Origin"); origin != "" && (g.origins["*"] || g.origins[normalizeOrigin(origin)]) {
+			allowOrigin(c.Writer.Header(), origin)
+		}
+		next(c)
+	}
+}
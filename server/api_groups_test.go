@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type productController struct {
+	group string
+}
+
+func (c productController) APIGroup() string { return c.group }
+
+func (productController) Prefix() string { return "v1" }
+
+func (productController) Handlers() []Handler {
+	ok := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(ok, HandlerConfig{Path: "/deployments", Method: http.MethodGet}),
+		NewHandler(ok, HandlerConfig{Path: "/deployments", Method: http.MethodPost, MaxConcurrent: 1, Deprecation: &Deprecation{Successor: "/v2/deployments"}}),
+	}
+}
+
+var deploymentsGroup = map[string]APIGroupConfiguration{
+	"deployments": {
+		Prefix:         "/cd/",
+		MaxConcurrent:  10,
+		MaxQueued:      5,
+		Deprecation:    &Deprecation{},
+		RequiredScopes: []string{"read:deployments"},
+		AllowedOrigins: []string{"https://app.example.com/"},
+	},
+}
+
+func TestAPIGroupsApplyGroupSettings(t *testing.T) {
+	groups, err := newAPIGroups(deploymentsGroup, []IController{productController{group: "deployments"}})
+	require.NoError(t, err)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), groups, []IController{productController{group: "deployments"}})
+	require.NoError(t, err)
+
+	handlers := map[string]*handlerDTO{}
+	for _, handler := range registry.handlers() {
+		handlers[handler.Method] = handler
+	}
+	get, post := handlers[http.MethodGet], handlers[http.MethodPost]
+	assert.Equal(t, "/cd/v1/deployments", get.Path)
+	assert.Equal(t, "deployments", get.APIGroup)
+	assert.Equal(t, 10, get.MaxConcurrent)
+	assert.Equal(t, 5, get.MaxQueued)
+	assert.Equal(t, "true", get.StaticHeaders.Get(deprecationHeader))
+	assert.Len(t, get.AuthZValidators, 1)
+
+	assert.Equal(t, 1, post.MaxConcurrent, "the handler's settings take precedence")
+	assert.Equal(t, 0, post.MaxQueued)
+	assert.Equal(t, "/v2/deployments", post.Deprecation.Successor)
+
+	is := &info.InfoService{}
+	is.AddInfoContributor(groups)
+	details := (*is.GetInfoContent())["apigroups"].(map[string]any)["deployments"].(map[string]any)
+	assert.Equal(t, []string{"productController"}, details["controllers"])
+	assert.Equal(t, deploymentsGroup["deployments"], details["settings"])
+}
+
+func TestAPIGroupsScopesAndOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	groups, err := newAPIGroups(deploymentsGroup, []IController{productController{group: "deployments"}})
+	require.NoError(t, err)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), groups, []IController{productController{group: "deployments"}})
+	require.NoError(t, err)
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) {
+		scopes := strings.Fields(c.GetHeader("scopes"))
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: "org", Type: iam.Machine, Scopes: scopes}))
+	})
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group(""),
+		AuthNotEnforcedGroup: g.Group(""),
+	}))
+
+	serve := func(scopes string, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cd/v1/deployments", nil)
+		req.Header.Set("scopes", scopes)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("read:deployments", "https://app.example.com")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = serve("", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestAPIGroupsUnknownGroup(t *testing.T) {
+	_, err := newAPIGroups(deploymentsGroup, []IController{productController{group: "rbac"}})
+	assert.ErrorContains(t, err, `API group "rbac" which is not configured`)
+
+	groups, err := newAPIGroups(nil, []IController{productController{}})
+	assert.NoError(t, err)
+	assert.Nil(t, groups)
+}
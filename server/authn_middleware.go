@@ -45,6 +45,15 @@ func ginAttemptAuthMiddleware(as AuthService) gin.HandlerFunc {
 }
 
 func extractPrincipalFromHTTPRequestAndSetContext(c *gin.Context, as AuthService) serr.Error {
+	if ras, ok := as.(RequestAuthService); ok {
+		if handled, err := ras.VerifyRequestAndSetContext(c); handled {
+			if err != nil {
+				return serr.NewSimpleErrorWithStatusCode("Failed to verify principal from request", http.StatusUnauthorized, err)
+			}
+			return nil
+		}
+	}
+
 	auth, err := iam.ExtractBearerToken(c.Request)
 	if err != nil {
 		return serr.NewSimpleErrorWithStatusCode("Failed to extract access token from request", http.StatusUnauthorized, err)
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// BackpressureHandlerConcurrency the source of the backpressure of HandlerConfig.MaxConcurrent
+	BackpressureHandlerConcurrency = "handlerConcurrency"
+	// BackpressureConcurrencyLimit the source of the backpressure of ConcurrencyLimitConfiguration
+	BackpressureConcurrencyLimit = "concurrencyLimit"
+
+	// latencyDecay the weight of the latest request in the average latencies Retry-After is estimated from
+	latencyDecay = 0.2
+)
+
+var backpressureKey = ctxutil.NewKey[[]Backpressure]("server.backpressure")
+
+// Backpressure the state of a guardrail, such as a concurrency limit, when it admitted or turned away a request. Requests that are turned
+// away are answered with the Retry-After header and the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the IETF
+// draft, whichever guardrail turned them away
+type Backpressure struct {
+	// Source the guardrail, see BackpressureHandlerConcurrency and BackpressureConcurrencyLimit
+	Source string `json:"source"`
+	// Limit the requests the guardrail allows
+	Limit int `json:"limit"`
+	// Remaining the requests the guardrail allows beyond this one
+	Remaining int `json:"remaining"`
+	// RetryAfter when a request that is turned away is likely to be admitted, zero for admitted requests
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+}
+
+// BackpressureOf the backpressure of the guardrails that admitted the request of the context, so handlers can shed optional work
+// when a guardrail is close to its limit
+func BackpressureOf(ctx context.Context) []Backpressure {
+	b, _ := backpressureKey.Value(ctx)
+	return b
+}
+
+// recordBackpressure adds the backpressure to the request's context
+func recordBackpressure(c *gin.Context, b Backpressure) {
+	current := BackpressureOf(c.Request.Context())
+	c.Request = c.Request.WithContext(backpressureKey.WithValue(c.Request.Context(), append(current[:len(current):len(current)], b)))
+}
+
+// rejectRequest answers a request the guardrail turned away with the error and the headers of the backpressure
+func rejectRequest(c *gin.Context, apiErr serr.APIError, b Backpressure, log *zap.SugaredLogger) {
+	recordBackpressure(c, b)
+	writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(apiErr,
+		serr.WithExtraResponseHeaders(b.headers()...),
+		serr.WithExtraDetailsForLogging(
+			serr.KVPair{Key: "backpressure", Value: b.Source},
+			serr.KVPair{Key: "retryAfter", Value: b.RetryAfter.String()},
+		),
+		serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+	), log)
+}
+
+func (b Backpressure) headers() []serr.KVPair {
+	retryAfter := strconv.Itoa(retryAfterSeconds(b.RetryAfter))
+	return []serr.KVPair{
+		{Key: "Retry-After", Value: retryAfter},
+		{Key: "RateLimit-Limit", Value: strconv.Itoa(b.Limit)},
+		{Key: "RateLimit-Remaining", Value: strconv.Itoa(b.Remaining)},
+		{Key: "RateLimit-Reset", Value: retryAfter},
+	}
+}
+
+// retryAfterSeconds the delay in whole seconds, rounded up so clients don't retry too early, and at least a second
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Max(1, math.Ceil(d.Seconds())))
+}
+
+// averageLatency the exponentially weighted average of the latencies
+func averageLatency(average time.Duration, latency time.Duration) time.Duration {
+	if average == 0 {
+		return latency
+	}
+	return time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(average))
+}
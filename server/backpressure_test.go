@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestBackpressureHeaders(t *testing.T) {
+	b := Backpressure{Source: BackpressureHandlerConcurrency, Limit: 4, RetryAfter: 1500 * time.Millisecond}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/reports", nil)
+	rejectRequest(c, handlerConcurrencyExceeded, b, zap.NewNop().Sugar())
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"), "delays are rounded up")
+	assert.Equal(t, "4", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, []Backpressure{b}, BackpressureOf(c.Request.Context()))
+
+	assert.Equal(t, 1, retryAfterSeconds(0), "clients wait at least a second")
+	assert.Equal(t, 100*time.Millisecond, averageLatency(0, 100*time.Millisecond))
+	assert.Equal(t, 180*time.Millisecond, averageLatency(200*time.Millisecond, 100*time.Millisecond))
+}
+
+func TestBackpressureOfAdmittedRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().GaugeWithTags(gomock.Any(), gomock.Any()).AnyTimes().Return(tally.NoopScope.Gauge(""))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().Return(tally.NoopScope.Counter(""))
+	limiter, err := newConcurrencyLimiter("http", ConcurrencyLimitConfiguration{Enabled: true, InitialLimit: 5}, ms, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	limits := newHandlerLimits(ms, zap.NewNop().Sugar())
+
+	var admitted []Backpressure
+	g := gin.New()
+	g.Use(limiter.middleware())
+	g.GET("/reports", limits.wrap(&handlerDTO{Path: "/reports", Method: http.MethodGet, MaxConcurrent: 2}, func(c *gin.Context) {
+		admitted = BackpressureOf(c.Request.Context())
+		c.Status(http.StatusOK)
+	}))
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reports", nil))
+
+	assert.Equal(t, []Backpressure{
+		{Source: BackpressureConcurrencyLimit, Limit: 5, Remaining: 4},
+		{Source: BackpressureHandlerConcurrency, Limit: 2, Remaining: 1},
+	}, admitted)
+}
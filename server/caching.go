@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const updatedAtField = "UpdatedAt"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type (
+	// CachePolicy the caching policy of the successful responses of a handler, see HandlerConfig.Cache. Error responses are never given
+	// these directives, and Response.Headers take precedence over them.
+	//
+	//	HandlerConfig{
+	//		Path:   "/deployments/:id",
+	//		Method: http.MethodGet,
+	//		Cache:  &server.CachePolicy{MaxAge: time.Minute, Private: true, LastModified: true},
+	//	}
+	CachePolicy struct {
+		// MaxAge how long the response may be reused, sent as max-age
+		MaxAge time.Duration
+		// Public the response may be stored by shared caches such as CDNs, even if the request was authenticated
+		Public bool
+		// Private the response may only be stored by the caller's own cache, as it is specific to the caller
+		Private bool
+		// NoCache caches must revalidate the response with the server before reusing it
+		NoCache bool
+		// NoStore the response must not be stored at all, all other directives are ignored
+		NoStore bool
+		// MustRevalidate a stale response must not be reused without revalidating it
+		MustRevalidate bool
+		// LastModified sets the Last-Modified header from the response body, either the LastModifier implementation or the UpdatedAt
+		// time.Time field of a struct body, and answers GET and HEAD requests whose If-Modified-Since is not older with a 304
+		LastModified bool
+	}
+
+	// LastModifier a response body that knows when it last changed, see CachePolicy.LastModified
+	LastModifier interface {
+		LastModified() time.Time
+	}
+)
+
+// cacheControl the Cache-Control header of the policy, empty if it has no directives
+func (p *CachePolicy) cacheControl() string {
+	if p == nil {
+		return ""
+	}
+	if p.NoStore {
+		return "no-store"
+	}
+	var directives []string
+	switch {
+	case p.Private:
+		directives = append(directives, "private")
+	case p.Public:
+		directives = append(directives, "public")
+	}
+	if p.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if p.MaxAge > 0 {
+		directives = append(directives, "max-age="+strconv.FormatInt(int64(p.MaxAge/time.Second), 10))
+	}
+	if p.MustRevalidate {
+		directives = append(directives, "must-revalidate")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// applyCachePolicy sets the caching headers of a successful response, it returns true when the request can be answered with a 304
+func applyCachePolicy(header http.Header, request *http.Request, handler *handlerDTO, body any) bool {
+	if handler.CacheControl != "" {
+		header.Set("Cache-Control", handler.CacheControl)
+	}
+	if !handler.LastModified {
+		return false
+	}
+	modified, ok := lastModified(body)
+	if !ok {
+		return false
+	}
+	// HTTP dates only have a precision of seconds
+	modified = modified.UTC().Truncate(time.Second)
+	header.Set("Last-Modified", modified.Format(http.TimeFormat))
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+// lastModified when the body last changed, false if it doesn't say or has never been modified
+func lastModified(body any) (time.Time, bool) {
+	if m, ok := body.(LastModifier); ok {
+		t := m.LastModified()
+		return t, !t.IsZero()
+	}
+
+	v := reflect.ValueOf(body)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return time.Time{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return time.Time{}, false
+	}
+	field := v.FieldByName(updatedAtField)
+	for field.IsValid() && field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return time.Time{}, false
+		}
+		field = field.Elem()
+	}
+	if !field.IsValid() || field.Type() != timeType {
+		return time.Time{}, false
+	}
+	t := field.Interface().(time.Time)
+	return t, !t.IsZero()
+}
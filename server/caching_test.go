@@ -0,0 +1,140 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type (
+	cachedController struct {
+		updatedAt time.Time
+	}
+
+	cachedDeployment struct {
+		ID        string    `json:"id"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}
+)
+
+func (c cachedController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, _ Void) (*Response[cachedDeployment], serr.Error) {
+			return SimpleResponse(cachedDeployment{ID: "dep-1", UpdatedAt: c.updatedAt}), nil
+		}, HandlerConfig{
+			Path:       "/deployment",
+			Method:     http.MethodGet,
+			AuthOptOut: true,
+			Cache:      &CachePolicy{MaxAge: 90 * time.Second, Private: true, LastModified: true},
+		}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+			return nil, serr.NewSimpleError("boom", nil)
+		}, HandlerConfig{
+			Path:       "/error",
+			Method:     http.MethodGet,
+			AuthOptOut: true,
+			Cache:      &CachePolicy{MaxAge: time.Hour, Public: true},
+		}),
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	updatedAt := time.Date(2023, 6, 1, 12, 0, 0, 500, time.UTC)
+	controller := cachedController{updatedAt: updatedAt}
+	data := map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO{}
+	for _, h := range controller.Handlers() {
+		assert.NoError(t, configureHandler(h, controller, nil, zap.S(), nil, data))
+	}
+
+	serve := func(path string, ifModifiedSince time.Time) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, path, nil)
+		if !ifModifiedSince.IsZero() {
+			c.Request.Header.Set("If-Modified-Since", ifModifiedSince.Format(http.TimeFormat))
+		}
+		createMultiMimeTypeFn(data[handlerDTOKey{path: path, method: http.MethodGet}], zap.S(), nil)(c)
+		return w
+	}
+
+	w := serve("/deployment", time.Time{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "private, max-age=90", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "Thu, 01 Jun 2023 12:00:00 GMT", w.Header().Get("Last-Modified"))
+
+	w = serve("/deployment", updatedAt)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = serve("/deployment", updatedAt.Add(-time.Minute))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Body.String())
+
+	w = serve("/error", time.Time{})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"), "error responses aren't cached")
+}
+
+func TestCacheControl(t *testing.T) {
+	cases := map[string]struct {
+		policy   *CachePolicy
+		expected string
+	}{
+		"none":        {policy: nil, expected: ""},
+		"no store":    {policy: &CachePolicy{NoStore: true, MaxAge: time.Minute, Public: true}, expected: "no-store"},
+		"public":      {policy: &CachePolicy{Public: true, MaxAge: 10 * time.Minute}, expected: "public, max-age=600"},
+		"revalidated": {policy: &CachePolicy{Private: true, NoCache: true, MustRevalidate: true}, expected: "private, no-cache, must-revalidate"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, c.policy.cacheControl())
+		})
+	}
+}
+
+type modifiedBody struct{}
+
+func (modifiedBody) LastModified() time.Time {
+	return time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestLastModified(t *testing.T) {
+	updatedAt := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	m, ok := lastModified(modifiedBody{})
+	assert.True(t, ok)
+	assert.Equal(t, 2023, m.Year())
+
+	m, ok = lastModified(&struct{ UpdatedAt *time.Time }{UpdatedAt: &updatedAt})
+	assert.True(t, ok)
+	assert.Equal(t, updatedAt, m)
+
+	_, ok = lastModified(struct{ UpdatedAt *time.Time }{})
+	assert.False(t, ok)
+	_, ok = lastModified(struct{ UpdatedAt string }{UpdatedAt: "yesterday"})
+	assert.False(t, ok)
+	_, ok = lastModified([]string{"a"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/iam/scopes"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorResponseCauseChain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	causes := []serr.Cause{
+		{Code: "DEPLOYMENT_FAILED", Component: "deployments-api", Message: "failed to start the deployment"},
+		{Code: "TARGET_UNREACHABLE", Component: "deploy-engine", Message: "failed to load the deployment target"},
+	}
+
+	serve := func(principalScopes ...string) (serr.ResponseContract, *observer.ObservedLogs) {
+		core, logs := observer.New(zapcore.ErrorLevel)
+		g := gin.New()
+		g.GET("/deployments/:id", func(c *gin.Context) {
+			c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{Type: iam.User, OrgId: "org-1", Scopes: principalScopes}))
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(serr.APIError{
+				Message:        "Failed to start the deployment",
+				HttpStatusCode: http.StatusBadGateway,
+			}, serr.WithCause(serr.WrapCauses(errors.New("deploy-engine responded 503"), causes[1])), serr.WithCauseChain(causes[0])), zap.New(core).Sugar())
+		})
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deployments/dep-1", nil))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		var contract serr.ResponseContract
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &contract))
+		return contract, logs
+	}
+
+	contract, logs := serve()
+	assert.Empty(t, contract.Causes, "principals without the debug scope don't get the cause chain")
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, causes, logs.All()[0].ContextMap()["causes"], "the cause chain is always logged")
+
+	contract, _ = serve(scopes.ScopeDebug)
+	assert.Equal(t, causes, contract.Causes)
+}
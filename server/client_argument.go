@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/ctxutil"
+	"net"
+)
+
+var geoIPReaderKey = ctxutil.NewKey[GeoIPReader]("server.geoIPReader")
+
+type (
+	// GeoIPReader looks up the country of an IP address. Provide one to the fx graph to fill in ClientArgument.Country,
+	// i.e. a wrapper of a MaxMind GeoLite2 Country database:
+	//
+	//	func (r mmdbReader) Country(ip net.IP) (string, error) {
+	//		record, err := r.db.Country(ip)
+	//		if err != nil {
+	//			return "", err
+	//		}
+	//		return record.Country.IsoCode, nil
+	//	}
+	GeoIPReader interface {
+		// Country the ISO 3166-1 alpha-2 code of the country of ip, empty when it is unknown
+		Country(ip net.IP) (string, error)
+	}
+
+	// ClientArgument a HandlerArgument with telemetry about the caller, for audit and analytics handlers:
+	//
+	//	New1ArgHandler(func(ctx context.Context, _ Void, client ClientArgument) (*Response[Void], serr.Error) {
+	//		audit.Record(ctx, client.IP, client.UserAgent.Client)
+	//		...
+	//	}, HandlerConfig{...})
+	ClientArgument struct {
+		// IP the address of the client, see ClientIPConfiguration
+		IP string `json:"ip"`
+		// UserAgent the parsed User-Agent header
+		UserAgent UserAgent `json:"userAgent"`
+		// Country the ISO country code of the IP, empty when there is no GeoIPReader or the country is unknown
+		Country string `json:"country,omitempty"`
+	}
+)
+
+func (ClientArgument) Source() ArgumentDataSource {
+	return clientContextSource
+}
+
+// ExtractClientFromContext resolves the ClientArgument of the request in ctx
+func ExtractClientFromContext(ctx context.Context) (*ClientArgument, bool) {
+	details, err := ExtractRequestDetailsFromContext(ctx)
+	if err != nil {
+		return nil, false
+	}
+
+	client := &ClientArgument{
+		IP:        details.ClientIP,
+		UserAgent: ParseUserAgent(firstHeader(details.Headers, "User-Agent")),
+	}
+	if reader, ok := geoIPReaderKey.Value(ctx); ok && reader != nil {
+		if ip := net.ParseIP(client.IP); ip != nil {
+			// the country is best effort, a failed lookup is the same as an unknown country
+			client.Country, _ = reader.Country(ip)
+		}
+	}
+	return client, true
+}
+
+func firstHeader(headers map[string][]string, name string) string {
+	if values := headers[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
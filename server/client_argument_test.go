@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGeoIPReader map[string]string
+
+func (f fakeGeoIPReader) Country(ip net.IP) (string, error) {
+	country, ok := f[ip.String()]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return country, nil
+}
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected UserAgent
+	}{
+		{
+			header:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46",
+			expected: UserAgent{Client: "Edge", Version: "118.0.2088.46", OS: "Windows"},
+		},
+		{
+			header:   "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36",
+			expected: UserAgent{Client: "Chrome", Version: "118.0.0.0", OS: "macOS"},
+		},
+		{
+			header:   "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/119.0",
+			expected: UserAgent{Client: "Firefox", Version: "119.0", OS: "Linux"},
+		},
+		{
+			header:   "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+			expected: UserAgent{Client: "Safari", Version: "17.0", OS: "iOS", Mobile: true},
+		},
+		{
+			header:   "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Mobile Safari/537.36",
+			expected: UserAgent{Client: "Chrome", Version: "118.0.0.0", OS: "Android", Mobile: true},
+		},
+		{
+			header:   "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			expected: UserAgent{Bot: true},
+		},
+		{
+			header:   "curl/8.1.2",
+			expected: UserAgent{Client: "curl", Version: "8.1.2"},
+		},
+		{
+			header:   "armory-cli",
+			expected: UserAgent{Client: "armory-cli"},
+		},
+		{
+			header:   "",
+			expected: UserAgent{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			c.expected.Raw = c.header
+			assert.Equal(t, c.expected, ParseUserAgent(c.header))
+		})
+	}
+}
+
+func TestExtractClientFromContext(t *testing.T) {
+	ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{
+		ClientIP: "198.51.100.7",
+		Headers:  map[string][]string{"User-Agent": {"curl/8.1.2"}},
+	})
+
+	client, ok := ExtractClientFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "198.51.100.7", client.IP)
+	assert.Equal(t, "curl", client.UserAgent.Client)
+	assert.Empty(t, client.Country)
+
+	client, ok = ExtractClientFromContext(geoIPReaderKey.WithValue(ctx, GeoIPReader(fakeGeoIPReader{"198.51.100.7": "DE"})))
+	assert.True(t, ok)
+	assert.Equal(t, "DE", client.Country)
+
+	client, ok = ExtractClientFromContext(geoIPReaderKey.WithValue(ctx, GeoIPReader(fakeGeoIPReader{})))
+	assert.True(t, ok)
+	assert.Empty(t, client.Country, "failed lookups leave the country empty")
+
+	_, ok = ExtractClientFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestExtractClientArgument(t *testing.T) {
+	ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{
+		ClientIP: "198.51.100.7",
+		Headers:  map[string][]string{"User-Agent": {"curl/8.1.2"}},
+	})
+	client, err := extractHandlerArgumentFromContextInternal[ClientArgument](ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "198.51.100.7", client.IP)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ErrClientDisconnected the reason the context of a request is done when its client went away before it was answered, see DoneReason
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// connectionContextKey the context of the request as net/http created it, which is only canceled when the client goes away
+var connectionContextKey = ctxutil.NewKey[context.Context]("server.connectionContext")
+
+// ClientDisconnected whether the client of the request went away, as opposed to the context being done because a deadline passed or
+// it was canceled by the handler. Once it has, the framework doesn't write a response: errors are logged at debug level rather than
+// as errors and the request is recorded with StatusClientClosedRequest, so aborted clients don't show up as 500s
+func ClientDisconnected(ctx context.Context) bool {
+	conn, ok := connectionContextKey.Value(ctx)
+	return ok && errors.Is(conn.Err(), context.Canceled)
+}
+
+// DoneReason why the context of a request is done, ErrClientDisconnected when the client went away, otherwise ctx.Err() such as
+// context.DeadlineExceeded. Nil while it isn't done. Handlers doing expensive work can stop early:
+//
+//	select {
+//	case <-ctx.Done():
+//		if errors.Is(server.DoneReason(ctx), server.ErrClientDisconnected) {
+//			c.log.Debugw("Report abandoned by its requester", "reportId", id)
+//		}
+//		return nil, serr.NewSimpleError("Failed to generate the report", server.DoneReason(ctx))
+//	case report := <-reports:
+//		...
+//	}
+func DoneReason(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	if ClientDisconnected(ctx) {
+		return ErrClientDisconnected
+	}
+	return ctx.Err()
+}
+
+// trackClientDisconnects keeps the context of the request so ClientDisconnected can tell the client going away apart from the contexts
+// derived from it being done, it must be the first middleware
+func trackClientDisconnects(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(connectionContextKey.WithValue(ctx, ctx))
+}
+
+// abortIfClientDisconnected records the request with StatusClientClosedRequest without writing a response when its client went away,
+// apiErr if any is logged at debug level
+func abortIfClientDisconnected(c *gin.Context, apiErr serr.Error, log *zap.SugaredLogger) bool {
+	if !ClientDisconnected(c.Request.Context()) {
+		return false
+	}
+	fields := []any{"method", c.Request.Method, "uri", c.FullPath()}
+	if apiErr != nil {
+		fields = append(fields, "status", serr.StatusCode(apiErr), "error", apiErr.Message(), "cause", apiErr.Cause())
+	}
+	log.Debugw("The client disconnected before it was answered", fields...)
+	c.Status(StatusClientClosedRequest)
+	c.Abort()
+	return true
+}
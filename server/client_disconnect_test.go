@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClientDisconnects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := zap.New(core).Sugar()
+
+	var reason error
+	g := gin.New()
+	g.Use(trackClientDisconnects)
+	g.GET("/reports", func(c *gin.Context) {
+		// the work of the handler outlives its client
+		disconnect := c.Request.Context().Value(disconnectKey{}).(context.CancelFunc)
+		disconnect()
+		reason = DoneReason(c.Request.Context())
+		writeAndLogApiErrorThenAbort(c, serr.NewSimpleError("Failed to generate the report", reason), log)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports", nil).WithContext(context.WithValue(ctx, disconnectKey{}, cancel)))
+
+	assert.ErrorIs(t, reason, ErrClientDisconnected)
+	assert.Equal(t, StatusClientClosedRequest, rec.Code)
+	assert.Empty(t, rec.Body.String(), "no response is written to a client that went away")
+	assert.Equal(t, 1, logs.FilterLevelExact(zapcore.DebugLevel).FilterMessage("The client disconnected before it was answered").Len())
+	assert.Zero(t, logs.FilterLevelExact(zapcore.ErrorLevel).Len())
+}
+
+type disconnectKey struct{}
+
+func TestDoneReason(t *testing.T) {
+	g := gin.New()
+	g.Use(trackClientDisconnects)
+	var reason error
+	var disconnected bool
+	g.GET("/reports", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Nanosecond)
+		defer cancel()
+		<-ctx.Done()
+		reason, disconnected = DoneReason(ctx), ClientDisconnected(ctx)
+	})
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reports", nil))
+
+	assert.True(t, errors.Is(reason, context.DeadlineExceeded), "timeouts are told apart from disconnects")
+	assert.False(t, disconnected)
+	assert.Nil(t, DoneReason(context.Background()))
+	assert.False(t, ClientDisconnected(context.Background()))
+}
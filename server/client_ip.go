@@ -0,0 +1,172 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	forwardedForHeader = "X-Forwarded-For"
+	realIPHeader       = "X-Real-Ip"
+	forwardedHeader    = "Forwarded"
+)
+
+var clientIPKey = ctxutil.NewKey[string]("server.clientIP")
+
+type (
+	// ClientIPConfiguration configures how the IP address of the client is derived, see RequestDetails.ClientIP.
+	// Forwarding headers are only believed when the request arrived from a trusted proxy, so callers can't spoof their address
+	ClientIPConfiguration struct {
+		// TrustedProxies the IPs or CIDRs of the load balancers and proxies in front of the server, defaults to none, in which case the client IP
+		// is always the address of the connection
+		TrustedProxies []string
+		// Headers the forwarding headers consulted in order, the first that yields an address wins. Defaults to X-Forwarded-For, X-Real-Ip, Forwarded
+		Headers []string
+		// geoIP the GeoIPReader provided to the server if any, see ClientArgument.Country
+		geoIP GeoIPReader
+	}
+
+	// clientIPResolver derives the client IP by walking the forwarding chain from the right, skipping trusted proxies
+	clientIPResolver struct {
+		trusted []*net.IPNet
+		headers []string
+		geoIP   GeoIPReader
+	}
+)
+
+func (c ClientIPConfiguration) withDefaults() ClientIPConfiguration {
+	if len(c.Headers) == 0 {
+		c.Headers = []string{forwardedForHeader, realIPHeader, forwardedHeader}
+	}
+	return c
+}
+
+func newClientIPResolver(config ClientIPConfiguration) (*clientIPResolver, error) {
+	config = config.withDefaults()
+	r := &clientIPResolver{headers: config.Headers, geoIP: config.geoIP}
+	for _, proxy := range config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// middleware adds the client IP, the base URL for Links, and the GeoIPReader for ClientArgument, to the request context
+func (r *clientIPResolver) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := clientIPKey.WithValue(c.Request.Context(), r.resolve(c.Request))
+		peer := parseIP(c.Request.RemoteAddr)
+		ctx = baseURLKey.WithValue(ctx, requestBaseURL(c.Request, peer != nil && r.isTrusted(peer)))
+		if r.geoIP != nil {
+			ctx = geoIPReaderKey.WithValue(ctx, r.geoIP)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+func (r *clientIPResolver) resolve(req *http.Request) string {
+	peer := parseIP(req.RemoteAddr)
+	if peer == nil {
+		return req.RemoteAddr
+	}
+	if !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	for _, header := range r.headers {
+		var chain []string
+		if http.CanonicalHeaderKey(header) == forwardedHeader {
+			chain = forwardedFor(req.Header.Values(header))
+		} else {
+			for _, value := range req.Header.Values(header) {
+				chain = append(chain, strings.Split(value, ",")...)
+			}
+		}
+		if ip := r.fromChain(chain); ip != nil {
+			return ip.String()
+		}
+	}
+	return peer.String()
+}
+
+// fromChain returns the right most address that isn't a trusted proxy, or the left most when they all are
+func (r *clientIPResolver) fromChain(chain []string) net.IP {
+	var leftmost net.IP
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseIP(chain[i])
+		if ip == nil {
+			// a malformed hop means everything to its left can't be trusted either
+			return leftmost
+		}
+		if !r.isTrusted(ip) {
+			return ip
+		}
+		leftmost = ip
+	}
+	return leftmost
+}
+
+func (r *clientIPResolver) isTrusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor extracts the for= addresses of RFC 7239 Forwarded header values
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseIP parses an address with an optional port, IPv6 addresses may be bracketed
+func parseIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
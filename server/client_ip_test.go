@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := newClientIPResolver(ClientIPConfiguration{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{name: "untrusted peers can't spoof their address", remoteAddr: "203.0.113.9:4000", headers: map[string]string{forwardedForHeader: "1.1.1.1"}, expected: "203.0.113.9"},
+		{name: "trusted peer without headers", remoteAddr: "10.1.2.3:4000", expected: "10.1.2.3"},
+		{name: "right most untrusted hop", remoteAddr: "10.1.2.3:4000", headers: map[string]string{forwardedForHeader: "6.6.6.6, 198.51.100.7, 10.0.0.5"}, expected: "198.51.100.7"},
+		{name: "all hops trusted", remoteAddr: "10.1.2.3:4000", headers: map[string]string{forwardedForHeader: "10.9.9.9, 192.168.1.1"}, expected: "10.9.9.9"},
+		{name: "real ip header", remoteAddr: "192.168.1.1:4000", headers: map[string]string{realIPHeader: "198.51.100.7"}, expected: "198.51.100.7"},
+		{name: "forwarded header", remoteAddr: "10.1.2.3:4000", headers: map[string]string{forwardedHeader: `for=198.51.100.7;proto=https, for="[2001:db8::1]:4711";by=10.0.0.1`}, expected: "2001:db8::1"},
+		{name: "malformed hop", remoteAddr: "10.1.2.3:4000", headers: map[string]string{forwardedForHeader: "198.51.100.7, unknown, 10.0.0.5"}, expected: "10.0.0.5"},
+		{name: "ipv6 peer", remoteAddr: "[fd00::1]:4000", headers: map[string]string{forwardedForHeader: "2001:db8::2"}, expected: "2001:db8::2"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = c.remoteAddr
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, c.expected, resolver.resolve(req))
+		})
+	}
+
+	_, err = newClientIPResolver(ClientIPConfiguration{TrustedProxies: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+}
+
+func TestClientIPHeaderOrder(t *testing.T) {
+	resolver, err := newClientIPResolver(ClientIPConfiguration{TrustedProxies: []string{"10.0.0.0/8"}, Headers: []string{realIPHeader, forwardedForHeader}})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:4000"
+	req.Header.Set(forwardedForHeader, "198.51.100.7")
+	req.Header.Set(realIPHeader, "203.0.113.9")
+	assert.Equal(t, "203.0.113.9", resolver.resolve(req))
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// CoalescedHeader is set on responses that were shared from a concurrent identical request instead of running the handler
+	CoalescedHeader = "X-Coalesced"
+
+	coalescedMetric          = "http.server.requests.coalesced"
+	coalescingOutcomeLeader  = "leader"
+	coalescingOutcomeShared  = "coalesced"
+	coalescingOutcomeRetried = "retried"
+)
+
+type (
+	// CoalescingConfiguration coalesces identical concurrent GET requests, same route, query and caller org and env, into a single run of the
+	// handler whose response is shared with every waiting request. This protects downstreams from thundering herds, i.e. when a cache expires.
+	// Handlers with principal, client or header arguments answer each caller differently and are never coalesced. Handlers that read the
+	// principal or headers such as Accept-Language from the context instead must opt out with HandlerConfig.DisableCoalescing
+	CoalescingConfiguration struct {
+		// Enabled coalesces the requests of every GET handler that doesn't opt out
+		Enabled bool
+	}
+
+	// coalescer runs a handler once for concurrent identical requests
+	coalescer struct {
+		metrics metrics.MetricsSvc
+		mu      sync.Mutex
+		calls   map[string]*coalescedCall
+	}
+
+	// coalescedCall the run of a handler that identical requests wait on, the response is set before done is closed
+	coalescedCall struct {
+		done     chan struct{}
+		response *coalescedResponse
+	}
+
+	coalescedResponse struct {
+		status int
+		header http.Header
+		body   []byte
+	}
+
+	// capturingWriter keeps a copy of the body written by the handler
+	capturingWriter struct {
+		gin.ResponseWriter
+		body bytes.Buffer
+	}
+)
+
+func newCoalescer(config CoalescingConfiguration, ms metrics.MetricsSvc) *coalescer {
+	if !config.Enabled {
+		return nil
+	}
+	return &coalescer{
+		metrics: ms,
+		calls:   make(map[string]*coalescedCall),
+	}
+}
+
+// wrap returns a handler func that shares the response of next between concurrent identical GET requests
+func (co *coalescer) wrap(handler *handlerDTO, next gin.HandlerFunc) gin.HandlerFunc {
+	// the key only includes the org and env of the caller, so handlers that depend on anything else about the caller can't share responses
+	if co == nil || handler.DisableCoalescing || handler.Method != http.MethodGet || handler.types.callerSpecific() {
+		return next
+	}
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		// callers that aren't authorized run the handler themselves to be answered with their own error
+		if !handler.AuthOptOut && authorizeRequest(ctx, handler) != nil {
+			next(c)
+			return
+		}
+
+		key := coalescingKey(ctx, handler, c.Request)
+		co.mu.Lock()
+		call, waiting := co.calls[key]
+		if !waiting {
+			call = &coalescedCall{done: make(chan struct{})}
+			co.calls[key] = call
+		}
+		co.mu.Unlock()
+
+		if !waiting {
+			co.record(handler, coalescingOutcomeLeader)
+			co.lead(c, key, call, next)
+			return
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			c.Abort()
+			return
+		}
+		if call.response == nil {
+			// the leader failed in a way that is specific to it, such as its caller going away
+			co.record(handler, coalescingOutcomeRetried)
+			next(c)
+			return
+		}
+		co.record(handler, coalescingOutcomeShared)
+		call.response.write(c)
+	}
+}
+
+// lead runs next for every request waiting on the call, sharing its response unless the request was canceled or the handler panicked
+func (co *coalescer) lead(c *gin.Context, key string, call *coalescedCall, next gin.HandlerFunc) {
+	writer := &capturingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	defer func() {
+		c.Writer = writer.ResponseWriter
+		co.mu.Lock()
+		delete(co.calls, key)
+		co.mu.Unlock()
+		close(call.done)
+	}()
+
+	next(c)
+
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	call.response = &coalescedResponse{
+		status: writer.Status(),
+		header: writer.Header().Clone(),
+		body:   writer.body.Bytes(),
+	}
+}
+
+func (co *coalescer) record(handler *handlerDTO, outcome string) {
+	if co.metrics == nil {
+		return
+	}
+	co.metrics.CounterWithTags(coalescedMetric, map[string]string{
+		"uri":     handler.Path,
+		"method":  handler.Method,
+		"outcome": outcome,
+	}).Inc(1)
+}
+
+// write answers the request with the shared response, headers the request already has, such as those of middlewares, are kept
+func (r *coalescedResponse) write(c *gin.Context) {
+	header := c.Writer.Header()
+	for name, values := range r.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	header.Set(CoalescedHeader, "true")
+	c.Status(r.status)
+	_, _ = c.Writer.Write(r.body)
+	c.Abort()
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// coalescingKey scopes requests to the caller's org and env, the route and the content type of the handler
+func coalescingKey(ctx context.Context, handler *handlerDTO, request *http.Request) string {
+	org, env := unknownCallerOrg, ""
+	if p, err := iam.ExtractPrincipalFromContext(ctx); err == nil && p.OrgId != "" {
+		org, env = p.OrgId, p.EnvId
+	}
+	return strings.Join([]string{org, env, handler.Method, handler.Path, handler.Produces, request.URL.RequestURI()}, "|")
+}
+
+// callerSpecific whether any argument of the handler is bound from the principal, the client or the headers of the request
+func (t handlerTypes) callerSpecific() bool {
+	for _, argument := range t.arguments {
+		switch argument.source {
+		case HeaderContextSource, authContextSource, clientContextSource:
+			return true
+		}
+	}
+	return false
+}
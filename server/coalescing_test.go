@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+)
+
+func TestCoalescer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(coalescedMetric, gomock.Any()).DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	}).AnyTimes()
+
+	var authorized sync.WaitGroup
+	co := newCoalescer(CoalescingConfiguration{Enabled: true}, ms)
+	handler := &handlerDTO{Path: "/deployments", Method: http.MethodGet, AuthZValidators: []AuthZValidatorV2Fn{
+		func(_ context.Context, p *iam.ArmoryCloudPrincipal) (string, bool) {
+			if p.Name == "intruder" {
+				return "not allowed", false
+			}
+			authorized.Done()
+			return "", true
+		},
+	}}
+
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	g := gin.New()
+	g.GET("/deployments", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: c.GetHeader("org"), Name: c.GetHeader("name")}))
+		c.Header("X-Request-Id", c.GetHeader("name"))
+	}, co.wrap(handler, func(c *gin.Context) {
+		if c.GetHeader("name") == "intruder" {
+			c.String(http.StatusForbidden, "not allowed")
+			return
+		}
+		calls.Add(1)
+		if c.GetHeader("block") != "" {
+			close(started)
+			<-release
+		}
+		c.Header("ETag", "v1")
+		c.String(http.StatusOK, "deployments of %s", c.GetHeader("org"))
+	}))
+
+	serve := func(org string, name string, block bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/deployments?status=ACTIVE", nil)
+		req.Header.Set("org", org)
+		req.Header.Set("name", name)
+		if block {
+			req.Header.Set("block", "true")
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	authorized.Add(4)
+	responses := make([]*httptest.ResponseRecorder, 4)
+	var served sync.WaitGroup
+	served.Add(4)
+	go func() {
+		defer served.Done()
+		responses[0] = serve("org-1", "leader", true)
+	}()
+	<-started
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			defer served.Done()
+			// waiters from another org aren't coalesced with the leader
+			if i == 3 {
+				responses[i] = serve("org-2", "other-org", false)
+				return
+			}
+			responses[i] = serve("org-1", "waiter", false)
+		}(i)
+	}
+	authorized.Wait()
+	// give the waiters a moment to join the leader after being authorized
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	served.Wait()
+
+	assert.Equal(t, int32(2), calls.Load())
+	for i, w := range responses[:3] {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "deployments of org-1", w.Body.String())
+		assert.Equal(t, "v1", w.Header().Get("ETag"))
+		assert.Equal(t, i != 0, w.Header().Get(CoalescedHeader) == "true")
+	}
+	assert.Equal(t, "waiter", responses[1].Header().Get("X-Request-Id"), "headers set before the handler are kept")
+	assert.Equal(t, "deployments of org-2", responses[3].Body.String())
+
+	counts := map[string]int64{}
+	for _, counter := range scope.Snapshot().Counters() {
+		counts[counter.Tags()["outcome"]] += counter.Value()
+	}
+	assert.Equal(t, map[string]int64{coalescingOutcomeLeader: 2, coalescingOutcomeShared: 2}, counts)
+
+	assert.Equal(t, http.StatusForbidden, serve("org-1", "intruder", false).Code, "unauthorized callers get their own error")
+	assert.Empty(t, co.calls, "calls are forgotten once answered")
+}
+
+func TestCoalescerSkipsHandlers(t *testing.T) {
+	co := newCoalescer(CoalescingConfiguration{Enabled: true}, nil)
+	next := func(*gin.Context) {}
+	pointer := func(fn gin.HandlerFunc) uintptr { return reflect.ValueOf(fn).Pointer() }
+
+	assert.NotEqual(t, pointer(next), pointer(co.wrap(&handlerDTO{Method: http.MethodGet}, next)))
+	assert.Equal(t, pointer(next), pointer(co.wrap(&handlerDTO{Method: http.MethodPost}, next)), "only GET requests are coalesced")
+	assert.Equal(t, pointer(next), pointer(co.wrap(&handlerDTO{Method: http.MethodGet, DisableCoalescing: true}, next)))
+	headers := handlerTypes{arguments: []argumentType{{source: QueryContextSource}, {source: HeaderContextSource}}}
+	assert.Equal(t, pointer(next), pointer(co.wrap(&handlerDTO{Method: http.MethodGet, types: headers}, next)), "handlers with header arguments aren't coalesced")
+	client := handlerTypes{arguments: []argumentType{{source: clientContextSource}}}
+	assert.Equal(t, pointer(next), pointer(co.wrap(&handlerDTO{Method: http.MethodGet, types: client}, next)), "handlers with client arguments aren't coalesced")
+	assert.Nil(t, newCoalescer(CoalescingConfiguration{}, nil), "coalescing is disabled by default")
+}
+
+func TestCoalescerPrincipalArguments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	co := newCoalescer(CoalescingConfiguration{Enabled: true}, nil)
+	handler := &handlerDTO{Path: "/me", Method: http.MethodGet, types: handlerTypes{arguments: []argumentType{{source: authContextSource}}}}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	g := gin.New()
+	g.GET("/me", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: "org-1", Name: c.GetHeader("name")}))
+	}, co.wrap(handler, func(c *gin.Context) {
+		principal, _ := iam.ExtractPrincipalFromContext(c.Request.Context())
+		if principal.Name == "alice" {
+			close(started)
+			<-release
+		}
+		c.String(http.StatusOK, "profile of %s", principal.Name)
+	}))
+	serve := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("name", name)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	alice, bob := make(chan *httptest.ResponseRecorder, 1), make(chan *httptest.ResponseRecorder, 1)
+	go func() { alice <- serve("alice") }()
+	<-started
+	go func() { bob <- serve("bob") }()
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-bob:
+		close(release)
+	case <-time.After(time.Second):
+		// bob is waiting on the call of alice
+		close(release)
+		w = <-bob
+	}
+
+	assert.Equal(t, "profile of bob", w.Body.String(), "principals of the same org don't share the responses of handlers that take the principal")
+	assert.Empty(t, w.Header().Get(CoalescedHeader))
+	assert.Equal(t, "profile of alice", (<-alice).Body.String())
+}
+
+func TestCoalescingKey(t *testing.T) {
+	handler := &handlerDTO{Method: http.MethodGet, Path: "/deployments", Produces: "application/json"}
+	request := httptest.NewRequest(http.MethodGet, "/deployments?status=ACTIVE", nil)
+	keyOf := func(env string) string {
+		return coalescingKey(iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{OrgId: "org-1", EnvId: env}), handler, request)
+	}
+	assert.Equal(t, "org-1|env-1|GET|/deployments|application/json|/deployments?status=ACTIVE", keyOf("env-1"))
+	assert.NotEqual(t, keyOf("env-1"), keyOf("env-2"), "the envs of an org don't share responses")
+}
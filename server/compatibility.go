@@ -0,0 +1,127 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+)
+
+const (
+	legacyNameMetric  = "http.server.requests.legacy"
+	legacyKindQuery   = "query"
+	legacyKindHeader  = "header"
+	unknownCallerOrg  = "unknown"
+	legacyWarnMessage = "request used a deprecated %s name %q, it has been mapped to %q. Callers should migrate before it is removed"
+)
+
+// compatibilityShims rewrites legacy query parameter and header names to their replacements before a handler runs
+type compatibilityShims struct {
+	path            string
+	queryParameters map[string]string
+	headers         map[string]string
+	metrics         metrics.MetricsSvc
+	log             *zap.SugaredLogger
+	// warned tracks the org/kind/name combinations that have already been logged, so each caller is only warned once
+	warned sync.Map
+}
+
+func newCompatibilityShims(handler *handlerDTO, ms metrics.MetricsSvc, log *zap.SugaredLogger) *compatibilityShims {
+	if len(handler.LegacyQueryParams) == 0 && len(handler.LegacyHeaders) == 0 {
+		return nil
+	}
+	return &compatibilityShims{
+		path:            handler.Path,
+		queryParameters: handler.LegacyQueryParams,
+		headers:         handler.LegacyHeaders,
+		metrics:         ms,
+		log:             log,
+	}
+}
+
+// wrap returns a handler func that applies the shims before calling next
+func (s *compatibilityShims) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if s == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		s.apply(c)
+		next(c)
+	}
+}
+
+func (s *compatibilityShims) apply(c *gin.Context) {
+	if len(s.queryParameters) > 0 {
+		query := c.Request.URL.Query()
+		rewritten := false
+		for legacy, replacement := range s.queryParameters {
+			values, ok := query[legacy]
+			if !ok {
+				continue
+			}
+			// the replacement wins when a caller sends both names
+			if _, exists := query[replacement]; !exists {
+				query[replacement] = values
+			}
+			delete(query, legacy)
+			rewritten = true
+			s.record(c, legacyKindQuery, legacy, replacement)
+		}
+		if rewritten {
+			c.Request.URL.RawQuery = query.Encode()
+		}
+	}
+
+	for legacy, replacement := range s.headers {
+		values := c.Request.Header.Values(legacy)
+		if len(values) == 0 {
+			continue
+		}
+		if len(c.Request.Header.Values(replacement)) == 0 {
+			for _, v := range values {
+				c.Request.Header.Add(replacement, v)
+			}
+		}
+		c.Request.Header.Del(legacy)
+		s.record(c, legacyKindHeader, http.CanonicalHeaderKey(legacy), http.CanonicalHeaderKey(replacement))
+	}
+}
+
+func (s *compatibilityShims) record(c *gin.Context, kind string, legacy string, replacement string) {
+	org := unknownCallerOrg
+	if p, err := iam.ExtractPrincipalFromContext(c.Request.Context()); err == nil && p.OrgId != "" {
+		org = p.OrgId
+	}
+
+	if s.metrics != nil {
+		s.metrics.CounterWithTags(legacyNameMetric, map[string]string{
+			"uri":   s.path,
+			"kind":  kind,
+			"name":  legacy,
+			"orgId": org,
+		}).Inc(1)
+	}
+
+	if _, alreadyWarned := s.warned.LoadOrStore(fmt.Sprintf("%s|%s|%s", org, kind, legacy), struct{}{}); !alreadyWarned {
+		s.log.With("uri", s.path, "orgId", org).Warnf(legacyWarnMessage, kind, legacy, replacement)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCompatibilityShims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(legacyNameMetric, gomock.Any()).DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	}).AnyTimes()
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	shims := newCompatibilityShims(&handlerDTO{
+		Path:              "/deployments",
+		LegacyQueryParams: map[string]string{"env": "environmentId"},
+		LegacyHeaders:     map[string]string{"X-Armory-Env": "X-Environment-Id"},
+	}, ms, zap.New(core).Sugar())
+
+	var query, header string
+	g := gin.New()
+	g.GET("/deployments", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: c.GetHeader("org")}))
+	}, shims.wrap(func(c *gin.Context) {
+		query = c.Request.URL.Query().Get("environmentId") + "|" + c.Request.URL.Query().Get("env")
+		header = c.GetHeader("X-Environment-Id") + "|" + c.GetHeader("X-Armory-Env")
+	}))
+
+	serve := func(target string, headers map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		g.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("/deployments?env=dev", map[string]string{"X-Armory-Env": "dev", "org": "org-1"})
+	assert.Equal(t, "dev|", query)
+	assert.Equal(t, "dev|", header)
+
+	serve("/deployments?env=dev&environmentId=prod", map[string]string{"X-Environment-Id": "prod", "X-Armory-Env": "dev", "org": "org-1"})
+	assert.Equal(t, "prod|", query, "the new name wins when both are sent")
+	assert.Equal(t, "prod|", header)
+
+	serve("/deployments?env=dev", map[string]string{"org": "org-2"})
+	serve("/deployments?environmentId=dev", map[string]string{"org": "org-3"})
+
+	assert.Equal(t, 3, logs.Len(), "each org is warned once per legacy name")
+
+	counters := scope.Snapshot().Counters()
+	var total int64
+	for _, c := range counters {
+		total += c.Value()
+	}
+	assert.Equal(t, int64(5), total)
+	assert.Nil(t, newCompatibilityShims(&handlerDTO{}, ms, zap.S()), "handlers without legacy names aren't wrapped")
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// AIMDConcurrencyLimit grows the limit by one while requests succeed and cuts it by BackoffRatio when one fails or is slower
+	// than LatencyThreshold. This is the default
+	AIMDConcurrencyLimit = "aimd"
+	// VegasConcurrencyLimit estimates the queue from how much slower requests are than the fastest recent request, and shrinks the
+	// limit as soon as latency grows, before requests start to fail
+	VegasConcurrencyLimit = "vegas"
+
+	concurrencyLimitMetric    = "http.server.concurrency.limit"
+	concurrencyInFlightMetric = "http.server.concurrency.inFlight"
+	concurrencyRejectedMetric = "http.server.concurrency.rejected"
+
+	defaultInitialConcurrencyLimit = 20
+	defaultMinConcurrencyLimit     = 1
+	defaultMaxConcurrencyLimit     = 1000
+	defaultLatencyThreshold        = 5 * time.Second
+	defaultBackoffRatio            = 0.9
+	// vegasProbeInterval the samples after which the fastest latency is forgotten, so the limit follows a shifting baseline
+	vegasProbeInterval = 1000
+)
+
+var concurrencyLimitExceeded = serr.APIError{
+	Message:        "The server is handling too many requests, try again later",
+	HttpStatusCode: http.StatusServiceUnavailable,
+}
+
+type (
+	// ConcurrencyLimitConfiguration adapts the requests a server or route group handles at once to how it is coping. The limit shrinks when
+	// requests fail with a 5xx or 429 or slow down, i.e. because a dependency degrades, and grows again as they recover.
+	// Requests over the limit are answered with a 503 and the headers of their Backpressure without being handled. The limit is reported by
+	// the http.server.concurrency.limit gauge
+	ConcurrencyLimitConfiguration struct {
+		// Enabled limits the requests in flight
+		Enabled bool
+		// Algorithm how the limit is adapted, aimd or vegas. Defaults to aimd
+		Algorithm string
+		// InitialLimit the limit before any request completed, defaults to 20
+		InitialLimit int
+		// MinLimit the limit never goes below, defaults to 1
+		MinLimit int
+		// MaxLimit the limit never goes above, defaults to 1000
+		MaxLimit int
+		// LatencyThreshold aimd only, requests slower than this count as failures, defaults to 5 seconds
+		LatencyThreshold time.Duration
+		// BackoffRatio aimd only, what the limit is multiplied by when a request fails, defaults to 0.9
+		BackoffRatio float64
+		// BlockList routes that are never limited, such as the health check endpoints
+		BlockList []string
+	}
+
+	// concurrencyLimiter admits requests while fewer than the limit are in flight, and adapts the limit as they complete
+	concurrencyLimiter struct {
+		config    ConcurrencyLimitConfiguration
+		algorithm limitAlgorithm
+		log       *zap.SugaredLogger
+		now       func() time.Time
+
+		mu       sync.Mutex
+		limit    float64
+		inFlight int
+		// latency the average latency of requests, which Retry-After is estimated from
+		latency time.Duration
+
+		limitGauge    tally.Gauge
+		inFlightGauge tally.Gauge
+		rejected      tally.Counter
+	}
+
+	// limitAlgorithm the next limit after a request completed, dropped when it failed
+	limitAlgorithm interface {
+		update(limit float64, latency time.Duration, inFlight int, dropped bool) float64
+	}
+
+	aimdLimit struct {
+		latencyThreshold time.Duration
+		backoffRatio     float64
+	}
+
+	vegasLimit struct {
+		fastest time.Duration
+		samples int
+	}
+)
+
+func (c ConcurrencyLimitConfiguration) withDefaults() ConcurrencyLimitConfiguration {
+	if c.Algorithm == "" {
+		c.Algorithm = AIMDConcurrencyLimit
+	}
+	if c.MinLimit <= 0 {
+		c.MinLimit = defaultMinConcurrencyLimit
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = defaultMaxConcurrencyLimit
+	}
+	if c.InitialLimit <= 0 {
+		c.InitialLimit = defaultInitialConcurrencyLimit
+	}
+	if c.LatencyThreshold <= 0 {
+		c.LatencyThreshold = defaultLatencyThreshold
+	}
+	if c.BackoffRatio <= 0 || c.BackoffRatio >= 1 {
+		c.BackoffRatio = defaultBackoffRatio
+	}
+	return c
+}
+
+// newConcurrencyLimiter creates the limiter of a server or route group, nil when limiting is disabled
+func newConcurrencyLimiter(name string, config ConcurrencyLimitConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) (*concurrencyLimiter, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	config = config.withDefaults()
+	if config.MinLimit > config.MaxLimit {
+		return nil, fmt.Errorf("concurrency limit of %s: minLimit %d is above maxLimit %d", name, config.MinLimit, config.MaxLimit)
+	}
+
+	var algorithm limitAlgorithm
+	switch config.Algorithm {
+	case AIMDConcurrencyLimit:
+		algorithm = &aimdLimit{latencyThreshold: config.LatencyThreshold, backoffRatio: config.BackoffRatio}
+	case VegasConcurrencyLimit:
+		algorithm = &vegasLimit{}
+	default:
+		return nil, fmt.Errorf("concurrency limit of %s: unknown algorithm %q, expected %q or %q", name, config.Algorithm, AIMDConcurrencyLimit, VegasConcurrencyLimit)
+	}
+
+	tags := map[string]string{"server": name}
+	l := &concurrencyLimiter{
+		config:        config,
+		algorithm:     algorithm,
+		log:           log,
+		now:           time.Now,
+		limit:         clamp(float64(config.InitialLimit), config.MinLimit, config.MaxLimit),
+		limitGauge:    ms.GaugeWithTags(concurrencyLimitMetric, tags),
+		inFlightGauge: ms.GaugeWithTags(concurrencyInFlightMetric, tags),
+		rejected:      ms.CounterWithTags(concurrencyRejectedMetric, tags),
+	}
+	l.limitGauge.Update(math.Floor(l.limit))
+	return l, nil
+}
+
+// middleware rejects requests over the limit and feeds the latency and outcome of the others to the algorithm
+func (l *concurrencyLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(l.config.BlockList, c.FullPath()) {
+			c.Next()
+			return
+		}
+		b, admitted := l.acquire()
+		if !admitted {
+			l.rejected.Inc(1)
+			rejectRequest(c, concurrencyLimitExceeded, b, l.log)
+			return
+		}
+		recordBackpressure(c, b)
+
+		start := l.now()
+		completed := false
+		// a panicking handler still frees its slot, and counts as failed
+		defer func() {
+			status := c.Writer.Status()
+			l.release(l.now().Sub(start), !completed || status >= http.StatusInternalServerError || status == http.StatusTooManyRequests)
+		}()
+		c.Next()
+		completed = true
+	}
+}
+
+// acquire counts the request as in flight unless the limit is reached, the backpressure of requests that are turned away has the
+// average latency as Retry-After, by when a request is likely to have completed
+func (l *concurrencyLimiter) acquire() (Backpressure, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := int(math.Floor(l.limit))
+	if l.inFlight >= limit {
+		return Backpressure{Source: BackpressureConcurrencyLimit, Limit: limit, RetryAfter: l.latency}, false
+	}
+	l.inFlight++
+	l.inFlightGauge.Update(float64(l.inFlight))
+	return Backpressure{Source: BackpressureConcurrencyLimit, Limit: limit, Remaining: limit - l.inFlight}, true
+}
+
+func (l *concurrencyLimiter) release(latency time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	l.latency = averageLatency(l.latency, latency)
+	l.limit = clamp(l.algorithm.update(l.limit, latency, inFlight, dropped), l.config.MinLimit, l.config.MaxLimit)
+	l.inFlightGauge.Update(float64(l.inFlight))
+	l.limitGauge.Update(math.Floor(l.limit))
+}
+
+func (a *aimdLimit) update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	if dropped || latency > a.latencyThreshold {
+		return limit * a.backoffRatio
+	}
+	// only grow while the limit is being used, an idle server has no evidence it can handle more
+	if float64(inFlight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+func (v *vegasLimit) update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	v.samples++
+	if v.fastest == 0 || latency < v.fastest || v.samples > vegasProbeInterval {
+		v.fastest = latency
+		v.samples = 0
+	}
+	step := math.Max(1, math.Log10(limit))
+	if dropped {
+		return limit - step
+	}
+
+	if latency <= 0 {
+		return limit
+	}
+	// the requests queued in the server, the share of the limit spent waiting rather than working
+	queue := limit * (1 - float64(v.fastest)/float64(latency))
+	alpha, beta := 3*step, 6*step
+	switch {
+	case queue <= alpha && float64(inFlight)*2 >= limit:
+		return limit + step
+	case queue >= beta:
+		return limit - step
+	default:
+		return limit
+	}
+}
+
+func clamp(limit float64, min int, max int) float64 {
+	return math.Min(math.Max(limit, float64(min)), float64(max))
+}
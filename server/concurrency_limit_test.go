@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func newTestConcurrencyLimiter(t *testing.T, config ConcurrencyLimitConfiguration) (*concurrencyLimiter, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().GaugeWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Gauge {
+		return scope.Tagged(tags).Gauge(name)
+	})
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	l, err := newConcurrencyLimiter("http", config, ms, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	return l, scope
+}
+
+func gaugeValue(scope tally.TestScope, name string) float64 {
+	for _, gauge := range scope.Snapshot().Gauges() {
+		if gauge.Name() == name {
+			return gauge.Value()
+		}
+	}
+	return -1
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, scope := newTestConcurrencyLimiter(t, ConcurrencyLimitConfiguration{Enabled: true, InitialLimit: 2, BlockList: []string{"/health"}})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	g := gin.New()
+	g.Use(l.middleware())
+	g.GET("/slow", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	g.GET("/failing", func(c *gin.Context) {
+		c.Status(http.StatusBadGateway)
+	})
+	g.GET("/health", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- serve("/slow") }()
+		<-started
+	}
+	assert.Equal(t, float64(2), gaugeValue(scope, concurrencyInFlightMetric))
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/slow"), "requests over the limit are rejected")
+	assert.Equal(t, http.StatusOK, serve("/health"), "blocked routes are never limited")
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, float64(3), gaugeValue(scope, concurrencyLimitMetric), "the limit grows while it is used")
+	assert.Equal(t, int64(1), scope.Snapshot().Counters()[concurrencyRejectedMetric+"+server=http"].Value())
+
+	for i := 0; i < 10; i++ {
+		serve("/failing")
+	}
+	assert.Equal(t, float64(1), gaugeValue(scope, concurrencyLimitMetric), "failures shrink the limit down to the minimum")
+	assert.Equal(t, float64(0), gaugeValue(scope, concurrencyInFlightMetric))
+}
+
+func TestAIMDLimit(t *testing.T) {
+	aimd := &aimdLimit{latencyThreshold: time.Second, backoffRatio: 0.5}
+
+	assert.Equal(t, float64(11), aimd.update(10, 10*time.Millisecond, 5, false))
+	assert.Equal(t, float64(10), aimd.update(10, 10*time.Millisecond, 4, false), "an underused limit doesn't grow")
+	assert.Equal(t, float64(5), aimd.update(10, 10*time.Millisecond, 5, true))
+	assert.Equal(t, float64(5), aimd.update(10, 2*time.Second, 5, false), "slow requests count as failures")
+}
+
+func TestVegasLimit(t *testing.T) {
+	vegas := &vegasLimit{}
+	limit := float64(100)
+
+	limit = vegas.update(limit, 10*time.Millisecond, 100, false)
+	assert.Equal(t, float64(102), limit, "requests as fast as the fastest grow the limit")
+	limit = vegas.update(limit, 20*time.Millisecond, 100, false)
+	assert.InDelta(t, 100, limit, 0.01, "requests twice as slow mean half the limit is queued")
+	assert.InDelta(t, limit-2, vegas.update(limit, 10*time.Millisecond, 100, true), 0.01)
+
+	for i := 0; i <= vegasProbeInterval; i++ {
+		vegas.update(limit, 20*time.Millisecond, 100, false)
+	}
+	assert.Equal(t, 20*time.Millisecond, vegas.fastest, "the fastest latency is forgotten after the probe interval")
+}
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	l, err := newConcurrencyLimiter("http", ConcurrencyLimitConfiguration{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, l, "limiting is disabled by default")
+
+	_, err = newConcurrencyLimiter("http", ConcurrencyLimitConfiguration{Enabled: true, Algorithm: "gradient"}, nil, nil)
+	assert.EqualError(t, err, `concurrency limit of http: unknown algorithm "gradient", expected "aimd" or "vegas"`)
+
+	_, err = newConcurrencyLimiter("http", ConcurrencyLimitConfiguration{Enabled: true, MinLimit: 10, MaxLimit: 5}, nil, nil)
+	assert.EqualError(t, err, "concurrency limit of http: minLimit 10 is above maxLimit 5")
+}
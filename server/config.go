@@ -30,6 +30,46 @@ type Configuration struct {
 	HTTP           http.HTTP
 	Management     http.HTTP
 	Profile        ProfileConfiguration
+	RequestSigning RequestSigningConfiguration
+	Deduplication  DeduplicationConfiguration
+	Coalescing     CoalescingConfiguration
+	// ConcurrencyLimit adapts the requests handled at once to how the server is coping, it doesn't apply to a separate management server
+	ConcurrencyLimit ConcurrencyLimitConfiguration
+	// PayloadEncryption the keys of the handlers that exchange JWE encrypted payloads, see HandlerConfig.Encryption
+	PayloadEncryption PayloadEncryptionConfiguration
+	// ResponseSize warns about or rejects JSON responses too large to be served without pagination, see ResponseSizeConfiguration
+	ResponseSize ResponseSizeConfiguration
+	// Digest verifies the digests of request bodies and adds digests to responses, see DigestConfiguration
+	Digest DigestConfiguration
+	// UsageAnalytics aggregates the usage of routes per org for product analytics, it doesn't apply to a separate management server
+	UsageAnalytics UsageAnalyticsConfiguration
+	// SecurityPolicy applies the CORS origins, token audiences and IP allowlists of orgs pulled from a central endpoint, see
+	// SecurityPolicyConfiguration. It doesn't apply to a separate management server
+	SecurityPolicy SecurityPolicyConfiguration
+	ClientIP       ClientIPConfiguration
+	Diagnostics    DiagnosticsConfiguration
+	Router         RouterConfiguration
+	Region         RegionConfiguration
+	// Lifecycle the timeouts of the IControllerLifecycle hooks of the controllers
+	Lifecycle LifecycleConfiguration
+	// RouteGroups serves controllers under additional prefixes or virtual hosts, see RouteGroupConfiguration
+	RouteGroups []RouteGroupConfiguration
+	// APIGroups the settings shared by the controllers of each API product by group name, see APIGroupConfiguration
+	APIGroups map[string]APIGroupConfiguration
+	// DisabledRoutes switches off routes without a code change, either a method and a path such as "DELETE /deployments/:id" or
+	// a path prefix such as "/deployments" for every route of a controller. Paths don't include the prefix of the server
+	DisabledRoutes []string
+	// DisabledRouteStatusCode the status of the responses of disabled routes, 503 by default or 404
+	DisabledRouteStatusCode int
+	// FeatureDisabledStatusCode the status of the responses of handlers whose HandlerConfig.RequiredFeatures are off, 404 by default or 403
+	FeatureDisabledStatusCode int
+	// OpenAPI serves an OpenAPI document of the handlers of the http server on the management server, see OpenAPIConfiguration
+	OpenAPI OpenAPIConfiguration
+	// RateLimit limits the requests of each org, it doesn't apply to a separate management server. See RateLimitConfiguration
+	RateLimit RateLimitConfiguration
+	// ManagementSecurity disables the management routes or restricts who can reach a separate management server, see
+	// ManagementSecurityConfiguration
+	ManagementSecurity ManagementSecurityConfiguration
 }
 
 // RequestLoggingConfiguration enable request logging, by default all requests are logged.
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/gin-gonic/gin"
+	"sync"
+)
+
+// DiagnosticsConfiguration enables extra bookkeeping that is useful while debugging a service, but has a per request cost
+type DiagnosticsConfiguration struct {
+	// RecordContextKeys if enabled the ctxutil keys set while handling each route are counted and listed at the /info endpoint
+	RecordContextKeys bool
+	// RecordNegotiations if enabled the content negotiation decisions of each route are counted and listed at the /info endpoint.
+	// Recording takes a lock of the route on every request, so it is off by default
+	RecordNegotiations bool
+	// ExtendedErrors if enabled 4xx and 5xx responses include a snapshot of the request, its route, negotiated content types, arguments and redacted headers.
+	// It is only honoured when the environment or an active profile is local or dev, and never when either is prod
+	ExtendedErrors bool
+	// DisableRouteListing in dev environments the routes of every server are logged at startup and listed at the /routes management
+	// endpoint, each with a curl command including the headers it requires. Set this to true to turn that off
+	DisableRouteListing bool
+	// PhaseTimings if enabled the time handlers spend authorizing, reading, validating, handling, marshalling and writing each request
+	// is added to the span of the request as handler.phase.<name>.ms attributes
+	PhaseTimings bool
+	// PhaseTimingsHeader if enabled the phase timings are also sent in a Server-Timing header of successful responses. It is only
+	// honoured when PhaseTimings is and, like ExtendedErrors, in dev environments
+	PhaseTimingsHeader bool
+	// Allocations if enabled the memory allocated by a sample of the requests is estimated and the requests over a threshold are logged,
+	// see AllocationAccountingConfiguration
+	Allocations AllocationAccountingConfiguration
+	// routes the route listing shared by the http and management servers, nil when routes aren't listed
+	routes *routeListing
+	clock  clock.Clock
+}
+
+// contextKeyDiagnostics counts the ctxutil keys that were set per route
+type contextKeyDiagnostics struct {
+	name   string
+	mu     sync.Mutex
+	routes map[string]map[string]int64
+}
+
+func newContextKeyDiagnostics(name string) *contextKeyDiagnostics {
+	return &contextKeyDiagnostics{
+		name:   name,
+		routes: map[string]map[string]int64{},
+	}
+}
+
+func (d *contextKeyDiagnostics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, recording := ctxutil.WithRecording(c.Request.Context())
+		if recording == nil {
+			c.Next()
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			// unmatched paths are caller controlled, don't let them grow the map
+			return
+		}
+		route = c.Request.Method + " " + route
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		counts, ok := d.routes[route]
+		if !ok {
+			counts = map[string]int64{}
+			d.routes[route] = counts
+		}
+		for _, key := range recording.Keys() {
+			counts[key]++
+		}
+	}
+}
+
+// Contribute implements the management.infoContributor interface
+func (d *contextKeyDiagnostics) Contribute(builder *info.InfoBuilder) {
+	d.mu.Lock()
+	routes := make(map[string]map[string]int64, len(d.routes))
+	for route, counts := range d.routes {
+		copied := make(map[string]int64, len(counts))
+		for k, v := range counts {
+			copied[k] = v
+		}
+		routes[route] = copied
+	}
+	d.mu.Unlock()
+
+	builder.WithDetails(map[string]any{
+		"contextKeys": map[string]any{
+			"declared": ctxutil.DeclaredKeys(),
+			d.name:     routes,
+		},
+	})
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DeliveryIDHeader the default header callers put the delivery id of a request in, retries of a delivery must reuse its id
+	DeliveryIDHeader = "X-Delivery-Id"
+	// DuplicateDeliveryHeader is set on responses to duplicate deliveries that were answered without running the handler
+	DuplicateDeliveryHeader = "X-Delivery-Duplicate"
+
+	deliveriesMetric         = "http.server.requests.deliveries"
+	deliveryOutcomeFirst     = "first"
+	deliveryOutcomeDuplicate = "duplicate"
+	deliveryOutcomeInFlight  = "in_flight"
+
+	defaultDeduplicationWindow  = time.Hour
+	defaultDeliveryInFlightTime = time.Minute
+	inMemorySweepInterval       = time.Minute
+)
+
+var deliveryInFlight = serr.APIError{
+	Message:        "A request with the same delivery id is already being processed",
+	HttpStatusCode: http.StatusConflict,
+}
+
+type (
+	// DeduplicationConfiguration configures the de-duplication of requests that carry a delivery id, for callers with at-least-once delivery
+	// such as agent callbacks. Handlers opt in with HandlerConfig.Deduplicate
+	DeduplicationConfiguration struct {
+		// Header the header that carries the delivery id, defaults to X-Delivery-Id. Requests without it are not de-duplicated
+		Header string
+		// Window how long the status code of a handled delivery is remembered, defaults to 1 hour
+		Window time.Duration
+		// InFlightTimeout how long a delivery is considered in progress before a retry may run the handler again, defaults to 1 minute
+		InFlightTimeout time.Duration
+		// store where deliveries are recorded, the DeduplicationStore provided to the server or else an in memory store
+		store DeduplicationStore
+	}
+
+	// DeduplicationStore records deliveries, provide one to the server to share deliveries between replicas.
+	// The server uses an in memory store by default
+	DeduplicationStore interface {
+		// Reserve marks the delivery as in progress for ttl. When the delivery is already known its record is returned and reserved is false
+		Reserve(ctx context.Context, key string, ttl time.Duration) (record DeliveryRecord, reserved bool, err error)
+		// Complete records the status code the delivery was answered with for ttl
+		Complete(ctx context.Context, key string, statusCode int, ttl time.Duration) error
+		// Release forgets the delivery so that a retry runs the handler again
+		Release(ctx context.Context, key string) error
+	}
+
+	// DeliveryRecord what is known about a delivery, StatusCode is 0 while the delivery is in progress
+	DeliveryRecord struct {
+		StatusCode int
+	}
+
+	// InMemoryDeduplicationStore a DeduplicationStore for a single replica
+	InMemoryDeduplicationStore struct {
+		mu        sync.Mutex
+		clock     clock.Clock
+		records   map[string]inMemoryDelivery
+		nextSweep time.Time
+	}
+
+	inMemoryDelivery struct {
+		record    DeliveryRecord
+		expiresAt time.Time
+	}
+
+	// deduplicator answers duplicate deliveries with the status code of the original delivery
+	deduplicator struct {
+		config  DeduplicationConfiguration
+		metrics metrics.MetricsSvc
+		log     *zap.SugaredLogger
+	}
+)
+
+// NewInMemoryDeduplicationStore creates an InMemoryDeduplicationStore, expired deliveries are swept as new ones are reserved
+func NewInMemoryDeduplicationStore(c clock.Clock) *InMemoryDeduplicationStore {
+	return &InMemoryDeduplicationStore{
+		clock:   clock.OrDefault(c),
+		records: make(map[string]inMemoryDelivery),
+	}
+}
+
+func (s *InMemoryDeduplicationStore) Reserve(_ context.Context, key string, ttl time.Duration) (DeliveryRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	s.sweepLocked(now)
+
+	if existing, ok := s.records[key]; ok && now.Before(existing.expiresAt) {
+		return existing.record, false, nil
+	}
+	s.records[key] = inMemoryDelivery{expiresAt: now.Add(ttl)}
+	return DeliveryRecord{}, true, nil
+}
+
+func (s *InMemoryDeduplicationStore) Complete(_ context.Context, key string, statusCode int, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = inMemoryDelivery{record: DeliveryRecord{StatusCode: statusCode}, expiresAt: s.clock.Now().Add(ttl)}
+	return nil
+}
+
+func (s *InMemoryDeduplicationStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *InMemoryDeduplicationStore) sweepLocked(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for key, delivery := range s.records {
+		if !now.Before(delivery.expiresAt) {
+			delete(s.records, key)
+		}
+	}
+	s.nextSweep = now.Add(inMemorySweepInterval)
+}
+
+func (c DeduplicationConfiguration) withDefaults() DeduplicationConfiguration {
+	if c.Header == "" {
+		c.Header = DeliveryIDHeader
+	}
+	if c.Window == 0 {
+		c.Window = defaultDeduplicationWindow
+	}
+	if c.InFlightTimeout == 0 {
+		c.InFlightTimeout = defaultDeliveryInFlightTime
+	}
+	if c.store == nil {
+		c.store = NewInMemoryDeduplicationStore(nil)
+	}
+	return c
+}
+
+func newDeduplicator(config DeduplicationConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) *deduplicator {
+	return &deduplicator{
+		config:  config.withDefaults(),
+		metrics: ms,
+		log:     log,
+	}
+}
+
+// wrap returns a handler func that runs next once per delivery of a handler that opted in to de-duplication
+func (d *deduplicator) wrap(handler *handlerDTO, next gin.HandlerFunc) gin.HandlerFunc {
+	if d == nil || !handler.Deduplicate {
+		return next
+	}
+	return func(c *gin.Context) {
+		deliveryID := c.GetHeader(d.config.Header)
+		if deliveryID == "" {
+			next(c)
+			return
+		}
+
+		ctx := c.Request.Context()
+		// the deduplicator runs before ginHOF authorizes the request, callers that aren't authorized run the handler themselves to
+		// be answered with their own error, rather than recording it against the delivery for the legitimate retry
+		if !handler.AuthOptOut && authorizeRequest(ctx, handler) != nil {
+			next(c)
+			return
+		}
+
+		key := deliveryKey(ctx, handler, deliveryID)
+		record, reserved, err := d.config.store.Reserve(ctx, key, d.config.InFlightTimeout)
+		if err != nil {
+			// fail open, handlers must already tolerate the occasional duplicate when the store is unavailable
+			d.log.Warnw("failed to reserve delivery, handling it without de-duplication", "uri", handler.Path, "deliveryId", deliveryID, "error", err)
+			next(c)
+			return
+		}
+
+		switch {
+		case !reserved && record.StatusCode == 0:
+			d.record(handler, deliveryOutcomeInFlight)
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(deliveryInFlight,
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+				serr.WithExtraDetailsForLogging(serr.KVPair{Key: "deliveryId", Value: deliveryID}),
+			), d.log)
+		case !reserved:
+			d.record(handler, deliveryOutcomeDuplicate)
+			c.Header(DuplicateDeliveryHeader, "true")
+			c.AbortWithStatus(record.StatusCode)
+		default:
+			d.record(handler, deliveryOutcomeFirst)
+			d.handle(c, handler, key, next)
+		}
+	}
+}
+
+// handle runs next and records its status code, deliveries that failed in a way a retry could fix are released instead
+func (d *deduplicator) handle(c *gin.Context, handler *handlerDTO, key string, next gin.HandlerFunc) {
+	ctx := c.Request.Context()
+	completed := false
+	// release the delivery when the handler panics too, so it isn't stuck in progress until InFlightTimeout
+	defer func() {
+		if completed {
+			return
+		}
+		if err := d.config.store.Release(ctx, key); err != nil {
+			d.log.Warnw("failed to release delivery", "uri", handler.Path, "error", err)
+		}
+	}()
+
+	next(c)
+
+	status := c.Writer.Status()
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		return
+	}
+	if err := d.config.store.Complete(ctx, key, status, d.config.Window); err != nil {
+		d.log.Warnw("failed to record delivery", "uri", handler.Path, "error", err)
+	}
+	completed = true
+}
+
+func (d *deduplicator) record(handler *handlerDTO, outcome string) {
+	if d.metrics == nil {
+		return
+	}
+	d.metrics.CounterWithTags(deliveriesMetric, map[string]string{
+		"uri":     handler.Path,
+		"method":  handler.Method,
+		"outcome": outcome,
+	}).Inc(1)
+}
+
+// deliveryKey scopes delivery ids to the caller and the route, so ids only have to be unique per caller and endpoint. Callers are
+// identified by their principal, else by the key that signed the request, else by their IP so that unauthenticated callers such as
+// agents don't share ids
+func deliveryKey(ctx context.Context, handler *handlerDTO, deliveryID string) string {
+	caller := unknownCallerOrg
+	if p, err := iam.ExtractPrincipalFromContext(ctx); err == nil && p != nil && p.OrgId != "" {
+		caller = "principal:" + p.OrgId + "/" + p.Name
+	} else if keyID, ok := signerKeyIDKey.Value(ctx); ok {
+		caller = "key:" + keyID
+	} else if ip, ok := clientIPKey.Value(ctx); ok && ip != "" {
+		caller = "ip:" + ip
+	}
+	return strings.Join([]string{caller, handler.Method, handler.Path, deliveryID}, "|")
+}
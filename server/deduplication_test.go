@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestDeduplicator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(deliveriesMetric, gomock.Any()).DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	}).AnyTimes()
+
+	fake := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := newDeduplicator(DeduplicationConfiguration{Window: time.Hour, store: NewInMemoryDeduplicationStore(fake)}, ms, zap.NewNop().Sugar())
+	handler := &handlerDTO{Path: "/callbacks", Method: http.MethodPost, Deduplicate: true}
+
+	calls := 0
+	status := http.StatusAccepted
+	release := make(chan struct{})
+	g := gin.New()
+	g.POST("/callbacks", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: c.GetHeader("org")}))
+	}, d.wrap(handler, func(c *gin.Context) {
+		calls++
+		if c.GetHeader("block") != "" {
+			<-release
+		}
+		c.Status(status)
+	}))
+
+	serve := func(deliveryID string, org string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/callbacks", nil)
+		req.Header.Set("org", org)
+		if deliveryID != "" {
+			req.Header.Set(DeliveryIDHeader, deliveryID)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusAccepted, serve("d-1", "org-1").Code)
+	status = http.StatusOK
+	duplicate := serve("d-1", "org-1")
+	assert.Equal(t, http.StatusAccepted, duplicate.Code, "duplicates get the original status code")
+	assert.Equal(t, "true", duplicate.Header().Get(DuplicateDeliveryHeader))
+	assert.Equal(t, 1, calls)
+
+	serve("d-1", "org-2")
+	assert.Equal(t, 2, calls, "delivery ids are scoped to the caller's org")
+
+	serve("", "org-1")
+	serve("", "org-1")
+	assert.Equal(t, 4, calls, "requests without a delivery id are always handled")
+
+	fake.Advance(time.Hour)
+	serve("d-1", "org-1")
+	assert.Equal(t, 5, calls, "deliveries are forgotten after the window")
+
+	status = http.StatusServiceUnavailable
+	serve("d-2", "org-1")
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, serve("d-2", "org-1").Code, "failed deliveries are released so retries are handled")
+	assert.Equal(t, 7, calls)
+
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/callbacks", nil)
+		req.Header.Set(DeliveryIDHeader, "d-3")
+		req.Header.Set("block", "true")
+		g.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		return serve("d-3", "").Code == http.StatusConflict
+	}, time.Second, 10*time.Millisecond, "deliveries in progress are rejected")
+	close(release)
+	<-done
+
+	outcomes := map[string]int64{}
+	for _, c := range scope.Snapshot().Counters() {
+		outcomes[c.Tags()["outcome"]] += c.Value()
+	}
+	assert.Equal(t, int64(1), outcomes[deliveryOutcomeDuplicate])
+	assert.Equal(t, int64(6), outcomes[deliveryOutcomeFirst])
+	assert.GreaterOrEqual(t, outcomes[deliveryOutcomeInFlight], int64(1))
+}
+
+func TestDeduplicatorUnauthorizedDelivery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	d := newDeduplicator(DeduplicationConfiguration{}, nil, zap.NewNop().Sugar())
+	handler := &handlerDTO{Path: "/callbacks", Method: http.MethodPost, Deduplicate: true, AuthZValidators: []AuthZValidatorV2Fn{
+		func(_ context.Context, p *iam.ArmoryCloudPrincipal) (string, bool) {
+			return "forged", p.Name == "agent"
+		},
+	}}
+
+	calls := 0
+	g := gin.New()
+	g.POST("/callbacks", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: "org-1", Name: c.GetHeader("name")}))
+	}, d.wrap(handler, func(c *gin.Context) {
+		calls++
+		if err := authorizeRequest(c.Request.Context(), handler); err != nil {
+			c.Status(http.StatusForbidden)
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}))
+	serve := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/callbacks", nil)
+		req.Header.Set("name", name)
+		req.Header.Set(DeliveryIDHeader, "d-1")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("").Code)
+	w := serve("agent")
+	assert.Equal(t, http.StatusAccepted, w.Code, "a rejected delivery isn't recorded against the delivery id")
+	assert.Empty(t, w.Header().Get(DuplicateDeliveryHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestDeliveryKey(t *testing.T) {
+	handler := &handlerDTO{Path: "/callbacks", Method: http.MethodPost}
+	ctx := context.Background()
+	keyOf := func(ctx context.Context) string { return deliveryKey(ctx, handler, "d-1") }
+
+	agent1 := clientIPKey.WithValue(ctx, "10.0.0.1")
+	agent2 := clientIPKey.WithValue(ctx, "10.0.0.2")
+	assert.NotEqual(t, keyOf(agent1), keyOf(agent2), "unauthenticated callers don't share delivery ids")
+	assert.Equal(t, "ip:10.0.0.1|POST|/callbacks|d-1", keyOf(agent1))
+
+	signed := signerKeyIDKey.WithValue(agent1, "agent-key")
+	assert.Equal(t, "key:agent-key|POST|/callbacks|d-1", keyOf(signed), "signed requests are scoped to their signing key")
+
+	principal := iam.WithPrincipal(signed, iam.ArmoryCloudPrincipal{OrgId: "org-1", Name: "agent"})
+	assert.Equal(t, "principal:org-1/agent|POST|/callbacks|d-1", keyOf(principal))
+	assert.Equal(t, "unknown|POST|/callbacks|d-1", keyOf(ctx))
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// deprecationReportPath the management route that reports the orgs calling deprecated routes, see HandlerConfig.Deprecation
+	deprecationReportPath = "/deprecations"
+
+	deprecationHeader = "Deprecation"
+	sunsetHeader      = "Sunset"
+	linkHeader        = "Link"
+)
+
+type (
+	// Deprecation marks a handler as deprecated. Its responses carry the Deprecation and Sunset headers, and when usage analytics are
+	// enabled the orgs that still call it, and when they last did, are reported at the /deprecations management endpoint
+	Deprecation struct {
+		// Since when the handler was deprecated, sent as the Deprecation header. Defaults to true when unset
+		Since time.Time `json:"since,omitempty"`
+		// Sunset when the handler will be removed, sent as the Sunset header
+		Sunset time.Time `json:"sunset,omitempty"`
+		// Successor what callers should migrate to, ex: "POST /v2/deployments". Absolute URLs and paths are also sent as a Link header
+		Successor string `json:"successor,omitempty"`
+	}
+
+	// deprecationReport the calls to deprecated routes per org since the server started, shared by the http and management servers.
+	// Every replica reports its own calls, aggregate the published usage summaries of UsageSinkPublisher for a fleet wide view
+	deprecationReport struct {
+		clock      clock.Clock
+		maxEntries int
+		since      time.Time
+
+		mu         sync.Mutex
+		deprecated map[deprecatedCallKey]deprecatedRoute
+		calls      map[deprecatedCallKey]*deprecatedRouteCaller
+	}
+
+	deprecatedCallKey struct {
+		method, route, org string
+	}
+
+	// deprecatedRoute a deprecated route and the orgs that called it, most recent first
+	deprecatedRoute struct {
+		Server       string                  `json:"server"`
+		Method       string                  `json:"method"`
+		Route        string                  `json:"route"`
+		Deprecation  Deprecation             `json:"deprecation"`
+		Requests     int64                   `json:"requests"`
+		LastCalledAt *time.Time              `json:"lastCalledAt,omitempty"`
+		Callers      []deprecatedRouteCaller `json:"callers"`
+	}
+
+	// deprecatedRouteCaller the calls of an org to a deprecated route, requests without a principal have no org
+	deprecatedRouteCaller struct {
+		Org          string    `json:"org"`
+		Requests     int64     `json:"requests"`
+		LastCalledAt time.Time `json:"lastCalledAt"`
+	}
+)
+
+// headers the response headers announcing the deprecation, see RFC 9745 and RFC 8594
+func (d *Deprecation) headers() http.Header {
+	if d == nil {
+		return nil
+	}
+	headers := http.Header{}
+	if d.Since.IsZero() {
+		headers.Set(deprecationHeader, "true")
+	} else {
+		headers.Set(deprecationHeader, fmt.Sprintf("@%d", d.Since.Unix()))
+	}
+	if !d.Sunset.IsZero() {
+		headers.Set(sunsetHeader, d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if strings.HasPrefix(d.Successor, "/") || strings.HasPrefix(d.Successor, "https://") || strings.HasPrefix(d.Successor, "http://") {
+		headers.Set(linkHeader, fmt.Sprintf(`<%s>; rel="successor-version"`, d.Successor))
+	}
+	return headers
+}
+
+func newDeprecationReport(c clock.Clock, maxEntries int) *deprecationReport {
+	c = clock.OrDefault(c)
+	if maxEntries <= 0 {
+		maxEntries = defaultUsageAnalyticsEntries
+	}
+	return &deprecationReport{clock: c, maxEntries: maxEntries, since: c.Now(), deprecated: map[deprecatedCallKey]deprecatedRoute{}, calls: map[deprecatedCallKey]*deprecatedRouteCaller{}}
+}
+
+// add reports the deprecated handlers of the registry, served under prefix by server
+func (r *deprecationReport) add(server string, prefix string, registry iHandlerRegistry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, handler := range registry.handlers() {
+		if handler.Deprecation == nil {
+			continue
+		}
+		route := deprecatedRoute{
+			Server:      server,
+			Method:      handler.Method,
+			Route:       joinPaths("/"+strings.TrimPrefix(prefix, "/"), handler.Path),
+			Deprecation: *handler.Deprecation,
+		}
+		// handlers of several media types share their route, the first one is reported
+		key := deprecatedCallKey{method: route.Method, route: route.Route}
+		if _, ok := r.deprecated[key]; !ok {
+			r.deprecated[key] = route
+		}
+	}
+}
+
+// isDeprecated whether the route is one of a deprecated handler
+func (r *deprecationReport) isDeprecated(method string, route string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.deprecated[deprecatedCallKey{method: method, route: route}]
+	return ok
+}
+
+// record counts a call of org to the route when it's deprecated
+func (r *deprecationReport) record(method string, route string, org string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.deprecated[deprecatedCallKey{method: method, route: route}]; !ok {
+		return
+	}
+	key := deprecatedCallKey{method: method, route: route, org: org}
+	caller, ok := r.calls[key]
+	if !ok {
+		if len(r.calls) >= r.maxEntries {
+			key.org = usageOverflowOrg
+			caller, ok = r.calls[key]
+		}
+		if !ok {
+			caller = &deprecatedRouteCaller{Org: key.org}
+			r.calls[key] = caller
+		}
+	}
+	caller.Requests++
+	caller.LastCalledAt = r.clock.Now()
+}
+
+// routes the deprecated routes and their callers, those with the soonest sunset first as they need attention first
+func (r *deprecationReport) routes() []deprecatedRoute {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes := make([]deprecatedRoute, 0, len(r.deprecated))
+	for _, route := range r.deprecated {
+		route.Callers = []deprecatedRouteCaller{}
+		routes = append(routes, route)
+	}
+
+	for i := range routes {
+		route := &routes[i]
+		for key, caller := range r.calls {
+			if key.method != route.Method || key.route != route.Route {
+				continue
+			}
+			route.Callers = append(route.Callers, *caller)
+			route.Requests += caller.Requests
+			if route.LastCalledAt == nil || caller.LastCalledAt.After(*route.LastCalledAt) {
+				lastCalledAt := caller.LastCalledAt
+				route.LastCalledAt = &lastCalledAt
+			}
+		}
+		sort.Slice(route.Callers, func(i, j int) bool {
+			if !route.Callers[i].LastCalledAt.Equal(route.Callers[j].LastCalledAt) {
+				return route.Callers[i].LastCalledAt.After(route.Callers[j].LastCalledAt)
+			}
+			return route.Callers[i].Org < route.Callers[j].Org
+		})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		si, sj := routes[i].Deprecation.Sunset, routes[j].Deprecation.Sunset
+		if !si.Equal(sj) {
+			// routes without a sunset go last
+			return !si.IsZero() && (sj.IsZero() || si.Before(sj))
+		}
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// handler serves the report as JSON
+func (r *deprecationReport) handler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{"since": r.since, "routes": r.routes()})
+}
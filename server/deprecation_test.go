@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+)
+
+var (
+	deprecatedSince  = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	deprecatedSunset = time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+)
+
+type deprecatedController struct{}
+
+func (deprecatedController) Handlers() []Handler {
+	ok := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(ok, HandlerConfig{
+			Path:   "/v1/deployments/:id",
+			Method: http.MethodGet,
+			Deprecation: &Deprecation{
+				Since:     deprecatedSince,
+				Sunset:    deprecatedSunset,
+				Successor: "/v2/deployments/:id",
+			},
+		}),
+		NewHandler(ok, HandlerConfig{
+			Path:        "/v1/deployments",
+			Method:      http.MethodPost,
+			Deprecation: &Deprecation{Successor: "POST /v2/deployments"},
+		}),
+		NewHandler(ok, HandlerConfig{
+			Path:   "/v2/deployments/:id",
+			Method: http.MethodGet,
+		}),
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	assert.Nil(t, (*Deprecation)(nil).headers())
+	assert.Equal(t, http.Header{
+		"Deprecation": {"@1672531200"},
+		"Sunset":      {"Fri, 01 Sep 2023 00:00:00 GMT"},
+		"Link":        {`</v2/deployments/:id>; rel="successor-version"`},
+	}, (&Deprecation{Since: deprecatedSince, Sunset: deprecatedSunset, Successor: "/v2/deployments/:id"}).headers())
+	assert.Equal(t, http.Header{"Deprecation": {"true"}}, (&Deprecation{Successor: "POST /v2/deployments"}).headers())
+
+	registry, err := newHandlerRegistry("http", zap.S(), nil, nil, []IController{deprecatedController{}})
+	require.NoError(t, err)
+	for _, handler := range registry.handlers() {
+		if handler.Deprecation != nil {
+			assert.NotEmpty(t, handler.StaticHeaders.Get(deprecationHeader), "%s %s announces its deprecation", handler.Method, handler.Path)
+		} else {
+			assert.Empty(t, handler.StaticHeaders.Get(deprecationHeader))
+		}
+	}
+}
+
+func TestDeprecationReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	registry, err := newHandlerRegistry("http", zap.S(), nil, nil, []IController{deprecatedController{}})
+	require.NoError(t, err)
+	report := newDeprecationReport(fake, 0)
+	report.add("http", "/api", registry)
+
+	publisher := &fakeUsagePublisher{}
+	analytics, err := newUsageAnalytics(fxtest.NewLifecycle(t), UsageAnalyticsConfiguration{
+		Enabled:      true,
+		Sinks:        []string{UsageSinkPublisher},
+		publisher:    publisher,
+		clock:        fake,
+		deprecations: report,
+	}, nil, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	g := gin.New()
+	g.Use(analytics.middleware())
+	authenticated := func(c *gin.Context) {
+		if org := c.GetHeader("org"); org != "" {
+			c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: org, Type: iam.User}))
+		}
+	}
+	for _, path := range []string{"/api/v1/deployments/:id", "/api/v2/deployments/:id"} {
+		g.GET(path, authenticated, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	serve := func(path string, org string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("org", org)
+		g.ServeHTTP(httptest.NewRecorder(), req)
+		fake.Advance(time.Minute)
+	}
+
+	serve("/api/v1/deployments/1", "org-1")
+	serve("/api/v1/deployments/2", "org-2")
+	serve("/api/v1/deployments/3", "org-1")
+	serve("/api/v1/deployments/4", "")
+	serve("/api/v2/deployments/1", "org-3")
+
+	first, last := time.Date(2023, 6, 1, 0, 2, 0, 0, time.UTC), time.Date(2023, 6, 1, 0, 3, 0, 0, time.UTC)
+	assert.Equal(t, []deprecatedRoute{
+		{
+			Server:       "http",
+			Method:       http.MethodGet,
+			Route:        "/api/v1/deployments/:id",
+			Deprecation:  Deprecation{Since: deprecatedSince, Sunset: deprecatedSunset, Successor: "/v2/deployments/:id"},
+			Requests:     4,
+			LastCalledAt: &last,
+			Callers: []deprecatedRouteCaller{
+				{Org: "", Requests: 1, LastCalledAt: last},
+				{Org: "org-1", Requests: 2, LastCalledAt: first},
+				{Org: "org-2", Requests: 1, LastCalledAt: time.Date(2023, 6, 1, 0, 1, 0, 0, time.UTC)},
+			},
+		},
+		{
+			Server:      "http",
+			Method:      http.MethodPost,
+			Route:       "/api/v1/deployments",
+			Deprecation: Deprecation{Successor: "POST /v2/deployments"},
+			Callers:     []deprecatedRouteCaller{},
+		},
+	}, report.routes(), "routes are reported by sunset with their most recent callers first, including routes nobody calls")
+
+	analytics.flush(context.Background())
+	require.Len(t, publisher.summaries, 1)
+	for _, usage := range publisher.summaries[0].Routes {
+		assert.Equal(t, usage.Route == "/api/v1/deployments/:id", usage.Deprecated, usage.Route)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	report.handler(c)
+	var body struct {
+		Since  time.Time         `json:"since"`
+		Routes []deprecatedRoute `json:"routes"`
+	}
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&body))
+	assert.Equal(t, time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), body.Since)
+	assert.Len(t, body.Routes, 2)
+}
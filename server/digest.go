@@ -0,0 +1,343 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ContentDigestHeader carries the digests of a body as defined by RFC 9530, ex: sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+	ContentDigestHeader = "Content-Digest"
+	// DigestHeader the legacy digest header of RFC 3230, ex: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=
+	DigestHeader = "Digest"
+	// ContentMD5Header the base64 encoded MD5 of a body
+	ContentMD5Header = "Content-MD5"
+
+	DigestSHA256 = "sha-256"
+	DigestSHA512 = "sha-512"
+	DigestMD5    = "md5"
+
+	defaultMaxDigestBufferedBytes = 10 << 20
+)
+
+var (
+	// ErrDigestMismatch is returned when reading a request body that doesn't match its digest, for bodies that were too large to be verified
+	// before the handler ran
+	ErrDigestMismatch = errors.New("request body does not match its digest")
+
+	digestAlgorithms = map[string]func() hash.Hash{
+		DigestSHA256: sha256.New,
+		DigestSHA512: sha512.New,
+		DigestMD5:    md5.New,
+	}
+
+	requestDigestInvalid = serr.APIError{
+		Message:        "The request body does not match its digest",
+		HttpStatusCode: http.StatusBadRequest,
+	}
+)
+
+type (
+	// DigestConfiguration verifies the integrity of request bodies and adds digests to response bodies, for integrations such as artifact uploads
+	DigestConfiguration struct {
+		// VerifyRequests checks the Content-Digest, Digest and Content-MD5 headers of requests that have them against their body, requests
+		// that don't match are answered with a 400
+		VerifyRequests bool
+		// ResponseAlgorithms the digests added to responses, sha-256 and sha-512 are added to the Content-Digest header and md5 as the
+		// Content-MD5 header. Streamed responses and responses larger than MaxBufferedBytes don't get digests
+		ResponseAlgorithms []string
+		// MaxBufferedBytes the largest request body verified before the handler runs, defaults to 10MiB. Larger bodies are verified as the
+		// handler reads them and fail with ErrDigestMismatch at their end. Also the largest response body that gets digests
+		MaxBufferedBytes int64
+	}
+
+	// digests the request verification and response digests of a server
+	digests struct {
+		verifyRequests bool
+		algorithms     []string
+		maxBuffered    int64
+		log            *zap.SugaredLogger
+	}
+
+	// expectedDigest a digest a request body must match
+	expectedDigest struct {
+		algorithm string
+		sum       []byte
+	}
+
+	// verifyingReader verifies the digests of a body as it is read, for bodies too large to buffer
+	verifyingReader struct {
+		io.ReadCloser
+		expected []expectedDigest
+		hashes   []hash.Hash
+	}
+
+	readCloser struct {
+		io.Reader
+		io.Closer
+	}
+
+	// digestWriter buffers the response body to add its digests to the headers before it is written
+	digestWriter struct {
+		gin.ResponseWriter
+		digests   *digests
+		body      bytes.Buffer
+		streaming bool
+	}
+)
+
+// newDigests the digests of a server, nil when neither verification nor response digests are enabled
+func newDigests(config DigestConfiguration, log *zap.SugaredLogger) (*digests, error) {
+	if !config.VerifyRequests && len(config.ResponseAlgorithms) == 0 {
+		return nil, nil
+	}
+	d := &digests{verifyRequests: config.VerifyRequests, maxBuffered: config.MaxBufferedBytes, log: log}
+	if d.maxBuffered <= 0 {
+		d.maxBuffered = defaultMaxDigestBufferedBytes
+	}
+	for _, algorithm := range config.ResponseAlgorithms {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, ok := digestAlgorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unsupported response digest algorithm %q, expected %s, %s or %s", algorithm, DigestSHA256, DigestSHA512, DigestMD5)
+		}
+		d.algorithms = append(d.algorithms, algorithm)
+	}
+	return d, nil
+}
+
+// middleware verifies the body of requests against their digests and adds digests to responses
+func (d *digests) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d.verifyRequests {
+			if err := d.verifyRequest(c.Request); err != nil {
+				writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(requestDigestInvalid,
+					serr.WithCause(err),
+					serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+				), d.log)
+				return
+			}
+		}
+		if len(d.algorithms) == 0 {
+			c.Next()
+			return
+		}
+
+		writer := &digestWriter{ResponseWriter: c.Writer, digests: d}
+		c.Writer = writer
+		// a panicking handler's partial response is dropped, the recovery middleware answers with the original writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+		}()
+		c.Next()
+		writer.flush()
+	}
+}
+
+// verifyRequest buffers bodies up to maxBuffered and checks them against their digests, larger bodies are verified as they are read
+func (d *digests) verifyRequest(req *http.Request) error {
+	expected, err := requestDigests(req.Header)
+	if err != nil || len(expected) == 0 || req.Body == nil || req.Body == http.NoBody {
+		return err
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(req.Body, d.maxBuffered+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buffered)) <= d.maxBuffered {
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(buffered))
+		for _, digest := range expected {
+			if !digest.matches(buffered) {
+				return fmt.Errorf("%w: %s", ErrDigestMismatch, digest.algorithm)
+			}
+		}
+		return nil
+	}
+
+	reader := &verifyingReader{
+		ReadCloser: readCloser{Reader: io.MultiReader(bytes.NewReader(buffered), req.Body), Closer: req.Body},
+		expected:   expected,
+	}
+	for _, digest := range expected {
+		reader.hashes = append(reader.hashes, digestAlgorithms[digest.algorithm]())
+	}
+	req.Body = reader
+	return nil
+}
+
+// requestDigests the supported digests of the Content-Digest, Digest and Content-MD5 headers, other algorithms are ignored
+func requestDigests(header http.Header) ([]expectedDigest, error) {
+	var expected []expectedDigest
+	add := func(algorithm string, encoded string) error {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, ok := digestAlgorithms[algorithm]; !ok {
+			return nil
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("malformed %s digest: %w", algorithm, err)
+		}
+		expected = append(expected, expectedDigest{algorithm: algorithm, sum: sum})
+		return nil
+	}
+
+	for _, entry := range splitHeaderList(header, ContentDigestHeader) {
+		algorithm, value, _ := strings.Cut(entry, "=")
+		// the value is a byte sequence, its base64 is wrapped in colons and may be followed by parameters
+		value, _, _ = strings.Cut(strings.TrimSpace(value), ";")
+		if err := add(algorithm, strings.Trim(value, ":")); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range splitHeaderList(header, DigestHeader) {
+		algorithm, value, _ := strings.Cut(entry, "=")
+		if err := add(algorithm, value); err != nil {
+			return nil, err
+		}
+	}
+	if value := header.Get(ContentMD5Header); value != "" {
+		if err := add(DigestMD5, value); err != nil {
+			return nil, err
+		}
+	}
+	return expected, nil
+}
+
+func splitHeaderList(header http.Header, name string) []string {
+	var entries []string
+	for _, value := range header.Values(name) {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+func (e expectedDigest) matches(body []byte) bool {
+	h := digestAlgorithms[e.algorithm]()
+	h.Write(body)
+	return subtle.ConstantTimeCompare(h.Sum(nil), e.sum) == 1
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	for _, h := range r.hashes {
+		h.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		for i, digest := range r.expected {
+			if subtle.ConstantTimeCompare(r.hashes[i].Sum(nil), digest.sum) != 1 {
+				return n, fmt.Errorf("%w: %s", ErrDigestMismatch, digest.algorithm)
+			}
+		}
+	}
+	return n, err
+}
+
+func (w *digestWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+	if int64(w.body.Len()+len(data)) > w.digests.maxBuffered {
+		w.stream()
+		return w.ResponseWriter.Write(data)
+	}
+	return w.body.Write(data)
+}
+
+func (w *digestWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow is deferred until the body is complete, so the digest headers can still be added
+func (w *digestWriter) WriteHeaderNow() {
+	if w.streaming {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *digestWriter) Written() bool {
+	return w.streaming || w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *digestWriter) Size() int {
+	if w.streaming {
+		return w.ResponseWriter.Size()
+	}
+	return w.body.Len()
+}
+
+// Flush streams the response, it is written as it is produced without digests
+func (w *digestWriter) Flush() {
+	w.stream()
+	w.ResponseWriter.Flush()
+}
+
+// stream writes what was buffered and the rest of the response as it is written
+func (w *digestWriter) stream() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	if w.body.Len() > 0 {
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+}
+
+// flush adds the digests of the buffered body and writes it
+func (w *digestWriter) flush() {
+	if w.streaming {
+		return
+	}
+	if w.body.Len() > 0 {
+		var contentDigests []string
+		for _, algorithm := range w.digests.algorithms {
+			h := digestAlgorithms[algorithm]()
+			h.Write(w.body.Bytes())
+			sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+			if algorithm == DigestMD5 {
+				w.Header().Set(ContentMD5Header, sum)
+			} else {
+				contentDigests = append(contentDigests, fmt.Sprintf("%s=:%s:", algorithm, sum))
+			}
+		}
+		if len(contentDigests) > 0 {
+			w.Header().Set(ContentDigestHeader, strings.Join(contentDigests, ", "))
+		}
+	}
+	w.stream()
+	w.ResponseWriter.WriteHeaderNow()
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func sha256Base64(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func digestEngine(t *testing.T, config DigestConfiguration, handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	d, err := newDigests(config, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	g := gin.New()
+	g.Use(d.middleware())
+	g.POST("/artifacts", handler)
+	return g
+}
+
+func TestDigestVerifiesRequests(t *testing.T) {
+	var received string
+	var readErr error
+	g := digestEngine(t, DigestConfiguration{VerifyRequests: true, MaxBufferedBytes: 8}, func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		received, readErr = string(body), err
+	})
+
+	serve := func(body string, header string, value string) int {
+		received, readErr = "", nil
+		req := httptest.NewRequest(http.MethodPost, "/artifacts", strings.NewReader(body))
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	md5Sum := md5.Sum([]byte("jar"))
+	assert.Equal(t, http.StatusOK, serve("jar", ContentDigestHeader, "sha-256=:"+sha256Base64("jar")+":"))
+	assert.Equal(t, "jar", received, "verified bodies are restored for the handler")
+	assert.Equal(t, http.StatusOK, serve("jar", DigestHeader, "SHA-256="+sha256Base64("jar")))
+	assert.Equal(t, http.StatusOK, serve("jar", ContentMD5Header, base64.StdEncoding.EncodeToString(md5Sum[:])))
+	assert.Equal(t, http.StatusOK, serve("jar", ContentDigestHeader, "unixsum=:AAA=:"), "unsupported algorithms are ignored")
+
+	assert.Equal(t, http.StatusBadRequest, serve("jar", ContentDigestHeader, "sha-256=:"+sha256Base64("war")+":"))
+	assert.Empty(t, received)
+	assert.Equal(t, http.StatusBadRequest, serve("jar", ContentMD5Header, "not base64"))
+
+	// bodies over MaxBufferedBytes are verified as the handler reads them
+	assert.Equal(t, http.StatusOK, serve("large artifact", ContentDigestHeader, "sha-256=:"+sha256Base64("large artifact")+":"))
+	assert.NoError(t, readErr)
+	assert.Equal(t, "large artifact", received)
+	serve("large artifact", ContentDigestHeader, "sha-256=:"+sha256Base64("other artifact")+":")
+	assert.ErrorIs(t, readErr, ErrDigestMismatch)
+}
+
+func TestDigestAddsResponseDigests(t *testing.T) {
+	body := "artifact"
+	flush := false
+	g := digestEngine(t, DigestConfiguration{ResponseAlgorithms: []string{"SHA-256", "md5"}}, func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+		_, _ = c.Writer.WriteString(body)
+		if flush {
+			c.Writer.Flush()
+		}
+	})
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/artifacts", nil))
+	md5Sum := md5.Sum([]byte(body))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, body, w.Body.String())
+	assert.Equal(t, "sha-256=:"+sha256Base64(body)+":", w.Header().Get(ContentDigestHeader))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(md5Sum[:]), w.Header().Get(ContentMD5Header))
+
+	flush = true
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/artifacts", nil))
+	assert.Equal(t, body, w.Body.String())
+	assert.Empty(t, w.Header().Get(ContentDigestHeader), "streamed responses don't get digests")
+}
+
+func TestNewDigestsRejectsUnknownAlgorithms(t *testing.T) {
+	_, err := newDigests(DigestConfiguration{ResponseAlgorithms: []string{"crc32"}}, zap.NewNop().Sugar())
+	assert.ErrorContains(t, err, `unsupported response digest algorithm "crc32"`)
+
+	d, err := newDigests(DigestConfiguration{}, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+}
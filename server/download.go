@@ -0,0 +1,242 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/server/serr"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// DownloadConfiguration configures how Download serves objects
+	DownloadConfiguration struct {
+		// Redirect when true the client is sent a 302 to a time limited signed URL instead of the server streaming the object
+		Redirect bool
+		// SignedURLExpiry how long redirect URLs are valid for, defaults to the blob.Store default
+		SignedURLExpiry time.Duration
+		// Attachment when true a Content-Disposition header is set so browsers save the object using the base name of its key
+		Attachment bool
+	}
+)
+
+var (
+	errDownloadNotFound = serr.APIError{
+		Message:        "The requested file was not found",
+		HttpStatusCode: http.StatusNotFound,
+	}
+	errDownloadFailed = serr.APIError{
+		Message:        "Failed to download the requested file",
+		HttpStatusCode: http.StatusInternalServerError,
+	}
+	errRangeNotSatisfiable = serr.APIError{
+		Message:        "The requested range is not satisfiable",
+		HttpStatusCode: http.StatusRequestedRangeNotSatisfiable,
+	}
+)
+
+func Example_Download() {
+	var store blob.Store
+
+	NewHandler(func(ctx context.Context, _ Void) (*Response[io.ReadCloser], serr.Error) {
+		return Download(ctx, store, "artifacts/release.tar.gz", DownloadConfiguration{Redirect: true})
+	}, HandlerConfig{
+		Path:     "/artifacts/release",
+		Method:   http.MethodGet,
+		Produces: "application/octet-stream", // <- required, Download returns a ReadCloser
+	})
+}
+
+// Download serves the object stored at key, either by streaming it through the server or by redirecting the client to a signed URL.
+// Conditional (If-Modified-Since, If-Range) and single Range requests are honored, the handler must produce application/octet-stream.
+func Download(ctx context.Context, store blob.Store, key string, config DownloadConfiguration) (*Response[io.ReadCloser], serr.Error) {
+	details, sErr := ExtractRequestDetailsFromContext(ctx)
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return nil, downloadError(err)
+	}
+
+	headers := map[string][]string{
+		"Accept-Ranges": {"bytes"},
+	}
+	if !info.LastModified.IsZero() {
+		headers["Last-Modified"] = []string{info.LastModified.UTC().Format(http.TimeFormat)}
+	}
+	if etag := quoteETag(info.ETag); etag != "" {
+		headers["ETag"] = []string{etag}
+	}
+	if config.Attachment {
+		headers["Content-Disposition"] = []string{mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)})}
+	}
+
+	if notModified(details.Headers, info) {
+		return &Response[io.ReadCloser]{
+			StatusCode: http.StatusNotModified,
+			Headers:    headers,
+			Body:       http.NoBody,
+		}, nil
+	}
+
+	if config.Redirect {
+		// the storage provider handles the Range header when the client follows the redirect
+		url, err := store.SignedURL(ctx, key, blob.SignedURLOptions{Method: http.MethodGet, Expires: config.SignedURLExpiry})
+		if err != nil {
+			return nil, downloadError(err)
+		}
+		return &Response[io.ReadCloser]{
+			StatusCode: http.StatusFound,
+			Headers: map[string][]string{
+				"Location":      {url},
+				"Cache-Control": {"no-store"},
+			},
+			Body: http.NoBody,
+		}, nil
+	}
+
+	byteRange, satisfiable := parseRange(details.Headers, info)
+	if !satisfiable {
+		return nil, serr.NewErrorResponseFromApiError(errRangeNotSatisfiable,
+			serr.WithErrorMessage(fmt.Sprintf("The range %q is outside of the %d byte file", details.Headers.Get("Range"), info.Size)),
+			// RFC 9110 15.5.17, the size of the file is sent so the client can request a range within it
+			serr.WithExtraResponseHeaders(serr.KVPair{Key: "Content-Range", Value: fmt.Sprintf("bytes */%d", info.Size)}),
+		)
+	}
+
+	obj, err := store.GetRange(ctx, key, byteRange)
+	if err != nil {
+		return nil, downloadError(err)
+	}
+
+	if byteRange == (blob.ByteRange{}) {
+		headers["Content-Length"] = []string{strconv.FormatInt(info.Size, 10)}
+		return &Response[io.ReadCloser]{Headers: headers, Body: obj.Body}, nil
+	}
+
+	headers["Content-Length"] = []string{strconv.FormatInt(byteRange.Length, 10)}
+	headers["Content-Range"] = []string{fmt.Sprintf("bytes %d-%d/%d", byteRange.Offset, byteRange.Offset+byteRange.Length-1, info.Size)}
+	return &Response[io.ReadCloser]{
+		StatusCode: http.StatusPartialContent,
+		Headers:    headers,
+		Body:       obj.Body,
+	}, nil
+}
+
+func downloadError(err error) serr.Error {
+	if errors.Is(err, blob.ErrNotFound) {
+		return serr.NewErrorResponseFromApiError(errDownloadNotFound, serr.WithCause(err), serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace))
+	}
+	return serr.NewErrorResponseFromApiError(errDownloadFailed, serr.WithCause(err))
+}
+
+// notModified evaluates If-Modified-Since, which HTTP dates only express with second precision
+func notModified(headers http.Header, info *blob.ObjectInfo) bool {
+	if info.LastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(headers.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !info.LastModified.Truncate(time.Second).After(since)
+}
+
+// parseRange resolves a single byte range request against the object, the zero ByteRange means the whole object should be served.
+// Multiple ranges, malformed ranges and stale If-Range validators fall back to the whole object as permitted by RFC 9110.
+func parseRange(headers http.Header, info *blob.ObjectInfo) (blob.ByteRange, bool) {
+	header := headers.Get("Range")
+	if header == "" || !ifRangeMatches(headers.Get("If-Range"), info) {
+		return blob.ByteRange{}, true
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return blob.ByteRange{}, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return blob.ByteRange{}, true
+	}
+
+	// suffix range, i.e. bytes=-500 requests the final 500 bytes
+	if first == "" {
+		length, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || length < 0 {
+			return blob.ByteRange{}, true
+		}
+		if length == 0 || info.Size == 0 {
+			return blob.ByteRange{}, false
+		}
+		if length >= info.Size {
+			return blob.ByteRange{}, true
+		}
+		return blob.ByteRange{Offset: info.Size - length, Length: length}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return blob.ByteRange{}, true
+	}
+	if start >= info.Size {
+		return blob.ByteRange{}, false
+	}
+	end := info.Size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return blob.ByteRange{}, true
+		}
+		if end >= info.Size {
+			end = info.Size - 1
+		}
+	}
+	if start == 0 && end == info.Size-1 {
+		return blob.ByteRange{}, true
+	}
+	return blob.ByteRange{Offset: start, Length: end - start + 1}, true
+}
+
+func ifRangeMatches(ifRange string, info *blob.ObjectInfo) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		// If-Range requires a strong comparison
+		return info.ETag != "" && ifRange == quoteETag(info.ETag)
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && info.LastModified.Truncate(time.Second).Equal(since)
+}
+
+// quoteETag GCS returns unquoted entity tags while S3 and Azure quote them
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return strconv.Quote(etag)
+}
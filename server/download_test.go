@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/blob"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDownloadStore struct {
+	blob.Store
+	content      string
+	lastModified time.Time
+}
+
+func (f *fakeDownloadStore) Stat(_ context.Context, key string) (*blob.ObjectInfo, error) {
+	if key != "release.tar.gz" {
+		return nil, blob.ErrNotFound
+	}
+	return &blob.ObjectInfo{Key: key, Size: int64(len(f.content)), ETag: "abc", LastModified: f.lastModified}, nil
+}
+
+func (f *fakeDownloadStore) GetRange(ctx context.Context, key string, r blob.ByteRange) (*blob.Object, error) {
+	info, err := f.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	content := f.content[r.Offset:]
+	if r.Length > 0 {
+		content = content[:r.Length]
+	}
+	return &blob.Object{ObjectInfo: *info, Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+func (f *fakeDownloadStore) SignedURL(_ context.Context, key string, _ blob.SignedURLOptions) (string, error) {
+	return "https://storage.example.com/" + key + "?sig=signed", nil
+}
+
+func TestDownload(t *testing.T) {
+	lastModified := time.Date(2023, 1, 2, 3, 4, 5, 600, time.UTC)
+	store := &fakeDownloadStore{content: "0123456789", lastModified: lastModified}
+
+	cases := []struct {
+		name           string
+		key            string
+		config         DownloadConfiguration
+		headers        http.Header
+		expectedStatus int
+		expectedBody   string
+		expectedHeader map[string]string
+		expectedError  int
+	}{
+		{
+			name:           "streams the whole object",
+			key:            "release.tar.gz",
+			expectedBody:   "0123456789",
+			expectedHeader: map[string]string{"Content-Length": "10", "ETag": `"abc"`, "Accept-Ranges": "bytes"},
+		},
+		{
+			name:           "serves a byte range",
+			key:            "release.tar.gz",
+			headers:        http.Header{"Range": {"bytes=2-4"}},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "234",
+			expectedHeader: map[string]string{"Content-Range": "bytes 2-4/10", "Content-Length": "3"},
+		},
+		{
+			name:           "serves a suffix range",
+			key:            "release.tar.gz",
+			headers:        http.Header{"Range": {"bytes=-3"}},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "789",
+			expectedHeader: map[string]string{"Content-Range": "bytes 7-9/10"},
+		},
+		{
+			name:           "rejects unsatisfiable ranges",
+			key:            "release.tar.gz",
+			headers:        http.Header{"Range": {"bytes=20-"}},
+			expectedError:  http.StatusRequestedRangeNotSatisfiable,
+			expectedHeader: map[string]string{"Content-Range": "bytes */10"},
+		},
+		{
+			name:         "ignores multiple ranges",
+			key:          "release.tar.gz",
+			headers:      http.Header{"Range": {"bytes=0-1,4-5"}},
+			expectedBody: "0123456789",
+		},
+		{
+			name:         "ignores ranges when If-Range does not match",
+			key:          "release.tar.gz",
+			headers:      http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"stale"`}},
+			expectedBody: "0123456789",
+		},
+		{
+			name:           "honors ranges when If-Range matches",
+			key:            "release.tar.gz",
+			headers:        http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"abc"`}},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "234",
+		},
+		{
+			name:           "not modified since",
+			key:            "release.tar.gz",
+			headers:        http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}},
+			expectedStatus: http.StatusNotModified,
+		},
+		{
+			name:         "modified since",
+			key:          "release.tar.gz",
+			headers:      http.Header{"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}},
+			expectedBody: "0123456789",
+		},
+		{
+			name:           "redirects to a signed url",
+			key:            "release.tar.gz",
+			config:         DownloadConfiguration{Redirect: true},
+			expectedStatus: http.StatusFound,
+			expectedHeader: map[string]string{"Location": "https://storage.example.com/release.tar.gz?sig=signed"},
+		},
+		{
+			name:          "not found",
+			key:           "missing",
+			expectedError: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			headers := c.headers
+			if headers == nil {
+				headers = http.Header{}
+			}
+			ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{Headers: headers})
+
+			res, err := Download(ctx, store, c.key, c.config)
+			if c.expectedError != 0 {
+				assert.NotNil(t, err)
+				assert.Equal(t, c.expectedError, err.Errors()[0].HttpStatusCode)
+				for k, v := range c.expectedHeader {
+					assert.Contains(t, err.ExtraResponseHeaders(), serr.KVPair{Key: k, Value: v}, k)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.expectedStatus, res.StatusCode)
+
+			body, _ := io.ReadAll(res.Body)
+			assert.Equal(t, c.expectedBody, string(body))
+			for k, v := range c.expectedHeader {
+				assert.Equal(t, []string{v}, res.Headers[k], k)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStreamMediaType the media type of server-sent events, handlers producing it return an *EventStream as the body of their response
+const EventStreamMediaType = "text/event-stream"
+
+const (
+	// defaultEventStreamHeartbeat the default interval of EventStream.WithHeartbeat, below the idle timeout of common proxies
+	defaultEventStreamHeartbeat = 15 * time.Second
+	eventStreamEventsMetric     = "http.server.events"
+	lastEventIDHeader           = "Last-Event-ID"
+)
+
+var errEventStreamClosed = errors.New("event stream closed")
+
+type (
+	// Event a server-sent event
+	Event struct {
+		// ID the id of the event, clients send the id of the last event they received when they reconnect, see LastEventID
+		ID string
+		// Name the type of the event, events without one are received as message events
+		Name string
+		// Data the payload of the event, strings and []byte are sent as is and other values are marshaled to JSON
+		Data any
+		// Retry how long clients wait before reconnecting once the stream ends
+		Retry time.Duration
+	}
+
+	// EventSender sends an event to the client and flushes it, it fails once the client left
+	EventSender func(event Event) error
+
+	// EventStream the body of the responses of handlers producing EventStreamMediaType. The status and headers of the response are
+	// written before the stream is produced, events are flushed as they are sent and the response ends when the producer returns:
+	//
+	//	func (c *deploymentController) watch(ctx context.Context, _ server.Void) (*server.Response[*server.EventStream], serr.Error) {
+	//		return server.SimpleResponse(server.NewEventStream(func(ctx context.Context, send server.EventSender) serr.Error {
+	//			for update := range c.updates.Subscribe(ctx) {
+	//				if err := send(server.Event{ID: update.ID, Name: "deployment", Data: update}); err != nil {
+	//					return nil
+	//				}
+	//			}
+	//			return nil
+	//		})), nil
+	//	}
+	//
+	// Errors returned by the producer are logged like those of other handlers and sent to the client as an error event holding the
+	// error response
+	EventStream struct {
+		produce   func(ctx context.Context, send EventSender) serr.Error
+		heartbeat time.Duration
+	}
+
+	// eventStreamWriter writes the events of a stream and its heartbeats to the response
+	eventStreamWriter struct {
+		mu     sync.Mutex
+		w      gin.ResponseWriter
+		ctx    context.Context
+		closed bool
+	}
+)
+
+// NewEventStream creates the stream the producer sends events to, the context of the producer is done when the client leaves
+func NewEventStream(produce func(ctx context.Context, send EventSender) serr.Error) *EventStream {
+	return &EventStream{produce: produce, heartbeat: defaultEventStreamHeartbeat}
+}
+
+// WithHeartbeat sends a comment every interval so proxies don't close idle streams, 0 disables heartbeats. Defaults to 15 seconds
+func (s *EventStream) WithHeartbeat(interval time.Duration) *EventStream {
+	s.heartbeat = interval
+	return s
+}
+
+// LastEventID the id of the last event a reconnecting client received, empty on the first connection
+func LastEventID(ctx context.Context) string {
+	details, ok := requestDetailsKey.Value(ctx)
+	if !ok {
+		return ""
+	}
+	return details.Headers.Get(lastEventIDHeader)
+}
+
+// writeEventStream streams the events of the body until its producer returns or the client leaves
+func writeEventStream(c *gin.Context, body any, logger *zap.SugaredLogger) {
+	stream, ok := body.(*EventStream)
+	if !ok || stream == nil || stream.produce == nil {
+		writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(serr.APIError{
+			Message:        "Failed to write response",
+			HttpStatusCode: http.StatusInternalServerError,
+		},
+			serr.WithErrorMessage(fmt.Sprintf("Handler specified that it produces %s but didn't return an *EventStream as the response", EventStreamMediaType)),
+		), logger)
+		return
+	}
+
+	ctx := c.Request.Context()
+	header := c.Writer.Header()
+	header.Set("Content-Type", EventStreamMediaType)
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", "no-cache")
+	}
+	// keeps proxies such as nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	timings := phaseTimingsOf(ctx)
+	timings.beforeWrite(header)
+	defer timings.start(phaseWrite)()
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	w := &eventStreamWriter{w: c.Writer, ctx: ctx}
+	defer w.close()
+	if stream.heartbeat > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go w.heartbeats(stream.heartbeat, done)
+	}
+
+	send := func(event Event) error {
+		if err := w.send(event); err != nil {
+			return err
+		}
+		if ms, ok := handlerMetricsKey.Value(ctx); ok {
+			ms.CounterWithTags(eventStreamEventsMetric, map[string]string{"event": event.Name}).Inc(1)
+		}
+		return nil
+	}
+	apiErr := stream.produce(ctx, send)
+	if apiErr == nil || ClientDisconnected(ctx) {
+		return
+	}
+	errorID := uuid.NewString()
+	statusCode := serr.StatusCode(apiErr)
+	LogAPIError(c.Request, errorID, apiErr, statusCode, logger)
+	contract := apiErr.ToErrorResponseContract(errorID)
+	if includesCauseChain(c.Request) {
+		contract.Causes = apiErr.CauseChain()
+	}
+	_ = w.send(Event{Name: "error", Data: contract})
+}
+
+func (w *eventStreamWriter) send(event Event) error {
+	var buf bytes.Buffer
+	if event.ID != "" {
+		writeEventField(&buf, "id", event.ID)
+	}
+	if event.Name != "" {
+		writeEventField(&buf, "event", event.Name)
+	}
+	if event.Retry > 0 {
+		writeEventField(&buf, "retry", fmt.Sprint(event.Retry.Milliseconds()))
+	}
+	var data string
+	switch d := event.Data.(type) {
+	case nil:
+	case string:
+		data = d
+	case []byte:
+		data = string(d)
+	default:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	// every line of the data is a field of its own, clients join them back with new lines
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		writeEventField(&buf, "data", line)
+	}
+	buf.WriteByte('\n')
+	return w.write(buf.Bytes())
+}
+
+func (w *eventStreamWriter) write(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errEventStreamClosed
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return nil
+}
+
+// heartbeats sends a comment every interval until done
+func (w *eventStreamWriter) heartbeats(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = w.write([]byte(":\n\n"))
+		}
+	}
+}
+
+// close fails the sends of producers that kept the sender after they returned
+func (w *eventStreamWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
+
+func writeEventField(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type deploymentUpdate struct {
+	Stage string `json:"stage"`
+}
+
+type eventStreamController struct{}
+
+func (eventStreamController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, _ Void) (*Response[[]deploymentUpdate], serr.Error) {
+			return SimpleResponse([]deploymentUpdate{{Stage: "deploy"}}), nil
+		}, HandlerConfig{
+			Path:     "/deployments/:id/updates",
+			Method:   http.MethodGet,
+			Produces: applicationJSON,
+			Default:  true,
+		}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[*EventStream], serr.Error) {
+			return SimpleResponse(NewEventStream(func(ctx context.Context, send EventSender) serr.Error {
+				if LastEventID(ctx) == "fail" {
+					return serr.NewSimpleErrorWithStatusCode("deployment not found", http.StatusNotFound, nil)
+				}
+				if err := send(Event{Retry: time.Second, Data: "multi\nline"}); err != nil {
+					return nil
+				}
+				for i, stage := range []string{"deploy", "verify"} {
+					if err := send(Event{ID: string(rune('1' + i)), Name: "deployment", Data: deploymentUpdate{Stage: stage}}); err != nil {
+						return nil
+					}
+				}
+				return nil
+			})), nil
+		}, HandlerConfig{
+			Path:     "/deployments/:id/updates",
+			Method:   http.MethodGet,
+			Produces: EventStreamMediaType,
+		}),
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{eventStreamController{}})
+	require.NoError(t, err)
+	for _, handler := range registry.handlers() {
+		assert.Equal(t, handler.Produces == EventStreamMediaType, handler.DisableCoalescing, "event streams are never coalesced")
+	}
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: "org", Type: iam.Machine}))
+	})
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group(""),
+		AuthNotEnforcedGroup: g.Group(""),
+	}))
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+
+	get := func(accept string, lastEventID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/deployments/1/updates", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		if lastEventID != "" {
+			req.Header.Set(lastEventIDHeader, lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res
+	}
+	events := func(res *http.Response) []string {
+		var events []string
+		var event strings.Builder
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				events = append(events, event.String())
+				event.Reset()
+				continue
+			}
+			event.WriteString(scanner.Text() + "\n")
+		}
+		return events
+	}
+
+	res := get(applicationJSON, "")
+	assert.Equal(t, applicationJSON, res.Header.Get("Content-Type"), "clients that don't accept event streams are answered by the other handlers")
+
+	res = get(EventStreamMediaType, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, EventStreamMediaType, res.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{
+		"retry: 1000\ndata: multi\ndata: line\n",
+		"id: 1\nevent: deployment\ndata: {\"stage\":\"deploy\"}\n",
+		"id: 2\nevent: deployment\ndata: {\"stage\":\"verify\"}\n",
+	}, events(res))
+
+	res = get(EventStreamMediaType, "fail")
+	assert.Equal(t, http.StatusOK, res.StatusCode, "the status is sent before the stream is produced")
+	sent := events(res)
+	require.Len(t, sent, 1)
+	data, found := strings.CutPrefix(strings.TrimPrefix(sent[0], "event: error\n"), "data: ")
+	require.True(t, found, sent[0])
+	var contract serr.ResponseContract
+	require.NoError(t, json.Unmarshal([]byte(data), &contract))
+	assert.Equal(t, "deployment not found", contract.Errors[0].Message)
+}
+
+func TestEventStreamHeartbeats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/updates", nil)
+
+	writeEventStream(c, NewEventStream(func(ctx context.Context, send EventSender) serr.Error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}).WithHeartbeat(10*time.Millisecond), zap.NewNop().Sugar())
+	assert.Contains(t, recorder.Body.String(), ":\n\n", "idle streams send heartbeats")
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/updates", nil)
+	writeEventStream(c, "not a stream", zap.NewNop().Sugar())
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/armory-io/go-commons/redact"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"strings"
+)
+
+// extendedErrorsKey marks the gin context of servers that add a request snapshot to error responses
+const extendedErrorsKey = "server.extendedErrors"
+
+var (
+	// sensitiveHeaderFragments headers containing any of these are redacted in snapshots, in addition to sensitiveHeaderNamesInLowerCase
+	sensitiveHeaderFragments = []string{"cookie", "token", "secret", "signature", "api-key"}
+)
+
+type (
+	// extendedErrorResponse the error response contract with a snapshot of the request that failed
+	extendedErrorResponse struct {
+		serr.ResponseContract
+		Debug *requestSnapshot `json:"debug"`
+	}
+
+	// requestSnapshot what the server knew about a request when it failed, only ever sent when running locally
+	requestSnapshot struct {
+		Method     string            `json:"method"`
+		Route      string            `json:"route,omitempty"`
+		Produces   string            `json:"produces,omitempty"`
+		Consumes   string            `json:"consumes,omitempty"`
+		Arguments  any               `json:"arguments,omitempty"`
+		Headers    map[string]string `json:"headers"`
+		Cause      string            `json:"cause,omitempty"`
+		Origin     string            `json:"origin,omitempty"`
+		Stacktrace string            `json:"stacktrace,omitempty"`
+	}
+)
+
+// extendedErrorsMiddleware enables request snapshots in the error responses of the server
+func extendedErrorsMiddleware(c *gin.Context) {
+	c.Set(extendedErrorsKey, true)
+}
+
+// snapshotRequest captures the request of c, returning nil unless extended errors are enabled for the server
+func snapshotRequest(c *gin.Context, apiErr serr.Error) *requestSnapshot {
+	if !c.GetBool(extendedErrorsKey) {
+		return nil
+	}
+	snapshot := &requestSnapshot{
+		Method:     c.Request.Method,
+		Route:      c.FullPath(),
+		Headers:    redactHeaders(c.Request.Header),
+		Origin:     apiErr.Origin(),
+		Stacktrace: apiErr.Stacktrace(),
+	}
+	if content, ok := ExtractNegotiatedContentFromContext(c.Request.Context()); ok {
+		snapshot.Produces = content.Produces.String()
+		snapshot.Consumes = content.Consumes.String()
+	}
+	if args, ok := requestArgumentsKey.Value(c.Request.Context()); ok {
+		snapshot.Arguments = redact.Value(args)
+	}
+	if apiErr.Cause() != nil {
+		snapshot.Cause = apiErr.Cause().Error()
+	}
+	return snapshot
+}
+
+func redactHeaders(headers http.Header) map[string]string {
+	redacted := make(map[string]string, len(headers))
+	for name, values := range headers {
+		lower := strings.ToLower(name)
+		sensitive := slices.Contains(sensitiveHeaderNamesInLowerCase, lower)
+		for _, fragment := range sensitiveHeaderFragments {
+			sensitive = sensitive || strings.Contains(lower, fragment)
+		}
+		if sensitive {
+			redacted[name] = "[MASKED]"
+			continue
+		}
+		redacted[name] = strings.Join(values, ",")
+	}
+	return redacted
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/elnormous/contenttype"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestExtendedErrorResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	failing := func(c *gin.Context) {
+		ctx := AddNegotiatedContentToCtx(c.Request.Context(), NegotiatedContent{
+			Produces: contenttype.NewMediaType("application/json"),
+			Consumes: contenttype.NewMediaType("application/json"),
+		})
+		ctx = addRequestArgumentsToCtx(ctx, map[string]string{"deploymentId": c.Param("id")})
+		c.Request = c.Request.WithContext(ctx)
+		writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(serr.APIError{
+			Message:        "Deployment not found",
+			HttpStatusCode: http.StatusNotFound,
+		}, serr.WithCause(errors.New("sql: no rows in result set"))), zap.NewNop().Sugar())
+	}
+
+	serve := func(extended bool) map[string]any {
+		g := gin.New()
+		if extended {
+			g.Use(extendedErrorsMiddleware)
+		}
+		g.GET("/deployments/:id", failing)
+
+		req := httptest.NewRequest(http.MethodGet, "/deployments/dep-1", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		req.Header.Set("X-Api-Key", "secret")
+		req.Header.Set("X-Request-Id", "req-1")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		var body map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+
+	assert.NotContains(t, serve(false), "debug")
+
+	body := serve(true)
+	assert.NotEmpty(t, body["error_id"])
+	assert.Len(t, body["errors"], 1)
+	debug := body["debug"].(map[string]any)
+	assert.Equal(t, "GET", debug["method"])
+	assert.Equal(t, "/deployments/:id", debug["route"])
+	assert.Equal(t, "application/json", debug["produces"])
+	assert.Equal(t, map[string]any{"deploymentId": "dep-1"}, debug["arguments"])
+	assert.Equal(t, "sql: no rows in result set", debug["cause"])
+	assert.Equal(t, map[string]any{
+		"Authorization": "[MASKED]",
+		"X-Api-Key":     "[MASKED]",
+		"X-Request-Id":  "req-1",
+	}, debug["headers"])
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/server/serr"
+	"net/http"
+	"sync"
+)
+
+type (
+	// FanOutTarget a downstream call of a fan-out, Name identifies the target in the results and in error metadata
+	FanOutTarget[T any] struct {
+		Name string
+		Call func(ctx context.Context) (T, error)
+	}
+
+	// FanOutResult the outcome of the call to a target
+	FanOutResult[T any] struct {
+		Target string `json:"target"`
+		// Status the HTTP status of the outcome, 200 for successful calls
+		Status int                             `json:"status"`
+		Body   *T                              `json:"body,omitempty"`
+		Errors []serr.ResponseContractErrorDTO `json:"errors,omitempty"`
+		err    serr.Error
+	}
+
+	// FanOutResults the outcomes of the calls, in the order of the targets
+	FanOutResults[T any] []FanOutResult[T]
+
+	// MultiStatus the body of a multi-status response, see FanOutResults.MultiStatus
+	MultiStatus[T any] struct {
+		Results []FanOutResult[T] `json:"results"`
+	}
+)
+
+// FanOut calls the targets concurrently, at most limit at once or all of them when limit isn't positive, and returns once every
+// call has returned. Failed calls don't cancel the others, so handlers can respond with the partial results:
+//
+//	results := server.FanOut(ctx, 5, targets)
+//	return results.MultiStatus(), nil
+//
+// or fail the request with the errors of every target:
+//
+//	if err := results.Err(serr.WithErrorMessage("Failed to aggregate clusters")); err != nil {
+//		return nil, err
+//	}
+//
+// Failed calls are reported as a 502, or a 504 when the call ran out of time
+func FanOut[T any](ctx context.Context, limit int, targets []FanOutTarget[T]) FanOutResults[T] {
+	if limit <= 0 || limit > len(targets) {
+		limit = len(targets)
+	}
+	results := make(FanOutResults[T], len(targets))
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, target FanOutTarget[T]) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = callFanOutTarget(ctx, target)
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+func callFanOutTarget[T any](ctx context.Context, target FanOutTarget[T]) FanOutResult[T] {
+	result := FanOutResult[T]{Target: target.Name, Status: http.StatusOK}
+	body, err := target.Call(ctx)
+	if err == nil {
+		result.Body = &body
+		return result
+	}
+
+	result.Status = http.StatusBadGateway
+	message := "Downstream call failed"
+	if errors.Is(err, context.DeadlineExceeded) {
+		result.Status = http.StatusGatewayTimeout
+		message = "Downstream call timed out"
+	}
+	result.err = serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        message,
+		Metadata:       map[string]any{"target": target.Name},
+		HttpStatusCode: result.Status,
+	}, serr.WithCause(err))
+	result.Errors = result.err.ToErrorResponseContract("").Errors
+	return result
+}
+
+// Values the bodies of the successful calls by target
+func (r FanOutResults[T]) Values() map[string]T {
+	values := make(map[string]T, len(r))
+	for _, result := range r {
+		if result.Body != nil {
+			values[result.Target] = *result.Body
+		}
+	}
+	return values
+}
+
+// Failed the number of calls that failed
+func (r FanOutResults[T]) Failed() int {
+	failed := 0
+	for _, result := range r {
+		if result.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Err the aggregated errors of the failed calls with the target in the metadata of each API error, nil when every call succeeded
+func (r FanOutResults[T]) Err(opts ...serr.Option) serr.Error {
+	var errs serr.Accumulator
+	for _, result := range r {
+		errs.AddError(result.err)
+	}
+	return errs.Err(opts...)
+}
+
+// MultiStatus a response with the outcome of every call, 207 when any call failed and 200 otherwise
+func (r FanOutResults[T]) MultiStatus() *Response[MultiStatus[T]] {
+	statusCode := http.StatusOK
+	if r.Failed() > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	return &Response[MultiStatus[T]]{Body: MultiStatus[T]{Results: r}, StatusCode: statusCode}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOut(t *testing.T) {
+	var active, peak atomic.Int32
+	call := func(name string, err error) FanOutTarget[string] {
+		return FanOutTarget[string]{Name: name, Call: func(ctx context.Context) (string, error) {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return "cluster " + name, err
+		}}
+	}
+
+	results := FanOut(context.Background(), 2, []FanOutTarget[string]{
+		call("us-east", nil),
+		call("us-west", errors.New("connection refused")),
+		call("eu", errors.New("connection reset")),
+		call("ap", context.DeadlineExceeded),
+	})
+	assert.LessOrEqual(t, peak.Load(), int32(2), "at most limit calls run at once")
+
+	require.Len(t, results, 4)
+	assert.Equal(t, map[string]string{"us-east": "cluster us-east"}, results.Values())
+	assert.Equal(t, 3, results.Failed())
+	assert.Equal(t, []int{http.StatusOK, http.StatusBadGateway, http.StatusBadGateway, http.StatusGatewayTimeout}, []int{results[0].Status, results[1].Status, results[2].Status, results[3].Status})
+	assert.Equal(t, "Downstream call failed", results[1].Errors[0].Message)
+	assert.Equal(t, map[string]any{"target": "us-west"}, results[1].Errors[0].Metadata)
+
+	err := results.Err(serr.WithErrorMessage("Failed to aggregate clusters"))
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, serr.StatusCode(err))
+	require.Len(t, err.Errors(), 3)
+	assert.Equal(t, "eu", err.Errors()[1].Metadata["target"])
+	assert.ErrorIs(t, err.Cause(), context.DeadlineExceeded)
+
+	response := results.MultiStatus()
+	assert.Equal(t, http.StatusMultiStatus, response.StatusCode)
+	assert.Len(t, response.Body.Results, 4)
+
+	succeeded := FanOut(context.Background(), 0, []FanOutTarget[string]{call("us-east", nil)})
+	assert.Nil(t, succeeded.Err())
+	assert.Equal(t, http.StatusOK, succeeded.MultiStatus().StatusCode)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// FeatureDisabledErrorCode the code of the errors answering requests to handlers whose HandlerConfig.RequiredFeatures are off
+const FeatureDisabledErrorCode = 4601
+
+type (
+	// FeatureFlags evaluates the flags of HandlerConfig.RequiredFeatures for the org of the principal of a request, provide one
+	// backed by the feature flag service of the application to gate handlers
+	FeatureFlags interface {
+		// Enabled whether the flag is on for the org, the org is empty for requests without a principal
+		Enabled(ctx context.Context, flag string, orgID string) (bool, error)
+	}
+
+	// featureGate answers the requests of handlers whose required features are off, see HandlerConfig.RequiredFeatures
+	featureGate struct {
+		flags      FeatureFlags
+		statusCode int
+		log        *zap.SugaredLogger
+	}
+)
+
+// newFeatureGate validates the status of the responses of gated handlers, 404 by default or 403
+func newFeatureGate(flags FeatureFlags, statusCode int, log *zap.SugaredLogger) (*featureGate, error) {
+	switch statusCode {
+	case 0:
+		statusCode = http.StatusNotFound
+	case http.StatusNotFound, http.StatusForbidden:
+	default:
+		return nil, fmt.Errorf("handlers with disabled features must respond with %d or %d, not %d", http.StatusNotFound, http.StatusForbidden, statusCode)
+	}
+	return &featureGate{flags: flags, statusCode: statusCode, log: log}, nil
+}
+
+// wrap returns a handler func that only calls next when every required feature of the handler is on for the org of the principal.
+// Flags that fail to be evaluated are considered off
+func (g *featureGate) wrap(handler *handlerDTO, next gin.HandlerFunc) (gin.HandlerFunc, error) {
+	if len(handler.RequiredFeatures) == 0 {
+		return next, nil
+	}
+	if g == nil || g.flags == nil {
+		return nil, fmt.Errorf("handler with method: %s, path: %s requires features %v but no server.FeatureFlags was provided", handler.Method, handler.Path, handler.RequiredFeatures)
+	}
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var orgID string
+		if principal, err := iam.ExtractPrincipalFromContext(ctx); err == nil && principal != nil {
+			orgID = principal.OrgId
+		}
+		for _, flag := range handler.RequiredFeatures {
+			enabled, err := g.flags.Enabled(ctx, flag, orgID)
+			if err != nil {
+				g.log.Warnw("Failed to evaluate a feature flag, it is considered off", "flag", flag, "orgId", orgID, "error", err)
+			}
+			if err != nil || !enabled {
+				writeAndLogApiErrorThenAbort(c, g.featureDisabled(flag), g.log)
+				return
+			}
+		}
+		next(c)
+	}, nil
+}
+
+// featureDisabled the error of requests for a disabled feature, 404s don't reveal the feature exists
+func (g *featureGate) featureDisabled(flag string) serr.Error {
+	apiErr := serr.APIError{
+		Code:           FeatureDisabledErrorCode,
+		Message:        "Not Found",
+		HttpStatusCode: g.statusCode,
+	}
+	if g.statusCode == http.StatusForbidden {
+		apiErr.Message = "This feature is not enabled for your organization"
+		apiErr.Metadata = map[string]any{"feature": flag}
+	}
+	return serr.NewErrorResponseFromApiError(apiErr,
+		serr.WithErrorMessage(fmt.Sprintf("Request for a handler whose feature %s is off", flag)),
+		serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+	)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type (
+	fakeFeatureFlags map[string][]string
+
+	gatedController struct{}
+)
+
+func (f fakeFeatureFlags) Enabled(_ context.Context, flag string, orgID string) (bool, error) {
+	if orgID == "flaky" {
+		return false, errors.New("flag service unavailable")
+	}
+	for _, org := range f[flag] {
+		if org == orgID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (gatedController) Handlers() []Handler {
+	ok := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(ok, HandlerConfig{Path: "/canary", Method: http.MethodGet, RequiredFeatures: []string{"canary-analysis", "new-ui"}}),
+		NewHandler(ok, HandlerConfig{Path: "/deployments", Method: http.MethodGet}),
+	}
+}
+
+func TestFeatureGate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	flags := fakeFeatureFlags{"canary-analysis": {"org-1", "org-2"}, "new-ui": {"org-1"}}
+
+	serve := func(statusCode int, org string, path string) *httptest.ResponseRecorder {
+		gate, err := newFeatureGate(flags, statusCode, zap.NewNop().Sugar())
+		require.NoError(t, err)
+		registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), nil, nil, []IController{gatedController{}})
+		require.NoError(t, err)
+		g := gin.New()
+		g.Use(func(c *gin.Context) {
+			c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: org, Type: iam.User}))
+		})
+		require.NoError(t, registry.registerHandlers(registerHandlersInput{
+			AuthRequiredGroup:    g.Group(""),
+			AuthNotEnforcedGroup: g.Group(""),
+			FeatureGate:          gate,
+		}))
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	errorOf := func(rec *httptest.ResponseRecorder) serr.ResponseContractErrorDTO {
+		var contract serr.ResponseContract
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&contract))
+		require.Len(t, contract.Errors, 1)
+		return contract.Errors[0]
+	}
+
+	assert.Equal(t, http.StatusOK, serve(0, "org-1", "/canary").Code)
+	assert.Equal(t, http.StatusOK, serve(0, "org-3", "/deployments").Code, "handlers without required features aren't gated")
+
+	rec := serve(0, "org-2", "/canary")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "every required feature must be on")
+	body := errorOf(rec)
+	assert.Equal(t, "4601", body.Code)
+	assert.Empty(t, body.Metadata, "404s don't reveal the feature")
+
+	rec = serve(http.StatusForbidden, "org-3", "/canary")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, map[string]any{"feature": "canary-analysis"}, errorOf(rec).Metadata)
+
+	assert.Equal(t, http.StatusNotFound, serve(0, "flaky", "/canary").Code, "flags that fail to be evaluated are off")
+}
+
+func TestFeatureGateConfiguration(t *testing.T) {
+	_, err := newFeatureGate(nil, http.StatusServiceUnavailable, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "handlers with disabled features must respond with 404 or 403, not 503")
+
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), nil, nil, []IController{gatedController{}})
+	require.NoError(t, err)
+	g := gin.New()
+	err = registry.registerHandlers(registerHandlersInput{AuthRequiredGroup: g.Group(""), AuthNotEnforcedGroup: g.Group("")})
+	assert.EqualError(t, err, "handler with method: GET, path: /canary requires features [canary-analysis new-ui] but no server.FeatureFlags was provided")
+}
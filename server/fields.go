@@ -0,0 +1,191 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// FieldsQueryParameter the query parameter callers use to request a sparse fieldset, ex: ?fields=metadata.name,status
+	FieldsQueryParameter = "fields"
+
+	defaultMaxFieldDepth = 5
+	defaultMaxFields     = 50
+)
+
+var fieldSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// FieldFilterConfiguration limits the sparse fieldsets a caller may request
+type FieldFilterConfiguration struct {
+	// MaxDepth the maximum number of dot separated segments in a single field, defaults to 5
+	MaxDepth int
+	// MaxFields the maximum number of fields that may be requested, defaults to 50
+	MaxFields int
+}
+
+// FieldFilterResponseProcessor returns a ResponseProcessorFn that trims JSON responses down to the fields requested with ?fields=.
+// Fields are dot separated paths into the response, arrays are traversed transparently so ?fields=items.metadata.name keeps the
+// name of every item in a list response. Responses are returned unchanged when the parameter isn't present.
+//
+// Handlers opt in by registering the processor, or a controller can apply it to all of its handlers via IControllerPostResponseProcessor.
+//
+//	handler := server.NewHandler(c.list, server.HandlerConfig{Method: http.MethodGet})
+//	handler.RegisterResponseProcessor(server.FieldFilterResponseProcessor(server.FieldFilterConfiguration{}))
+func FieldFilterResponseProcessor(config FieldFilterConfiguration) ResponseProcessorFn {
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = defaultMaxFieldDepth
+	}
+	if config.MaxFields <= 0 {
+		config.MaxFields = defaultMaxFields
+	}
+
+	return func(ctx context.Context, body []byte) ([]byte, serr.Error) {
+		details, sErr := ExtractRequestDetailsFromContext(ctx)
+		if sErr != nil {
+			return nil, sErr
+		}
+
+		requested := details.QueryParameters[FieldsQueryParameter]
+		if len(requested) == 0 {
+			return body, nil
+		}
+
+		fields, err := parseFields(requested, config)
+		if err != nil {
+			return nil, serr.NewErrorResponseFromApiError(serr.APIError{
+				Message:        fmt.Sprintf("Invalid %s query parameter", FieldsQueryParameter),
+				HttpStatusCode: http.StatusBadRequest,
+			},
+				serr.WithCause(err),
+				serr.WithErrorMessage(err.Error()),
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			)
+		}
+		if fields == nil {
+			return body, nil
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		// preserve the exact representation of numbers, they would otherwise be round-tripped through float64
+		decoder.UseNumber()
+		var decoded any
+		if err := decoder.Decode(&decoded); err != nil {
+			return nil, serr.NewErrorResponseFromApiError(serr.APIError{
+				Message:        "Failed to filter response",
+				HttpStatusCode: http.StatusInternalServerError,
+			}, serr.WithCause(err))
+		}
+
+		filtered, err := json.Marshal(fields.filter(decoded))
+		if err != nil {
+			return nil, serr.NewErrorResponseFromApiError(serr.APIError{
+				Message:        "Failed to filter response",
+				HttpStatusCode: http.StatusInternalServerError,
+			}, serr.WithCause(err))
+		}
+		return filtered, nil
+	}
+}
+
+// fieldSet is a tree of the requested fields, a nil fieldSet for a key means the whole value is kept
+type fieldSet map[string]fieldSet
+
+func parseFields(values []string, config FieldFilterConfiguration) (fieldSet, error) {
+	var root fieldSet
+	count := 0
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+
+			count++
+			if count > config.MaxFields {
+				return nil, fmt.Errorf("at most %d fields may be requested", config.MaxFields)
+			}
+
+			segments := strings.Split(field, ".")
+			if len(segments) > config.MaxDepth {
+				return nil, fmt.Errorf("field %q is nested deeper than the maximum depth of %d", field, config.MaxDepth)
+			}
+			for _, segment := range segments {
+				if !fieldSegmentPattern.MatchString(segment) {
+					return nil, fmt.Errorf("field %q is malformed", field)
+				}
+			}
+
+			if root == nil {
+				root = fieldSet{}
+			}
+			root.add(segments)
+		}
+	}
+	return root, nil
+}
+
+func (f fieldSet) add(segments []string) {
+	children, exists := f[segments[0]]
+	if exists && children == nil {
+		// the whole value was already requested
+		return
+	}
+	if len(segments) == 1 {
+		f[segments[0]] = nil
+		return
+	}
+	if children == nil {
+		children = fieldSet{}
+		f[segments[0]] = children
+	}
+	children.add(segments[1:])
+}
+
+func (f fieldSet) filter(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		filtered := make(map[string]any, len(f))
+		for key, children := range f {
+			child, ok := v[key]
+			if !ok {
+				continue
+			}
+			if children == nil {
+				filtered[key] = child
+			} else {
+				filtered[key] = children.filter(child)
+			}
+		}
+		return filtered
+	case []any:
+		filtered := make([]any, len(v))
+		for i, item := range v {
+			filtered[i] = f.filter(item)
+		}
+		return filtered
+	default:
+		return value
+	}
+}
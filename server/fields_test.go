@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldFilterResponseProcessor(t *testing.T) {
+	body := `{"items":[{"metadata":{"name":"a","id":12345678901234567890},"status":"ok","spec":{"replicas":1}},{"metadata":{"name":"b"},"status":"failed"}],"pagination":{"next":"abc"}}`
+
+	cases := []struct {
+		name           string
+		fields         []string
+		expected       string
+		expectedStatus int
+	}{
+		{
+			name:     "no fields requested",
+			expected: body,
+		},
+		{
+			name:     "nested fields within a list",
+			fields:   []string{"items.metadata.name,items.status"},
+			expected: `{"items":[{"metadata":{"name":"a"},"status":"ok"},{"metadata":{"name":"b"},"status":"failed"}]}`,
+		},
+		{
+			name:     "parent field wins over its children",
+			fields:   []string{"items.metadata.name", "items.metadata", "pagination"},
+			expected: `{"items":[{"metadata":{"name":"a","id":12345678901234567890}},{"metadata":{"name":"b"}}],"pagination":{"next":"abc"}}`,
+		},
+		{
+			name:     "unknown fields are omitted",
+			fields:   []string{"missing, pagination.next"},
+			expected: `{"pagination":{"next":"abc"}}`,
+		},
+		{
+			name:           "malformed field",
+			fields:         []string{"items..name"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "too deep",
+			fields:         []string{"a.b.c.d"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "too many fields",
+			fields:         []string{"a,b,c,d,e"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	processor := FieldFilterResponseProcessor(FieldFilterConfiguration{MaxDepth: 3, MaxFields: 4})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			query := map[string][]string{}
+			if c.fields != nil {
+				query[FieldsQueryParameter] = c.fields
+			}
+			ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{QueryParameters: query})
+
+			filtered, err := processor(ctx, []byte(body))
+			if c.expectedStatus != 0 {
+				assert.NotNil(t, err)
+				assert.Equal(t, c.expectedStatus, err.Errors()[0].HttpStatusCode)
+				return
+			}
+			assert.Nil(t, err)
+			if c.fields == nil {
+				assert.Equal(t, c.expected, string(filtered))
+			} else {
+				assert.JSONEq(t, c.expected, string(filtered))
+				assert.False(t, strings.Contains(string(filtered), "e+"), "numbers should not be rewritten")
+			}
+		})
+	}
+}
@@ -17,11 +17,24 @@
 package server
 
 import (
+	"encoding/json"
+	"github.com/armory-io/go-commons/validation"
 	"github.com/go-playground/validator/v10"
 	"go.uber.org/fx"
 )
 
 var Module = fx.Options(
-	fx.Provide(validator.New),
+	fx.Provide(newValidator),
+	fx.Provide(NewHandlerMetrics),
 	fx.Invoke(ConfigureAndStartHttpServer),
 )
+
+// newValidator creates the request validator with the shared validation tags and the ones provided with validation.Provide
+func newValidator(p validation.Parameters) (*validator.Validate, error) {
+	v := validator.New()
+	v.RegisterCustomTypeFunc(jsonNumberValue, json.Number(""))
+	if err := validation.Register(v, append(validation.Validations(), p.Validations...)...); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
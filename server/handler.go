@@ -24,6 +24,7 @@ import (
 	"github.com/go-playground/validator/v10"
 	"go.uber.org/zap"
 	"net/http"
+	"time"
 )
 
 type (
@@ -43,7 +44,8 @@ type (
 		Method string
 		// Consumes The content-type that the handler consumes, defaults to application/json
 		Consumes string
-		// Produces The content-type that the handler produces/offers, defaults to application/json
+		// Produces The content-type that the handler produces/offers, defaults to application/json. Handlers producing
+		// text/event-stream stream the events of the *EventStream they return, see EventStream
 		Produces string
 		// Default denotes that the handler should be used when the request doesn't specify a preferred Media/MIME type via the Accept header
 		// Please note that one and only one handler for a given path/method combo can be marked as default, else a runtime error will be produced.
@@ -52,6 +54,53 @@ type (
 		StatusCode int
 		// AuthOptOut Set this to true if the handler should skip AuthZ and AuthN.
 		AuthOptOut bool
+		// RequireSignature Set this to true if requests must carry a valid X-Armory-Signature, see RequestSigningConfiguration.
+		// This is typically combined with AuthOptOut for callers that can't use OAuth, such as agent callbacks
+		RequireSignature bool
+		// LegacyQueryParameters Maps deprecated query parameter names to the names the handler now expects, so existing callers keep working while they migrate.
+		// Requests using a legacy name are rewritten before arguments are extracted, warned about once per caller org and counted in the http.server.requests.legacy metric
+		LegacyQueryParameters map[string]string
+		// LegacyHeaders Maps deprecated header names to the names the handler now expects, see LegacyQueryParameters
+		LegacyHeaders map[string]string
+		// StaticHeaders Headers added to every response of the handler, including error responses. These replace any headers of the same name from
+		// IControllerResponseHeaders, and are replaced by Response.Headers
+		StaticHeaders map[string][]string
+		// Deprecation marks the handler as deprecated, its responses announce it and the orgs still calling it are reported, see Deprecation
+		Deprecation *Deprecation
+		// Deduplicate Set this to true to run the handler once per delivery id, see DeduplicationConfiguration. Duplicate deliveries are answered
+		// with the status code of the first, so this suits handlers for callers that retry aggressively and ignore response bodies, such as agent callbacks
+		Deduplicate bool
+		// LatencyBudget the time the handler is expected to respond within. Budgets are listed at the /info endpoint and requests that take
+		// longer are counted by the http.server.requests.overBudget metric, so regressions show up per endpoint
+		LatencyBudget time.Duration
+		// Cache the Cache-Control directives and Last-Modified handling of the handler's successful responses, see CachePolicy
+		Cache *CachePolicy
+		// RegionPin rejects or redirects requests for resources of another region than the one serving the request, see RegionPin
+		RegionPin *RegionPin
+		// DisableCoalescing Set this to true to run the handler for every request when CoalescingConfiguration is enabled,
+		// required for GET handlers whose responses are specific to the principal rather than its org
+		DisableCoalescing bool
+		// RequiredFeatures the feature flags that must be on for the org of the principal, requests are answered with a 404, or a 403
+		// per Configuration.FeatureDisabledStatusCode, while any is off. Requires a FeatureFlags to be provided
+		RequiredFeatures []string
+		// RequiredHeaders headers requests must have, ex: "X-Tenant". A colon followed by a regular expression also requires the value to match
+		// it, ex: "X-Api-Version: ^v[0-9]+$". Requests missing any are answered with a 400 listing them before the handler's arguments are extracted
+		RequiredHeaders []string
+		// Encryption the name of the PayloadEncryptionConfiguration keys the handler's request and response bodies are JWE encrypted with.
+		// The handler still works with plain structs, bodies are decrypted before they are unmarshalled and validated. Consumes and
+		// Produces default to application/jose
+		Encryption string
+		// JSONDecoding how JSON request bodies are decoded, such as matching field names case-sensitively or decoding numbers as json.Number
+		// to keep large integer ids exact, see JSONDecoding. Defaults to the encoding/json behaviour
+		JSONDecoding *JSONDecoding
+		// LongPoll parks requests in LongPoll until the handler has something to answer them with, see LongPollConfig
+		LongPoll *LongPollConfig
+		// MaxConcurrent bounds the requests the route handles at once, for expensive handlers such as report generation. Requests over it
+		// wait for a free execution in a queue of MaxQueued, requests beyond that are answered with a 429, see Backpressure. The active and queued requests
+		// of the route are reported by the http.server.handler.active and http.server.handler.queued gauges
+		MaxConcurrent int
+		// MaxQueued the requests that wait for a free execution when MaxConcurrent is reached, defaults to none
+		MaxQueued int
 		// AuthZValidator see AuthZValidatorFn
 		AuthZValidator AuthZValidatorFn
 		// AuthZValidatorExtended see AuthZValidatorV2Fn
@@ -88,7 +137,9 @@ type (
 	beforeRequestValidateFn func(ctx context.Context)
 
 	handler[T, U any] struct {
-		config          HandlerConfig
+		config HandlerConfig
+		// funcName the name of the function the handler was created with, see HandlerMetrics
+		funcName        string
 		extractArgsFunc extractRequestArgumentsDelegate[T]
 		handleFunc      handleRequestDelegate[T, U]
 	}
@@ -191,12 +242,17 @@ const (
 	QueryContextSource  ArgumentDataSource = 1
 	HeaderContextSource ArgumentDataSource = 2
 	authContextSource   ArgumentDataSource = 200
+	clientContextSource ArgumentDataSource = 201
 )
 
 func (r *handler[REQUEST, RESPONSE]) Config() HandlerConfig {
 	return r.config
 }
 
+func (r *handler[REQUEST, RESPONSE]) name() string {
+	return r.funcName
+}
+
 func (r *handler[REQUEST, RESPONSE]) GetGinHandlerFn(log *zap.SugaredLogger, requestValidator *validator.Validate, config *handlerDTO) gin.HandlerFunc {
 	extensionPoints := HandlerExtensionPoints{
 		BeforeRequestValidate: r.config.beforeRequestValidate,
@@ -217,6 +273,7 @@ func NewHandler[REQUEST, RESPONSE any](f func(ctx context.Context, request REQUE
 	return &Handler1Extensions[REQUEST, RESPONSE]{
 		&handler[REQUEST, RESPONSE]{
 			config:          config,
+			funcName:        funcName(f),
 			extractArgsFunc: extractArgsFromRequest1[REQUEST],
 			handleFunc:      f,
 		},
@@ -233,6 +290,7 @@ func New1ArgHandler[REQUEST, RESPONSE any, CTX HandlerArgument](f func(ctx conte
 	return &Handler2Extensions[REQUEST, RESPONSE, CTX]{
 		&handler[REQUEST, RESPONSE]{
 			config:          config,
+			funcName:        funcName(f),
 			extractArgsFunc: extractArgsFromRequest2[REQUEST, CTX],
 			handleFunc:      delegate,
 		},
@@ -249,6 +307,7 @@ func New2ArgHandler[REQUEST, RESPONSE any, CTX1 HandlerArgument, CTX2 HandlerArg
 	return &Handler3Extensions[REQUEST, RESPONSE, CTX1, CTX2]{
 		&handler[REQUEST, RESPONSE]{
 			config:          config,
+			funcName:        funcName(f),
 			extractArgsFunc: extractArgsFromRequest3[REQUEST, CTX1, CTX2],
 			handleFunc:      delegate,
 		},
@@ -266,6 +325,7 @@ func New3ArgHandler[REQUEST, RESPONSE any, CTX1 HandlerArgument, CTX2 HandlerArg
 	return &Handler4Extensions[REQUEST, RESPONSE, CTX1, CTX2, CTX3]{
 		&handler[REQUEST, RESPONSE]{
 			config:          config,
+			funcName:        funcName(f),
 			extractArgsFunc: extractArgsFromRequest4[REQUEST, CTX1, CTX2, CTX3],
 			handleFunc:      delegate,
 		},
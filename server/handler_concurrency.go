@@ -0,0 +1,184 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	handlerActiveMetric   = "http.server.handler.active"
+	handlerQueuedMetric   = "http.server.handler.queued"
+	handlerRejectedMetric = "http.server.handler.rejected"
+)
+
+var handlerConcurrencyExceeded = serr.APIError{
+	Message:        "The endpoint is handling too many requests, try again later",
+	HttpStatusCode: http.StatusTooManyRequests,
+}
+
+type (
+	// handlerLimits the concurrency limits of the handlers with a HandlerConfig.MaxConcurrent, shared by every route group and
+	// content type of a route so the route is limited as a whole
+	handlerLimits struct {
+		metrics metrics.MetricsSvc
+		log     *zap.SugaredLogger
+
+		mu     sync.Mutex
+		limits map[handlerDTOKey]*handlerLimit
+	}
+
+	// handlerLimit the executions of a route, and the requests queued for one
+	handlerLimit struct {
+		slots     chan struct{}
+		maxQueued int
+		active    tally.Gauge
+		queued    tally.Gauge
+		rejected  tally.Counter
+		log       *zap.SugaredLogger
+
+		mu      sync.Mutex
+		running int
+		waiting int
+		// latency the average latency of the route, which Retry-After is estimated from
+		latency time.Duration
+	}
+)
+
+func newHandlerLimits(ms metrics.MetricsSvc, log *zap.SugaredLogger) *handlerLimits {
+	return &handlerLimits{metrics: ms, log: log, limits: map[handlerDTOKey]*handlerLimit{}}
+}
+
+// wrap returns a handler func that runs next once the route has a free execution, queueing up to HandlerConfig.MaxQueued requests
+// for one and answering the others with a 429
+func (l *handlerLimits) wrap(handler *handlerDTO, next gin.HandlerFunc) gin.HandlerFunc {
+	if l == nil || handler.MaxConcurrent <= 0 {
+		return next
+	}
+	limit := l.limit(handler)
+	return func(c *gin.Context) {
+		if !limit.acquire(c) {
+			return
+		}
+		start := time.Now()
+		defer func() {
+			limit.release(time.Since(start))
+		}()
+		next(c)
+	}
+}
+
+func (l *handlerLimits) limit(handler *handlerDTO) *handlerLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := handlerDTOKey{path: handler.Path, method: handler.Method}
+	if limit, ok := l.limits[key]; ok {
+		return limit
+	}
+	tags := map[string]string{
+		"uri":           handler.Path,
+		"method":        handler.Method,
+		"maxConcurrent": strconv.Itoa(handler.MaxConcurrent),
+	}
+	limit := &handlerLimit{
+		slots:     make(chan struct{}, handler.MaxConcurrent),
+		maxQueued: handler.MaxQueued,
+		active:    l.metrics.GaugeWithTags(handlerActiveMetric, tags),
+		queued:    l.metrics.GaugeWithTags(handlerQueuedMetric, tags),
+		rejected:  l.metrics.CounterWithTags(handlerRejectedMetric, tags),
+		log:       l.log,
+	}
+	l.limits[key] = limit
+	return limit
+}
+
+// acquire takes an execution of the route, waiting in the queue for one when there is room in it. The request has been answered when
+// it returns false
+func (l *handlerLimit) acquire(c *gin.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		recordBackpressure(c, l.update(1, 0))
+		return true
+	default:
+	}
+
+	if !l.enqueue() {
+		l.rejected.Inc(1)
+		rejectRequest(c, handlerConcurrencyExceeded, l.backpressure(), l.log)
+		return false
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		recordBackpressure(c, l.update(1, -1))
+		return true
+	case <-c.Request.Context().Done():
+		l.update(0, -1)
+		c.AbortWithStatus(StatusClientClosedRequest)
+		return false
+	}
+}
+
+// enqueue counts the request as waiting, false when the queue is full
+func (l *handlerLimit) enqueue() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiting >= l.maxQueued {
+		return false
+	}
+	l.waiting++
+	l.queued.Update(float64(l.waiting))
+	return true
+}
+
+func (l *handlerLimit) release(latency time.Duration) {
+	<-l.slots
+	l.mu.Lock()
+	l.latency = averageLatency(l.latency, latency)
+	l.mu.Unlock()
+	l.update(-1, 0)
+}
+
+// update counts the running and waiting requests, returning the backpressure of the route after the update
+func (l *handlerLimit) update(running int, waiting int) Backpressure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running += running
+	l.waiting += waiting
+	l.active.Update(float64(l.running))
+	l.queued.Update(float64(l.waiting))
+	return Backpressure{Source: BackpressureHandlerConcurrency, Limit: cap(l.slots), Remaining: cap(l.slots) - l.running}
+}
+
+// backpressure of a request that is turned away, which is likely to be admitted once the queue drained
+func (l *handlerLimit) backpressure() Backpressure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Backpressure{
+		Source:     BackpressureHandlerConcurrency,
+		Limit:      cap(l.slots),
+		RetryAfter: l.latency * time.Duration(l.waiting+1) / time.Duration(cap(l.slots)),
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestHandlerLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	tags := map[string]string{"uri": "/reports", "method": http.MethodPost, "maxConcurrent": "1"}
+	ms.EXPECT().GaugeWithTags(gomock.Any(), tags).Times(2).DoAndReturn(func(name string, tags map[string]string) tally.Gauge {
+		return scope.Tagged(tags).Gauge(name)
+	})
+	ms.EXPECT().CounterWithTags(handlerRejectedMetric, tags).DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	limits := newHandlerLimits(ms, zap.NewNop().Sugar())
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	g := gin.New()
+	handler := &handlerDTO{Path: "/reports", Method: http.MethodPost, MaxConcurrent: 1, MaxQueued: 1}
+	g.POST("/reports", limits.wrap(handler, func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	}))
+	// another content type of the route shares its limit
+	assert.Same(t, limits.limit(handler), limits.limit(&handlerDTO{Path: "/reports", Method: http.MethodPost, MaxConcurrent: 1}))
+
+	gauge := func(name string) float64 {
+		for _, g := range scope.Snapshot().Gauges() {
+			if g.Name() == name {
+				return g.Value()
+			}
+		}
+		return -1
+	}
+	serve := func(ctx context.Context) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reports", nil).WithContext(ctx))
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve(context.Background()).Code
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	require.Eventually(t, func() bool { return gauge(handlerQueuedMetric) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, float64(1), gauge(handlerActiveMetric))
+
+	assert.Equal(t, http.StatusTooManyRequests, serve(context.Background()).Code, "requests beyond the queue are rejected")
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+	assert.Equal(t, float64(0), gauge(handlerActiveMetric))
+	assert.Equal(t, float64(0), gauge(handlerQueuedMetric))
+	assert.Equal(t, int64(1), scope.Snapshot().Counters()[handlerRejectedMetric+"+maxConcurrent=1,method=POST,uri=/reports"].Value())
+}
+
+func TestHandlerLimitsQueuedCallerDisconnects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().GaugeWithTags(gomock.Any(), gomock.Any()).AnyTimes().Return(tally.NoopScope.Gauge(""))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().Return(tally.NoopScope.Counter(""))
+	limits := newHandlerLimits(ms, zap.NewNop().Sugar())
+	limit := limits.limit(&handlerDTO{Path: "/reports", Method: http.MethodPost, MaxConcurrent: 1, MaxQueued: 1})
+	limit.slots <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/reports", nil).WithContext(ctx)
+
+	assert.False(t, limit.acquire(c))
+	assert.Equal(t, StatusClientClosedRequest, c.Writer.Status())
+	assert.Equal(t, 0, limit.waiting)
+}
+
+func TestHandlerLimitsOnlyWrapLimitedHandlers(t *testing.T) {
+	limits := newHandlerLimits(nil, zap.NewNop().Sugar())
+	called := false
+	limits.wrap(&handlerDTO{}, func(c *gin.Context) { called = true })(nil)
+	assert.True(t, called)
+	assert.Empty(t, limits.limits)
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+var handlerMetricsKey = ctxutil.NewKey[metrics.MetricsSvc]("server.handlerMetrics")
+
+type (
+	// HandlerMetrics gives business code the metrics of the handler serving a request, tagged with the controller and handler
+	// names and the uri and method of the route. The uri tag is the one of the http.server.requests timer, so business metrics
+	// can be joined with the latency of their endpoint:
+	//
+	//	func (c *deploymentController) start(ctx context.Context, req startRequest) (*server.Response[deployment], serr.Error) {
+	//		c.metrics.For(ctx).CounterWithTags("deployments.started", map[string]string{"strategy": req.Strategy}).Inc(1)
+	//		...
+	//	}
+	HandlerMetrics struct {
+		metrics metrics.MetricsSvc
+	}
+
+	// handlerMetrics tags the metrics of the requests of a handler
+	handlerMetrics struct {
+		metrics metrics.MetricsSvc
+		handler *handlerDTO
+	}
+
+	// namedHandler a handler that knows the name of the function it calls, see funcName
+	namedHandler interface {
+		name() string
+	}
+)
+
+// NewHandlerMetrics creates the HandlerMetrics of the MetricsSvc, controllers can depend on it
+func NewHandlerMetrics(ms metrics.MetricsSvc) *HandlerMetrics {
+	return &HandlerMetrics{metrics: ms}
+}
+
+// For the metrics of the handler serving the request of ctx, or the untagged metrics outside of handlers
+func (h *HandlerMetrics) For(ctx context.Context) metrics.MetricsSvc {
+	if ms, ok := handlerMetricsKey.Value(ctx); ok {
+		return ms
+	}
+	return h.metrics
+}
+
+func newHandlerMetrics(handler *handlerDTO, ms metrics.MetricsSvc) *handlerMetrics {
+	if ms == nil {
+		return nil
+	}
+	return &handlerMetrics{metrics: ms, handler: handler}
+}
+
+// wrap returns a handler func that puts the tagged metrics of the handler in the request context
+func (m *handlerMetrics) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if m == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		tagged := metrics.Tagged(m.metrics, map[string]string{
+			"controller": m.handler.controllerName,
+			"handler":    m.handler.handlerName,
+			"method":     m.handler.Method,
+			"uri":        c.FullPath(),
+		})
+		c.Request = c.Request.WithContext(handlerMetricsKey.WithValue(c.Request.Context(), tagged))
+		next(c)
+	}
+}
+
+// typeName the name of the type of v without its package or pointers, ex: deploymentController
+func typeName(v any) string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return ""
+	}
+	return t.Name()
+}
+
+// funcName the name of the function or method f without its package or receiver, ex: startDeployment
+func funcName(f any) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return ""
+	}
+	name := strings.TrimSuffix(fn.Name(), "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+type meteredController struct {
+	metrics *HandlerMetrics
+}
+
+func (c *meteredController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(c.startDeployment, HandlerConfig{
+			Path:       "/deployments/:id/start",
+			Method:     http.MethodPost,
+			AuthOptOut: true,
+		}),
+	}
+}
+
+func (c *meteredController) startDeployment(ctx context.Context, _ Void) (*Response[Void], serr.Error) {
+	c.metrics.For(ctx).CounterWithTags("deployments.started", map[string]string{"strategy": "canary"}).Inc(1)
+	return SimpleResponse(Void{}), nil
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	handlerMetrics := NewHandlerMetrics(ms)
+
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{&meteredController{metrics: handlerMetrics}})
+	require.NoError(t, err)
+	g := gin.New()
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group("/api"),
+		AuthNotEnforcedGroup: g.Group("/api"),
+		Metrics:              ms,
+	}))
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/deployments/1/start", nil))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	counters := scope.Snapshot().Counters()
+	require.Len(t, counters, 1)
+	for _, counter := range counters {
+		assert.Equal(t, "deployments.started", counter.Name())
+		assert.Equal(t, map[string]string{
+			"controller": "meteredController",
+			"handler":    "startDeployment",
+			"method":     http.MethodPost,
+			"uri":        "/api/deployments/:id/start",
+			"strategy":   "canary",
+		}, counter.Tags())
+	}
+
+	assert.Equal(t, ms, handlerMetrics.For(context.Background()), "the untagged metrics are returned outside of handlers")
+}
@@ -170,7 +170,7 @@ func (h *HandlerTestContext) BuildHandler(t *testing.T) (*gin.Context, gin.Handl
 	}
 
 	registryData := make(map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO)
-	err := configureHandler(h.selectedHandler, h.controller, h.logger, h.validate, registryData)
+	err := configureHandler(h.selectedHandler, h.controller, nil, h.logger, h.validate, registryData)
 	if err != nil {
 		t.Fatal("failed to create handler configuration", err)
 	}
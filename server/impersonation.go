@@ -0,0 +1,53 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/armory-io/go-commons/iam"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ImpersonatedHeader the response header of requests made by a principal on behalf of another one with the proxied authorization header
+const ImpersonatedHeader = "X-Armory-Impersonated"
+
+// impersonationMiddleware records the principal of the proxy that made a request on behalf of another principal, it must be
+// registered after the middleware that authenticates the effective principal. The actual principal is available with
+// iam.ExtractActualPrincipalFromContext and is added to the logging metadata of the request
+func impersonationMiddleware(as AuthService, log *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !iam.IsProxiedRequest(c.Request) {
+			return
+		}
+		effective := c.Request
+		if _, err := iam.ExtractPrincipalFromContext(effective.Context()); err != nil {
+			return
+		}
+
+		var actual *iam.ArmoryCloudPrincipal
+		if auth, ok := iam.ExtractImpersonatorBearerToken(effective); ok {
+			// verifying sets the principal of the request, it's restored to the effective principal below
+			if err := as.VerifyPrincipalAndSetContext(auth, c); err != nil {
+				log.Debugw("Failed to verify the principal impersonating the principal of the request", "error", err)
+			} else {
+				actual, _ = iam.ExtractPrincipalFromContext(c.Request.Context())
+			}
+		}
+		c.Request = effective.WithContext(iam.WithImpersonation(effective.Context(), actual))
+		c.Header(ImpersonatedHeader, "true")
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type tokenAuthService map[string]iam.ArmoryCloudPrincipal
+
+func (s tokenAuthService) VerifyPrincipalAndSetContext(tokenOrRawHeader string, c *gin.Context) error {
+	principal, ok := s[tokenOrRawHeader]
+	if !ok {
+		return errors.New("invalid token")
+	}
+	c.Request = c.Request.WithContext(iam.DangerouslyWriteUnverifiedPrincipalToContext(c.Request.Context(), &principal))
+	return nil
+}
+
+func TestImpersonationMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	as := tokenAuthService{
+		"Bearer glados": {Name: "glados", Type: iam.Machine, OrgId: "armory"},
+		"Bearer alice":  {Name: "alice", Type: iam.User, OrgId: "org-1", EnvId: "env-1"},
+	}
+
+	var metadata map[string]string
+	var actual, effective *iam.ArmoryCloudPrincipal
+	g := gin.New()
+	g.Use(ginEnforceAuthMiddleware(as, zap.NewNop().Sugar()), impersonationMiddleware(as, zap.NewNop().Sugar()))
+	g.GET("/deployments", func(c *gin.Context) {
+		metadata = extractLoggingMetadata(c.Request.Context())
+		actual, _ = iam.ExtractActualPrincipalFromContext(c.Request.Context())
+		effective, _ = iam.ExtractEffectivePrincipalFromContext(c.Request.Context())
+		c.Status(http.StatusOK)
+	})
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(map[string]string{"Authorization": "Bearer alice"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(ImpersonatedHeader))
+	assert.Equal(t, "alice", actual.Name, "the actual principal of requests that aren't impersonated is the principal")
+	assert.Equal(t, "alice", effective.Name)
+	assert.NotContains(t, metadata, "impersonated")
+
+	w = serve(map[string]string{"Authorization": "Bearer glados", "X-Armory-Proxied-Authorization": "Bearer alice"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(ImpersonatedHeader))
+	assert.Equal(t, "glados", actual.Name)
+	assert.Equal(t, "alice", effective.Name)
+	assert.Equal(t, "true", metadata["impersonated"])
+	assert.Equal(t, "alice", metadata["principal-name"])
+	assert.Equal(t, "glados", metadata["actual-principal-name"])
+	assert.Equal(t, string(iam.Machine), metadata["actual-principal-type"])
+
+	w = serve(map[string]string{"Authorization": "Bearer unknown", "X-Armory-Proxied-Authorization": "Bearer alice"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(ImpersonatedHeader))
+	assert.Nil(t, actual, "the actual principal is unknown when the proxy's token can't be verified")
+	assert.Equal(t, "alice", effective.Name)
+	assert.Equal(t, "true", metadata["impersonated"])
+	assert.NotContains(t, metadata, "actual-principal-name")
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlightRequests(t *testing.T) {
+	inFlight := &inFlightRequests{}
+	var during int64
+	handler := inFlight.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = inFlight.count()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, int64(1), during)
+	assert.Equal(t, int64(0), inFlight.count())
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/armory-io/go-commons/server/serr"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errFieldCaseMismatch = serr.APIError{
+		Message:        "Request fields must match the case of the documented field names",
+		HttpStatusCode: http.StatusBadRequest,
+	}
+
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// JSONDecoding how a handler decodes JSON request bodies, by default the way encoding/json does
+type JSONDecoding struct {
+	// CaseSensitive rejects requests with fields that only match a field of the request type in a different case, such as
+	// "deploymentid" for "deploymentId", which encoding/json would otherwise accept
+	CaseSensitive bool `json:"caseSensitive,omitempty"`
+	// UseNumber decodes the numbers of any, map[string]any and []any fields as json.Number rather than float64, which can't hold
+	// integers beyond 2^53 exactly. json.Number fields are validated as the numbers they hold, so tags such as gte apply
+	UseNumber bool `json:"useNumber,omitempty"`
+}
+
+// unmarshalJSON decodes a request body with the JSONDecoding of the handler, nil for the encoding/json defaults
+func unmarshalJSON(b []byte, req any, decoding *JSONDecoding) serr.Error {
+	if decoding == nil || !decoding.UseNumber {
+		if err := json.Unmarshal(b, req); err != nil {
+			return handleUnmarshalError(b, err)
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		if err := decoder.Decode(req); err != nil {
+			return handleUnmarshalError(b, err)
+		}
+	}
+	if decoding != nil && decoding.CaseSensitive {
+		var mismatches []string
+		findFieldCaseMismatches(b, reflect.TypeOf(req), "", &mismatches)
+		if len(mismatches) > 0 {
+			sort.Strings(mismatches)
+			return serr.NewErrorResponseFromApiError(serr.APIError{
+				Message:        errFieldCaseMismatch.Message,
+				Metadata:       map[string]any{"fields": mismatches},
+				HttpStatusCode: errFieldCaseMismatch.HttpStatusCode,
+			})
+		}
+	}
+	return nil
+}
+
+// findFieldCaseMismatches adds the paths of the fields of data that only match a field of t in a different case
+func findFieldCaseMismatches(data []byte, t reflect.Type, path string, mismatches *[]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// types that decode themselves decide how their fields are matched
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return
+		}
+		fields := jsonFields(t)
+		for key, value := range object {
+			if field, ok := fields[key]; ok {
+				findFieldCaseMismatches(value, field, joinFieldPath(path, key), mismatches)
+				continue
+			}
+			for name := range fields {
+				if strings.EqualFold(name, key) {
+					*mismatches = append(*mismatches, joinFieldPath(path, key))
+					break
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var elements []json.RawMessage
+		if t.Elem().Kind() == reflect.Uint8 || json.Unmarshal(data, &elements) != nil {
+			return
+		}
+		for i, element := range elements {
+			findFieldCaseMismatches(element, t.Elem(), path+"["+strconv.Itoa(i)+"]", mismatches)
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(data, &entries) != nil {
+			return
+		}
+		for key, value := range entries {
+			findFieldCaseMismatches(value, t.Elem(), joinFieldPath(path, key), mismatches)
+		}
+	}
+}
+
+// jsonFields the types of the fields of a struct by the names encoding/json decodes them from, including promoted fields
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			// the fields of embedded structs are promoted and visited on their own
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if _, ok := fields[name]; !ok {
+			fields[name] = field.Type
+		}
+	}
+	return fields
+}
+
+func joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonNumberValue validates json.Number fields as the int64 or float64 they hold, see JSONDecoding.UseNumber
+func jsonNumberValue(field reflect.Value) any {
+	n, ok := field.Interface().(json.Number)
+	if !ok {
+		return nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return string(n)
+}
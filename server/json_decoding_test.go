@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/armory-io/go-commons/validation"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	deploymentRequest struct {
+		DeploymentID json.Number       `json:"deploymentId" validate:"gte=1"`
+		Target       deploymentTarget  `json:"target"`
+		Stages       []deploymentStage `json:"stages"`
+		Context      map[string]any    `json:"context"`
+	}
+
+	deploymentTarget struct {
+		Account string `json:"account"`
+	}
+
+	deploymentStage struct {
+		deploymentTarget
+		Name string
+	}
+)
+
+func TestJSONDecoding(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	decode := func(body string, decoding *JSONDecoding) (*deploymentRequest, serr.Error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(body))
+		req, _, apiErr := extractRequestBody[deploymentRequest](c, "application/json", decoding)
+		return req, apiErr
+	}
+	body := `{"deploymentId": 9007199254740993, "Target": {"account": "prod"}, "stages": [{"name": "deploy", "Account": "staging"}], "context": {"pipelineId": 9007199254740993}}`
+
+	req, apiErr := decode(body, nil)
+	require.Nil(t, apiErr)
+	assert.Equal(t, json.Number("9007199254740993"), req.DeploymentID)
+	assert.Equal(t, "prod", req.Target.Account, "fields match case-insensitively by default")
+	assert.Equal(t, float64(9007199254740992), req.Context["pipelineId"], "numbers of any fields are float64 by default")
+
+	req, apiErr = decode(body, &JSONDecoding{UseNumber: true})
+	require.Nil(t, apiErr)
+	assert.Equal(t, json.Number("9007199254740993"), req.Context["pipelineId"])
+
+	_, apiErr = decode(body, &JSONDecoding{CaseSensitive: true})
+	require.NotNil(t, apiErr)
+	require.Len(t, apiErr.Errors(), 1)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Errors()[0].HttpStatusCode)
+	assert.Equal(t, []string{"Target", "stages[0].Account", "stages[0].name"}, apiErr.Errors()[0].Metadata["fields"])
+
+	req, apiErr = decode(`{"deploymentId": 1, "target": {"account": "prod"}, "stages": [{"Name": "deploy", "account": "staging"}], "context": {"Pipeline": 1}}`, &JSONDecoding{CaseSensitive: true})
+	require.Nil(t, apiErr)
+	assert.Equal(t, "staging", req.Stages[0].Account, "promoted fields and untagged field names are matched exactly")
+}
+
+func TestJSONNumberValidation(t *testing.T) {
+	v, err := newValidator(validation.Parameters{})
+	require.NoError(t, err)
+
+	assert.NoError(t, v.Struct(deploymentRequest{DeploymentID: "9007199254740993"}))
+	assert.Error(t, v.Struct(deploymentRequest{DeploymentID: "0"}), "json.Number fields are validated as numbers")
+	assert.NoError(t, v.Struct(deploymentRequest{DeploymentID: "1.5"}))
+}
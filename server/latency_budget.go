@@ -0,0 +1,71 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/uber-go/tally/v4"
+	"strconv"
+	"time"
+)
+
+const overBudgetMetric = "http.server.requests.overBudget"
+
+// latencyBudget a HandlerConfig.LatencyBudget, listed at the /info endpoint as a duration string such as 250ms
+type latencyBudget time.Duration
+
+func (b latencyBudget) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(b).String())
+}
+
+// latencyBudgetRecorder counts the requests of a handler that take longer than its latency budget
+type latencyBudgetRecorder struct {
+	budget     time.Duration
+	overBudget tally.Counter
+	now        func() time.Time
+}
+
+func newLatencyBudgetRecorder(handler *handlerDTO, ms metrics.MetricsSvc) *latencyBudgetRecorder {
+	if handler.LatencyBudget <= 0 || ms == nil {
+		return nil
+	}
+	return &latencyBudgetRecorder{
+		budget: time.Duration(handler.LatencyBudget),
+		overBudget: ms.CounterWithTags(overBudgetMetric, map[string]string{
+			"uri":    handler.Path,
+			"method": handler.Method,
+			"budget": strconv.FormatInt(time.Duration(handler.LatencyBudget).Milliseconds(), 10),
+		}),
+		now: time.Now,
+	}
+}
+
+// wrap returns a handler func that times next against the budget
+func (r *latencyBudgetRecorder) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if r == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		start := r.now()
+		next(c)
+		if r.now().Sub(start) > r.budget {
+			r.overBudget.Inc(1)
+		}
+	}
+}
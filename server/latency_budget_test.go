@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyBudgetRecorder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(overBudgetMetric, map[string]string{"uri": "/deployments", "method": http.MethodGet, "budget": "250"}).
+		DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+			return scope.Tagged(tags).Counter(name)
+		})
+
+	recorder := newLatencyBudgetRecorder(&handlerDTO{Path: "/deployments", Method: http.MethodGet, LatencyBudget: latencyBudget(250 * time.Millisecond)}, ms)
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time { return now }
+
+	var elapsed time.Duration
+	g := gin.New()
+	g.GET("/deployments", recorder.wrap(func(c *gin.Context) {
+		now = now.Add(elapsed)
+	}))
+
+	for _, d := range []time.Duration{100 * time.Millisecond, 250 * time.Millisecond, 300 * time.Millisecond, time.Second} {
+		elapsed = d
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/deployments", nil))
+	}
+
+	var total int64
+	for _, c := range scope.Snapshot().Counters() {
+		total += c.Value()
+	}
+	assert.Equal(t, int64(2), total)
+	assert.Nil(t, newLatencyBudgetRecorder(&handlerDTO{}, ms), "handlers without a budget aren't wrapped")
+}
+
+func TestLatencyBudgetJSON(t *testing.T) {
+	b, err := json.Marshal(handlerDTO{LatencyBudget: latencyBudget(1500 * time.Millisecond)})
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"latencyBudget":"1.5s"`)
+
+	b, err = json.Marshal(handlerDTO{})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "latencyBudget")
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	defaultLifecycleStartTimeout = 15 * time.Second
+	defaultLifecycleStopTimeout  = 15 * time.Second
+)
+
+type (
+	// IControllerLifecycle an IController can implement this interface to run code around the start and stop of the server, i.e. to warm
+	// caches before requests are accepted or to flush buffers once they have drained. OnStart is called in the order the controllers were
+	// provided, before the servers start listening, and OnStop in the reverse order, after the servers shut down
+	IControllerLifecycle interface {
+		OnStart(ctx context.Context) error
+		OnStop(ctx context.Context) error
+	}
+
+	// LifecycleConfiguration how long the IControllerLifecycle hooks of each controller may take
+	LifecycleConfiguration struct {
+		// StartTimeout the time OnStart has before the application fails to start, defaults to 15 seconds
+		StartTimeout time.Duration
+		// StopTimeout the time OnStop has before it is abandoned, defaults to 15 seconds
+		StopTimeout time.Duration
+	}
+
+	controllerLifecycle struct {
+		name       string
+		controller IControllerLifecycle
+	}
+)
+
+func (c LifecycleConfiguration) withDefaults() LifecycleConfiguration {
+	if c.StartTimeout <= 0 {
+		c.StartTimeout = defaultLifecycleStartTimeout
+	}
+	if c.StopTimeout <= 0 {
+		c.StopTimeout = defaultLifecycleStopTimeout
+	}
+	return c
+}
+
+// registerControllerLifecycles appends a hook that starts and stops the controllers implementing IControllerLifecycle. It must be
+// appended before the servers' hooks, so controllers are started before requests are accepted and stopped once they are drained
+func registerControllerLifecycles(lc fx.Lifecycle, config LifecycleConfiguration, logger *zap.SugaredLogger, controllers ...IController) {
+	var lifecycles []controllerLifecycle
+	for _, controller := range controllers {
+		if l, ok := controller.(IControllerLifecycle); ok {
+			lifecycles = append(lifecycles, controllerLifecycle{name: fmt.Sprintf("%T", controller), controller: l})
+		}
+	}
+	if len(lifecycles) == 0 {
+		return
+	}
+	config = config.withDefaults()
+
+	var started []controllerLifecycle
+	stop := func(ctx context.Context) error {
+		var errs []error
+		for i := len(started) - 1; i >= 0; i-- {
+			if err := runLifecycleHook(ctx, config.StopTimeout, started[i].controller.OnStop); err != nil {
+				logger.Errorw("Controller failed to stop", "controller", started[i].name, "error", err)
+				errs = append(errs, fmt.Errorf("failed to stop controller %s: %w", started[i].name, err))
+			}
+		}
+		started = nil
+		return errors.Join(errs...)
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			for _, l := range lifecycles {
+				if err := runLifecycleHook(ctx, config.StartTimeout, l.controller.OnStart); err != nil {
+					// fx only stops the hooks that started successfully, the controllers started before this one are stopped here
+					if stopErr := stop(ctx); stopErr != nil {
+						logger.Errorw("Failed to stop controllers after a controller failed to start", "error", stopErr)
+					}
+					return fmt.Errorf("failed to start controller %s: %w", l.name, err)
+				}
+				started = append(started, l)
+			}
+			return nil
+		},
+		OnStop: stop,
+	})
+}
+
+// runLifecycleHook calls the hook with a context that times out, hooks that ignore the context are abandoned once it is done
+func runLifecycleHook(ctx context.Context, timeout time.Duration, hook func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hook(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
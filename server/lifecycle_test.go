@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+type lifecycleController struct {
+	name     string
+	events   *[]string
+	startErr error
+	block    bool
+}
+
+func (c *lifecycleController) Handlers() []Handler {
+	return nil
+}
+
+func (c *lifecycleController) OnStart(ctx context.Context) error {
+	*c.events = append(*c.events, "start "+c.name)
+	if c.block {
+		<-make(chan struct{})
+	}
+	return c.startErr
+}
+
+func (c *lifecycleController) OnStop(ctx context.Context) error {
+	*c.events = append(*c.events, "stop "+c.name)
+	return nil
+}
+
+type plainController struct{}
+
+func (c *plainController) Handlers() []Handler {
+	return nil
+}
+
+func TestControllerLifecycles(t *testing.T) {
+	var events []string
+	lc := fxtest.NewLifecycle(t)
+	registerControllerLifecycles(lc, LifecycleConfiguration{}, zap.NewNop().Sugar(),
+		&lifecycleController{name: "a", events: &events},
+		&plainController{},
+		&lifecycleController{name: "b", events: &events},
+	)
+
+	assert.NoError(t, lc.Start(context.Background()))
+	assert.NoError(t, lc.Stop(context.Background()))
+	assert.Equal(t, []string{"start a", "start b", "stop b", "stop a"}, events)
+}
+
+func TestControllerLifecycleStartFailure(t *testing.T) {
+	var events []string
+	lc := fxtest.NewLifecycle(t)
+	registerControllerLifecycles(lc, LifecycleConfiguration{}, zap.NewNop().Sugar(),
+		&lifecycleController{name: "a", events: &events},
+		&lifecycleController{name: "b", events: &events, startErr: errors.New("cache unavailable")},
+		&lifecycleController{name: "c", events: &events},
+	)
+
+	err := lc.Start(context.Background())
+	assert.ErrorContains(t, err, "failed to start controller *server.lifecycleController: cache unavailable")
+	assert.Equal(t, []string{"start a", "start b", "stop a"}, events)
+}
+
+func TestControllerLifecycleStartTimeout(t *testing.T) {
+	var events []string
+	lc := fxtest.NewLifecycle(t)
+	registerControllerLifecycles(lc, LifecycleConfiguration{StartTimeout: 10 * time.Millisecond}, zap.NewNop().Sugar(),
+		&lifecycleController{name: "a", events: &events, block: true},
+	)
+
+	assert.ErrorIs(t, lc.Start(context.Background()), context.DeadlineExceeded)
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// LongPollWaitParameter the query parameter callers can shorten the wait of a long poll with, as a duration or seconds, ex: ?wait=10s
+	LongPollWaitParameter = "wait"
+	// StatusClientClosedRequest the status code recorded for requests, such as long polls, whose client disconnected before they were answered
+	StatusClientClosedRequest = 499
+
+	longPollWaitMetric         = "http.server.longPoll.wait"
+	longPollOutcomeReady       = "ready"
+	longPollOutcomeTimeout     = "timeout"
+	longPollOutcomeDisconnect  = "disconnected"
+	defaultLongPollMaxWait     = 30 * time.Second
+	defaultLongPollTimeoutCode = http.StatusNotModified
+)
+
+var longPollKey = ctxutil.NewKey[*longPolling]("server.longPoll")
+
+type (
+	// LongPollConfig how the long polls of a handler wait, see HandlerConfig.LongPoll and LongPoll
+	LongPollConfig struct {
+		// MaxWait how long a request is parked before it is answered with TimeoutStatusCode, defaults to 30 seconds.
+		// Callers can wait less with LongPollWaitParameter
+		MaxWait time.Duration
+		// TimeoutStatusCode the status code of requests that timed out, http.StatusNotModified or http.StatusNoContent. Defaults to http.StatusNotModified
+		TimeoutStatusCode int
+	}
+
+	// Broadcaster wakes the long polls waiting on it when what they wait for may have changed, such as the work queued for an agent
+	Broadcaster struct {
+		mu      sync.Mutex
+		changed chan struct{}
+	}
+
+	// longPolling the long poll settings and metrics of a handler
+	longPolling struct {
+		config  LongPollConfig
+		handler *handlerDTO
+		metrics metrics.MetricsSvc
+	}
+)
+
+// NewBroadcaster creates a Broadcaster
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{changed: make(chan struct{})}
+}
+
+// Changed a channel that is closed by the next Broadcast
+func (b *Broadcaster) Changed() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changed
+}
+
+// Broadcast wakes every long poll waiting on the Broadcaster
+func (b *Broadcaster) Broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// LongPoll parks a request until there is something to answer it with. check is called right away and again every time wake
+// broadcasts, until it returns a result, the max wait of the handler elapses or the caller disconnects:
+//
+//	func (c *agentController) checkIn(ctx context.Context, agent agentArgument) (*server.Response[Work], serr.Error) {
+//		return server.LongPoll(ctx, c.queue.Broadcaster(agent.ID), func(ctx context.Context) (*Work, serr.Error) {
+//			return c.queue.Next(ctx, agent.ID)
+//		})
+//	}
+//
+// Requests that time out are answered with the TimeoutStatusCode of HandlerConfig.LongPoll and no body. The wait and outcome of every
+// long poll is recorded by the http.server.longPoll.wait metric. A nil wake only calls check once
+func LongPoll[T any](ctx context.Context, wake *Broadcaster, check func(ctx context.Context) (*T, serr.Error)) (*Response[T], serr.Error) {
+	polling, ok := longPollKey.Value(ctx)
+	if !ok {
+		polling = &longPolling{}
+	}
+	config := polling.config.withDefaults()
+	maxWait := waitOf(ctx, config.MaxWait)
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		// subscribe before checking, so a change between the check and the wait isn't missed
+		var changed <-chan struct{}
+		if wake != nil {
+			changed = wake.Changed()
+		}
+		result, err := check(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			polling.record(longPollOutcomeReady, time.Since(start))
+			return SimpleResponse(*result), nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			polling.record(longPollOutcomeTimeout, time.Since(start))
+			return &Response[T]{StatusCode: config.TimeoutStatusCode}, nil
+		case <-ctx.Done():
+			polling.record(longPollOutcomeDisconnect, time.Since(start))
+			return &Response[T]{StatusCode: StatusClientClosedRequest}, nil
+		}
+	}
+}
+
+func (c LongPollConfig) withDefaults() LongPollConfig {
+	if c.MaxWait <= 0 {
+		c.MaxWait = defaultLongPollMaxWait
+	}
+	if c.TimeoutStatusCode != http.StatusNoContent {
+		c.TimeoutStatusCode = defaultLongPollTimeoutCode
+	}
+	return c
+}
+
+func (c LongPollConfig) MarshalJSON() ([]byte, error) {
+	c = c.withDefaults()
+	return json.Marshal(map[string]any{
+		"maxWait":           c.MaxWait.String(),
+		"timeoutStatusCode": c.TimeoutStatusCode,
+	})
+}
+
+// newLongPolling the long polling of a handler, nil when it isn't a long poll handler
+func newLongPolling(handler *handlerDTO, ms metrics.MetricsSvc) *longPolling {
+	if handler.LongPoll == nil {
+		return nil
+	}
+	return &longPolling{config: *handler.LongPoll, handler: handler, metrics: ms}
+}
+
+// wrap returns a handler func that gives LongPoll the settings of the handler
+func (p *longPolling) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if p == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(longPollKey.WithValue(c.Request.Context(), p))
+		next(c)
+	}
+}
+
+func (p *longPolling) record(outcome string, wait time.Duration) {
+	if p.metrics == nil {
+		return
+	}
+	p.metrics.TimerWithTags(longPollWaitMetric, map[string]string{
+		"uri":     p.handler.Path,
+		"method":  p.handler.Method,
+		"outcome": outcome,
+	}).Record(wait)
+}
+
+// waitOf the wait the caller asked for with LongPollWaitParameter, never longer than maxWait
+func waitOf(ctx context.Context, maxWait time.Duration) time.Duration {
+	details, err := ExtractRequestDetailsFromContext(ctx)
+	if err != nil {
+		return maxWait
+	}
+	values := details.QueryParameters[LongPollWaitParameter]
+	if len(values) == 0 {
+		return maxWait
+	}
+	wait, parseErr := time.ParseDuration(values[0])
+	if parseErr != nil {
+		seconds, atoiErr := strconv.Atoi(values[0])
+		if atoiErr != nil {
+			return maxWait
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 || wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// isBodilessStatus whether responses with the status code never have a body
+func isBodilessStatus(statusCode int) bool {
+	return statusCode == http.StatusNoContent || statusCode == http.StatusNotModified || statusCode == StatusClientClosedRequest
+}
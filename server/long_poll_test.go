@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type checkIn struct {
+	Work string
+}
+
+func longPollContext(t *testing.T, config LongPollConfig, scope tally.TestScope) context.Context {
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().TimerWithTags(longPollWaitMetric, gomock.Any()).
+		DoAndReturn(func(name string, tags map[string]string) tally.Timer {
+			return scope.Tagged(tags).Timer(name)
+		}).AnyTimes()
+	polling := newLongPolling(&handlerDTO{Path: "/agents/:id/check-in", Method: http.MethodGet, LongPoll: &config}, ms)
+	return longPollKey.WithValue(context.Background(), polling)
+}
+
+func outcomes(scope tally.TestScope) map[string]int {
+	counts := map[string]int{}
+	for _, timer := range scope.Snapshot().Timers() {
+		counts[timer.Tags()["outcome"]] += len(timer.Values())
+	}
+	return counts
+}
+
+func TestLongPollWakesOnBroadcast(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	ctx := longPollContext(t, LongPollConfig{MaxWait: time.Minute}, scope)
+	broadcaster := NewBroadcaster()
+
+	var work *checkIn
+	checked := make(chan struct{}, 10)
+	go func() {
+		<-checked
+		work = &checkIn{Work: "deploy"}
+		broadcaster.Broadcast()
+	}()
+
+	response, err := LongPoll(ctx, broadcaster, func(ctx context.Context) (*checkIn, serr.Error) {
+		defer func() { checked <- struct{}{} }()
+		return work, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "deploy", response.Body.Work)
+	assert.Equal(t, map[string]int{longPollOutcomeReady: 1}, outcomes(scope))
+}
+
+func TestLongPollTimesOut(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	ctx := longPollContext(t, LongPollConfig{MaxWait: 10 * time.Millisecond, TimeoutStatusCode: http.StatusNoContent}, scope)
+
+	response, err := LongPoll(ctx, NewBroadcaster(), func(ctx context.Context) (*checkIn, serr.Error) {
+		return nil, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Equal(t, map[string]int{longPollOutcomeTimeout: 1}, outcomes(scope))
+}
+
+func TestLongPollCallerDisconnects(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	ctx, cancel := context.WithCancel(longPollContext(t, LongPollConfig{MaxWait: time.Minute}, scope))
+	cancel()
+
+	response, err := LongPoll(ctx, nil, func(ctx context.Context) (*checkIn, serr.Error) {
+		return nil, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, StatusClientClosedRequest, response.StatusCode)
+	assert.Equal(t, map[string]int{longPollOutcomeDisconnect: 1}, outcomes(scope))
+}
+
+func TestLongPollWait(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      time.Minute,
+		"10s":   10 * time.Second,
+		"5":     5 * time.Second,
+		"2h":    time.Minute,
+		"-1s":   time.Minute,
+		"never": time.Minute,
+	}
+	for wait, expected := range cases {
+		ctx := context.Background()
+		if wait != "" {
+			ctx = requestDetailsKey.WithValue(ctx, RequestDetails{QueryParameters: map[string][]string{LongPollWaitParameter: {wait}}})
+		}
+		assert.Equal(t, expected, waitOf(ctx, time.Minute), wait)
+	}
+}
+
+func TestLongPollJSON(t *testing.T) {
+	b, err := json.Marshal(handlerDTO{LongPoll: &LongPollConfig{}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"longPoll":{"maxWait":"30s","timeoutStatusCode":304}`)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	armoryhttp "github.com/armory-io/go-commons/http"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// loopbackHost the host a LoopbackOnly management server binds to when none is configured
+const loopbackHost = "127.0.0.1"
+
+var errManagementPortRequired = errors.New("management security requires a separate management port, set management.port")
+
+type (
+	// ManagementSecurityConfiguration keeps the management routes, such as /metrics, /info and pprof, from being exposed along with
+	// the API. By default the management server authenticates requests with the AuthService of the http server and its routes opt
+	// out of auth.
+	//
+	// Apart from Disabled, the settings apply to a separate management server and fail the startup when Management.Port isn't set
+	ManagementSecurityConfiguration struct {
+		// Disabled serves none of the management routes, neither the routes of ManagementController nor /metrics, pprof and the
+		// diagnostic documents
+		Disabled bool
+		// LoopbackOnly binds the management server to 127.0.0.1 when Management.Host isn't set, and fails the startup when it is set
+		// to an address other than a loopback one
+		LoopbackOnly bool
+		// RequireClientCertificate fails the startup unless the management server requires and verifies client certificates, see
+		// http.SSL.ClientAuth
+		RequireClientCertificate bool
+		// RequiredScopes the scopes of the principal every request to the management server must be made by, including the
+		// routes that opt out of auth. The principal is verified by the AuthService named management when one is provided
+		RequiredScopes []string
+	}
+
+	// managementSecurity enforces the RequiredScopes of the management server
+	managementSecurity struct {
+		as     AuthService
+		scopes []string
+	}
+)
+
+// separate whether the configuration only applies to a separate management server
+func (c ManagementSecurityConfiguration) separate() bool {
+	return c.LoopbackOnly || c.RequireClientCertificate || len(c.RequiredScopes) > 0
+}
+
+// newManagementSecurity validates the configuration against the management server, binding it to the loopback address when
+// LoopbackOnly. The returned policy is nil when no scopes are required. managementAS replaces as when it was provided
+func newManagementSecurity(config ManagementSecurityConfiguration, management *armoryhttp.HTTP, as AuthService, managementAS AuthService) (*managementSecurity, error) {
+	if management.Port == 0 {
+		if config.separate() || managementAS != nil {
+			return nil, errManagementPortRequired
+		}
+		return nil, nil
+	}
+	if config.LoopbackOnly {
+		if management.Host == "" {
+			management.Host = loopbackHost
+		} else if !isLoopback(management.Host) {
+			return nil, fmt.Errorf("management server must be bound to a loopback address, got host %q", management.Host)
+		}
+	}
+	if config.RequireClientCertificate && (!management.SSL.Enabled || management.SSL.ClientAuth != armoryhttp.ClientAuthNeed) {
+		return nil, fmt.Errorf("management server must require client certificates, enable management.ssl with clientAuth %q", armoryhttp.ClientAuthNeed)
+	}
+	if len(config.RequiredScopes) == 0 {
+		return nil, nil
+	}
+	if managementAS != nil {
+		as = managementAS
+	}
+	return &managementSecurity{as: as, scopes: config.RequiredScopes}, nil
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// middleware rejects the requests made without a principal with a 401 and by a principal without the required scopes with a 403
+func (m *managementSecurity) middleware(log *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := iam.ExtractPrincipalFromContext(c.Request.Context())
+		if err != nil || principal == nil {
+			if err := extractPrincipalFromHTTPRequestAndSetContext(c, m.as); err != nil {
+				writeAndLogApiErrorThenAbort(c, err, log)
+				return
+			}
+			principal, _ = iam.ExtractPrincipalFromContext(c.Request.Context())
+		}
+		for _, scope := range m.scopes {
+			if principal == nil || !principal.HasScope(scope) {
+				writeAndLogApiErrorThenAbort(c, serr.NewSimpleErrorWithStatusCode("Principal is missing the scopes required by the management server", http.StatusForbidden, nil), log)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	armoryhttp "github.com/armory-io/go-commons/http"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewManagementSecurity(t *testing.T) {
+	as := tokenAuthService{}
+	managementAS := tokenAuthService{}
+
+	_, err := newManagementSecurity(ManagementSecurityConfiguration{LoopbackOnly: true}, &armoryhttp.HTTP{}, as, nil)
+	assert.ErrorIs(t, err, errManagementPortRequired)
+	_, err = newManagementSecurity(ManagementSecurityConfiguration{}, &armoryhttp.HTTP{}, as, managementAS)
+	assert.ErrorIs(t, err, errManagementPortRequired, "a management auth service needs a management server to authenticate")
+	m, err := newManagementSecurity(ManagementSecurityConfiguration{Disabled: true}, &armoryhttp.HTTP{}, as, nil)
+	assert.NoError(t, err, "the management routes of the http server can be disabled")
+	assert.Nil(t, m)
+
+	management := &armoryhttp.HTTP{Port: 3001}
+	_, err = newManagementSecurity(ManagementSecurityConfiguration{LoopbackOnly: true}, management, as, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", management.Host)
+	for _, host := range []string{"localhost", "::1", "[::1]", "127.0.0.2"} {
+		_, err = newManagementSecurity(ManagementSecurityConfiguration{LoopbackOnly: true}, &armoryhttp.HTTP{Host: host, Port: 3001}, as, nil)
+		assert.NoError(t, err, host)
+	}
+	_, err = newManagementSecurity(ManagementSecurityConfiguration{LoopbackOnly: true}, &armoryhttp.HTTP{Host: "0.0.0.0", Port: 3001}, as, nil)
+	assert.EqualError(t, err, `management server must be bound to a loopback address, got host "0.0.0.0"`)
+
+	_, err = newManagementSecurity(ManagementSecurityConfiguration{RequireClientCertificate: true}, &armoryhttp.HTTP{Port: 3001, SSL: armoryhttp.SSL{Enabled: true, ClientAuth: armoryhttp.ClientAuthWant}}, as, nil)
+	assert.EqualError(t, err, `management server must require client certificates, enable management.ssl with clientAuth "need"`)
+	_, err = newManagementSecurity(ManagementSecurityConfiguration{RequireClientCertificate: true}, &armoryhttp.HTTP{Port: 3001, SSL: armoryhttp.SSL{Enabled: true, ClientAuth: armoryhttp.ClientAuthNeed}}, as, nil)
+	assert.NoError(t, err)
+
+	m, err = newManagementSecurity(ManagementSecurityConfiguration{}, &armoryhttp.HTTP{Port: 3001}, as, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, m, "no scopes are required by default")
+}
+
+func TestManagementSecurityMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	as := tokenAuthService{
+		"Bearer operator": {Name: "operator", Scopes: []string{"manage:internal"}},
+		"Bearer user":     {Name: "user", Scopes: []string{"read:deployments"}},
+	}
+	m, err := newManagementSecurity(ManagementSecurityConfiguration{RequiredScopes: []string{"manage:internal"}}, &armoryhttp.HTTP{Port: 3001}, nil, as)
+	require.NoError(t, err)
+
+	g := gin.New()
+	g.Use(ginAttemptAuthMiddleware(as), m.middleware(zap.NewNop().Sugar()))
+	g.GET("/metrics", func(c *gin.Context) {
+		principal, _ := iam.ExtractPrincipalFromContext(c.Request.Context())
+		c.String(http.StatusOK, principal.Name)
+	})
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("operator")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "operator", rec.Body.String())
+
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code, "routes that opt out of auth require a principal")
+	rec = serve("user")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	var contract serr.ResponseContract
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&contract))
+	require.Len(t, contract.Errors, 1)
+	assert.Equal(t, "Principal is missing the scopes required by the management server", contract.Errors[0].Message)
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/elnormous/contenttype"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxRecordedNegotiations bounds the distinct Accept/Content-Type combinations recorded per route, the headers are caller controlled
+const maxRecordedNegotiations = 50
+
+var (
+	negotiationVaryHeaders = []string{"Accept", "Content-Type"}
+
+	negotiatedContentKey = ctxutil.NewKey[NegotiatedContent]("server.negotiatedContent")
+)
+
+// NegotiatedContent the outcome of content negotiation for the current request
+type NegotiatedContent struct {
+	// Produces the media type the response will be written as
+	Produces contenttype.MediaType
+	// Consumes the media type the request body was matched against
+	Consumes contenttype.MediaType
+	// AcceptParameters any Accept extension parameters, those after the q-value, of the matched media range
+	AcceptParameters map[string]string
+}
+
+// AddNegotiatedContentToCtx is exposed for testing and allows tests to configure the negotiated content when testing handler functions
+func AddNegotiatedContentToCtx(ctx context.Context, content NegotiatedContent) context.Context {
+	return negotiatedContentKey.WithValue(ctx, content)
+}
+
+// ExtractNegotiatedContentFromContext fetches the media types negotiated for the request, so handlers that produce several types can tell which was chosen
+func ExtractNegotiatedContentFromContext(ctx context.Context) (*NegotiatedContent, bool) {
+	v, ok := negotiatedContentKey.Value(ctx)
+	if !ok {
+		return nil, false
+	}
+	return &v, true
+}
+
+// joinedHeaderValues combines every value of a header into a single comma separated list, so that media ranges
+// sent across multiple header lines are weighed together
+func joinedHeaderValues(h http.Header, key string) string {
+	return strings.Join(h.Values(key), ", ")
+}
+
+// addVary adds the negotiation headers to the Vary response header, without duplicating values already present
+func addVary(h http.Header) {
+	present := map[string]bool{}
+	for _, value := range h.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			present[strings.ToLower(strings.TrimSpace(v))] = true
+		}
+	}
+	if present["*"] {
+		return
+	}
+	var missing []string
+	for _, v := range negotiationVaryHeaders {
+		if !present[strings.ToLower(v)] {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		h.Add("Vary", strings.Join(missing, ", "))
+	}
+}
+
+type (
+	negotiationRequest struct {
+		Accept      string `json:"accept"`
+		ContentType string `json:"contentType"`
+	}
+
+	// NegotiationDecision a summary of how requests with a given Accept and Content-Type were negotiated for a route
+	NegotiationDecision struct {
+		Accept      string `json:"accept"`
+		ContentType string `json:"contentType"`
+		Consumes    string `json:"consumes,omitempty"`
+		Produces    string `json:"produces,omitempty"`
+		Rejected    bool   `json:"rejected"`
+		Count       int64  `json:"count"`
+	}
+
+	// negotiationRecorder keeps the negotiation decisions for a single route, which are listed at the /info endpoint. It is nil
+	// unless DiagnosticsConfiguration.RecordNegotiations is enabled
+	negotiationRecorder struct {
+		mu        sync.Mutex
+		decisions map[negotiationRequest]*NegotiationDecision
+		dropped   int64
+	}
+)
+
+func newNegotiationRecorder() *negotiationRecorder {
+	return &negotiationRecorder{decisions: map[negotiationRequest]*NegotiationDecision{}}
+}
+
+func (r *negotiationRecorder) record(c *gin.Context, handler *handlerDTO) {
+	if r == nil {
+		return
+	}
+	key := negotiationRequest{
+		Accept:      joinedHeaderValues(c.Request.Header, "Accept"),
+		ContentType: c.Request.Header.Get("Content-Type"),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	decision, ok := r.decisions[key]
+	if !ok {
+		if len(r.decisions) >= maxRecordedNegotiations {
+			r.dropped++
+			return
+		}
+		decision = &NegotiationDecision{Accept: key.Accept, ContentType: key.ContentType, Rejected: handler == nil}
+		if handler != nil {
+			decision.Consumes = handler.Consumes
+			decision.Produces = handler.Produces
+		}
+		r.decisions[key] = decision
+	}
+	decision.Count++
+}
+
+func (r *negotiationRecorder) snapshot() map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	decisions := make([]NegotiationDecision, 0, len(r.decisions))
+	for _, d := range r.decisions {
+		decisions = append(decisions, *d)
+	}
+	return map[string]any{
+		"decisions":    decisions,
+		"unrecordable": r.dropped,
+	}
+}
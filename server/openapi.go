@@ -0,0 +1,617 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIPath the management route that serves the OpenAPI document of the http server, see OpenAPIConfiguration
+const openAPIPath = "/openapi.json"
+
+type (
+	// OpenAPIConfiguration serves an OpenAPI 3 document describing the handlers of the http server at the /openapi.json management
+	// endpoint. Request, response and argument schemas are derived from the types of the handlers, their validate tags become
+	// schema constraints
+	OpenAPIConfiguration struct {
+		Enabled bool
+		// Title the title of the document, defaults to the name of the application
+		Title string
+		// Version the version of the document, defaults to the version of the application
+		Version string
+		// document the document shared by the http and management servers, nil when it isn't served
+		document *openAPIDocument
+	}
+
+	// typedHandler a handler that knows the types of its request, response and arguments, see handler.types
+	typedHandler interface {
+		types() handlerTypes
+	}
+
+	handlerTypes struct {
+		request   reflect.Type
+		response  reflect.Type
+		arguments []argumentType
+	}
+
+	argumentType struct {
+		t      reflect.Type
+		source ArgumentDataSource
+	}
+
+	// openAPIDocument collects the handlers of the http server and describes them as an OpenAPI 3 document
+	openAPIDocument struct {
+		title   string
+		version string
+		mu      sync.Mutex
+		sources []openAPISource
+	}
+
+	openAPISource struct {
+		prefix   string
+		registry iHandlerRegistry
+	}
+
+	openAPISpec struct {
+		OpenAPI    string                                  `json:"openapi"`
+		Info       openAPIInfo                             `json:"info"`
+		Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+		Components openAPIComponents                       `json:"components"`
+	}
+
+	openAPIInfo struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	}
+
+	openAPIComponents struct {
+		Schemas         map[string]*openAPISchema    `json:"schemas,omitempty"`
+		SecuritySchemes map[string]map[string]string `json:"securitySchemes,omitempty"`
+	}
+
+	openAPIOperation struct {
+		OperationID string                      `json:"operationId,omitempty"`
+		Tags        []string                    `json:"tags,omitempty"`
+		Deprecated  bool                        `json:"deprecated,omitempty"`
+		Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+		RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+		Responses   map[string]*openAPIResponse `json:"responses"`
+		Security    []map[string][]string       `json:"security,omitempty"`
+	}
+
+	openAPIParameter struct {
+		Name     string         `json:"name"`
+		In       string         `json:"in"`
+		Required bool           `json:"required,omitempty"`
+		Schema   *openAPISchema `json:"schema"`
+	}
+
+	openAPIRequestBody struct {
+		Required bool                        `json:"required"`
+		Content  map[string]openAPIMediaType `json:"content"`
+	}
+
+	openAPIResponse struct {
+		Description string                      `json:"description"`
+		Content     map[string]openAPIMediaType `json:"content,omitempty"`
+	}
+
+	openAPIMediaType struct {
+		Schema *openAPISchema `json:"schema"`
+	}
+
+	openAPISchema struct {
+		Ref                  string                    `json:"$ref,omitempty"`
+		Type                 string                    `json:"type,omitempty"`
+		Format               string                    `json:"format,omitempty"`
+		Items                *openAPISchema            `json:"items,omitempty"`
+		Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+		AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+		Required             []string                  `json:"required,omitempty"`
+		Enum                 []any                     `json:"enum,omitempty"`
+		Pattern              string                    `json:"pattern,omitempty"`
+		MinLength            *int                      `json:"minLength,omitempty"`
+		MaxLength            *int                      `json:"maxLength,omitempty"`
+		MinItems             *int                      `json:"minItems,omitempty"`
+		MaxItems             *int                      `json:"maxItems,omitempty"`
+		Minimum              *float64                  `json:"minimum,omitempty"`
+		Maximum              *float64                  `json:"maximum,omitempty"`
+		ExclusiveMinimum     bool                      `json:"exclusiveMinimum,omitempty"`
+		ExclusiveMaximum     bool                      `json:"exclusiveMaximum,omitempty"`
+	}
+
+	// schemaGenerator derives the schemas of types, named structs are added to the components once and referenced
+	schemaGenerator struct {
+		schemas map[string]*openAPISchema
+		names   map[reflect.Type]string
+	}
+)
+
+const bearerSecurityScheme = "bearerAuth"
+
+var (
+	durationType         = reflect.TypeOf(time.Duration(0))
+	rawMessageType       = reflect.TypeOf(json.RawMessage{})
+	responseContractType = reflect.TypeOf(serr.ResponseContract{})
+	// componentNameChars the characters OpenAPI allows in the names of components
+	componentNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+func (r *handler[REQUEST, RESPONSE]) types() handlerTypes {
+	return handlerTypes{
+		request:  reflect.TypeOf((*REQUEST)(nil)).Elem(),
+		response: reflect.TypeOf((*RESPONSE)(nil)).Elem(),
+	}
+}
+
+func (r *Handler2Extensions[REQUEST, RESPONSE, ARG]) types() handlerTypes {
+	t := r.handler.types()
+	t.arguments = []argumentType{argumentTypeOf[ARG]()}
+	return t
+}
+
+func (r *Handler3Extensions[REQUEST, RESPONSE, ARG1, ARG2]) types() handlerTypes {
+	t := r.handler.types()
+	t.arguments = []argumentType{argumentTypeOf[ARG1](), argumentTypeOf[ARG2]()}
+	return t
+}
+
+func (r *Handler4Extensions[REQUEST, RESPONSE, ARG1, ARG2, ARG3]) types() handlerTypes {
+	t := r.handler.types()
+	t.arguments = []argumentType{argumentTypeOf[ARG1](), argumentTypeOf[ARG2](), argumentTypeOf[ARG3]()}
+	return t
+}
+
+func argumentTypeOf[ARG HandlerArgument]() argumentType {
+	var arg ARG
+	return argumentType{t: reflect.TypeOf(&arg).Elem(), source: arg.Source()}
+}
+
+func newOpenAPIDocument(config OpenAPIConfiguration, name string, version string) *openAPIDocument {
+	if config.Title != "" {
+		name = config.Title
+	}
+	if config.Version != "" {
+		version = config.Version
+	}
+	return &openAPIDocument{title: name, version: version}
+}
+
+// add describes the handlers of the registry, served under prefix
+func (d *openAPIDocument) add(prefix string, registry iHandlerRegistry) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sources = append(d.sources, openAPISource{prefix: prefix, registry: registry})
+}
+
+// handler serves the document as JSON
+func (d *openAPIDocument) handler(c *gin.Context) {
+	c.JSON(http.StatusOK, d.spec())
+}
+
+func (d *openAPIDocument) spec() *openAPISpec {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	spec := &openAPISpec{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: d.title, Version: d.version},
+		Paths:   map[string]map[string]*openAPIOperation{},
+	}
+	generator := &schemaGenerator{schemas: map[string]*openAPISchema{}, names: map[reflect.Type]string{}}
+	secured := false
+	for _, source := range d.sources {
+		handlers := source.registry.handlers()
+		// handlers of the same route and method are one operation with a content type per handler, the default handler's first
+		sort.SliceStable(handlers, func(i, j int) bool {
+			if handlers[i].Default != handlers[j].Default {
+				return handlers[i].Default
+			}
+			return handlers[i].Produces < handlers[j].Produces
+		})
+		for _, handler := range handlers {
+			if handler.WebSocket || handler.Disabled {
+				continue
+			}
+			path := openAPIPathOf(joinPaths("/"+strings.TrimPrefix(source.prefix, "/"), handler.Path))
+			operations, ok := spec.Paths[path]
+			if !ok {
+				operations = map[string]*openAPIOperation{}
+				spec.Paths[path] = operations
+			}
+			method := strings.ToLower(handler.Method)
+			operation, ok := operations[method]
+			if !ok {
+				operation = newOperation(generator, handler)
+				operations[method] = operation
+			}
+			generator.addContent(operation, handler)
+			secured = secured || len(operation.Security) > 0
+		}
+	}
+	spec.Components.Schemas = generator.schemas
+	if secured {
+		spec.Components.SecuritySchemes = map[string]map[string]string{
+			bearerSecurityScheme: {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+	}
+	return spec
+}
+
+// newOperation describes the parameters, security and errors of the route of handler, its bodies are added per content type
+func newOperation(g *schemaGenerator, handler *handlerDTO) *openAPIOperation {
+	operation := &openAPIOperation{
+		Deprecated: handler.Deprecation != nil,
+		Responses: map[string]*openAPIResponse{
+			"default": {
+				Description: "Error",
+				Content:     map[string]openAPIMediaType{"application/json": {Schema: g.schema(responseContractType)}},
+			},
+		},
+	}
+	if handler.controllerName != "" {
+		operation.Tags = []string{handler.controllerName}
+	}
+	if handler.handlerName != "" {
+		operation.OperationID = handler.handlerName
+	}
+	if !handler.AuthOptOut {
+		operation.Security = []map[string][]string{{bearerSecurityScheme: {}}}
+	}
+
+	pathParameters := map[string]string{}
+	for _, segment := range strings.Split(handler.Path, "/") {
+		if isWildcardSegment(segment) {
+			pathParameters[strings.ToLower(segment[1:])] = segment[1:]
+		}
+	}
+	for _, argument := range handler.types.arguments {
+		in := map[ArgumentDataSource]string{PathContextSource: "path", QueryContextSource: "query", HeaderContextSource: "header"}[argument.source]
+		if in == "" {
+			continue
+		}
+		schema := g.inline(argument.t)
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			parameter := &openAPIParameter{Name: name, In: in, Required: lo.Contains(schema.Required, name), Schema: schema.Properties[name]}
+			if in == "path" {
+				// arguments are decoded case-insensitively, the route spells the name of the parameter
+				if routeName, ok := pathParameters[strings.ToLower(name)]; ok {
+					parameter.Name = routeName
+				}
+				parameter.Required = true
+			}
+			operation.Parameters = append(operation.Parameters, parameter)
+		}
+	}
+	return operation
+}
+
+// addContent adds the request and response bodies of handler to the operation of its route under its content types
+func (g *schemaGenerator) addContent(operation *openAPIOperation, handler *handlerDTO) {
+	types := handler.types
+	if types.request != nil && types.request != voidType {
+		switch handler.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if operation.RequestBody == nil {
+				operation.RequestBody = &openAPIRequestBody{Required: true, Content: map[string]openAPIMediaType{}}
+			}
+			if _, ok := operation.RequestBody.Content[handler.Consumes]; !ok {
+				operation.RequestBody.Content[handler.Consumes] = openAPIMediaType{Schema: g.schema(types.request)}
+			}
+		}
+	}
+
+	status := handler.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if types.response == nil || types.response == voidType {
+		if status == http.StatusOK {
+			status = http.StatusNoContent
+		}
+		if _, ok := operation.Responses[strconv.Itoa(status)]; !ok {
+			operation.Responses[strconv.Itoa(status)] = &openAPIResponse{Description: http.StatusText(status)}
+		}
+		return
+	}
+	response, ok := operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		response = &openAPIResponse{Description: http.StatusText(status), Content: map[string]openAPIMediaType{}}
+		operation.Responses[strconv.Itoa(status)] = response
+	}
+	schema := &openAPISchema{Type: "string"}
+	if handler.Produces != EventStreamMediaType {
+		schema = g.schema(types.response)
+	}
+	response.Content[handler.Produces] = openAPIMediaType{Schema: schema}
+}
+
+// schema the schema of t, a reference for named structs
+func (g *schemaGenerator) schema(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case rawMessageType:
+		return &openAPISchema{}
+	case byteArrayType:
+		return &openAPISchema{Type: "string", Format: "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.inline(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.componentName(t)
+			// registered before its fields are, so recursive types reference themselves
+			g.names[t] = name
+			g.schemas[name] = g.inline(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	default:
+		// interfaces and anything else JSON can't describe up front
+		return &openAPISchema{}
+	}
+}
+
+// inline the object schema of the fields of struct t, named as encoding/json and mapstructure name them
+func (g *schemaGenerator) inline(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	schema := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+	if t.Kind() != reflect.Struct {
+		return schema
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, embedded := fieldName(field)
+		if name == "-" {
+			continue
+		}
+		if embedded {
+			// the fields of embedded structs are promoted
+			promoted := g.inline(field.Type)
+			for n, s := range promoted.Properties {
+				schema.Properties[n] = s
+			}
+			schema.Required = append(schema.Required, promoted.Required...)
+			continue
+		}
+		property := g.schema(field.Type)
+		if applyValidation(property, field.Tag.Get("validate")) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+	return schema
+}
+
+// fieldName the name of the field in JSON bodies and in the path, query and headers, "-" for fields that aren't decoded.
+// Embedded structs without a name have their fields promoted
+func fieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() && !field.Anonymous {
+		return "-", false
+	}
+	if tag, ok := field.Tag.Lookup("json"); ok {
+		name, _, _ := strings.Cut(tag, ",")
+		if name != "" {
+			return name, false
+		}
+	}
+	if tag, ok := field.Tag.Lookup("mapstructure"); ok {
+		name, options, _ := strings.Cut(tag, ",")
+		if options == "squash" {
+			return "", true
+		}
+		if name != "" {
+			return name, false
+		}
+	}
+	if field.Anonymous {
+		t := field.Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			return "", true
+		}
+	}
+	return field.Name, false
+}
+
+// applyValidation converts the validate tag of a field into constraints of its schema, returns whether the field is required.
+// Rules after dive apply to the items of slices and the values of maps, rules that aren't understood are left out
+func applyValidation(schema *openAPISchema, tag string) bool {
+	if tag == "" || tag == "-" {
+		return false
+	}
+	own, elements, dive := strings.Cut(tag, ",dive")
+	required := false
+	for _, rule := range strings.Split(own, ",") {
+		if rule == "required" {
+			required = true
+			continue
+		}
+		applyRule(schema, rule)
+	}
+	if dive {
+		item := schema.Items
+		if item == nil {
+			item = schema.AdditionalProperties
+		}
+		if item != nil && item.Ref == "" {
+			applyValidation(item, strings.TrimPrefix(elements, ","))
+		}
+	}
+	return required
+}
+
+func applyRule(schema *openAPISchema, rule string) {
+	if schema.Ref != "" || strings.Contains(rule, "|") {
+		return
+	}
+	name, param, _ := strings.Cut(rule, "=")
+	number := func() (float64, bool) {
+		n, err := strconv.ParseFloat(param, 64)
+		return n, err == nil
+	}
+	count := func() (*int, bool) {
+		n, err := strconv.Atoi(param)
+		return &n, err == nil
+	}
+	switch name {
+	case "min", "max", "len":
+		switch schema.Type {
+		case "string":
+			if n, ok := count(); ok {
+				if name != "max" {
+					schema.MinLength = n
+				}
+				if name != "min" {
+					schema.MaxLength = n
+				}
+			}
+		case "array":
+			if n, ok := count(); ok {
+				if name != "max" {
+					schema.MinItems = n
+				}
+				if name != "min" {
+					schema.MaxItems = n
+				}
+			}
+		case "integer", "number":
+			if n, ok := number(); ok {
+				if name != "max" {
+					schema.Minimum = &n
+				}
+				if name != "min" {
+					schema.Maximum = &n
+				}
+			}
+		}
+	case "gt", "gte", "lt", "lte":
+		if schema.Type != "integer" && schema.Type != "number" {
+			return
+		}
+		if n, ok := number(); ok {
+			if strings.HasPrefix(name, "g") {
+				schema.Minimum, schema.ExclusiveMinimum = &n, name == "gt"
+			} else {
+				schema.Maximum, schema.ExclusiveMaximum = &n, name == "lt"
+			}
+		}
+	case "oneof":
+		for _, value := range strings.Fields(param) {
+			if schema.Type == "integer" || schema.Type == "number" {
+				if n, err := strconv.ParseFloat(value, 64); err == nil {
+					schema.Enum = append(schema.Enum, n)
+				}
+				continue
+			}
+			schema.Enum = append(schema.Enum, strings.Trim(value, "'"))
+		}
+	case "email", "hostname", "ipv4", "ipv6", "uuid":
+		schema.Format = name
+	case "uuid4":
+		schema.Format = "uuid"
+	case "url", "uri", "http_url":
+		schema.Format = "uri"
+	case "alpha":
+		schema.Pattern = "^[a-zA-Z]+$"
+	case "alphanum":
+		schema.Pattern = "^[a-zA-Z0-9]+$"
+	case "numeric":
+		schema.Pattern = `^[-+]?[0-9]+(?:\.[0-9]+)?$`
+	case "startswith":
+		schema.Pattern = "^" + regexp.QuoteMeta(param)
+	}
+}
+
+// componentName the name of the component of t, generic types are named after their type arguments without packages. Types with
+// the same name in different packages are numbered
+func (g *schemaGenerator) componentName(t reflect.Type) string {
+	name := t.Name()
+	if base, args, ok := strings.Cut(name, "["); ok {
+		parts := []string{base}
+		for _, arg := range strings.Split(strings.TrimSuffix(args, "]"), ",") {
+			parts = append(parts, arg[strings.LastIndex(arg, ".")+1:])
+		}
+		name = strings.Join(parts, "_")
+	}
+	name = componentNameChars.ReplaceAllString(name, "_")
+	candidate := name
+	for i := 2; ; i++ {
+		if _, taken := g.schemas[candidate]; !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+}
+
+// openAPIPathOf converts the :name and *name parameters of a gin path to {name}
+func openAPIPathOf(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, segment := range segments {
+		if isWildcardSegment(segment) {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
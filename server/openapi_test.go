@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type (
+	specController struct{}
+
+	deploymentSpec struct {
+		Name     string            `json:"name" validate:"required,min=3,max=63"`
+		Strategy string            `json:"strategy,omitempty" validate:"oneof=canary blueGreen"`
+		Replicas int               `json:"replicas" validate:"gte=1,lte=10"`
+		Owner    string            `json:"owner" validate:"omitempty,email"`
+		Targets  []string          `json:"targets" validate:"required,min=1,dive,hostname"`
+		Labels   map[string]string `json:"labels,omitempty"`
+		Parent   *deploymentSpec   `json:"parent,omitempty"`
+		internal string
+	}
+
+	deploymentStatus struct {
+		ID        string    `json:"id"`
+		StartedAt time.Time `json:"startedAt"`
+	}
+
+	deploymentPath struct {
+		ID string `mapstructure:"id" validate:"uuid"`
+	}
+
+	deploymentQuery struct {
+		Limit  int    `validate:"max=100"`
+		Cursor string `mapstructure:"cursor"`
+	}
+)
+
+func (deploymentPath) Source() ArgumentDataSource  { return PathContextSource }
+func (deploymentQuery) Source() ArgumentDataSource { return QueryContextSource }
+
+func (specController) Handlers() []Handler {
+	return []Handler{
+		New1ArgHandler(func(ctx context.Context, _ deploymentSpec, _ deploymentPath) (*Response[deploymentStatus], serr.Error) {
+			return nil, nil
+		}, HandlerConfig{Path: "/deployments/:id", Method: http.MethodPut, StatusCode: http.StatusAccepted}),
+		New2ArgHandler(func(ctx context.Context, _ Void, _ ArmoryPrincipalArgument, _ deploymentQuery) (*Response[[]deploymentStatus], serr.Error) {
+			return nil, nil
+		}, HandlerConfig{Path: "/deployments", Method: http.MethodGet, AuthOptOut: true, Deprecation: &Deprecation{}}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[Void], serr.Error) {
+			return nil, nil
+		}, HandlerConfig{Path: "/deployments/:id", Method: http.MethodDelete}),
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), nil, nil, []IController{specController{}})
+	require.NoError(t, err)
+	document := newOpenAPIDocument(OpenAPIConfiguration{Title: "Deploy Engine"}, "deploy-engine", "1.2.3")
+	document.add("/api", registry)
+
+	g := gin.New()
+	g.GET(openAPIPath, document.handler)
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, openAPIPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var spec openAPISpec
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&spec))
+
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+	assert.Equal(t, openAPIInfo{Title: "Deploy Engine", Version: "1.2.3"}, spec.Info)
+	require.Contains(t, spec.Paths, "/api/deployments/{id}")
+
+	put := spec.Paths["/api/deployments/{id}"]["put"]
+	require.NotNil(t, put)
+	assert.Equal(t, []string{"specController"}, put.Tags)
+	assert.Equal(t, []map[string][]string{{bearerSecurityScheme: {}}}, put.Security)
+	require.Len(t, put.Parameters, 1)
+	assert.Equal(t, &openAPIParameter{Name: "id", In: "path", Required: true, Schema: &openAPISchema{Type: "string", Format: "uuid"}}, put.Parameters[0])
+	assert.Equal(t, "#/components/schemas/deploymentSpec", put.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/deploymentStatus", put.Responses["202"].Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/ResponseContract", put.Responses["default"].Content["application/json"].Schema.Ref)
+
+	list := spec.Paths["/api/deployments"]["get"]
+	require.NotNil(t, list)
+	assert.True(t, list.Deprecated)
+	assert.Empty(t, list.Security, "handlers opting out of auth don't require a token")
+	assert.Nil(t, list.RequestBody)
+	require.Len(t, list.Parameters, 2, "the principal argument isn't a parameter")
+	assert.Equal(t, "Limit", list.Parameters[0].Name)
+	assert.Equal(t, 100.0, *list.Parameters[0].Schema.Maximum)
+	assert.Equal(t, "cursor", list.Parameters[1].Name)
+	items := list.Responses["200"].Content["application/json"].Schema
+	assert.Equal(t, "array", items.Type)
+	assert.Equal(t, "#/components/schemas/deploymentStatus", items.Items.Ref)
+
+	del := spec.Paths["/api/deployments/{id}"]["delete"]
+	require.NotNil(t, del)
+	assert.Contains(t, del.Responses, "204")
+	assert.Empty(t, del.Responses["204"].Content)
+
+	schema := spec.Components.Schemas["deploymentSpec"]
+	require.NotNil(t, schema)
+	assert.ElementsMatch(t, []string{"name", "targets"}, schema.Required)
+	assert.NotContains(t, schema.Properties, "internal")
+	assert.Equal(t, 3, *schema.Properties["name"].MinLength)
+	assert.Equal(t, 63, *schema.Properties["name"].MaxLength)
+	assert.Equal(t, []any{"canary", "blueGreen"}, schema.Properties["strategy"].Enum)
+	assert.Equal(t, 1.0, *schema.Properties["replicas"].Minimum)
+	assert.Equal(t, 10.0, *schema.Properties["replicas"].Maximum)
+	assert.Equal(t, "email", schema.Properties["owner"].Format)
+	assert.Equal(t, 1, *schema.Properties["targets"].MinItems)
+	assert.Equal(t, "hostname", schema.Properties["targets"].Items.Format, "rules after dive constrain the items")
+	assert.Equal(t, "string", schema.Properties["labels"].AdditionalProperties.Type)
+	assert.Equal(t, "#/components/schemas/deploymentSpec", schema.Properties["parent"].Ref, "recursive types reference themselves")
+	assert.Equal(t, "date-time", spec.Components.Schemas["deploymentStatus"].Properties["startedAt"].Format)
+	assert.Contains(t, spec.Components.SecuritySchemes, bearerSecurityScheme)
+}
+
+func TestOpenAPIComponentNames(t *testing.T) {
+	g := &schemaGenerator{schemas: map[string]*openAPISchema{}, names: map[reflect.Type]string{}}
+	assert.Equal(t, "Response_deploymentStatus", g.componentName(reflect.TypeOf(Response[deploymentStatus]{})))
+	g.schemas["deploymentStatus"] = &openAPISchema{}
+	assert.Equal(t, "deploymentStatus2", g.componentName(reflect.TypeOf(deploymentStatus{})), "types of other packages with the same name are numbered")
+	assert.Equal(t, "/deployments/{id}/files/{path}", openAPIPathOf("/deployments/:id/files/*path"))
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/secrets"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+)
+
+// JWEMediaType the media type of JWE compact serialized payloads, the default Consumes and Produces of handlers with HandlerConfig.Encryption
+const JWEMediaType = "application/jose"
+
+var errFailedToDecryptRequest = serr.APIError{
+	Message:        "Failed to decrypt request body",
+	HttpStatusCode: http.StatusBadRequest,
+}
+
+type (
+	// PayloadEncryptionConfiguration the keys of the integrations whose handlers exchange JWE encrypted JSON, see HandlerConfig.Encryption
+	PayloadEncryptionConfiguration struct {
+		// Keys the keys of each integration by name
+		Keys map[string]PayloadEncryptionKey
+	}
+
+	// PayloadEncryptionKey the keys requests and responses of an integration are encrypted with. Keys are JWKs, given inline or as a reference
+	// to a secret engine, ex: encrypted:secrets-manager!r:us-west-2!s:partner-jwe!k:privateKey
+	PayloadEncryptionKey struct {
+		// DecryptionKey the private key the integration encrypts requests to
+		DecryptionKey string
+		// EncryptionKey the public key of the integration responses are encrypted to
+		EncryptionKey string
+		// KeyAlgorithm the key management algorithm, defaults to RSA-OAEP-256
+		KeyAlgorithm string
+		// ContentAlgorithm the content encryption algorithm of responses, defaults to A256GCM
+		ContentAlgorithm string
+	}
+
+	// payloadEncryption the parsed keys of the integrations by name
+	payloadEncryption struct {
+		keys map[string]*payloadKeys
+		log  *zap.SugaredLogger
+	}
+
+	payloadKeys struct {
+		decryptionKey    jwk.Key
+		encryptionKey    jwk.Key
+		keyAlgorithm     jwa.KeyEncryptionAlgorithm
+		contentAlgorithm jwa.ContentEncryptionAlgorithm
+	}
+)
+
+// newPayloadEncryption resolves and parses the keys of every integration, nil when there are none
+func newPayloadEncryption(ctx context.Context, config PayloadEncryptionConfiguration, log *zap.SugaredLogger) (*payloadEncryption, error) {
+	if len(config.Keys) == 0 {
+		return nil, nil
+	}
+	e := &payloadEncryption{keys: make(map[string]*payloadKeys, len(config.Keys)), log: log}
+	for name, key := range config.Keys {
+		keys, err := parsePayloadKeys(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("payload encryption keys of %s: %w", name, err)
+		}
+		e.keys[name] = keys
+	}
+	return e, nil
+}
+
+func parsePayloadKeys(ctx context.Context, config PayloadEncryptionKey) (*payloadKeys, error) {
+	keys := &payloadKeys{keyAlgorithm: jwa.RSA_OAEP_256, contentAlgorithm: jwa.A256GCM}
+	if config.KeyAlgorithm != "" {
+		if err := keys.keyAlgorithm.Accept(config.KeyAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+	if config.ContentAlgorithm != "" {
+		if err := keys.contentAlgorithm.Accept(config.ContentAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if keys.decryptionKey, err = parseJWK(ctx, config.DecryptionKey); err != nil {
+		return nil, fmt.Errorf("decryption key: %w", err)
+	}
+	if keys.encryptionKey, err = parseJWK(ctx, config.EncryptionKey); err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	return keys, nil
+}
+
+// parseJWK parses the JWK, reading it from the secret engine it references if any
+func parseJWK(ctx context.Context, value string, options ...jwk.ParseOption) (jwk.Key, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+	value, err := resolveSecret(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	return jwk.ParseKey([]byte(value), options...)
+}
+
+// resolveSecret reads the value from the secret engine it references, values that aren't references are returned as is
+func resolveSecret(ctx context.Context, value string) (string, error) {
+	if secrets.IsEncryptedSecret(value) {
+		d, err := secrets.NewDecrypter(ctx, value)
+		if err != nil {
+			return "", err
+		}
+		if value, err = d.Decrypt(); err != nil {
+			return "", err
+		}
+		// encryptedFile references are decrypted to a file holding the key
+		if d.IsFile() {
+			contents, err := os.ReadFile(value)
+			if err != nil {
+				return "", err
+			}
+			value = string(contents)
+		}
+	}
+	return value, nil
+}
+
+// apply makes the handler decrypt request bodies before its arguments are extracted and validated, and encrypt its marshaled responses
+// after the other response processors ran. Error responses aren't encrypted
+func (e *payloadEncryption) apply(handler *handlerDTO) error {
+	if handler.Encryption == "" {
+		return nil
+	}
+	if e == nil || e.keys[handler.Encryption] == nil {
+		return fmt.Errorf("handler with method: %s, path: %s uses unknown payload encryption keys %q", handler.Method, handler.Path, handler.Encryption)
+	}
+	keys := e.keys[handler.Encryption]
+
+	next := handler.HandlerFn
+	handler.HandlerFn = func(c *gin.Context) {
+		if err := keys.decryptRequest(c.Request); err != nil {
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(errFailedToDecryptRequest,
+				serr.WithCause(err),
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			), e.log)
+			return
+		}
+		next(c)
+	}
+	handler.ResponseProcessors = append(handler.ResponseProcessors, keys.encryptResponse)
+	return nil
+}
+
+func (k *payloadKeys) decryptRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	encrypted, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	_ = req.Body.Close()
+	if len(bytes.TrimSpace(encrypted)) == 0 {
+		req.Body = http.NoBody
+		return nil
+	}
+	payload, err := jwe.Decrypt(bytes.TrimSpace(encrypted), k.keyAlgorithm, k.decryptionKey)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	return nil
+}
+
+func (k *payloadKeys) encryptResponse(_ context.Context, payload []byte) ([]byte, serr.Error) {
+	encrypted, err := jwe.Encrypt(payload, k.keyAlgorithm, k.encryptionKey, k.contentAlgorithm, jwa.NoCompress)
+	if err != nil {
+		return nil, serr.NewErrorResponseFromApiError(serr.APIError{
+			Message:        "Failed to encrypt response",
+			HttpStatusCode: http.StatusInternalServerError,
+		}, serr.WithCause(err))
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type (
+	encryptedController struct{}
+
+	encryptedRequest struct {
+		Name string `json:"name" validate:"required"`
+	}
+
+	encryptedResponse struct {
+		Greeting string `json:"greeting"`
+	}
+)
+
+func (encryptedController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, request encryptedRequest) (*Response[encryptedResponse], serr.Error) {
+			return SimpleResponse(encryptedResponse{Greeting: "hello " + request.Name}), nil
+		}, HandlerConfig{
+			Path:       "/greetings",
+			Method:     http.MethodPost,
+			AuthOptOut: true,
+			Encryption: "partner",
+		}),
+	}
+}
+
+func jwkJSON(t *testing.T, raw any) string {
+	key, err := jwk.New(raw)
+	require.NoError(t, err)
+	b, err := json.Marshal(key)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	partnerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	encryption, err := newPayloadEncryption(context.Background(), PayloadEncryptionConfiguration{
+		Keys: map[string]PayloadEncryptionKey{
+			"partner": {DecryptionKey: jwkJSON(t, serverKey), EncryptionKey: jwkJSON(t, &partnerKey.PublicKey)},
+		},
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{encryptedController{}})
+	require.NoError(t, err)
+	g := gin.New()
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group(""),
+		AuthNotEnforcedGroup: g.Group(""),
+		Encryption:           encryption,
+	}))
+
+	serve := func(payload string) *httptest.ResponseRecorder {
+		encrypted, err := jwe.Encrypt([]byte(payload), jwa.RSA_OAEP_256, &serverKey.PublicKey, jwa.A256GCM, jwa.NoCompress)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/greetings", strings.NewReader(string(encrypted)))
+		req.Header.Set("Content-Type", JWEMediaType)
+		req.Header.Set("Accept", JWEMediaType)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(`{"name":"partner"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, JWEMediaType, w.Header().Get("Content-Type"))
+	decrypted, err := jwe.Decrypt(w.Body.Bytes(), jwa.RSA_OAEP_256, partnerKey)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"greeting":"hello partner"}`, string(decrypted))
+
+	w = serve(`{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "decrypted bodies are validated")
+
+	req := httptest.NewRequest(http.MethodPost, "/greetings", strings.NewReader(`{"name":"partner"}`))
+	req.Header.Set("Content-Type", JWEMediaType)
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "plain bodies are rejected")
+	assert.Contains(t, w.Body.String(), errFailedToDecryptRequest.Message)
+}
+
+func TestPayloadEncryptionUnknownKeys(t *testing.T) {
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{encryptedController{}})
+	require.NoError(t, err)
+	g := gin.New()
+	err = registry.registerHandlers(registerHandlersInput{AuthRequiredGroup: g.Group(""), AuthNotEnforcedGroup: g.Group("")})
+	assert.ErrorContains(t, err, `uses unknown payload encryption keys "partner"`)
+}
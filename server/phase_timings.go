@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	phaseAuth       = "auth"
+	phaseBodyRead   = "bodyRead"
+	phaseValidation = "validation"
+	phaseHandler    = "handler"
+	phaseMarshal    = "marshal"
+	phaseWrite      = "write"
+
+	serverTimingHeader = "Server-Timing"
+)
+
+var phaseTimingsKey = ctxutil.NewKey[*phaseTimings]("server.phaseTimings")
+
+type (
+	// phaseTimings the time ginHOF spent in each phase of a request, see DiagnosticsConfiguration.PhaseTimings
+	phaseTimings struct {
+		clock  clock.Clock
+		header bool
+		phases []phaseTiming
+		// headerSent whether the Server-Timing header was added, it can't be once the response is written
+		headerSent bool
+	}
+
+	phaseTiming struct {
+		name     string
+		duration time.Duration
+	}
+)
+
+// phaseTimingsMiddleware records the phases of the handlers of the server, optionally sending them in a Server-Timing header
+func phaseTimingsMiddleware(header bool, c clock.Clock) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		timings := &phaseTimings{clock: clock.OrDefault(c), header: header}
+		ctx.Request = ctx.Request.WithContext(phaseTimingsKey.WithValue(ctx.Request.Context(), timings))
+		ctx.Next()
+		timings.annotate(trace.SpanFromContext(ctx.Request.Context()))
+	}
+}
+
+// phaseTimingsOf the timings of the request, nil when they aren't recorded
+func phaseTimingsOf(ctx context.Context) *phaseTimings {
+	timings, _ := phaseTimingsKey.Value(ctx)
+	return timings
+}
+
+// start times a phase until the returned func is called, phases timed more than once add up
+func (t *phaseTimings) start(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := t.clock.Now()
+	return func() {
+		elapsed := t.clock.Since(start)
+		for i := range t.phases {
+			if t.phases[i].name == phase {
+				t.phases[i].duration += elapsed
+				return
+			}
+		}
+		t.phases = append(t.phases, phaseTiming{name: phase, duration: elapsed})
+	}
+}
+
+// beforeWrite adds the Server-Timing header of the phases so far, the write phase itself is only recorded on the span
+func (t *phaseTimings) beforeWrite(h http.Header) {
+	if t == nil || !t.header || t.headerSent || len(t.phases) == 0 {
+		return
+	}
+	t.headerSent = true
+	metrics := make([]string, 0, len(t.phases))
+	for _, phase := range t.phases {
+		metrics = append(metrics, phase.name+";dur="+milliseconds(phase.duration))
+	}
+	h.Add(serverTimingHeader, strings.Join(metrics, ", "))
+}
+
+// annotate adds the phases to the span of the request as handler.phase.<name>.ms attributes
+func (t *phaseTimings) annotate(span trace.Span) {
+	if len(t.phases) == 0 || !span.IsRecording() {
+		return
+	}
+	attributes := make([]attribute.KeyValue, 0, len(t.phases))
+	for _, phase := range t.phases {
+		attributes = append(attributes, attribute.Float64("handler.phase."+phase.name+".ms", float64(phase.duration)/float64(time.Millisecond)))
+	}
+	span.SetAttributes(attributes...)
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
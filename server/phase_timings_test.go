@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+type phaseTimingsResponse struct {
+	ID string `json:"id"`
+}
+
+func TestPhaseTimings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	recorder := tracetest.NewSpanRecorder()
+
+	serve := func(header bool) *httptest.ResponseRecorder {
+		g := gin.New()
+		g.Use(otelgin.Middleware("test", otelgin.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))))
+		g.Use(phaseTimingsMiddleware(header, fake))
+		g.GET("/deployments/:id", ginHOF(func(ctx context.Context, _ Void) (*Response[phaseTimingsResponse], serr.Error) {
+			fake.Advance(5 * time.Millisecond)
+			return SimpleResponse(phaseTimingsResponse{ID: "dep-1"}), nil
+		}, nil, &handlerDTO{AuthOptOut: true, Produces: "application/json"}, validator.New(), &HandlerExtensionPoints{}, zap.NewNop().Sugar()))
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deployments/dep-1", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"id":"dep-1"}`, w.Body.String())
+		return w
+	}
+
+	w := serve(false)
+	assert.Empty(t, w.Header().Get(serverTimingHeader))
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[0].Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	assert.Equal(t, 5.0, attributes["handler.phase.handler.ms"].AsFloat64())
+	for _, phase := range []string{phaseAuth, phaseBodyRead, phaseValidation, phaseMarshal, phaseWrite} {
+		assert.Contains(t, attributes, attribute.Key("handler.phase."+phase+".ms"))
+	}
+
+	w = serve(true)
+	assert.Equal(t, "auth;dur=0.000, bodyRead;dur=0.000, validation;dur=0.000, handler;dur=5.000, marshal;dur=0.000", w.Header().Get(serverTimingHeader))
+}
+
+func TestPhaseTimingsNotRecorded(t *testing.T) {
+	var timings *phaseTimings
+	timings.start(phaseHandler)()
+	h := http.Header{}
+	timings.beforeWrite(h)
+	assert.Empty(t, h)
+	assert.Nil(t, phaseTimingsOf(context.Background()))
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FlatQuerySyntax query parameter names are used as is, this is the default
+	FlatQuerySyntax QuerySyntax = iota
+	// BracketQuerySyntax nests query parameters on brackets, ex: ?filter[status]=ACTIVE&page[size]=10. A trailing [] always
+	// decodes into a list, ex: ?filter[tag][]=a&filter[tag][]=b
+	BracketQuerySyntax
+	// DotQuerySyntax nests query parameters on dots, ex: ?filter.status=ACTIVE&page.size=10
+	DotQuerySyntax
+
+	maxQueryDepth = 5
+)
+
+// queryDecodeErrorPatterns the errors of mapstructure name the value that failed to decode in quotes, see queryDecodeError
+var queryDecodeErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^error decoding '([^']*)': (.*)$`),
+	regexp.MustCompile(`^cannot parse '([^']*)' as (\w+)`),
+	regexp.MustCompile(`^'([^']*)' expected type '([^']*)'`),
+}
+
+type (
+	// QuerySyntax how the names of query parameters describe nested values
+	QuerySyntax int
+
+	// NestedQueryArgument a QueryContextSource argument with nested query parameters, which are decoded into nested structs or maps:
+	//
+	//	type listQuery struct {
+	//		Filter struct {
+	//			Status string `mapstructure:"status"`
+	//		} `mapstructure:"filter"`
+	//		Page struct {
+	//			Size int `mapstructure:"size" validate:"max=100"`
+	//		} `mapstructure:"page"`
+	//	}
+	//
+	//	func (listQuery) Source() server.ArgumentDataSource { return server.QueryContextSource }
+	//	func (listQuery) QuerySyntax() server.QuerySyntax   { return server.BracketQuerySyntax }
+	//
+	// Unlike flat query parameters, a parameter given once decodes into a single value, so fields don't have to be slices.
+	// Repeated parameters still decode into slices.
+	NestedQueryArgument interface {
+		HandlerArgument
+		QuerySyntax() QuerySyntax
+	}
+)
+
+// ExtractNestedQueryParamsFromRequestContext accepts a type param T and attempts to map the HTTP request's query params,
+// nested according to syntax, into T. See NestedQueryArgument.
+func ExtractNestedQueryParamsFromRequestContext[T any](ctx context.Context, syntax QuerySyntax) (*T, serr.Error) {
+	var result T
+	err := extractNestedQuery(ctx, syntax, &result)
+	return &result, err
+}
+
+func extractNestedQuery[T any](ctx context.Context, syntax QuerySyntax, target *T) serr.Error {
+	d, sErr := ExtractRequestDetailsFromContext(ctx)
+	if sErr != nil {
+		return sErr
+	}
+
+	nested, err := nestQuery(d.QueryParameters, syntax)
+	if err != nil {
+		return serr.NewErrorResponseFromApiError(serr.APIError{
+			Message:        err.Error(),
+			HttpStatusCode: http.StatusBadRequest,
+		},
+			serr.WithCause(err),
+			serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+		)
+	}
+
+	return decodeQuery(nested, target)
+}
+
+// decodeQuery weakly decodes query parameters into target. Besides what mapstructure.WeakDecode supports:
+//   - scalar fields take parameters given once
+//   - time.Time fields take RFC 3339 times or unix seconds, ex: ?since=2023-06-01T00:00:00Z or ?since=1685577600
+//   - slice fields take comma separated lists as well as repeated parameters, ex: ?id=a,b&id=c
+//   - map[string]T fields take comma separated key=value pairs, ex: ?labels=team=cd,tier=1
+//
+// Values that can't be decoded are answered with a 400 naming the parameters
+func decodeQuery(query any, target any) serr.Error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.ComposeDecodeHookFunc(queryScalarHook, queryTimeHook, querySliceHook, queryMapHook),
+		WeaklyTypedInput: true,
+		Result:           target,
+	})
+	if err != nil {
+		return serr.NewErrorResponseFromApiError(unableToExtractRequestDetails, serr.WithCause(err))
+	}
+	if err := decoder.Decode(query); err != nil {
+		return queryDecodeError(err)
+	}
+	return nil
+}
+
+// queryValue the single value of a parameter, which the query gives as a list
+func queryValue(data any) (string, error) {
+	switch v := data.(type) {
+	case string:
+		return v, nil
+	case []string:
+		if len(v) != 1 {
+			return "", fmt.Errorf("given %d times, expected once", len(v))
+		}
+		return v[0], nil
+	}
+	return "", fmt.Errorf("unexpected value %v", data)
+}
+
+func isQueryValue(data any) bool {
+	switch data.(type) {
+	case string, []string:
+		return true
+	}
+	return false
+}
+
+// queryScalarHook decodes parameters given once into scalar fields, which mapstructure doesn't from a list
+func queryScalarHook(_ reflect.Type, to reflect.Type, data any) (any, error) {
+	values, ok := data.([]string)
+	if !ok {
+		return data, nil
+	}
+	switch to.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct, reflect.Interface:
+		return data, nil
+	}
+	return queryValue(values)
+}
+
+func queryTimeHook(_ reflect.Type, to reflect.Type, data any) (any, error) {
+	if to != timeType || !isQueryValue(data) {
+		return data, nil
+	}
+	value, err := queryValue(data)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	// the + of an offset that wasn't escaped is decoded as a space
+	if t, err := time.Parse(time.RFC3339Nano, strings.Replace(value, " ", "+", 1)); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return nil, fmt.Errorf("%q is not a valid time, expected RFC 3339 or unix seconds", value)
+}
+
+// querySliceHook splits the values of slices on commas, empty items are dropped
+func querySliceHook(_ reflect.Type, to reflect.Type, data any) (any, error) {
+	if to.Kind() != reflect.Slice || to.Elem().Kind() == reflect.Uint8 || !isQueryValue(data) {
+		return data, nil
+	}
+	values, ok := data.([]string)
+	if !ok {
+		values = []string{data.(string)}
+	}
+	items := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// queryMapHook decodes comma separated key=value pairs into maps with string keys, repeated parameters add pairs
+func queryMapHook(_ reflect.Type, to reflect.Type, data any) (any, error) {
+	if to.Kind() != reflect.Map || to.Key().Kind() != reflect.String || !isQueryValue(data) {
+		return data, nil
+	}
+	items, err := querySliceHook(reflect.TypeOf([]string{}), reflect.TypeOf([]string{}), data)
+	if err != nil {
+		return nil, err
+	}
+	pairs := map[string]string{}
+	for _, item := range items.([]string) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", item)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+// queryDecodeError a 400 naming the parameters that failed to decode, as named by the tags of the fields they decode into
+func queryDecodeError(err error) serr.Error {
+	messages := []string{err.Error()}
+	if decodeErr, ok := err.(*mapstructure.Error); ok {
+		messages = decodeErr.Errors
+	}
+	var parameters, reasons []string
+	for _, message := range messages {
+		parameter, reason := explainQueryDecodeError(message)
+		if parameter != "" {
+			parameters = append(parameters, parameter)
+			reason = parameter + ": " + reason
+		}
+		reasons = append(reasons, reason)
+	}
+	return serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        "Invalid query parameter " + strings.Join(reasons, "; "),
+		Metadata:       map[string]any{"parameters": parameters},
+		HttpStatusCode: http.StatusBadRequest,
+	},
+		serr.WithCause(err),
+		serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+	)
+}
+
+func explainQueryDecodeError(message string) (string, string) {
+	for i, pattern := range queryDecodeErrorPatterns {
+		match := pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		if i == 0 {
+			return match[1], match[2]
+		}
+		return match[1], "expected " + match[2]
+	}
+	return "", message
+}
+
+// nestQuery turns the query parameters into a tree of maps, with a string for parameters given once and a slice of strings
+// for repeated ones
+func nestQuery(query map[string][]string, syntax QuerySyntax) (map[string]any, error) {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	// sorted so conflicts are reported the same way on every request
+	sort.Strings(names)
+
+	root := map[string]any{}
+	for _, name := range names {
+		path, list, err := splitQueryName(name, syntax)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > maxQueryDepth {
+			return nil, fmt.Errorf("query parameter %s is nested deeper than %d levels", name, maxQueryDepth)
+		}
+
+		node := root
+		for _, segment := range path[:len(path)-1] {
+			switch child := node[segment].(type) {
+			case nil:
+				next := map[string]any{}
+				node[segment] = next
+				node = next
+			case map[string]any:
+				node = child
+			default:
+				return nil, fmt.Errorf("query parameter %s conflicts with another parameter", name)
+			}
+		}
+
+		leaf := path[len(path)-1]
+		if _, exists := node[leaf]; exists {
+			return nil, fmt.Errorf("query parameter %s conflicts with another parameter", name)
+		}
+		values := query[name]
+		if len(values) == 1 && !list {
+			node[leaf] = values[0]
+		} else {
+			node[leaf] = values
+		}
+	}
+	return root, nil
+}
+
+// splitQueryName splits the name of a query parameter into the path of its value, and whether it ends in [] to always be a list
+func splitQueryName(name string, syntax QuerySyntax) ([]string, bool, error) {
+	switch syntax {
+	case BracketQuerySyntax:
+		return splitBracketName(name)
+	case DotQuerySyntax:
+		path := strings.Split(name, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, false, fmt.Errorf("malformed query parameter %s", name)
+			}
+		}
+		return path, false, nil
+	default:
+		return []string{name}, false, nil
+	}
+}
+
+func splitBracketName(name string) ([]string, bool, error) {
+	malformed := fmt.Errorf("malformed query parameter %s", name)
+	open := strings.IndexByte(name, '[')
+	if open == -1 {
+		if strings.IndexByte(name, ']') != -1 {
+			return nil, false, malformed
+		}
+		return []string{name}, false, nil
+	}
+	if open == 0 {
+		return nil, false, malformed
+	}
+
+	path := []string{name[:open]}
+	rest := name[open:]
+	for rest != "" {
+		end := strings.IndexByte(rest, ']')
+		if rest[0] != '[' || end == -1 {
+			return nil, false, malformed
+		}
+		segment := rest[1:end]
+		rest = rest[end+1:]
+		if strings.ContainsAny(segment, "[") {
+			return nil, false, malformed
+		}
+		if segment == "" {
+			// only a trailing [] marks a list
+			if rest != "" {
+				return nil, false, malformed
+			}
+			return path, true, nil
+		}
+		path = append(path, segment)
+	}
+	return path, false, nil
+}
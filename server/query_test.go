@@ -0,0 +1,182 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type listQuery struct {
+	Filter struct {
+		Status string   `mapstructure:"status"`
+		Tags   []string `mapstructure:"tag"`
+	} `mapstructure:"filter"`
+	Page struct {
+		Size int `mapstructure:"size" validate:"max=100"`
+	} `mapstructure:"page"`
+	Sort []string `mapstructure:"sort"`
+}
+
+func (listQuery) Source() ArgumentDataSource { return QueryContextSource }
+func (listQuery) QuerySyntax() QuerySyntax   { return BracketQuerySyntax }
+
+type searchQuery struct {
+	Since  time.Time         `mapstructure:"since"`
+	Until  *time.Time        `mapstructure:"until"`
+	IDs    []string          `mapstructure:"id"`
+	Sizes  []int             `mapstructure:"size"`
+	Labels map[string]string `mapstructure:"labels"`
+	Limit  int               `mapstructure:"limit"`
+}
+
+func (searchQuery) Source() ArgumentDataSource { return QueryContextSource }
+
+func TestNestQuery(t *testing.T) {
+	cases := map[string]struct {
+		query         string
+		syntax        QuerySyntax
+		expected      map[string]any
+		expectedError string
+	}{
+		"brackets": {
+			query:    "filter[status]=ACTIVE&filter[tag][]=a&page[size]=10&sort=name&sort=age",
+			syntax:   BracketQuerySyntax,
+			expected: map[string]any{"filter": map[string]any{"status": "ACTIVE", "tag": []string{"a"}}, "page": map[string]any{"size": "10"}, "sort": []string{"name", "age"}},
+		},
+		"dots": {
+			query:    "filter.status=ACTIVE&page.size=10",
+			syntax:   DotQuerySyntax,
+			expected: map[string]any{"filter": map[string]any{"status": "ACTIVE"}, "page": map[string]any{"size": "10"}},
+		},
+		"flat": {
+			query:    "filter[status]=ACTIVE",
+			syntax:   FlatQuerySyntax,
+			expected: map[string]any{"filter[status]": "ACTIVE"},
+		},
+		"conflict": {
+			query:         "filter=ACTIVE&filter[status]=ACTIVE",
+			syntax:        BracketQuerySyntax,
+			expectedError: "query parameter filter[status] conflicts with another parameter",
+		},
+		"unclosed bracket": {
+			query:         "filter[status=ACTIVE",
+			syntax:        BracketQuerySyntax,
+			expectedError: "malformed query parameter filter[status",
+		},
+		"list in the middle": {
+			query:         "filter[][status]=ACTIVE",
+			syntax:        BracketQuerySyntax,
+			expectedError: "malformed query parameter filter[][status]",
+		},
+		"empty dot segment": {
+			query:         "filter..status=ACTIVE",
+			syntax:        DotQuerySyntax,
+			expectedError: "malformed query parameter filter..status",
+		},
+		"too deep": {
+			query:         "a.b.c.d.e.f=1",
+			syntax:        DotQuerySyntax,
+			expectedError: "query parameter a.b.c.d.e.f is nested deeper than 5 levels",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			query, err := url.ParseQuery(c.query)
+			assert.NoError(t, err)
+			nested, err := nestQuery(query, c.syntax)
+			if c.expectedError != "" {
+				assert.EqualError(t, err, c.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, nested)
+		})
+	}
+}
+
+func TestNestedQueryArgument(t *testing.T) {
+	extract := func(rawQuery string) (*listQuery, int) {
+		query, _ := url.ParseQuery(rawQuery)
+		ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{QueryParameters: query})
+		arg, err := extractHandlerArgumentFromContext[listQuery](ctx, validator.New())
+		if err != nil {
+			return arg, err.Errors()[0].HttpStatusCode
+		}
+		return arg, http.StatusOK
+	}
+
+	arg, status := extract("filter[status]=ACTIVE&filter[tag][]=a&filter[tag][]=b&page[size]=10&sort=name")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ACTIVE", arg.Filter.Status)
+	assert.Equal(t, []string{"a", "b"}, arg.Filter.Tags)
+	assert.Equal(t, 10, arg.Page.Size)
+	assert.Equal(t, []string{"name"}, arg.Sort)
+
+	_, status = extract("page[size]=1000")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	_, status = extract("page=1&page[size]=10")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestQueryArgument(t *testing.T) {
+	extract := func(rawQuery string) (*searchQuery, *serr.APIError) {
+		query, _ := url.ParseQuery(rawQuery)
+		ctx := AddRequestDetailsToCtx(context.Background(), RequestDetails{QueryParameters: query})
+		arg, err := extractHandlerArgumentFromContext[searchQuery](ctx, validator.New())
+		if err != nil {
+			return arg, &err.Errors()[0]
+		}
+		return arg, nil
+	}
+
+	arg, err := extract("since=2023-06-01T10:00:00Z&until=1685613600&id=a,b&id=c&size=1,,2&labels=team=cd,tier=1&limit=10")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC), arg.Since)
+	assert.Equal(t, time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC), *arg.Until, "times can be unix seconds")
+	assert.Equal(t, []string{"a", "b", "c"}, arg.IDs, "lists can be comma separated and repeated")
+	assert.Equal(t, []int{1, 2}, arg.Sizes)
+	assert.Equal(t, map[string]string{"team": "cd", "tier": "1"}, arg.Labels)
+	assert.Equal(t, 10, arg.Limit)
+
+	arg, err = extract("since=2023-06-01T10:00:00+02:00")
+	assert.Nil(t, err)
+	assert.True(t, time.Date(2023, 6, 1, 8, 0, 0, 0, time.UTC).Equal(arg.Since), "an unescaped + is decoded as a space")
+
+	cases := map[string]string{
+		"since=yesterday": `Invalid query parameter since: "yesterday" is not a valid time, expected RFC 3339 or unix seconds`,
+		"since=1&since=2": "Invalid query parameter since: given 2 times, expected once",
+		"labels=team":     `Invalid query parameter labels: "team" is not a key=value pair`,
+		"limit=ten":       "Invalid query parameter limit: expected int",
+		"size=1,two":      "Invalid query parameter size[1]: expected int",
+	}
+	for rawQuery, expected := range cases {
+		_, err = extract(rawQuery)
+		if assert.NotNil(t, err, rawQuery) {
+			assert.Equal(t, expected, err.Message, rawQuery)
+		}
+	}
+	_, err = extract("limit=ten&since=yesterday")
+	assert.Equal(t, []string{"since", "limit"}, err.Metadata["parameters"], "every offending parameter is named")
+}
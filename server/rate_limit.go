@@ -0,0 +1,260 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitByOrg shares the bucket of an org between its principals. This is the default
+	RateLimitByOrg = "org"
+	// RateLimitByPrincipal gives every principal of an org a bucket of its own
+	RateLimitByPrincipal = "principal"
+
+	// BackpressureRateLimit the source of the backpressure of RateLimitConfiguration
+	BackpressureRateLimit = "rateLimit"
+
+	// RateLimitExceededErrorCode the code of the errors answering requests over the rate limit
+	RateLimitExceededErrorCode = 4290
+
+	rateLimitRejectedMetric = "http.server.rateLimit.rejected"
+
+	// rateLimitSweepInterval how often the in memory store forgets the buckets that refilled
+	rateLimitSweepInterval = time.Minute
+)
+
+var rateLimitExceeded = serr.APIError{
+	Code:           RateLimitExceededErrorCode,
+	Message:        "Too many requests, try again later",
+	HttpStatusCode: http.StatusTooManyRequests,
+}
+
+type (
+	// RateLimitConfiguration limits the requests of each org with a token bucket, so that one tenant can't starve the others. Requests over
+	// the limit are answered with a 429 and the headers of their Backpressure without being handled, and counted by the
+	// http.server.rateLimit.rejected metric. Requests without a principal are limited per client IP.
+	//
+	// Buckets are kept in memory by default, so every replica limits on its own. Provide a RateLimitStore to the server to share
+	// them between replicas
+	RateLimitConfiguration struct {
+		Enabled bool
+		// RequestsPerSecond the rate the bucket of each org refills at
+		RequestsPerSecond float64
+		// Burst the requests an org can make at once, defaults to RequestsPerSecond rounded up
+		Burst int
+		// Key what requests share a bucket, org or principal. Defaults to org
+		Key string
+		// Orgs the limits of orgs that differ from the default by org id, such as orgs on an enterprise plan
+		Orgs map[string]RateLimit
+		// BlockList routes that are never limited, such as the health check endpoints
+		BlockList []string
+		// store where buckets are kept, the RateLimitStore provided to the server or else an in memory store
+		store RateLimitStore
+	}
+
+	// RateLimit the rate a bucket refills at and the tokens it holds
+	RateLimit struct {
+		RequestsPerSecond float64
+		Burst             int
+	}
+
+	// RateLimitDecision whether a request was allowed, Remaining the tokens left in its bucket and RetryAfter, for requests that weren't,
+	// when the bucket has a token again
+	RateLimitDecision struct {
+		Allowed    bool
+		Remaining  int
+		RetryAfter time.Duration
+	}
+
+	// RateLimitStore keeps the token buckets, provide one backed by a shared cache such as Redis to the server to limit orgs across
+	// replicas. The server uses an in memory store by default
+	RateLimitStore interface {
+		// Take takes a token from the bucket of key, which is created full
+		Take(ctx context.Context, key string, limit RateLimit) (RateLimitDecision, error)
+	}
+
+	// InMemoryRateLimitStore a RateLimitStore for a single replica
+	InMemoryRateLimitStore struct {
+		clock     clock.Clock
+		mu        sync.Mutex
+		buckets   map[string]*tokenBucket
+		lastSweep time.Time
+	}
+
+	tokenBucket struct {
+		tokens  float64
+		updated time.Time
+		// full when the bucket will have refilled, after which it can be forgotten
+		full time.Time
+	}
+
+	// rateLimiter takes a token for every request from the bucket of its org
+	rateLimiter struct {
+		config RateLimitConfiguration
+		// limit the limit of orgs without one of their own and of requests without a principal
+		limit    RateLimit
+		orgs     map[string]RateLimit
+		log      *zap.SugaredLogger
+		rejected tally.Counter
+	}
+)
+
+// NewInMemoryRateLimitStore creates an InMemoryRateLimitStore, buckets that refilled are swept as tokens are taken
+func NewInMemoryRateLimitStore(c clock.Clock) *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{clock: clock.OrDefault(c), buckets: map[string]*tokenBucket{}}
+}
+
+func (s *InMemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (RateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	s.sweepLocked(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.RequestsPerSecond)
+	b.updated = now
+
+	decision := RateLimitDecision{}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = time.Duration((1 - b.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	decision.Remaining = int(b.tokens)
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.RequestsPerSecond * float64(time.Second)))
+	return decision, nil
+}
+
+func (s *InMemoryRateLimitStore) sweepLocked(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (c RateLimitConfiguration) withDefaults() RateLimitConfiguration {
+	if c.Key == "" {
+		c.Key = RateLimitByOrg
+	}
+	if c.store == nil {
+		c.store = NewInMemoryRateLimitStore(nil)
+	}
+	return c
+}
+
+func (l RateLimit) withDefaults() RateLimit {
+	if l.Burst <= 0 {
+		l.Burst = int(math.Ceil(l.RequestsPerSecond))
+	}
+	return l
+}
+
+// newRateLimiter creates the limiter of a server, nil when rate limiting is disabled
+func newRateLimiter(name string, config RateLimitConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) (*rateLimiter, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	config = config.withDefaults()
+	if config.Key != RateLimitByOrg && config.Key != RateLimitByPrincipal {
+		return nil, fmt.Errorf("rate limit of %s: unknown key %q, expected %q or %q", name, config.Key, RateLimitByOrg, RateLimitByPrincipal)
+	}
+	limit := RateLimit{RequestsPerSecond: config.RequestsPerSecond, Burst: config.Burst}.withDefaults()
+	if limit.RequestsPerSecond <= 0 {
+		return nil, fmt.Errorf("rate limit of %s: requestsPerSecond must be positive", name)
+	}
+	orgs := make(map[string]RateLimit, len(config.Orgs))
+	for org, orgLimit := range config.Orgs {
+		if orgLimit.RequestsPerSecond <= 0 {
+			return nil, fmt.Errorf("rate limit of %s: requestsPerSecond of org %s must be positive", name, org)
+		}
+		orgs[org] = orgLimit.withDefaults()
+	}
+	return &rateLimiter{
+		config:   config,
+		limit:    limit,
+		orgs:     orgs,
+		log:      log,
+		rejected: ms.CounterWithTags(rateLimitRejectedMetric, map[string]string{"server": name}),
+	}, nil
+}
+
+// middleware rejects requests whose bucket is empty, it runs after the principal of the request was extracted. Requests are let
+// through when the store fails, rather than failing every request while it is unavailable
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(l.config.BlockList, c.FullPath()) {
+			c.Next()
+			return
+		}
+		key, limit := l.bucketOf(c.Request.Context())
+		decision, err := l.config.store.Take(c.Request.Context(), key, limit)
+		if err != nil {
+			l.log.Warnw("Failed to take a rate limit token, the request is let through", "key", key, "error", err)
+			c.Next()
+			return
+		}
+		b := Backpressure{Source: BackpressureRateLimit, Limit: limit.Burst, Remaining: decision.Remaining, RetryAfter: decision.RetryAfter}
+		if !decision.Allowed {
+			l.rejected.Inc(1)
+			rejectRequest(c, rateLimitExceeded, b, l.log)
+			return
+		}
+		recordBackpressure(c, b)
+		c.Next()
+	}
+}
+
+// bucketOf the key of the bucket of the request and its limit, requests without a principal are limited per client IP at the default rate
+func (l *rateLimiter) bucketOf(ctx context.Context) (string, RateLimit) {
+	limit := l.limit
+	principal, err := iam.ExtractPrincipalFromContext(ctx)
+	if err != nil || principal == nil || principal.OrgId == "" {
+		ip, _ := clientIPKey.Value(ctx)
+		return "ip:" + ip, limit
+	}
+	if orgLimit, ok := l.orgs[principal.OrgId]; ok {
+		limit = orgLimit
+	}
+	if l.config.Key == RateLimitByPrincipal {
+		return "principal:" + principal.OrgId + "/" + principal.Name, limit
+	}
+	return "org:" + principal.OrgId, limit
+}
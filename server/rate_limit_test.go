@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(context.Context, string, RateLimit) (RateLimitDecision, error) {
+	return RateLimitDecision{}, errors.New("redis is unavailable")
+}
+
+func newTestRateLimiter(t *testing.T, config RateLimitConfiguration) (*rateLimiter, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	config.Enabled = true
+	l, err := newRateLimiter("http", config, ms, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return l, scope
+}
+
+func TestInMemoryRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	store := NewInMemoryRateLimitStore(fake)
+	limit := RateLimit{RequestsPerSecond: 2, Burst: 3}
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		decision, err := store.Take(ctx, "org:armory", limit)
+		require.NoError(t, err)
+		assert.Equal(t, RateLimitDecision{Allowed: true, Remaining: remaining}, decision)
+	}
+	decision, _ := store.Take(ctx, "org:armory", limit)
+	assert.Equal(t, RateLimitDecision{Allowed: false, RetryAfter: 500 * time.Millisecond}, decision, "buckets refill at the rate of the limit")
+	decision, _ = store.Take(ctx, "org:other", limit)
+	assert.True(t, decision.Allowed, "every key has a bucket of its own")
+
+	fake.Advance(time.Second)
+	decision, _ = store.Take(ctx, "org:armory", limit)
+	assert.Equal(t, RateLimitDecision{Allowed: true, Remaining: 1}, decision)
+
+	fake.Advance(time.Hour)
+	_, _ = store.Take(ctx, "org:new", limit)
+	assert.Len(t, store.buckets, 1, "buckets that refilled are forgotten")
+}
+
+func TestRateLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, scope := newTestRateLimiter(t, RateLimitConfiguration{
+		RequestsPerSecond: 1,
+		Orgs:              map[string]RateLimit{"enterprise": {RequestsPerSecond: 10, Burst: 2}},
+		BlockList:         []string{"/health"},
+	})
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) {
+		ctx := clientIPKey.WithValue(c.Request.Context(), "10.0.0.1")
+		if org := c.GetHeader("X-Org"); org != "" {
+			ctx = iam.WithPrincipal(ctx, iam.ArmoryCloudPrincipal{OrgId: org, Name: c.GetHeader("X-User"), Type: iam.User})
+		}
+		c.Request = c.Request.WithContext(ctx)
+	})
+	g.Use(l.middleware())
+	g.GET("/deployments", func(c *gin.Context) { c.Status(http.StatusOK) })
+	g.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	serve := func(path string, org string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if org != "" {
+			req.Header.Set("X-Org", org)
+			req.Header.Set("X-User", user)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/deployments", "armory", "alice").Code)
+	rec := serve("/deployments", "armory", "bob")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the principals of an org share its bucket")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	var contract serr.ResponseContract
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&contract))
+	require.Len(t, contract.Errors, 1)
+	assert.Equal(t, "4290", contract.Errors[0].Code)
+	assert.Equal(t, "Too many requests, try again later", contract.Errors[0].Message)
+
+	assert.Equal(t, http.StatusOK, serve("/deployments", "enterprise", "carol").Code)
+	assert.Equal(t, http.StatusOK, serve("/deployments", "enterprise", "carol").Code, "orgs can have limits of their own")
+	assert.Equal(t, http.StatusOK, serve("/deployments", "", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("/deployments", "", "").Code, "requests without a principal are limited per client IP")
+	assert.Equal(t, http.StatusOK, serve("/health", "armory", "alice").Code, "blocked routes are never limited")
+	assert.Equal(t, int64(2), scope.Snapshot().Counters()[rateLimitRejectedMetric+"+server=http"].Value())
+
+	l, _ = newTestRateLimiter(t, RateLimitConfiguration{RequestsPerSecond: 1, Key: RateLimitByPrincipal})
+	key, _ := l.bucketOf(iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{OrgId: "armory", Name: "alice"}))
+	assert.Equal(t, "principal:armory/alice", key)
+}
+
+func TestRateLimiterFailsOpen(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, _ := newTestRateLimiter(t, RateLimitConfiguration{RequestsPerSecond: 1, store: failingRateLimitStore{}})
+	g := gin.New()
+	g.Use(l.middleware())
+	g.GET("/deployments", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/deployments", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "requests are let through while the store is unavailable")
+	}
+}
+
+func TestRateLimitConfiguration(t *testing.T) {
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	l, err := newRateLimiter("http", RateLimitConfiguration{}, ms, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	assert.Nil(t, l, "rate limiting is disabled by default")
+
+	_, err = newRateLimiter("http", RateLimitConfiguration{Enabled: true}, ms, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "rate limit of http: requestsPerSecond must be positive")
+	_, err = newRateLimiter("http", RateLimitConfiguration{Enabled: true, RequestsPerSecond: 1, Key: "ip"}, ms, zap.NewNop().Sugar())
+	assert.EqualError(t, err, `rate limit of http: unknown key "ip", expected "org" or "principal"`)
+	_, err = newRateLimiter("http", RateLimitConfiguration{Enabled: true, RequestsPerSecond: 1, Orgs: map[string]RateLimit{"armory": {}}}, ms, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "rate limit of http: requestsPerSecond of org armory must be positive")
+}
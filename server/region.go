@@ -0,0 +1,161 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RejectMisdirected answers requests for resources of another region with 421 Misdirected Request, so clients retry
+	// against the region of the resource. This is the default
+	RejectMisdirected RegionMismatchAction = iota
+	// RejectConflict answers requests for resources of another region with 409 Conflict, for resources that must not be
+	// accessed from another region, such as writes to data that is replicated from its home region
+	RejectConflict
+	// RedirectToRegion redirects requests for resources of another region to its endpoint with 307 Temporary Redirect,
+	// keeping the method and body. Requests for regions without an endpoint are answered as with RejectMisdirected
+	RedirectToRegion
+
+	// RegionHeader the header with the serving region on every response of a pinned handler
+	RegionHeader = "X-Armory-Region"
+)
+
+type (
+	// RegionMismatchAction how a pinned handler answers requests for resources of another region
+	RegionMismatchAction int
+
+	// RegionConfiguration the other regions of a multi-region application. The serving region is metadata.ApplicationMetadata.Region
+	RegionConfiguration struct {
+		// Endpoints the base URLs of the regions by name, such as https://api.eu.example.com, see RedirectToRegion
+		Endpoints map[string]string
+	}
+
+	// RegionPin pins a handler to the resources of the serving region. The region of the resource is read from a path parameter
+	// or a header, and requests without one are served. Pinning is disabled when the application has no region
+	//
+	//	HandlerConfig{
+	//		Path:      "/regions/:region/deployments/:id",
+	//		Method:    http.MethodGet,
+	//		RegionPin: &server.RegionPin{PathParameter: "region", OnMismatch: server.RedirectToRegion},
+	//	}
+	RegionPin struct {
+		// PathParameter the path parameter with the region of the resource
+		PathParameter string `json:"pathParameter,omitempty"`
+		// Header the header with the region of the resource, consulted when there is no PathParameter value
+		Header string `json:"header,omitempty"`
+		// OnMismatch defaults to RejectMisdirected
+		OnMismatch RegionMismatchAction `json:"onMismatch"`
+	}
+
+	// regionPinning the pins of the handlers of a server
+	regionPinning struct {
+		serving   string
+		endpoints map[string]string
+		logger    *zap.SugaredLogger
+	}
+)
+
+// NewRegionMismatchError the error for a request for a resource of resourceRegion served by servingRegion, with the
+// endpoint of the resource's region in the metadata and Location header when it is known. Handlers that only learn the
+// region of a resource after loading it can return this so clients get the same contract as pinned handlers
+func NewRegionMismatchError(servingRegion string, resourceRegion string, endpoint string, action RegionMismatchAction) serr.Error {
+	status := http.StatusMisdirectedRequest
+	if action == RejectConflict {
+		status = http.StatusConflict
+	}
+	metadata := map[string]any{
+		"servingRegion":  servingRegion,
+		"resourceRegion": resourceRegion,
+	}
+	if endpoint != "" {
+		metadata["endpoint"] = endpoint
+	}
+	return serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        fmt.Sprintf("The resource belongs to region %s and can't be served by region %s", resourceRegion, servingRegion),
+		Metadata:       metadata,
+		HttpStatusCode: status,
+	},
+		serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+		serr.WithExtraDetailsForLogging(
+			serr.KVPair{Key: "servingRegion", Value: servingRegion},
+			serr.KVPair{Key: "resourceRegion", Value: resourceRegion},
+		),
+	)
+}
+
+func (a RegionMismatchAction) MarshalText() ([]byte, error) {
+	switch a {
+	case RejectConflict:
+		return []byte("rejectConflict"), nil
+	case RedirectToRegion:
+		return []byte("redirectToRegion"), nil
+	default:
+		return []byte("rejectMisdirected"), nil
+	}
+}
+
+func newRegionPinning(serving string, config RegionConfiguration, logger *zap.SugaredLogger) *regionPinning {
+	if serving == "" {
+		return nil
+	}
+	endpoints := make(map[string]string, len(config.Endpoints))
+	for region, endpoint := range config.Endpoints {
+		endpoints[strings.ToLower(region)] = strings.TrimSuffix(endpoint, "/")
+	}
+	return &regionPinning{serving: strings.ToLower(serving), endpoints: endpoints, logger: logger}
+}
+
+// wrap returns a handler func that serves next only for resources of the serving region
+func (p *regionPinning) wrap(handler *handlerDTO, next gin.HandlerFunc) gin.HandlerFunc {
+	pin := handler.RegionPin
+	if p == nil || pin == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		c.Writer.Header().Set(RegionHeader, p.serving)
+
+		region := ""
+		if pin.PathParameter != "" {
+			region = c.Param(pin.PathParameter)
+		}
+		if region == "" && pin.Header != "" {
+			region = c.GetHeader(pin.Header)
+		}
+		region = strings.ToLower(strings.TrimSpace(region))
+		if region == "" || region == p.serving {
+			next(c)
+			return
+		}
+
+		endpoint := p.endpoints[region]
+		if pin.OnMismatch == RedirectToRegion && endpoint != "" {
+			c.Redirect(http.StatusTemporaryRedirect, endpoint+c.Request.URL.RequestURI())
+			c.Abort()
+			return
+		}
+		if endpoint != "" {
+			c.Writer.Header().Set("Location", endpoint+c.Request.URL.RequestURI())
+		}
+		writeAndLogApiErrorThenAbort(c, NewRegionMismatchError(p.serving, region, endpoint, pin.OnMismatch), p.logger)
+	}
+}
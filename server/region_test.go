@@ -0,0 +1,87 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegionPinning(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	pinning := newRegionPinning("us-east-1", RegionConfiguration{Endpoints: map[string]string{"EU-West-1": "https://api.eu.example.com/"}}, zap.NewNop().Sugar())
+	g := gin.New()
+	serve := func(action RegionMismatchAction) gin.HandlerFunc {
+		pin := &RegionPin{PathParameter: "region", Header: "X-Resource-Region", OnMismatch: action}
+		return pinning.wrap(&handlerDTO{RegionPin: pin}, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	g.GET("/misdirected/:region", serve(RejectMisdirected))
+	g.GET("/conflict/:region", serve(RejectConflict))
+	g.GET("/redirect/:region", serve(RedirectToRegion))
+	g.GET("/header", serve(RejectMisdirected))
+
+	cases := []struct {
+		name     string
+		path     string
+		header   string
+		status   int
+		location string
+	}{
+		{name: "serving region", path: "/misdirected/US-EAST-1", status: http.StatusOK},
+		{name: "no region", path: "/header", status: http.StatusOK},
+		{name: "misdirected", path: "/misdirected/ap-south-1", status: http.StatusMisdirectedRequest},
+		{name: "misdirected with known endpoint", path: "/misdirected/eu-west-1", status: http.StatusMisdirectedRequest, location: "https://api.eu.example.com/misdirected/eu-west-1"},
+		{name: "conflict", path: "/conflict/eu-west-1", status: http.StatusConflict, location: "https://api.eu.example.com/conflict/eu-west-1"},
+		{name: "redirect", path: "/redirect/eu-west-1?page=2", status: http.StatusTemporaryRedirect, location: "https://api.eu.example.com/redirect/eu-west-1?page=2"},
+		{name: "redirect without endpoint", path: "/redirect/ap-south-1", status: http.StatusMisdirectedRequest},
+		{name: "region header", path: "/header", header: "ap-south-1", status: http.StatusMisdirectedRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.path, nil)
+			if c.header != "" {
+				req.Header.Set("X-Resource-Region", c.header)
+			}
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, req)
+			assert.Equal(t, c.status, w.Code)
+			assert.Equal(t, c.location, w.Header().Get("Location"))
+			assert.Equal(t, "us-east-1", w.Header().Get(RegionHeader))
+		})
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/misdirected/ap-south-1", nil))
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	errs := body["errors"].([]any)
+	assert.Equal(t, map[string]any{"servingRegion": "us-east-1", "resourceRegion": "ap-south-1"}, errs[0].(map[string]any)["metadata"])
+
+	assert.Nil(t, newRegionPinning("", RegionConfiguration{}, nil), "applications without a region aren't pinned")
+}
+
+func TestRegionPinJSON(t *testing.T) {
+	b, err := json.Marshal(handlerDTO{RegionPin: &RegionPin{PathParameter: "region", OnMismatch: RedirectToRegion}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"regionPin":{"pathParameter":"region","onMismatch":"redirectToRegion"}`)
+}
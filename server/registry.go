@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"github.com/armory-io/go-commons/iam"
 	"github.com/armory-io/go-commons/management/info"
+	"github.com/armory-io/go-commons/metrics"
 	"github.com/armory-io/go-commons/server/serr"
 	"github.com/elnormous/contenttype"
 	"github.com/gin-gonic/gin"
@@ -53,6 +54,26 @@ type (
 		Method             string                `json:"method"`
 		AuthZValidators    []AuthZValidatorV2Fn  `json:"-"`
 		AuthOptOut         bool                  `json:"authOptOut"`
+		RequireSignature   bool                  `json:"requireSignature"`
+		LegacyQueryParams  map[string]string     `json:"legacyQueryParameters,omitempty"`
+		LegacyHeaders      map[string]string     `json:"legacyHeaders,omitempty"`
+		StaticHeaders      http.Header           `json:"staticHeaders,omitempty"`
+		Deprecation        *Deprecation          `json:"deprecation,omitempty"`
+		APIGroup           string                `json:"apiGroup,omitempty"`
+		WebSocket          bool                  `json:"webSocket,omitempty"`
+		Deduplicate        bool                  `json:"deduplicate,omitempty"`
+		LatencyBudget      latencyBudget         `json:"latencyBudget,omitempty"`
+		CacheControl       string                `json:"cacheControl,omitempty"`
+		LastModified       bool                  `json:"lastModified,omitempty"`
+		RegionPin          *RegionPin            `json:"regionPin,omitempty"`
+		DisableCoalescing  bool                  `json:"disableCoalescing,omitempty"`
+		LongPoll           *LongPollConfig       `json:"longPoll,omitempty"`
+		MaxConcurrent      int                   `json:"maxConcurrent,omitempty"`
+		MaxQueued          int                   `json:"maxQueued,omitempty"`
+		RequiredHeaders    []string              `json:"requiredHeaders,omitempty"`
+		RequiredFeatures   []string              `json:"requiredFeatures,omitempty"`
+		Encryption         string                `json:"encryption,omitempty"`
+		JSONDecoding       *JSONDecoding         `json:"jsonDecoding,omitempty"`
 		Consumes           string                `json:"consumes"`
 		Produces           string                `json:"produces"`
 		StatusCode         int                   `json:"statusCode"`
@@ -60,7 +81,16 @@ type (
 		MediaType          contenttype.MediaType `json:"-"`
 		ConsumesMediaType  contenttype.MediaType `json:"-"`
 		Default            bool                  `json:"default"`
+		Disabled           bool                  `json:"disabled,omitempty"`
 		ResponseProcessors []ResponseProcessorFn `json:"-"`
+		ResponseMappers    []ResponseMapper      `json:"-"`
+		requiredHeaders    []requiredHeader
+		apiGroup           *apiGroup
+		// controllerName and handlerName tag the metrics of HandlerMetrics
+		controllerName string
+		handlerName    string
+		// types the request, response and argument types of the handler, described by OpenAPIConfiguration and checked by coalescing
+		types handlerTypes
 	}
 )
 
@@ -68,28 +98,67 @@ type handlerRegistry struct {
 	name   string
 	logger *zap.SugaredLogger
 	data   map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO
+	// negotiations the content negotiation decisions made for each route, populated when the handlers are registered with
+	// RecordNegotiations
+	negotiations map[handlerDTOKey]*negotiationRecorder
 }
 
 type registerHandlersInput struct {
-	AuthRequiredGroup    *gin.RouterGroup
-	AuthNotEnforcedGroup *gin.RouterGroup
+	AuthRequiredGroup    gin.IRoutes
+	AuthNotEnforcedGroup gin.IRoutes
+	SignatureVerifier    gin.HandlerFunc
+	// RequireSignature requires every handler to be signed, regardless of HandlerConfig.RequireSignature
+	RequireSignature bool
+	Metrics          metrics.MetricsSvc
+	Deduplicator     *deduplicator
+	Coalescer        *coalescer
+	HandlerLimits    *handlerLimits
+	RegionPinning    *regionPinning
+	Encryption       *payloadEncryption
+	ResponseSize     *responseSizeGuard
+	// DisabledRoutes the routes switched off by configuration, they are answered without running their handlers
+	DisabledRoutes *routeSwitches
+	// FeatureGate answers the requests of handlers whose required features are off
+	FeatureGate *featureGate
+	// RecordNegotiations records the content negotiation decisions of every route, see DiagnosticsConfiguration.RecordNegotiations
+	RecordNegotiations bool
 }
 
 type iHandlerRegistry interface {
 	registerHandlers(in registerHandlersInput) error
+	// handlers the handlers of every route and content type
+	handlers() []*handlerDTO
 	Contribute(builder *info.InfoBuilder)
 }
 
+func (r *handlerRegistry) handlers() []*handlerDTO {
+	var handlers []*handlerDTO
+	for _, handlersByMimeType := range r.data {
+		handlers = append(handlers, maps.Values(handlersByMimeType)...)
+	}
+	return handlers
+}
+
 // Contribute implements the management.infoContributor interface so we can add available routes at the /info endpoint
 func (r *handlerRegistry) Contribute(builder *info.InfoBuilder) {
 	data := make(map[string][]*handlerDTO)
 	for k, v := range r.data {
 		data[k.path] = maps.Values(v)
 	}
+	negotiations := make(map[string]map[string]any)
+	for k, v := range r.negotiations {
+		if negotiations[k.path] == nil {
+			negotiations[k.path] = make(map[string]any)
+		}
+		negotiations[k.path][k.method] = v.snapshot()
+	}
 	builder.WithDetails(map[string]any{
 		"routes": map[string]any{
 			r.name: data,
 		},
+		"contentNegotiation": map[string]any{
+			r.name: negotiations,
+		},
 	})
 }
 
@@ -113,19 +182,73 @@ func (r *handlerRegistry) registerHandlers(in registerHandlersInput) error {
 			return fmt.Errorf("can not register composite multi-mime type handler with for method: %s and path: %s because more than 1 hander was marked as the default", key.method, key.path)
 		}
 
-		fn := createMultiMimeTypeFn(handlersByMimeType, r.logger)
+		// Ensure that all in handlers for the multi-mime type handler have the same request signing settings
+		requireSignature := maps.Values(handlersByMimeType)[0].RequireSignature
+		matches = lo.PickBy(handlersByMimeType, func(mimeTypeKey handlerDTOMimeTypeKey, handler *handlerDTO) bool {
+			return handler.RequireSignature != requireSignature
+		})
+		if len(matches) > 0 {
+			return fmt.Errorf("can not register composite multi-mime type handler with for method: %s and path: %s because all handers do not have the same RequireSignature flag configured", key.method, key.path)
+		}
+
+		// Each wrapper runs before the ones applied ahead of it, so requests go through apiGroup, RegionPinning, FeatureGate,
+		// HandlerLimits, metrics, longPolling, latencyBudget, requiredHeaders, coalescer, deduplicator and compatShims before
+		// ginHOF. AuthZ runs innermost, in ginHOF, which is why the coalescer and deduplicator check authorizeRequest themselves
+		for _, handler := range handlersByMimeType {
+			in.ResponseSize.apply(handler)
+			if err := in.Encryption.apply(handler); err != nil {
+				return err
+			}
+			// rewrite any deprecated query parameter or header names before the handler extracts its arguments
+			handler.HandlerFn = newCompatibilityShims(handler, in.Metrics, r.logger).wrap(handler.HandlerFn)
+			handler.HandlerFn = in.Deduplicator.wrap(handler, handler.HandlerFn)
+			handler.HandlerFn = in.Coalescer.wrap(handler, handler.HandlerFn)
+			handler.HandlerFn = newRequiredHeaders(handler, r.logger).wrap(handler.HandlerFn)
+			handler.HandlerFn = newLatencyBudgetRecorder(handler, in.Metrics).wrap(handler.HandlerFn)
+			handler.HandlerFn = newLongPolling(handler, in.Metrics).wrap(handler.HandlerFn)
+			handler.HandlerFn = newHandlerMetrics(handler, in.Metrics).wrap(handler.HandlerFn)
+			handler.HandlerFn = in.HandlerLimits.wrap(handler, handler.HandlerFn)
+			// requests for disabled features don't take a slot of the limits of the handler
+			gated, err := in.FeatureGate.wrap(handler, handler.HandlerFn)
+			if err != nil {
+				return err
+			}
+			handler.HandlerFn = gated
+			// requests for resources of another region are turned away before anything else runs
+			handler.HandlerFn = in.RegionPinning.wrap(handler, handler.HandlerFn)
+			handler.HandlerFn = handler.apiGroup.wrap(handler.HandlerFn)
+		}
+
+		var recorder *negotiationRecorder
+		if in.RecordNegotiations {
+			recorder = newNegotiationRecorder()
+			r.negotiations[key] = recorder
+		}
 
+		fns := []gin.HandlerFunc{createMultiMimeTypeFn(handlersByMimeType, r.logger, recorder)}
+		if in.DisabledRoutes.disabled(key) {
+			for _, handler := range handlersByMimeType {
+				handler.Disabled = true
+			}
+			fns = []gin.HandlerFunc{in.DisabledRoutes.handler}
+		} else if requireSignature || in.RequireSignature {
+			fns = append([]gin.HandlerFunc{in.SignatureVerifier}, fns...)
+		}
+
+		source := maps.Values(handlersByMimeType)[0].controllerName
 		if authOptOut {
-			in.AuthNotEnforcedGroup.Handle(key.method, key.path, fn)
+			routesFrom(in.AuthNotEnforcedGroup, source).Handle(key.method, key.path, fns...)
 		} else {
-			in.AuthRequiredGroup.Handle(key.method, key.path, fn)
+			routesFrom(in.AuthRequiredGroup, source).Handle(key.method, key.path, fns...)
 		}
 	}
 
 	return nil
 }
 
-func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handlerDTO, logger *zap.SugaredLogger) gin.HandlerFunc {
+// createMultiMimeTypeFn returns a handler func that picks the handler to execute from the Accept and Content-Type headers,
+// decisions are recorded to the recorder when it isn't nil
+func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handlerDTO, logger *zap.SugaredLogger, recorder *negotiationRecorder) gin.HandlerFunc {
 	values := maps.Values(handlersByMimeType)
 	// sort available in reverse lexicographical order, so that the newest version is chosen by default when no accept header is present
 	sort.Slice(values, func(i, j int) bool { return values[i].Produces > values[j].Produces })
@@ -136,7 +259,11 @@ func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handler
 	})
 
 	return func(c *gin.Context) {
-		accept := c.Request.Header.Get("Accept")
+		// the response depends on both headers whether negotiation succeeds or not, so caches must key on them
+		addVary(c.Writer.Header())
+
+		// an Accept header may be split across several lines, all of them are weighed together by q-value
+		accept := joinedHeaderValues(c.Request.Header, "Accept")
 		if accept == "" {
 			accept = "*/*"
 		}
@@ -149,9 +276,9 @@ func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handler
 		availableCombinations := lo.Map(values, func(hDTO *handlerDTO, _ int) handlerDTOMimeTypeKey {
 			return handlerDTOMimeTypeKey{hDTO.Consumes, hDTO.Produces}
 		})
-		// TODO add params to context
-		amt, _, err := contenttype.GetAcceptableMediaTypeFromHeader(accept, available)
+		amt, acceptParameters, err := contenttype.GetAcceptableMediaTypeFromHeader(accept, available)
 		if err != nil {
+			recorder.record(c, nil)
 			handleContentTypesMismatch(c, availableCombinations, c.ContentType(), accept, err, logger)
 			return
 		}
@@ -162,6 +289,7 @@ func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handler
 
 		cmt, _, err := contenttype.GetAcceptableMediaTypeFromHeader(contentType, availableConsumes)
 		if err != nil {
+			recorder.record(c, nil)
 			handleContentTypesMismatch(c, availableCombinations, c.ContentType(), accept, err, logger)
 			return
 		}
@@ -176,15 +304,33 @@ func createMultiMimeTypeFn(handlersByMimeType map[handlerDTOMimeTypeKey]*handler
 			handler = findAcceptableDefaultHandler(values, amt, cmt)
 
 			if handler == nil {
+				recorder.record(c, nil)
 				handleContentTypesMismatch(c, availableCombinations, c.ContentType(), accept, err, logger)
 				return
 			}
 
 		}
+		recorder.record(c, handler)
+		c.Request = c.Request.WithContext(AddNegotiatedContentToCtx(c.Request.Context(), NegotiatedContent{
+			Produces:         handler.MediaType,
+			Consumes:         handler.ConsumesMediaType,
+			AcceptParameters: acceptParameters,
+		}))
 		handler.HandlerFn(c)
 	}
 }
 
+// mergeHeaders returns dst with the headers from src added, replacing any values for headers of the same name
+func mergeHeaders(dst http.Header, src map[string][]string) http.Header {
+	for header, values := range src {
+		if dst == nil {
+			dst = http.Header{}
+		}
+		dst[http.CanonicalHeaderKey(header)] = append([]string(nil), values...)
+	}
+	return dst
+}
+
 // findAcceptableDefaultHandler An acceptable match will be a matching produces MediaType and one that has the same consumes Type and a subset of the Subtype
 func findAcceptableDefaultHandler(handlers []*handlerDTO, produces contenttype.MediaType, consumes contenttype.MediaType) *handlerDTO {
 	for _, dto := range handlers {
@@ -249,12 +395,12 @@ func handleContentTypesMismatch(c *gin.Context, availableCombinations []handlerD
 		)), logger)
 }
 
-func newHandlerRegistry(name string, logger *zap.SugaredLogger, requestValidator *validator.Validate, controllerCollections ...[]IController) (iHandlerRegistry, error) {
+func newHandlerRegistry(name string, logger *zap.SugaredLogger, requestValidator *validator.Validate, groups *apiGroups, controllerCollections ...[]IController) (iHandlerRegistry, error) {
 	registryData := make(map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO)
 	for _, collection := range controllerCollections {
 		for _, c := range collection {
 			for _, h := range c.Handlers() {
-				if err := configureHandler(h, c, logger, requestValidator, registryData); err != nil {
+				if err := configureHandler(h, c, groups.of(c), logger, requestValidator, registryData); err != nil {
 					return nil, err
 				}
 			}
@@ -262,20 +408,38 @@ func newHandlerRegistry(name string, logger *zap.SugaredLogger, requestValidator
 	}
 
 	return &handlerRegistry{
-		name:   name,
-		logger: logger,
-		data:   registryData,
+		name:         name,
+		logger:       logger,
+		data:         registryData,
+		negotiations: make(map[handlerDTOKey]*negotiationRecorder),
 	}, nil
 }
 
-func configureHandler(handler Handler, controller IController, logger *zap.SugaredLogger, requestValidator *validator.Validate, registryData map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO) error {
+func configureHandler(handler Handler, controller IController, group *apiGroup, logger *zap.SugaredLogger, requestValidator *validator.Validate, registryData map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO) error {
 	validators := make([]AuthZValidatorV2Fn, 0)
 	hDTO := &handlerDTO{
-		Path:       strings.TrimSuffix(strings.TrimSpace(handler.Config().Path), "/"),
-		Method:     strings.TrimSpace(handler.Config().Method),
-		AuthOptOut: handler.Config().AuthOptOut,
-		StatusCode: handler.Config().StatusCode,
-		Default:    handler.Config().Default,
+		Path:              strings.TrimSuffix(strings.TrimSpace(handler.Config().Path), "/"),
+		Method:            strings.TrimSpace(handler.Config().Method),
+		AuthOptOut:        handler.Config().AuthOptOut,
+		RequireSignature:  handler.Config().RequireSignature,
+		LegacyQueryParams: handler.Config().LegacyQueryParameters,
+		LegacyHeaders:     handler.Config().LegacyHeaders,
+		Deduplicate:       handler.Config().Deduplicate,
+		LatencyBudget:     latencyBudget(handler.Config().LatencyBudget),
+		CacheControl:      handler.Config().Cache.cacheControl(),
+		LastModified:      handler.Config().Cache != nil && handler.Config().Cache.LastModified,
+		RegionPin:         handler.Config().RegionPin,
+		DisableCoalescing: handler.Config().DisableCoalescing,
+		LongPoll:          handler.Config().LongPoll,
+		MaxConcurrent:     handler.Config().MaxConcurrent,
+		MaxQueued:         handler.Config().MaxQueued,
+		RequiredHeaders:   handler.Config().RequiredHeaders,
+		RequiredFeatures:  handler.Config().RequiredFeatures,
+		Encryption:        handler.Config().Encryption,
+		JSONDecoding:      handler.Config().JSONDecoding,
+		StatusCode:        handler.Config().StatusCode,
+		Default:           handler.Config().Default,
+		Deprecation:       handler.Config().Deprecation,
 	}
 
 	if handler.Config().AuthZValidator != nil {
@@ -288,6 +452,21 @@ func configureHandler(handler Handler, controller IController, logger *zap.Sugar
 		validators = append(validators, handler.Config().AuthZValidatorExtended)
 	}
 
+	requiredHeaders, err := parseRequiredHeaders(hDTO.RequiredHeaders, hDTO.LegacyHeaders)
+	if err != nil {
+		return fmt.Errorf("failed to process the required headers of handler with method: %s, path: %s: %w", hDTO.Method, hDTO.Path, err)
+	}
+	hDTO.requiredHeaders = requiredHeaders
+
+	hDTO.controllerName = typeName(controller)
+	if h, ok := handler.(namedHandler); ok {
+		hDTO.handlerName = h.name()
+	}
+	if h, ok := handler.(typedHandler); ok {
+		hDTO.types = h.types()
+	}
+	_, hDTO.WebSocket = handler.(webSocketHandlerMarker)
+
 	// Configure the Path with the controller provided prefix if present
 	if c, ok := controller.(IControllerPrefix); ok {
 		if c.Prefix() != "" {
@@ -308,6 +487,12 @@ func configureHandler(handler Handler, controller IController, logger *zap.Sugar
 		validators = append(validators, c.AuthZValidator)
 	}
 
+	// Apply the settings of the controller's API group, the group's scopes are checked before the controller validators
+	group.apply(hDTO)
+	if v := group.authZValidator(); v != nil {
+		validators = append([]AuthZValidatorV2Fn{v}, validators...)
+	}
+
 	var iResponseProcessors []ResponseProcessorWithOrder
 	if c, ok := controller.(IControllerPostResponseProcessor); ok {
 		iResponseProcessors = c.ResponseProcessors()
@@ -327,16 +512,33 @@ func configureHandler(handler Handler, controller IController, logger *zap.Sugar
 
 	hDTO.ResponseProcessors = processors
 
+	if c, ok := controller.(IControllerResponseMappers); ok {
+		hDTO.ResponseMappers = c.ResponseMappers()
+	}
+
+	// Merge the controller headers with the deprecation and handler headers, the handler's take precedence
+	var staticHeaders http.Header
+	if c, ok := controller.(IControllerResponseHeaders); ok {
+		staticHeaders = mergeHeaders(staticHeaders, c.ResponseHeaders())
+	}
+	staticHeaders = mergeHeaders(staticHeaders, hDTO.Deprecation.headers())
+	hDTO.StaticHeaders = mergeHeaders(staticHeaders, handler.Config().StaticHeaders)
+
+	defaultMediaType := "application/json"
+	if hDTO.Encryption != "" {
+		defaultMediaType = JWEMediaType
+	}
+
 	if handler.Config().Produces != "" {
 		hDTO.Produces = handler.Config().Produces
 	} else {
-		hDTO.Produces = "application/json"
+		hDTO.Produces = defaultMediaType
 	}
 
 	if handler.Config().Consumes != "" {
 		hDTO.Consumes = handler.Config().Consumes
 	} else {
-		hDTO.Consumes = "application/json"
+		hDTO.Consumes = defaultMediaType
 	}
 
 	mt, err := contenttype.ParseMediaType(hDTO.Produces)
@@ -357,6 +559,15 @@ func configureHandler(handler Handler, controller IController, logger *zap.Sugar
 	}
 	hDTO.ConsumesMediaType = cmt
 
+	// Event streams stay open as long as their clients listen, they can't be shared between callers or held to a latency budget
+	if hDTO.Produces == EventStreamMediaType {
+		if hDTO.Encryption != "" {
+			return fmt.Errorf("handler with method: %s, path: %s produces %s which can't be encrypted", hDTO.Method, hDTO.Path, EventStreamMediaType)
+		}
+		hDTO.DisableCoalescing = true
+		hDTO.LatencyBudget = 0
+	}
+
 	if hDTO.StatusCode == 0 {
 		hDTO.StatusCode = http.StatusOK
 	}
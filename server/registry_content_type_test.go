@@ -9,7 +9,6 @@ import (
 	armoryhttp "github.com/armory-io/go-commons/http"
 	"github.com/armory-io/go-commons/logging"
 	"github.com/armory-io/go-commons/management/info"
-	"github.com/armory-io/go-commons/metadata"
 	metrics2 "github.com/armory-io/go-commons/metrics"
 	"github.com/armory-io/go-commons/server/serr"
 	"github.com/go-playground/validator/v10"
@@ -249,23 +248,18 @@ func (s *ContentTypesTestSuite) SetupSuite() {
 	s.baseUrl = fmt.Sprintf("http://localhost:%d/", port)
 	metrics := metrics2.NewMockMetricsSvc(gomock.NewController(s.T()))
 	metrics.EXPECT().TimerWithTags(gomock.Any(), gomock.Any()).Return(&testTimer{})
+	metrics.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).Return(tally.NoopScope.Counter("")).AnyTimes()
+	metrics.EXPECT().GaugeWithTags(gomock.Any(), gomock.Any()).Return(tally.NoopScope.Gauge("")).AnyTimes()
 
 	is := &info.InfoService{}
 
-	err = configureServer("http",
-		s.lc,
-		config,
-		RequestLoggingConfiguration{Enabled: false},
-		SPAConfiguration{Enabled: false},
-		ProfileConfiguration{Enabled: false},
-		nil,
-		s.log,
-		metrics,
-		metadata.ApplicationMetadata{},
-		is,
-		false,
-		validator.New(),
-		s.controller.Controller)
+	err = configureServer(serverOptions{name: "http", config: Configuration{HTTP: config}}, serverDependencies{
+		lc:               s.lc,
+		logger:           s.log,
+		ms:               metrics,
+		is:               is,
+		requestValidator: validator.New(),
+	}, s.controller.Controller)
 	if err != nil {
 		s.T().Fail()
 		return
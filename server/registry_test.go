@@ -1,8 +1,12 @@
 package server
 
 import (
+	"context"
 	"github.com/armory-io/go-commons/logging"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/elnormous/contenttype"
 	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -83,19 +87,19 @@ func (s *RegistryTestSuite) TestRegisterHandlersWithSameProducesAndConsumesCombi
 	// When handlers are registered, there is no issue
 	registryData := map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO{}
 	for _, handler := range s.controller.Handlers() {
-		err := configureHandler(handler, s.controller, s.log, nil, registryData)
+		err := configureHandler(handler, s.controller, nil, s.log, nil, registryData)
 		s.NoError(err, "all handlers should register")
 	}
 
 	// When a duplicate handler is registered, we get an error
-	err := configureHandler(s.controller.Handlers()[0], s.controller, s.log, nil, registryData)
+	err := configureHandler(s.controller.Handlers()[0], s.controller, nil, s.log, nil, registryData)
 	s.ErrorIs(err, ErrDuplicateHandlerRegistered)
 
 	// We can use the registered handler even when a super type (i.e. application/json is specified and there isn't a specific consumer for it)
 	multiHandlerFn := createMultiMimeTypeFn(registryData[handlerDTOKey{
 		path:   "/pipelines/kubernetes",
 		method: http.MethodPost,
-	}], s.log)
+	}], s.log, nil)
 
 	c, _ := gin.CreateTestContext(httptest.NewRecorder())
 	c.Request = &http.Request{
@@ -111,3 +115,154 @@ func (s *RegistryTestSuite) TestRegisterHandlersWithSameProducesAndConsumesCombi
 	}
 	multiHandlerFn(c)
 }
+
+func (s *RegistryTestSuite) TestContentNegotiationHonorsQualityFactorsAcrossHeaderValues() {
+	var negotiated *NegotiatedContent
+	newDTO := func(produces string, isDefault bool) *handlerDTO {
+		return &handlerDTO{
+			Consumes:          applicationJSON,
+			Produces:          produces,
+			MediaType:         contenttype.NewMediaType(produces),
+			ConsumesMediaType: contenttype.NewMediaType(applicationJSON),
+			Default:           isDefault,
+			HandlerFn: func(c *gin.Context) {
+				negotiated, _ = ExtractNegotiatedContentFromContext(c.Request.Context())
+			},
+		}
+	}
+	handlers := map[handlerDTOMimeTypeKey]*handlerDTO{
+		{applicationJSON, test1JSON}:     newDTO(test1JSON, true),
+		{applicationJSON, test1LinkJSON}: newDTO(test1LinkJSON, false),
+	}
+	recorder := newNegotiationRecorder()
+	fn := createMultiMimeTypeFn(handlers, s.log, recorder)
+
+	serve := func(accept ...string) *httptest.ResponseRecorder {
+		negotiated = nil
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/pipelines/kubernetes", nil)
+		c.Request.Header.Set("Content-Type", applicationJSON)
+		for _, a := range accept {
+			c.Request.Header.Add("Accept", a)
+		}
+		fn(c)
+		return w
+	}
+
+	w := serve(test1JSON+";q=0.5", test1LinkJSON+";q=0.9;version=2")
+	s.Equal("Accept, Content-Type", w.Header().Get("Vary"))
+	s.Require().NotNil(negotiated)
+	s.Equal(test1LinkJSON, negotiated.Produces.MIME(), "the highest q-value in a later header line should win")
+	s.Equal("2", negotiated.AcceptParameters["version"])
+
+	serve(test1LinkJSON + ";q=0, */*;q=0.1")
+	s.Require().NotNil(negotiated)
+	s.Equal(test1JSON, negotiated.Produces.MIME(), "q=0 excludes a media type")
+
+	w = serve("text/html")
+	s.Nil(negotiated)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal("Accept, Content-Type", w.Header().Get("Vary"), "rejections vary on the same headers")
+
+	decisions := recorder.snapshot()["decisions"].([]NegotiationDecision)
+	s.Len(decisions, 3)
+	rejected := lo.Filter(decisions, func(d NegotiationDecision, _ int) bool { return d.Rejected })
+	s.Len(rejected, 1)
+	s.Equal("text/html", rejected[0].Accept)
+
+	fn = createMultiMimeTypeFn(handlers, s.log, nil)
+	s.Equal(http.StatusBadRequest, serve("text/html").Code, "decisions aren't recorded without RecordNegotiations")
+	s.Equal(http.StatusOK, serve(test1JSON).Code)
+}
+
+func (s *RegistryTestSuite) TestAddVaryDoesNotDuplicateValues() {
+	h := http.Header{}
+	h.Set("Vary", "accept-encoding, accept")
+	addVary(h)
+	s.Equal([]string{"accept-encoding, accept", "Content-Type"}, h.Values("Vary"))
+
+	h = http.Header{}
+	h.Set("Vary", "*")
+	addVary(h)
+	s.Equal([]string{"*"}, h.Values("Vary"))
+}
+
+type headersController struct{}
+
+func (headersController) ResponseHeaders() map[string][]string {
+	return map[string][]string{
+		"cache-control": {"no-store"},
+		"X-Api-Version": {"1"},
+	}
+}
+
+func (headersController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+			return &Response[string]{Body: "ok", Headers: map[string][]string{"X-Api-Version": {"3"}}}, nil
+		}, HandlerConfig{
+			Path:          "/ok",
+			Method:        http.MethodGet,
+			AuthOptOut:    true,
+			StaticHeaders: map[string][]string{"X-Api-Version": {"2"}},
+		}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+			return nil, serr.NewSimpleError("boom", nil)
+		}, HandlerConfig{
+			Path:       "/error",
+			Method:     http.MethodGet,
+			AuthOptOut: true,
+		}),
+	}
+}
+
+func (s *RegistryTestSuite) TestControllerResponseHeaders() {
+	serve := func(path string) *httptest.ResponseRecorder {
+		data := map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO{}
+		for _, h := range (headersController{}).Handlers() {
+			s.Require().NoError(configureHandler(h, headersController{}, nil, s.log, nil, data))
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, path, nil)
+		createMultiMimeTypeFn(data[handlerDTOKey{path: path, method: http.MethodGet}], s.log, nil)(c)
+		return w
+	}
+
+	w := serve("/ok")
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("no-store", w.Header().Get("Cache-Control"))
+	s.Equal([]string{"3"}, w.Header().Values("X-Api-Version"), "response headers take precedence over static headers")
+
+	w = serve("/error")
+	s.Equal(http.StatusInternalServerError, w.Code)
+	s.Equal("no-store", w.Header().Get("Cache-Control"), "static headers are sent with errors")
+	s.Equal("1", w.Header().Get("X-Api-Version"))
+}
+
+func (s *RegistryTestSuite) TestRegisterHTTPHandler() {
+	g := gin.New()
+	authRequired := g.Group("")
+	authRequired.Use(func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	})
+	authNotEnforced := g.Group("")
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.Path))
+	})
+	registerHTTPHandler(HTTPHandlerConfig{Prefix: "/gate/", Handler: echo, AuthOptOut: true}, authRequired, authNotEnforced)
+	registerHTTPHandler(HTTPHandlerConfig{Prefix: "private", Handler: echo}, authRequired, authNotEnforced)
+
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	s.Equal("GET /gate", serve(http.MethodGet, "/gate").Body.String())
+	s.Equal("DELETE /gate/pipelines/1", serve(http.MethodDelete, "/gate/pipelines/1").Body.String())
+	s.Equal(http.StatusUnauthorized, serve(http.MethodGet, "/private/things").Code)
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the request signature, formatted as t=<unix seconds>,kid=<key id>,v1=<hex hmac-sha256>
+	SignatureHeader = "X-Armory-Signature"
+
+	defaultMaxClockSkew        = 5 * time.Minute
+	defaultMaxSignedBodyBytes  = 10 << 20
+	signatureVersion           = "v1"
+	signatureTimestampField    = "t"
+	signatureKeyIDField        = "kid"
+	signatureComponentSplitter = ","
+)
+
+var (
+	errMissingSignature = errors.New("request is not signed")
+	errInvalidSignature = errors.New("request signature does not match")
+	errStaleSignature   = errors.New("request signature timestamp is outside the allowed clock skew")
+	errUnknownSignerKey = errors.New("request was signed with an unknown key")
+
+	// signerKeyIDKey the id of the key that verified the signature of the request
+	signerKeyIDKey = ctxutil.NewKey[string]("server.signerKeyID")
+
+	requestSignatureInvalid = serr.APIError{
+		Message:        "Invalid request signature",
+		HttpStatusCode: http.StatusUnauthorized,
+	}
+)
+
+// RequestSigningConfiguration configures the verification of HMAC signed requests, for endpoints such as agent callbacks that can't use OAuth.
+// Handlers opt in with HandlerConfig.RequireSignature
+type RequestSigningConfiguration struct {
+	// Keys the active signing secrets by key id, multiple keys may be active at once so secrets can be rotated without downtime
+	Keys map[string]string
+	// MaxClockSkew how far the signature timestamp may drift from the server clock, defaults to 5 minutes
+	MaxClockSkew time.Duration
+	// MaxBodyBytes the largest body that will be read to verify a signature, defaults to 10MiB
+	MaxBodyBytes int64
+	// clock the clock signatures are checked against, set from the clock.Clock provided to the server if any
+	clock clock.Clock
+}
+
+// SignRequest signs the request for verification by a server configured with the same key, the request body is buffered and restored
+func SignRequest(req *http.Request, keyID string, secret string, now time.Time) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := computeSignature([]byte(secret), timestamp, req.Method, req.URL.RequestURI(), body)
+	req.Header.Set(SignatureHeader, fmt.Sprintf("%s=%s,%s=%s,%s=%s",
+		signatureTimestampField, timestamp,
+		signatureKeyIDField, keyID,
+		signatureVersion, hex.EncodeToString(signature),
+	))
+	return nil
+}
+
+// RequestSignatureMiddleware verifies the X-Armory-Signature header of every request, aborting with a 401 when it is missing or invalid.
+// Handlers served by this package should use HandlerConfig.RequireSignature instead
+func RequestSignatureMiddleware(config RequestSigningConfiguration, log *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := verifyRequestSignature(c.Request, config, clock.OrDefault(config.clock).Now())
+		if err != nil {
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(requestSignatureInvalid,
+				serr.WithCause(err),
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			), log)
+			return
+		}
+		c.Request = c.Request.WithContext(signerKeyIDKey.WithValue(c.Request.Context(), keyID))
+	}
+}
+
+// verifyRequestSignature returns the id of the key the request was signed with
+func verifyRequestSignature(req *http.Request, config RequestSigningConfiguration, now time.Time) (string, error) {
+	header := req.Header.Get(SignatureHeader)
+	if header == "" {
+		return "", errMissingSignature
+	}
+
+	fields := map[string]string{}
+	for _, component := range strings.Split(header, signatureComponentSplitter) {
+		if k, v, found := strings.Cut(strings.TrimSpace(component), "="); found {
+			fields[k] = v
+		}
+	}
+
+	timestamp := fields[signatureTimestampField]
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errMissingSignature
+	}
+	maxClockSkew := config.MaxClockSkew
+	if maxClockSkew <= 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+	if skew := now.Sub(time.Unix(signedAt, 0)).Abs(); skew > maxClockSkew {
+		return "", errStaleSignature
+	}
+
+	expected, err := hex.DecodeString(fields[signatureVersion])
+	if err != nil || len(expected) == 0 {
+		return "", errMissingSignature
+	}
+
+	// when the key id is omitted every active key is tried, so callers can be migrated to a new key before they report its id
+	candidates := config.Keys
+	if keyID := fields[signatureKeyIDField]; keyID != "" {
+		secret, ok := config.Keys[keyID]
+		if !ok {
+			return "", errUnknownSignerKey
+		}
+		candidates = map[string]string{keyID: secret}
+	}
+
+	body, err := readAndRestoreBody(req, config.MaxBodyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	for keyID, secret := range candidates {
+		if hmac.Equal(expected, computeSignature([]byte(secret), timestamp, req.Method, req.URL.RequestURI(), body)) {
+			return keyID, nil
+		}
+	}
+	return "", errInvalidSignature
+}
+
+func readAndRestoreBody(req *http.Request, maxBytes int64) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxSignedBodyBytes
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("signed request body exceeds %d bytes", maxBytes)
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// computeSignature HMAC-SHA256 of the timestamp, method, request URI and body separated by newlines. The request URI is the
+// escaped path and query, so neither can be changed without invalidating the signature
+func computeSignature(secret []byte, timestamp string, method string, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + strings.ToUpper(method) + "\n" + requestURI + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
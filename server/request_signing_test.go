@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestVerifyRequestSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	config := RequestSigningConfiguration{
+		Keys: map[string]string{
+			"old": "old-secret",
+			"new": "new-secret",
+		},
+	}
+
+	newRequest := func(body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/agents/callback", strings.NewReader(body))
+	}
+
+	cases := []struct {
+		name     string
+		request  func() *http.Request
+		expected error
+	}{
+		{
+			name: "valid signature",
+			request: func() *http.Request {
+				req := newRequest(`{"status":"done"}`)
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now))
+				return req
+			},
+		},
+		{
+			name: "signed with a key that is still active during rotation",
+			request: func() *http.Request {
+				req := newRequest(`{"status":"done"}`)
+				assert.NoError(t, SignRequest(req, "old", "old-secret", now))
+				return req
+			},
+		},
+		{
+			name: "signature without a key id is checked against every active key",
+			request: func() *http.Request {
+				req := newRequest(`{"status":"done"}`)
+				assert.NoError(t, SignRequest(req, "", "old-secret", now))
+				return req
+			},
+		},
+		{
+			name:     "missing signature",
+			request:  func() *http.Request { return newRequest("{}") },
+			expected: errMissingSignature,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				req := newRequest(`{"status":"done"}`)
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now))
+				req.Body = io.NopCloser(strings.NewReader(`{"status":"failed"}`))
+				return req
+			},
+			expected: errInvalidSignature,
+		},
+		{
+			name: "tampered path",
+			request: func() *http.Request {
+				req := newRequest("{}")
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now))
+				req.URL.Path = "/agents/other"
+				return req
+			},
+			expected: errInvalidSignature,
+		},
+		{
+			name: "tampered query",
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/agents/callback?status=done", strings.NewReader("{}"))
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now))
+				req.URL.RawQuery = "status=failed"
+				return req
+			},
+			expected: errInvalidSignature,
+		},
+		{
+			name: "signed query",
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/agents/callback?status=done", strings.NewReader("{}"))
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now))
+				return req
+			},
+		},
+		{
+			name: "retired key",
+			request: func() *http.Request {
+				req := newRequest("{}")
+				assert.NoError(t, SignRequest(req, "retired", "retired-secret", now))
+				return req
+			},
+			expected: errUnknownSignerKey,
+		},
+		{
+			name: "outside the allowed clock skew",
+			request: func() *http.Request {
+				req := newRequest("{}")
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now.Add(-10*time.Minute)))
+				return req
+			},
+			expected: errStaleSignature,
+		},
+		{
+			name: "within the allowed clock skew",
+			request: func() *http.Request {
+				req := newRequest("{}")
+				assert.NoError(t, SignRequest(req, "new", "new-secret", now.Add(4*time.Minute)))
+				return req
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := c.request()
+			_, err := verifyRequestSignature(req, config, now)
+			assert.ErrorIs(t, err, c.expected)
+
+			if c.expected == nil {
+				body, _ := io.ReadAll(req.Body)
+				assert.NotEmpty(t, body, "the body should be restored for the handler")
+			}
+		})
+	}
+}
+
+func TestRequestSignatureMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config := RequestSigningConfiguration{Keys: map[string]string{"key": "secret"}}
+
+	g := gin.New()
+	g.POST("/callback", RequestSignatureMiddleware(config, zap.S()), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader("payload"))
+	assert.NoError(t, SignRequest(req, "key", "secret", time.Now()))
+	recorder := httptest.NewRecorder()
+	g.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "payload", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	g.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader("payload")))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestRequestSignatureMiddlewareUsesClock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signedAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(signedAt)
+	config := RequestSigningConfiguration{Keys: map[string]string{"key": "secret"}, clock: fake}
+
+	g := gin.New()
+	g.POST("/callback", RequestSignatureMiddleware(config, zap.S()), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader("payload"))
+		assert.NoError(t, SignRequest(req, "key", "secret", signedAt))
+		recorder := httptest.NewRecorder()
+		g.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+	fake.Advance(time.Hour)
+	assert.Equal(t, http.StatusUnauthorized, serve())
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type (
+	// requiredHeader a header a handler requires, and the pattern its value must match when one was given
+	requiredHeader struct {
+		name    string
+		pattern *regexp.Regexp
+		// aliases the legacy names of the header, see HandlerConfig.LegacyHeaders
+		aliases []string
+	}
+
+	// requiredHeaders rejects requests that are missing a header the handler requires, before its arguments are extracted
+	requiredHeaders struct {
+		headers []requiredHeader
+		log     *zap.SugaredLogger
+	}
+)
+
+// parseRequiredHeaders parses the HandlerConfig.RequiredHeaders entries, a header name optionally followed by a colon and the
+// regular expression its value must match, ex: "X-Api-Version: ^v[0-9]+$"
+func parseRequiredHeaders(entries []string, legacyHeaders map[string]string) ([]requiredHeader, error) {
+	headers := make([]requiredHeader, 0, len(entries))
+	for _, entry := range entries {
+		name, expression, hasPattern := strings.Cut(entry, ":")
+		header := requiredHeader{name: http.CanonicalHeaderKey(strings.TrimSpace(name))}
+		if header.name == "" {
+			return nil, fmt.Errorf("required header %q has no name", entry)
+		}
+		if hasPattern {
+			pattern, err := regexp.Compile(strings.TrimSpace(expression))
+			if err != nil {
+				return nil, fmt.Errorf("required header %s has an invalid pattern: %w", header.name, err)
+			}
+			header.pattern = pattern
+		}
+		for legacy, replacement := range legacyHeaders {
+			if http.CanonicalHeaderKey(replacement) == header.name {
+				header.aliases = append(header.aliases, legacy)
+			}
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+// newRequiredHeaders the required headers of a handler, nil when it has none
+func newRequiredHeaders(handler *handlerDTO, log *zap.SugaredLogger) *requiredHeaders {
+	if len(handler.requiredHeaders) == 0 {
+		return nil
+	}
+	return &requiredHeaders{headers: handler.requiredHeaders, log: log}
+}
+
+// wrap returns a handler func that answers with a 400 listing the missing and invalid headers instead of calling next when
+// the request doesn't have every required header
+func (r *requiredHeaders) wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	if r == nil {
+		return next
+	}
+	return func(c *gin.Context) {
+		var missing, invalid []string
+		for _, header := range r.headers {
+			value, ok := header.value(c.Request.Header)
+			switch {
+			case !ok:
+				missing = append(missing, header.name)
+			case header.pattern != nil && !header.pattern.MatchString(value):
+				invalid = append(invalid, header.name)
+			}
+		}
+		if len(missing) > 0 || len(invalid) > 0 {
+			writeAndLogApiErrorThenAbort(c, newRequiredHeadersError(missing, invalid), r.log)
+			return
+		}
+		next(c)
+	}
+}
+
+// value the value of the header or of one of its legacy names, legacy names are only rewritten once the header is found
+func (h requiredHeader) value(header http.Header) (string, bool) {
+	for _, name := range append([]string{h.name}, h.aliases...) {
+		if values := header.Values(name); len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+func newRequiredHeadersError(missing []string, invalid []string) serr.Error {
+	metadata := map[string]any{}
+	if len(missing) > 0 {
+		metadata["missingHeaders"] = missing
+	}
+	if len(invalid) > 0 {
+		metadata["invalidHeaders"] = invalid
+	}
+	return serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        "The request is missing required headers or their values are invalid",
+		Metadata:       metadata,
+		HttpStatusCode: http.StatusBadRequest,
+	}, serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace))
+}
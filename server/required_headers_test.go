@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRequiredHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	headers, err := parseRequiredHeaders([]string{"x-tenant", "X-Api-Version: ^v[0-9]+$"}, map[string]string{"X-Armory-Tenant": "X-Tenant"})
+	assert.NoError(t, err)
+
+	called := false
+	g := gin.New()
+	g.GET("/deployments", newRequiredHeaders(&handlerDTO{requiredHeaders: headers}, zap.NewNop().Sugar()).wrap(func(c *gin.Context) {
+		called = true
+	}))
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		called = false
+		req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(map[string]string{"X-Tenant": "armory", "X-Api-Version": "v2"})
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(map[string]string{"X-Armory-Tenant": "armory", "X-Api-Version": "v2"})
+	assert.True(t, called, "legacy names of a required header satisfy it")
+
+	w = serve(map[string]string{"X-Api-Version": "latest"})
+	assert.False(t, called)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"missingHeaders":["X-Tenant"]`)
+	assert.Contains(t, w.Body.String(), `"invalidHeaders":["X-Api-Version"]`)
+
+	assert.Nil(t, newRequiredHeaders(&handlerDTO{}, zap.NewNop().Sugar()), "handlers without required headers aren't wrapped")
+}
+
+func TestParseRequiredHeadersErrors(t *testing.T) {
+	_, err := parseRequiredHeaders([]string{": ^v1$"}, nil)
+	assert.ErrorContains(t, err, "has no name")
+
+	_, err = parseRequiredHeaders([]string{"X-Api-Version: ^v[0-9+$"}, nil)
+	assert.ErrorContains(t, err, "required header X-Api-Version has an invalid pattern")
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+const (
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	forwardedHostHeader  = "X-Forwarded-Host"
+)
+
+var (
+	baseURLKey = ctxutil.NewKey[string]("server.baseURL")
+
+	errFailedToMapResponse = serr.APIError{
+		Message:        "Failed to Produce Response Body",
+		HttpStatusCode: http.StatusInternalServerError,
+	}
+)
+
+type (
+	// IControllerResponseMappers an IController can implement this interface to decorate the response bodies of its handlers
+	// before they are marshaled, i.e. with HATEOAS links, see NewResponseMapper
+	IControllerResponseMappers interface {
+		ResponseMappers() []ResponseMapper
+	}
+
+	// ResponseMapper decorates response bodies of one type, create them with NewResponseMapper
+	ResponseMapper interface {
+		mapResponse(ctx context.Context, links Links, body reflect.Value) error
+	}
+
+	// Links builds the absolute URLs of the routes of the server, from the base URL the caller used to reach it
+	Links struct {
+		base   string
+		prefix string
+		self   string
+	}
+
+	responseMapper[T any] struct {
+		fn func(ctx context.Context, links Links, body *T) error
+	}
+)
+
+// NewResponseMapper creates a ResponseMapper that calls fn with response bodies of type T, *T, []T or []*T, so the links
+// of a resource are computed in one place instead of in every handler that returns it:
+//
+//	func (c *deploymentsController) ResponseMappers() []server.ResponseMapper {
+//		return []server.ResponseMapper{
+//			server.NewResponseMapper(func(ctx context.Context, links server.Links, d *Deployment) error {
+//				d.Links = map[string]string{
+//					"self":   links.Route("/deployments/:id", d.ID),
+//					"events": links.Route("/deployments/:id/events", d.ID),
+//				}
+//				return nil
+//			}),
+//		}
+//	}
+//
+// Mappers run in order, after the handler returned and before cache headers are applied and the body is marshaled
+func NewResponseMapper[T any](fn func(ctx context.Context, links Links, body *T) error) ResponseMapper {
+	return &responseMapper[T]{fn: fn}
+}
+
+func (m *responseMapper[T]) mapResponse(ctx context.Context, links Links, body reflect.Value) error {
+	target := reflect.TypeOf((*T)(nil)).Elem()
+	switch {
+	case body.Type() == target:
+		return m.fn(ctx, links, body.Addr().Interface().(*T))
+	case body.Kind() == reflect.Pointer && body.Type().Elem() == target:
+		if body.IsNil() {
+			return nil
+		}
+		return m.fn(ctx, links, body.Interface().(*T))
+	case body.Kind() == reflect.Slice:
+		for i := 0; i < body.Len(); i++ {
+			if err := m.mapResponse(ctx, links, body.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Base the scheme and host the caller used to reach the server, ex: https://api.cloud.armory.io
+func (l Links) Base() string {
+	return l.base
+}
+
+// Self the URL of the request being answered, including its query
+func (l Links) Self() string {
+	return l.self
+}
+
+// Route the URL of a route of the server, the :name and *name segments of the template are replaced in order with the
+// path escaped params. Templates are relative to the prefix of the server, like HandlerConfig.Path, ex:
+//
+//	links.Route("/deployments/:id/events/:eventId", deploymentID, eventID)
+func (l Links) Route(template string, params ...any) string {
+	segments := strings.Split(strings.TrimPrefix(template, "/"), "/")
+	for i, segment := range segments {
+		if len(params) == 0 {
+			break
+		}
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = url.PathEscape(fmt.Sprint(params[0]))
+			params = params[1:]
+		}
+	}
+	return l.base + l.prefix + "/" + strings.Join(segments, "/")
+}
+
+// newLinks the Links of a request to the handler
+func newLinks(c *gin.Context, handler *handlerDTO) Links {
+	base, ok := baseURLKey.Value(c.Request.Context())
+	if !ok {
+		base = requestBaseURL(c.Request, false)
+	}
+	return Links{
+		base: base,
+		// the route of the request is the prefix of the server or route group followed by the path of the handler
+		prefix: strings.TrimSuffix(strings.TrimSuffix(c.FullPath(), handler.Path), "/"),
+		self:   base + c.Request.URL.RequestURI(),
+	}
+}
+
+// mapResponseBody runs the response mappers of the handler on the body
+func mapResponseBody(c *gin.Context, handler *handlerDTO, body reflect.Value) serr.Error {
+	if len(handler.ResponseMappers) == 0 {
+		return nil
+	}
+	links := newLinks(c, handler)
+	for _, mapper := range handler.ResponseMappers {
+		if err := mapper.mapResponse(c.Request.Context(), links, body); err != nil {
+			return serr.NewErrorResponseFromApiError(errFailedToMapResponse, serr.WithCause(err))
+		}
+	}
+	return nil
+}
+
+// requestBaseURL the scheme and host of the request, taken from the X-Forwarded-Proto and X-Forwarded-Host headers when they
+// were set by a trusted proxy
+func requestBaseURL(req *http.Request, forwarded bool) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	if forwarded {
+		if proto := firstHeaderValue(req, forwardedProtoHeader); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstHeaderValue(req, forwardedHostHeader); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+func firstHeaderValue(req *http.Request, header string) string {
+	value, _, _ := strings.Cut(req.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type (
+	linkedController struct{}
+
+	linkedDeployment struct {
+		ID    string            `json:"id"`
+		Links map[string]string `json:"links,omitempty"`
+	}
+)
+
+func (linkedController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, _ Void) (*Response[linkedDeployment], serr.Error) {
+			return SimpleResponse(linkedDeployment{ID: "dep 1"}), nil
+		}, HandlerConfig{Path: "/deployments/:id", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[[]*linkedDeployment], serr.Error) {
+			return SimpleResponse([]*linkedDeployment{{ID: "dep-1"}, {ID: "dep-2"}, nil}), nil
+		}, HandlerConfig{Path: "/deployments", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(func(ctx context.Context, _ Void) (*Response[linkedDeployment], serr.Error) {
+			return SimpleResponse(linkedDeployment{ID: "broken"}), nil
+		}, HandlerConfig{Path: "/broken", Method: http.MethodGet, AuthOptOut: true}),
+	}
+}
+
+func (linkedController) Prefix() string {
+	return "/v1"
+}
+
+func (linkedController) ResponseMappers() []ResponseMapper {
+	return []ResponseMapper{
+		NewResponseMapper(func(ctx context.Context, links Links, d *linkedDeployment) error {
+			if d.ID == "broken" {
+				return errors.New("no links for you")
+			}
+			d.Links = map[string]string{
+				"self":   links.Route("/v1/deployments/:id", d.ID),
+				"events": links.Route("/v1/deployments/:id/events", d.ID),
+			}
+			return nil
+		}),
+		NewResponseMapper(func(ctx context.Context, links Links, s *string) error {
+			return errors.New("mappers of other types are skipped")
+		}),
+	}
+}
+
+func TestResponseMappers(t *testing.T) {
+	controller := linkedController{}
+	data := map[handlerDTOKey]map[handlerDTOMimeTypeKey]*handlerDTO{}
+	for _, h := range controller.Handlers() {
+		assert.NoError(t, configureHandler(h, controller, nil, zap.S(), nil, data))
+	}
+	resolver, err := newClientIPResolver(ClientIPConfiguration{TrustedProxies: []string{"10.0.0.1"}})
+	assert.NoError(t, err)
+
+	g := gin.New()
+	g.Use(resolver.middleware())
+	api := g.Group("/api")
+	for key, handlers := range data {
+		api.Handle(key.method, key.path, createMultiMimeTypeFn(handlers, zap.S(), nil))
+	}
+
+	serve := func(path string, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "deployments.internal"
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(forwardedProtoHeader, "https")
+		req.Header.Set(forwardedHostHeader, "api.cloud.armory.io, proxy.internal")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/api/v1/deployments/dep%201", "10.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id": "dep 1", "links": {
+		"self": "https://api.cloud.armory.io/api/v1/deployments/dep%201",
+		"events": "https://api.cloud.armory.io/api/v1/deployments/dep%201/events"
+	}}`, w.Body.String())
+
+	w = serve("/api/v1/deployments?limit=2", "192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[
+		{"id": "dep-1", "links": {"self": "http://deployments.internal/api/v1/deployments/dep-1", "events": "http://deployments.internal/api/v1/deployments/dep-1/events"}},
+		{"id": "dep-2", "links": {"self": "http://deployments.internal/api/v1/deployments/dep-2", "events": "http://deployments.internal/api/v1/deployments/dep-2/events"}},
+		null
+	]`, w.Body.String(), "forwarding headers of untrusted peers are ignored")
+
+	assert.Equal(t, http.StatusInternalServerError, serve("/api/v1/broken", "10.0.0.1:1234").Code)
+}
+
+func TestLinks(t *testing.T) {
+	links := Links{base: "https://api.cloud.armory.io", prefix: "/api", self: "https://api.cloud.armory.io/api/v1/deployments?limit=2"}
+
+	assert.Equal(t, "https://api.cloud.armory.io", links.Base())
+	assert.Equal(t, "https://api.cloud.armory.io/api/v1/deployments?limit=2", links.Self())
+	assert.Equal(t, "https://api.cloud.armory.io/api/deployments/d-1/events/42", links.Route("/deployments/:id/events/:eventId", "d-1", 42))
+	assert.Equal(t, "https://api.cloud.armory.io/api/files/a%2Fb", links.Route("files/*path", "a/b"))
+	assert.Equal(t, "https://api.cloud.armory.io/api/deployments/:id", links.Route("/deployments/:id"), "missing params are left alone")
+}
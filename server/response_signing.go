@@ -0,0 +1,305 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// JWSSignatureHeader carries the detached JWS of a response body, its payload is the body, ex: eyJhbGciOiJFUzI1NiIsImtpZCI6IjIwMjQifQ..MEUCIQC
+	JWSSignatureHeader = "X-JWS-Signature"
+	// SignatureInputHeader carries the covered components and parameters of the HTTP Message Signatures of RFC 9421
+	SignatureInputHeader = "Signature-Input"
+	// MessageSignatureHeader carries the HTTP Message Signatures of RFC 9421
+	MessageSignatureHeader = "Signature"
+
+	messageSignatureLabel = "sig1"
+)
+
+var errFailedToSignResponse = serr.APIError{
+	Message:        "Failed to sign response",
+	HttpStatusCode: http.StatusInternalServerError,
+}
+
+type (
+	// ResponseSigningConfiguration the private keys responses are signed with, for partners that require signed responses
+	ResponseSigningConfiguration struct {
+		// Keys the private keys by key id, PEM or JWK encoded, inline or as a reference to a secret engine,
+		// ex: encrypted:secrets-manager!r:us-west-2!s:partner-signing!k:privateKey. RSA, P-256, P-384 and Ed25519 keys are supported
+		Keys map[string]string
+		// ActiveKey the id of the key responses are signed with, defaults to the only key. The other keys are still listed by
+		// ResponseSigner.PublicKeys, so partners can fetch the next key before it becomes active
+		ActiveKey string
+		// RefreshInterval how often the keys are read again from their secret engines, so rotated secrets are picked up without a restart.
+		// Keys are not refreshed when zero
+		RefreshInterval time.Duration
+		// clock the clock signatures are created at and keys are refreshed by
+		clock clock.Clock
+	}
+
+	// ResponseSigner creates response processors that sign response bodies, register them as the last processor of a handler with
+	// RegisterResponseProcessor so the signature covers the body as it is sent. Error responses aren't signed
+	ResponseSigner struct {
+		config     ResponseSigningConfiguration
+		clock      clock.Clock
+		log        *zap.SugaredLogger
+		keys       atomic.Pointer[signingKeys]
+		refreshing atomic.Bool
+	}
+
+	signingKeys struct {
+		active *signingKey
+		byID   map[string]*signingKey
+		loaded time.Time
+	}
+
+	signingKey struct {
+		id               string
+		key              jwk.Key
+		signer           crypto.Signer
+		jwsAlgorithm     jwa.SignatureAlgorithm
+		messageAlgorithm string
+	}
+)
+
+// NewResponseSigner reads the keys of the configuration from their secret engines
+func NewResponseSigner(ctx context.Context, config ResponseSigningConfiguration, log *zap.SugaredLogger) (*ResponseSigner, error) {
+	s := &ResponseSigner{config: config, clock: clock.OrDefault(config.clock), log: log}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// JWSProcessor signs response bodies with a detached JWS in the X-JWS-Signature header, the protected header names the key in kid
+func (s *ResponseSigner) JWSProcessor() ResponseProcessorFn {
+	return func(ctx context.Context, body []byte) ([]byte, serr.Error) {
+		key := s.activeKey()
+		headers := jws.NewHeaders()
+		if err := headers.Set(jws.KeyIDKey, key.id); err != nil {
+			return nil, serr.NewErrorResponseFromApiError(errFailedToSignResponse, serr.WithCause(err))
+		}
+		signature, err := jws.Sign(nil, key.jwsAlgorithm, key.key, jws.WithDetachedPayload(body), jws.WithHeaders(headers))
+		if err != nil {
+			return nil, serr.NewErrorResponseFromApiError(errFailedToSignResponse, serr.WithCause(err))
+		}
+		if header := ResponseHeaders(ctx); header != nil {
+			header.Set(JWSSignatureHeader, string(signature))
+		}
+		return body, nil
+	}
+}
+
+// MessageSignatureProcessor signs the Content-Type and Content-Digest of responses with the HTTP Message Signatures of RFC 9421,
+// adding a sha-256 Content-Digest when the response has none. Don't combine it with sha-512 DigestConfiguration.ResponseAlgorithms,
+// which replace the signed Content-Digest
+func (s *ResponseSigner) MessageSignatureProcessor() ResponseProcessorFn {
+	return func(ctx context.Context, body []byte) ([]byte, serr.Error) {
+		header := ResponseHeaders(ctx)
+		if header == nil {
+			return body, nil
+		}
+		if header.Get(ContentDigestHeader) == "" {
+			sum := sha256.Sum256(body)
+			header.Set(ContentDigestHeader, DigestSHA256+"=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		}
+
+		key := s.activeKey()
+		params := fmt.Sprintf(`("content-type" "content-digest");created=%d;keyid=%q;alg=%q`, s.clock.Now().Unix(), key.id, key.messageAlgorithm)
+		signature, err := key.signMessage([]byte(messageSignatureBase(header, params)))
+		if err != nil {
+			return nil, serr.NewErrorResponseFromApiError(errFailedToSignResponse, serr.WithCause(err))
+		}
+		header.Set(SignatureInputHeader, messageSignatureLabel+"="+params)
+		header.Set(MessageSignatureHeader, messageSignatureLabel+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+		return body, nil
+	}
+}
+
+// PublicKeys the public keys of every configured key, for partners to verify signatures with, such as served as a JWKS
+func (s *ResponseSigner) PublicKeys() (jwk.Set, error) {
+	keys := s.keys.Load()
+	ids := make([]string, 0, len(keys.byID))
+	for id := range keys.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := jwk.NewSet()
+	for _, id := range ids {
+		public, err := jwk.PublicKeyOf(keys.byID[id].key)
+		if err != nil {
+			return nil, err
+		}
+		if err := public.Set(jwk.AlgorithmKey, keys.byID[id].jwsAlgorithm); err != nil {
+			return nil, err
+		}
+		set.Add(public)
+	}
+	return set, nil
+}
+
+// activeKey the key to sign with, refreshing the keys in the background once they are older than the refresh interval
+func (s *ResponseSigner) activeKey() *signingKey {
+	keys := s.keys.Load()
+	if s.config.RefreshInterval > 0 && s.clock.Since(keys.loaded) >= s.config.RefreshInterval && s.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer s.refreshing.Store(false)
+			if err := s.refresh(context.Background()); err != nil {
+				s.log.Warnw("Failed to refresh the response signing keys, signing with the previous keys", "error", err)
+			}
+		}()
+	}
+	return keys.active
+}
+
+// refresh reads the keys again, keeping the current keys until the next refresh interval when they can't be read
+func (s *ResponseSigner) refresh(ctx context.Context) error {
+	now := s.clock.Now()
+	keys, err := loadSigningKeys(ctx, s.config)
+	if err != nil {
+		if current := s.keys.Load(); current != nil {
+			s.keys.Store(&signingKeys{active: current.active, byID: current.byID, loaded: now})
+		}
+		return err
+	}
+	keys.loaded = now
+	s.keys.Store(keys)
+	return nil
+}
+
+func loadSigningKeys(ctx context.Context, config ResponseSigningConfiguration) (*signingKeys, error) {
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("no response signing keys are configured")
+	}
+	active := config.ActiveKey
+	if active == "" {
+		if len(config.Keys) > 1 {
+			return nil, fmt.Errorf("the active response signing key must be set when there are several keys")
+		}
+		for id := range config.Keys {
+			active = id
+		}
+	}
+	if _, ok := config.Keys[active]; !ok {
+		return nil, fmt.Errorf("unknown active response signing key %q", active)
+	}
+
+	keys := &signingKeys{byID: make(map[string]*signingKey, len(config.Keys))}
+	for id, value := range config.Keys {
+		key, err := parseSigningKey(ctx, id, value)
+		if err != nil {
+			return nil, fmt.Errorf("response signing key %s: %w", id, err)
+		}
+		keys.byID[id] = key
+	}
+	keys.active = keys.byID[active]
+	return keys, nil
+}
+
+func parseSigningKey(ctx context.Context, id string, value string) (*signingKey, error) {
+	value = strings.TrimSpace(value)
+	key, err := parseJWK(ctx, value, jwk.WithPEM(strings.HasPrefix(value, "-----")))
+	if err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.KeyIDKey, id); err != nil {
+		return nil, err
+	}
+	var raw any
+	if err := key.Raw(&raw); err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{id: id, key: key}
+	switch private := raw.(type) {
+	case *rsa.PrivateKey:
+		k.signer, k.jwsAlgorithm, k.messageAlgorithm = private, jwa.RS256, "rsa-pss-sha512"
+	case *ecdsa.PrivateKey:
+		switch private.Curve {
+		case elliptic.P256():
+			k.signer, k.jwsAlgorithm, k.messageAlgorithm = private, jwa.ES256, "ecdsa-p256-sha256"
+		case elliptic.P384():
+			k.signer, k.jwsAlgorithm, k.messageAlgorithm = private, jwa.ES384, "ecdsa-p384-sha384"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", private.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		k.signer, k.jwsAlgorithm, k.messageAlgorithm = private, jwa.EdDSA, "ed25519"
+	default:
+		return nil, fmt.Errorf("not a supported private key: %T", raw)
+	}
+	return k, nil
+}
+
+// signMessage signs a signature base with the algorithm of the key, ECDSA signatures are the concatenated r and s of RFC 9421
+func (k *signingKey) signMessage(base []byte) ([]byte, error) {
+	switch private := k.signer.(type) {
+	case *rsa.PrivateKey:
+		digest := sha512.Sum512(base)
+		return rsa.SignPSS(rand.Reader, private, crypto.SHA512, digest[:], &rsa.PSSOptions{SaltLength: sha512.Size})
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if k.messageAlgorithm == "ecdsa-p384-sha384" {
+			sum := sha512.Sum384(base)
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256(base)
+			digest = sum[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (private.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature, nil
+	default:
+		return k.signer.Sign(rand.Reader, base, crypto.Hash(0))
+	}
+}
+
+// messageSignatureBase the signature base of RFC 9421 covering the content type and digest of a response
+func messageSignatureBase(header http.Header, params string) string {
+	return `"content-type": ` + strings.TrimSpace(header.Get("Content-Type")) + "\n" +
+		`"content-digest": ` + strings.TrimSpace(header.Get(ContentDigestHeader)) + "\n" +
+		`"@signature-params": ` + params
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func pemPrivateKey(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func serveSigned(t *testing.T, processor ResponseProcessorFn) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.GET("/webhooks/status", ginHOF(func(ctx context.Context, _ Void) (*Response[phaseTimingsResponse], serr.Error) {
+		return SimpleResponse(phaseTimingsResponse{ID: "dep-1"}), nil
+	}, nil, &handlerDTO{AuthOptOut: true, Produces: "application/json", ResponseProcessors: []ResponseProcessorFn{processor}}, validator.New(), &HandlerExtensionPoints{}, zap.NewNop().Sugar()))
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w
+}
+
+func TestJWSResponseSigning(t *testing.T) {
+	current, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, next, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := NewResponseSigner(context.Background(), ResponseSigningConfiguration{
+		Keys:      map[string]string{"2023-01": pemPrivateKey(t, current), "2023-07": pemPrivateKey(t, next)},
+		ActiveKey: "2023-01",
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	w := serveSigned(t, signer.JWSProcessor())
+	signature := w.Header().Get(JWSSignatureHeader)
+	require.NotEmpty(t, signature)
+	assert.Len(t, strings.Split(signature, "."), 3)
+	assert.Empty(t, strings.Split(signature, ".")[1], "the payload is detached")
+
+	payload, err := jws.Verify([]byte(signature), jwa.ES256, &current.PublicKey, jws.WithDetachedPayload(w.Body.Bytes()))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"dep-1"}`, string(payload))
+	message, err := jws.Parse([]byte(signature))
+	require.NoError(t, err)
+	assert.Equal(t, "2023-01", message.Signatures()[0].ProtectedHeaders().KeyID())
+
+	set, err := signer.PublicKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 2, set.Len(), "keys that aren't active yet are published too")
+}
+
+func TestMessageSignatureResponseSigning(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	signer, err := NewResponseSigner(context.Background(), ResponseSigningConfiguration{
+		Keys:  map[string]string{"partner": pemPrivateKey(t, key)},
+		clock: fake,
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	w := serveSigned(t, signer.MessageSignatureProcessor())
+	sum := sha256.Sum256(w.Body.Bytes())
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", w.Header().Get(ContentDigestHeader))
+	params := `("content-type" "content-digest");created=1700000000;keyid="partner";alg="ecdsa-p256-sha256"`
+	assert.Equal(t, "sig1="+params, w.Header().Get(SignatureInputHeader))
+
+	encoded := strings.TrimSuffix(strings.TrimPrefix(w.Header().Get(MessageSignatureHeader), "sig1=:"), ":")
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	require.Len(t, signature, 64)
+	base := `"content-type": application/json` + "\n" +
+		`"content-digest": ` + w.Header().Get(ContentDigestHeader) + "\n" +
+		`"@signature-params": ` + params
+	digest := sha256.Sum256([]byte(base))
+	assert.True(t, ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])))
+}
+
+func TestResponseSigningKeyRotation(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	// stands in for a secret engine whose value is rotated
+	keys := map[string]string{"partner": pemPrivateKey(t, first)}
+	signer, err := NewResponseSigner(context.Background(), ResponseSigningConfiguration{Keys: keys, RefreshInterval: time.Hour, clock: fake}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	verifiesWith := func(key *rsa.PrivateKey) bool {
+		w := serveSigned(t, signer.JWSProcessor())
+		_, err := jws.Verify([]byte(w.Header().Get(JWSSignatureHeader)), jwa.RS256, &key.PublicKey, jws.WithDetachedPayload(w.Body.Bytes()))
+		return err == nil
+	}
+	assert.True(t, verifiesWith(first))
+
+	keys["partner"] = pemPrivateKey(t, second)
+	assert.True(t, verifiesWith(first), "keys are only read again after the refresh interval")
+
+	fake.Advance(time.Hour)
+	assert.Eventually(t, func() bool { return verifiesWith(second) }, time.Second, 10*time.Millisecond, "stale keys are refreshed in the background")
+
+	keys["partner"] = "not a key"
+	fake.Advance(time.Hour)
+	require.Error(t, signer.refresh(context.Background()))
+	assert.True(t, verifiesWith(second), "the previous keys are kept when the keys can't be read")
+}
+
+func TestResponseSigningConfiguration(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = NewResponseSigner(context.Background(), ResponseSigningConfiguration{}, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "no response signing keys are configured")
+	_, err = NewResponseSigner(context.Background(), ResponseSigningConfiguration{Keys: map[string]string{"a": pemPrivateKey(t, key), "b": pemPrivateKey(t, key)}}, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "the active response signing key must be set when there are several keys")
+	_, err = NewResponseSigner(context.Background(), ResponseSigningConfiguration{Keys: map[string]string{"a": pemPrivateKey(t, key)}, ActiveKey: "b"}, zap.NewNop().Sugar())
+	assert.EqualError(t, err, `unknown active response signing key "b"`)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	oversizedResponseMetric = "http.server.response.oversized"
+
+	defaultMaxResponseBytes = 10 << 20
+)
+
+var errResponseTooLarge = serr.APIError{
+	Message:        "The response is too large, the endpoint must paginate it",
+	HttpStatusCode: http.StatusInternalServerError,
+}
+
+type (
+	// ResponseSizeConfiguration guards against handlers returning unbounded lists. JSON responses larger than MaxBytes are logged with
+	// their route and size and counted by the http.server.response.oversized metric, and with Reject answered with a 500 instead, so
+	// a list that grew to hundreds of MB can't take down the pod serving it
+	ResponseSizeConfiguration struct {
+		Enabled bool
+		// MaxBytes the size of the marshaled response above which it is oversized, defaults to 10MB
+		MaxBytes int
+		// Reject answers oversized responses with a 500 directing developers to paginate, rather than only warning about them
+		Reject bool
+	}
+
+	// responseSizeGuard the guardrail of the handlers of a server
+	responseSizeGuard struct {
+		config  ResponseSizeConfiguration
+		metrics metrics.MetricsSvc
+		log     *zap.SugaredLogger
+	}
+)
+
+// newResponseSizeGuard the guardrail of the configuration, nil when disabled
+func newResponseSizeGuard(config ResponseSizeConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) *responseSizeGuard {
+	if !config.Enabled {
+		return nil
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultMaxResponseBytes
+	}
+	return &responseSizeGuard{config: config, metrics: ms, log: log}
+}
+
+// apply checks the size of the handler's JSON responses after the processors added so far ran, encrypted responses are checked before
+// they are encrypted
+func (g *responseSizeGuard) apply(handler *handlerDTO) {
+	if g == nil || (!isJSONMediaType(handler.Produces) && handler.Encryption == "") {
+		return
+	}
+	outcome := "warned"
+	if g.config.Reject {
+		outcome = "rejected"
+	}
+	oversized := g.metrics.CounterWithTags(oversizedResponseMetric, map[string]string{
+		"uri":     handler.Path,
+		"method":  handler.Method,
+		"outcome": outcome,
+	})
+	handler.ResponseProcessors = append(handler.ResponseProcessors, func(ctx context.Context, body []byte) ([]byte, serr.Error) {
+		if len(body) <= g.config.MaxBytes {
+			return body, nil
+		}
+		oversized.Inc(1)
+		if g.config.Reject {
+			return nil, serr.NewErrorResponseFromApiError(errResponseTooLarge,
+				serr.WithErrorMessage(fmt.Sprintf("The response of %d bytes exceeds the max of %d bytes, paginate it", len(body), g.config.MaxBytes)),
+				serr.WithExtraDetailsForLogging(
+					serr.KVPair{Key: "route", Value: handler.Path},
+					serr.KVPair{Key: "responseBytes", Value: strconv.Itoa(len(body))},
+				),
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			)
+		}
+		g.log.Warnw("Response exceeds the max size, the endpoint should paginate it",
+			"method", handler.Method,
+			"route", handler.Path,
+			"responseBytes", len(body),
+			"maxBytes", g.config.MaxBytes,
+		)
+		return body, nil
+	})
+}
+
+// isJSONMediaType whether the content type is application/json or a +json suffixed type such as application/problem+json
+func isJSONMediaType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
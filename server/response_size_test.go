@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestResponseSizeGuard(t *testing.T) {
+	cases := []struct {
+		name      string
+		reject    bool
+		body      string
+		outcome   string
+		status    int
+		warned    int
+		oversized int64
+	}{
+		{name: "small responses pass", body: `[1,2]`, outcome: "warned"},
+		{name: "oversized responses are warned about", body: `[1,2,3,4,5]`, outcome: "warned", warned: 1, oversized: 1},
+		{name: "oversized responses are rejected", reject: true, body: `[1,2,3,4,5]`, outcome: "rejected", status: http.StatusInternalServerError, oversized: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scope := tally.NewTestScope("", nil)
+			ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+			ms.EXPECT().CounterWithTags(oversizedResponseMetric, map[string]string{"uri": "/deployments", "method": http.MethodGet, "outcome": c.outcome}).
+				DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+					return scope.Tagged(tags).Counter(name)
+				})
+			core, logs := observer.New(zapcore.WarnLevel)
+			guard := newResponseSizeGuard(ResponseSizeConfiguration{Enabled: true, MaxBytes: 8, Reject: c.reject}, ms, zap.New(core).Sugar())
+
+			handler := &handlerDTO{Path: "/deployments", Method: http.MethodGet, Produces: "application/json"}
+			guard.apply(handler)
+			require.Len(t, handler.ResponseProcessors, 1)
+
+			body, err := handler.ResponseProcessors[0](context.Background(), []byte(c.body))
+			if c.status != 0 {
+				require.NotNil(t, err)
+				assert.Equal(t, c.status, serr.StatusCode(err))
+				assert.Contains(t, err.Errors()[0].Message, "paginate")
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, c.body, string(body))
+			}
+			assert.Equal(t, c.warned, logs.Len())
+
+			var oversized int64
+			for _, counter := range scope.Snapshot().Counters() {
+				oversized += counter.Value()
+			}
+			assert.Equal(t, c.oversized, oversized)
+		})
+	}
+}
+
+func TestResponseSizeGuardOnlyAppliesToJSON(t *testing.T) {
+	guard := newResponseSizeGuard(ResponseSizeConfiguration{Enabled: true}, nil, zap.NewNop().Sugar())
+	assert.Equal(t, defaultMaxResponseBytes, guard.config.MaxBytes)
+
+	handler := &handlerDTO{Produces: "text/plain"}
+	guard.apply(handler)
+	assert.Empty(t, handler.ResponseProcessors)
+
+	assert.Nil(t, newResponseSizeGuard(ResponseSizeConfiguration{}, nil, nil))
+	assert.True(t, isJSONMediaType("application/problem+json; charset=utf-8"))
+	assert.False(t, isJSONMediaType("text/yaml"))
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+type (
+	// routeTable the routes of a router, checked as they are registered so that every conflict is reported at once when the server
+	// is configured rather than as a panic of the router on the first one
+	routeTable struct {
+		backend           RouterBackend
+		disallowShadowing bool
+		log               *zap.SugaredLogger
+		routes            []registeredRoute
+		conflicts         []string
+	}
+
+	registeredRoute struct {
+		method string
+		path   string
+		// source what registered the route, a controller or the server itself
+		source string
+	}
+
+	// recordingRoutes registers the routes of a group with the router once the table accepted them, conflicting routes are skipped
+	recordingRoutes struct {
+		routes gin.IRoutes
+		table  *routeTable
+		prefix string
+		source string
+	}
+)
+
+func newRouteTable(config RouterConfiguration, log *zap.SugaredLogger) *routeTable {
+	backend := config.Backend
+	if backend == "" {
+		backend = GinRouterBackend
+	}
+	return &routeTable{backend: backend, disallowShadowing: config.DisallowShadowing, log: log}
+}
+
+// group records the routes registered with the group under prefix as coming from source
+func (t *routeTable) group(routes gin.IRoutes, prefix string, source string) gin.IRoutes {
+	return &recordingRoutes{routes: routes, table: t, prefix: prefix, source: source}
+}
+
+// routesFrom the routes of the group recorded as coming from source, groups that aren't recorded are returned as is
+func routesFrom(routes gin.IRoutes, source string) gin.IRoutes {
+	if r, ok := routes.(*recordingRoutes); ok {
+		return &recordingRoutes{routes: r.routes, table: r.table, prefix: r.prefix, source: source}
+	}
+	return routes
+}
+
+// add records the route, false when it conflicts with a route of the table and must not be registered. Only the first conflict of
+// a route is reported
+func (t *routeTable) add(route registeredRoute) bool {
+	for _, existing := range t.routes {
+		conflict, shadowed := t.conflict(existing, route)
+		if shadowed != "" {
+			if t.disallowShadowing {
+				t.conflicts = append(t.conflicts, shadowed)
+			} else {
+				t.log.Warnw("Route is shadowed by a static route", "conflict", shadowed)
+			}
+		}
+		if conflict != "" {
+			t.conflicts = append(t.conflicts, conflict)
+			return false
+		}
+	}
+	t.routes = append(t.routes, route)
+	return true
+}
+
+// conflict compares the segments of the routes the way the router matches them. A conflict means the router can't register the new
+// route, a shadowed route is registered but never matches the requests of the static route that shadows it
+func (t *routeTable) conflict(existing registeredRoute, route registeredRoute) (conflict string, shadowed string) {
+	if existing.method != route.method {
+		return "", ""
+	}
+	describe := func(reason string) string {
+		return fmt.Sprintf("%s %s of %s %s %s %s of %s", route.method, route.path, route.source, reason, existing.method, existing.path, existing.source)
+	}
+	a, b := strings.Split(existing.path, "/"), strings.Split(route.path, "/")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		aWildcard, bWildcard := isWildcardSegment(a[i]), isWildcardSegment(b[i])
+		switch {
+		case !aWildcard && !bWildcard:
+			return "", ""
+		// chi matches every route on its own, only the gin tree requires the wildcards of a segment to be the only one
+		case t.backend != GinRouterBackend && aWildcard != bWildcard:
+			return "", shadowedRoute(describe, a[i], b[i])
+		case t.backend != GinRouterBackend:
+			return "", ""
+		case strings.HasPrefix(a[i], "*"):
+			return describe(fmt.Sprintf("conflicts with catch-all %s of", a[i])), ""
+		case strings.HasPrefix(b[i], "*"):
+			return describe(fmt.Sprintf("has catch-all %s conflicting with %q of", b[i], a[i])), ""
+		case aWildcard && bWildcard:
+			return describe(fmt.Sprintf("names wildcard %q differently than", b[i])), ""
+		default:
+			return "", shadowedRoute(describe, a[i], b[i])
+		}
+	}
+	if len(a) == len(b) {
+		return describe("duplicates"), ""
+	}
+	return "", ""
+}
+
+// shadowedRoute describes the route with a parameter shadowed by the route with a static segment
+func shadowedRoute(describe func(reason string) string, existing string, segment string) string {
+	if isWildcardSegment(segment) {
+		return describe(fmt.Sprintf("has parameter %s shadowed for %q by", segment, existing))
+	}
+	return describe(fmt.Sprintf("shadows parameter %s for %q of", existing, segment))
+}
+
+func isWildcardSegment(segment string) bool {
+	return strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*")
+}
+
+// err lists every conflict found, nil when there were none
+func (t *routeTable) err() error {
+	if len(t.conflicts) == 0 {
+		return nil
+	}
+	conflicts := append([]string{}, t.conflicts...)
+	sort.Strings(conflicts)
+	errs := make([]error, len(conflicts))
+	for i, conflict := range conflicts {
+		errs[i] = errors.New(conflict)
+	}
+	return fmt.Errorf("%d conflicting routes:\n%w", len(conflicts), errors.Join(errs...))
+}
+
+func (r *recordingRoutes) Use(middleware ...gin.HandlerFunc) gin.IRoutes {
+	r.routes.Use(middleware...)
+	return r
+}
+
+func (r *recordingRoutes) Handle(method string, relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Match([]string{method}, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) Any(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Match([]string{
+		http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodHead,
+		http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace,
+	}, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) GET(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodGet, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) POST(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodPost, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) DELETE(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodDelete, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) PATCH(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodPatch, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) PUT(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodPut, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) OPTIONS(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodOptions, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) HEAD(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.Handle(http.MethodHead, relativePath, handlers...)
+}
+
+func (r *recordingRoutes) Match(methods []string, relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	accepted := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if r.table.add(registeredRoute{method: method, path: joinPaths("/"+strings.TrimPrefix(r.prefix, "/"), relativePath), source: r.source}) {
+			accepted = append(accepted, method)
+		}
+	}
+	if len(accepted) > 0 {
+		r.routes.Match(accepted, relativePath, handlers...)
+	}
+	return r
+}
+
+func (r *recordingRoutes) StaticFile(relativePath string, filepath string) gin.IRoutes {
+	if r.accepts([]string{http.MethodGet, http.MethodHead}, relativePath) {
+		r.routes.StaticFile(relativePath, filepath)
+	}
+	return r
+}
+
+func (r *recordingRoutes) StaticFileFS(relativePath string, filepath string, fs http.FileSystem) gin.IRoutes {
+	if r.accepts([]string{http.MethodGet, http.MethodHead}, relativePath) {
+		r.routes.StaticFileFS(relativePath, filepath, fs)
+	}
+	return r
+}
+
+func (r *recordingRoutes) Static(relativePath string, root string) gin.IRoutes {
+	if r.accepts([]string{http.MethodGet, http.MethodHead}, path.Join(relativePath, "/*filepath")) {
+		r.routes.Static(relativePath, root)
+	}
+	return r
+}
+
+func (r *recordingRoutes) StaticFS(relativePath string, fs http.FileSystem) gin.IRoutes {
+	if r.accepts([]string{http.MethodGet, http.MethodHead}, path.Join(relativePath, "/*filepath")) {
+		r.routes.StaticFS(relativePath, fs)
+	}
+	return r
+}
+
+// accepts records the routes of a static file or directory, which are registered for every method or none
+func (r *recordingRoutes) accepts(methods []string, relativePath string) bool {
+	ok := true
+	for _, method := range methods {
+		ok = r.table.add(registeredRoute{method: method, path: joinPaths("/"+strings.TrimPrefix(r.prefix, "/"), relativePath), source: r.source}) && ok
+	}
+	return ok
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type (
+	deploymentsByIDController   struct{}
+	deploymentsByNameController struct{}
+)
+
+func (deploymentsByIDController) Handlers() []Handler {
+	ok := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(ok, HandlerConfig{Path: "/deployments/:id", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(ok, HandlerConfig{Path: "/deployments/:id", Method: http.MethodDelete, AuthOptOut: true}),
+	}
+}
+
+func (deploymentsByNameController) Handlers() []Handler {
+	ok := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(ok, HandlerConfig{Path: "/deployments/:name", Method: http.MethodGet, AuthOptOut: true}),
+		// another method has a tree of its own
+		NewHandler(ok, HandlerConfig{Path: "/deployments/:name", Method: http.MethodPut, AuthOptOut: true}),
+		NewHandler(ok, HandlerConfig{Path: "/deployments/latest", Method: http.MethodDelete, AuthOptOut: true}),
+	}
+}
+
+func TestRouteTableConflicts(t *testing.T) {
+	table := newRouteTable(RouterConfiguration{}, zap.NewNop().Sugar())
+	for _, route := range []registeredRoute{
+		{method: http.MethodGet, path: "/api/deployments/:id", source: "deploymentController"},
+		{method: http.MethodGet, path: "/api/deployments/:id/events", source: "eventController"},
+		{method: http.MethodPost, path: "/api/deployments/:name", source: "deploymentController"},
+		{method: http.MethodGet, path: "/api/deployments/latest", source: "deploymentController"},
+		{method: http.MethodGet, path: "/api/files/*path", source: "fileController"},
+	} {
+		assert.True(t, table.add(route), "%s %s", route.method, route.path)
+	}
+	for _, route := range []registeredRoute{
+		{method: http.MethodGet, path: "/api/deployments/:name/events", source: "eventController"},
+		{method: http.MethodGet, path: "/api/deployments/:id", source: "legacyController"},
+		{method: http.MethodGet, path: "/api/files/readme", source: "fileController"},
+		{method: http.MethodGet, path: "/api/deployments/*rest", source: "proxyController"},
+	} {
+		assert.False(t, table.add(route), "%s %s", route.method, route.path)
+	}
+
+	assert.EqualError(t, table.err(), `4 conflicting routes:
+GET /api/deployments/*rest of proxyController has catch-all *rest conflicting with ":id" of GET /api/deployments/:id of deploymentController
+GET /api/deployments/:id of legacyController duplicates GET /api/deployments/:id of deploymentController
+GET /api/deployments/:name/events of eventController names wildcard ":name" differently than GET /api/deployments/:id of deploymentController
+GET /api/files/readme of fileController conflicts with catch-all *path of GET /api/files/*path of fileController`)
+}
+
+func TestRouteTableShadowing(t *testing.T) {
+	routes := []registeredRoute{
+		{method: http.MethodGet, path: "/deployments/:id", source: "deploymentController"},
+		{method: http.MethodGet, path: "/deployments/latest", source: "deploymentController"},
+	}
+
+	table := newRouteTable(RouterConfiguration{}, zap.NewNop().Sugar())
+	for _, route := range routes {
+		assert.True(t, table.add(route))
+	}
+	assert.NoError(t, table.err(), "shadowed routes are only logged by default")
+
+	table = newRouteTable(RouterConfiguration{DisallowShadowing: true}, zap.NewNop().Sugar())
+	for _, route := range routes {
+		assert.True(t, table.add(route), "shadowed routes can still be served")
+	}
+	assert.EqualError(t, table.err(), `1 conflicting routes:
+GET /deployments/latest of deploymentController shadows parameter :id for "latest" of GET /deployments/:id of deploymentController`)
+
+	table = newRouteTable(RouterConfiguration{Backend: ChiRouterBackend}, zap.NewNop().Sugar())
+	assert.True(t, table.add(registeredRoute{method: http.MethodGet, path: "/deployments/:id"}))
+	assert.True(t, table.add(registeredRoute{method: http.MethodGet, path: "/deployments/:name/events"}), "chi accepts wildcards named differently")
+	assert.False(t, table.add(registeredRoute{method: http.MethodGet, path: "/deployments/:id"}))
+}
+
+func TestRegisterConflictingHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{deploymentsByIDController{}, deploymentsByNameController{}})
+	require.NoError(t, err)
+
+	g := gin.New()
+	table := newRouteTable(RouterConfiguration{}, zap.NewNop().Sugar())
+	group := table.group(g.Group("/api"), "/api", "server")
+	require.NotPanics(t, func() {
+		require.NoError(t, registry.registerHandlers(registerHandlersInput{AuthRequiredGroup: group, AuthNotEnforcedGroup: group}))
+		group.GET("/deployments/:id", func(c *gin.Context) {})
+	})
+
+	err = table.err()
+	require.Error(t, err)
+	// which of the controllers registers its route first depends on the order of the registry
+	assert.Contains(t, err.Error(), "2 conflicting routes:")
+	assert.Contains(t, err.Error(), "GET /api/deployments/:id of server")
+	assert.Contains(t, err.Error(), "names wildcard")
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/deployments/latest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "routes that don't conflict are registered")
+}
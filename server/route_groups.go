@@ -0,0 +1,174 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultRouteGroup the name controllers return from IControllerRouteGroups to also be served under the server's HTTP prefix
+const DefaultRouteGroup = ""
+
+type (
+	// RouteGroupConfiguration serves the controllers that join the group under their own prefixes and/or virtual hosts, with their own middleware
+	// configuration. This allows several services to be consolidated into one binary without rewriting their paths at the proxy.
+	// Requests are matched to groups by host and then by the longest prefix, requests that match no group are served by the ungrouped controllers
+	RouteGroupConfiguration struct {
+		// Name controllers join the group by returning the name from IControllerRouteGroups
+		Name string
+		// Prefixes the base paths the group is served under, defaults to the server's HTTP prefix. Each prefix is matched as a path prefix
+		Prefixes []string
+		// Hosts when set the group is only served for requests to these hosts, i.e. internal.cloud.armory.io. Ports are ignored
+		Hosts []string
+		// RequestLogging overrides the server's request logging configuration for the group
+		RequestLogging *RequestLoggingConfiguration
+		// RequireSignature when true every handler in the group requires a signed request, see RequestSigningConfiguration
+		RequireSignature bool
+		// ConcurrencyLimit overrides the server's concurrency limit configuration for the group, which has a limit of its own either way
+		ConcurrencyLimit *ConcurrencyLimitConfiguration
+	}
+
+	// IControllerRouteGroups an IController can implement this interface to be served by the named route groups instead of the server's
+	// default prefix, include DefaultRouteGroup to be served by both
+	IControllerRouteGroups interface {
+		RouteGroups() []string
+	}
+
+	// routeGroupRouter dispatches requests to the engine of the matching route group
+	routeGroupRouter struct {
+		routes   []groupRoute
+		fallback http.Handler
+	}
+
+	groupRoute struct {
+		hosts   []string
+		prefix  string
+		handler http.Handler
+	}
+)
+
+func validateRouteGroups(groups []RouteGroupConfiguration) error {
+	names := map[string]bool{}
+	for _, group := range groups {
+		if group.Name == DefaultRouteGroup {
+			return fmt.Errorf("route groups must have a name")
+		}
+		if names[group.Name] {
+			return fmt.Errorf("route group %q is configured more than once", group.Name)
+		}
+		names[group.Name] = true
+		if len(group.Prefixes) == 0 && len(group.Hosts) == 0 {
+			return fmt.Errorf("route group %q must have prefixes or hosts, otherwise it would replace the default routes", group.Name)
+		}
+	}
+	return nil
+}
+
+// partitionControllers splits the controllers into those served by each route group and the ungrouped ones
+func partitionControllers(groups []RouteGroupConfiguration, controllers []IController) (map[string][]IController, []IController, error) {
+	known := map[string]bool{}
+	for _, group := range groups {
+		known[group.Name] = true
+	}
+
+	grouped := map[string][]IController{}
+	var ungrouped []IController
+	for _, controller := range controllers {
+		c, ok := controller.(IControllerRouteGroups)
+		if !ok {
+			ungrouped = append(ungrouped, controller)
+			continue
+		}
+		for _, name := range c.RouteGroups() {
+			switch {
+			case name == DefaultRouteGroup:
+				ungrouped = append(ungrouped, controller)
+			case known[name]:
+				grouped[name] = append(grouped[name], controller)
+			default:
+				return nil, nil, fmt.Errorf("controller %T joins route group %q which is not configured", controller, name)
+			}
+		}
+	}
+	return grouped, ungrouped, nil
+}
+
+func newRouteGroupRouter(fallback http.Handler) *routeGroupRouter {
+	return &routeGroupRouter{fallback: fallback}
+}
+
+func (r *routeGroupRouter) add(hosts []string, prefixes []string, handler http.Handler) {
+	normalizedHosts := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		normalizedHosts = append(normalizedHosts, strings.ToLower(host))
+	}
+	for _, prefix := range prefixes {
+		r.routes = append(r.routes, groupRoute{hosts: normalizedHosts, prefix: normalizePrefix(prefix), handler: handler})
+	}
+	// host specific routes are tried first, then the longest prefix
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		if (len(r.routes[i].hosts) > 0) != (len(r.routes[j].hosts) > 0) {
+			return len(r.routes[i].hosts) > 0
+		}
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+func (r *routeGroupRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range r.routes {
+		if route.matches(host, req.URL.Path) {
+			route.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+	r.fallback.ServeHTTP(w, req)
+}
+
+func (g groupRoute) matches(host string, path string) bool {
+	if len(g.hosts) > 0 && !contains(g.hosts, host) {
+		return false
+	}
+	return g.prefix == "" || path == g.prefix || strings.HasPrefix(path, g.prefix+"/")
+}
+
+// normalizePrefix returns the prefix with a leading and without a trailing slash, the root prefix is empty
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var _ http.Handler = (*routeGroupRouter)(nil)
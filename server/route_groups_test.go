@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	groupedController struct {
+		groups []string
+	}
+	ungroupedController struct{}
+)
+
+func (c groupedController) Handlers() []Handler   { return nil }
+func (c groupedController) RouteGroups() []string { return c.groups }
+func (ungroupedController) Handlers() []Handler   { return nil }
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	})
+}
+
+func TestRouteGroupRouter(t *testing.T) {
+	router := newRouteGroupRouter(named("default"))
+	router.add(nil, []string{"/api"}, named("api"))
+	router.add(nil, []string{"/api/v2/"}, named("v2"))
+	router.add([]string{"Internal.example.com"}, []string{"/"}, named("internal"))
+
+	cases := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{host: "example.com", path: "/api/things", expected: "api"},
+		{host: "example.com", path: "/api", expected: "api"},
+		{host: "example.com", path: "/apiary", expected: "default"},
+		{host: "example.com", path: "/api/v2/things", expected: "v2"},
+		{host: "internal.example.com:3000", path: "/api/things", expected: "internal"},
+		{host: "example.com", path: "/health", expected: "default"},
+	}
+	for _, c := range cases {
+		t.Run(c.host+c.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.path, nil)
+			req.Host = c.host
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, c.expected, rec.Body.String())
+		})
+	}
+}
+
+func TestPartitionControllers(t *testing.T) {
+	groups := []RouteGroupConfiguration{{Name: "internal", Hosts: []string{"internal"}}, {Name: "legacy", Prefixes: []string{"/legacy"}}}
+	internal := groupedController{groups: []string{"internal"}}
+	both := groupedController{groups: []string{DefaultRouteGroup, "legacy"}}
+	plain := ungroupedController{}
+
+	grouped, ungrouped, err := partitionControllers(groups, []IController{internal, both, plain})
+	assert.NoError(t, err)
+	assert.Equal(t, []IController{both, plain}, ungrouped)
+	assert.Equal(t, []IController{internal}, grouped["internal"])
+	assert.Equal(t, []IController{both}, grouped["legacy"])
+
+	_, _, err = partitionControllers(groups, []IController{groupedController{groups: []string{"missing"}}})
+	assert.Error(t, err)
+}
+
+func TestValidateRouteGroups(t *testing.T) {
+	assert.NoError(t, validateRouteGroups(nil))
+	assert.NoError(t, validateRouteGroups([]RouteGroupConfiguration{{Name: "a", Prefixes: []string{"/a"}}, {Name: "b", Hosts: []string{"b"}}}))
+	assert.Error(t, validateRouteGroups([]RouteGroupConfiguration{{Prefixes: []string{"/a"}}}))
+	assert.Error(t, validateRouteGroups([]RouteGroupConfiguration{{Name: "a"}}))
+	assert.Error(t, validateRouteGroups([]RouteGroupConfiguration{{Name: "a", Prefixes: []string{"/a"}}, {Name: "a", Prefixes: []string{"/b"}}}))
+}
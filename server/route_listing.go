@@ -0,0 +1,197 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	armoryhttp "github.com/armory-io/go-commons/http"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// routeListingPath the management route that lists the routes of every server, see DiagnosticsConfiguration.DisableRouteListing
+const routeListingPath = "/routes"
+
+type (
+	// routeListing collects the routes of the servers, so they can be listed with example requests while developing
+	routeListing struct {
+		mu      sync.Mutex
+		sources []routeSource
+	}
+
+	routeSource struct {
+		server           string
+		baseURL          string
+		prefix           string
+		requireSignature bool
+		deliveryHeader   string
+		registry         iHandlerRegistry
+	}
+
+	// listedRoute a route along with a curl command that calls it
+	listedRoute struct {
+		Server           string `json:"server"`
+		Method           string `json:"method"`
+		Path             string `json:"path"`
+		Consumes         string `json:"consumes"`
+		Produces         string `json:"produces"`
+		AuthRequired     bool   `json:"authRequired"`
+		RequireSignature bool   `json:"requireSignature,omitempty"`
+		Deduplicate      bool   `json:"deduplicate,omitempty"`
+		Default          bool   `json:"default,omitempty"`
+		Curl             string `json:"curl"`
+	}
+)
+
+// add lists the handlers of the registry, served under prefix by the server at httpConfig
+func (l *routeListing) add(server string, httpConfig armoryhttp.HTTP, prefix string, requireSignature bool, deduplication DeduplicationConfiguration, registry iHandlerRegistry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sources = append(l.sources, routeSource{
+		server:           server,
+		baseURL:          baseURL(httpConfig),
+		prefix:           prefix,
+		requireSignature: requireSignature,
+		deliveryHeader:   deduplication.withDefaults().Header,
+		registry:         registry,
+	})
+}
+
+// routes the listed routes of server, or of every server when server is empty, sorted by path and method
+func (l *routeListing) routes(server string) []listedRoute {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var routes []listedRoute
+	for _, source := range l.sources {
+		if server != "" && source.server != server {
+			continue
+		}
+		for _, handler := range source.registry.handlers() {
+			route := listedRoute{
+				Server:           source.server,
+				Method:           handler.Method,
+				Path:             joinPaths("/"+strings.TrimPrefix(source.prefix, "/"), handler.Path),
+				Consumes:         handler.Consumes,
+				Produces:         handler.Produces,
+				AuthRequired:     !handler.AuthOptOut,
+				RequireSignature: handler.RequireSignature || source.requireSignature,
+				Deduplicate:      handler.Deduplicate,
+				Default:          handler.Default,
+			}
+			route.Curl = curlExample(source.baseURL, source.deliveryHeader, route)
+			routes = append(routes, route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		if routes[i].Method != routes[j].Method {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Produces < routes[j].Produces
+	})
+	return routes
+}
+
+// handler serves the routes of every server as JSON
+func (l *routeListing) handler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{"routes": l.routes("")})
+}
+
+// log logs the routes of server along with their curl commands
+func (l *routeListing) log(server string, logger *zap.SugaredLogger) {
+	if l == nil {
+		return
+	}
+	for _, route := range l.routes(server) {
+		logger.Infow(fmt.Sprintf("Route %s %s", route.Method, route.Path),
+			"server", route.Server,
+			"consumes", route.Consumes,
+			"produces", route.Produces,
+			"authRequired", route.AuthRequired,
+			"curl", route.Curl,
+		)
+	}
+}
+
+// curlExample a curl command with the headers route requires, path parameters are left as <name> placeholders
+func curlExample(baseURL string, deliveryHeader string, route listedRoute) string {
+	command := []string{"curl", "-X", route.Method, quoteShell(baseURL + examplePath(route.Path))}
+	if route.AuthRequired {
+		// double quoted so the token is taken from the environment
+		command = append(command, "-H", `"Authorization: Bearer $ARMORY_TOKEN"`)
+	}
+	if route.RequireSignature {
+		command = append(command, "-H", quoteShell(SignatureHeader+": <signature>"))
+	}
+	if route.Deduplicate {
+		command = append(command, "-H", quoteShell(deliveryHeader+": <delivery id>"))
+	}
+	if route.Produces != "" {
+		command = append(command, "-H", quoteShell("Accept: "+route.Produces))
+	}
+	switch route.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		if route.Consumes != "" {
+			command = append(command, "-H", quoteShell("Content-Type: "+route.Consumes))
+		}
+		if strings.Contains(route.Consumes, "json") {
+			command = append(command, "-d", quoteShell("{}"))
+		} else {
+			command = append(command, "--data-binary", "@body")
+		}
+	}
+	return strings.Join(command, " ")
+}
+
+// examplePath replaces the :name and *name parameters of a gin path with <name>
+func examplePath(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "<" + segment[1:] + ">"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func baseURL(httpConfig armoryhttp.HTTP) string {
+	scheme := "http"
+	if httpConfig.SSL.Enabled {
+		scheme = "https"
+	}
+	host := httpConfig.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	if httpConfig.Port == 0 {
+		return fmt.Sprintf("%s://%s", scheme, host)
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, httpConfig.Port)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	armoryhttp "github.com/armory-io/go-commons/http"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type listedController struct{}
+
+func (listedController) Prefix() string { return "/deployments" }
+
+func (listedController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+			return SimpleResponse("ok"), nil
+		}, HandlerConfig{
+			Path:   "/:id",
+			Method: http.MethodGet,
+		}),
+		NewHandler(func(ctx context.Context, _ map[string]any) (*Response[Void], serr.Error) {
+			return nil, nil
+		}, HandlerConfig{
+			Method:      http.MethodPost,
+			AuthOptOut:  true,
+			Deduplicate: true,
+		}),
+	}
+}
+
+func TestRouteListing(t *testing.T) {
+	registry, err := newHandlerRegistry("http", zap.S(), nil, nil, []IController{listedController{}})
+	assert.NoError(t, err)
+
+	listing := &routeListing{}
+	listing.add("http", armoryhttp.HTTP{Prefix: "/api", Port: 3000}, "/api", true, DeduplicationConfiguration{}, registry)
+	listing.add("management", armoryhttp.HTTP{Port: 3001}, "", false, DeduplicationConfiguration{}, &handlerRegistry{})
+
+	routes := listing.routes("")
+	assert.Equal(t, []listedRoute{
+		{
+			Server:           "http",
+			Method:           http.MethodPost,
+			Path:             "/api/deployments",
+			Consumes:         "application/json",
+			Produces:         "application/json",
+			RequireSignature: true,
+			Deduplicate:      true,
+			Curl:             `curl -X POST 'http://localhost:3000/api/deployments' -H 'X-Armory-Signature: <signature>' -H 'X-Delivery-Id: <delivery id>' -H 'Accept: application/json' -H 'Content-Type: application/json' -d '{}'`,
+		},
+		{
+			Server:           "http",
+			Method:           http.MethodGet,
+			Path:             "/api/deployments/:id",
+			Consumes:         "application/json",
+			Produces:         "application/json",
+			AuthRequired:     true,
+			RequireSignature: true,
+			Curl:             `curl -X GET 'http://localhost:3000/api/deployments/<id>' -H "Authorization: Bearer $ARMORY_TOKEN" -H 'X-Armory-Signature: <signature>' -H 'Accept: application/json'`,
+		},
+	}, routes)
+	assert.Empty(t, listing.routes("management"))
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	listing.handler(c)
+	var body map[string][]listedRoute
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, routes, body["routes"])
+
+	var disabled *routeListing
+	disabled.add("http", armoryhttp.HTTP{}, "", false, DeduplicationConfiguration{}, registry)
+	disabled.log("http", zap.S())
+}
+
+func TestCurlExample(t *testing.T) {
+	assert.Equal(t,
+		`curl -X PUT 'https://api.example.com/files/<path>' -H 'Accept: application/json' -H 'Content-Type: application/octet-stream' --data-binary @body`,
+		curlExample("https://api.example.com", DeliveryIDHeader, listedRoute{Method: http.MethodPut, Path: "/files/*path", Consumes: "application/octet-stream", Produces: "application/json"}),
+	)
+	assert.Equal(t, "http://localhost", baseURL(armoryhttp.HTTP{Host: "0.0.0.0"}))
+	assert.Equal(t, "https://example.com:8443", baseURL(armoryhttp.HTTP{Host: "example.com", Port: 8443, SSL: armoryhttp.SSL{Enabled: true}}))
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// routeSwitches the routes switched off by Configuration.DisabledRoutes
+type routeSwitches struct {
+	routes     map[handlerDTOKey]bool
+	prefixes   []string
+	statusCode int
+	logger     *zap.SugaredLogger
+}
+
+// newRouteSwitches parses the disabled routes, entries are either a method and a path such as "DELETE /deployments/:id", or a
+// path prefix such as "/deployments" that disables every route under it. Nil when nothing is disabled
+func newRouteSwitches(disabled []string, statusCode int, logger *zap.SugaredLogger) (*routeSwitches, error) {
+	if len(disabled) == 0 {
+		return nil, nil
+	}
+	switch statusCode {
+	case 0:
+		statusCode = http.StatusServiceUnavailable
+	case http.StatusNotFound, http.StatusServiceUnavailable:
+	default:
+		return nil, fmt.Errorf("disabled routes must respond with %d or %d, not %d", http.StatusNotFound, http.StatusServiceUnavailable, statusCode)
+	}
+
+	s := &routeSwitches{routes: map[handlerDTOKey]bool{}, statusCode: statusCode, logger: logger}
+	for _, entry := range disabled {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 1:
+			s.prefixes = append(s.prefixes, normalizeRoutePath(fields[0]))
+		case 2:
+			s.routes[handlerDTOKey{method: strings.ToUpper(fields[0]), path: normalizeRoutePath(fields[1])}] = true
+		default:
+			return nil, fmt.Errorf("invalid disabled route %q, expected a method and a path or a path prefix", entry)
+		}
+	}
+	return s, nil
+}
+
+func normalizeRoutePath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+// disabled whether the route has been switched off
+func (s *routeSwitches) disabled(key handlerDTOKey) bool {
+	if s == nil {
+		return false
+	}
+	path := normalizeRoutePath(key.path)
+	if s.routes[handlerDTOKey{method: key.method, path: path}] {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handler answers the requests of a disabled route
+func (s *routeSwitches) handler(c *gin.Context) {
+	message := "This endpoint has been disabled"
+	if s.statusCode == http.StatusNotFound {
+		message = "Not Found"
+	}
+	writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        message,
+		HttpStatusCode: s.statusCode,
+	}, serr.WithErrorMessage("Request for a disabled route")), s.logger)
+}
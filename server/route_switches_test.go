@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type switchedController struct{}
+
+func (switchedController) Handlers() []Handler {
+	handler := func(ctx context.Context, _ Void) (*Response[string], serr.Error) {
+		return SimpleResponse("ok"), nil
+	}
+	return []Handler{
+		NewHandler(handler, HandlerConfig{Path: "/deployments/:id", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(handler, HandlerConfig{Path: "/deployments/:id", Method: http.MethodDelete, AuthOptOut: true}),
+		NewHandler(handler, HandlerConfig{Path: "/clusters", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(handler, HandlerConfig{Path: "/clusters/:id/nodes", Method: http.MethodGet, AuthOptOut: true}),
+		NewHandler(handler, HandlerConfig{Path: "/clustersets", Method: http.MethodGet, AuthOptOut: true}),
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		statusCode int
+		expected   int
+	}{
+		"503 by default":     {expected: http.StatusServiceUnavailable},
+		"404 when requested": {statusCode: http.StatusNotFound, expected: http.StatusNotFound},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			switches, err := newRouteSwitches([]string{"delete /deployments/:id", "clusters/"}, c.statusCode, zap.NewNop().Sugar())
+			require.NoError(t, err)
+			registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{switchedController{}})
+			require.NoError(t, err)
+			g := gin.New()
+			require.NoError(t, registry.registerHandlers(registerHandlersInput{
+				AuthRequiredGroup:    g.Group(""),
+				AuthNotEnforcedGroup: g.Group(""),
+				DisabledRoutes:       switches,
+			}))
+
+			for path, expected := range map[string]int{
+				"GET /deployments/1":    http.StatusOK,
+				"DELETE /deployments/1": c.expected,
+				"GET /clusters":         c.expected,
+				"GET /clusters/1/nodes": c.expected,
+				"GET /clustersets":      http.StatusOK,
+			} {
+				method, target, _ := strings.Cut(path, " ")
+				w := httptest.NewRecorder()
+				g.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+				assert.Equal(t, expected, w.Code, path)
+				if expected != http.StatusOK {
+					assert.Contains(t, w.Body.String(), `"errors"`, "disabled routes respond with the standard error contract")
+				}
+			}
+
+			disabled := 0
+			for _, handler := range registry.handlers() {
+				if handler.Disabled {
+					disabled++
+				}
+			}
+			assert.Equal(t, 3, disabled, "disabled handlers are flagged in the route listing of /info")
+		})
+	}
+}
+
+func TestNewRouteSwitches(t *testing.T) {
+	switches, err := newRouteSwitches(nil, 0, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	assert.Nil(t, switches)
+	assert.False(t, switches.disabled(handlerDTOKey{method: http.MethodGet, path: "/"}))
+
+	_, err = newRouteSwitches([]string{"GET /deployments extra"}, 0, zap.NewNop().Sugar())
+	assert.EqualError(t, err, `invalid disabled route "GET /deployments extra", expected a method and a path or a path prefix`)
+	_, err = newRouteSwitches([]string{"/deployments"}, http.StatusGone, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "disabled routes must respond with 404 or 503, not 410")
+}
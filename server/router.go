@@ -0,0 +1,275 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/pprof"
+	"path"
+	"strings"
+)
+
+const (
+	// GinRouterBackend routes requests with gin's radix tree, this is the default
+	GinRouterBackend RouterBackend = "gin"
+	// ChiRouterBackend routes requests with chi. Every route is served by its own gin engine, so handlers and middleware see the
+	// same gin.Context, path parameters and gin.Context.FullPath as with GinRouterBackend, but routes gin refuses to register
+	// together such as /users/:id and /users/:name/posts are accepted
+	ChiRouterBackend RouterBackend = "chi"
+
+	defaultProfilePrefix = "/debug/pprof"
+)
+
+type (
+	// RouterBackend the router that matches requests to handlers
+	RouterBackend string
+
+	// RouterConfiguration selects the router of the server, the Handler and Controller APIs are the same for all of them
+	RouterConfiguration struct {
+		// Backend defaults to GinRouterBackend
+		Backend RouterBackend
+		// DisallowShadowing fails to start when a static route shadows the parameter of another, ex: /deployments/latest and
+		// /deployments/:id. Shadowed routes are otherwise only logged, conflicts the router can't serve always fail
+		DisallowShadowing bool
+	}
+
+	// router registers the routes of a server and serves them
+	router interface {
+		http.Handler
+		gin.IRoutes
+		// group creates a group of routes under prefix that starts out with the middleware of the router
+		group(prefix string) gin.IRoutes
+	}
+
+	ginRouter struct {
+		*gin.Engine
+	}
+
+	// chiRouter matches requests with chi and hands them to a gin engine with the single matching route
+	chiRouter struct {
+		*chiGroup
+		mux            *chi.Mux
+		trustedProxies []string
+		// notFound serves the requests that match no route with the middleware of the router, as gin does
+		notFound *gin.Engine
+	}
+
+	chiGroup struct {
+		router   *chiRouter
+		basePath string
+		handlers gin.HandlersChain
+	}
+)
+
+func newRouter(config RouterConfiguration, trustedProxies []string) (router, error) {
+	switch config.Backend {
+	case "", GinRouterBackend:
+		g := gin.New()
+		// gin trusts every proxy by default, restrict it to the configured ones. Handlers should use RequestDetails.ClientIP
+		if err := g.SetTrustedProxies(trustedProxies); err != nil {
+			return nil, err
+		}
+		return ginRouter{g}, nil
+	case ChiRouterBackend:
+		return newChiRouter(trustedProxies)
+	default:
+		return nil, fmt.Errorf("unknown router backend %q, expected %q or %q", config.Backend, GinRouterBackend, ChiRouterBackend)
+	}
+}
+
+func (r ginRouter) group(prefix string) gin.IRoutes {
+	return r.Engine.Group(prefix)
+}
+
+func newChiRouter(trustedProxies []string) (*chiRouter, error) {
+	r := &chiRouter{mux: chi.NewRouter(), trustedProxies: trustedProxies}
+	r.chiGroup = &chiGroup{router: r, basePath: "/"}
+	notFound, err := r.newEngine()
+	if err != nil {
+		return nil, err
+	}
+	r.notFound = notFound
+	// gin answers requests for a path registered with another method with a 404 unless HandleMethodNotAllowed is set
+	r.mux.NotFound(func(w http.ResponseWriter, req *http.Request) { r.notFound.ServeHTTP(w, req) })
+	r.mux.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) { r.notFound.ServeHTTP(w, req) })
+	return r, nil
+}
+
+func (r *chiRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.ServeHTTP(w, req)
+}
+
+// Use adds middleware to the routes registered afterwards and to requests that match no route
+func (r *chiRouter) Use(middleware ...gin.HandlerFunc) gin.IRoutes {
+	r.chiGroup.Use(middleware...)
+	r.notFound.Use(middleware...)
+	return r
+}
+
+func (r *chiRouter) group(prefix string) gin.IRoutes {
+	return &chiGroup{router: r, basePath: joinPaths(r.basePath, prefix), handlers: r.combineHandlers(nil)}
+}
+
+func (r *chiRouter) newEngine() (*gin.Engine, error) {
+	g := gin.New()
+	if err := g.SetTrustedProxies(r.trustedProxies); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// add registers the route with chi, served by an engine of its own so gin never sees two routes that could conflict
+func (r *chiRouter) add(methods []string, absolutePath string, handlers gin.HandlersChain) {
+	g, err := r.newEngine()
+	if err != nil {
+		// the trusted proxies were already validated when the router was created
+		panic(err)
+	}
+	pattern := chiPattern(absolutePath)
+	for _, method := range methods {
+		g.Handle(method, absolutePath, handlers...)
+		chi.RegisterMethod(method)
+		r.mux.Method(method, pattern, g)
+	}
+}
+
+func (g *chiGroup) Use(middleware ...gin.HandlerFunc) gin.IRoutes {
+	g.handlers = append(g.handlers, middleware...)
+	return g
+}
+
+func (g *chiGroup) Handle(method string, relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Match([]string{method}, relativePath, handlers...)
+}
+
+func (g *chiGroup) Any(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Match([]string{
+		http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodHead,
+		http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace,
+	}, relativePath, handlers...)
+}
+
+func (g *chiGroup) GET(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodGet, relativePath, handlers...)
+}
+
+func (g *chiGroup) POST(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodPost, relativePath, handlers...)
+}
+
+func (g *chiGroup) DELETE(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodDelete, relativePath, handlers...)
+}
+
+func (g *chiGroup) PATCH(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodPatch, relativePath, handlers...)
+}
+
+func (g *chiGroup) PUT(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodPut, relativePath, handlers...)
+}
+
+func (g *chiGroup) OPTIONS(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodOptions, relativePath, handlers...)
+}
+
+func (g *chiGroup) HEAD(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return g.Handle(http.MethodHead, relativePath, handlers...)
+}
+
+func (g *chiGroup) Match(methods []string, relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.router.add(methods, joinPaths(g.basePath, relativePath), g.combineHandlers(handlers))
+	return g
+}
+
+func (g *chiGroup) StaticFile(relativePath string, filepath string) gin.IRoutes {
+	return g.serveFile(relativePath, func(c *gin.Context) { c.File(filepath) })
+}
+
+func (g *chiGroup) StaticFileFS(relativePath string, filepath string, fs http.FileSystem) gin.IRoutes {
+	return g.serveFile(relativePath, func(c *gin.Context) { c.FileFromFS(filepath, fs) })
+}
+
+func (g *chiGroup) Static(relativePath string, root string) gin.IRoutes {
+	return g.StaticFS(relativePath, gin.Dir(root, false))
+}
+
+func (g *chiGroup) StaticFS(relativePath string, fs http.FileSystem) gin.IRoutes {
+	fileServer := http.StripPrefix(joinPaths(g.basePath, relativePath), http.FileServer(fs))
+	handler := gin.WrapH(fileServer)
+	urlPattern := path.Join(relativePath, "/*filepath")
+	g.GET(urlPattern, handler)
+	g.HEAD(urlPattern, handler)
+	return g
+}
+
+func (g *chiGroup) serveFile(relativePath string, handler gin.HandlerFunc) gin.IRoutes {
+	if strings.ContainsAny(relativePath, ":*") {
+		panic("URL parameters can not be used when serving a static file")
+	}
+	g.GET(relativePath, handler)
+	g.HEAD(relativePath, handler)
+	return g
+}
+
+func (g *chiGroup) combineHandlers(handlers gin.HandlersChain) gin.HandlersChain {
+	combined := make(gin.HandlersChain, 0, len(g.handlers)+len(handlers))
+	combined = append(combined, g.handlers...)
+	return append(combined, handlers...)
+}
+
+// chiPattern converts a gin path such as /users/:id/*path into the chi pattern /users/{id}/*
+func chiPattern(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = "{" + segment[1:] + "}"
+		case strings.HasPrefix(segment, "*"):
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// joinPaths joins paths the way gin does, keeping the trailing slash of the relative path
+func joinPaths(absolutePath string, relativePath string) string {
+	if relativePath == "" {
+		return absolutePath
+	}
+	joined := path.Join(absolutePath, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(joined, "/") {
+		return joined + "/"
+	}
+	return joined
+}
+
+// registerProfiler serves the runtime profiles of net/http/pprof under prefix
+func registerProfiler(group gin.IRoutes, prefix string) {
+	group.GET(prefix+"/", gin.WrapF(pprof.Index))
+	group.GET(prefix+"/cmdline", gin.WrapF(pprof.Cmdline))
+	group.GET(prefix+"/profile", gin.WrapF(pprof.Profile))
+	group.POST(prefix+"/symbol", gin.WrapF(pprof.Symbol))
+	group.GET(prefix+"/symbol", gin.WrapF(pprof.Symbol))
+	group.GET(prefix+"/trace", gin.WrapF(pprof.Trace))
+	for _, profile := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		group.GET(prefix+"/"+profile, gin.WrapH(pprof.Handler(profile)))
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterBackends(t *testing.T) {
+	for _, backend := range []RouterBackend{GinRouterBackend, ChiRouterBackend} {
+		t.Run(string(backend), func(t *testing.T) {
+			r, err := newRouter(RouterConfiguration{Backend: backend}, nil)
+			assert.NoError(t, err)
+			r.Use(func(c *gin.Context) {
+				c.Header("X-Global", "true")
+			})
+
+			public := r.group("/api")
+			private := r.group("/api")
+			private.Use(func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+			})
+			public.GET("/users/:id", func(c *gin.Context) {
+				c.String(http.StatusOK, c.FullPath()+" "+c.Param("id"))
+			})
+			public.Any("/files/*path", func(c *gin.Context) {
+				c.String(http.StatusOK, c.Request.Method+" "+c.Param("path"))
+			})
+			private.POST("/users", func(c *gin.Context) {
+				c.Status(http.StatusCreated)
+			})
+
+			serve := func(method string, path string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+				return w
+			}
+
+			w := serve(http.MethodGet, "/api/users/42")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "/api/users/:id 42", w.Body.String())
+			assert.Equal(t, "true", w.Header().Get("X-Global"))
+
+			assert.Equal(t, "DELETE /a/b.txt", serve(http.MethodDelete, "/api/files/a/b.txt").Body.String())
+			assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/api/users").Code)
+
+			w = serve(http.MethodGet, "/api/nothing")
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, "true", w.Header().Get("X-Global"), "middleware runs for requests that match no route")
+			assert.Equal(t, http.StatusNotFound, serve(http.MethodPut, "/api/users/42").Code)
+		})
+	}
+}
+
+func TestChiRouterAcceptsRoutesThatConflictInGin(t *testing.T) {
+	register := func(r router) {
+		r.GET("/users/:id", func(c *gin.Context) { c.String(http.StatusOK, "user "+c.Param("id")) })
+		r.GET("/users/:name/posts", func(c *gin.Context) { c.String(http.StatusOK, "posts of "+c.Param("name")) })
+	}
+
+	g, err := newRouter(RouterConfiguration{}, nil)
+	assert.NoError(t, err)
+	assert.Panics(t, func() { register(g) })
+
+	r, err := newRouter(RouterConfiguration{Backend: ChiRouterBackend}, nil)
+	assert.NoError(t, err)
+	register(r)
+	for path, expected := range map[string]string{"/users/1": "user 1", "/users/jane/posts": "posts of jane"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expected, w.Body.String())
+	}
+}
+
+func TestNewRouterRejectsUnknownBackends(t *testing.T) {
+	_, err := newRouter(RouterConfiguration{Backend: "mux"}, nil)
+	assert.EqualError(t, err, `unknown router backend "mux", expected "gin" or "chi"`)
+
+	_, err = newRouter(RouterConfiguration{Backend: ChiRouterBackend}, []string{"not an ip"})
+	assert.Error(t, err)
+}
+
+func TestChiPattern(t *testing.T) {
+	assert.Equal(t, "/api/users/{id}/files/*", chiPattern("/api/users/:id/files/*path"))
+	assert.Equal(t, "/", chiPattern("/"))
+}
@@ -0,0 +1,436 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	securityPolicyRefreshMetric  = "http.server.securityPolicy.refresh"
+	securityPolicyRejectedMetric = "http.server.securityPolicy.rejected"
+
+	defaultSecurityPolicyRefreshInterval = time.Minute
+	defaultSecurityPolicyMaxAge          = 10 * time.Minute
+)
+
+var (
+	securityPolicyUnavailable = serr.APIError{
+		Message:        "The security policy of the organization is unavailable, try again later",
+		HttpStatusCode: http.StatusServiceUnavailable,
+	}
+	securityPolicyDenied = serr.APIError{
+		Message:        "The request is not allowed by the security policy of the organization",
+		HttpStatusCode: http.StatusForbidden,
+	}
+)
+
+type (
+	// SecurityPolicyConfiguration applies the security policies of orgs and environments, pulled from a central endpoint every
+	// RefreshInterval, to the requests of their principals, so changing them doesn't require a redeploy. It fails closed: until the
+	// policies are loaded, or once they are older than MaxAge because refreshing keeps failing, requests with a principal are answered
+	// with a 503 and no cross-origin requests are allowed. It only applies to the http server
+	SecurityPolicyConfiguration struct {
+		Enabled bool
+		// Endpoint the URL the policies are fetched from as a JSON array of SecurityPolicy, unless a SecurityPolicySource is provided
+		// to the server. It is fetched with the http.Client provided to the server if any, such as the authenticated client of the
+		// armory-http module
+		Endpoint string
+		// RefreshInterval how often the policies are pulled, defaults to 1m
+		RefreshInterval time.Duration
+		// MaxAge how long the last policies pulled are applied for while refreshing fails, defaults to 10m
+		MaxAge time.Duration
+		// source the SecurityPolicySource provided to the server
+		source SecurityPolicySource
+		client *http.Client
+		clock  clock.Clock
+	}
+
+	// SecurityPolicySource loads the security policies of every org and environment, provide one to the server to load them from
+	// elsewhere than the Endpoint
+	SecurityPolicySource interface {
+		SecurityPolicies(ctx context.Context) ([]SecurityPolicy, error)
+	}
+
+	// SecurityPolicy restricts the requests of the principals of an org, or of an environment of the org. A policy without an EnvID
+	// applies to the environments of the org that have none of their own. Empty lists don't restrict anything
+	SecurityPolicy struct {
+		OrgID string `json:"orgId"`
+		EnvID string `json:"envId,omitempty"`
+		// AllowedOrigins the origins, such as https://app.example.com, browsers may send cross-origin requests from
+		AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+		// AllowedAudiences the token audiences accepted, a token is accepted when any of its audiences is allowed
+		AllowedAudiences []string `json:"allowedAudiences,omitempty"`
+		// AllowedIPs the IPs or CIDRs requests may come from, see RequestDetails.ClientIP
+		AllowedIPs []string `json:"allowedIps,omitempty"`
+	}
+
+	securityPolicyKey struct {
+		orgID, envID string
+	}
+
+	// compiledSecurityPolicy a SecurityPolicy parsed for matching requests
+	compiledSecurityPolicy struct {
+		origins   map[string]bool
+		audiences map[string]bool
+		networks  []*net.IPNet
+	}
+
+	// securityPolicies the last policies loaded, replaced as a whole on every successful refresh
+	securityPolicies struct {
+		config  SecurityPolicyConfiguration
+		source  SecurityPolicySource
+		log     *zap.SugaredLogger
+		metrics metrics.MetricsSvc
+		clock   clock.Clock
+
+		mu       sync.RWMutex
+		policies map[securityPolicyKey]*compiledSecurityPolicy
+		// origins the origins allowed by any policy, for requests that have no tenant such as preflights
+		origins  map[string]bool
+		loadedAt time.Time
+	}
+
+	// httpSecurityPolicySource fetches the policies from an endpoint, with conditional requests so unchanged policies aren't
+	// transferred again
+	httpSecurityPolicySource struct {
+		endpoint string
+		client   *http.Client
+		etag     string
+		policies []SecurityPolicy
+	}
+)
+
+// newSecurityPolicies loads the policies of the configuration and refreshes them until the application stops, nil when disabled
+func newSecurityPolicies(lc fx.Lifecycle, config SecurityPolicyConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) (*securityPolicies, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaultSecurityPolicyRefreshInterval
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = defaultSecurityPolicyMaxAge
+	}
+	source := config.source
+	if source == nil {
+		if config.Endpoint == "" {
+			return nil, errors.New("security policies require an endpoint or a SecurityPolicySource")
+		}
+		client := config.client
+		if client == nil {
+			client = &http.Client{Timeout: 30 * time.Second}
+		}
+		source = &httpSecurityPolicySource{endpoint: config.Endpoint, client: client}
+	}
+
+	c := clock.OrDefault(config.clock)
+	p := &securityPolicies{config: config, source: source, log: log, metrics: ms, clock: c}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			// requests are rejected until the policies are loaded, a failure here is retried by the refresh loop
+			p.refresh(ctx)
+			go func() {
+				defer close(done)
+				ticker := c.NewTicker(config.RefreshInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C():
+						p.refresh(context.Background())
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			close(stop)
+			<-done
+			return nil
+		},
+	})
+	return p, nil
+}
+
+// refresh replaces the policies with the ones of the source, the previous ones are kept when loading or parsing them fails
+func (p *securityPolicies) refresh(ctx context.Context) {
+	loaded, err := p.source.SecurityPolicies(ctx)
+	if err != nil {
+		p.metrics.CounterWithTags(securityPolicyRefreshMetric, map[string]string{"outcome": "failed"}).Inc(1)
+		p.log.Warnw("Failed to load the security policies", "error", err, "lastLoaded", p.lastLoaded())
+		return
+	}
+	policies := make(map[securityPolicyKey]*compiledSecurityPolicy, len(loaded))
+	origins := map[string]bool{}
+	for _, policy := range loaded {
+		compiled, err := compileSecurityPolicy(policy)
+		if err != nil {
+			p.metrics.CounterWithTags(securityPolicyRefreshMetric, map[string]string{"outcome": "invalid"}).Inc(1)
+			p.log.Errorw("Failed to parse the security policies", "error", err, "orgId", policy.OrgID, "envId", policy.EnvID)
+			return
+		}
+		policies[securityPolicyKey{orgID: policy.OrgID, envID: policy.EnvID}] = compiled
+		for origin := range compiled.origins {
+			origins[origin] = true
+		}
+	}
+
+	p.mu.Lock()
+	p.policies, p.origins, p.loadedAt = policies, origins, p.clock.Now()
+	p.mu.Unlock()
+	p.metrics.CounterWithTags(securityPolicyRefreshMetric, map[string]string{"outcome": "loaded"}).Inc(1)
+}
+
+func (p *securityPolicies) lastLoaded() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.loadedAt
+}
+
+// fresh whether the policies were loaded within MaxAge, the caller holds the lock
+func (p *securityPolicies) fresh() bool {
+	return p.policies != nil && p.clock.Since(p.loadedAt) <= p.config.MaxAge
+}
+
+// policy the policy of the tenant, nil when it has none. False when the policies are unavailable
+func (p *securityPolicies) policy(orgID string, envID string) (*compiledSecurityPolicy, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.fresh() {
+		return nil, false
+	}
+	if policy, ok := p.policies[securityPolicyKey{orgID: orgID, envID: envID}]; ok {
+		return policy, true
+	}
+	return p.policies[securityPolicyKey{orgID: orgID}], true
+}
+
+// allowsOrigin whether any policy allows the origin
+func (p *securityPolicies) allowsOrigin(origin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.fresh() && p.origins[normalizeOrigin(origin)]
+}
+
+// corsMiddleware answers preflights, which carry no credentials so the tenant is unknown. They are allowed for the origins allowed by
+// any policy, the request that follows is checked against the policy of its tenant by tenantMiddleware
+func (p *securityPolicies) corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		method := c.GetHeader("Access-Control-Request-Method")
+		if c.Request.Method != http.MethodOptions || method == "" {
+			return
+		}
+		if p.allowsOrigin(origin) {
+			h := c.Writer.Header()
+			allowOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", method)
+			if headers := c.GetHeader("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			// so browsers pick up policy changes about as soon as the server does
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.config.RefreshInterval.Seconds())))
+		} else {
+			p.rejected("origin")
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// tenantMiddleware applies the policy of the tenant of the principal, it must be registered after the middleware that authenticates
+// the principal. Requests without a principal are only subject to the origins allowed by any policy
+func (p *securityPolicies) tenantMiddleware(log *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		principal, err := iam.ExtractPrincipalFromContext(c.Request.Context())
+		if err != nil {
+			if origin != "" && p.allowsOrigin(origin) {
+				allowOrigin(c.Writer.Header(), origin)
+			}
+			return
+		}
+
+		policy, ok := p.policy(principal.OrgId, principal.EnvId)
+		if !ok {
+			p.rejected("unavailable")
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(securityPolicyUnavailable,
+				serr.WithErrorMessage("the security policies are older than the max age"),
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			), log)
+			return
+		}
+		if policy != nil {
+			if reason := policy.deny(c.Request.Context(), principal); reason != "" {
+				p.rejected(reason)
+				writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(securityPolicyDenied,
+					serr.WithErrorMessage(fmt.Sprintf("the %s of the request is not allowed", reason)),
+					serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+				), log)
+				return
+			}
+		}
+
+		if origin == "" {
+			return
+		}
+		if policy != nil && len(policy.origins) > 0 {
+			if policy.origins[normalizeOrigin(origin)] {
+				allowOrigin(c.Writer.Header(), origin)
+			}
+			return
+		}
+		if p.allowsOrigin(origin) {
+			allowOrigin(c.Writer.Header(), origin)
+		}
+	}
+}
+
+func (p *securityPolicies) rejected(reason string) {
+	p.metrics.CounterWithTags(securityPolicyRejectedMetric, map[string]string{"reason": reason}).Inc(1)
+}
+
+func allowOrigin(h http.Header, origin string) {
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Credentials", "true")
+}
+
+func compileSecurityPolicy(policy SecurityPolicy) (*compiledSecurityPolicy, error) {
+	if policy.OrgID == "" {
+		return nil, errors.New("policy has no org")
+	}
+	compiled := &compiledSecurityPolicy{origins: map[string]bool{}, audiences: map[string]bool{}}
+	for _, origin := range policy.AllowedOrigins {
+		compiled.origins[normalizeOrigin(origin)] = true
+	}
+	for _, audience := range policy.AllowedAudiences {
+		compiled.audiences[audience] = true
+	}
+	for _, ip := range policy.AllowedIPs {
+		cidr := ip
+		if !strings.Contains(ip, "/") {
+			if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP %q: %w", ip, err)
+		}
+		compiled.networks = append(compiled.networks, network)
+	}
+	return compiled, nil
+}
+
+// deny what about the request the policy doesn't allow, empty when it is allowed
+func (s *compiledSecurityPolicy) deny(ctx context.Context, principal *iam.ArmoryCloudPrincipal) string {
+	if len(s.audiences) > 0 && !s.allowsAudience(principal.Audience) {
+		return "audience"
+	}
+	if len(s.networks) > 0 {
+		ip, _ := clientIPKey.Value(ctx)
+		if !s.allowsIP(net.ParseIP(ip)) {
+			return "ip"
+		}
+	}
+	return ""
+}
+
+func (s *compiledSecurityPolicy) allowsAudience(audiences []string) bool {
+	for _, audience := range audiences {
+		if s.audiences[audience] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compiledSecurityPolicy) allowsIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOrigin lower cases the origin and drops a trailing slash, origins are otherwise compared exactly
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(origin), "/")
+}
+
+func (s *httpSecurityPolicySource) SecurityPolicies(ctx context.Context) ([]SecurityPolicy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && s.policies != nil:
+		return s.policies, nil
+	case resp.StatusCode != http.StatusOK:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, s.endpoint)
+	}
+	var policies []SecurityPolicy
+	if err := json.NewDecoder(resp.Body).Decode(&policies); err != nil {
+		return nil, fmt.Errorf("failed to decode the security policies: %w", err)
+	}
+	if policies == nil {
+		policies = []SecurityPolicy{}
+	}
+	s.etag, s.policies = resp.Header.Get("ETag"), policies
+	return policies, nil
+}
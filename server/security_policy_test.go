@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+)
+
+func newSecurityPolicyMetrics(t *testing.T) (metrics.MetricsSvc, tally.TestScope) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	return ms, scope
+}
+
+type fakeSecurityPolicySource struct {
+	policies []SecurityPolicy
+	err      error
+}
+
+func (s *fakeSecurityPolicySource) SecurityPolicies(context.Context) ([]SecurityPolicy, error) {
+	return s.policies, s.err
+}
+
+func TestSecurityPolicies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	ms, scope := newSecurityPolicyMetrics(t)
+	source := &fakeSecurityPolicySource{err: errors.New("unavailable")}
+
+	policies, err := newSecurityPolicies(fxtest.NewLifecycle(t), SecurityPolicyConfiguration{Enabled: true, source: source, clock: fake}, ms, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	policies.refresh(context.Background())
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(clientIPKey.WithValue(c.Request.Context(), c.GetHeader("ip")))
+	})
+	g.Use(policies.corsMiddleware())
+	authenticated := func(c *gin.Context) {
+		if org := c.GetHeader("org"); org != "" {
+			c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: org, EnvId: c.GetHeader("env"), Audience: []string{c.GetHeader("aud")}}))
+		}
+	}
+	g.GET("/deployments", authenticated, policies.tenantMiddleware(zap.NewNop().Sugar()), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	serve := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/deployments", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec
+	}
+	preflight := map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": http.MethodGet}
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, map[string]string{"org": "org-1"}).Code, "fails closed until the policies are loaded")
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, nil).Code, "requests without a principal have no policy")
+	rec := serve(http.MethodOptions, preflight)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"), "no origin is allowed until the policies are loaded")
+
+	source.policies, source.err = []SecurityPolicy{
+		{OrgID: "org-1", AllowedOrigins: []string{"https://App.example.com/"}, AllowedAudiences: []string{"https://api.armory.io"}, AllowedIPs: []string{"10.0.0.0/8", "192.0.2.1"}},
+		{OrgID: "org-1", EnvID: "sandbox"},
+	}, nil
+	fake.Advance(time.Minute)
+	policies.refresh(context.Background())
+
+	allowed := map[string]string{"org": "org-1", "aud": "https://api.armory.io", "ip": "10.1.2.3", "Origin": "https://app.example.com"}
+	rec = serve(http.MethodGet, allowed)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = serve(http.MethodOptions, preflight)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, http.MethodGet, rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "60", rec.Header().Get("Access-Control-Max-Age"))
+
+	with := func(key string, value string) map[string]string {
+		headers := map[string]string{}
+		for k, v := range allowed {
+			headers[k] = v
+		}
+		headers[key] = value
+		return headers
+	}
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, with("aud", "https://other.armory.io")).Code)
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, with("ip", "192.0.2.2")).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, with("ip", "192.0.2.1")).Code)
+	rec = serve(http.MethodGet, with("Origin", "https://evil.example.com"))
+	assert.Equal(t, http.StatusOK, rec.Code, "browsers enforce CORS")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, with("env", "sandbox")).Code, "environments with a policy of their own don't inherit the org's")
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, map[string]string{"org": "org-2"}).Code, "orgs without a policy aren't restricted")
+
+	source.policies, source.err = nil, errors.New("unavailable")
+	fake.Advance(10 * time.Minute)
+	policies.refresh(context.Background())
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, allowed).Code, "the last policies are applied up to the max age")
+	fake.Advance(time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, allowed).Code, "fails closed once the policies are older than the max age")
+
+	counts := map[string]int64{}
+	for _, counter := range scope.Snapshot().Counters() {
+		counts[counter.Name()+"/"+counter.Tags()["outcome"]+counter.Tags()["reason"]] += counter.Value()
+	}
+	assert.Equal(t, int64(1), counts[securityPolicyRefreshMetric+"/loaded"])
+	assert.Equal(t, int64(2), counts[securityPolicyRejectedMetric+"/unavailable"])
+	assert.Equal(t, int64(1), counts[securityPolicyRejectedMetric+"/audience"])
+}
+
+func TestSecurityPoliciesKeepTheLastValidPolicies(t *testing.T) {
+	source := &fakeSecurityPolicySource{policies: []SecurityPolicy{{OrgID: "org-1", AllowedIPs: []string{"10.0.0.0/8"}}}}
+	ms, _ := newSecurityPolicyMetrics(t)
+	policies, err := newSecurityPolicies(fxtest.NewLifecycle(t), SecurityPolicyConfiguration{Enabled: true, source: source}, ms, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	policies.refresh(context.Background())
+
+	source.policies = []SecurityPolicy{{OrgID: "org-1", AllowedIPs: []string{"not-an-ip"}}}
+	policies.refresh(context.Background())
+
+	policy, ok := policies.policy("org-1", "")
+	require.True(t, ok)
+	assert.Len(t, policy.networks, 1)
+}
+
+func TestHTTPSecurityPolicySource(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`[{"orgId": "org-1", "allowedOrigins": ["https://app.example.com"]}]`))
+	}))
+	defer server.Close()
+	source := &httpSecurityPolicySource{endpoint: server.URL, client: server.Client()}
+
+	for i := 0; i < 2; i++ {
+		policies, err := source.SecurityPolicies(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []SecurityPolicy{{OrgID: "org-1", AllowedOrigins: []string{"https://app.example.com"}}}, policies)
+	}
+	assert.Equal(t, 2, requests)
+}
+
+func TestSecurityPoliciesRequireASource(t *testing.T) {
+	_, err := newSecurityPolicies(fxtest.NewLifecycle(t), SecurityPolicyConfiguration{Enabled: true}, nil, zap.NewNop().Sugar())
+	assert.EqualError(t, err, "security policies require an endpoint or a SecurityPolicySource")
+}
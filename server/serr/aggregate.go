@@ -0,0 +1,150 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serr
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// Accumulator collects the errors of a handler that validates or processes several things before responding,
+// so the client gets all of them at once instead of one per request.
+//
+//	var errs serr.Accumulator
+//	for i, item := range request.Items {
+//		if !exists(item) {
+//			errs.Add(serr.APIError{Message: "item not found", Metadata: map[string]any{"index": i}, HttpStatusCode: http.StatusNotFound})
+//		}
+//	}
+//	if err := errs.Err(serr.WithErrorMessage("Failed to import items")); err != nil {
+//		return nil, err
+//	}
+//
+// The zero value is ready to use.
+type Accumulator struct {
+	errors []APIError
+	causes []error
+	chain  []Cause
+}
+
+// Add adds API errors to the response
+func (a *Accumulator) Add(apiErrors ...APIError) {
+	a.errors = append(a.errors, apiErrors...)
+}
+
+// AddError adds the API errors, the cause and the cause chain of an Error, nil errors are ignored
+func (a *Accumulator) AddError(err Error) {
+	if err == nil {
+		return
+	}
+	a.errors = append(a.errors, err.Errors()...)
+	if err.Cause() != nil {
+		a.causes = append(a.causes, err.Cause())
+	}
+	a.chain = append(a.chain, err.CauseChain()...)
+}
+
+// Len the number of API errors added so far
+func (a *Accumulator) Len() int {
+	return len(a.errors)
+}
+
+// Err an Error with the deduplicated API errors and the joined causes, nil if nothing was added
+func (a *Accumulator) Err(opts ...Option) Error {
+	if len(a.errors) == 0 {
+		return nil
+	}
+	if cause := errors.Join(a.causes...); cause != nil {
+		opts = append([]Option{WithCause(cause)}, opts...)
+	}
+	if len(a.chain) > 0 {
+		opts = append(opts, withJoinedCauseChain(a.chain))
+	}
+	return NewErrorResponseFromApiErrors(dedupe(a.errors), opts...)
+}
+
+// Join combines errors into a single Error with their deduplicated API errors, joined causes and cause chains, logging details and
+// response headers. Nil errors are ignored, and nil is returned when all of them are nil
+func Join(errs ...Error) Error {
+	var (
+		apiErrors []APIError
+		causes    []error
+		chain     []Cause
+		details   []KVPair
+		headers   []KVPair
+	)
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		apiErrors = append(apiErrors, err.Errors()...)
+		if err.Cause() != nil {
+			causes = append(causes, err.Cause())
+		}
+		chain = append(chain, err.CauseChain()...)
+		details = append(details, err.ExtraDetailsForLogging()...)
+		headers = append(headers, err.ExtraResponseHeaders()...)
+	}
+	if len(apiErrors) == 0 {
+		return nil
+	}
+	return NewErrorResponseFromApiErrors(dedupe(apiErrors),
+		WithCause(errors.Join(causes...)),
+		withJoinedCauseChain(chain),
+		WithExtraDetailsForLogging(details...),
+		WithExtraResponseHeaders(headers...),
+	)
+}
+
+// StatusCode the HTTP status of the response for err. When the API errors disagree the most specific status wins:
+// server errors over client errors, and any other client error over a plain 400, i.e. 400 and 403 become 403.
+// API errors without a status count as http.StatusInternalServerError
+func StatusCode(err Error) int {
+	status := 0
+	for _, apiErr := range err.Errors() {
+		code := apiErr.HttpStatusCode
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		if code > status {
+			status = code
+		}
+	}
+	if status == 0 {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// dedupe drops repeated API errors, such as the same field error reported by two handler arguments
+func dedupe(apiErrors []APIError) []APIError {
+	deduped := make([]APIError, 0, len(apiErrors))
+	for _, apiErr := range apiErrors {
+		duplicate := false
+		for _, existing := range deduped {
+			if reflect.DeepEqual(existing, apiErr) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			deduped = append(deduped, apiErr)
+		}
+	}
+	return deduped
+}
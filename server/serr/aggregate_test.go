@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serr
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func fieldError(field string, status int) APIError {
+	return APIError{Message: field + " is invalid", Metadata: map[string]any{"field": field}, HttpStatusCode: status}
+}
+
+func TestStatusCode(t *testing.T) {
+	cases := map[string]struct {
+		errors   []APIError
+		expected int
+	}{
+		"all bad requests": {
+			errors:   []APIError{fieldError("a", http.StatusBadRequest), fieldError("b", http.StatusBadRequest)},
+			expected: http.StatusBadRequest,
+		},
+		"bad request and forbidden": {
+			errors:   []APIError{fieldError("a", http.StatusBadRequest), fieldError("b", http.StatusForbidden)},
+			expected: http.StatusForbidden,
+		},
+		"client and server errors": {
+			errors:   []APIError{fieldError("a", http.StatusNotFound), fieldError("b", http.StatusBadGateway)},
+			expected: http.StatusBadGateway,
+		},
+		"unset status": {
+			errors:   []APIError{fieldError("a", http.StatusBadRequest), {Message: "boom"}},
+			expected: http.StatusInternalServerError,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, StatusCode(NewErrorResponseFromApiErrors(c.errors)))
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	cause := errors.New("cause")
+	err := Join(
+		nil,
+		NewErrorResponseFromApiErrors([]APIError{fieldError("a", http.StatusBadRequest), fieldError("b", http.StatusBadRequest)}, WithCause(cause)),
+		NewErrorResponseFromApiError(fieldError("a", http.StatusBadRequest), WithExtraResponseHeaders(KVPair{Key: "Retry-After", Value: "1"})),
+	)
+	assert.Equal(t, []APIError{fieldError("a", http.StatusBadRequest), fieldError("b", http.StatusBadRequest)}, err.Errors())
+	assert.ErrorIs(t, err.Cause(), cause)
+	assert.Equal(t, []KVPair{{Key: "Retry-After", Value: "1"}}, err.ExtraResponseHeaders())
+
+	assert.Nil(t, Join(nil, nil))
+}
+
+func TestAccumulator(t *testing.T) {
+	var errs Accumulator
+	assert.Nil(t, errs.Err())
+
+	errs.Add(fieldError("a", http.StatusBadRequest))
+	errs.AddError(nil)
+	errs.AddError(NewErrorResponseFromApiError(fieldError("a", http.StatusBadRequest), WithCause(errors.New("cause"))))
+	errs.Add(fieldError("b", http.StatusConflict))
+
+	err := errs.Err(WithErrorMessage("Failed to import items"))
+	assert.Equal(t, 3, errs.Len())
+	assert.Len(t, err.Errors(), 2)
+	assert.Equal(t, http.StatusConflict, StatusCode(err))
+	assert.Equal(t, "Failed to import items", err.Message())
+	assert.EqualError(t, err.Cause(), "cause")
+}
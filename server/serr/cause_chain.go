@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package serr
+
+import (
+	"errors"
+)
+
+type (
+	// Cause a link of the chain of causes of an error, so support tooling can follow a failure across services. Chains are
+	// ordered from the error to its root cause, and are logged and only returned to principals with the debug scope
+	Cause struct {
+		// Code a stable identifier of the failure within its component, ex: TARGET_UNREACHABLE
+		Code string `json:"code"`
+		// Component the service or subsystem that failed, ex: deploy-engine
+		Component string `json:"component"`
+		// Message what failed, for support engineers rather than end users
+		Message string `json:"message"`
+	}
+
+	// causeChainer implemented by errors that carry a cause chain
+	causeChainer interface {
+		CauseChain() []Cause
+	}
+
+	// causeChainError an error carrying a cause chain, see WrapCauses
+	causeChainError struct {
+		err    error
+		causes []Cause
+	}
+)
+
+// WithCauseChain adds the causes to the cause chain of the error, before the chain of Error.Cause if it carries one
+func WithCauseChain(causes ...Cause) Option {
+	return func(aE *apiErrorResponse) {
+		aE.causes = append(aE.causes, causes...)
+	}
+}
+
+// WrapCauses wraps err with the causes so that an Error created from it, with WithCause, keeps the chain. Use it to pass the
+// chain of a failed downstream call, or of an Error, through code that returns plain errors
+func WrapCauses(err error, causes ...Cause) error {
+	if err == nil || len(causes) == 0 {
+		return err
+	}
+	return &causeChainError{err: err, causes: causes}
+}
+
+// CauseChainOf the cause chain carried by err or any error it wraps, nil if there's none
+func CauseChainOf(err error) []Cause {
+	var chainer causeChainer
+	if err == nil || !errors.As(err, &chainer) {
+		return nil
+	}
+	return chainer.CauseChain()
+}
+
+func (e *causeChainError) Error() string {
+	return e.err.Error()
+}
+
+func (e *causeChainError) Unwrap() error {
+	return e.err
+}
+
+// CauseChain the causes of the error followed by the chain of the error it wraps
+func (e *causeChainError) CauseChain() []Cause {
+	return append(append([]Cause(nil), e.causes...), CauseChainOf(e.err)...)
+}
+
+// withJoinedCauseChain adds the chains of the errors an error joins, in place of the chain of its cause as that joins their
+// causes and errors.As would only find the chain of the first
+func withJoinedCauseChain(causes []Cause) Option {
+	return func(aE *apiErrorResponse) {
+		aE.causes = append(aE.causes, causes...)
+		aE.joinedChain = true
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package serr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+var (
+	dbCause     = Cause{Code: "CONNECTION_REFUSED", Component: "mysql", Message: "dial tcp 10.0.0.1:3306: connection refused"}
+	targetCause = Cause{Code: "TARGET_UNREACHABLE", Component: "deploy-engine", Message: "failed to load the deployment target"}
+	edgeCause   = Cause{Code: "DEPLOYMENT_FAILED", Component: "deployments-api", Message: "failed to start the deployment"}
+)
+
+func TestCauseChain(t *testing.T) {
+	err := NewSimpleError("Failed to start the deployment", nil)
+	assert.Empty(t, err.CauseChain())
+	assert.Empty(t, err.ToErrorResponseContract("error-id").Causes, "chains are only added to responses by the server")
+
+	// a downstream failure carried through code returning plain errors
+	downstream := WrapCauses(errors.New("deploy-engine responded 503"), targetCause, dbCause)
+	wrapped := fmt.Errorf("starting deployment: %w", downstream)
+	assert.Equal(t, []Cause{targetCause, dbCause}, CauseChainOf(wrapped))
+
+	err = NewErrorResponseFromApiError(APIError{Message: "Failed to start the deployment", HttpStatusCode: http.StatusBadGateway},
+		WithCause(wrapped),
+		WithCauseChain(edgeCause),
+	)
+	assert.Equal(t, []Cause{edgeCause, targetCause, dbCause}, err.CauseChain(), "the chain runs from the error to its root cause")
+
+	// an Error passed on as a plain error keeps its chain
+	rewrapped := NewSimpleError("Failed to retry the deployment", WrapCauses(errors.New("retry failed"), err.CauseChain()...))
+	assert.Equal(t, []Cause{edgeCause, targetCause, dbCause}, rewrapped.CauseChain())
+
+	assert.Nil(t, WrapCauses(nil, dbCause))
+	assert.Nil(t, CauseChainOf(errors.New("plain")))
+}
+
+func TestJoinedCauseChains(t *testing.T) {
+	first := NewSimpleError("first", WrapCauses(errors.New("first"), dbCause))
+	second := NewSimpleError("second", errors.New("second"))
+	third := NewErrorResponseFromApiError(APIError{Message: "third"}, WithCauseChain(targetCause))
+
+	assert.Equal(t, []Cause{dbCause, targetCause}, Join(first, second, third).CauseChain(), "the chain of every joined cause is kept once")
+
+	var errs Accumulator
+	errs.AddError(first)
+	errs.AddError(third)
+	assert.Equal(t, []Cause{edgeCause, dbCause, targetCause}, errs.Err(WithCauseChain(edgeCause)).CauseChain())
+}
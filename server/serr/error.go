@@ -21,6 +21,7 @@ package serr
 
 import (
 	"github.com/armory-io/go-commons/bufferpool"
+	"github.com/armory-io/go-commons/redact"
 	"github.com/armory-io/go-commons/stacktrace"
 	"go.uber.org/zap/zapcore"
 	"strconv"
@@ -32,6 +33,8 @@ const defaultErrorCode = 42
 type ResponseContract struct {
 	ErrorId string                     `json:"error_id"`
 	Errors  []ResponseContractErrorDTO `json:"errors"`
+	// Causes the cause chain of the error, only returned to principals with the debug scope
+	Causes []Cause `json:"causes,omitempty"`
 }
 
 type ResponseContractErrorDTO struct {
@@ -92,6 +95,10 @@ type apiErrorResponse struct {
 	message string
 	// cause See Error.Cause
 	cause error
+	// causes See Error.CauseChain
+	causes []Cause
+	// joinedChain the causes are the chains of joined errors, which already include the chains of their causes
+	joinedChain bool
 	// stacktrace
 	stacktrace string
 	// origin
@@ -154,6 +161,8 @@ type Error interface {
 	Message() string
 	// Cause The cause of the API error
 	Cause() error
+	// CauseChain The machine-readable chain of causes of the API error, see Cause. Empty unless set WithCauseChain or carried by Cause
+	CauseChain() []Cause
 	// Stacktrace The stacktrace of the error
 	Stacktrace() string
 	// Origin the origination of the API error
@@ -186,6 +195,13 @@ func (c *apiErrorResponse) Cause() error {
 	return c.cause
 }
 
+func (c *apiErrorResponse) CauseChain() []Cause {
+	if c.joinedChain {
+		return c.causes
+	}
+	return append(append([]Cause(nil), c.causes...), CauseChainOf(c.cause)...)
+}
+
 func (c *apiErrorResponse) Stacktrace() string {
 	return c.stacktrace
 }
@@ -204,7 +220,7 @@ func (c *apiErrorResponse) ToErrorResponseContract(errorId string) ResponseContr
 		}
 		errors = append(errors, ResponseContractErrorDTO{
 			Message:  err.Message,
-			Metadata: err.Metadata,
+			Metadata: redactMetadata(err.Metadata),
 			Code:     strconv.Itoa(code),
 		})
 	}
@@ -336,3 +352,11 @@ func NewSimpleErrorWithStatusCode(msgForResponse string, statusCodeForResponse i
 func NewWrappedErrorWithStatusCode(err error, statusCodeForResponse int) Error {
 	return NewSimpleErrorWithStatusCode(err.Error(), statusCodeForResponse, err)
 }
+
+// redactMetadata masks the sensitive fields of the values of the metadata, see the redact package
+func redactMetadata(metadata map[string]any) map[string]any {
+	if metadata == nil {
+		return nil
+	}
+	return redact.Value(metadata).(map[string]any)
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serr
+
+import (
+	"github.com/armory-io/go-commons/redact"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestToErrorResponseContractRedactsMetadata(t *testing.T) {
+	type connection struct {
+		Host     string `json:"host"`
+		Password string `json:"password" sensitive:"true"`
+	}
+	err := NewErrorResponseFromApiError(APIError{
+		Message:        "Failed to connect",
+		Metadata:       map[string]any{"attempt": 2, "connection": connection{Host: "db", Password: "hunter2"}},
+		HttpStatusCode: http.StatusBadGateway,
+	})
+
+	contract := err.ToErrorResponseContract("error-id")
+	assert.Equal(t, map[string]any{"attempt": 2, "connection": map[string]any{"host": "db", "password": redact.Masked}}, contract.Errors[0].Metadata)
+}
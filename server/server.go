@@ -21,14 +21,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/envutils"
 	armoryhttp "github.com/armory-io/go-commons/http"
 	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/iam/scopes"
+	"github.com/armory-io/go-commons/logging"
 	"github.com/armory-io/go-commons/management/info"
 	"github.com/armory-io/go-commons/metadata"
 	"github.com/armory-io/go-commons/metrics"
 	"github.com/armory-io/go-commons/server/serr"
+	"github.com/armory-io/go-commons/shutdown"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"github.com/armory-io/go-commons/validation"
 	"github.com/creasty/defaults"
-	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
@@ -46,6 +53,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -75,6 +83,28 @@ type (
 		ResponseProcessors() []ResponseProcessorWithOrder
 	}
 
+	// IControllerResponseHeaders an IController can implement this interface to add headers, such as Cache-Control: no-store, to every response
+	// of its exported handlers, including error responses. HandlerConfig.StaticHeaders and Response.Headers take precedence over these
+	IControllerResponseHeaders interface {
+		ResponseHeaders() map[string][]string
+	}
+
+	// IControllerHTTPHandlers an IController can implement this interface to serve plain http.Handlers, such as reverse proxies, that need
+	// the raw request and response. Each handler receives every method and sub path of its prefix, which must not overlap with other handlers
+	IControllerHTTPHandlers interface {
+		HTTPHandlers() []HTTPHandlerConfig
+	}
+
+	// HTTPHandlerConfig config that mounts an http.Handler under a path prefix, see IControllerHTTPHandlers
+	HTTPHandlerConfig struct {
+		// Prefix the path prefix the handler is served on, the controller prefix does not apply
+		Prefix string
+		// Handler the handler, it is responsible for its own error responses
+		Handler http.Handler
+		// AuthOptOut Set this to true if the handler should skip AuthN, otherwise the principal is available from the request context
+		AuthOptOut bool
+	}
+
 	// IControllerAuthZValidator an IController can implement this interface to apply a common AuthZ validator to all exported handlers
 	IControllerAuthZValidator interface {
 		AuthZValidator(p *iam.ArmoryCloudPrincipal) (string, bool)
@@ -177,6 +207,54 @@ type (
 		Controllers []IController `group:"management"`
 	}
 
+	// optionalDependencies dependencies the server uses when the application provides them
+	optionalDependencies struct {
+		fx.In
+		Clock              clock.Clock        `optional:"true"`
+		DeduplicationStore DeduplicationStore `optional:"true"`
+		GeoIPReader        GeoIPReader        `optional:"true"`
+		UsagePublisher     UsagePublisher     `optional:"true"`
+		ShutdownRecorder   *shutdown.Recorder `optional:"true"`
+		// SecurityPolicySource and HTTPClient load the policies of SecurityPolicyConfiguration
+		SecurityPolicySource SecurityPolicySource `optional:"true"`
+		HTTPClient           *http.Client         `optional:"true"`
+		// StepUpVerifier records the step-up authentication of requests onto their principal
+		StepUpVerifier StepUpVerifier `optional:"true"`
+		// FeatureFlags evaluates the HandlerConfig.RequiredFeatures of handlers
+		FeatureFlags FeatureFlags `optional:"true"`
+		// RateLimitStore shares the buckets of RateLimitConfiguration between replicas
+		RateLimitStore RateLimitStore `optional:"true"`
+		// ManagementAuthService authenticates the requests to a separate management server in place of the AuthService of the
+		// http server, see ManagementSecurityConfiguration
+		ManagementAuthService AuthService `name:"management" optional:"true"`
+	}
+
+	// serverOptions the server configured by configureServer
+	serverOptions struct {
+		name string
+		// config the configuration of the server, it listens on config.HTTP
+		config Configuration
+		// handlesManagement whether the server serves the management routes, such as /metrics
+		handlesManagement bool
+		// management the policy of a separate management server, see ManagementSecurityConfiguration
+		management *managementSecurity
+	}
+
+	// serverDependencies the dependencies shared by the http and management servers
+	serverDependencies struct {
+		lc               fx.Lifecycle
+		optional         optionalDependencies
+		as               AuthService
+		logger           *zap.SugaredLogger
+		ms               metrics.MetricsSvc
+		md               metadata.ApplicationMetadata
+		is               *info.InfoService
+		requestValidator *validator.Validate
+		groups           *apiGroups
+		switches         *routeSwitches
+		gate             *featureGate
+	}
+
 	// Void an empty struct that can be used as a placeholder for requests/responses that do not have a body
 	Void struct{}
 
@@ -215,6 +293,13 @@ type (
 		VerifyPrincipalAndSetContext(tokenOrRawHeader string, c *gin.Context) error
 	}
 
+	// RequestAuthService an AuthService that can also authenticate requests without a bearer token, such as iam.SpinnakerVerifier.
+	// VerifyRequestAndSetContext returns false when it leaves the request to the bearer token
+	RequestAuthService interface {
+		AuthService
+		VerifyRequestAndSetContext(c *gin.Context) (bool, error)
+	}
+
 	// RequestDetails use server.ExtractRequestDetailsFromContext to get this out of the request context
 	RequestDetails struct {
 		// Headers the headers sent along with the request
@@ -228,6 +313,8 @@ type (
 		PathParameters map[string]string
 		// RequestPath the string representing requested resources i.e. /api/v1/organizations/:orgID/...
 		RequestPath string
+		// ClientIP the address of the client, derived from the forwarding headers set by trusted proxies, see ClientIPConfiguration
+		ClientIP string
 		// LoggingMetadata
 		LoggingMetadata LoggingMetadata
 	}
@@ -236,10 +323,6 @@ type (
 		Logger   *zap.SugaredLogger
 		Metadata map[string]string
 	}
-
-	requestDetailsKey struct{}
-
-	requestArgumentsKey struct{}
 )
 
 var (
@@ -247,9 +330,14 @@ var (
 	voidType      = reflect.TypeOf(Void{})
 
 	extractPathDetails   = func(details *RequestDetails) any { return details.PathParameters }
-	extractQueryDetails  = func(details *RequestDetails) any { return details.QueryParameters }
 	extractHeaderDetails = func(details *RequestDetails) any { return details.Headers }
 
+	requestDetailsKey = ctxutil.NewKey[RequestDetails]("server.requestDetails")
+	// requestArgumentsKey holds a requestArgs, which is generic over the handler's request and argument types
+	requestArgumentsKey = ctxutil.NewKey[any]("server.requestArguments")
+	// responseHeadersKey the headers of the response being written, see ResponseHeaders
+	responseHeadersKey = ctxutil.NewKey[http.Header]("server.responseHeaders")
+
 	unableToExtractRequestDetails = serr.APIError{
 		Message:        "Unable to extract request details",
 		HttpStatusCode: http.StatusInternalServerError,
@@ -326,121 +414,471 @@ func ConfigureAndStartHttpServer(
 	md metadata.ApplicationMetadata,
 	requestValidator *validator.Validate,
 	is *info.InfoService,
+	optional optionalDependencies,
 ) error {
 	gin.SetMode(gin.ReleaseMode)
 
-	if config.Management.Port == 0 {
-		var controllers []IController
-		controllers = append(controllers, serverControllers.Controllers...)
-		controllers = append(controllers, managementControllers.Controllers...)
-		err := configureServer("http", lc, config.HTTP, config.RequestLogging, config.SPA, config.Profile, as, logger, ms, md, is, true, requestValidator, controllers...)
-		if err != nil {
-			return err
-		}
-		return nil
+	config.RequestSigning.clock = optional.Clock
+	config.ClientIP.geoIP = optional.GeoIPReader
+	config.Deduplication.store = optional.DeduplicationStore
+	config.UsageAnalytics.publisher = optional.UsagePublisher
+	config.UsageAnalytics.clock = optional.Clock
+	config.SecurityPolicy.source = optional.SecurityPolicySource
+	config.SecurityPolicy.client = optional.HTTPClient
+	config.SecurityPolicy.clock = optional.Clock
+	config.Diagnostics.clock = optional.Clock
+	config.RateLimit.store = optional.RateLimitStore
+	if config.RateLimit.store == nil {
+		config.RateLimit.store = NewInMemoryRateLimitStore(optional.Clock)
+	}
+	if config.Deduplication.store == nil {
+		// shared by the http and management servers
+		config.Deduplication.store = NewInMemoryDeduplicationStore(optional.Clock)
+	}
+
+	if config.UsageAnalytics.Enabled {
+		// shared so the management server reports the calls the http server recorded
+		config.UsageAnalytics.deprecations = newDeprecationReport(optional.Clock, config.UsageAnalytics.MaxEntries)
+	}
+
+	if config.Diagnostics.RecordContextKeys {
+		ctxutil.EnableDebug(true)
+	}
+
+	devMode := envutils.IsDev(md.Environment, typesafeconfig.ActiveProfiles())
+	if config.Diagnostics.ExtendedErrors && !devMode {
+		logger.Warnw("Extended error responses are only available in dev environments and have been disabled", "environment", md.Environment)
+		config.Diagnostics.ExtendedErrors = false
+	}
+	if config.Diagnostics.PhaseTimingsHeader && !devMode {
+		logger.Warnw("Phase timing headers are only available in dev environments and have been disabled", "environment", md.Environment)
+		config.Diagnostics.PhaseTimingsHeader = false
+	}
+	if devMode && !config.Diagnostics.DisableRouteListing {
+		config.Diagnostics.routes = &routeListing{}
+	}
+	if config.OpenAPI.Enabled {
+		config.OpenAPI.document = newOpenAPIDocument(config.OpenAPI, md.Name, md.Version)
 	}
 
-	err := configureServer("http", lc, config.HTTP, config.RequestLogging, config.SPA, config.Profile, as, logger, ms, md, is, false, requestValidator, serverControllers.Controllers...)
+	switches, err := newRouteSwitches(config.DisabledRoutes, config.DisabledRouteStatusCode, logger)
 	if err != nil {
 		return err
 	}
-	err = configureServer("management", lc, config.Management, config.RequestLogging, config.SPA, config.Profile, as, logger, ms, md, is, true, requestValidator, managementControllers.Controllers...)
+	gate, err := newFeatureGate(optional.FeatureFlags, config.FeatureDisabledStatusCode, logger)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func configureServer(
-	name string,
-	lc fx.Lifecycle,
-	httpConfig armoryhttp.HTTP,
-	requestLoggingConfig RequestLoggingConfiguration,
-	spaConfig SPAConfiguration,
-	profile ProfileConfiguration,
-	as AuthService,
-	logger *zap.SugaredLogger,
-	ms metrics.MetricsSvc,
-	md metadata.ApplicationMetadata,
-	is *info.InfoService,
-	handlesManagement bool,
-	requestValidator *validator.Validate,
-	controllers ...IController,
-) error {
-	g := gin.New()
+	groups, err := newAPIGroups(config.APIGroups, append(append([]IController{}, serverControllers.Controllers...), managementControllers.Controllers...))
+	if err != nil {
+		return err
+	}
+	if groups != nil {
+		is.AddInfoContributor(groups)
+	}
 
-	// Dist Tracing
-	g.Use(otelgin.Middleware(md.Name))
+	// appended before the servers so controllers are started before and stopped after them
+	registerControllerLifecycles(lc, config.Lifecycle, logger, append(append([]IController{}, serverControllers.Controllers...), managementControllers.Controllers...)...)
 
-	// Metrics
-	g.Use(metrics.GinHTTPMiddleware(ms))
+	management, err := newManagementSecurity(config.ManagementSecurity, &config.Management, as, optional.ManagementAuthService)
+	if err != nil {
+		return err
+	}
 
-	// Optionally enable request logging
-	if requestLoggingConfig.Enabled {
-		g.Use(requestLogger(logger, requestLoggingConfig))
+	deps := serverDependencies{
+		lc:               lc,
+		optional:         optional,
+		as:               as,
+		logger:           logger,
+		ms:               ms,
+		md:               md,
+		is:               is,
+		requestValidator: requestValidator,
+		groups:           groups,
+		switches:         switches,
+		gate:             gate,
 	}
 
-	authNotEnforcedGroup := g.Group(httpConfig.Prefix)
-	authNotEnforcedGroup.Use(ginAttemptAuthMiddleware(as))
+	if config.Management.Port == 0 {
+		var controllers []IController
+		controllers = append(controllers, serverControllers.Controllers...)
+		if !config.ManagementSecurity.Disabled {
+			controllers = append(controllers, managementControllers.Controllers...)
+		}
+		return configureServer(serverOptions{name: "http", config: config, handlesManagement: !config.ManagementSecurity.Disabled}, deps, controllers...)
+	}
 
-	// Allow a web-app to serve a single page application (SPA), such as react, vue, angular, etc.
-	if spaConfig.Enabled {
-		g.Use(spaMiddleware(spaConfig))
+	if err := configureServer(serverOptions{name: "http", config: config}, deps, serverControllers.Controllers...); err != nil {
+		return err
+	}
+	if config.ManagementSecurity.Disabled {
+		logger.Infow("Management routes are disabled, the management server isn't started", "port", config.Management.Port)
+		return nil
 	}
+	managementDeps := deps
+	if optional.ManagementAuthService != nil {
+		managementDeps.as = optional.ManagementAuthService
+	}
+	return configureServer(serverOptions{name: "management", config: config.forManagement(), handlesManagement: true, management: management}, managementDeps, managementControllers.Controllers...)
+}
 
-	authRequiredGroup := g.Group(httpConfig.Prefix)
-	authRequiredGroup.Use(ginEnforceAuthMiddleware(as, logger))
+// forManagement the configuration of a separate management server, which listens on Management and doesn't limit requests,
+// apply security policies or aggregate usage. It still serves the deprecation report of the http server
+func (c Configuration) forManagement() Configuration {
+	c.HTTP = c.Management
+	c.ConcurrencyLimit = ConcurrencyLimitConfiguration{}
+	c.UsageAnalytics = UsageAnalyticsConfiguration{deprecations: c.UsageAnalytics.deprecations}
+	c.SecurityPolicy = SecurityPolicyConfiguration{}
+	c.RateLimit = RateLimitConfiguration{}
+	c.RouteGroups = nil
+	return c
+}
 
-	handlerRegistry, err := newHandlerRegistry(name, logger, requestValidator, controllers)
+func configureServer(options serverOptions, deps serverDependencies, controllers ...IController) error {
+	config := options.config
+	if err := validateRouteGroups(config.RouteGroups); err != nil {
+		return err
+	}
+	grouped, ungrouped, err := partitionControllers(config.RouteGroups, controllers)
 	if err != nil {
 		return err
 	}
-
-	if err = handlerRegistry.registerHandlers(registerHandlersInput{
-		AuthRequiredGroup:    authRequiredGroup,
-		AuthNotEnforcedGroup: authNotEnforcedGroup,
-	}); err != nil {
+	clientIPResolver, err := newClientIPResolver(config.ClientIP)
+	if err != nil {
+		return err
+	}
+	digests, err := newDigests(config.Digest, deps.logger)
+	if err != nil {
+		return err
+	}
+	encryption, err := newPayloadEncryption(context.Background(), config.PayloadEncryption, deps.logger)
+	if err != nil {
+		return err
+	}
+	analytics, err := newUsageAnalytics(deps.lc, config.UsageAnalytics, deps.ms, deps.logger)
+	if err != nil {
+		return err
+	}
+	policies, err := newSecurityPolicies(deps.lc, config.SecurityPolicy, deps.ms, deps.logger)
+	if err != nil {
+		return err
+	}
+	// shared by every route group so that an org has a single bucket whichever group it calls
+	rateLimiter, err := newRateLimiter(options.name, config.RateLimit, deps.ms, deps.logger)
+	if err != nil {
 		return err
 	}
+	// shared by every route group so that a delivery is only handled once whichever group receives it
+	dedup := newDeduplicator(config.Deduplication, deps.ms, deps.logger)
+	coalesce := newCoalescer(config.Coalescing, deps.ms)
+	limits := newHandlerLimits(deps.ms, deps.logger)
+	responseSizeGuard := newResponseSizeGuard(config.ResponseSize, deps.ms, deps.logger)
+	// shared by every route group so that requests are sampled and counted in flight across the server
+	allocations := newAllocationAccounting(options.name, config.Diagnostics.Allocations, config.Diagnostics.clock, deps.ms, deps.logger)
+	var keyDiagnostics *contextKeyDiagnostics
+	if ctxutil.DebugEnabled() {
+		keyDiagnostics = newContextKeyDiagnostics(options.name)
+		deps.is.AddInfoContributor(keyDiagnostics)
+	}
+
+	// newEngine creates the router that serves controllers under prefixes, the default router also serves the SPA and management routes
+	newEngine := func(registryName string, prefixes []string, requestLogging RequestLoggingConfiguration, concurrencyLimit ConcurrencyLimitConfiguration, requireSignature bool, isDefault bool, controllers []IController) (router, error) {
+		g, err := newRouter(config.Router, config.ClientIP.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		limiter, err := newConcurrencyLimiter(registryName, concurrencyLimit, deps.ms, deps.logger)
+		if err != nil {
+			return nil, err
+		}
+		// conflicting routes are skipped and reported together once every route was registered, rather than panicking on the first one
+		routes := newRouteTable(config.Router, deps.logger)
+		g.Use(trackClientDisconnects)
+		g.Use(clientIPResolver.middleware())
+
+		// Dist Tracing
+		g.Use(otelgin.Middleware(deps.md.Name))
+
+		// Metrics
+		g.Use(metrics.GinHTTPMiddleware(deps.ms))
 
-	// the prom handler has a bunch of logic that I don't want to have to port, so we will not make a controller for it.
-	if handlesManagement {
-		authNotEnforcedGroup.GET("/metrics", gin.WrapH(promhttp.Handler()))
+		// Optionally aggregate the usage of routes per org, see UsageAnalyticsConfiguration
+		if analytics != nil {
+			g.Use(analytics.middleware())
+		}
+
+		// Optionally answer CORS preflights for the origins of the security policies, see SecurityPolicyConfiguration
+		if policies != nil {
+			g.Use(policies.corsMiddleware())
+		}
+
+		// Optionally enable request logging
+		if requestLogging.Enabled {
+			g.Use(requestLogger(deps.logger, requestLogging))
+		}
+
+		// Optionally record the context keys set while handling each route
+		if keyDiagnostics != nil {
+			g.Use(keyDiagnostics.middleware())
+		}
+
+		// Optionally add a snapshot of the request to error responses, see DiagnosticsConfiguration.ExtendedErrors
+		if config.Diagnostics.ExtendedErrors {
+			g.Use(extendedErrorsMiddleware)
+		}
+
+		// Optionally record the time handlers spend in each phase of a request, see DiagnosticsConfiguration.PhaseTimings
+		if config.Diagnostics.PhaseTimings {
+			g.Use(phaseTimingsMiddleware(config.Diagnostics.PhaseTimingsHeader, config.Diagnostics.clock))
+		}
+
+		// Optionally estimate the memory allocated by a sample of the requests, see DiagnosticsConfiguration.Allocations
+		if allocations != nil {
+			g.Use(allocations.middleware())
+		}
+
+		// Optionally adapt the requests handled at once to how the server is coping, see ConcurrencyLimitConfiguration
+		if limiter != nil {
+			g.Use(limiter.middleware())
+		}
+
+		// Optionally verify the digests of request bodies and add digests to responses, see DigestConfiguration
+		if digests != nil {
+			g.Use(digests.middleware())
+		}
+
+		for _, prefix := range prefixes {
+			authNotEnforcedGroup := routes.group(g.group(prefix), prefix, "server")
+			authNotEnforcedGroup.Use(ginAttemptAuthMiddleware(deps.as))
+
+			// Allow a web-app to serve a single page application (SPA), such as react, vue, angular, etc.
+			if isDefault && config.SPA.Enabled {
+				g.Use(spaMiddleware(config.SPA))
+			}
+
+			authRequiredGroup := routes.group(g.group(prefix), prefix, "server")
+			authRequiredGroup.Use(ginEnforceAuthMiddleware(deps.as, deps.logger))
+
+			// Optionally require the scopes of ManagementSecurityConfiguration on every route of the management server
+			if options.management != nil {
+				authNotEnforcedGroup.Use(options.management.middleware(deps.logger))
+				authRequiredGroup.Use(options.management.middleware(deps.logger))
+			}
+
+			// Record the actual principal of requests made on behalf of another principal with the proxied authorization header
+			authNotEnforcedGroup.Use(impersonationMiddleware(deps.as, deps.logger))
+			authRequiredGroup.Use(impersonationMiddleware(deps.as, deps.logger))
+
+			// Optionally record the step-up authentication of the principal, see StepUpVerifier
+			if deps.optional.StepUpVerifier != nil {
+				authNotEnforcedGroup.Use(stepUpMiddleware(deps.optional.StepUpVerifier, deps.logger))
+				authRequiredGroup.Use(stepUpMiddleware(deps.optional.StepUpVerifier, deps.logger))
+			}
+
+			// Optionally apply the security policy of the tenant of the principal, see SecurityPolicyConfiguration
+			if policies != nil {
+				authNotEnforcedGroup.Use(policies.tenantMiddleware(deps.logger))
+				authRequiredGroup.Use(policies.tenantMiddleware(deps.logger))
+			}
+
+			// Optionally limit the requests of each org, see RateLimitConfiguration
+			if rateLimiter != nil {
+				authNotEnforcedGroup.Use(rateLimiter.middleware())
+				authRequiredGroup.Use(rateLimiter.middleware())
+			}
+
+			// each prefix gets its own registry as registering wraps the handlers
+			handlerRegistry, err := newHandlerRegistry(registryName, deps.logger, deps.requestValidator, deps.groups, controllers)
+			if err != nil {
+				return nil, err
+			}
+
+			if err = handlerRegistry.registerHandlers(registerHandlersInput{
+				AuthRequiredGroup:    authRequiredGroup,
+				AuthNotEnforcedGroup: authNotEnforcedGroup,
+				SignatureVerifier:    RequestSignatureMiddleware(config.RequestSigning, deps.logger),
+				RequireSignature:     requireSignature,
+				Metrics:              deps.ms,
+				Deduplicator:         dedup,
+				Coalescer:            coalesce,
+				HandlerLimits:        limits,
+				RegionPinning:        newRegionPinning(deps.md.Region, config.Region, deps.logger),
+				Encryption:           encryption,
+				ResponseSize:         responseSizeGuard,
+				DisabledRoutes:       deps.switches,
+				FeatureGate:          deps.gate,
+				RecordNegotiations:   config.Diagnostics.RecordNegotiations,
+			}); err != nil {
+				return nil, err
+			}
+
+			for _, controller := range controllers {
+				if c, ok := controller.(IControllerHTTPHandlers); ok {
+					for _, h := range c.HTTPHandlers() {
+						registerHTTPHandler(h, routesFrom(authRequiredGroup, typeName(controller)), routesFrom(authNotEnforcedGroup, typeName(controller)))
+					}
+				}
+			}
+
+			// the prom handler has a bunch of logic that I don't want to have to port, so we will not make a controller for it.
+			if isDefault && options.handlesManagement {
+				authNotEnforcedGroup.GET("/metrics", gin.WrapH(promhttp.Handler()))
+			}
+
+			// if this is the management server and profile is enabled turn on pprof
+			if isDefault && options.handlesManagement && config.Profile.Enabled {
+				profilePrefix := defaultProfilePrefix
+				if config.Profile.OverridePrefix != "" {
+					profilePrefix = config.Profile.OverridePrefix
+				}
+				registerProfiler(authNotEnforcedGroup, profilePrefix)
+			}
+
+			// in dev environments list every route with an example request, see DiagnosticsConfiguration.DisableRouteListing
+			if isDefault && options.handlesManagement && config.Diagnostics.routes != nil {
+				authNotEnforcedGroup.GET(routeListingPath, config.Diagnostics.routes.handler)
+			}
+			if isDefault && options.handlesManagement && config.OpenAPI.document != nil {
+				authNotEnforcedGroup.GET(openAPIPath, config.OpenAPI.document.handler)
+			}
+
+			// the orgs calling deprecated routes are reported per prefix, as each prefix is a route of its own
+			if analytics != nil {
+				config.UsageAnalytics.deprecations.add(options.name, prefix, handlerRegistry)
+			}
+			if isDefault && options.handlesManagement && config.UsageAnalytics.deprecations != nil {
+				authNotEnforcedGroup.GET(deprecationReportPath, config.UsageAnalytics.deprecations.handler)
+			}
+
+			// only the first prefix of a registry is listed at the /info endpoint, the others serve the same routes
+			if prefix == prefixes[0] {
+				deps.is.AddInfoContributor(handlerRegistry)
+				config.Diagnostics.routes.add(options.name, config.HTTP, prefix, requireSignature, config.Deduplication, handlerRegistry)
+				// the document describes the API of the http server, a separate management server isn't part of it
+				if options.name != "management" {
+					config.OpenAPI.document.add(prefix, handlerRegistry)
+				}
+			}
+		}
+		if err := routes.err(); err != nil {
+			return nil, fmt.Errorf("server %s has %w", registryName, err)
+		}
+		return g, nil
 	}
 
-	// if this is the management server and profile is enabled turn on pprof
-	if handlesManagement && profile.Enabled {
-		if profile.OverridePrefix != "" {
-			pprof.RouteRegister(authNotEnforcedGroup, profile.OverridePrefix)
-		} else {
-			pprof.RouteRegister(authNotEnforcedGroup)
+	g, err := newEngine(options.name, []string{config.HTTP.Prefix}, config.RequestLogging, config.ConcurrencyLimit, false, true, ungrouped)
+	if err != nil {
+		return err
+	}
+
+	var router http.Handler = g
+	if len(config.RouteGroups) > 0 {
+		groupRouter := newRouteGroupRouter(g)
+		for _, group := range config.RouteGroups {
+			requestLogging := config.RequestLogging
+			if group.RequestLogging != nil {
+				requestLogging = *group.RequestLogging
+			}
+			// every group gets its own limit so a degraded group doesn't throttle the others
+			groupConcurrencyLimit := config.ConcurrencyLimit
+			if group.ConcurrencyLimit != nil {
+				groupConcurrencyLimit = *group.ConcurrencyLimit
+			}
+			prefixes := group.Prefixes
+			if len(prefixes) == 0 {
+				prefixes = []string{config.HTTP.Prefix}
+			}
+			engine, err := newEngine(options.name+"/"+group.Name, prefixes, requestLogging, groupConcurrencyLimit, group.RequireSignature, false, grouped[group.Name])
+			if err != nil {
+				return err
+			}
+			groupRouter.add(group.Hosts, prefixes, engine)
 		}
+		router = groupRouter
 	}
 
-	server := armoryhttp.NewServer(armoryhttp.Configuration{HTTP: httpConfig})
+	server := armoryhttp.NewServer(armoryhttp.Configuration{HTTP: config.HTTP})
+	server.OnConnectionStateChange(connectionMetrics(options.name, deps.ms))
+	inFlight := &inFlightRequests{}
+	if deps.optional.ShutdownRecorder != nil {
+		router = inFlight.wrap(router)
+	}
 
-	lc.Append(fx.Hook{
+	deps.lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			logger.Infof("Starting %s server at: h: %s, p: %d, ssl: %t", name, httpConfig.Host, httpConfig.Port, httpConfig.SSL.Enabled)
+			deps.logger.Infow("Starting server", "server", options.name, "host", config.HTTP.Host, "port", config.HTTP.Port, "ssl", config.HTTP.SSL.Enabled, "routeGroups", len(config.RouteGroups))
+			config.Diagnostics.routes.log(options.name, deps.logger)
 			go func() {
-				if err := server.Start(g); err != nil {
+				if err := server.Start(router); err != nil {
 					if !errors.Is(err, http.ErrServerClosed) {
-						logger.Fatalf("Failed to start server: %s", err)
+						deps.logger.Fatalf("Failed to start server: %s", err)
 					}
 				}
 			}()
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			return server.Shutdown(ctx)
+			draining := inFlight.count()
+			err := server.Shutdown(ctx)
+			abandoned := inFlight.count()
+			deps.optional.ShutdownRecorder.Record(options.name+".requestsDrained", draining-abandoned)
+			deps.optional.ShutdownRecorder.Record(options.name+".requestsAbandoned", abandoned)
+			return err
 		},
 	})
 
-	is.AddInfoContributor(handlerRegistry)
-
 	return nil
 }
 
+// inFlightRequests counts the requests being handled, for the shutdown report
+type inFlightRequests struct {
+	n atomic.Int64
+}
+
+func (r *inFlightRequests) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.n.Add(1)
+		defer r.n.Add(-1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *inFlightRequests) count() int64 {
+	return r.n.Load()
+}
+
+// connectionMetrics records the accepted, active and idle connections of the server
+func connectionMetrics(name string, ms metrics.MetricsSvc) armoryhttp.ConnectionListener {
+	tags := map[string]string{"server": name}
+	accepted := ms.CounterWithTags("http.server.connections.accepted", tags)
+	active := ms.GaugeWithTags("http.server.connections.active", tags)
+	idle := ms.GaugeWithTags("http.server.connections.idle", tags)
+	return func(state http.ConnState, stats armoryhttp.ConnectionStats) {
+		if state == http.StateNew {
+			accepted.Inc(1)
+		}
+		active.Update(float64(stats.Active))
+		idle.Update(float64(stats.Idle))
+	}
+}
+
+// registerHTTPHandler routes the prefix and everything below it to the handler
+func registerHTTPHandler(h HTTPHandlerConfig, authRequiredGroup gin.IRoutes, authNotEnforcedGroup gin.IRoutes) {
+	group := authRequiredGroup
+	if h.AuthOptOut {
+		group = authNotEnforcedGroup
+	}
+	prefix := "/" + strings.Trim(strings.TrimSpace(h.Prefix), "/")
+	handler := gin.WrapH(h.Handler)
+	if prefix == "/" {
+		group.Any("/*path", handler)
+		return
+	}
+	group.Any(prefix, handler)
+	group.Any(prefix+"/*path", handler)
+}
+
 func NewNoopAuthService() AuthService {
 	return &noopAuthService{}
 }
@@ -451,7 +889,14 @@ func (a *noopAuthService) VerifyPrincipalAndSetContext(tokenOrRawHeader string,
 
 // AddRequestDetailsToCtx is exposed for testing and allows tests to configure the request details when testing handler functions
 func AddRequestDetailsToCtx(ctx context.Context, details RequestDetails) context.Context {
-	return context.WithValue(ctx, requestDetailsKey{}, details)
+	return requestDetailsKey.WithValue(ctx, details)
+}
+
+// ResponseHeaders the headers of the response to the request of the context, so response processors can add headers such as
+// signatures of the body. Nil outside of handlers
+func ResponseHeaders(ctx context.Context) http.Header {
+	header, _ := responseHeadersKey.Value(ctx)
+	return header
 }
 
 // ExtractPrincipalFromContext retrieves the principal from the context and returns a serr.Error
@@ -469,7 +914,7 @@ type requestDetailsContext interface {
 
 // ExtractRequestDetailsFromContext fetches the server.RequestDetails from the context
 func ExtractRequestDetailsFromContext(ctx requestDetailsContext) (*RequestDetails, serr.Error) {
-	v, ok := ctx.Value(requestDetailsKey{}).(RequestDetails)
+	v, ok := requestDetailsKey.Value(ctx)
 	if !ok {
 		return nil, serr.NewErrorResponseFromApiError(unableToExtractRequestDetails)
 	}
@@ -486,10 +931,10 @@ func ExtractPathParamsFromRequestContext[T any](ctx context.Context) (*T, serr.E
 
 // ExtractQueryParamsFromRequestContext accepts a type param T and attempts to map the HTTP
 // request's query params into T.
-// Query parameters can be a string array, so make sure your target field definition is array type as well.
+// Repeated and comma separated parameters decode into slices, see decodeQuery for times and maps.
 func ExtractQueryParamsFromRequestContext[T any](ctx context.Context) (*T, serr.Error) {
 	var result T
-	err := extract[T](ctx, extractQueryDetails, &result)
+	err := extractQuery(ctx, &result)
 	return &result, err
 }
 
@@ -520,28 +965,42 @@ func ginHOF[REQUEST, RESPONSE any](
 			}
 		}()
 
+		// static headers are set first so that they are sent with error responses as well
+		for header, values := range handler.StaticHeaders {
+			c.Writer.Header()[header] = append([]string(nil), values...)
+		}
+
 		loggingMetadata := extractLoggingMetadata(c.Request.Context())
 		onPrepareRequestContext(c, LoggingMetadata{
-			Logger:   logger.With(ExtractLoggingFields(loggingMetadata)...),
+			Logger:   logger.With(append(ExtractLoggingFields(loggingMetadata), logging.SpanField(c.Request.Context()))...),
 			Metadata: loggingMetadata,
 		})
 
-		if !onAuthorizeRequest(c, handler, logger) {
+		timings := phaseTimingsOf(c.Request.Context())
+		stop := timings.start(phaseAuth)
+		authorized := onAuthorizeRequest(c, handler, logger)
+		stop()
+		if !authorized {
 			return
 		}
 
 		var req *REQUEST
-		if r, ok := onExtractRequestBodyAndParameters(c, extractRequestArgsFn, logger, requestValidator, func(r *REQUEST) bool { return onValidateRequest(c, r, logger, requestValidator, extensions) }); !ok {
+		if r, ok := onExtractRequestBodyAndParameters(c, handler, extractRequestArgsFn, logger, requestValidator, func(r *REQUEST) bool { return onValidateRequest(c, r, logger, requestValidator, extensions) }); !ok {
 			return
 		} else {
 			req = r
 		}
 
+		stop = timings.start(phaseHandler)
 		response, apiError := handlerFn(c.Request.Context(), *req)
+		stop()
 		if apiError != nil {
 			writeAndLogApiErrorThenAbort(c, apiError, logger)
 			return
 		}
+		if abortIfClientDisconnected(c, nil, logger) {
+			return
+		}
 
 		onHandleResponse(c, response, logger, handler)
 	}
@@ -570,7 +1029,10 @@ func onPrepareRequestContext(c *gin.Context, loggingMetadata LoggingMetadata) {
 		RequestPath:     c.Request.URL.Path,
 		LoggingMetadata: loggingMetadata,
 	}
-	c.Request = c.Request.WithContext(AddRequestDetailsToCtx(c.Request.Context(), requestDetails))
+	if ip, ok := clientIPKey.Value(c.Request.Context()); ok {
+		requestDetails.ClientIP = ip
+	}
+	c.Request = c.Request.WithContext(responseHeadersKey.WithValue(AddRequestDetailsToCtx(c.Request.Context(), requestDetails), c.Writer.Header()))
 }
 
 func onAuthorizeRequest(c *gin.Context, handler *handlerDTO, logger *zap.SugaredLogger) bool {
@@ -585,12 +1047,16 @@ func onAuthorizeRequest(c *gin.Context, handler *handlerDTO, logger *zap.Sugared
 
 func onExtractRequestBodyAndParameters[REQUEST any](
 	c *gin.Context,
+	handler *handlerDTO,
 	extractRequestArgsFn extractRequestArgumentsDelegate[REQUEST],
 	logger *zap.SugaredLogger,
 	validator *validator.Validate,
 	validateHandler func(req *REQUEST) bool) (*REQUEST, bool) {
 
-	req, shouldValidateBody, apiError := extractRequestBody[REQUEST](c)
+	timings := phaseTimingsOf(c.Request.Context())
+	stop := timings.start(phaseBodyRead)
+	req, shouldValidateBody, apiError := extractRequestBody[REQUEST](c, handler.Consumes, handler.JSONDecoding)
+	stop()
 	if apiError != nil {
 		writeAndLogApiErrorThenAbort(c, apiError, logger)
 		return nil, false
@@ -600,7 +1066,10 @@ func onExtractRequestBodyAndParameters[REQUEST any](
 		extractRequestArgsFn = extractArgsFromRequest1[REQUEST]
 	}
 
+	// path, query and header arguments are validated as they are extracted
+	stop = timings.start(phaseValidation)
 	args, apiError := extractRequestArgsFn(c.Request.Context(), req, validator)
+	stop()
 	if apiError != nil {
 		writeAndLogApiErrorThenAbort(c, apiError, logger)
 		return nil, false
@@ -609,6 +1078,7 @@ func onExtractRequestBodyAndParameters[REQUEST any](
 	c.Request = c.Request.WithContext(addRequestArgumentsToCtx(c.Request.Context(), args))
 
 	if shouldValidateBody {
+		defer timings.start(phaseValidation)()
 		return req, validateHandler(req)
 	}
 
@@ -636,11 +1106,25 @@ func onValidateRequest[REQUEST any](c *gin.Context, req *REQUEST, logger *zap.Su
 }
 
 func onHandleResponse[RESPONSE any](c *gin.Context, response *Response[RESPONSE], logger *zap.SugaredLogger, handler *handlerDTO) {
+	timings := phaseTimingsOf(c.Request.Context())
 	var r RESPONSE
 	responseType := reflect.TypeOf(r)
+	// long polls that timed out or whose caller left are answered without a body, whatever the response type
+	if response != nil && isBodilessStatus(response.StatusCode) && reflect.ValueOf(&response.Body).Elem().IsZero() {
+		for header, values := range response.Headers {
+			for _, value := range values {
+				c.Header(header, value)
+			}
+		}
+		c.Status(response.StatusCode)
+		timings.beforeWrite(c.Writer.Header())
+		c.Writer.WriteHeaderNow()
+		return
+	}
 	if response == nil || reflect.ValueOf(&response.Body).Elem().IsZero() {
 		if responseType != nil && responseType == voidType {
 			c.Status(http.StatusNoContent)
+			timings.beforeWrite(c.Writer.Header())
 			_, _ = c.Writer.Write([]byte{})
 			return
 		} else {
@@ -653,6 +1137,15 @@ func onHandleResponse[RESPONSE any](c *gin.Context, response *Response[RESPONSE]
 		}
 	}
 
+	// mapping the body is counted as marshalling it
+	stop := timings.start(phaseMarshal)
+	apiError := mapResponseBody(c, handler, reflect.ValueOf(&response.Body).Elem())
+	stop()
+	if apiError != nil {
+		writeAndLogApiErrorThenAbort(c, apiError, logger)
+		return
+	}
+
 	statusCode := http.StatusOK
 	if handler.StatusCode != 0 {
 		statusCode = handler.StatusCode
@@ -662,13 +1155,30 @@ func onHandleResponse[RESPONSE any](c *gin.Context, response *Response[RESPONSE]
 	}
 	c.Status(statusCode)
 
+	notModified := false
+	if statusCode >= 200 && statusCode < 300 {
+		notModified = applyCachePolicy(c.Writer.Header(), c.Request, handler, response.Body)
+	}
+
 	for header, values := range response.Headers {
 		for _, value := range values {
 			c.Header(header, value)
 		}
 	}
 
-	apiError := writeResponse(c.Request.Context(), handler.Produces, response.Body, c.Writer, handler.ResponseProcessors)
+	if notModified {
+		c.Status(http.StatusNotModified)
+		timings.beforeWrite(c.Writer.Header())
+		c.Writer.WriteHeaderNow()
+		return
+	}
+
+	if handler.Produces == EventStreamMediaType {
+		writeEventStream(c, response.Body, logger)
+		return
+	}
+
+	apiError = writeResponse(c.Request.Context(), handler.Produces, response.Body, c.Writer, handler.ResponseProcessors)
 	if apiError != nil {
 		writeAndLogApiErrorThenAbort(c, apiError, logger)
 		return
@@ -693,11 +1203,12 @@ func authorizeRequest(ctx context.Context, h *handlerDTO) serr.Error {
 }
 
 func addRequestArgumentsToCtx(ctx context.Context, arguments interface{}) context.Context {
-	return context.WithValue(ctx, requestArgumentsKey{}, arguments)
+	return requestArgumentsKey.WithValue(ctx, arguments)
 }
 
 func referenceArguments[REQUEST any, ARG1 HandlerArgument, ARG2 HandlerArgument, ARG3 HandlerArgument](ctx context.Context) requestArgs[REQUEST, ARG1, ARG2, ARG3] {
-	return ctx.Value(requestArgumentsKey{}).(requestArgs[REQUEST, ARG1, ARG2, ARG3])
+	v, _ := requestArgumentsKey.Value(ctx)
+	return v.(requestArgs[REQUEST, ARG1, ARG2, ARG3])
 }
 
 func validateRequestBody[T any](req T, v *validator.Validate) serr.Error {
@@ -708,7 +1219,7 @@ func validateRequestBody[T any](req T, v *validator.Validate) serr.Error {
 			var errs []serr.APIError
 			for _, err := range vErr {
 				errs = append(errs, serr.APIError{
-					Message: err.Error(),
+					Message: validation.Message(v, err),
 					Metadata: map[string]any{
 						"key":   err.Namespace(),
 						"field": err.Field(),
@@ -733,10 +1244,15 @@ func validateRequestBody[T any](req T, v *validator.Validate) serr.Error {
 
 func writeResponse(ctx context.Context, contentType string, body any, w gin.ResponseWriter, processors []ResponseProcessorFn) serr.Error {
 	w.Header().Set("Content-Type", contentType)
+	timings := phaseTimingsOf(ctx)
 	switch contentType {
 	case "text/plain", "application/yaml":
+		timings.beforeWrite(w.Header())
+		defer timings.start(phaseWrite)()
 		return writeStringResponse(ctx, contentType, body, w, processors)
 	case "application/octet-stream":
+		timings.beforeWrite(w.Header())
+		defer timings.start(phaseWrite)()
 		return writeOctetStream(contentType, body, w)
 	default:
 		return writeJsonResponse(ctx, body, w, processors)
@@ -744,8 +1260,11 @@ func writeResponse(ctx context.Context, contentType string, body any, w gin.Resp
 }
 
 func writeJsonResponse(ctx context.Context, body any, w gin.ResponseWriter, processors []ResponseProcessorFn) serr.Error {
+	timings := phaseTimingsOf(ctx)
+	stop := timings.start(phaseMarshal)
 	bytes, err := json.Marshal(body)
 	if err != nil {
+		stop()
 		return serr.NewErrorResponseFromApiError(serr.APIError{
 			Message:        "Failed to marshal response",
 			HttpStatusCode: http.StatusInternalServerError,
@@ -759,8 +1278,13 @@ func writeJsonResponse(ctx context.Context, body any, w gin.ResponseWriter, proc
 		}
 		bytes = b
 	}
+	stop()
 
-	if _, err = w.Write(bytes); err != nil {
+	timings.beforeWrite(w.Header())
+	stop = timings.start(phaseWrite)
+	_, err = w.Write(bytes)
+	stop()
+	if err != nil {
 		return serr.NewErrorResponseFromApiError(serr.APIError{
 			Message:        "Failed to write response",
 			HttpStatusCode: http.StatusInternalServerError,
@@ -853,6 +1377,15 @@ func extract[T any](ctx context.Context, pick func(details *RequestDetails) any,
 	return nil
 }
 
+// extractQuery decodes the query parameters into target, see decodeQuery
+func extractQuery[T any](ctx context.Context, target *T) serr.Error {
+	d, err := ExtractRequestDetailsFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return decodeQuery(d.QueryParameters, target)
+}
+
 func extractPathParameters(c *gin.Context) map[string]string {
 	var pathParameters = make(map[string]string)
 	for _, p := range c.Params {
@@ -861,7 +1394,8 @@ func extractPathParameters(c *gin.Context) map[string]string {
 	return pathParameters
 }
 
-func extractRequestBody[REQUEST any](c *gin.Context) (*REQUEST, bool, serr.Error) {
+// extractRequestBody unmarshals the body of the request, YAML when the handler consumes YAML and JSON otherwise
+func extractRequestBody[REQUEST any](c *gin.Context, consumes string, decoding *JSONDecoding) (*REQUEST, bool, serr.Error) {
 	var req REQUEST
 	shouldProcessBody := false
 	isArrayType := false
@@ -891,9 +1425,13 @@ func extractRequestBody[REQUEST any](c *gin.Context) (*REQUEST, bool, serr.Error
 		}
 		if requestType == byteArrayType {
 			req = *(*REQUEST)(unsafe.Pointer(&b))
+		} else if isYAMLMediaType(consumes) {
+			if apiErr := unmarshalYAML(b, &req); apiErr != nil {
+				return nil, shouldProcessBody, apiErr
+			}
 		} else {
-			if err := json.Unmarshal(b, &req); err != nil {
-				return nil, shouldProcessBody, handleUnmarshalError(b, err)
+			if apiErr := unmarshalJSON(b, &req, decoding); apiErr != nil {
+				return nil, shouldProcessBody, apiErr
 			}
 		}
 	}
@@ -948,13 +1486,13 @@ func handleUnmarshalError(bytes []byte, err error) serr.Error {
 // writeAndLogApiErrorThenAbort a helper function that will take a serr.Error and ensure that it is logged and a properly
 // formatted response is returned to the requester
 func writeAndLogApiErrorThenAbort(c *gin.Context, apiErr serr.Error, log *zap.SugaredLogger) {
-	errorID := uuid.NewString()
-	statusCode := http.StatusInternalServerError
-	if c := apiErr.Errors()[0].HttpStatusCode; c != 0 {
-		statusCode = c
+	if abortIfClientDisconnected(c, apiErr, log) {
+		return
 	}
+	errorID := uuid.NewString()
+	statusCode := serr.StatusCode(apiErr)
 
-	writeErrorResponse(c.Writer, apiErr, statusCode, errorID, log)
+	writeErrorResponse(c.Writer, apiErr, statusCode, errorID, snapshotRequest(c, apiErr), includesCauseChain(c.Request), log)
 	LogAPIError(c.Request, errorID, apiErr, statusCode, log)
 	c.Abort()
 }
@@ -968,7 +1506,7 @@ func LogAPIError(
 ) {
 	fields := getBaseFields(request, statusCode)
 
-	fields = append(fields, "errorID", errorID)
+	fields = append(fields, "errorID", errorID, logging.SpanField(request.Context()))
 
 	// If enabled add the stacktrace to the logging details
 	b := apiErr.StackTraceLoggingBehavior()
@@ -990,6 +1528,9 @@ func LogAPIError(
 	if apiErr.Cause() != nil {
 		fields = append(fields, "error", apiErr.Cause())
 	}
+	if causes := apiErr.CauseChain(); len(causes) > 0 {
+		fields = append(fields, "causes", causes)
+	}
 
 	// Add any extra details to the logging fields
 	for _, extraDetails := range apiErr.ExtraDetailsForLogging() {
@@ -1036,12 +1577,22 @@ func getBaseFields(
 	// Add the full request uri, which will include query params to logging fields
 	fields = append(fields, "uri", request.RequestURI)
 
+	if ip, ok := clientIPKey.Value(request.Context()); ok {
+		fields = append(fields, "clientIp", ip)
+	}
+
 	fields = append(fields, ExtractLoggingFields(extractLoggingMetadata(request.Context()))...)
 
 	return fields
 }
 
-func writeErrorResponse(writer gin.ResponseWriter, apiErr serr.Error, statusCode int, errorID string, log *zap.SugaredLogger) {
+// includesCauseChain whether error responses to the request include the cause chain of the error, only principals with the debug scope get it
+func includesCauseChain(request *http.Request) bool {
+	principal, err := iam.ExtractPrincipalFromContext(request.Context())
+	return err == nil && principal.HasScope(scopes.ScopeDebug)
+}
+
+func writeErrorResponse(writer gin.ResponseWriter, apiErr serr.Error, statusCode int, errorID string, snapshot *requestSnapshot, includeCauses bool, log *zap.SugaredLogger) {
 	writer.Header().Set("content-type", "application/json")
 
 	for _, header := range apiErr.ExtraResponseHeaders() {
@@ -1049,7 +1600,15 @@ func writeErrorResponse(writer gin.ResponseWriter, apiErr serr.Error, statusCode
 	}
 
 	writer.WriteHeader(statusCode)
-	err := json.NewEncoder(writer).Encode(apiErr.ToErrorResponseContract(errorID))
+	contract := apiErr.ToErrorResponseContract(errorID)
+	if includeCauses {
+		contract.Causes = apiErr.CauseChain()
+	}
+	var body any = contract
+	if snapshot != nil {
+		body = extendedErrorResponse{ResponseContract: contract, Debug: snapshot}
+	}
+	err := json.NewEncoder(writer).Encode(body)
 	if err != nil {
 		log.Errorf("Failed to write error response: %s", err)
 	}
@@ -1106,6 +1665,14 @@ func extractLoggingMetadata(ctx context.Context) map[string]string {
 		fields["principal-name"] = principal.Name
 		fields["principal-type"] = string(principal.Type)
 	}
+	if iam.IsImpersonated(ctx) {
+		fields["impersonated"] = "true"
+		if actual, _ := iam.ExtractActualPrincipalFromContext(ctx); actual != nil {
+			fields["actual-tenant"] = actual.Tenant()
+			fields["actual-principal-name"] = actual.Name
+			fields["actual-principal-type"] = string(actual.Type)
+		}
+	}
 
 	return fields
 }
@@ -1135,7 +1702,11 @@ func extractHandlerArgumentFromContextInternal[CTX HandlerArgument](c context.Co
 		return &arg, err
 
 	case QueryContextSource:
-		err := extract(c, extractQueryDetails, &arg)
+		if nested, ok := any(arg).(NestedQueryArgument); ok {
+			err := extractNestedQuery(c, nested.QuerySyntax(), &arg)
+			return &arg, err
+		}
+		err := extractQuery(c, &arg)
 		return &arg, err
 
 	case HeaderContextSource:
@@ -1147,6 +1718,14 @@ func extractHandlerArgumentFromContextInternal[CTX HandlerArgument](c context.Co
 		var retValue interface{} = &ArmoryPrincipalArgument{principal}
 		return retValue.(*CTX), err
 
+	case clientContextSource:
+		client, ok := ExtractClientFromContext(c)
+		if !ok {
+			return nil, serr.NewErrorResponseFromApiError(unableToExtractRequestDetails)
+		}
+		var retValue interface{} = client
+		return retValue.(*CTX), nil
+
 	case voidArgumentSource:
 		var retValue interface{} = &voidArgument{}
 		return retValue.(*CTX), nil
@@ -1156,21 +1735,7 @@ func extractHandlerArgumentFromContextInternal[CTX HandlerArgument](c context.Co
 }
 
 func aggregateErrors(items ...serr.Error) serr.Error {
-	if len(items) == 0 {
-		return nil
-	}
-
-	apiErrors := lo.FlatMap(items, func(e serr.Error, _ int) []serr.APIError {
-		if e != nil {
-			return e.Errors()
-		}
-		return []serr.APIError{}
-	})
-
-	if len(apiErrors) == 0 {
-		return nil
-	}
-	return serr.NewErrorResponseFromApiErrors(apiErrors)
+	return serr.Join(items...)
 }
 
 func extractArgsFromRequest1[REQUEST any](c context.Context, r *REQUEST, _ *validator.Validate) (interface{}, serr.Error) {
@@ -0,0 +1,38 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// StepUpVerifier records the step-up authentication a request proves onto the principal of its context, see iam.WithStepUp.
+// Provide one, such as the stepup.Verifier, for handlers to require a recent step-up with their AuthZValidatorExtended
+type StepUpVerifier interface {
+	// VerifyStepUp records the step-up of the request, if any. Requests without one aren't an error, handlers that require it reject them
+	VerifyStepUp(c *gin.Context) error
+}
+
+// stepUpMiddleware must be registered after the middleware that authenticates the principal of the request
+func stepUpMiddleware(verifier StepUpVerifier, log *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := verifier.VerifyStepUp(c); err != nil {
+			log.Debugw("Failed to verify the step-up authentication of the request", "error", err)
+		}
+	}
+}
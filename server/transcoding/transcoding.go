@@ -0,0 +1,238 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transcoding serves the REST surface of protobuf defined services from the go-commons server, with handlers
+// generated by protoc-gen-grpc-gateway from the google.api.http annotations of the services. Requests go through the
+// auth and metrics middleware of the server, and errors are returned in the serr.ResponseContract.
+//
+// The gateway calls the gRPC implementation in process, so one implementation serves both surfaces:
+//
+//	fx.New(
+//		server.Module,
+//		transcoding.Module,
+//		transcoding.Provide(transcoding.Service{
+//			Prefix: "/v1/deployments",
+//			Register: func(ctx context.Context, mux *runtime.ServeMux) error {
+//				return deploymentsv1.RegisterDeploymentsHandlerServer(ctx, mux, deploymentsServer)
+//			},
+//		}),
+//	)
+//
+// The implementation gets the principal of the caller from its context with iam.ExtractPrincipalFromContext.
+package transcoding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// GroupName the fx value group of the services that are transcoded
+	GroupName = "transcodedServices"
+
+	requestsMetric  = "http.server.transcoded.requests"
+	unmatchedMethod = "unmatched"
+	internalError   = "The server was not able to handle the request"
+)
+
+// callKey the call of the request, set before the request is handed to the gateway
+var callKey = ctxutil.NewKey[*call]("transcoding.call")
+
+type (
+	// RegisterFunc registers the generated handlers of a service with the mux, i.e. a RegisterXxxHandlerServer function
+	RegisterFunc func(ctx context.Context, mux *runtime.ServeMux) error
+
+	// Service a protobuf defined service whose HTTP rules are served under Prefix
+	Service struct {
+		// Prefix the path prefix shared by the HTTP rules of the service, requests below it are handed to the gateway
+		Prefix string
+		// AuthOptOut Set this to true if the service should skip AuthN
+		AuthOptOut bool
+		Register   RegisterFunc
+	}
+
+	Parameters struct {
+		fx.In
+		Log      *zap.SugaredLogger
+		Metrics  metrics.MetricsSvc
+		Services []Service `group:"transcodedServices"`
+		// MuxOptions additional options of the gateway, i.e. marshalers or header matchers
+		MuxOptions []runtime.ServeMuxOption `optional:"true"`
+	}
+
+	// Gateway a server controller that serves the transcoded services
+	Gateway struct {
+		mux      *runtime.ServeMux
+		services []Service
+		log      *zap.SugaredLogger
+		metrics  metrics.MetricsSvc
+	}
+
+	// call records the gRPC method a request was routed to, the gateway only knows it once the request is matched
+	call struct {
+		method string
+	}
+
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// Module provides the Gateway as a server controller
+var Module = fx.Module("transcoding",
+	fx.Provide(func(p Parameters) (server.Controller, error) {
+		g, err := New(context.Background(), p)
+		if err != nil {
+			return server.Controller{}, err
+		}
+		return server.Controller{Controller: g}, nil
+	}),
+)
+
+// Provide adds services to the fx group
+func Provide(services ...Service) fx.Option {
+	options := make([]fx.Option, 0, len(services))
+	for _, service := range services {
+		service := service
+		options = append(options, fx.Provide(fx.Annotate(
+			func() Service { return service },
+			fx.ResultTags(`group:"`+GroupName+`"`),
+		)))
+	}
+	return fx.Options(options...)
+}
+
+// New creates a Gateway and registers the handlers of the services
+func New(ctx context.Context, p Parameters) (*Gateway, error) {
+	g := &Gateway{services: p.Services, log: p.Log, metrics: p.Metrics}
+	options := []runtime.ServeMuxOption{
+		runtime.WithErrorHandler(g.handleError),
+		runtime.WithMetadata(recordMethod),
+	}
+	g.mux = runtime.NewServeMux(append(options, p.MuxOptions...)...)
+
+	for _, service := range p.Services {
+		if strings.Trim(service.Prefix, "/") == "" {
+			return nil, fmt.Errorf("transcoding: a service must have a prefix")
+		}
+		if service.Register == nil {
+			return nil, fmt.Errorf("transcoding: service %s has no register function", service.Prefix)
+		}
+		if err := service.Register(ctx, g.mux); err != nil {
+			return nil, fmt.Errorf("transcoding: failed to register service %s: %w", service.Prefix, err)
+		}
+	}
+	return g, nil
+}
+
+// Handlers implements server.IController, the services are served through HTTPHandlers
+func (g *Gateway) Handlers() []server.Handler {
+	return nil
+}
+
+// HTTPHandlers implements server.IControllerHTTPHandlers
+func (g *Gateway) HTTPHandlers() []server.HTTPHandlerConfig {
+	handlers := make([]server.HTTPHandlerConfig, 0, len(g.services))
+	for _, service := range g.services {
+		handlers = append(handlers, server.HTTPHandlerConfig{
+			Prefix:     service.Prefix,
+			Handler:    g,
+			AuthOptOut: service.AuthOptOut,
+		})
+	}
+	return handlers
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := &call{method: unmatchedMethod}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+
+	g.mux.ServeHTTP(recorder, r.WithContext(callKey.WithValue(r.Context(), c)))
+
+	g.metrics.TimerWithTags(requestsMetric, map[string]string{
+		"method": c.method,
+		"status": strconv.Itoa(recorder.status),
+	}).Record(time.Since(start))
+}
+
+// handleError writes the gRPC status of err as a serr.ResponseContract
+func (g *Gateway) handleError(ctx context.Context, _ *runtime.ServeMux, _ runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	statusCode := runtime.HTTPStatusFromCode(st.Code())
+
+	message := st.Message()
+	switch st.Code() {
+	case codes.Unknown, codes.Internal, codes.DataLoss:
+		// the messages of unexpected errors are only logged
+		message = internalError
+	}
+	apiErr := serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        message,
+		Metadata:       map[string]any{"grpcCode": st.Code().String()},
+		HttpStatusCode: statusCode,
+	},
+		serr.WithCause(err),
+		serr.WithErrorMessage(st.Message()),
+	)
+
+	errorID := uuid.NewString()
+	w.Header().Del("Trailer")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(apiErr.ToErrorResponseContract(errorID)); err != nil {
+		g.log.Errorf("Failed to write error response: %s", err)
+	}
+	server.LogAPIError(r.WithContext(ctx), errorID, apiErr, statusCode, g.log)
+}
+
+// recordMethod is called by the gateway once a request is matched, it records the gRPC method without adding metadata
+func recordMethod(ctx context.Context, r *http.Request) metadata.MD {
+	if c, ok := callKey.Value(r.Context()); ok {
+		if method, ok := runtime.RPCMethod(ctx); ok {
+			c.method = method
+		}
+	}
+	return nil
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
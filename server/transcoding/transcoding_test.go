@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transcoding
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/golang/mock/gomock"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// registerDeployments registers a handler the way generated RegisterXxxHandlerServer functions do
+func registerDeployments(_ context.Context, mux *runtime.ServeMux) error {
+	return mux.HandlePath(http.MethodGet, "/v1/deployments/{id}", func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		ctx, err := runtime.AnnotateIncomingContext(r.Context(), mux, r, "/deployments.v1.Deployments/GetDeployment")
+		if err != nil {
+			runtime.HTTPError(ctx, mux, &runtime.JSONPb{}, w, r, err)
+			return
+		}
+		switch params["id"] {
+		case "missing":
+			runtime.HTTPError(ctx, mux, &runtime.JSONPb{}, w, r, status.Error(codes.NotFound, "deployment not found"))
+		case "broken":
+			runtime.HTTPError(ctx, mux, &runtime.JSONPb{}, w, r, status.Error(codes.Internal, "connection to db-1 refused"))
+		default:
+			_, _ = w.Write([]byte(`{"id":"` + params["id"] + `"}`))
+		}
+	})
+}
+
+func TestGateway(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().TimerWithTags(requestsMetric, gomock.Any()).DoAndReturn(func(name string, tags map[string]string) tally.Timer {
+		return scope.Tagged(tags).Timer(name)
+	}).AnyTimes()
+
+	g, err := New(context.Background(), Parameters{
+		Log:      zap.NewNop().Sugar(),
+		Metrics:  ms,
+		Services: []Service{{Prefix: "/v1/deployments", Register: registerDeployments}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, g.HTTPHandlers(), 1)
+	assert.Equal(t, "/v1/deployments", g.HTTPHandlers()[0].Prefix)
+
+	serve := func(path string) (*httptest.ResponseRecorder, serr.ResponseContract) {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var contract serr.ResponseContract
+		if w.Code != http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &contract))
+		}
+		return w, contract
+	}
+
+	w, _ := serve("/v1/deployments/dep-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"dep-1"}`, w.Body.String())
+
+	w, contract := serve("/v1/deployments/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotEmpty(t, contract.ErrorId)
+	assert.Equal(t, "deployment not found", contract.Errors[0].Message)
+	assert.Equal(t, "NotFound", contract.Errors[0].Metadata["grpcCode"])
+
+	w, contract = serve("/v1/deployments/broken")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, internalError, contract.Errors[0].Message, "the messages of internal errors are not returned")
+
+	w, _ = serve("/v1/deployments/dep-1/history")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	timers := map[string]int{}
+	for _, timer := range scope.Snapshot().Timers() {
+		timers[timer.Tags()["method"]+" "+timer.Tags()["status"]] += len(timer.Values())
+	}
+	assert.Equal(t, map[string]int{
+		"/deployments.v1.Deployments/GetDeployment 200": 1,
+		"/deployments.v1.Deployments/GetDeployment 404": 1,
+		"/deployments.v1.Deployments/GetDeployment 500": 1,
+		"unmatched 404": 1,
+	}, timers)
+}
+
+func TestNewRejectsInvalidServices(t *testing.T) {
+	_, err := New(context.Background(), Parameters{Services: []Service{{Register: registerDeployments}}})
+	assert.EqualError(t, err, "transcoding: a service must have a prefix")
+
+	_, err = New(context.Background(), Parameters{Services: []Service{{Prefix: "/v1/deployments"}}})
+	assert.EqualError(t, err, "transcoding: service /v1/deployments has no register function")
+}
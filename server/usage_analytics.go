@@ -0,0 +1,283 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// UsageSinkLog logs a line per route, org and principal of every summary
+	UsageSinkLog = "log"
+	// UsageSinkMetrics increments the http.server.routeUsage counter by route, org and outcome
+	UsageSinkMetrics = "metrics"
+	// UsageSinkPublisher hands every summary to the UsagePublisher provided to the server, such as an event bus producer
+	UsageSinkPublisher = "publisher"
+
+	// usageOverflowOrg the org the usage of new keys is counted under once MaxEntries is reached
+	usageOverflowOrg = "_other"
+
+	routeUsageMetric             = "http.server.routeUsage"
+	defaultUsageFlushInterval    = time.Minute
+	defaultUsageAnalyticsEntries = 10_000
+)
+
+type (
+	// UsageAnalyticsConfiguration aggregates the requests of each route per org, and optionally principal, and flushes summaries of them
+	// to the configured sinks every FlushInterval. It only applies to the http server. The orgs calling deprecated handlers, and when
+	// they last did, are also reported at the /deprecations management endpoint, see HandlerConfig.Deprecation
+	UsageAnalyticsConfiguration struct {
+		Enabled bool
+		// FlushInterval how often summaries are flushed, defaults to 1m
+		FlushInterval time.Duration
+		// Sinks any of log, metrics and publisher, defaults to log
+		Sinks []string
+		// IncludePrincipals aggregates by principal within orgs, not only by org
+		IncludePrincipals bool
+		// MaxEntries the max route, org and principal combinations per summary, usage beyond it is counted under the _other org.
+		// Defaults to 10000
+		MaxEntries int
+		// publisher the UsagePublisher provided to the server
+		publisher UsagePublisher
+		clock     clock.Clock
+		// deprecations the calls to deprecated handlers, reported at the /deprecations management endpoint
+		deprecations *deprecationReport
+	}
+
+	// UsagePublisher publishes usage summaries, provide one to the server to use the publisher sink
+	UsagePublisher interface {
+		PublishUsage(ctx context.Context, summary UsageSummary) error
+	}
+
+	// UsageSummary the requests to the routes of the server between Start and End
+	UsageSummary struct {
+		Start  time.Time    `json:"start"`
+		End    time.Time    `json:"end"`
+		Routes []RouteUsage `json:"routes"`
+	}
+
+	// RouteUsage the requests an org, or a principal of the org, made to a route. Requests without a principal have no org
+	RouteUsage struct {
+		Method        string `json:"method"`
+		Route         string `json:"route"`
+		Org           string `json:"org,omitempty"`
+		PrincipalName string `json:"principalName,omitempty"`
+		PrincipalType string `json:"principalType,omitempty"`
+		// Deprecated whether the route is of a deprecated handler, see HandlerConfig.Deprecation
+		Deprecated   bool  `json:"deprecated,omitempty"`
+		Requests     int64 `json:"requests"`
+		ClientErrors int64 `json:"clientErrors"`
+		ServerErrors int64 `json:"serverErrors"`
+		// TotalLatency the sum of the latencies of the requests, divide by Requests for the mean
+		TotalLatency time.Duration `json:"totalLatency"`
+	}
+
+	usageKey struct {
+		method, route, org, principalName, principalType string
+	}
+
+	// usageAnalytics the usage aggregated since the last flush
+	usageAnalytics struct {
+		config  UsageAnalyticsConfiguration
+		sinks   map[string]bool
+		log     *zap.SugaredLogger
+		metrics metrics.MetricsSvc
+		clock   clock.Clock
+
+		mu    sync.Mutex
+		start time.Time
+		usage map[usageKey]*RouteUsage
+	}
+)
+
+// newUsageAnalytics creates the analytics of the configuration and flushes them until the application stops, nil when disabled
+func newUsageAnalytics(lc fx.Lifecycle, config UsageAnalyticsConfiguration, ms metrics.MetricsSvc, log *zap.SugaredLogger) (*usageAnalytics, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultUsageFlushInterval
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultUsageAnalyticsEntries
+	}
+	if len(config.Sinks) == 0 {
+		config.Sinks = []string{UsageSinkLog}
+	}
+	sinks := map[string]bool{}
+	for _, sink := range config.Sinks {
+		switch sink {
+		case UsageSinkLog, UsageSinkMetrics:
+		case UsageSinkPublisher:
+			if config.publisher == nil {
+				return nil, fmt.Errorf("usage analytics sink %q requires a UsagePublisher", sink)
+			}
+		default:
+			return nil, fmt.Errorf("unknown usage analytics sink %q, expected one of log, metrics or publisher", sink)
+		}
+		sinks[sink] = true
+	}
+
+	c := clock.OrDefault(config.clock)
+	a := &usageAnalytics{config: config, sinks: sinks, log: log, metrics: ms, clock: c, start: c.Now(), usage: map[usageKey]*RouteUsage{}}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				ticker := c.NewTicker(config.FlushInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C():
+						a.flush(context.Background())
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(stop)
+			<-done
+			a.flush(ctx)
+			return nil
+		},
+	})
+	return a, nil
+}
+
+func (a *usageAnalytics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := a.clock.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+		key := usageKey{method: c.Request.Method, route: route}
+		// the principal is only in the context of the request once the auth middleware of the route ran
+		if principal, err := iam.ExtractPrincipalFromContext(c.Request.Context()); err == nil && principal != nil {
+			key.org = principal.OrgId
+			if a.config.IncludePrincipals {
+				key.principalName, key.principalType = principal.Name, string(principal.Type)
+			}
+		}
+		a.record(key, c.Writer.Status(), a.clock.Since(start))
+		a.config.deprecations.record(key.method, key.route, key.org)
+	}
+}
+
+func (a *usageAnalytics) record(key usageKey, status int, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage, ok := a.usage[key]
+	if !ok {
+		if len(a.usage) >= a.config.MaxEntries {
+			key = usageKey{method: key.method, route: key.route, org: usageOverflowOrg}
+			usage, ok = a.usage[key]
+		}
+		if !ok {
+			usage = &RouteUsage{Method: key.method, Route: key.route, Org: key.org, PrincipalName: key.principalName, PrincipalType: key.principalType}
+			usage.Deprecated = a.config.deprecations.isDeprecated(key.method, key.route)
+			a.usage[key] = usage
+		}
+	}
+	usage.Requests++
+	usage.TotalLatency += latency
+	switch {
+	case status >= 500:
+		usage.ServerErrors++
+	case status >= 400:
+		usage.ClientErrors++
+	}
+}
+
+// flush hands the usage since the last flush to the sinks, nothing is flushed when there was none
+func (a *usageAnalytics) flush(ctx context.Context) {
+	a.mu.Lock()
+	summary := UsageSummary{Start: a.start, End: a.clock.Now()}
+	for _, usage := range a.usage {
+		summary.Routes = append(summary.Routes, *usage)
+	}
+	a.start, a.usage = summary.End, map[usageKey]*RouteUsage{}
+	a.mu.Unlock()
+
+	if len(summary.Routes) == 0 {
+		return
+	}
+	sort.Slice(summary.Routes, func(i, j int) bool {
+		if summary.Routes[i].Requests != summary.Routes[j].Requests {
+			return summary.Routes[i].Requests > summary.Routes[j].Requests
+		}
+		return summary.Routes[i].Route < summary.Routes[j].Route
+	})
+
+	if a.sinks[UsageSinkLog] {
+		for _, usage := range summary.Routes {
+			a.log.Infow("Route usage",
+				"method", usage.Method,
+				"route", usage.Route,
+				"org", usage.Org,
+				"principalName", usage.PrincipalName,
+				"principalType", usage.PrincipalType,
+				"deprecated", usage.Deprecated,
+				"requests", usage.Requests,
+				"clientErrors", usage.ClientErrors,
+				"serverErrors", usage.ServerErrors,
+				"meanLatency", usage.TotalLatency/time.Duration(usage.Requests),
+				"since", summary.Start,
+			)
+		}
+	}
+	if a.sinks[UsageSinkMetrics] && a.metrics != nil {
+		for _, usage := range summary.Routes {
+			for outcome, n := range map[string]int64{
+				"success":     usage.Requests - usage.ClientErrors - usage.ServerErrors,
+				"clientError": usage.ClientErrors,
+				"serverError": usage.ServerErrors,
+			} {
+				if n > 0 {
+					a.metrics.CounterWithTags(routeUsageMetric, map[string]string{
+						"method":  usage.Method,
+						"uri":     usage.Route,
+						"org":     usage.Org,
+						"outcome": outcome,
+					}).Inc(n)
+				}
+			}
+		}
+	}
+	if a.sinks[UsageSinkPublisher] {
+		if err := a.config.publisher.PublishUsage(ctx, summary); err != nil {
+			a.log.Warnw("Failed to publish route usage", "error", err, "routes", len(summary.Routes))
+		}
+	}
+}
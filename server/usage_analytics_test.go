@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type fakeUsagePublisher struct {
+	summaries []UsageSummary
+}
+
+func (p *fakeUsagePublisher) PublishUsage(_ context.Context, summary UsageSummary) error {
+	p.summaries = append(p.summaries, summary)
+	return nil
+}
+
+func TestUsageAnalytics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	core, logs := observer.New(zapcore.InfoLevel)
+	scope := tally.NewTestScope("", nil)
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().CounterWithTags(routeUsageMetric, gomock.Any()).AnyTimes().DoAndReturn(func(name string, tags map[string]string) tally.Counter {
+		return scope.Tagged(tags).Counter(name)
+	})
+	publisher := &fakeUsagePublisher{}
+
+	lc := fxtest.NewLifecycle(t)
+	analytics, err := newUsageAnalytics(lc, UsageAnalyticsConfiguration{
+		Enabled:           true,
+		Sinks:             []string{UsageSinkLog, UsageSinkMetrics, UsageSinkPublisher},
+		IncludePrincipals: true,
+		MaxEntries:        3,
+		publisher:         publisher,
+		clock:             fake,
+	}, ms, zap.New(core).Sugar())
+	require.NoError(t, err)
+
+	g := gin.New()
+	g.Use(analytics.middleware())
+	authenticated := func(c *gin.Context) {
+		if org := c.GetHeader("org"); org != "" {
+			c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: org, Name: c.GetHeader("name"), Type: iam.User}))
+		}
+	}
+	g.GET("/deployments/:id", authenticated, func(c *gin.Context) {
+		fake.Advance(10 * time.Millisecond)
+		if c.Param("id") == "missing" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	serve := func(path string, org string, name string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("org", org)
+		req.Header.Set("name", name)
+		g.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("/deployments/1", "org-1", "alice")
+	serve("/deployments/missing", "org-1", "alice")
+	serve("/deployments/2", "org-1", "bob")
+	serve("/deployments/3", "", "")
+	serve("/deployments/4", "org-2", "carol")
+	serve("/unknown", "org-1", "alice")
+
+	fake.Advance(time.Minute)
+	analytics.flush(context.Background())
+
+	require.Len(t, publisher.summaries, 1)
+	summary := publisher.summaries[0]
+	assert.Equal(t, start, summary.Start)
+	assert.Equal(t, fake.Now(), summary.End)
+	require.Len(t, summary.Routes, 4, "unmatched routes aren't recorded")
+	assert.Equal(t, RouteUsage{Method: http.MethodGet, Route: "/deployments/:id", Org: "org-1", PrincipalName: "alice", PrincipalType: string(iam.User), Requests: 2, ClientErrors: 1, TotalLatency: 20 * time.Millisecond}, summary.Routes[0])
+	assert.ElementsMatch(t, []RouteUsage{
+		{Method: http.MethodGet, Route: "/deployments/:id", Requests: 1, TotalLatency: 10 * time.Millisecond},
+		{Method: http.MethodGet, Route: "/deployments/:id", Org: "org-1", PrincipalName: "bob", PrincipalType: string(iam.User), Requests: 1, TotalLatency: 10 * time.Millisecond},
+		{Method: http.MethodGet, Route: "/deployments/:id", Org: usageOverflowOrg, Requests: 1, TotalLatency: 10 * time.Millisecond},
+	}, summary.Routes[1:], "usage beyond MaxEntries is counted under the overflow org")
+
+	assert.Equal(t, 4, logs.FilterMessage("Route usage").Len())
+	counts := map[string]int64{}
+	for _, counter := range scope.Snapshot().Counters() {
+		counts[counter.Tags()["org"]+"/"+counter.Tags()["outcome"]] += counter.Value()
+	}
+	assert.Equal(t, map[string]int64{"org-1/success": 2, "org-1/clientError": 1, "/success": 1, usageOverflowOrg + "/success": 1}, counts)
+
+	analytics.flush(context.Background())
+	assert.Len(t, publisher.summaries, 1, "nothing is flushed without usage")
+}
+
+func TestUsageAnalyticsConfiguration(t *testing.T) {
+	lc := fxtest.NewLifecycle(t)
+	analytics, err := newUsageAnalytics(lc, UsageAnalyticsConfiguration{}, nil, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	assert.Nil(t, analytics, "analytics are disabled by default")
+
+	_, err = newUsageAnalytics(lc, UsageAnalyticsConfiguration{Enabled: true, Sinks: []string{UsageSinkPublisher}}, nil, zap.NewNop().Sugar())
+	assert.EqualError(t, err, `usage analytics sink "publisher" requires a UsagePublisher`)
+	_, err = newUsageAnalytics(lc, UsageAnalyticsConfiguration{Enabled: true, Sinks: []string{"kafka"}}, nil, zap.NewNop().Sugar())
+	assert.EqualError(t, err, `unknown usage analytics sink "kafka", expected one of log, metrics or publisher`)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"strings"
+)
+
+// UserAgent the parts of a User-Agent header that telemetry cares about. Parsing is best effort, unknown parts are left empty
+type UserAgent struct {
+	// Raw the header as sent
+	Raw string `json:"raw,omitempty"`
+	// Client the browser, i.e. Chrome or Firefox, or the product of non browser clients such as curl or armory-cli
+	Client string `json:"client,omitempty"`
+	// Version the version of the client
+	Version string `json:"version,omitempty"`
+	// OS the operating system, one of Windows, macOS, iOS, Android, ChromeOS or Linux
+	OS     string `json:"os,omitempty"`
+	Mobile bool   `json:"mobile,omitempty"`
+	// Bot whether the client identifies as a crawler or monitoring bot
+	Bot bool `json:"bot,omitempty"`
+}
+
+var (
+	// browsers in the order they are checked, browsers based on others also send the tokens of their base
+	browsers = []struct{ name, token string }{
+		{"Edge", "Edg/"},
+		{"Opera", "OPR/"},
+		{"Samsung Internet", "SamsungBrowser/"},
+		{"Firefox", "Firefox/"},
+		{"Chrome", "CriOS/"},
+		{"Chrome", "Chrome/"},
+		{"Safari", "Version/"},
+	}
+	operatingSystems = []struct{ name, token string }{
+		{"iOS", "iPhone"},
+		{"iOS", "iPad"},
+		{"Android", "Android"},
+		{"ChromeOS", "CrOS"},
+		{"Windows", "Windows"},
+		{"macOS", "Mac OS X"},
+		{"Linux", "Linux"},
+	}
+	botTokens = []string{"bot", "crawler", "spider", "slurp", "monitor", "pingdom", "headless"}
+)
+
+// ParseUserAgent parses a User-Agent header
+func ParseUserAgent(header string) UserAgent {
+	ua := UserAgent{Raw: header}
+	if strings.TrimSpace(header) == "" {
+		return ua
+	}
+
+	lower := strings.ToLower(header)
+	for _, token := range botTokens {
+		if strings.Contains(lower, token) {
+			ua.Bot = true
+			break
+		}
+	}
+	ua.Mobile = strings.Contains(header, "Mobile") || strings.Contains(header, "iPhone") || strings.Contains(header, "Android")
+
+	for _, os := range operatingSystems {
+		if strings.Contains(header, os.token) {
+			ua.OS = os.name
+			break
+		}
+	}
+
+	if strings.HasPrefix(header, "Mozilla/") {
+		for _, browser := range browsers {
+			if version, ok := productVersion(header, browser.token); ok {
+				ua.Client, ua.Version = browser.name, version
+				return ua
+			}
+		}
+		return ua
+	}
+
+	// non browser clients lead with their product, i.e. curl/8.1.2 or Go-http-client/1.1
+	product, _, _ := strings.Cut(header, " ")
+	ua.Client, ua.Version, _ = strings.Cut(product, "/")
+	return ua
+}
+
+// productVersion the version following token, up to the next space or semicolon
+func productVersion(header string, token string) (string, bool) {
+	i := strings.Index(header, token)
+	if i == -1 {
+		return "", false
+	}
+	version := header[i+len(token):]
+	if end := strings.IndexAny(version, " ;)"); end != -1 {
+		version = version[:end]
+	}
+	return version, true
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/logging"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxWebSocketMessageBytes the default of WebSocketEndpoint.MaxMessageBytes
+const defaultMaxWebSocketMessageBytes = 1 << 20
+
+var (
+	errWebSocketUpgradeRequired = serr.APIError{
+		Message:        "Expected a WebSocket upgrade request",
+		HttpStatusCode: http.StatusUpgradeRequired,
+	}
+	errWebSocketMessageTooLarge = serr.APIError{
+		Message:        "Message too large",
+		HttpStatusCode: http.StatusRequestEntityTooLarge,
+	}
+	errWebSocketClosed = errors.New("websocket session closed")
+)
+
+type (
+	// WebSocketEndpoint the lifecycle hooks of a WebSocket handler, see NewWebSocketHandler. The hooks of a connection are called
+	// from a single goroutine with the context of the upgrade request, which carries the principal and is canceled once the connection closes
+	WebSocketEndpoint[MESSAGE any] struct {
+		// OnConnect is called once the connection is established, an error is sent to the client before the connection is closed
+		OnConnect func(ctx context.Context, session *WebSocketSession) serr.Error
+		// OnMessage is called with each message of the client, unmarshalled from JSON and validated unless MESSAGE is []byte.
+		// Errors are sent to the client, the connection stays open
+		OnMessage func(ctx context.Context, session *WebSocketSession, message MESSAGE) serr.Error
+		// OnClose is called once the connection is closed by either side, unless OnConnect failed
+		OnClose func(ctx context.Context, session *WebSocketSession)
+		// AllowedOrigins the origins, such as https://app.example.com, browsers may connect from besides the server's own, "*" for any.
+		// Clients that don't send an Origin header, such as other services, are always allowed
+		AllowedOrigins []string
+		// MaxMessageBytes the largest message accepted from clients, defaults to 1MiB. Larger messages are answered with a 413 error
+		MaxMessageBytes int
+	}
+
+	// WebSocketSession a WebSocket connection, safe for concurrent use so messages can be pushed from other goroutines
+	WebSocketSession struct {
+		conn    *websocket.Conn
+		request *http.Request
+		log     *zap.SugaredLogger
+		mu      sync.Mutex
+		closed  bool
+	}
+
+	// webSocketHandlerMarker marks the handlers created by NewWebSocketHandler in the registry
+	webSocketHandlerMarker interface {
+		webSocket()
+	}
+
+	webSocketHandler[MESSAGE any] struct {
+		config   HandlerConfig
+		endpoint WebSocketEndpoint[MESSAGE]
+		origins  map[string]bool
+	}
+)
+
+// NewWebSocketHandler creates a Handler that upgrades GET requests to the path of the config to WebSocket connections. Requests are
+// authenticated and authorized like those of other handlers before they are upgraded. Settings that only apply to request/response
+// handlers, such as Deduplicate, Encryption, LongPoll and Cache, are ignored
+func NewWebSocketHandler[MESSAGE any](endpoint WebSocketEndpoint[MESSAGE], config HandlerConfig) Handler {
+	config.Method = http.MethodGet
+	config.Deduplicate = false
+	config.DisableCoalescing = true
+	config.LatencyBudget = 0
+	config.Cache = nil
+	config.Encryption = ""
+	config.LongPoll = nil
+	if endpoint.MaxMessageBytes <= 0 {
+		endpoint.MaxMessageBytes = defaultMaxWebSocketMessageBytes
+	}
+	origins := map[string]bool{}
+	for _, origin := range endpoint.AllowedOrigins {
+		origins[normalizeOrigin(origin)] = true
+	}
+	return &webSocketHandler[MESSAGE]{config: config, endpoint: endpoint, origins: origins}
+}
+
+func (h *webSocketHandler[MESSAGE]) Config() HandlerConfig {
+	return h.config
+}
+
+func (h *webSocketHandler[MESSAGE]) name() string {
+	if h.endpoint.OnMessage != nil {
+		return funcName(h.endpoint.OnMessage)
+	}
+	return ""
+}
+
+func (h *webSocketHandler[MESSAGE]) webSocket() {}
+
+func (h *webSocketHandler[MESSAGE]) GetGinHandlerFn(log *zap.SugaredLogger, requestValidator *validator.Validate, handler *handlerDTO) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				onRequestCompleted(c, log, r)
+			}
+		}()
+
+		loggingMetadata := extractLoggingMetadata(c.Request.Context())
+		onPrepareRequestContext(c, LoggingMetadata{
+			Logger:   log.With(append(ExtractLoggingFields(loggingMetadata), logging.SpanField(c.Request.Context()))...),
+			Metadata: loggingMetadata,
+		})
+		if !onAuthorizeRequest(c, handler, log) {
+			return
+		}
+		if !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+			writeAndLogApiErrorThenAbort(c, serr.NewErrorResponseFromApiError(errWebSocketUpgradeRequired,
+				serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+			), log)
+			return
+		}
+
+		ctx := c.Request.Context()
+		websocket.Server{
+			Handshake: h.handshake,
+			Handler: func(conn *websocket.Conn) {
+				h.serve(ctx, conn, handler, requestValidator, log)
+			},
+		}.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// handshake accepts connections from clients without an origin, the server's own origin and the allowed origins
+func (h *webSocketHandler[MESSAGE]) handshake(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil || origin == nil {
+		return err
+	}
+	config.Origin = origin
+	if strings.EqualFold(origin.Host, req.Host) || h.origins["*"] || h.origins[normalizeOrigin(origin.Scheme+"://"+origin.Host)] {
+		return nil
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+func (h *webSocketHandler[MESSAGE]) serve(ctx context.Context, conn *websocket.Conn, handler *handlerDTO, requestValidator *validator.Validate, log *zap.SugaredLogger) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// hijacked connections keep the deadlines of the server, which are meant for requests
+	_ = conn.SetDeadline(time.Time{})
+	conn.MaxPayloadBytes = h.endpoint.MaxMessageBytes
+	session := &WebSocketSession{conn: conn, request: conn.Request(), log: log}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorw("WebSocket handler panicked", "path", handler.Path, "panic", fmt.Sprintf("%v", r))
+		}
+		_ = session.Close()
+	}()
+
+	if h.endpoint.OnConnect != nil {
+		if apiErr := h.endpoint.OnConnect(ctx, session); apiErr != nil {
+			_ = session.SendError(apiErr)
+			return
+		}
+	}
+	if h.endpoint.OnClose != nil {
+		defer h.endpoint.OnClose(ctx, session)
+	}
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			// the rest of an oversized message is discarded by the next receive
+			if errors.Is(err, websocket.ErrFrameTooLarge) {
+				_ = session.SendError(serr.NewErrorResponseFromApiError(errWebSocketMessageTooLarge,
+					serr.WithStackTraceLoggingBehavior(serr.ForceNoStackTrace),
+				))
+				continue
+			}
+			return
+		}
+		if h.endpoint.OnMessage == nil {
+			continue
+		}
+		message, apiErr := decodeWebSocketMessage[MESSAGE](data, handler.JSONDecoding, requestValidator)
+		if apiErr == nil {
+			apiErr = h.endpoint.OnMessage(ctx, session, *message)
+		}
+		if apiErr != nil {
+			_ = session.SendError(apiErr)
+		}
+	}
+}
+
+// decodeWebSocketMessage unmarshals and validates a message like the bodies of requests, []byte messages are passed as is
+func decodeWebSocketMessage[MESSAGE any](data []byte, decoding *JSONDecoding, requestValidator *validator.Validate) (*MESSAGE, serr.Error) {
+	var message MESSAGE
+	if raw, ok := any(&message).(*[]byte); ok {
+		*raw = data
+		return &message, nil
+	}
+	if apiErr := unmarshalJSON(data, &message, decoding); apiErr != nil {
+		return nil, apiErr
+	}
+	if t := reflect.TypeOf(message); requestValidator != nil && t != nil && t.Kind() == reflect.Struct {
+		if apiErr := validateRequestBody(&message, requestValidator); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+	return &message, nil
+}
+
+// Send sends the message to the client as JSON, []byte messages are sent as binary frames
+func (s *WebSocketSession) Send(message any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errWebSocketClosed
+	}
+	if b, ok := message.([]byte); ok {
+		return websocket.Message.Send(s.conn, b)
+	}
+	return websocket.JSON.Send(s.conn, message)
+}
+
+// SendError sends the error to the client in the format of error responses and logs it like the errors of other handlers
+func (s *WebSocketSession) SendError(apiErr serr.Error) error {
+	errorID := uuid.NewString()
+	statusCode := serr.StatusCode(apiErr)
+	LogAPIError(s.request, errorID, apiErr, statusCode, s.log)
+	contract := apiErr.ToErrorResponseContract(errorID)
+	if includesCauseChain(s.request) {
+		contract.Causes = apiErr.CauseChain()
+	}
+	b, err := json.Marshal(contract)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errWebSocketClosed
+	}
+	return websocket.Message.Send(s.conn, string(b))
+}
+
+// Close closes the connection, the OnClose hook is called once the receiving of messages stops
+func (s *WebSocketSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.conn.Close()
+}
+
+// Request the upgrade request of the connection
+func (s *WebSocketSession) Request() *http.Request {
+	return s.request
+}
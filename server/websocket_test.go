@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+type echoMessage struct {
+	Text string `json:"text" validate:"required"`
+}
+
+type webSocketController struct {
+	closed chan string
+}
+
+func (w webSocketController) Handlers() []Handler {
+	return []Handler{
+		NewWebSocketHandler(WebSocketEndpoint[echoMessage]{
+			OnConnect: func(ctx context.Context, session *WebSocketSession) serr.Error {
+				principal, _ := iam.ExtractPrincipalFromContext(ctx)
+				if principal.OrgId == "banned" {
+					return serr.NewSimpleErrorWithStatusCode("org is banned", http.StatusForbidden, nil)
+				}
+				return nil
+			},
+			OnMessage: func(ctx context.Context, session *WebSocketSession, message echoMessage) serr.Error {
+				if message.Text == "fail" {
+					return serr.NewSimpleErrorWithStatusCode("failed on purpose", http.StatusConflict, nil)
+				}
+				principal, _ := iam.ExtractPrincipalFromContext(ctx)
+				_ = session.Send(echoMessage{Text: principal.OrgId + ": " + message.Text})
+				return nil
+			},
+			OnClose: func(ctx context.Context, session *WebSocketSession) {
+				principal, _ := iam.ExtractPrincipalFromContext(ctx)
+				w.closed <- principal.OrgId
+			},
+			AllowedOrigins:  []string{"https://app.example.com"},
+			MaxMessageBytes: 64,
+		}, HandlerConfig{
+			Path: "/events",
+			AuthZValidator: func(p *iam.ArmoryCloudPrincipal) (string, bool) {
+				return "not allowed", p.OrgId != "unauthorized"
+			},
+		}),
+	}
+}
+
+func newWebSocketTestServer(t *testing.T, controller webSocketController) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{controller})
+	require.NoError(t, err)
+	assert.True(t, registry.handlers()[0].WebSocket)
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(iam.WithPrincipal(c.Request.Context(), iam.ArmoryCloudPrincipal{OrgId: c.Query("org"), Type: iam.Machine}))
+	})
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group(""),
+		AuthNotEnforcedGroup: g.Group(""),
+	}))
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, org string, origin string) (*websocket.Conn, error) {
+	return websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/events?org="+org, "", origin)
+}
+
+func receiveError(t *testing.T, conn *websocket.Conn) serr.ResponseContract {
+	var data string
+	require.NoError(t, websocket.Message.Receive(conn, &data))
+	var contract serr.ResponseContract
+	require.NoError(t, json.Unmarshal([]byte(data), &contract))
+	return contract
+}
+
+func TestWebSocketHandlerMessages(t *testing.T) {
+	controller := webSocketController{closed: make(chan string, 1)}
+	server := newWebSocketTestServer(t, controller)
+
+	conn, err := dialWebSocket(t, server, "org-1", server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, websocket.JSON.Send(conn, echoMessage{Text: "hello"}))
+	var echo echoMessage
+	require.NoError(t, websocket.JSON.Receive(conn, &echo))
+	assert.Equal(t, "org-1: hello", echo.Text)
+
+	require.NoError(t, websocket.JSON.Send(conn, echoMessage{Text: "fail"}))
+	assert.Equal(t, "failed on purpose", receiveError(t, conn).Errors[0].Message)
+
+	require.NoError(t, websocket.Message.Send(conn, `{}`))
+	assert.Contains(t, receiveError(t, conn).Errors[0].Message, "Text")
+
+	require.NoError(t, websocket.Message.Send(conn, strings.Repeat("x", 100)))
+	assert.Equal(t, errWebSocketMessageTooLarge.Message, receiveError(t, conn).Errors[0].Message)
+
+	require.NoError(t, websocket.JSON.Send(conn, echoMessage{Text: "still open"}))
+	require.NoError(t, websocket.JSON.Receive(conn, &echo))
+	assert.Equal(t, "org-1: still open", echo.Text)
+
+	require.NoError(t, conn.Close())
+	assert.Equal(t, "org-1", <-controller.closed)
+}
+
+func TestWebSocketHandlerRejections(t *testing.T) {
+	controller := webSocketController{closed: make(chan string, 1)}
+	server := newWebSocketTestServer(t, controller)
+
+	_, err := dialWebSocket(t, server, "unauthorized", server.URL)
+	assert.Error(t, err, "the AuthZValidator runs before the upgrade")
+
+	_, err = dialWebSocket(t, server, "org-1", "https://evil.example.com")
+	assert.Error(t, err)
+	conn, err := dialWebSocket(t, server, "org-1", "https://app.example.com")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, "org-1", <-controller.closed)
+
+	conn, err = dialWebSocket(t, server, "banned", server.URL)
+	require.NoError(t, err)
+	contract := receiveError(t, conn)
+	assert.Equal(t, "org is banned", contract.Errors[0].Message)
+	var data string
+	assert.Error(t, websocket.Message.Receive(conn, &data), "the connection is closed when OnConnect fails")
+
+	res, err := http.Get(server.URL + "/events?org=org-1")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, res.StatusCode)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// isYAMLMediaType whether the content type is application/yaml, application/x-yaml, text/yaml or a +yaml suffixed type
+func isYAMLMediaType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+yaml")
+}
+
+// unmarshalYAML decodes a YAML request body into req through its JSON form, so the json tags and validation of the request apply as
+// they do to JSON bodies. Errors carry the same metadata as JSON ones, with the 1-based line and column of the offending value
+func unmarshalYAML[REQUEST any](body []byte, req *REQUEST) serr.Error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return yamlUnmarshalError(err, map[string]any{"reason": err.Error(), "line": yamlLineOf(err)})
+	}
+	var value any
+	if err := doc.Decode(&value); err != nil {
+		return yamlUnmarshalError(err, map[string]any{"reason": err.Error(), "line": yamlLineOf(err)})
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		// i.e. mappings with keys that aren't strings
+		return yamlUnmarshalError(err, map[string]any{"reason": err.Error()})
+	}
+	if err := json.Unmarshal(b, req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return yamlUnmarshalError(err, nil)
+		}
+		path := typeErr.Struct + lo.Ternary(typeErr.Struct == "" || typeErr.Field == "", "", ".") + typeErr.Field
+		meta := map[string]any{
+			"path":         path,
+			"providedType": typeErr.Value,
+			"expectedType": lo.Ternary(typeErr.Type.Name() != "", typeErr.Type.Name(), strconv.Itoa(int(typeErr.Type.Kind()))),
+			"reason":       "cannot unmarshal data",
+		}
+		if node := yamlNodeAt(&doc, typeErr.Field); node != nil {
+			meta["line"], meta["column"] = node.Line, node.Column
+		}
+		return yamlUnmarshalError(err, meta)
+	}
+	return nil
+}
+
+func yamlUnmarshalError(err error, meta map[string]any) serr.Error {
+	return serr.NewErrorResponseFromApiError(serr.APIError{
+		Message:        errFailedToUnmarshalRequest.Message,
+		Metadata:       meta,
+		HttpStatusCode: errFailedToUnmarshalRequest.HttpStatusCode,
+		Code:           errFailedToUnmarshalRequest.Code,
+	}, serr.WithCause(err))
+}
+
+// yamlLineOf the line of a YAML error, yaml.v3 reports the line but not the column of syntax errors
+func yamlLineOf(err error) any {
+	match := yamlErrorLine.FindStringSubmatch(err.Error())
+	if match == nil {
+		return nil
+	}
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+// yamlNodeAt the node at the dotted path of JSON field names. Paths don't say which item of a sequence they are in, so the sequence
+// is returned for fields within one
+func yamlNodeAt(doc *yaml.Node, path string) *yaml.Node {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if path == "" {
+		return node
+	}
+	for _, field := range strings.Split(path, ".") {
+		if node.Kind != yaml.MappingNode {
+			return node
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			// encoding/json matches field names case-insensitively
+			if strings.EqualFold(node.Content[i].Value, field) {
+				next = node.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/armory-io/go-commons/server/serr"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type (
+	yamlController struct{}
+
+	yamlPipeline struct {
+		Name   string             `json:"name" validate:"required"`
+		Stages []yamlStage        `json:"stages"`
+		Config yamlPipelineConfig `json:"config"`
+	}
+
+	yamlStage struct {
+		Name string `json:"name"`
+	}
+
+	yamlPipelineConfig struct {
+		Timeout int `json:"timeout"`
+	}
+)
+
+func (yamlController) Handlers() []Handler {
+	return []Handler{
+		NewHandler(func(ctx context.Context, request yamlPipeline) (*Response[yamlPipeline], serr.Error) {
+			return SimpleResponse(request), nil
+		}, HandlerConfig{
+			Path:       "/pipelines",
+			Method:     http.MethodPost,
+			Consumes:   "application/yaml",
+			AuthOptOut: true,
+		}),
+	}
+}
+
+func TestYAMLRequestBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry, err := newHandlerRegistry("http", zap.NewNop().Sugar(), validator.New(), nil, []IController{yamlController{}})
+	require.NoError(t, err)
+	g := gin.New()
+	require.NoError(t, registry.registerHandlers(registerHandlersInput{
+		AuthRequiredGroup:    g.Group(""),
+		AuthNotEnforcedGroup: g.Group(""),
+	}))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/pipelines", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/yaml")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+	errorMetadata := func(w *httptest.ResponseRecorder) map[string]any {
+		var response serr.ResponseContract
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response), w.Body.String())
+		require.Len(t, response.Errors, 1)
+		return response.Errors[0].Metadata
+	}
+
+	w := serve("name: deploy\nstages:\n  - name: build\nconfig:\n  timeout: 30\n")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"name":"deploy","stages":[{"name":"build"}],"config":{"timeout":30}}`, w.Body.String())
+
+	w = serve("stages: []\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "validator tags apply to YAML bodies")
+
+	w = serve("name: deploy\nconfig:\n  timeout: soon\n")
+	require.Equal(t, errFailedToUnmarshalRequest.HttpStatusCode, w.Code)
+	meta := errorMetadata(w)
+	assert.Equal(t, "string", meta["providedType"])
+	assert.Equal(t, "int", meta["expectedType"])
+	assert.Equal(t, float64(3), meta["line"])
+	assert.Equal(t, float64(12), meta["column"])
+	assert.True(t, strings.HasSuffix(meta["path"].(string), "timeout"), meta["path"])
+
+	w = serve("name: deploy\nstages: [\n")
+	require.Equal(t, errFailedToUnmarshalRequest.HttpStatusCode, w.Code)
+	meta = errorMetadata(w)
+	assert.Equal(t, float64(2), meta["line"])
+	assert.Contains(t, meta["reason"], "yaml:")
+}
+
+func TestIsYAMLMediaType(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/yaml":                  true,
+		"application/x-yaml; charset=utf-8": true,
+		"text/yaml":                         true,
+		"application/vnd.pipeline+yaml":     true,
+		"application/json":                  false,
+		"*/*":                               false,
+	} {
+		assert.Equal(t, expected, isYAMLMediaType(contentType), contentType)
+	}
+}
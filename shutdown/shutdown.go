@@ -0,0 +1,224 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package shutdown runs an fx application, logs a structured report of how it stopped and exits with a code that tells
+// orchestration and on-call why it did:
+//
+//	runner := shutdown.NewRunner()
+//	app := fx.New(application.ModuleV2, runner.Module(), ...)
+//	runner.Run(app)
+//
+// Components record what they drained or flushed while stopping with the Recorder the Runner provides, see Recorder.Record
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/logging"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The exit codes of the outcomes of an application, above the codes of the shell and of panics (2)
+const (
+	ExitClean        = 0
+	ExitStartFailed  = 10
+	ExitStartTimeout = 11
+	ExitStopFailed   = 12
+	ExitStopTimeout  = 13
+)
+
+const (
+	OutcomeClean        = "clean"
+	OutcomeStartFailed  = "startFailed"
+	OutcomeStartTimeout = "startTimeout"
+	OutcomeStopFailed   = "stopFailed"
+	OutcomeStopTimeout  = "stopTimeout"
+)
+
+type (
+	// Report how an application stopped
+	Report struct {
+		Outcome  string `json:"outcome"`
+		ExitCode int    `json:"exitCode"`
+		// Reason the signal that stopped the application, or the error it failed with
+		Reason string `json:"reason"`
+		// Uptime from the start of the application until it stopped
+		Uptime time.Duration `json:"uptime"`
+		// StopDuration how long stopping took
+		StopDuration time.Duration `json:"stopDuration"`
+		// Hooks the OnStop hooks that ran, the ones still running when stopping timed out are stuck
+		Hooks []Hook `json:"hooks,omitempty"`
+		// Details what components recorded while stopping, such as the requests drained or the events flushed
+		Details map[string]any `json:"details,omitempty"`
+	}
+
+	// Hook an OnStop hook that ran
+	Hook struct {
+		Function string        `json:"function"`
+		Caller   string        `json:"caller"`
+		Duration time.Duration `json:"duration"`
+		Error    string        `json:"error,omitempty"`
+		Stuck    bool          `json:"stuck,omitempty"`
+	}
+
+	// Recorder collects the details of the report, provided by Runner.Module. A nil Recorder records nothing
+	Recorder struct {
+		mu      sync.Mutex
+		details map[string]any
+	}
+
+	// Runner starts and stops an application, then reports how it stopped
+	Runner struct {
+		recorder *Recorder
+		log      *zap.SugaredLogger
+		clock    clock.Clock
+		exit     func(code int)
+	}
+)
+
+// NewRunner creates a Runner
+func NewRunner() *Runner {
+	return &Runner{recorder: &Recorder{details: map[string]any{}}, clock: clock.New(), exit: os.Exit}
+}
+
+// Module provides the Recorder of the runner and has it log the report with the logger of the application
+func (r *Runner) Module() fx.Option {
+	return fx.Module("shutdown",
+		fx.Supply(r.recorder),
+		fx.Invoke(func(log *zap.SugaredLogger) {
+			r.log = log
+		}),
+	)
+}
+
+// Run starts the application and stops it when it receives SIGINT or SIGTERM, or is shut down with fx.Shutdowner, then logs the
+// report and exits with the exit code of its outcome
+func (r *Runner) Run(app *fx.App) {
+	report := r.run(app, app.Done())
+	r.logReport(report)
+	r.exit(report.ExitCode)
+}
+
+func (r *Runner) run(app *fx.App, done <-chan os.Signal) Report {
+	started := r.clock.Now()
+	startCtx, cancel := context.WithTimeout(context.Background(), app.StartTimeout())
+	defer cancel()
+	if err := app.Start(startCtx); err != nil {
+		report := r.report(started, started, err.Error())
+		report.Outcome, report.ExitCode = OutcomeStartFailed, ExitStartFailed
+		if errors.Is(err, context.DeadlineExceeded) {
+			report.Outcome, report.ExitCode = OutcomeStartTimeout, ExitStartTimeout
+		}
+		return report
+	}
+
+	sig := <-done
+	stopping := r.clock.Now()
+	stopCtx, cancel := context.WithTimeout(context.Background(), app.StopTimeout())
+	defer cancel()
+	err := app.Stop(stopCtx)
+
+	report := r.report(started, stopping, sig.String())
+	switch {
+	case err == nil:
+		report.Outcome, report.ExitCode = OutcomeClean, ExitClean
+	case errors.Is(err, context.DeadlineExceeded):
+		report.Outcome, report.ExitCode = OutcomeStopTimeout, ExitStopTimeout
+	default:
+		report.Outcome, report.ExitCode = OutcomeStopFailed, ExitStopFailed
+	}
+	return report
+}
+
+func (r *Runner) report(started time.Time, stopping time.Time, reason string) Report {
+	now := r.clock.Now()
+	report := Report{
+		Reason:       reason,
+		Uptime:       now.Sub(started),
+		StopDuration: now.Sub(stopping),
+		Details:      r.recorder.snapshot(),
+	}
+	for _, h := range logging.FxStopHooks() {
+		hook := Hook{Function: h.Function, Caller: h.Caller, Duration: h.Runtime, Stuck: h.Running}
+		if h.Err != nil {
+			hook.Error = h.Err.Error()
+		}
+		report.Hooks = append(report.Hooks, hook)
+	}
+	return report
+}
+
+func (r *Runner) logReport(report Report) {
+	log := r.log
+	if log == nil {
+		// the application failed before its logger was created
+		l, err := zap.NewProduction()
+		if err != nil {
+			return
+		}
+		log = l.Sugar()
+	}
+	defer func() { _ = log.Sync() }()
+
+	fields := []any{
+		"outcome", report.Outcome,
+		"exitCode", report.ExitCode,
+		"reason", report.Reason,
+		"uptime", report.Uptime.String(),
+		"stopDuration", report.StopDuration.String(),
+		"hooks", report.Hooks,
+		"details", report.Details,
+	}
+	if report.Outcome == OutcomeClean {
+		log.Infow("Shutdown report", fields...)
+		return
+	}
+	log.Errorw("Shutdown report", fields...)
+}
+
+// Record adds a detail to the report, such as the requests a server drained while stopping
+func (r *Recorder) Record(key string, value any) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.details[key] = value
+}
+
+func (r *Recorder) snapshot() map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.details) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(r.details))
+	for k := range r.details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	details := make(map[string]any, len(keys))
+	for _, k := range keys {
+		details[k] = r.details[k]
+	}
+	return details
+}
@@ -0,0 +1,136 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestRunner() *Runner {
+	r := NewRunner()
+	r.clock = clock.NewFake(time.Unix(1700000000, 0))
+	r.exit = func(int) {}
+	return r
+}
+
+func newTestApp(r *Runner, log *zap.SugaredLogger, hook fx.Hook, options ...fx.Option) *fx.App {
+	return fx.New(
+		fx.NopLogger,
+		fx.StartTimeout(50*time.Millisecond),
+		fx.StopTimeout(50*time.Millisecond),
+		fx.Supply(log),
+		r.Module(),
+		fx.Invoke(func(lc fx.Lifecycle, recorder *Recorder) {
+			lc.Append(hook)
+			recorder.Record("server.requestsDrained", 3)
+		}),
+		fx.Options(options...),
+	)
+}
+
+func signal(sig os.Signal) <-chan os.Signal {
+	done := make(chan os.Signal, 1)
+	done <- sig
+	return done
+}
+
+func blockUntilDone(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRunOutcomes(t *testing.T) {
+	cases := []struct {
+		name     string
+		hook     fx.Hook
+		outcome  string
+		exitCode int
+		reason   string
+	}{
+		{
+			name:     "clean",
+			hook:     fx.Hook{},
+			outcome:  OutcomeClean,
+			exitCode: ExitClean,
+			reason:   "terminated",
+		},
+		{
+			name:     "start failed",
+			hook:     fx.Hook{OnStart: func(context.Context) error { return errors.New("no database") }},
+			outcome:  OutcomeStartFailed,
+			exitCode: ExitStartFailed,
+			reason:   "no database",
+		},
+		{
+			name:     "start timeout",
+			hook:     fx.Hook{OnStart: blockUntilDone},
+			outcome:  OutcomeStartTimeout,
+			exitCode: ExitStartTimeout,
+			reason:   "context deadline exceeded",
+		},
+		{
+			name:     "stop failed",
+			hook:     fx.Hook{OnStop: func(context.Context) error { return errors.New("flush failed") }},
+			outcome:  OutcomeStopFailed,
+			exitCode: ExitStopFailed,
+			reason:   "terminated",
+		},
+		{
+			name:     "stop timeout",
+			hook:     fx.Hook{OnStop: blockUntilDone},
+			outcome:  OutcomeStopTimeout,
+			exitCode: ExitStopTimeout,
+			reason:   "terminated",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := newTestRunner()
+			app := newTestApp(r, zap.NewNop().Sugar(), c.hook)
+			require.NoError(t, app.Err())
+
+			report := r.run(app, signal(syscall.SIGTERM))
+
+			assert.Equal(t, c.outcome, report.Outcome)
+			assert.Equal(t, c.exitCode, report.ExitCode)
+			assert.Contains(t, report.Reason, c.reason)
+			assert.Equal(t, map[string]any{"server.requestsDrained": 3}, report.Details)
+		})
+	}
+}
+
+func TestRunLogsTheReportAndExits(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	r := newTestRunner()
+	var code int
+	r.exit = func(c int) { code = c }
+	var shutdowner fx.Shutdowner
+	app := newTestApp(r, zap.New(core).Sugar(), fx.Hook{
+		OnStart: func(context.Context) error { return shutdowner.Shutdown() },
+		OnStop:  func(context.Context) error { return errors.New("flush failed") },
+	}, fx.Populate(&shutdowner))
+	require.NoError(t, app.Err())
+
+	r.Run(app)
+
+	assert.Equal(t, ExitStopFailed, code)
+	entries := logs.FilterMessage("Shutdown report").AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, OutcomeStopFailed, entries[0].ContextMap()["outcome"])
+}
+
+func TestNilRecorderRecordsNothing(t *testing.T) {
+	var r *Recorder
+	assert.NotPanics(t, func() { r.Record("metering.eventsFlushed", 1) })
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/server/serr"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const defaultCanaryDelay = 5 * time.Second
+
+type (
+	Configuration struct {
+		// Canary runs the checks once at startup and logs their report
+		Canary bool
+		// CanaryDelay how long after startup the canary run starts, so the server is listening, defaults to 5 seconds
+		CanaryDelay time.Duration
+		// BaseURL where the HTTP checks are sent, defaults to the port and prefix of the server on localhost
+		BaseURL string
+	}
+
+	Parameters struct {
+		fx.In
+
+		Lifecycle fx.Lifecycle
+		Config    Configuration        `optional:"true"`
+		Server    server.Configuration `optional:"true"`
+		Checks    []Check              `group:"smoke-checks"`
+		Metadata  metadata.ApplicationMetadata
+		Client    *http.Client `optional:"true"`
+		Log       *zap.SugaredLogger
+		Clock     clock.Clock `optional:"true"`
+	}
+
+	controller struct {
+		runner *Runner
+	}
+)
+
+var Module = fx.Module(
+	"smoke",
+	fx.Provide(New, NewController),
+)
+
+// Provide adds checks to the fx group
+func Provide(checks ...Check) fx.Option {
+	options := make([]fx.Option, 0, len(checks))
+	for _, check := range checks {
+		check := check
+		options = append(options, fx.Provide(fx.Annotate(
+			func() Check { return check },
+			fx.ResultTags(`group:"`+GroupName+`"`),
+		)))
+	}
+	return fx.Options(options...)
+}
+
+// New creates the Runner of the checks of the fx group and runs them once at startup in canary mode
+func New(p Parameters) (*Runner, error) {
+	baseURL := p.Config.BaseURL
+	if baseURL == "" && p.Server.HTTP.Port != 0 {
+		scheme := "http"
+		if p.Server.HTTP.SSL.Enabled {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://localhost:%d%s", scheme, p.Server.HTTP.Port, p.Server.HTTP.Prefix)
+	}
+	runner, err := NewRunner(p.Checks, baseURL, p.Client, p.Metadata, p.Log, p.Clock)
+	if err != nil || !p.Config.Canary {
+		return runner, err
+	}
+
+	delay := p.Config.CanaryDelay
+	if delay <= 0 {
+		delay = defaultCanaryDelay
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				select {
+				case <-runner.clock.After(delay):
+					runner.Run(ctx, TriggerCanary)
+				case <-ctx.Done():
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-done
+			return nil
+		},
+	})
+	return runner, nil
+}
+
+// NewController runs the checks with a POST to the smoke endpoint of the management server and serves the last report with a GET.
+// Both respond 503 when a check didn't pass
+func NewController(runner *Runner) server.ManagementController {
+	return server.ManagementController{Controller: &controller{runner: runner}}
+}
+
+func (c *controller) Handlers() []server.Handler {
+	return []server.Handler{
+		server.NewHandler(c.run, server.HandlerConfig{
+			Path:       "smoke",
+			Method:     http.MethodPost,
+			AuthOptOut: true,
+		}),
+		server.NewHandler(c.last, server.HandlerConfig{
+			Path:       "smoke",
+			Method:     http.MethodGet,
+			AuthOptOut: true,
+		}),
+	}
+}
+
+func (c *controller) run(ctx context.Context, _ server.Void) (*server.Response[Report], serr.Error) {
+	return reportResponse(c.runner.Run(ctx, TriggerManual)), nil
+}
+
+func (c *controller) last(_ context.Context, _ server.Void) (*server.Response[Report], serr.Error) {
+	report := c.runner.Last()
+	if report == nil {
+		return nil, serr.NewSimpleErrorWithStatusCode("The smoke tests haven't run yet", http.StatusNotFound, nil)
+	}
+	return reportResponse(*report), nil
+}
+
+func reportResponse(report Report) *server.Response[Report] {
+	statusCode := http.StatusOK
+	if report.Status != StatusPassed {
+		statusCode = http.StatusServiceUnavailable
+	}
+	return &server.Response[Report]{Body: report, StatusCode: statusCode}
+}
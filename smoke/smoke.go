@@ -0,0 +1,292 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package smoke runs the self-checks a service declares, such as calls to its own routes, database and queue round trips, and
+// reports the outcome as a machine-readable Report for deployment verification. The checks run on demand with a POST to the
+// smoke endpoint of the management server, and once at startup in canary mode.
+//
+//	fx.New(
+//		smoke.Module,
+//		smoke.Provide(
+//			smoke.Check{Name: "list-deployments", HTTP: &smoke.HTTPCheck{Path: "/deployments", ExpectedStatus: http.StatusOK}},
+//			smoke.Database("db", db),
+//		),
+//	)
+package smoke
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/ids"
+	"github.com/armory-io/go-commons/metadata"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GroupName the fx value group of the checks
+	GroupName = "smoke-checks"
+
+	StatusPassed   Status = "passed"
+	StatusFailed   Status = "failed"
+	StatusTimedOut Status = "timedOut"
+
+	TriggerCanary Trigger = "canary"
+	TriggerManual Trigger = "manual"
+
+	defaultTimeout = 30 * time.Second
+)
+
+type (
+	// Status the outcome of a check or of a run
+	Status string
+
+	// Trigger what started a run
+	Trigger string
+
+	// Check a self-check of the service, either an HTTP call to one of its own routes or a Run function
+	Check struct {
+		Name string
+		// Timeout how long the check may run, defaults to 30 seconds
+		Timeout time.Duration
+		HTTP    *HTTPCheck
+		Run     func(ctx context.Context) error
+	}
+
+	// HTTPCheck a request to a route of the service, sent to the BaseURL of the Configuration
+	HTTPCheck struct {
+		// Method defaults to GET
+		Method  string
+		Path    string
+		Headers map[string]string
+		Body    string
+		// ExpectedStatus defaults to 200
+		ExpectedStatus int
+	}
+
+	// Result the outcome of a check
+	Result struct {
+		Name     string `json:"name"`
+		Status   Status `json:"status"`
+		Duration string `json:"duration"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// Report the outcome of a run, passed when every check passed
+	Report struct {
+		Status      Status    `json:"status"`
+		Trigger     Trigger   `json:"trigger"`
+		Application string    `json:"application,omitempty"`
+		Version     string    `json:"version,omitempty"`
+		InstanceId  string    `json:"instanceId,omitempty"`
+		StartedAt   time.Time `json:"startedAt"`
+		Duration    string    `json:"duration"`
+		Checks      []Result  `json:"checks"`
+	}
+
+	// Runner runs the checks and keeps the report of the last run
+	Runner struct {
+		checks  []Check
+		baseURL string
+		client  *http.Client
+		app     metadata.ApplicationMetadata
+		log     *zap.SugaredLogger
+		clock   clock.Clock
+		mu      sync.RWMutex
+		last    *Report
+	}
+)
+
+// NewRunner creates a Runner, failing when a check is invalid or two checks have the same name
+func NewRunner(checks []Check, baseURL string, client *http.Client, app metadata.ApplicationMetadata, log *zap.SugaredLogger, c clock.Clock) (*Runner, error) {
+	names := make(map[string]bool, len(checks))
+	for _, check := range checks {
+		if check.Name == "" || (check.HTTP == nil) == (check.Run == nil) {
+			return nil, errors.New("smoke: checks must have a name and either an HTTP check or a Run function")
+		}
+		if check.HTTP != nil && baseURL == "" {
+			return nil, fmt.Errorf("smoke: check %s requires a base URL", check.Name)
+		}
+		if names[check.Name] {
+			return nil, fmt.Errorf("smoke: duplicate check %s", check.Name)
+		}
+		names[check.Name] = true
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Runner{
+		checks:  checks,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+		app:     app,
+		log:     log,
+		clock:   clock.OrDefault(c),
+	}, nil
+}
+
+// Run runs the checks concurrently and returns their report once all of them have finished or timed out
+func (r *Runner) Run(ctx context.Context, trigger Trigger) Report {
+	start := r.clock.Now()
+	results := make([]Result, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = r.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{
+		Status:      StatusPassed,
+		Trigger:     trigger,
+		Application: r.app.Name,
+		Version:     r.app.Version,
+		InstanceId:  r.app.InstanceId,
+		StartedAt:   start,
+		Duration:    r.clock.Since(start).String(),
+		Checks:      results,
+	}
+	for _, result := range results {
+		if result.Status != StatusPassed {
+			report.Status = StatusFailed
+		}
+	}
+
+	log := r.log.With("report", report)
+	if report.Status == StatusPassed {
+		log.Info("Smoke tests passed")
+	} else {
+		log.Error("Smoke tests failed")
+	}
+
+	r.mu.Lock()
+	r.last = &report
+	r.mu.Unlock()
+	return report
+}
+
+// Last the report of the last run, nil until the checks have run
+func (r *Runner) Last() *Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.last
+}
+
+func (r *Runner) run(ctx context.Context, check Check) Result {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := r.clock.Now()
+	errs := make(chan error, 1)
+	go func() {
+		if check.HTTP != nil {
+			errs <- r.call(ctx, check.HTTP)
+			return
+		}
+		errs <- check.Run(ctx)
+	}()
+
+	result := Result{Name: check.Name, Status: StatusPassed}
+	select {
+	case err := <-errs:
+		if err != nil {
+			result.Status = StatusFailed
+			result.Error = err.Error()
+		}
+	case <-r.clock.After(timeout):
+		result.Status = StatusTimedOut
+		result.Error = fmt.Sprintf("did not finish within %s", timeout)
+	}
+	result.Duration = r.clock.Since(start).String()
+	return result
+}
+
+func (r *Runner) call(ctx context.Context, check *HTTPCheck) error {
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	expected := check.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+"/"+strings.TrimPrefix(check.Path, "/"), strings.NewReader(check.Body))
+	if err != nil {
+		return err
+	}
+	for name, value := range check.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expected {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s responded %d, expected %d: %s", method, check.Path, res.StatusCode, expected, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Database a check that the database answers a query
+func Database(name string, db *sql.DB) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		var one int
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			return err
+		}
+		if one != 1 {
+			return fmt.Errorf("SELECT 1 returned %d", one)
+		}
+		return nil
+	}}
+}
+
+// RoundTrip a check that a message sent through a queue is received, send sends a unique token and receive returns the next
+// message received. Messages other than the token, i.e. left over from earlier runs, are skipped
+func RoundTrip(name string, send func(ctx context.Context, token string) error, receive func(ctx context.Context) (string, error)) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		token := ids.NewString("smoke")
+		if err := send(ctx, token); err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+		for {
+			received, err := receive(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to receive: %w", err)
+			}
+			if received == token {
+				return nil
+			}
+		}
+	}}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package smoke
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunner(t *testing.T) {
+	svc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/deployments":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"message":"not found"}]}`))
+		}
+	}))
+	defer svc.Close()
+
+	queue := make(chan string, 2)
+	queue <- "left over"
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	r, err := NewRunner([]Check{
+		{Name: "deployments", HTTP: &HTTPCheck{Path: "/deployments"}},
+		{Name: "missing", HTTP: &HTTPCheck{Path: "missing", ExpectedStatus: http.StatusOK}},
+		RoundTrip("queue", func(ctx context.Context, token string) error {
+			queue <- token
+			return nil
+		}, func(ctx context.Context) (string, error) {
+			return <-queue, nil
+		}),
+		{Name: "cache", Run: func(ctx context.Context) error { return errors.New("redis unavailable") }},
+		{Name: "slow", Timeout: time.Second, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}, svc.URL+"/api/", svc.Client(), metadata.ApplicationMetadata{Name: "deploy-engine", Version: "1.2.3"}, zap.NewNop().Sugar(), fake)
+	require.NoError(t, err)
+	assert.Nil(t, r.Last())
+
+	reports := make(chan Report)
+	go func() { reports <- r.Run(context.Background(), TriggerManual) }()
+	fake.BlockUntil(5)
+	fake.Advance(time.Second)
+	report := <-reports
+
+	assert.Equal(t, StatusFailed, report.Status)
+	assert.Equal(t, TriggerManual, report.Trigger)
+	assert.Equal(t, "deploy-engine", report.Application)
+	assert.Equal(t, "1.2.3", report.Version)
+	require.Len(t, report.Checks, 5)
+	statuses := map[string]Status{}
+	for _, result := range report.Checks {
+		statuses[result.Name] = result.Status
+	}
+	assert.Equal(t, map[string]Status{
+		"deployments": StatusPassed,
+		"missing":     StatusFailed,
+		"queue":       StatusPassed,
+		"cache":       StatusFailed,
+		"slow":        StatusTimedOut,
+	}, statuses)
+	assert.Equal(t, `GET missing responded 404, expected 200: {"errors":[{"message":"not found"}]}`, report.Checks[1].Error)
+	assert.Equal(t, "did not finish within 1s", report.Checks[4].Error)
+	assert.Equal(t, &report, r.Last())
+}
+
+func TestNewRunnerValidation(t *testing.T) {
+	run := func(ctx context.Context) error { return nil }
+	for name, checks := range map[string][]Check{
+		"unnamed":       {{Run: run}},
+		"nothing to do": {{Name: "a"}},
+		"both":          {{Name: "a", Run: run, HTTP: &HTTPCheck{Path: "/"}}},
+		"duplicate":     {{Name: "a", Run: run}, {Name: "a", Run: run}},
+		"no base url":   {{Name: "a", HTTP: &HTTPCheck{Path: "/"}}},
+	} {
+		_, err := NewRunner(checks, "", nil, metadata.ApplicationMetadata{}, zap.NewNop().Sugar(), nil)
+		assert.Error(t, err, name)
+	}
+}
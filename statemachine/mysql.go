@@ -0,0 +1,87 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package statemachine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/armory-io/go-commons/mysql"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"strings"
+)
+
+type (
+	// MySQLTable the table and columns the state of entities is kept in
+	MySQLTable struct {
+		Name string
+		// IDColumn defaults to id
+		IDColumn string
+		// StateColumn defaults to state
+		StateColumn string
+	}
+
+	// MySQLPersister persists transitions with a conditional update, in a transaction scope that joins the transaction of the context if
+	// there is one. Actions run in the same transaction scope
+	MySQLPersister[S ~string] struct {
+		builder mysql.TransactionScopeBuilder
+		table   MySQLTable
+		options []mysql.TransactionScopeOption
+	}
+)
+
+// NewMySQLPersister creates the persister of the table, the options are applied to the transaction scopes, see mysql.WithRetry
+func NewMySQLPersister[S ~string](builder mysql.TransactionScopeBuilder, table MySQLTable, options ...mysql.TransactionScopeOption) *MySQLPersister[S] {
+	if table.IDColumn == "" {
+		table.IDColumn = "id"
+	}
+	if table.StateColumn == "" {
+		table.StateColumn = "state"
+	}
+	return &MySQLPersister[S]{builder: builder, table: table, options: options}
+}
+
+func (p *MySQLPersister[S]) Persist(ctx context.Context, id string, from S, to S, apply func(ctx context.Context) error) error {
+	scope, err := p.builder(ctx, sql.LevelDefault, p.options...)
+	if err != nil {
+		return err
+	}
+	return scope(func(ctx context.Context, exec boil.ContextExecutor) error {
+		// the update locks the row, so concurrent transitions of the entity wait for this one and then find it moved
+		result, err := exec.ExecContext(ctx, p.updateQuery(), string(to), id, string(from))
+		if err != nil {
+			return fmt.Errorf("statemachine: failed to persist %s %s from %s to %s: %w", p.table.Name, id, from, to, err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return fmt.Errorf("%w: %s %s is no longer %s", ErrStaleState, p.table.Name, id, from)
+		}
+		return apply(ctx)
+	})
+}
+
+func (p *MySQLPersister[S]) updateQuery() string {
+	return fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ? AND %s = ?",
+		quote(p.table.Name), quote(p.table.StateColumn), quote(p.table.IDColumn), quote(p.table.StateColumn))
+}
+
+func quote(identifier string) string {
+	return "`" + strings.ReplaceAll(identifier, "`", "``") + "`"
+}
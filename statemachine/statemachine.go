@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package statemachine moves entities such as deployments or pipeline stages between states through declared transitions,
+// instead of each service hand-rolling its status checks:
+//
+//	machine, err := statemachine.New(statemachine.Config[Status, Event, Deployment]{
+//		Transitions: []statemachine.Transition[Status, Event, Deployment]{
+//			{From: []Status{Pending}, Event: Start, To: Running, Action: startDeployment},
+//			{From: []Status{Running}, Event: Finish, To: Succeeded},
+//			{From: []Status{Pending, Running}, Event: Cancel, To: Cancelled, Guard: cancellable},
+//		},
+//		State:     func(d *Deployment) Status { return d.Status },
+//		SetState:  func(d *Deployment, s Status) { d.Status = s },
+//		ID:        func(d *Deployment) string { return d.ID },
+//		Persister: statemachine.NewMySQLPersister[Status](builder, statemachine.MySQLTable{Name: "deployments", StateColumn: "status"}),
+//	})
+//
+//	err = machine.Fire(ctx, deployment, Cancel)
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidTransition the entity has no transition for the event in its current state
+	ErrInvalidTransition = errors.New("statemachine: invalid transition")
+	// ErrGuardRejected the guard of the transition rejected it
+	ErrGuardRejected = errors.New("statemachine: transition rejected")
+	// ErrStaleState the persisted entity was no longer in the state the transition started from, it was moved concurrently
+	ErrStaleState = errors.New("statemachine: entity state changed concurrently")
+)
+
+type (
+	// Transition moves entities in one of the From states to the To state when Event is fired
+	Transition[S comparable, E comparable, T any] struct {
+		From  []S
+		Event E
+		To    S
+		// Guard rejects the transition when it returns an error, before anything is persisted
+		Guard func(ctx context.Context, entity *T) error
+		// Action runs with the transition, in the same transaction as the new state is persisted in when the persister is transactional.
+		// The transition fails and nothing is persisted if it returns an error
+		Action func(ctx context.Context, entity *T, change Change[S, E]) error
+	}
+
+	// Change a transition of an entity
+	Change[S comparable, E comparable] struct {
+		From  S
+		Event E
+		To    S
+	}
+
+	// Persister persists the new state of entities
+	Persister[S comparable] interface {
+		// Persist moves the entity with the id from one state to the other and calls apply, atomically, and fails with ErrStaleState when
+		// the entity is no longer in from
+		Persist(ctx context.Context, id string, from S, to S, apply func(ctx context.Context) error) error
+	}
+
+	Config[S comparable, E comparable, T any] struct {
+		Transitions []Transition[S, E, T]
+		// State reads the state of an entity
+		State func(entity *T) S
+		// SetState sets the state of an entity once the transition is persisted
+		SetState func(entity *T, state S)
+		// ID the id of an entity, required with a Persister
+		ID func(entity *T) string
+		// Persister persists transitions, entities are only changed in memory without one
+		Persister Persister[S]
+		// OnTransition is called after every transition was persisted, i.e. to publish events
+		OnTransition func(ctx context.Context, entity *T, change Change[S, E])
+	}
+
+	// Machine fires events on entities
+	Machine[S comparable, E comparable, T any] struct {
+		config      Config[S, E, T]
+		transitions map[S]map[E]*Transition[S, E, T]
+	}
+
+	noopPersister[S comparable] struct{}
+)
+
+// New creates the machine of the configuration, transitions must not overlap
+func New[S comparable, E comparable, T any](config Config[S, E, T]) (*Machine[S, E, T], error) {
+	if config.State == nil || config.SetState == nil {
+		return nil, errors.New("statemachine: State and SetState are required")
+	}
+	if config.Persister == nil {
+		config.Persister = noopPersister[S]{}
+	} else if config.ID == nil {
+		return nil, errors.New("statemachine: ID is required with a Persister")
+	}
+
+	m := &Machine[S, E, T]{config: config, transitions: map[S]map[E]*Transition[S, E, T]{}}
+	for i := range config.Transitions {
+		t := &config.Transitions[i]
+		if len(t.From) == 0 {
+			return nil, fmt.Errorf("statemachine: transition %v to %v has no From states", t.Event, t.To)
+		}
+		for _, from := range t.From {
+			if m.transitions[from] == nil {
+				m.transitions[from] = map[E]*Transition[S, E, T]{}
+			}
+			if _, exists := m.transitions[from][t.Event]; exists {
+				return nil, fmt.Errorf("statemachine: more than one transition for %v from %v", t.Event, from)
+			}
+			m.transitions[from][t.Event] = t
+		}
+	}
+	return m, nil
+}
+
+// Can whether an entity in the state has a transition for the event, guards aren't checked
+func (m *Machine[S, E, T]) Can(state S, event E) bool {
+	_, ok := m.transitions[state][event]
+	return ok
+}
+
+// Events the events that have a transition from the state, in the order the transitions were declared
+func (m *Machine[S, E, T]) Events(state S) []E {
+	var events []E
+	for _, t := range m.config.Transitions {
+		for _, from := range t.From {
+			if from == state {
+				events = append(events, t.Event)
+			}
+		}
+	}
+	return events
+}
+
+// Fire moves the entity through the transition of the event from its state: the guard is checked, then the new state is persisted
+// along with the action, and finally the state of the entity is set and OnTransition is called. The entity is left unchanged when
+// any step fails
+func (m *Machine[S, E, T]) Fire(ctx context.Context, entity *T, event E) error {
+	from := m.config.State(entity)
+	t, ok := m.transitions[from][event]
+	if !ok {
+		return fmt.Errorf("%w: no transition for %v from %v", ErrInvalidTransition, event, from)
+	}
+	if t.Guard != nil {
+		if err := t.Guard(ctx, entity); err != nil {
+			return fmt.Errorf("%w: %v from %v: %w", ErrGuardRejected, event, from, err)
+		}
+	}
+
+	change := Change[S, E]{From: from, Event: event, To: t.To}
+	var id string
+	if m.config.ID != nil {
+		id = m.config.ID(entity)
+	}
+	if err := m.config.Persister.Persist(ctx, id, from, t.To, func(ctx context.Context) error {
+		if t.Action == nil {
+			return nil
+		}
+		return t.Action(ctx, entity, change)
+	}); err != nil {
+		return err
+	}
+
+	m.config.SetState(entity, t.To)
+	if m.config.OnTransition != nil {
+		m.config.OnTransition(ctx, entity, change)
+	}
+	return nil
+}
+
+func (noopPersister[S]) Persist(ctx context.Context, _ string, _ S, _ S, apply func(ctx context.Context) error) error {
+	return apply(ctx)
+}
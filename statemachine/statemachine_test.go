@@ -0,0 +1,223 @@
+package statemachine
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type (
+	status string
+	event  string
+
+	deployment struct {
+		ID     string
+		Status status
+		Force  bool
+	}
+)
+
+const (
+	pending   status = "PENDING"
+	running   status = "RUNNING"
+	succeeded status = "SUCCEEDED"
+	cancelled status = "CANCELLED"
+
+	start  event = "start"
+	finish event = "finish"
+	cancel event = "cancel"
+)
+
+func newMachine(t *testing.T, persister Persister[status], action func(ctx context.Context, d *deployment, change Change[status, event]) error) (*Machine[status, event, deployment], *[]Change[status, event]) {
+	var changes []Change[status, event]
+	m, err := New(Config[status, event, deployment]{
+		Transitions: []Transition[status, event, deployment]{
+			{From: []status{pending}, Event: start, To: running, Action: action},
+			{From: []status{running}, Event: finish, To: succeeded},
+			{From: []status{pending, running}, Event: cancel, To: cancelled, Guard: func(_ context.Context, d *deployment) error {
+				if d.Status == running && !d.Force {
+					return errors.New("running deployments can only be cancelled by force")
+				}
+				return nil
+			}},
+		},
+		State:     func(d *deployment) status { return d.Status },
+		SetState:  func(d *deployment, s status) { d.Status = s },
+		ID:        func(d *deployment) string { return d.ID },
+		Persister: persister,
+		OnTransition: func(_ context.Context, _ *deployment, change Change[status, event]) {
+			changes = append(changes, change)
+		},
+	})
+	require.NoError(t, err)
+	return m, &changes
+}
+
+func TestFire(t *testing.T) {
+	m, changes := newMachine(t, nil, nil)
+	d := &deployment{ID: "d-1", Status: pending}
+
+	assert.True(t, m.Can(pending, start))
+	assert.False(t, m.Can(succeeded, cancel))
+	assert.Equal(t, []event{start, cancel}, m.Events(pending))
+
+	require.NoError(t, m.Fire(context.Background(), d, start))
+	assert.Equal(t, running, d.Status)
+
+	err := m.Fire(context.Background(), d, start)
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	assert.Equal(t, running, d.Status)
+
+	err = m.Fire(context.Background(), d, cancel)
+	assert.ErrorIs(t, err, ErrGuardRejected)
+	assert.ErrorContains(t, err, "only be cancelled by force")
+	assert.Equal(t, running, d.Status)
+
+	d.Force = true
+	require.NoError(t, m.Fire(context.Background(), d, cancel))
+	assert.Equal(t, cancelled, d.Status)
+	assert.Equal(t, []Change[status, event]{{From: pending, Event: start, To: running}, {From: running, Event: cancel, To: cancelled}}, *changes)
+}
+
+func TestFailedActionLeavesEntityUnchanged(t *testing.T) {
+	m, changes := newMachine(t, nil, func(context.Context, *deployment, Change[status, event]) error {
+		return errors.New("no capacity")
+	})
+	d := &deployment{ID: "d-1", Status: pending}
+
+	assert.EqualError(t, m.Fire(context.Background(), d, start), "no capacity")
+	assert.Equal(t, pending, d.Status)
+	assert.Empty(t, *changes)
+}
+
+func TestNewValidatesTransitions(t *testing.T) {
+	config := Config[status, event, deployment]{
+		Transitions: []Transition[status, event, deployment]{
+			{From: []status{pending}, Event: start, To: running},
+			{From: []status{running, pending}, Event: start, To: succeeded},
+		},
+		State:    func(d *deployment) status { return d.Status },
+		SetState: func(d *deployment, s status) { d.Status = s },
+	}
+	_, err := New(config)
+	assert.EqualError(t, err, "statemachine: more than one transition for start from PENDING")
+
+	config.Transitions = config.Transitions[:1]
+	config.Persister = noopPersister[status]{}
+	_, err = New(config)
+	assert.EqualError(t, err, "statemachine: ID is required with a Persister")
+}
+
+func TestMySQLPersister(t *testing.T) {
+	db, rows := newStatesDB(t, map[string]string{"d-1": string(pending), "d-2": string(pending)})
+	builder := mysql.NewTransactionScopeBuilder(mysql.TransactionScopeParameters{DB: db, Log: zap.NewNop().Sugar()})
+	persister := NewMySQLPersister[status](builder, MySQLTable{Name: "deployments", StateColumn: "status"})
+	assert.Equal(t, "UPDATE `deployments` SET `status` = ? WHERE `id` = ? AND `status` = ?", persister.updateQuery())
+
+	var joined bool
+	m, _ := newMachine(t, persister, func(ctx context.Context, d *deployment, _ Change[status, event]) error {
+		if d.ID == "d-2" {
+			return errors.New("no capacity")
+		}
+		// scopes built in actions join the transaction of the transition
+		scope, err := builder(ctx, sql.LevelDefault)
+		if err != nil {
+			return err
+		}
+		return scope(func(context.Context, boil.ContextExecutor) error {
+			joined = true
+			return nil
+		})
+	})
+
+	d := &deployment{ID: "d-1", Status: pending}
+	require.NoError(t, m.Fire(context.Background(), d, start))
+	assert.Equal(t, running, d.Status)
+	assert.True(t, joined)
+	assert.Equal(t, string(running), rows.get("d-1"))
+	assert.Equal(t, int32(1), rows.begins.Load(), "the action ran in the transaction of the transition")
+
+	failed := &deployment{ID: "d-2", Status: pending}
+	assert.EqualError(t, m.Fire(context.Background(), failed, start), "no capacity")
+	assert.Equal(t, string(pending), rows.get("d-2"), "the update is rolled back when the action fails")
+
+	stale := &deployment{ID: "d-1", Status: pending}
+	assert.ErrorIs(t, m.Fire(context.Background(), stale, start), ErrStaleState)
+	assert.Equal(t, pending, stale.Status)
+}
+
+// statesDriver a database/sql driver that only runs the update of MySQLPersister against a map of ids to states
+type (
+	statesDriver struct {
+		mu     sync.Mutex
+		states map[string]string
+		begins atomic.Int32
+	}
+	statesConn struct {
+		d       *statesDriver
+		pending map[string]string
+	}
+	statesTx struct{ c *statesConn }
+)
+
+var driverCount atomic.Int32
+
+func newStatesDB(t *testing.T, states map[string]string) (*sql.DB, *statesDriver) {
+	d := &statesDriver{states: states}
+	name := fmt.Sprintf("states-%d", driverCount.Add(1))
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db, d
+}
+
+func (d *statesDriver) get(id string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.states[id]
+}
+
+func (d *statesDriver) Open(string) (driver.Conn, error) { return &statesConn{d: d}, nil }
+
+func (c *statesConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *statesConn) Close() error                        { return nil }
+func (c *statesConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+func (c *statesConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.d.begins.Add(1)
+	c.pending = map[string]string{}
+	return statesTx{c}, nil
+}
+
+func (c *statesConn) ExecContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Result, error) {
+	to, id, from := args[0].Value.(string), args[1].Value.(string), args[2].Value.(string)
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.states[id] != from {
+		return driver.RowsAffected(0), nil
+	}
+	c.pending[id] = to
+	return driver.RowsAffected(1), nil
+}
+
+func (t statesTx) Commit() error {
+	t.c.d.mu.Lock()
+	defer t.c.d.mu.Unlock()
+	for id, state := range t.c.pending {
+		t.c.d.states[id] = state
+	}
+	return nil
+}
+func (t statesTx) Rollback() error { return nil }
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package stepup
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/securecookie"
+	"github.com/armory-io/go-commons/server"
+	"github.com/armory-io/go-commons/server/serr"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultChallengeTimeout = 2 * time.Minute
+	defaultMaxAge           = 15 * time.Minute
+)
+
+type (
+	Configuration struct {
+		// RPID the relying party id credentials are scoped to, the domain of the origins or a registrable suffix of it, ex: cloud.armory.io
+		RPID string
+		// RPName the name of the relying party authenticators show, defaults to RPID
+		RPName string
+		// Origins the origins ceremonies can be performed from, ex: https://console.cloud.armory.io
+		Origins []string
+		// RequireUserVerification requires authenticators to verify the user with a PIN or biometrics rather than only their presence
+		RequireUserVerification bool
+		// ChallengeTimeout how long a ceremony can take, defaults to 2 minutes
+		ChallengeTimeout time.Duration
+		// MaxAge how long a step-up token is accepted after the assertion it was issued for, defaults to 15 minutes
+		MaxAge time.Duration
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config      Configuration
+		Credentials CredentialStore
+		Challenges  ChallengeStore `optional:"true"`
+		Codec       *securecookie.Codec
+		Clock       clock.Clock `optional:"true"`
+	}
+
+	controller struct {
+		service *Service
+		log     *zap.SugaredLogger
+	}
+)
+
+// Module provides the Service as the server.StepUpVerifier and the controller of its ceremonies. It requires a CredentialStore and
+// the securecookie.Module, whose keys seal the step-up tokens
+var Module = fx.Module(
+	"stepup",
+	fx.Provide(
+		New,
+		func(s *Service) server.StepUpVerifier { return s },
+		NewController,
+	),
+)
+
+func New(p Parameters) (*Service, error) {
+	return NewService(p.Config, p.Challenges, p.Credentials, p.Codec, p.Clock)
+}
+
+// NewController serves the registration and assertion ceremonies under step-up/webauthn, both start with a POST to options and
+// finish with a POST of the response of the authenticator
+func NewController(service *Service, log *zap.SugaredLogger) server.Controller {
+	return server.Controller{Controller: &controller{service: service, log: log}}
+}
+
+func (c *controller) Prefix() string {
+	return "/step-up/webauthn"
+}
+
+func (c *controller) Handlers() []server.Handler {
+	return []server.Handler{
+		server.NewHandler(c.beginRegistration, server.HandlerConfig{
+			Path:   "registrations/options",
+			Method: http.MethodPost,
+		}),
+		server.NewHandler(c.finishRegistration, server.HandlerConfig{
+			Path:       "registrations",
+			Method:     http.MethodPost,
+			StatusCode: http.StatusCreated,
+		}),
+		server.NewHandler(c.beginAssertion, server.HandlerConfig{
+			Path:   "assertions/options",
+			Method: http.MethodPost,
+		}),
+		server.NewHandler(c.finishAssertion, server.HandlerConfig{
+			Path:   "assertions",
+			Method: http.MethodPost,
+		}),
+	}
+}
+
+func (c *controller) beginRegistration(ctx context.Context, _ server.Void) (*server.Response[CreationOptions], serr.Error) {
+	options, err := c.service.BeginRegistration(ctx)
+	if err != nil {
+		return nil, c.toError(err)
+	}
+	return server.SimpleResponse(*options), nil
+}
+
+func (c *controller) finishRegistration(ctx context.Context, r RegistrationResponse) (*server.Response[CredentialDescriptor], serr.Error) {
+	credential, err := c.service.FinishRegistration(ctx, r)
+	if err != nil {
+		return nil, c.toError(err)
+	}
+	return server.SimpleResponse(CredentialDescriptor{Type: publicKeyType, ID: credential.ID}), nil
+}
+
+func (c *controller) beginAssertion(ctx context.Context, _ server.Void) (*server.Response[RequestOptions], serr.Error) {
+	options, err := c.service.BeginAssertion(ctx)
+	if err != nil {
+		return nil, c.toError(err)
+	}
+	return server.SimpleResponse(*options), nil
+}
+
+func (c *controller) finishAssertion(ctx context.Context, r AssertionResponse) (*server.Response[Token], serr.Error) {
+	token, err := c.service.FinishAssertion(ctx, r)
+	if err != nil {
+		return nil, c.toError(err)
+	}
+	return server.SimpleResponse(*token), nil
+}
+
+// toError doesn't tell clients why a response couldn't be verified, the reason is logged
+func (c *controller) toError(err error) serr.Error {
+	switch {
+	case errors.Is(err, ErrVerificationFailed):
+		c.log.Infow("Rejected a WebAuthn response", "error", err)
+		return serr.NewSimpleErrorWithStatusCode("The WebAuthn response couldn't be verified", http.StatusBadRequest, err)
+	case errors.Is(err, ErrNotAUser), errors.Is(err, ErrImpersonated), errors.Is(err, iam.ErrNoPrincipal):
+		return serr.NewSimpleErrorWithStatusCode(err.Error(), http.StatusForbidden, err)
+	default:
+		return serr.NewSimpleError("Failed to perform the WebAuthn ceremony", err)
+	}
+}
@@ -0,0 +1,500 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package stepup lets handlers of dangerous actions require a recent WebAuthn assertion, a security key or platform
+// authenticator, on top of the bearer token of the request.
+//
+// Principals register credentials and assert them with the ceremonies of the controller, a successful assertion returns a
+// step-up token that's sent along with the X-Armory-Step-Up header. The Service verifies the header of every request and
+// records the step-up onto the principal in its context, and handlers require it with Service.Require:
+//
+//	server.NewHandler(c.rotateKeys, server.HandlerConfig{
+//		Path:                   "keys/rotate",
+//		Method:                 http.MethodPost,
+//		AuthZValidatorExtended: stepUp.Require(5 * time.Minute),
+//	})
+package stepup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/securecookie"
+	"github.com/armory-io/go-commons/server"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+const (
+	// Header the request header carrying a step-up token
+	Header = "X-Armory-Step-Up"
+	// MethodWebAuthn the iam.StepUp method of WebAuthn assertions
+	MethodWebAuthn = "webauthn"
+
+	tokenName     = "armory-step-up"
+	challengeSize = 32
+	publicKeyType = "public-key"
+)
+
+var (
+	// ErrNotAUser step-up requires a user principal, machines can't perform ceremonies
+	ErrNotAUser = errors.New("step-up authentication is only available to users")
+	// ErrImpersonated step-up authentication can't be performed or used on behalf of another principal
+	ErrImpersonated = errors.New("step-up authentication isn't available to impersonated principals")
+	// ErrStepUpExpired the step-up token is older than Configuration.MaxAge
+	ErrStepUpExpired = errors.New("the step-up authentication has expired")
+	// ErrOtherPrincipal the step-up token was issued to another principal
+	ErrOtherPrincipal = errors.New("the step-up token was issued to another principal")
+)
+
+type (
+	// Service performs the ceremonies of WebAuthn credentials and verifies the step-up tokens of requests, it's a server.StepUpVerifier
+	Service struct {
+		rpID             string
+		rpName           string
+		origins          map[string]bool
+		userVerification bool
+		challengeTimeout time.Duration
+		maxAge           time.Duration
+		challenges       ChallengeStore
+		credentials      CredentialStore
+		codec            *securecookie.Codec
+		clock            clock.Clock
+	}
+
+	RelyingParty struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	User struct {
+		ID          URLEncoded `json:"id"`
+		Name        string     `json:"name"`
+		DisplayName string     `json:"displayName"`
+	}
+
+	CredentialParameters struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	}
+
+	CredentialDescriptor struct {
+		Type string     `json:"type"`
+		ID   URLEncoded `json:"id"`
+	}
+
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+
+	// CreationOptions the options of navigator.credentials.create() for a registration, see PublicKeyCredential.parseCreationOptionsFromJSON()
+	CreationOptions struct {
+		Challenge              URLEncoded             `json:"challenge"`
+		RP                     RelyingParty           `json:"rp"`
+		User                   User                   `json:"user"`
+		PubKeyCredParams       []CredentialParameters `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+		Attestation            string                 `json:"attestation"`
+	}
+
+	// RequestOptions the options of navigator.credentials.get() for an assertion, see PublicKeyCredential.parseRequestOptionsFromJSON()
+	RequestOptions struct {
+		Challenge        URLEncoded             `json:"challenge"`
+		Timeout          int64                  `json:"timeout"`
+		RPID             string                 `json:"rpId"`
+		AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+		UserVerification string                 `json:"userVerification"`
+	}
+
+	// RegistrationResponse the credential created by the authenticator, as encoded by PublicKeyCredential.toJSON()
+	RegistrationResponse struct {
+		RawID    URLEncoded `json:"rawId" validate:"required"`
+		Type     string     `json:"type" validate:"eq=public-key"`
+		Response struct {
+			ClientDataJSON    URLEncoded `json:"clientDataJSON" validate:"required"`
+			AttestationObject URLEncoded `json:"attestationObject" validate:"required"`
+		} `json:"response"`
+	}
+
+	// AssertionResponse the assertion of the authenticator, as encoded by PublicKeyCredential.toJSON()
+	AssertionResponse struct {
+		RawID    URLEncoded `json:"rawId" validate:"required"`
+		Type     string     `json:"type" validate:"eq=public-key"`
+		Response struct {
+			ClientDataJSON    URLEncoded `json:"clientDataJSON" validate:"required"`
+			AuthenticatorData URLEncoded `json:"authenticatorData" validate:"required"`
+			Signature         URLEncoded `json:"signature" validate:"required"`
+			UserHandle        URLEncoded `json:"userHandle,omitempty"`
+		} `json:"response"`
+	}
+
+	// Token a step-up token to send with the Header until it expires
+	Token struct {
+		Token     string     `json:"token"`
+		ExpiresAt time.Time  `json:"expiresAt"`
+		StepUp    iam.StepUp `json:"stepUp"`
+	}
+
+	sealedStepUp struct {
+		User   string     `json:"user"`
+		StepUp iam.StepUp `json:"stepUp"`
+	}
+)
+
+var _ server.StepUpVerifier = (*Service)(nil)
+
+// NewService creates a Service outside of fx, challenges may be nil to use an in memory store and c nil to use the real clock.
+// Tokens are sealed with the codec, so they're valid on every replica that shares its keys
+func NewService(config Configuration, challenges ChallengeStore, credentials CredentialStore, codec *securecookie.Codec, c clock.Clock) (*Service, error) {
+	if config.RPID == "" || len(config.Origins) == 0 {
+		return nil, errors.New("stepup.rpId and stepup.origins are required")
+	}
+	if credentials == nil || codec == nil {
+		return nil, errors.New("step-up authentication requires a CredentialStore and a securecookie.Codec")
+	}
+	s := &Service{
+		rpID:             config.RPID,
+		rpName:           config.RPName,
+		origins:          make(map[string]bool, len(config.Origins)),
+		userVerification: config.RequireUserVerification,
+		challengeTimeout: config.ChallengeTimeout,
+		maxAge:           config.MaxAge,
+		challenges:       challenges,
+		credentials:      credentials,
+		codec:            codec,
+		clock:            clock.OrDefault(c),
+	}
+	for _, origin := range config.Origins {
+		s.origins[origin] = true
+	}
+	if s.rpName == "" {
+		s.rpName = s.rpID
+	}
+	if s.challengeTimeout <= 0 {
+		s.challengeTimeout = defaultChallengeTimeout
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultMaxAge
+	}
+	if s.challenges == nil {
+		s.challenges = NewInMemoryChallengeStore(s.clock)
+	}
+	return s, nil
+}
+
+// UserOf the key credentials are registered under for the principal, its subject within its org
+func UserOf(p *iam.ArmoryCloudPrincipal) string {
+	subject := p.Subject
+	if subject == "" {
+		subject = p.Name
+	}
+	return p.OrgId + "/" + subject
+}
+
+// BeginRegistration starts the registration of a credential by the principal of the context
+func (s *Service) BeginRegistration(ctx context.Context) (*CreationOptions, error) {
+	p, user, err := principalOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := s.credentials.Credentials(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := s.newChallenge(ctx, ceremonyCreate, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// the user handle is returned by authenticators so it's a hash rather than the email address of the user
+	handle := sha256.Sum256([]byte(user))
+	options := &CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingParty{ID: s.rpID, Name: s.rpName},
+		User:               User{ID: handle[:], Name: p.Name, DisplayName: p.Name},
+		Timeout:            s.challengeTimeout.Milliseconds(),
+		ExcludeCredentials: descriptors(credentials),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "discouraged",
+			UserVerification: s.userVerificationRequirement(),
+		},
+		Attestation: "none",
+	}
+	for _, alg := range supportedAlgorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, CredentialParameters{Type: publicKeyType, Alg: alg})
+	}
+	return options, nil
+}
+
+// FinishRegistration verifies the credential created by the authenticator and stores it
+func (s *Service) FinishRegistration(ctx context.Context, r RegistrationResponse) (*Credential, error) {
+	_, user, err := principalOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.takeChallenge(ctx, r.Response.ClientDataJSON, ceremonyCreate, user); err != nil {
+		return nil, err
+	}
+	rawAuthData, err := parseAttestationObject(r.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := s.parseAuthenticatorData(rawAuthData, true)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ad.credentialID, r.RawID) {
+		return nil, verificationFailed("the attested credential isn't the one of the response")
+	}
+	_, alg, err := parsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := s.credentials.Credentials(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := find(credentials, ad.credentialID); ok {
+		return nil, verificationFailed("the credential is already registered")
+	}
+	credential := Credential{
+		ID:        append(URLEncoded(nil), ad.credentialID...),
+		User:      user,
+		PublicKey: append([]byte(nil), ad.publicKey...),
+		Algorithm: alg,
+		SignCount: ad.signCount,
+		CreatedAt: s.clock.Now(),
+	}
+	if err := s.credentials.Save(ctx, credential); err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// BeginAssertion starts an assertion with one of the credentials registered by the principal of the context
+func (s *Service) BeginAssertion(ctx context.Context) (*RequestOptions, error) {
+	_, user, err := principalOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := s.credentials.Credentials(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, verificationFailed("the principal hasn't registered a credential")
+	}
+	challenge, err := s.newChallenge(ctx, ceremonyGet, user)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          s.challengeTimeout.Milliseconds(),
+		RPID:             s.rpID,
+		AllowCredentials: descriptors(credentials),
+		UserVerification: s.userVerificationRequirement(),
+	}, nil
+}
+
+// FinishAssertion verifies the assertion of the authenticator and returns a step-up token for the principal of the context
+func (s *Service) FinishAssertion(ctx context.Context, r AssertionResponse) (*Token, error) {
+	_, user, err := principalOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.takeChallenge(ctx, r.Response.ClientDataJSON, ceremonyGet, user); err != nil {
+		return nil, err
+	}
+	credentials, err := s.credentials.Credentials(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	credential, ok := find(credentials, r.RawID)
+	if !ok {
+		return nil, verificationFailed("the credential isn't registered by the principal")
+	}
+	ad, err := s.parseAuthenticatorData(r.Response.AuthenticatorData, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(credential.PublicKey, r.Response.AuthenticatorData, r.Response.ClientDataJSON, r.Response.Signature); err != nil {
+		return nil, err
+	}
+	// authenticators that count signatures must always increase the count, a lower one means the credential was cloned
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return nil, verificationFailed("the signature count didn't increase, the credential may have been cloned")
+	}
+
+	now := s.clock.Now()
+	credential.SignCount = ad.signCount
+	credential.LastUsedAt = now
+	if err := s.credentials.Save(ctx, credential); err != nil {
+		return nil, err
+	}
+
+	stepUp := iam.StepUp{
+		Method:          MethodWebAuthn,
+		CredentialID:    credential.ID.String(),
+		AuthenticatedAt: now,
+		UserVerified:    ad.flags&flagUserVerified != 0,
+	}
+	token, err := s.codec.Encode(tokenName, sealedStepUp{User: user, StepUp: stepUp})
+	if err != nil {
+		return nil, err
+	}
+	return &Token{Token: token, ExpiresAt: now.Add(s.maxAge), StepUp: stepUp}, nil
+}
+
+// VerifyStepUp records the step-up token of the request onto its principal, requests without the Header are left as they are
+func (s *Service) VerifyStepUp(c *gin.Context) error {
+	token := c.GetHeader(Header)
+	if token == "" {
+		return nil
+	}
+	ctx := c.Request.Context()
+	_, user, err := principalOf(ctx)
+	if err != nil {
+		return err
+	}
+	var sealed sealedStepUp
+	if err := s.codec.Decode(tokenName, token, &sealed); err != nil {
+		return err
+	}
+	if sealed.User != user {
+		return ErrOtherPrincipal
+	}
+	if s.clock.Since(sealed.StepUp.AuthenticatedAt) > s.maxAge {
+		return ErrStepUpExpired
+	}
+	ctx, err = iam.WithStepUp(ctx, sealed.StepUp)
+	if err != nil {
+		return err
+	}
+	c.Request = c.Request.WithContext(ctx)
+	return nil
+}
+
+// Require an AuthZValidatorExtended for handlers that the principal must have stepped up for within maxAge.
+// maxAge is capped by Configuration.MaxAge, which it defaults to
+func (s *Service) Require(maxAge time.Duration) server.AuthZValidatorV2Fn {
+	if maxAge <= 0 || maxAge > s.maxAge {
+		maxAge = s.maxAge
+	}
+	return func(_ context.Context, p *iam.ArmoryCloudPrincipal) (string, bool) {
+		if !p.SteppedUpWithin(maxAge, s.clock.Now()) {
+			return fmt.Sprintf("This action requires a step-up authentication within the last %s, send a step-up token with the %s header", maxAge, Header), false
+		}
+		if s.userVerification && !p.StepUp.UserVerified {
+			return "This action requires a step-up authentication that verified the user", false
+		}
+		return "", true
+	}
+}
+
+func (s *Service) newChallenge(ctx context.Context, ceremony string, user string) (URLEncoded, error) {
+	challenge := make(URLEncoded, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if err := s.challenges.Put(ctx, challenge.String(), Challenge{
+		Ceremony:  ceremony,
+		User:      user,
+		ExpiresAt: s.clock.Now().Add(s.challengeTimeout),
+	}); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// takeChallenge checks the client data of a response and consumes the challenge it was issued for
+func (s *Service) takeChallenge(ctx context.Context, rawClientData []byte, ceremony string, user string) error {
+	id, err := parseClientData(rawClientData, ceremony, s.origins)
+	if err != nil {
+		return err
+	}
+	// the challenge is re-encoded so that padded and unpadded encodings are the same challenge
+	decoded, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return verificationFailed("malformed challenge")
+	}
+	challenge, ok, err := s.challenges.Take(ctx, URLEncoded(decoded).String())
+	if err != nil {
+		return err
+	}
+	if !ok || challenge.Ceremony != ceremony || challenge.User != user {
+		return verificationFailed("the challenge is unknown, has expired or was issued for another ceremony")
+	}
+	return nil
+}
+
+func (s *Service) parseAuthenticatorData(raw []byte, attested bool) (*authenticatorData, error) {
+	ad, err := parseAuthenticatorData(raw, s.rpID, attested)
+	if err != nil {
+		return nil, err
+	}
+	if s.userVerification && ad.flags&flagUserVerified == 0 {
+		return nil, verificationFailed("the authenticator didn't verify the user")
+	}
+	return ad, nil
+}
+
+func (s *Service) userVerificationRequirement() string {
+	if s.userVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func principalOf(ctx context.Context) (*iam.ArmoryCloudPrincipal, string, error) {
+	p, err := iam.ExtractPrincipalFromContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.Type != iam.User {
+		return nil, "", ErrNotAUser
+	}
+	if iam.IsImpersonated(ctx) {
+		return nil, "", ErrImpersonated
+	}
+	return p, UserOf(p), nil
+}
+
+func descriptors(credentials []Credential) []CredentialDescriptor {
+	result := make([]CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		result = append(result, CredentialDescriptor{Type: publicKeyType, ID: c.ID})
+	}
+	return result
+}
+
+func find(credentials []Credential, id []byte) (Credential, bool) {
+	for _, c := range credentials {
+		if bytes.Equal(c.ID, id) {
+			return c, true
+		}
+	}
+	return Credential{}, false
+}
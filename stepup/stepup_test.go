@@ -0,0 +1,383 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package stepup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/securecookie"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testRPID   = "cloud.armory.io"
+	testOrigin = "https://console.cloud.armory.io"
+)
+
+// authenticator a software authenticator with a single ES256 credential
+type authenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+	flags     byte
+	origin    string
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &authenticator{id: []byte("credential-1"), key: key, flags: flagUserPresent | flagUserVerified, origin: testOrigin}
+}
+
+func (a *authenticator) clientData(t *testing.T, ceremony string, challenge URLEncoded) []byte {
+	raw, err := json.Marshal(clientData{Type: ceremony, Challenge: challenge.String(), Origin: a.origin})
+	require.NoError(t, err)
+	return raw
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedCredential
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, encodeCBOR(map[any]any{
+			int64(coseKeyType): int64(coseKtyEC2),
+			int64(coseAlg):     int64(AlgorithmES256),
+			int64(coseCurve):   int64(coseP256),
+			int64(coseX):       a.key.X.FillBytes(make([]byte, 32)),
+			int64(coseY):       a.key.Y.FillBytes(make([]byte, 32)),
+		})...)
+	}
+	return data
+}
+
+func (a *authenticator) create(t *testing.T, options *CreationOptions) RegistrationResponse {
+	var r RegistrationResponse
+	r.RawID = a.id
+	r.Type = publicKeyType
+	r.Response.ClientDataJSON = a.clientData(t, ceremonyCreate, options.Challenge)
+	r.Response.AttestationObject = encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": a.authData(true),
+	})
+	return r
+}
+
+func (a *authenticator) get(t *testing.T, options *RequestOptions) AssertionResponse {
+	a.signCount++
+	var r AssertionResponse
+	r.RawID = a.id
+	r.Type = publicKeyType
+	r.Response.ClientDataJSON = a.clientData(t, ceremonyGet, options.Challenge)
+	r.Response.AuthenticatorData = a.authData(false)
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), r.Response.AuthenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+	r.Response.Signature = signature
+	return r
+}
+
+// encodeCBOR encodes v with the canonical encoding authenticators use
+func encodeCBOR(v any) []byte {
+	em, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	data, err := em.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func newTestService(t *testing.T, c clock.Clock, config Configuration) *Service {
+	codec, err := securecookie.NewCodec(securecookie.Configuration{
+		PrimaryKeyID: "2023",
+		Keys:         map[string]string{"2023": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))},
+	}, c)
+	require.NoError(t, err)
+	config.RPID = testRPID
+	config.Origins = []string{testOrigin}
+	s, err := NewService(config, nil, NewInMemoryCredentialStore(), codec, c)
+	require.NoError(t, err)
+	return s
+}
+
+func userContext(subject string) context.Context {
+	return iam.DangerouslyWriteUnverifiedPrincipalToContext(context.Background(), &iam.ArmoryCloudPrincipal{
+		Type:    iam.User,
+		Name:    subject + "@armory.io",
+		Subject: subject,
+		OrgId:   "org-1",
+	})
+}
+
+func register(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+	options, err := s.BeginRegistration(ctx)
+	require.NoError(t, err)
+	_, err = s.FinishRegistration(ctx, a.create(t, options))
+	require.NoError(t, err)
+}
+
+func assertWith(t *testing.T, s *Service, ctx context.Context, a *authenticator) (*Token, error) {
+	options, err := s.BeginAssertion(ctx)
+	require.NoError(t, err)
+	return s.FinishAssertion(ctx, a.get(t, options))
+}
+
+func verify(s *Service, ctx context.Context, token string) (*iam.ArmoryCloudPrincipal, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/keys/rotate", nil).WithContext(ctx)
+	c.Request.Header.Set(Header, token)
+	if err := s.VerifyStepUp(c); err != nil {
+		return nil, err
+	}
+	p, err := iam.ExtractPrincipalFromContext(c.Request.Context())
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func TestStepUp(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestService(t, fake, Configuration{MaxAge: 10 * time.Minute})
+	ctx := userContext("alice")
+	a := newAuthenticator(t)
+
+	register(t, s, ctx, a)
+	token, err := assertWith(t, s, ctx, a)
+	require.NoError(t, err)
+	assert.Equal(t, fake.Now().Add(10*time.Minute), token.ExpiresAt)
+	assert.Equal(t, iam.StepUp{
+		Method:          MethodWebAuthn,
+		CredentialID:    URLEncoded(a.id).String(),
+		AuthenticatedAt: fake.Now(),
+		UserVerified:    true,
+	}, token.StepUp)
+
+	p, err := verify(s, ctx, token.Token)
+	require.NoError(t, err)
+	require.NotNil(t, p.StepUp)
+	assert.Equal(t, token.StepUp, *p.StepUp)
+
+	fake.Advance(6 * time.Minute)
+	_, ok := s.Require(5*time.Minute)(ctx, p)
+	assert.False(t, ok)
+	_, ok = s.Require(0)(ctx, p)
+	assert.True(t, ok)
+
+	fake.Advance(5 * time.Minute)
+	_, err = verify(s, ctx, token.Token)
+	assert.ErrorIs(t, err, ErrStepUpExpired)
+}
+
+func TestStepUpRejects(t *testing.T) {
+	cases := []struct {
+		name  string
+		check func(t *testing.T, s *Service, ctx context.Context, a *authenticator)
+	}{
+		{
+			name: "assertions from other origins",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				a.origin = "https://evil.example.com"
+				_, err := assertWith(t, s, ctx, a)
+				assert.ErrorIs(t, err, ErrVerificationFailed)
+			},
+		},
+		{
+			name: "replayed challenges",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				options, err := s.BeginAssertion(ctx)
+				require.NoError(t, err)
+				_, err = s.FinishAssertion(ctx, a.get(t, options))
+				require.NoError(t, err)
+				_, err = s.FinishAssertion(ctx, a.get(t, options))
+				assert.ErrorIs(t, err, ErrVerificationFailed)
+			},
+		},
+		{
+			name: "challenges issued to other principals",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				options, err := s.BeginAssertion(ctx)
+				require.NoError(t, err)
+				_, err = s.FinishAssertion(userContext("bob"), a.get(t, options))
+				assert.ErrorIs(t, err, ErrVerificationFailed)
+			},
+		},
+		{
+			name: "signature counts that don't increase",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				_, err := assertWith(t, s, ctx, a)
+				require.NoError(t, err)
+				a.signCount--
+				_, err = assertWith(t, s, ctx, a)
+				assert.ErrorIs(t, err, ErrVerificationFailed)
+			},
+		},
+		{
+			name: "forged signatures",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				options, err := s.BeginAssertion(ctx)
+				require.NoError(t, err)
+				r := a.get(t, options)
+				r.Response.AuthenticatorData[32] |= 0x02
+				_, err = s.FinishAssertion(ctx, r)
+				assert.ErrorIs(t, err, ErrVerificationFailed)
+			},
+		},
+		{
+			name: "tokens of other principals",
+			check: func(t *testing.T, s *Service, ctx context.Context, a *authenticator) {
+				token, err := assertWith(t, s, ctx, a)
+				require.NoError(t, err)
+				_, err = verify(s, userContext("bob"), token.Token)
+				assert.ErrorIs(t, err, ErrOtherPrincipal)
+			},
+		},
+		{
+			name: "machine principals",
+			check: func(t *testing.T, s *Service, _ context.Context, _ *authenticator) {
+				ctx := iam.DangerouslyWriteUnverifiedPrincipalToContext(context.Background(), &iam.ArmoryCloudPrincipal{Type: iam.Machine, Name: "deploy-bot"})
+				_, err := s.BeginRegistration(ctx)
+				assert.ErrorIs(t, err, ErrNotAUser)
+			},
+		},
+		{
+			name: "impersonated principals",
+			check: func(t *testing.T, s *Service, ctx context.Context, _ *authenticator) {
+				_, err := s.BeginAssertion(iam.WithImpersonation(ctx, nil))
+				assert.ErrorIs(t, err, ErrImpersonated)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestService(t, nil, Configuration{})
+			ctx := userContext("alice")
+			a := newAuthenticator(t)
+			register(t, s, ctx, a)
+			c.check(t, s, ctx, a)
+		})
+	}
+}
+
+func TestRequireUserVerification(t *testing.T) {
+	s := newTestService(t, nil, Configuration{RequireUserVerification: true})
+	ctx := userContext("alice")
+	a := newAuthenticator(t)
+	a.flags = flagUserPresent
+
+	options, err := s.BeginRegistration(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "required", options.AuthenticatorSelection.UserVerification)
+	_, err = s.FinishRegistration(ctx, a.create(t, options))
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	a := newAuthenticator(t)
+	rawKey := func(overrides map[any]any) []byte {
+		key := map[any]any{
+			int64(coseKeyType): int64(coseKtyEC2),
+			int64(coseAlg):     int64(AlgorithmES256),
+			int64(coseCurve):   int64(coseP256),
+			int64(coseX):       a.key.X.FillBytes(make([]byte, 32)),
+			int64(coseY):       a.key.Y.FillBytes(make([]byte, 32)),
+		}
+		for k, v := range overrides {
+			key[k] = v
+		}
+		return encodeCBOR(key)
+	}
+	_, alg, err := parsePublicKey(rawKey(nil))
+	require.NoError(t, err)
+	assert.Equal(t, int64(AlgorithmES256), alg)
+
+	for name, malformed := range map[string][]byte{
+		"truncated":         rawKey(nil)[:20],
+		"indefinite length": {0x5f, 0x41, 0x01, 0xff},
+		"duplicate keys":    {0xa2, 0x01, 0x02, 0x01, 0x02},
+		"other curve":       rawKey(map[any]any{int64(coseCurve): int64(2)}),
+		"off the curve":     rawKey(map[any]any{int64(coseY): make([]byte, 32)}),
+		"short RSA key":     encodeCBOR(map[any]any{int64(coseKeyType): int64(coseKtyRSA), int64(coseAlg): int64(AlgorithmRS256), int64(coseRSAN): make([]byte, 128), int64(coseRSAE): []byte{1, 0, 1}}),
+		"RSA exponent":      encodeCBOR(map[any]any{int64(coseKeyType): int64(coseKtyRSA), int64(coseAlg): int64(AlgorithmRS256), int64(coseRSAN): make([]byte, 256), int64(coseRSAE): []byte{3}}),
+		"unsupported":       rawKey(map[any]any{int64(coseAlg): int64(-35)}),
+	} {
+		_, _, err := parsePublicKey(malformed)
+		assert.ErrorIs(t, err, ErrVerificationFailed, name)
+	}
+}
+
+func FuzzParseAuthenticatorData(f *testing.F) {
+	a := &authenticator{id: []byte("credential-1"), key: &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: elliptic.P256().Params().Gx, Y: elliptic.P256().Params().Gy}}, flags: flagUserPresent}
+	f.Add(a.authData(true), true)
+	f.Add(a.authData(false), false)
+	f.Fuzz(func(t *testing.T, raw []byte, attested bool) {
+		ad, err := parseAuthenticatorData(raw, testRPID, attested)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrVerificationFailed)
+			return
+		}
+		if attested {
+			_, _, _ = parsePublicKey(ad.publicKey)
+		}
+	})
+}
+
+func FuzzParsePublicKey(f *testing.F) {
+	a := &authenticator{id: []byte("credential-1"), key: &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: elliptic.P256().Params().Gx, Y: elliptic.P256().Params().Gy}}, flags: flagUserPresent}
+	f.Add(a.authData(true)[55+len(a.id):])
+	f.Add(encodeCBOR(map[any]any{int64(coseKeyType): int64(coseKtyRSA), int64(coseAlg): int64(AlgorithmRS256), int64(coseRSAN): make([]byte, 256), int64(coseRSAE): []byte{1, 0, 1}}))
+	f.Add(encodeCBOR(map[any]any{int64(coseKeyType): int64(coseKtyOKP), int64(coseAlg): int64(AlgorithmEdDSA), int64(coseCurve): int64(coseEd25519), int64(coseX): make([]byte, 32)}))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		key, _, err := parsePublicKey(raw)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrVerificationFailed)
+			return
+		}
+		// a key that parsed must be usable without panicking
+		_, _ = webauthncose.VerifySignature(key, raw, raw)
+	})
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package stepup
+
+import (
+	"bytes"
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"sync"
+	"time"
+)
+
+const inMemorySweepInterval = time.Minute
+
+type (
+	// Challenge a ceremony in progress, challenges are single use and expire after Configuration.ChallengeTimeout
+	Challenge struct {
+		// Ceremony webauthn.create for registrations and webauthn.get for assertions
+		Ceremony string `json:"ceremony"`
+		// User the principal that started the ceremony, see UserOf
+		User string `json:"user"`
+		// ExpiresAt when the ceremony can no longer be finished
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	// ChallengeStore holds the challenges of ceremonies in progress, provide one to share them between replicas.
+	// The Service uses an in memory store by default
+	ChallengeStore interface {
+		// Put stores the challenge until it expires
+		Put(ctx context.Context, id string, challenge Challenge) error
+		// Take removes and returns the challenge so that it's only used once, ok is false when it's unknown or has expired
+		Take(ctx context.Context, id string) (challenge Challenge, ok bool, err error)
+	}
+
+	// Credential a public key credential registered by a principal
+	Credential struct {
+		ID         URLEncoded `json:"id"`
+		User       string     `json:"user"`
+		PublicKey  []byte     `json:"publicKey"`
+		Algorithm  int64      `json:"algorithm"`
+		SignCount  uint32     `json:"signCount"`
+		CreatedAt  time.Time  `json:"createdAt"`
+		LastUsedAt time.Time  `json:"lastUsedAt,omitempty"`
+	}
+
+	// CredentialStore persists the credentials principals register, the in memory store loses them on restarts so it only suits tests
+	CredentialStore interface {
+		// Save creates or replaces the credential with the id of the given one
+		Save(ctx context.Context, credential Credential) error
+		// Credentials the credentials registered by the user
+		Credentials(ctx context.Context, user string) ([]Credential, error)
+	}
+
+	// InMemoryChallengeStore a ChallengeStore for a single replica
+	InMemoryChallengeStore struct {
+		mu         sync.Mutex
+		clock      clock.Clock
+		challenges map[string]Challenge
+		nextSweep  time.Time
+	}
+
+	// InMemoryCredentialStore a CredentialStore for tests
+	InMemoryCredentialStore struct {
+		mu          sync.Mutex
+		credentials map[string][]Credential
+	}
+)
+
+// NewInMemoryChallengeStore creates an InMemoryChallengeStore, expired challenges are swept as new ones are put
+func NewInMemoryChallengeStore(c clock.Clock) *InMemoryChallengeStore {
+	return &InMemoryChallengeStore{
+		clock:      clock.OrDefault(c),
+		challenges: make(map[string]Challenge),
+	}
+}
+
+func (s *InMemoryChallengeStore) Put(_ context.Context, id string, challenge Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	if !now.Before(s.nextSweep) {
+		for key, c := range s.challenges {
+			if !now.Before(c.ExpiresAt) {
+				delete(s.challenges, key)
+			}
+		}
+		s.nextSweep = now.Add(inMemorySweepInterval)
+	}
+	s.challenges[id] = challenge
+	return nil
+}
+
+func (s *InMemoryChallengeStore) Take(_ context.Context, id string) (Challenge, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.challenges[id]
+	delete(s.challenges, id)
+	if !ok || !s.clock.Now().Before(challenge.ExpiresAt) {
+		return Challenge{}, false, nil
+	}
+	return challenge, true, nil
+}
+
+// NewInMemoryCredentialStore creates an empty InMemoryCredentialStore
+func NewInMemoryCredentialStore() *InMemoryCredentialStore {
+	return &InMemoryCredentialStore{credentials: make(map[string][]Credential)}
+}
+
+func (s *InMemoryCredentialStore) Save(_ context.Context, credential Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credentials := s.credentials[credential.User]
+	for i, existing := range credentials {
+		if bytes.Equal(existing.ID, credential.ID) {
+			credentials[i] = credential
+			return nil
+		}
+	}
+	s.credentials[credential.User] = append(credentials, credential)
+	return nil
+}
+
+func (s *InMemoryCredentialStore) Credentials(_ context.Context, user string) ([]Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Credential(nil), s.credentials[user]...), nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package stepup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"math/big"
+	"strings"
+)
+
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+
+	flagUserPresent        = 0x01
+	flagUserVerified       = 0x04
+	flagAttestedCredential = 0x40
+
+	// COSE algorithm identifiers of the keys that can be registered
+	AlgorithmES256 = -7
+	AlgorithmEdDSA = -8
+	AlgorithmRS256 = -257
+
+	coseKeyType  = 1
+	coseAlg      = 3
+	coseCurve    = -1
+	coseX        = -2
+	coseY        = -3
+	coseRSAN     = -1
+	coseRSAE     = -2
+	coseKtyOKP   = 1
+	coseKtyEC2   = 2
+	coseKtyRSA   = 3
+	coseP256     = 1
+	coseEd25519  = 6
+	minRSAKeyLen = 2048
+)
+
+// ErrVerificationFailed the response of an authenticator didn't prove the ceremony, the wrapped error says why
+var ErrVerificationFailed = errors.New("the WebAuthn response couldn't be verified")
+
+// cborDecoder rejects the duplicate map keys and deep nesting attestation objects and COSE keys never have
+var cborDecoder, _ = cbor.DecOptions{DupMapKey: cbor.DupMapKeyEnforcedAPF, MaxNestedLevels: 16, IndefLength: cbor.IndefLengthForbidden}.DecMode()
+
+// supportedAlgorithms the algorithms offered to authenticators at registration, in order of preference
+var supportedAlgorithms = []int64{AlgorithmES256, AlgorithmEdDSA, AlgorithmRS256}
+
+type (
+	// URLEncoded binary data encoded with unpadded base64url in JSON, as with PublicKeyCredential.toJSON() in the browser
+	URLEncoded []byte
+
+	clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+
+	authenticatorData struct {
+		rpIDHash     []byte
+		flags        byte
+		signCount    uint32
+		credentialID []byte
+		publicKey    []byte
+	}
+)
+
+func (u URLEncoded) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(u))
+}
+
+func (u *URLEncoded) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*u = decoded
+	return nil
+}
+
+func (u URLEncoded) String() string {
+	return base64.RawURLEncoding.EncodeToString(u)
+}
+
+func verificationFailed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrVerificationFailed, fmt.Sprintf(format, args...))
+}
+
+// parseClientData checks the client data of a ceremony and returns its challenge
+func parseClientData(raw []byte, ceremony string, origins map[string]bool) (string, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", verificationFailed("malformed client data: %s", err)
+	}
+	if cd.Type != ceremony {
+		return "", verificationFailed("client data is of a %q ceremony rather than %q", cd.Type, ceremony)
+	}
+	if !origins[cd.Origin] {
+		return "", verificationFailed("origin %q isn't allowed", cd.Origin)
+	}
+	if cd.CrossOrigin {
+		return "", verificationFailed("cross origin ceremonies aren't allowed")
+	}
+	if cd.Challenge == "" {
+		return "", verificationFailed("client data has no challenge")
+	}
+	return cd.Challenge, nil
+}
+
+// parseAuthenticatorData checks the relying party and user presence of authenticator data, registrations must attest a credential
+func parseAuthenticatorData(raw []byte, rpID string, attested bool) (*authenticatorData, error) {
+	var parsed protocol.AuthenticatorData
+	if err := parsed.Unmarshal(raw); err != nil {
+		return nil, verificationFailed("malformed authenticator data: %s", err)
+	}
+	ad := &authenticatorData{
+		rpIDHash:     parsed.RPIDHash,
+		flags:        byte(parsed.Flags),
+		signCount:    parsed.Counter,
+		credentialID: parsed.AttData.CredentialID,
+		publicKey:    parsed.AttData.CredentialPublicKey,
+	}
+	expected := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.rpIDHash, expected[:]) {
+		return nil, verificationFailed("authenticator data is for another relying party")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, verificationFailed("the user wasn't present")
+	}
+	if attested && (ad.flags&flagAttestedCredential == 0 || len(ad.publicKey) == 0) {
+		return nil, verificationFailed("authenticator data has no attested credential")
+	}
+	return ad, nil
+}
+
+// parseAttestationObject returns the authenticator data of an attestation object. Attestation statements aren't verified, the
+// credential is trusted because the principal registering it is authenticated, so request the "none" attestation conveyance
+func parseAttestationObject(raw []byte) ([]byte, error) {
+	var object struct {
+		AuthData []byte `cbor:"authData"`
+	}
+	if err := cborDecoder.Unmarshal(raw, &object); err != nil {
+		return nil, verificationFailed("malformed attestation object: %s", err)
+	}
+	if len(object.AuthData) == 0 {
+		return nil, verificationFailed("attestation object has no authenticator data")
+	}
+	return object.AuthData, nil
+}
+
+// parsePublicKey parses a COSE public key of one of the supportedAlgorithms. webauthncose doesn't validate the parameters of the
+// keys it parses, so they are checked before the key is used
+func parsePublicKey(raw []byte) (any, int64, error) {
+	var params struct {
+		KeyType   int64 `cbor:"1,keyasint"`
+		Algorithm int64 `cbor:"3,keyasint"`
+		Curve     any   `cbor:"-1,keyasint"`
+	}
+	if err := cborDecoder.Unmarshal(raw, &params); err != nil {
+		return nil, 0, verificationFailed("malformed credential public key: %s", err)
+	}
+	key, err := webauthncose.ParsePublicKey(raw)
+	if err != nil {
+		return nil, 0, verificationFailed("malformed credential public key: %s", err)
+	}
+	crv, _ := params.Curve.(uint64)
+
+	switch k := key.(type) {
+	case webauthncose.EC2PublicKeyData:
+		if params.Algorithm != AlgorithmES256 || crv != coseP256 || len(k.XCoord) != 32 || len(k.YCoord) != 32 {
+			return nil, 0, verificationFailed("ES256 keys must be on the P-256 curve")
+		}
+		if !elliptic.P256().IsOnCurve(new(big.Int).SetBytes(k.XCoord), new(big.Int).SetBytes(k.YCoord)) {
+			return nil, 0, verificationFailed("ES256 key isn't on the P-256 curve")
+		}
+	case webauthncose.OKPPublicKeyData:
+		if params.Algorithm != AlgorithmEdDSA || crv != coseEd25519 || len(k.XCoord) != ed25519.PublicKeySize {
+			return nil, 0, verificationFailed("EdDSA keys must be Ed25519 keys")
+		}
+	case webauthncose.RSAPublicKeyData:
+		// webauthncose reads the exponent as exactly three bytes, as with the usual 65537
+		if params.Algorithm != AlgorithmRS256 || len(k.Modulus)*8 < minRSAKeyLen || len(k.Exponent) != 3 {
+			return nil, 0, verificationFailed("RS256 keys must be at least %d bits with a 3 byte exponent", minRSAKeyLen)
+		}
+	default:
+		return nil, 0, verificationFailed("unsupported key type %d with algorithm %d", params.KeyType, params.Algorithm)
+	}
+	return key, params.Algorithm, nil
+}
+
+// verifySignature verifies the signature of an assertion over its authenticator data and the hash of its client data
+func verifySignature(rawPublicKey []byte, authData []byte, rawClientData []byte, signature []byte) error {
+	key, _, err := parsePublicKey(rawPublicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if valid, err := webauthncose.VerifySignature(key, signed, signature); err != nil || !valid {
+		return verificationFailed("invalid signature")
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package temporal
 
 import (
 	"context"
+	"github.com/armory-io/go-commons/opentelemetry"
 	"github.com/armory-io/go-commons/server"
 	"github.com/samber/lo"
 	"go.temporal.io/api/common/v1"
@@ -142,11 +143,13 @@ func setFields(ctx valuer, fields ...LoggerField) *sync.Map {
 }
 
 func extractFields(ctx valuer) []LoggerField {
-	details, err := server.ExtractRequestDetailsFromContext(ctx)
-	if err != nil {
-		return []LoggerField{}
+	var loggingMetadata map[string]string
+	if details, err := server.ExtractRequestDetailsFromContext(ctx); err == nil {
+		loggingMetadata = details.LoggingMetadata.Metadata
+	} else if c, ok := ctx.(context.Context); ok {
+		// workflows started outside of a request, such as by a message consumer, carry the trace of their span
+		loggingMetadata = opentelemetry.TraceLoggingMetadata(c)
 	}
-	loggingMetadata := details.LoggingMetadata.Metadata
 	return lo.MapToSlice(loggingMetadata, func(k string, v string) LoggerField {
 		return LoggerField{
 			Key:   k,
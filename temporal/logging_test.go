@@ -1,7 +1,9 @@
 package temporal
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
 	"go.temporal.io/api/common/v1"
 	"go.temporal.io/sdk/converter"
 	"testing"
@@ -23,3 +25,14 @@ func TestExtractLoggerMetadata(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "1-800-pipelines", metadata["PipelineID"])
 }
+
+func TestWithFieldsOutsideOfRequests(t *testing.T) {
+	span := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}, TraceFlags: trace.FlagsSampled})
+	ctx := WithFields(trace.ContextWithSpanContext(context.Background(), span), LoggerField{Key: "PipelineID", Value: "1-800-pipelines"})
+
+	assert.ElementsMatch(t, []LoggerField{
+		{Key: "PipelineID", Value: "1-800-pipelines"},
+		{Key: "trace.id", Value: span.TraceID().String()},
+		{Key: "span.id", Value: span.SpanID().String()},
+	}, getFields(ctx))
+}
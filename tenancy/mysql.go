@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tenancy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/armory-io/go-commons/envutils"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/mysql"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	defaultOrgColumn = "org_id"
+	defaultEnvColumn = "env_id"
+)
+
+type (
+	Configuration struct {
+		// OrgColumn the column that holds the org id of tenant owned rows, defaults to org_id
+		OrgColumn string `yaml:"orgColumn"`
+		// EnvColumn the column that holds the env id of tenant owned rows, defaults to env_id
+		EnvColumn string `yaml:"envColumn"`
+		// SessionVariables when true @org_id and @env_id are set at the start of every tenant scoped transaction, so views and triggers can filter on them
+		SessionVariables bool `yaml:"sessionVariables"`
+		// Lint when true queries executed in a tenant scope that do not reference OrgColumn are logged, always enabled in dev environments, see envutils.IsDev
+		Lint bool `yaml:"lint"`
+	}
+
+	// TransactionScopeBuilder creates transaction scopes that are bound to the tenant of the context, see mysql.TransactionScopeBuilder.
+	// Building a scope fails with ErrNoTenant when the context has no tenant
+	TransactionScopeBuilder func(ctx context.Context, txIsolationLevel sql.IsolationLevel, options ...mysql.TransactionScopeOption) (mysql.TransactionScopeWrapper, error)
+
+	ScopeParameters struct {
+		fx.In
+
+		Builder       mysql.TransactionScopeBuilder
+		Configuration Configuration `optional:"true"`
+		Metadata      metadata.ApplicationMetadata
+		Log           *zap.SugaredLogger
+	}
+
+	// lintExecutor logs queries that are executed in a tenant scope without referencing the org column
+	lintExecutor struct {
+		boil.ContextExecutor
+		orgColumn string
+		tenant    Tenant
+		log       *zap.SugaredLogger
+	}
+)
+
+var Module = fx.Module(
+	"tenancy",
+	fx.Provide(NewTransactionScopeBuilder),
+)
+
+// NewTransactionScopeBuilder decorates the mysql.TransactionScopeBuilder so every scope it creates is bound to the tenant of the context
+func NewTransactionScopeBuilder(params ScopeParameters) TransactionScopeBuilder {
+	config := params.Configuration.withDefaults()
+	lint := config.Lint || envutils.IsDev(params.Metadata.Environment, typesafeconfig.ActiveProfiles())
+	log := params.Log
+
+	return func(ctx context.Context, isolationLevel sql.IsolationLevel, options ...mysql.TransactionScopeOption) (mysql.TransactionScopeWrapper, error) {
+		tenant, err := FromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// the tenant is also passed on to a mysql.TenantRouter, should the scopes be routed to the database of the org
+		wrapper, err := params.Builder(mysql.WithTenantOrg(WithTenant(ctx, *tenant), tenant.OrgID), isolationLevel, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(executeInTx mysql.InTransactionHandler) error {
+			return wrapper(func(ctx context.Context, db boil.ContextExecutor) error {
+				if config.SessionVariables {
+					if _, err := db.ExecContext(ctx, "SET @org_id = ?, @env_id = ?", tenant.OrgID, tenant.EnvID); err != nil {
+						return err
+					}
+				}
+				if lint {
+					db = &lintExecutor{ContextExecutor: db, orgColumn: config.OrgColumn, tenant: *tenant, log: log}
+				}
+				return executeInTx(ctx, db)
+			})
+		}, nil
+	}
+}
+
+// Where returns a predicate and its arguments that restrict a query to the tenant of the context,
+// usable with raw SQL or sqlboiler, i.e. qm.Where(clause, args...)
+func Where(ctx context.Context, config Configuration) (string, []interface{}, error) {
+	tenant, err := FromContext(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	config = config.withDefaults()
+
+	if tenant.EnvID == "" {
+		return config.OrgColumn + " = ?", []interface{}{tenant.OrgID}, nil
+	}
+	return fmt.Sprintf("%s = ? AND %s = ?", config.OrgColumn, config.EnvColumn), []interface{}{tenant.OrgID, tenant.EnvID}, nil
+}
+
+func (c Configuration) withDefaults() Configuration {
+	if c.OrgColumn == "" {
+		c.OrgColumn = defaultOrgColumn
+	}
+	if c.EnvColumn == "" {
+		c.EnvColumn = defaultEnvColumn
+	}
+	return c
+}
+
+func (l *lintExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	l.check(query)
+	return l.ContextExecutor.Exec(query, args...)
+}
+
+func (l *lintExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	l.check(query)
+	return l.ContextExecutor.Query(query, args...)
+}
+
+func (l *lintExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	l.check(query)
+	return l.ContextExecutor.QueryRow(query, args...)
+}
+
+func (l *lintExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	l.check(query)
+	return l.ContextExecutor.ExecContext(ctx, query, args...)
+}
+
+func (l *lintExecutor) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	l.check(query)
+	return l.ContextExecutor.QueryContext(ctx, query, args...)
+}
+
+func (l *lintExecutor) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	l.check(query)
+	return l.ContextExecutor.QueryRowContext(ctx, query, args...)
+}
+
+func (l *lintExecutor) check(query string) {
+	if !isUnscoped(query, l.orgColumn) {
+		return
+	}
+	l.log.Warnw("query executed in a tenant scope without a tenant predicate",
+		"tenant", l.tenant.String(),
+		"query", query,
+	)
+}
+
+// isUnscoped reports whether a DML statement does not reference the org column at all
+func isUnscoped(query string, orgColumn string) bool {
+	normalized := strings.ToLower(strings.TrimSpace(query))
+	isDML := false
+	for _, verb := range []string{"select", "insert", "update", "delete", "replace"} {
+		if strings.HasPrefix(normalized, verb) {
+			isDML = true
+			break
+		}
+	}
+	return isDML && !strings.Contains(normalized, strings.ToLower(orgColumn))
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tenancy derives the tenant (org and env) of a request and enforces that database access is scoped to it.
+package tenancy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/ctxutil"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	// Tenant the org and env that a request is executed on behalf of
+	Tenant struct {
+		OrgID string
+		EnvID string
+	}
+)
+
+var (
+	ErrNoTenant = errors.New("no tenant found in context")
+
+	tenantKey = ctxutil.NewKey[Tenant]("tenancy.tenant")
+)
+
+// FromPrincipal derives the Tenant of an authenticated principal
+func FromPrincipal(p *iam.ArmoryCloudPrincipal) Tenant {
+	return Tenant{OrgID: p.OrgId, EnvID: p.EnvId}
+}
+
+func (t Tenant) String() string {
+	return fmt.Sprintf("%s:%s", t.OrgID, t.EnvID)
+}
+
+// WithTenant returns a copy of ctx that carries the tenant
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return tenantKey.WithValue(ctx, tenant)
+}
+
+// FromContext returns the tenant set by WithTenant, falling back to deriving it from the principal in the context.
+// Returns ErrNoTenant if neither is present or the tenant has no org
+func FromContext(ctx context.Context) (*Tenant, error) {
+	if t, ok := tenantKey.Value(ctx); ok {
+		return &t, nil
+	}
+	p, err := iam.ExtractPrincipalFromContext(ctx)
+	if err != nil {
+		return nil, ErrNoTenant
+	}
+	t := FromPrincipal(p)
+	if t.OrgID == "" {
+		return nil, ErrNoTenant
+	}
+	return &t, nil
+}
+
+// Derive resolves the tenant once and stores it in the returned context, so it is not re-derived for every FromContext call
+func Derive(ctx context.Context) (context.Context, error) {
+	t, err := FromContext(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	return WithTenant(ctx, *t), nil
+}
+
+// GinMiddleware derives the tenant of each request, it must be registered after the middleware that authenticates the principal.
+// Requests without a tenant are passed through, enforcement happens where the tenant is used
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ctx, err := Derive(c.Request.Context()); err == nil {
+			c.Request = c.Request.WithContext(ctx)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tenancy
+
+import (
+	"context"
+	"database/sql"
+	"github.com/armory-io/go-commons/iam"
+	"github.com/armory-io/go-commons/metadata"
+	"github.com/armory-io/go-commons/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/volatiletech/sqlboiler/v4/boil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+type recordingExecutor struct {
+	boil.ContextExecutor
+	queries []string
+}
+
+func (r *recordingExecutor) ExecContext(_ context.Context, query string, _ ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	return nil, nil
+}
+
+func fakeScopeBuilder(executor boil.ContextExecutor) mysql.TransactionScopeBuilder {
+	return func(ctx context.Context, _ sql.IsolationLevel, _ ...mysql.TransactionScopeOption) (mysql.TransactionScopeWrapper, error) {
+		return func(executeInTx mysql.InTransactionHandler) error {
+			return executeInTx(ctx, executor)
+		}, nil
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	_, err := FromContext(context.Background())
+	assert.ErrorIs(t, err, ErrNoTenant)
+
+	ctx := iam.WithPrincipal(context.Background(), iam.ArmoryCloudPrincipal{OrgId: "org", EnvId: "env"})
+	tenant, err := FromContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Tenant{OrgID: "org", EnvID: "env"}, *tenant)
+
+	ctx, err = Derive(ctx)
+	assert.NoError(t, err)
+	tenant, err = FromContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "org:env", tenant.String())
+}
+
+func TestWhere(t *testing.T) {
+	ctx := WithTenant(context.Background(), Tenant{OrgID: "org", EnvID: "env"})
+	clause, args, err := Where(ctx, Configuration{})
+	assert.NoError(t, err)
+	assert.Equal(t, "org_id = ? AND env_id = ?", clause)
+	assert.Equal(t, []interface{}{"org", "env"}, args)
+
+	clause, args, err = Where(WithTenant(context.Background(), Tenant{OrgID: "org"}), Configuration{OrgColumn: "organization"})
+	assert.NoError(t, err)
+	assert.Equal(t, "organization = ?", clause, "the env predicate is omitted for org wide tenants")
+	assert.Equal(t, []interface{}{"org"}, args)
+
+	_, _, err = Where(context.Background(), Configuration{})
+	assert.ErrorIs(t, err, ErrNoTenant)
+}
+
+func TestTransactionScopeBuilder(t *testing.T) {
+	executor := &recordingExecutor{}
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	builder := NewTransactionScopeBuilder(ScopeParameters{
+		Builder:       fakeScopeBuilder(executor),
+		Configuration: Configuration{SessionVariables: true},
+		Metadata:      metadata.ApplicationMetadata{Environment: "local"},
+		Log:           zap.New(core).Sugar(),
+	})
+
+	_, err := builder(context.Background(), sql.LevelReadCommitted)
+	assert.ErrorIs(t, err, ErrNoTenant)
+
+	ctx := WithTenant(context.Background(), Tenant{OrgID: "org", EnvID: "env"})
+	wrapper, err := builder(ctx, sql.LevelReadCommitted)
+	assert.NoError(t, err)
+
+	err = wrapper(func(ctx context.Context, db boil.ContextExecutor) error {
+		tenant, err := FromContext(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "org", tenant.OrgID)
+
+		_, _ = db.ExecContext(ctx, "UPDATE pipelines SET name = ? WHERE org_id = ?", "name", "org")
+		_, _ = db.ExecContext(ctx, "DELETE FROM pipelines WHERE id = ?", 1)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"SET @org_id = ?, @env_id = ?",
+		"UPDATE pipelines SET name = ? WHERE org_id = ?",
+		"DELETE FROM pipelines WHERE id = ?",
+	}, executor.queries)
+
+	assert.Equal(t, 1, logs.Len(), "only the unscoped delete should be flagged")
+	assert.Equal(t, "DELETE FROM pipelines WHERE id = ?", logs.All()[0].ContextMap()["query"])
+}
+
+func TestIsUnscoped(t *testing.T) {
+	assert.True(t, isUnscoped("select * from pipelines", "org_id"))
+	assert.False(t, isUnscoped("SELECT * FROM pipelines WHERE ORG_ID = ?", "org_id"))
+	assert.False(t, isUnscoped("SET @org_id = ?", "tenant_id"))
+}
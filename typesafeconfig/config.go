@@ -52,10 +52,19 @@ import (
 	"os/user"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
-var ErrNoConfigurationSourcesProvided = errors.New("no configuration sources provided, you must provide at least 1 embed.FS or dir path")
+var (
+	ErrNoConfigurationSourcesProvided = errors.New("no configuration sources provided, you must provide at least 1 embed.FS or dir path")
+	// ErrUnusedKeys configuration keys that don't match a field of the configuration, see WithFailOnUnusedKeys
+	ErrUnusedKeys = errors.New("configuration has keys that don't match any field")
+)
+
+// activeProfiles the profiles used by the most recent ResolveConfiguration
+var activeProfiles atomic.Pointer[[]string]
 
 type resolver struct {
 	log                 *zap.SugaredLogger
@@ -64,6 +73,9 @@ type resolver struct {
 	baseNames           []string
 	profiles            []string
 	explicitProperties  map[string]any
+	inMemorySources     []map[string]any
+	failOnUnusedKeys    bool
+	snapshot            *Snapshot
 }
 
 type Option = func(resolver *resolver)
@@ -115,6 +127,32 @@ func WithExplicitProperties[T string | map[string]any](properties ...T) Option {
 	}
 }
 
+// Options combines options into one, applied in order
+func Options(options ...Option) Option {
+	return func(resolver *resolver) {
+		for _, option := range options {
+			option(resolver)
+		}
+	}
+}
+
+// WithInMemorySources adds configuration sources that take precedence over configuration files and are overridden by
+// environment variables and explicit properties, see typesafeconfigtest.WithInMemoryYAML
+func WithInMemorySources(sources ...map[string]any) Option {
+	return func(resolver *resolver) {
+		resolver.inMemorySources = append(resolver.inMemorySources, sources...)
+	}
+}
+
+// WithFailOnUnusedKeys fails resolution with ErrUnusedKeys when a key of a configuration file, in memory source or explicit
+// property doesn't match a field of the configuration, such as a misspelled or removed property. Environment variables are
+// not checked as most of them aren't configuration
+func WithFailOnUnusedKeys() Option {
+	return func(resolver *resolver) {
+		resolver.failOnUnusedKeys = true
+	}
+}
+
 func defaultResolver() *resolver {
 	configurationDirs := []string{"/opt/go-application/config", "resources"}
 	usr, err := user.Current()
@@ -137,20 +175,34 @@ func ResolveConfiguration[T any](log *zap.SugaredLogger, options ...Option) (*T,
 		option(r)
 	}
 
-	if len(r.embeddedFilesystems) == 0 && len(r.configurationDirs) == 0 {
+	if len(r.embeddedFilesystems) == 0 && len(r.configurationDirs) == 0 && len(r.inMemorySources) == 0 {
 		return nil, ErrNoConfigurationSourcesProvided
 	}
 
+	recordActiveProfiles(r.profiles)
 	candidates := getConfigurationFileCandidates(r.configurationDirs, r.baseNames, r.profiles)
 	sources, err := loadFileBasedConfigurationSources(log, candidates, r.embeddedFilesystems)
 	if err != nil {
 		return nil, err
 	}
+	sources = append(sources, r.inMemorySources...)
+	var unused []string
+	if r.failOnUnusedKeys {
+		unused = unusedKeys(maputils.MergeSources(append(sources, r.explicitProperties)...), reflect.TypeOf((*T)(nil)).Elem(), "")
+	}
 	sources = append(sources,
 		loadEnvironmentSources(),
 		r.explicitProperties, // explicit properties should be the last source
 	)
 	untypedConfig := maputils.MergeSources(sources...)
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return nil, fmt.Errorf("%w: %s", ErrUnusedKeys, strings.Join(unused, ", "))
+	}
+	var raw map[string]string
+	if r.snapshot != nil {
+		raw = flattenConfig(untypedConfig, reflect.TypeOf((*T)(nil)).Elem())
+	}
 	// hydrate secret tokens
 	if err = resolveSecrets(untypedConfig, log); err != nil {
 		return nil, err
@@ -159,16 +211,14 @@ func ResolveConfiguration[T any](log *zap.SugaredLogger, options ...Option) (*T,
 	if err = resolveTemplates(untypedConfig); err != nil {
 		return nil, err
 	}
+	if r.snapshot != nil {
+		r.snapshot.record(raw, flattenConfig(untypedConfig, reflect.TypeOf((*T)(nil)).Elem()))
+	}
 	var typeSafeConfig *T
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
 		Result:           &typeSafeConfig,
-		MatchName: func(mapKey, fieldName string) bool {
-			normalizedMapKey := strings.ToLower(mapKey)
-			normalizedMapKey = strings.ReplaceAll(normalizedMapKey, "-", "")
-			normalizedMapKey = strings.ReplaceAll(normalizedMapKey, "_", "")
-			return strings.ToLower(fieldName) == normalizedMapKey
-		},
+		MatchName:        matchName,
 	})
 	if err != nil {
 		return nil, err
@@ -176,6 +226,98 @@ func ResolveConfiguration[T any](log *zap.SugaredLogger, options ...Option) (*T,
 	return typeSafeConfig, decoder.Decode(untypedConfig)
 }
 
+// matchName matches configuration keys to fields regardless of case, dashes and underscores
+func matchName(mapKey, fieldName string) bool {
+	normalizedMapKey := strings.ToLower(mapKey)
+	normalizedMapKey = strings.ReplaceAll(normalizedMapKey, "-", "")
+	normalizedMapKey = strings.ReplaceAll(normalizedMapKey, "_", "")
+	return strings.ToLower(fieldName) == normalizedMapKey
+}
+
+// unusedKeys the paths of the keys of config that don't match a field of t, keys of maps and interfaces are always used
+func unusedKeys(config map[string]any, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var unused []string
+	switch t.Kind() {
+	case reflect.Struct:
+		if hasRemainField(t) {
+			return nil
+		}
+		for key, value := range config {
+			field, ok := findField(t, key)
+			if !ok {
+				unused = append(unused, prefix+key)
+				continue
+			}
+			unused = append(unused, unusedValueKeys(value, field.Type, prefix+key)...)
+		}
+	case reflect.Map:
+		for key, value := range config {
+			unused = append(unused, unusedValueKeys(value, t.Elem(), prefix+key)...)
+		}
+	}
+	return unused
+}
+
+func unusedValueKeys(value any, t reflect.Type, path string) []string {
+	switch v := value.(type) {
+	case map[string]any:
+		return unusedKeys(v, t, path+".")
+	case []any:
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		var unused []string
+		for i, item := range v {
+			if m, ok := item.(map[string]any); ok {
+				unused = append(unused, unusedKeys(m, t.Elem(), fmt.Sprintf("%s[%d].", path, i))...)
+			}
+		}
+		return unused
+	default:
+		return nil
+	}
+}
+
+// findField the field of the struct the key decodes into, including the fields of squashed embedded structs
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if strings.Contains(options, "squash") && field.Type.Kind() == reflect.Struct {
+			if squashed, ok := findField(field.Type, key); ok {
+				return squashed, true
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name != "-" && matchName(key, name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// hasRemainField whether the struct collects the keys that match no field, with a mapstructure:",remain" field
+func hasRemainField(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Contains(t.Field(i).Tag.Get("mapstructure"), ",remain") {
+			return true
+		}
+	}
+	return false
+}
+
 func loadEnvironmentSources() map[string]any {
 	config := make(map[string]any)
 	env := os.Environ()
@@ -333,6 +475,25 @@ func loadCandidate(candidate string) (map[string]any, error) {
 	return unmarshalData(data, candidate)
 }
 
+// ActiveProfiles the profiles the most recently resolved configuration was resolved with, including ADDITIONAL_ACTIVE_PROFILES
+func ActiveProfiles() []string {
+	profiles := activeProfiles.Load()
+	if profiles == nil {
+		return []string{}
+	}
+	return append([]string{}, *profiles...)
+}
+
+func recordActiveProfiles(profiles []string) {
+	active := append([]string{}, profiles...)
+	for _, profile := range strings.Split(os.Getenv("ADDITIONAL_ACTIVE_PROFILES"), ",") {
+		if profile != "" && !slices.Contains(active, profile) {
+			active = append(active, profile)
+		}
+	}
+	activeProfiles.Store(&active)
+}
+
 func getConfigurationFileCandidates(
 	configurationDirs []string,
 	baseNames []string,
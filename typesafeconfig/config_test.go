@@ -359,6 +359,41 @@ func (s *TypesafeConfigTestSuite) TestGetConfigurationFileCandidates() {
 	}
 }
 
+func (s *TypesafeConfigTestSuite) TestInMemorySources() {
+	config, err := ResolveConfiguration[Config](s.log,
+		WithDirectories(),
+		WithInMemorySources(
+			map[string]any{"featureEnabled": true, "someStringOption": "in memory"},
+			map[string]any{"some-string-option": "second source wins"},
+		),
+		WithExplicitProperties("numberOfWidgets=3"),
+	)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), &Config{FeatureEnabled: true, SomeStringOption: "second source wins", NumberOfWidgets: 3}, config)
+}
+
+func (s *TypesafeConfigTestSuite) TestFailOnUnusedKeys() {
+	_, err := ResolveConfiguration[Config](s.log,
+		WithDirectories(),
+		WithInMemorySources(map[string]any{
+			"featureEnabled":    true,
+			"numberOfWidgetz":   3,
+			"listOptions":       []any{map[string]any{"name": "a", "valeu": "b"}},
+			"embeddedSubConfig": map[string]any{"some_other_string_option": "ok", "removed": "x"},
+		}),
+		WithFailOnUnusedKeys(),
+	)
+	assert.ErrorIs(s.T(), err, ErrUnusedKeys)
+	assert.ErrorContains(s.T(), err, "embeddedsubconfig.removed, listoptions[0].valeu, numberofwidgetz")
+
+	_, err = ResolveConfiguration[map[string]any](s.log,
+		WithDirectories(),
+		WithInMemorySources(map[string]any{"anything": map[string]any{"goes": true}}),
+		WithFailOnUnusedKeys(),
+	)
+	assert.NoError(s.T(), err, "keys of maps are always used")
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestTypesafeConfigTestSuite(t *testing.T) {
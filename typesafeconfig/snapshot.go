@@ -0,0 +1,163 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package typesafeconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/armory-io/go-commons/diff"
+	"github.com/armory-io/go-commons/secrets"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// sensitiveKeyPattern matches the last segment of keys whose values are masked even when they weren't resolved from a secret engine
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(password|secret|token|credential|privatekey|apikey)`)
+
+// Snapshot the flattened resolved configuration, recorded with WithSnapshot so that it can be persisted and compared with the
+// configuration of the next start, see the configsnapshot package. Values resolved from secret engines and the values of keys
+// that look sensitive are only kept as a hash
+type Snapshot struct {
+	// Hash the hash of the whole configuration, secrets included, so rotating a secret changes it
+	Hash string `json:"hash"`
+	// Values the values by key path, ex: server.http.port
+	Values map[string]string `json:"values"`
+	// Sensitive the key paths whose values are hashes
+	Sensitive []string `json:"sensitive,omitempty"`
+}
+
+// WithSnapshot records the resolved configuration in snapshot. Only the keys that match a field of the configuration are recorded,
+// so environment variables unrelated to the configuration are left out
+func WithSnapshot(snapshot *Snapshot) Option {
+	return func(resolver *resolver) {
+		resolver.snapshot = snapshot
+	}
+}
+
+// Changes the keys that were added, removed or changed since the previous snapshot, sorted by key. The values of sensitive keys are masked
+func (s *Snapshot) Changes(previous *Snapshot) []diff.Change {
+	var before map[string]string
+	if previous != nil {
+		before = previous.Values
+	}
+	sensitive := map[string]bool{}
+	for _, snapshot := range []*Snapshot{previous, s} {
+		if snapshot == nil {
+			continue
+		}
+		for _, key := range snapshot.Sensitive {
+			sensitive[key] = true
+		}
+	}
+
+	changes := diff.Compare(before, s.Values)
+	for i, change := range changes {
+		if !sensitive[change.Path] {
+			continue
+		}
+		if change.From != nil {
+			changes[i].From = diff.Masked
+		}
+		if change.To != nil {
+			changes[i].To = diff.Masked
+		}
+	}
+	return changes
+}
+
+// record fills the snapshot from the configuration before and after its secrets were resolved
+func (s *Snapshot) record(raw map[string]string, resolved map[string]string) {
+	keys := make([]string, 0, len(resolved))
+	for key := range resolved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	s.Values = make(map[string]string, len(resolved))
+	s.Sensitive = nil
+	for _, key := range keys {
+		value := resolved[key]
+		fmt.Fprintf(hash, "%s=%s\n", key, value)
+
+		segments := strings.Split(key, ".")
+		if secrets.IsEncryptedSecret(raw[key]) || sensitiveKeyPattern.MatchString(segments[len(segments)-1]) {
+			sum := sha256.Sum256([]byte(value))
+			s.Values[key] = "sha256:" + hex.EncodeToString(sum[:])
+			s.Sensitive = append(s.Sensitive, key)
+			continue
+		}
+		s.Values[key] = value
+	}
+	s.Hash = hex.EncodeToString(hash.Sum(nil))
+}
+
+// flattenConfig the leaf values of the keys of config that match a field of t by key path
+func flattenConfig(config map[string]any, t reflect.Type) map[string]string {
+	flattened := map[string]string{}
+	flattenKeys(config, t, "", flattened)
+	return flattened
+}
+
+func flattenKeys(config map[string]any, t reflect.Type, prefix string, flattened map[string]string) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for key, value := range config {
+		var valueType reflect.Type
+		switch {
+		case t == nil:
+		case t.Kind() == reflect.Struct:
+			field, ok := findField(t, key)
+			if !ok {
+				if !hasRemainField(t) {
+					continue
+				}
+			} else {
+				valueType = field.Type
+			}
+		case t.Kind() == reflect.Map:
+			valueType = t.Elem()
+		}
+		flattenValue(value, valueType, prefix+key, flattened)
+	}
+}
+
+func flattenValue(value any, t reflect.Type, path string, flattened map[string]string) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		flattenKeys(v, t, path+".", flattened)
+	case []any:
+		var itemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			itemType = t.Elem()
+		}
+		for i, item := range v {
+			flattenValue(item, itemType, fmt.Sprintf("%s[%d]", path, i), flattened)
+		}
+	case nil:
+		flattened[path] = ""
+	default:
+		flattened[path] = fmt.Sprint(v)
+	}
+}
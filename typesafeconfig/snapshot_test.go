@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package typesafeconfig
+
+import (
+	"github.com/armory-io/go-commons/diff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+type snapshotConfig struct {
+	Database struct {
+		Url      string
+		Password string
+	}
+	Replicas int
+	Regions  []string
+	ApiKey   string
+	Labels   map[string]string
+}
+
+func resolveSnapshot(t *testing.T, source map[string]any) *Snapshot {
+	snapshot := &Snapshot{}
+	_, err := ResolveConfiguration[snapshotConfig](zap.NewNop().Sugar(), WithInMemorySources(source), WithSnapshot(snapshot))
+	require.NoError(t, err)
+	return snapshot
+}
+
+func TestSnapshot(t *testing.T) {
+	previous := resolveSnapshot(t, map[string]any{
+		"database": map[string]any{"url": "mysql://db-1", "password": "hunter2"},
+		"replicas": 2,
+		"regions":  []any{"us-west-2"},
+		"apiKey":   "encrypted:noop!v:key-1",
+		"unknown":  "not part of the configuration",
+	})
+	assert.Equal(t, "mysql://db-1", previous.Values["database.url"])
+	assert.Equal(t, "2", previous.Values["replicas"])
+	assert.Equal(t, "us-west-2", previous.Values["regions[0]"])
+	assert.NotContains(t, previous.Values, "unknown")
+	assert.NotContains(t, previous.Values["database.password"], "hunter2")
+	assert.NotContains(t, previous.Values["apikey"], "key-1")
+	assert.ElementsMatch(t, []string{"apikey", "database.password"}, previous.Sensitive)
+
+	current := resolveSnapshot(t, map[string]any{
+		"database": map[string]any{"url": "mysql://db-2", "password": "hunter2"},
+		"replicas": 2,
+		"apiKey":   "encrypted:noop!v:key-2",
+		"labels":   map[string]any{"team": "cd"},
+	})
+	assert.NotEqual(t, previous.Hash, current.Hash)
+	assert.Equal(t, []diff.Change{
+		{Path: "apikey", Op: diff.OpReplace, From: diff.Masked, To: diff.Masked},
+		{Path: "database.url", Op: diff.OpReplace, From: "mysql://db-1", To: "mysql://db-2"},
+		{Path: "labels.team", Op: diff.OpAdd, To: "cd"},
+		{Path: "regions[0]", Op: diff.OpRemove, From: "us-west-2"},
+	}, current.Changes(previous))
+
+	assert.Empty(t, current.Changes(current))
+	assert.Len(t, current.Changes(nil), len(current.Values))
+}
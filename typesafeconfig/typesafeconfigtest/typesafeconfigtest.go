@@ -0,0 +1,217 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package typesafeconfigtest helps unit test configurations resolved with typesafeconfig, so that renamed, misspelled and
+// removed properties show up as failing tests rather than as surprises in a deployed environment:
+//
+//	func TestConfiguration(t *testing.T) {
+//		config := typesafeconfigtest.Resolve[Configuration](t,
+//			typesafeconfig.WithEmbeddedFilesystems(&resources),
+//			typesafeconfig.WithActiveProfiles("prod"),
+//			typesafeconfig.WithFailOnUnusedKeys(),
+//		)
+//		typesafeconfigtest.AssertGolden(t, "testdata/prod.golden.yaml", config)
+//	}
+//
+// Golden files are written, rather than compared, when the UPDATE_GOLDEN environment variable is true.
+package typesafeconfigtest
+
+import (
+	"encoding/json"
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	// Masked replaces the values of secrets in golden files
+	Masked = "[MASKED]"
+
+	updateGoldenEnv = "UPDATE_GOLDEN"
+)
+
+// secretFragments properties whose names contain any of these are masked in golden files
+var secretFragments = []string{"password", "secret", "token", "apikey", "privatekey", "credential"}
+
+type (
+	// GoldenOption customizes AssertGolden
+	GoldenOption func(*golden)
+
+	golden struct {
+		masked []string
+	}
+)
+
+// WithInMemoryYAML resolves the configuration from the YAML document instead of configuration files, so tests don't depend
+// on the files of the working directory or the home directory. Profiles have no effect on it, environment variables and
+// explicit properties still override it
+func WithInMemoryYAML(t testing.TB, document string) typesafeconfig.Option {
+	t.Helper()
+	var source map[string]any
+	if err := yaml.Unmarshal([]byte(document), &source); err != nil {
+		t.Fatalf("failed to parse in memory configuration: %s", err)
+	}
+	if source == nil {
+		source = map[string]any{}
+	}
+	return typesafeconfig.Options(typesafeconfig.WithDirectories(), typesafeconfig.WithInMemorySources(source))
+}
+
+// Resolve resolves the configuration, failing the test when it can't be resolved
+func Resolve[T any](t testing.TB, options ...typesafeconfig.Option) *T {
+	t.Helper()
+	config, err := typesafeconfig.ResolveConfiguration[T](zap.NewNop().Sugar(), options...)
+	if err != nil {
+		t.Fatalf("failed to resolve configuration: %s", err)
+	}
+	return config
+}
+
+// MaskProperties masks the properties with these names in addition to the ones that look like secrets, such as passwords and tokens
+func MaskProperties(names ...string) GoldenOption {
+	return func(g *golden) {
+		for _, name := range names {
+			g.masked = append(g.masked, normalize(name))
+		}
+	}
+}
+
+// AssertGolden compares the configuration, as YAML with its secrets masked, to the golden file
+func AssertGolden(t testing.TB, goldenFile string, config any, options ...GoldenOption) {
+	t.Helper()
+	g := &golden{}
+	for _, option := range options {
+		option(g)
+	}
+
+	actual, err := g.render(config)
+	if err != nil {
+		t.Fatalf("failed to render configuration: %s", err)
+	}
+
+	if update, _ := strconv.ParseBool(os.Getenv(updateGoldenEnv)); update {
+		if err := os.MkdirAll(filepath.Dir(goldenFile), 0o755); err != nil {
+			t.Fatalf("failed to create the directory of %s: %s", goldenFile, err)
+		}
+		if err := os.WriteFile(goldenFile, actual, 0o644); err != nil {
+			t.Fatalf("failed to update %s: %s", goldenFile, err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("failed to read %s, run the test with %s=true to create it: %s", goldenFile, updateGoldenEnv, err)
+	}
+	if string(expected) != string(actual) {
+		t.Errorf("configuration doesn't match %s, run the test with %s=true to update it if the change is expected\n%s",
+			goldenFile, updateGoldenEnv, lineDiff(string(expected), string(actual)))
+	}
+}
+
+// render the configuration as YAML with sorted keys, going through JSON so fields keep their Go names and json tags are honoured
+func (g *golden) render(config any) ([]byte, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var untyped any
+	if err := json.Unmarshal(b, &untyped); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(g.mask(untyped))
+}
+
+func (g *golden) mask(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if child != nil && child != "" && g.isSecret(key) {
+				v[key] = Masked
+			} else {
+				v[key] = g.mask(child)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = g.mask(item)
+		}
+	}
+	return value
+}
+
+func (g *golden) isSecret(name string) bool {
+	name = normalize(name)
+	for _, masked := range g.masked {
+		if name == masked {
+			return true
+		}
+	}
+	for _, fragment := range secretFragments {
+		if strings.Contains(name, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(name string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+// lineDiff lists the lines that were removed from expected with - and added in actual with +
+func lineDiff(expected string, actual string) string {
+	a, b := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	// longest common subsequence of lines, the files are small
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,75 @@
+package typesafeconfigtest
+
+import (
+	"github.com/armory-io/go-commons/typesafeconfig"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type (
+	database struct {
+		URL      string
+		User     string
+		Password string
+	}
+
+	configuration struct {
+		Name     string
+		Database database
+		Clients  []client
+		Webhook  string
+	}
+
+	client struct {
+		ID           string
+		ClientSecret string
+	}
+)
+
+const document = `
+name: deployments
+database:
+  url: mysql://localhost:3306/deployments
+  user: app
+  password: hunter2
+clients:
+  - id: cli
+    client-secret: s3cr3t
+webhook: https://hooks.example.com/abc
+`
+
+func TestResolveInMemoryYAML(t *testing.T) {
+	config := Resolve[configuration](t, WithInMemoryYAML(t, document), typesafeconfig.WithFailOnUnusedKeys())
+	assert.Equal(t, "deployments", config.Name)
+	assert.Equal(t, "hunter2", config.Database.Password)
+	assert.Equal(t, []client{{ID: "cli", ClientSecret: "s3cr3t"}}, config.Clients)
+
+	_, err := typesafeconfig.ResolveConfiguration[configuration](zap.NewNop().Sugar(), WithInMemoryYAML(t, "nmae: typo"), typesafeconfig.WithFailOnUnusedKeys())
+	assert.ErrorIs(t, err, typesafeconfig.ErrUnusedKeys)
+}
+
+func TestAssertGolden(t *testing.T) {
+	config := Resolve[configuration](t, WithInMemoryYAML(t, document))
+	AssertGolden(t, "testdata/configuration.golden.yaml", config, MaskProperties("webhook"))
+
+	changed := *config
+	changed.Name = "renamed"
+	recorder := &testing.T{}
+	AssertGolden(recorder, "testdata/configuration.golden.yaml", &changed, MaskProperties("webhook"))
+	assert.True(t, recorder.Failed(), "changes fail the assertion")
+
+	golden := filepath.Join(t.TempDir(), "new.golden.yaml")
+	t.Setenv(updateGoldenEnv, "true")
+	AssertGolden(t, golden, config)
+	written, err := os.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Contains(t, string(written), "Password: '[MASKED]'")
+	assert.Contains(t, string(written), "Webhook: https://hooks.example.com/abc")
+}
+
+func TestLineDiff(t *testing.T) {
+	assert.Equal(t, "  a\n- b\n+ c\n  d\n", lineDiff("a\nb\nd", "a\nc\nd"))
+}
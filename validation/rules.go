@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validation
+
+import (
+	"github.com/go-playground/validator/v10"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// TagMutuallyExclusive the field can't be set together with any of the listed sibling fields
+	//
+	//	Image string `validate:"mutually_exclusive=Chart Manifest"`
+	TagMutuallyExclusive = "mutually_exclusive"
+	// TagExactlyOneOf exactly one of the field and the listed sibling fields is set
+	//
+	//	Image string `validate:"exactly_one_of=Chart Manifest"`
+	TagExactlyOneOf = "exactly_one_of"
+	// TagDuration a string such as 30s or 5m, see time.ParseDuration
+	TagDuration = "duration"
+	// TagMinDuration a time.Duration or duration string of at least the parameter
+	//
+	//	Timeout time.Duration `validate:"min_duration=1s,max_duration=1h"`
+	TagMinDuration = "min_duration"
+	// TagMaxDuration a time.Duration or duration string of at most the parameter
+	TagMaxDuration = "max_duration"
+	// TagK8sQuantity a Kubernetes resource quantity such as 500m or 1Gi
+	TagK8sQuantity = "k8s_quantity"
+	// TagK8sName a Kubernetes resource name, a DNS subdomain of lowercase alphanumerics, dashes and dots
+	TagK8sName = "k8s_name"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func mutuallyExclusive(fl validator.FieldLevel) bool {
+	if isZero(fl.Field()) {
+		return true
+	}
+	for _, sibling := range strings.Fields(fl.Param()) {
+		if !isZero(siblingField(fl, sibling)) {
+			return false
+		}
+	}
+	return true
+}
+
+func exactlyOneOf(fl validator.FieldLevel) bool {
+	set := 0
+	if !isZero(fl.Field()) {
+		set++
+	}
+	for _, sibling := range strings.Fields(fl.Param()) {
+		if !isZero(siblingField(fl, sibling)) {
+			set++
+		}
+	}
+	return set == 1
+}
+
+func duration(fl validator.FieldLevel) bool {
+	_, ok := durationOf(fl.Field())
+	return ok
+}
+
+func minDuration(fl validator.FieldLevel) bool {
+	d, ok := durationOf(fl.Field())
+	min, err := time.ParseDuration(fl.Param())
+	return ok && err == nil && d >= min
+}
+
+func maxDuration(fl validator.FieldLevel) bool {
+	d, ok := durationOf(fl.Field())
+	max, err := time.ParseDuration(fl.Param())
+	return ok && err == nil && d <= max
+}
+
+func k8sQuantity(fl validator.FieldLevel) bool {
+	if fl.Field().Kind() != reflect.String {
+		return false
+	}
+	_, err := resource.ParseQuantity(fl.Field().String())
+	return err == nil
+}
+
+func k8sName(fl validator.FieldLevel) bool {
+	if fl.Field().Kind() != reflect.String {
+		return false
+	}
+	return len(k8svalidation.IsDNS1123Subdomain(fl.Field().String())) == 0
+}
+
+// durationOf reads a time.Duration field or parses a string field
+func durationOf(field reflect.Value) (time.Duration, bool) {
+	switch {
+	case field.Type() == durationType:
+		return time.Duration(field.Int()), true
+	case field.Kind() == reflect.String:
+		d, err := time.ParseDuration(field.String())
+		return d, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// siblingField the field of the struct that contains the validated field, an invalid value when there is no such field
+func siblingField(fl validator.FieldLevel, name string) reflect.Value {
+	parent := reflect.Indirect(fl.Parent())
+	if parent.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return parent.FieldByName(name)
+}
+
+func isZero(v reflect.Value) bool {
+	return !v.IsValid() || v.IsZero()
+}
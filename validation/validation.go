@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package validation holds the custom validation tags shared across services, and the fx group through which services
+// add their own tags to the validator of the server:
+//
+//	fx.New(
+//		server.Module,
+//		validation.Provide(validation.Validation{
+//			Tag:     "region",
+//			Func:    func(fl validator.FieldLevel) bool { return slices.Contains(regions, fl.Field().String()) },
+//			Message: "{0} must be a supported region",
+//		}),
+//	)
+package validation
+
+import (
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/fx"
+	"strings"
+	"sync"
+)
+
+// GroupName the fx value group of the validations that the server registers with its validator
+const GroupName = "validations"
+
+type (
+	// Validation a validation tag along with the message of a failed validation
+	Validation struct {
+		Tag string
+		// Func the validation, nil to only add a message to a tag that is already registered such as one of the baked in tags
+		Func validator.Func
+		// CallEvenIfNull runs the validation on nil pointers, which otherwise fail every validation but required ones
+		CallEvenIfNull bool
+		// Message in English, {0} is replaced with the name of the field and {1} with the parameter of the tag,
+		// with the fields of cross-field tags separated by commas
+		Message string
+	}
+
+	// Parameters the validations of the fx group
+	Parameters struct {
+		fx.In
+		Validations []Validation `group:"validations"`
+	}
+)
+
+// messages *validator.Validate -> map[string]string of tag to message
+var messages sync.Map
+
+// Provide adds validations to the fx group
+func Provide(validations ...Validation) fx.Option {
+	options := make([]fx.Option, 0, len(validations))
+	for _, validation := range validations {
+		validation := validation
+		options = append(options, fx.Provide(fx.Annotate(
+			func() Validation { return validation },
+			fx.ResultTags(`group:"`+GroupName+`"`),
+		)))
+	}
+	return fx.Options(options...)
+}
+
+// Validations the shared validation tags, see the tag constants
+func Validations() []Validation {
+	return []Validation{
+		{Tag: TagMutuallyExclusive, Func: mutuallyExclusive, CallEvenIfNull: true, Message: "{0} can't be set together with {1}"},
+		{Tag: TagExactlyOneOf, Func: exactlyOneOf, CallEvenIfNull: true, Message: "exactly one of {0}, {1} must be set"},
+		{Tag: TagDuration, Func: duration, Message: "{0} must be a duration such as 30s or 5m"},
+		{Tag: TagMinDuration, Func: minDuration, Message: "{0} must be a duration of at least {1}"},
+		{Tag: TagMaxDuration, Func: maxDuration, Message: "{0} must be a duration of at most {1}"},
+		{Tag: TagK8sQuantity, Func: k8sQuantity, Message: "{0} must be a Kubernetes resource quantity such as 500m or 1Gi"},
+		{Tag: TagK8sName, Func: k8sName, Message: "{0} must be a valid Kubernetes resource name"},
+		{Tag: "semver", Message: "{0} must be a semantic version such as 1.2.3"},
+		{Tag: "cron", Message: "{0} must be a cron expression"},
+	}
+}
+
+// Register registers the validations and their messages with v
+func Register(v *validator.Validate, validations ...Validation) error {
+	registered := map[string]string{}
+	if existing, ok := messages.Load(v); ok {
+		for tag, message := range existing.(map[string]string) {
+			registered[tag] = message
+		}
+	}
+	for _, validation := range validations {
+		if validation.Func != nil {
+			if err := v.RegisterValidation(validation.Tag, validation.Func, validation.CallEvenIfNull); err != nil {
+				return fmt.Errorf("failed to register validation %q: %w", validation.Tag, err)
+			}
+		}
+		if validation.Message != "" {
+			registered[validation.Tag] = validation.Message
+		}
+	}
+	messages.Store(v, registered)
+	return nil
+}
+
+// Message the message of a failed validation, fields failing tags without a registered message get the default message of the validator
+func Message(v *validator.Validate, fe validator.FieldError) string {
+	if registered, ok := messages.Load(v); ok {
+		if message, ok := registered.(map[string]string)[fe.Tag()]; ok {
+			return strings.NewReplacer("{0}", fe.Field(), "{1}", strings.Join(strings.Fields(fe.Param()), ", ")).Replace(message)
+		}
+	}
+	return fe.Error()
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validation
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/fx"
+	"testing"
+	"time"
+)
+
+type deployRequest struct {
+	Image    string        `validate:"exactly_one_of=Chart Manifest"`
+	Chart    *string       `validate:"mutually_exclusive=Image"`
+	Manifest string        `validate:"omitempty,mutually_exclusive=Image"`
+	Timeout  time.Duration `validate:"min_duration=1s,max_duration=1h"`
+	Interval string        `validate:"omitempty,duration,max_duration=10m"`
+	CPU      string        `validate:"omitempty,k8s_quantity"`
+	Name     string        `validate:"omitempty,k8s_name"`
+	Version  string        `validate:"omitempty,semver"`
+}
+
+func newTestValidator(t *testing.T) *validator.Validate {
+	v := validator.New()
+	assert.NoError(t, Register(v, Validations()...))
+	return v
+}
+
+func TestValidations(t *testing.T) {
+	chart := "nginx"
+	cases := []struct {
+		name    string
+		request deployRequest
+		failed  []string
+	}{
+		{
+			name:    "valid",
+			request: deployRequest{Image: "nginx:1", Timeout: time.Minute, Interval: "30s", CPU: "500m", Name: "web-1", Version: "1.2.3"},
+		},
+		{
+			name:    "none of exactly one of",
+			request: deployRequest{Timeout: time.Minute},
+			failed:  []string{"exactly_one_of"},
+		},
+		{
+			name:    "mutually exclusive",
+			request: deployRequest{Image: "nginx:1", Chart: &chart, Timeout: time.Minute},
+			failed:  []string{"exactly_one_of", "mutually_exclusive"},
+		},
+		{
+			name:    "durations",
+			request: deployRequest{Image: "nginx:1", Timeout: time.Millisecond, Interval: "1h"},
+			failed:  []string{"min_duration", "max_duration"},
+		},
+		{
+			name:    "malformed",
+			request: deployRequest{Image: "nginx:1", Timeout: time.Minute, Interval: "soon", CPU: "lots", Name: "Web_1"},
+			failed:  []string{"duration", "k8s_quantity", "k8s_name"},
+		},
+	}
+	v := newTestValidator(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := v.Struct(c.request)
+			if len(c.failed) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var tags []string
+			for _, fe := range err.(validator.ValidationErrors) {
+				tags = append(tags, fe.Tag())
+			}
+			assert.Equal(t, c.failed, tags)
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	v := newTestValidator(t)
+	err := v.Struct(deployRequest{Timeout: time.Millisecond})
+	errs := err.(validator.ValidationErrors)
+
+	assert.Equal(t, "exactly one of Image, Chart, Manifest must be set", Message(v, errs[0]))
+	assert.Equal(t, "Timeout must be a duration of at least 1s", Message(v, errs[1]))
+
+	unregistered := validator.New()
+	err = unregistered.Var("", "required")
+	assert.Equal(t, err.(validator.ValidationErrors)[0].Error(), Message(unregistered, err.(validator.ValidationErrors)[0]))
+}
+
+func TestProvide(t *testing.T) {
+	var provided []Validation
+	app := fx.New(
+		fx.NopLogger,
+		Provide(Validation{Tag: "region"}, Validation{Tag: "zone"}),
+		fx.Invoke(func(p Parameters) {
+			provided = p.Validations
+		}),
+	)
+	assert.NoError(t, app.Err())
+	assert.Len(t, provided, 2)
+}
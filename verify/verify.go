@@ -0,0 +1,378 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package verify checks that downloaded artifacts, such as plugins or agent binaries, are the ones that were published before
+// they're used. Artifacts are checked against a SHA-256 checksum, a signature written by cosign sign-blob with a key, an in-toto
+// attestation in a DSSE envelope written by cosign attest-blob, or any combination of them:
+//
+//	verify:
+//	  requireSignature: true
+//	  keys:
+//	    release: encrypted:secrets-manager!r:us-west-2!s:release-signing!k:publicKey
+//
+// Download replaces unverified downloads with http.Get, the artifact is only moved to its path once it's verified.
+// Keyless signatures, verified with Fulcio certificates and the Rekor transparency log, aren't supported
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/secrets"
+	"go.uber.org/fx"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// InTotoPayloadType the DSSE payload type of in-toto statements
+	InTotoPayloadType = "application/vnd.in-toto+json"
+	dssePrefix        = "DSSEv1"
+)
+
+var (
+	ErrChecksumMismatch   = errors.New("the artifact doesn't match its checksum")
+	ErrInvalidSignature   = errors.New("the artifact isn't signed by a trusted key")
+	ErrInvalidAttestation = errors.New("the attestation isn't valid for the artifact")
+	ErrUnsigned           = errors.New("the artifact must be signed or attested by a trusted key")
+	ErrNothingToVerify    = errors.New("expected a checksum, signature or attestation to verify the artifact with")
+)
+
+type (
+	Configuration struct {
+		// Keys the public keys artifacts are signed with by name, PEM encoded given inline or as a reference to a secret engine,
+		// ex: encrypted:secrets-manager!r:us-west-2!s:release-signing!k:publicKey. ECDSA, RSA and Ed25519 keys are supported
+		Keys map[string]string
+		// RequireSignature rejects artifacts that are only checked against a checksum, a signature or attestation is required
+		RequireSignature bool
+	}
+
+	Parameters struct {
+		fx.In
+		Config Configuration
+	}
+
+	// Artifact what the artifact is expected to be, at least one of the fields is required
+	Artifact struct {
+		// SHA256 the hex encoded checksum of the artifact, see ChecksumOf to read it from a checksums file
+		SHA256 string
+		// Signature the base64 encoded signature of the artifact written by cosign sign-blob --key
+		Signature string
+		// Attestation the DSSE envelope of an in-toto statement about the artifact written by cosign attest-blob, as JSON or base64 encoded JSON
+		Attestation []byte
+		// PredicateType the predicate type the attestation must have, ex: https://slsa.dev/provenance/v1. Any is accepted when empty
+		PredicateType string
+	}
+
+	// Result what was verified about an artifact
+	Result struct {
+		// SHA256 the hex encoded checksum of the artifact
+		SHA256 string
+		// SignedBy the name of the key that signed the artifact, if it was signed
+		SignedBy string
+		// AttestedBy the name of the key that signed the attestation, if it was attested
+		AttestedBy string
+		// Statement the in-toto statement of the attestation, if it was attested
+		Statement *Statement
+	}
+
+	// Statement an in-toto statement, the predicate is left for the caller to decode as it depends on PredicateType
+	Statement struct {
+		Type          string          `json:"_type"`
+		Subject       []Subject       `json:"subject"`
+		PredicateType string          `json:"predicateType"`
+		Predicate     json.RawMessage `json:"predicate"`
+	}
+
+	Subject struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	}
+
+	// Verifier verifies artifacts with the trusted keys of the Configuration
+	Verifier struct {
+		keys             map[string]crypto.PublicKey
+		names            []string
+		requireSignature bool
+	}
+
+	envelope struct {
+		PayloadType string `json:"payloadType"`
+		Payload     string `json:"payload"`
+		Signatures  []struct {
+			KeyID string `json:"keyid"`
+			Sig   string `json:"sig"`
+		} `json:"signatures"`
+	}
+)
+
+var Module = fx.Module("verify", fx.Provide(New))
+
+func New(p Parameters) (*Verifier, error) {
+	return NewVerifier(context.Background(), p.Config)
+}
+
+// NewVerifier creates a Verifier outside of fx, reading the keys that reference a secret engine
+func NewVerifier(ctx context.Context, config Configuration) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string]crypto.PublicKey, len(config.Keys)), requireSignature: config.RequireSignature}
+	for name, value := range config.Keys {
+		key, err := parsePublicKey(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("verify.keys.%s: %w", name, err)
+		}
+		v.keys[name] = key
+		v.names = append(v.names, name)
+	}
+	sort.Strings(v.names)
+	if v.requireSignature && len(v.keys) == 0 {
+		return nil, errors.New("verify.requireSignature requires at least one key")
+	}
+	return v, nil
+}
+
+// Verify reads the artifact and checks it against what it's expected to be
+func (v *Verifier) Verify(artifact io.Reader, expected Artifact) (*Result, error) {
+	if expected.SHA256 == "" && expected.Signature == "" && len(expected.Attestation) == 0 {
+		return nil, ErrNothingToVerify
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, artifact); err != nil {
+		return nil, fmt.Errorf("failed to read the artifact: %w", err)
+	}
+	digest := h.Sum(nil)
+	result := &Result{SHA256: hex.EncodeToString(digest)}
+
+	if expected.SHA256 != "" && !strings.EqualFold(strings.TrimSpace(expected.SHA256), result.SHA256) {
+		return nil, fmt.Errorf("%w: expected %s but got %s", ErrChecksumMismatch, expected.SHA256, result.SHA256)
+	}
+	if expected.Signature != "" {
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(expected.Signature))
+		if err != nil {
+			return nil, fmt.Errorf("%w: the signature isn't base64 encoded", ErrInvalidSignature)
+		}
+		if result.SignedBy = v.verifyDigest(digest, signature); result.SignedBy == "" {
+			return nil, ErrInvalidSignature
+		}
+	}
+	if len(expected.Attestation) > 0 {
+		statement, attestedBy, err := v.verifyAttestation(expected.Attestation, result.SHA256, expected.PredicateType)
+		if err != nil {
+			return nil, err
+		}
+		result.Statement, result.AttestedBy = statement, attestedBy
+	}
+	if v.requireSignature && result.SignedBy == "" && result.AttestedBy == "" {
+		return nil, ErrUnsigned
+	}
+	return result, nil
+}
+
+// Download fetches the artifact at url and verifies it, it's only moved to path once verified so path never holds an unverified
+// artifact. The file is created with mode 0600, change it to make a binary executable
+func (v *Verifier) Download(ctx context.Context, client *http.Client, url string, path string, expected Artifact) (*Result, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	result, err := v.Verify(io.TeeReader(resp.Body, tmp), expected)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ChecksumOf the checksum of the named artifact in a checksums file written by sha256sum, such as the SHA256SUMS of a release.
+// Verify the checksums file itself, with a signature, before trusting it
+func ChecksumOf(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		checksum, file, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+		// binary mode entries are marked with an asterisk
+		if strings.TrimPrefix(strings.TrimSpace(file), "*") == name {
+			return checksum, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// verifyDigest the name of the key that signed the SHA-256 digest, empty when none did. Ed25519 keys sign whole messages, so
+// they're only used for attestations
+func (v *Verifier) verifyDigest(digest []byte, signature []byte) string {
+	for _, name := range v.names {
+		switch key := v.keys[name].(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest, signature) {
+				return name
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// verifyAttestation verifies the DSSE envelope and returns its in-toto statement, which must have the artifact as a subject
+func (v *Verifier) verifyAttestation(raw []byte, sha256Hex string, predicateType string) (*Statement, string, error) {
+	raw = bytes.TrimSpace(raw)
+	if !bytes.HasPrefix(raw, []byte("{")) {
+		decoded, err := base64.StdEncoding.DecodeString(string(raw))
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: the envelope is neither JSON nor base64 encoded JSON", ErrInvalidAttestation)
+		}
+		raw = decoded
+	}
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, "", fmt.Errorf("%w: malformed envelope: %s", ErrInvalidAttestation, err)
+	}
+	if env.PayloadType != InTotoPayloadType {
+		return nil, "", fmt.Errorf("%w: unexpected payload type %q", ErrInvalidAttestation, env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: the payload isn't base64 encoded", ErrInvalidAttestation)
+	}
+
+	pae := []byte(fmt.Sprintf("%s %d %s %d ", dssePrefix, len(env.PayloadType), env.PayloadType, len(payload)))
+	pae = append(pae, payload...)
+	attestedBy := ""
+	for _, s := range env.Signatures {
+		signature, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if attestedBy = v.verifyMessage(pae, signature); attestedBy != "" {
+			break
+		}
+	}
+	if attestedBy == "" {
+		return nil, "", fmt.Errorf("%w: the envelope isn't signed by a trusted key", ErrInvalidAttestation)
+	}
+
+	var statement Statement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, "", fmt.Errorf("%w: malformed statement: %s", ErrInvalidAttestation, err)
+	}
+	if predicateType != "" && statement.PredicateType != predicateType {
+		return nil, "", fmt.Errorf("%w: expected predicate type %q but got %q", ErrInvalidAttestation, predicateType, statement.PredicateType)
+	}
+	for _, subject := range statement.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], sha256Hex) {
+			return &statement, attestedBy, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: the artifact isn't a subject of the statement", ErrInvalidAttestation)
+}
+
+// verifyMessage the name of the key that signed the message, empty when none did
+func (v *Verifier) verifyMessage(message []byte, signature []byte) string {
+	digest := sha256.Sum256(message)
+	if name := v.verifyDigest(digest[:], signature); name != "" {
+		return name
+	}
+	for _, name := range v.names {
+		if key, ok := v.keys[name].(ed25519.PublicKey); ok && ed25519.Verify(key, message, signature) {
+			return name
+		}
+	}
+	return ""
+}
+
+// parsePublicKey parses a PEM encoded public key, reading it from the secret engine it references if any
+func parsePublicKey(ctx context.Context, value string) (crypto.PublicKey, error) {
+	if secrets.IsEncryptedSecret(value) {
+		d, err := secrets.NewDecrypter(ctx, value)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = d.Decrypt(); err != nil {
+			return nil, err
+		}
+		// encryptedFile references are decrypted to a file holding the key
+		if d.IsFile() {
+			contents, err := os.ReadFile(value)
+			if err != nil {
+				return nil, err
+			}
+			value = string(contents)
+		}
+	}
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, errors.New("the key isn't PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
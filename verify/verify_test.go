@@ -0,0 +1,235 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package verify
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var artifact = []byte("#!/bin/sh\necho agent\n")
+
+func publicKeyPEM(t *testing.T, key any) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func signBlob(t *testing.T, key *ecdsa.PrivateKey, blob []byte) string {
+	digest := sha256.Sum256(blob)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func attest(t *testing.T, sign func(pae []byte) []byte, digest string, predicateType string) []byte {
+	payload, err := json.Marshal(Statement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []Subject{{Name: "agent", Digest: map[string]string{"sha256": digest}}},
+		PredicateType: predicateType,
+		Predicate:     json.RawMessage(`{"builder":{"id":"https://github.com/armory-io/agent/actions"}}`),
+	})
+	require.NoError(t, err)
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(InTotoPayloadType), InTotoPayloadType, len(payload), payload))
+	envelope, err := json.Marshal(map[string]any{
+		"payloadType": InTotoPayloadType,
+		"payload":     base64.StdEncoding.EncodeToString(payload),
+		"signatures":  []map[string]string{{"keyid": "", "sig": base64.StdEncoding.EncodeToString(sign(pae))}},
+	})
+	require.NoError(t, err)
+	return envelope
+}
+
+func TestVerify(t *testing.T) {
+	releaseKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	provenancePub, provenanceKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	v, err := NewVerifier(context.Background(), Configuration{Keys: map[string]string{
+		"release":    publicKeyPEM(t, &releaseKey.PublicKey),
+		"provenance": publicKeyPEM(t, provenancePub),
+	}})
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+	signPAE := func(pae []byte) []byte { return ed25519.Sign(provenanceKey, pae) }
+	slsa := "https://slsa.dev/provenance/v1"
+
+	cases := []struct {
+		name     string
+		expected Artifact
+		result   *Result
+		err      error
+	}{
+		{
+			name:     "matching checksum",
+			expected: Artifact{SHA256: strings.ToUpper(digest)},
+			result:   &Result{SHA256: digest},
+		},
+		{
+			name:     "mismatched checksum",
+			expected: Artifact{SHA256: strings.Repeat("0", 64)},
+			err:      ErrChecksumMismatch,
+		},
+		{
+			name:     "signature of a trusted key",
+			expected: Artifact{Signature: signBlob(t, releaseKey, artifact)},
+			result:   &Result{SHA256: digest, SignedBy: "release"},
+		},
+		{
+			name:     "signature of an unknown key",
+			expected: Artifact{Signature: signBlob(t, otherKey, artifact)},
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "signature of another artifact",
+			expected: Artifact{Signature: signBlob(t, releaseKey, []byte("tampered"))},
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "attestation of the artifact",
+			expected: Artifact{Attestation: attest(t, signPAE, digest, slsa), PredicateType: slsa},
+		},
+		{
+			name:     "base64 encoded attestation",
+			expected: Artifact{Attestation: []byte(base64.StdEncoding.EncodeToString(attest(t, signPAE, digest, slsa)))},
+		},
+		{
+			name:     "attestation of another artifact",
+			expected: Artifact{Attestation: attest(t, signPAE, strings.Repeat("0", 64), slsa)},
+			err:      ErrInvalidAttestation,
+		},
+		{
+			name:     "attestation of another predicate type",
+			expected: Artifact{Attestation: attest(t, signPAE, digest, "https://spdx.dev/Document"), PredicateType: slsa},
+			err:      ErrInvalidAttestation,
+		},
+		{
+			name: "attestation of an unknown key",
+			expected: Artifact{Attestation: attest(t, func(pae []byte) []byte {
+				d := sha256.Sum256(pae)
+				signature, _ := ecdsa.SignASN1(rand.Reader, otherKey, d[:])
+				return signature
+			}, digest, slsa)},
+			err: ErrInvalidAttestation,
+		},
+		{
+			name: "nothing to verify",
+			err:  ErrNothingToVerify,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := v.Verify(strings.NewReader(string(artifact)), c.expected)
+			if c.err != nil {
+				assert.ErrorIs(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			if c.result != nil {
+				assert.Equal(t, c.result, result)
+				return
+			}
+			assert.Equal(t, "provenance", result.AttestedBy)
+			require.NotNil(t, result.Statement)
+			assert.Equal(t, slsa, result.Statement.PredicateType)
+		})
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+	_, err := NewVerifier(context.Background(), Configuration{RequireSignature: true})
+	assert.Error(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	v, err := NewVerifier(context.Background(), Configuration{RequireSignature: true, Keys: map[string]string{"release": publicKeyPEM(t, &key.PublicKey)}})
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(artifact)
+	_, err = v.Verify(strings.NewReader(string(artifact)), Artifact{SHA256: hex.EncodeToString(sum[:])})
+	assert.ErrorIs(t, err, ErrUnsigned)
+	_, err = v.Verify(strings.NewReader(string(artifact)), Artifact{SHA256: hex.EncodeToString(sum[:]), Signature: signBlob(t, key, artifact)})
+	assert.NoError(t, err)
+}
+
+func TestDownload(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	v, err := NewVerifier(context.Background(), Configuration{Keys: map[string]string{"release": publicKeyPEM(t, &key.PublicKey)}})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(artifact)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent")
+	_, err = v.Download(context.Background(), nil, server.URL+"/agent", path, Artifact{Signature: signBlob(t, key, []byte("tampered"))})
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = v.Download(context.Background(), nil, server.URL+"/missing", path, Artifact{Signature: signBlob(t, key, artifact)})
+	assert.Error(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "unverified artifacts are removed")
+
+	result, err := v.Download(context.Background(), server.Client(), server.URL+"/agent", path, Artifact{Signature: signBlob(t, key, artifact)})
+	require.NoError(t, err)
+	assert.Equal(t, "release", result.SignedBy)
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, artifact, contents)
+}
+
+func TestChecksumOf(t *testing.T) {
+	checksums := []byte("0123abcd  agent-linux-amd64\nfedc3210 *agent-darwin-arm64\n")
+	checksum, err := ChecksumOf(checksums, "agent-darwin-arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, "fedc3210", checksum)
+	checksum, err = ChecksumOf(checksums, "agent-linux-amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, "0123abcd", checksum)
+	_, err = ChecksumOf(checksums, "agent-windows-amd64.exe")
+	assert.EqualError(t, err, "no checksum for agent-windows-amd64.exe")
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package version negotiates features between services during rolling upgrades. A service lists the API versions it supports
+// at its /info endpoint, and checks the versions of its peers before using a feature they may not have yet:
+//
+//	version:
+//	  apis:
+//	    - deployments.v1
+//	    - deployments.v2
+//	  peers:
+//	    deploy-engine: http://deploy-engine:3001
+//
+//	if ok, _ := negotiator.PeerSupports(ctx, "deploy-engine", "deployments.v2"); ok {
+//		return c.startDeploymentV2(ctx, request)
+//	}
+//	return c.startDeploymentV1(ctx, request)
+package version
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/management/info"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// infoDetail the key of the /info endpoint that lists the API versions of a service
+	infoDetail = "apiVersions"
+
+	defaultCacheTTL     = time.Minute
+	defaultFetchTimeout = 5 * time.Second
+)
+
+// ErrUnknownPeer the peer isn't in version.peers
+var ErrUnknownPeer = errors.New("unknown peer")
+
+type (
+	Configuration struct {
+		// APIs the API versions the service supports, ex: deployments.v2
+		APIs []string
+		// Peers the base URLs of the management servers of peer services by name, their versions are read from the /info endpoint below it
+		Peers map[string]string
+		// CacheTTL how long the versions of a peer are cached, defaults to 1 minute
+		CacheTTL time.Duration
+	}
+
+	Parameters struct {
+		fx.In
+
+		Config Configuration `optional:"true"`
+		Log    *zap.SugaredLogger
+		// Client the client peers are called with, defaults to a client with a 5 second timeout
+		Client *http.Client `optional:"true"`
+		Clock  clock.Clock  `optional:"true"`
+	}
+
+	// Negotiator knows the API versions of the service and of its peers
+	Negotiator struct {
+		apis   map[string]bool
+		peers  map[string]*peer
+		ttl    time.Duration
+		client *http.Client
+		clock  clock.Clock
+		log    *zap.SugaredLogger
+	}
+
+	// peer the cached API versions of a peer
+	peer struct {
+		name      string
+		url       string
+		mu        sync.Mutex
+		apis      map[string]bool
+		fetchedAt time.Time
+	}
+
+	infoResponse struct {
+		APIVersions []string `json:"apiVersions"`
+	}
+)
+
+var Module = fx.Module(
+	"version",
+	fx.Provide(New, InfoContributor),
+)
+
+// New creates the Negotiator of the configuration
+func New(p Parameters) *Negotiator {
+	n := &Negotiator{
+		apis:   toSet(p.Config.APIs),
+		peers:  make(map[string]*peer, len(p.Config.Peers)),
+		ttl:    p.Config.CacheTTL,
+		client: p.Client,
+		clock:  clock.OrDefault(p.Clock),
+		log:    p.Log,
+	}
+	if n.ttl <= 0 {
+		n.ttl = defaultCacheTTL
+	}
+	if n.client == nil {
+		n.client = &http.Client{Timeout: defaultFetchTimeout}
+	}
+	for name, url := range p.Config.Peers {
+		n.peers[name] = &peer{name: name, url: strings.TrimSuffix(url, "/") + "/info"}
+	}
+	return n
+}
+
+// InfoContributor lists the API versions of the service at the /info endpoint, where peers read them
+func InfoContributor(n *Negotiator) info.InfoContributorOut {
+	return info.InfoContributorOut{InfoContributor: n}
+}
+
+func (n *Negotiator) Contribute(builder *info.InfoBuilder) {
+	builder.WithDetail(infoDetail, sorted(n.apis))
+}
+
+// Supports whether the service itself supports the API version
+func (n *Negotiator) Supports(api string) bool {
+	return n.apis[api]
+}
+
+// PeerSupports whether the peer supports the API version. Peers that don't list their versions support none, so features
+// are only used once every peer has been upgraded to list them
+func (n *Negotiator) PeerSupports(ctx context.Context, name string, api string) (bool, error) {
+	apis, err := n.peerAPIs(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return apis[api], nil
+}
+
+// PeerVersions the sorted API versions of the peer
+func (n *Negotiator) PeerVersions(ctx context.Context, name string) ([]string, error) {
+	apis, err := n.peerAPIs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return sorted(apis), nil
+}
+
+// peerAPIs the cached API versions of the peer, fetched again once they are older than the ttl. When the peer can't be
+// reached the versions fetched last are used until it can
+func (n *Negotiator) peerAPIs(ctx context.Context, name string) (map[string]bool, error) {
+	p, ok := n.peers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.apis != nil && n.clock.Since(p.fetchedAt) < n.ttl {
+		return p.apis, nil
+	}
+
+	apis, err := n.fetch(ctx, p)
+	if err != nil {
+		if p.apis != nil {
+			n.log.Warnw("failed to fetch the API versions of peer, using the versions fetched last", "peer", name, "error", err)
+			return p.apis, nil
+		}
+		return nil, err
+	}
+	p.apis = apis
+	p.fetchedAt = n.clock.Now()
+	return apis, nil
+}
+
+func (n *Negotiator) fetch(ctx context.Context, p *peer) (map[string]bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := n.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the API versions of %s: %w", p.name, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the API versions of %s: %s responded with %d", p.name, p.url, response.StatusCode)
+	}
+
+	var body infoResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode the API versions of %s: %w", p.name, err)
+	}
+	return toSet(body.APIVersions), nil
+}
+
+func toSet(apis []string) map[string]bool {
+	set := make(map[string]bool, len(apis))
+	for _, api := range apis {
+		set[api] = true
+	}
+	return set
+}
+
+func sorted(set map[string]bool) []string {
+	apis := make([]string, 0, len(set))
+	for api := range set {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+	return apis
+}
@@ -0,0 +1,80 @@
+package version
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/management/info"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegotiator(t *testing.T) {
+	var fetches atomic.Int32
+	body := `{"application": {"name": "deploy-engine"}, "apiVersions": ["deployments.v1", "deployments.v2"]}`
+	status := http.StatusOK
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		assert.Equal(t, "/management/info", r.URL.Path)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer peerServer.Close()
+
+	fake := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	n := New(Parameters{
+		Config: Configuration{
+			APIs:  []string{"deployments.v2", "deployments.v1"},
+			Peers: map[string]string{"deploy-engine": peerServer.URL + "/management/", "legacy": peerServer.URL + "/management"},
+		},
+		Log:   zap.NewNop().Sugar(),
+		Clock: fake,
+	})
+	ctx := context.Background()
+
+	assert.True(t, n.Supports("deployments.v2"))
+	assert.False(t, n.Supports("deployments.v3"))
+
+	ok, err := n.PeerSupports(ctx, "deploy-engine", "deployments.v2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	versions, err := n.PeerVersions(ctx, "deploy-engine")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deployments.v1", "deployments.v2"}, versions)
+	assert.Equal(t, int32(1), fetches.Load(), "versions are cached")
+
+	body = `{"apiVersions": ["deployments.v1"]}`
+	fake.Advance(time.Minute)
+	ok, err = n.PeerSupports(ctx, "deploy-engine", "deployments.v2")
+	assert.NoError(t, err)
+	assert.False(t, ok, "versions are fetched again after the ttl, i.e. when a rollout is rolled back")
+
+	status = http.StatusServiceUnavailable
+	fake.Advance(time.Minute)
+	ok, err = n.PeerSupports(ctx, "deploy-engine", "deployments.v1")
+	assert.NoError(t, err)
+	assert.True(t, ok, "the versions fetched last are used while the peer is unavailable")
+
+	_, err = n.PeerSupports(ctx, "legacy", "deployments.v1")
+	assert.EqualError(t, err, "failed to fetch the API versions of legacy: "+peerServer.URL+"/management/info responded with 503")
+
+	status = http.StatusOK
+	body = `{"application": {"name": "legacy"}}`
+	ok, err = n.PeerSupports(ctx, "legacy", "deployments.v1")
+	assert.NoError(t, err)
+	assert.False(t, ok, "peers that don't list their versions support none")
+
+	_, err = n.PeerSupports(ctx, "billing", "invoices.v1")
+	assert.ErrorIs(t, err, ErrUnknownPeer)
+}
+
+func TestContribute(t *testing.T) {
+	n := New(Parameters{Config: Configuration{APIs: []string{"deployments.v2", "deployments.v1"}}, Log: zap.NewNop().Sugar()})
+	is := &info.InfoService{}
+	is.AddInfoContributor(InfoContributor(n).InfoContributor)
+	assert.Equal(t, []string{"deployments.v1", "deployments.v2"}, (*is.GetInfoContent())[infoDetail])
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package warmup runs the warm-up tasks of components in the background at startup, such as fetching JWKS, pinging databases,
+// priming caches or compiling templates, so the first requests after a deploy don't pay for them. The service reports not
+// ready until every task has finished, and the outcome of each task is listed at the /info endpoint.
+//
+//	fx.New(
+//		warmup.Module,
+//		warmup.Provide(warmup.Task{
+//			Name:    "jwks",
+//			Timeout: 10 * time.Second,
+//			WarmUp:  verifier.FetchKeys,
+//		}),
+//	)
+package warmup
+
+import (
+	"context"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/armory-io/go-commons/management"
+	"github.com/armory-io/go-commons/management/info"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GroupName the fx value group of the warm-up tasks
+	GroupName = "warmups"
+
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusTimedOut  Status = "timedOut"
+
+	defaultTimeout = 30 * time.Second
+)
+
+type (
+	// Status the outcome of a task
+	Status string
+
+	// Task a warm-up function of a component
+	Task struct {
+		Name string
+		// Timeout how long the task may run, defaults to 30 seconds. The context of WarmUp is cancelled when it runs out
+		Timeout time.Duration
+		// Optional the service is ready even if the task fails or times out, the failure is only logged and listed at /info
+		Optional bool
+		WarmUp   func(ctx context.Context) error
+	}
+
+	// Result the outcome of a task, listed at the /info endpoint
+	Result struct {
+		Status   Status `json:"status"`
+		Duration string `json:"duration,omitempty"`
+		Error    string `json:"error,omitempty"`
+		Optional bool   `json:"optional,omitempty"`
+	}
+
+	Parameters struct {
+		fx.In
+		Log   *zap.SugaredLogger
+		Tasks []Task      `group:"warmups"`
+		Clock clock.Clock `optional:"true"`
+	}
+
+	// Runner runs the tasks concurrently and tracks their results
+	Runner struct {
+		tasks   []Task
+		log     *zap.SugaredLogger
+		clock   clock.Clock
+		mu      sync.RWMutex
+		results map[string]Result
+		done    chan struct{}
+	}
+)
+
+// Module runs the tasks of the fx group when the application starts
+var Module = fx.Module("warmup",
+	fx.Provide(
+		New,
+		func(r *Runner) management.HealthIndicator { return management.HealthIndicator{HealthIndicator: r} },
+		func(r *Runner) info.InfoContributorOut { return info.InfoContributorOut{InfoContributor: r} },
+	),
+	fx.Invoke(func(lc fx.Lifecycle, r *Runner) {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				// the start context is cancelled once the application has started, the tasks outlive it
+				go r.Run(context.Background())
+				return nil
+			},
+		})
+	}),
+)
+
+// Provide adds tasks to the fx group
+func Provide(tasks ...Task) fx.Option {
+	options := make([]fx.Option, 0, len(tasks))
+	for _, task := range tasks {
+		task := task
+		options = append(options, fx.Provide(fx.Annotate(
+			func() Task { return task },
+			fx.ResultTags(`group:"`+GroupName+`"`),
+		)))
+	}
+	return fx.Options(options...)
+}
+
+// New creates a Runner, failing when two tasks have the same name
+func New(p Parameters) (*Runner, error) {
+	r := &Runner{
+		tasks:   p.Tasks,
+		log:     p.Log,
+		clock:   clock.OrDefault(p.Clock),
+		results: make(map[string]Result, len(p.Tasks)),
+		done:    make(chan struct{}),
+	}
+	for _, task := range p.Tasks {
+		if task.Name == "" || task.WarmUp == nil {
+			return nil, fmt.Errorf("warmup: tasks must have a name and a WarmUp function")
+		}
+		if _, exists := r.results[task.Name]; exists {
+			return nil, fmt.Errorf("warmup: duplicate task %s", task.Name)
+		}
+		r.results[task.Name] = Result{Status: StatusPending, Optional: task.Optional}
+	}
+	return r, nil
+}
+
+// Run runs the tasks concurrently and returns once all of them have finished or timed out, it must only be called once
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, task := range r.tasks {
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			r.run(ctx, task)
+		}(task)
+	}
+	wg.Wait()
+	close(r.done)
+}
+
+// Done is closed once all tasks have finished
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+// Results the results of the tasks by name
+func (r *Runner) Results() map[string]Result {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	results := make(map[string]Result, len(r.results))
+	for name, result := range r.results {
+		results[name] = result
+	}
+	return results
+}
+
+// Health implements the health indicator of the management package, the service is ready once every task that isn't optional
+// has succeeded
+func (r *Runner) Health() *management.Health {
+	var pending, failed []string
+	for name, result := range r.Results() {
+		switch {
+		case result.Status == StatusPending:
+			pending = append(pending, name)
+		case result.Status != StatusSucceeded && !result.Optional:
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(pending)
+	sort.Strings(failed)
+
+	health := &management.Health{Name: "warmup", Ready: len(pending) == 0 && len(failed) == 0, Alive: true}
+	switch {
+	case len(failed) > 0:
+		health.Msg = "failed: " + strings.Join(failed, ", ")
+	case len(pending) > 0:
+		health.Msg = "warming up: " + strings.Join(pending, ", ")
+	}
+	return health
+}
+
+// Contribute implements the info contributor of the management package
+func (r *Runner) Contribute(builder *info.InfoBuilder) {
+	builder.WithDetail("warmup", r.Results())
+}
+
+func (r *Runner) run(ctx context.Context, task Task) {
+	timeout := task.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := r.clock.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- task.WarmUp(ctx)
+	}()
+
+	result := Result{Optional: task.Optional}
+	select {
+	case err := <-errs:
+		result.Status = StatusSucceeded
+		if err != nil {
+			result.Status = StatusFailed
+			result.Error = err.Error()
+		}
+	case <-r.clock.After(timeout):
+		result.Status = StatusTimedOut
+		result.Error = fmt.Sprintf("did not finish within %s", timeout)
+	}
+	result.Duration = r.clock.Since(start).String()
+
+	log := r.log.With("task", task.Name, "duration", result.Duration)
+	switch {
+	case result.Status == StatusSucceeded:
+		log.Info("Warm-up task succeeded")
+	case task.Optional:
+		log.Warnw("Optional warm-up task did not succeed", "status", result.Status, "error", result.Error)
+	default:
+		log.Errorw("Warm-up task did not succeed, the service will not be ready", "status", result.Status, "error", result.Error)
+	}
+
+	r.mu.Lock()
+	r.results[task.Name] = result
+	r.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package warmup
+
+import (
+	"context"
+	"errors"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestRunner(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	release := make(chan struct{})
+	r, err := New(Parameters{
+		Log:   zap.NewNop().Sugar(),
+		Clock: fake,
+		Tasks: []Task{
+			{Name: "jwks", Timeout: 10 * time.Second, WarmUp: func(ctx context.Context) error {
+				<-release
+				return nil
+			}},
+			{Name: "cache", Optional: true, WarmUp: func(ctx context.Context) error {
+				return errors.New("redis unavailable")
+			}},
+			{Name: "db", Timeout: 5 * time.Second, WarmUp: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+		},
+	})
+	assert.NoError(t, err)
+
+	go r.Run(context.Background())
+	fake.BlockUntil(3)
+	assert.False(t, r.Health().Ready)
+	assert.Contains(t, r.Health().Msg, "warming up: ")
+
+	close(release)
+	assert.Eventually(t, func() bool { return r.Results()["jwks"].Status == StatusSucceeded }, time.Second, time.Millisecond)
+	fake.Advance(5 * time.Second)
+	<-r.Done()
+
+	results := r.Results()
+	assert.Equal(t, Result{Status: StatusSucceeded, Duration: "0s"}, results["jwks"])
+	assert.Equal(t, Result{Status: StatusFailed, Duration: "0s", Error: "redis unavailable", Optional: true}, results["cache"])
+	assert.Equal(t, Result{Status: StatusTimedOut, Duration: "5s", Error: "did not finish within 5s"}, results["db"])
+
+	health := r.Health()
+	assert.False(t, health.Ready)
+	assert.True(t, health.Alive)
+	assert.Equal(t, "failed: db", health.Msg)
+}
+
+func TestRunnerIsReadyWhenOptionalTasksFail(t *testing.T) {
+	r, err := New(Parameters{
+		Log: zap.NewNop().Sugar(),
+		Tasks: []Task{
+			{Name: "templates", WarmUp: func(ctx context.Context) error { return nil }},
+			{Name: "cache", Optional: true, WarmUp: func(ctx context.Context) error { return errors.New("redis unavailable") }},
+		},
+	})
+	assert.NoError(t, err)
+
+	r.Run(context.Background())
+	assert.True(t, r.Health().Ready)
+	assert.Empty(t, r.Health().Msg)
+}
+
+func TestNewRejectsInvalidTasks(t *testing.T) {
+	noop := func(ctx context.Context) error { return nil }
+	_, err := New(Parameters{Tasks: []Task{{Name: "jwks", WarmUp: noop}, {Name: "jwks", WarmUp: noop}}})
+	assert.EqualError(t, err, "warmup: duplicate task jwks")
+
+	_, err = New(Parameters{Tasks: []Task{{Name: "jwks"}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"time"
+)
+
+const (
+	instrumentationName = "github.com/armory-io/go-commons/wormhole/proxy"
+	requestsMetric      = "wormhole.client.requests"
+	dialsMetric         = "wormhole.proxy.dials"
+
+	operationCreateSession       = "createSession"
+	operationFetchK8sCredentials = "fetchKubernetesCredentials"
+	operationListAgents          = "listAgents"
+)
+
+// instrumentation records a span and a timer for every call to wormhole and every dial to the SOCKS proxy,
+// tagged by agent identifier so that connectivity issues with a single agent stand out
+type instrumentation struct {
+	tracer trace.Tracer
+	ms     metrics.MetricsSvc
+}
+
+var defaultDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+func newInstrumentation(ms metrics.MetricsSvc) *instrumentation {
+	return &instrumentation{
+		tracer: otel.Tracer(instrumentationName),
+		ms:     ms,
+	}
+}
+
+// instrument the instrumentation of the service, services that weren't created with New only get spans
+func (ws *WormholeService) instrument() *instrumentation {
+	if ws.instrumentation == nil {
+		return newInstrumentation(nil)
+	}
+	return ws.instrumentation
+}
+
+// proxyDialer the dialer of the transports that proxy through the agent
+func (ws *WormholeService) proxyDialer(agentGroup *AgentGroup) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return ws.instrument().dialer(agentGroup.AgentIdentifier, defaultDialer.DialContext)
+}
+
+// start starts the span of a wormhole operation, the returned function must be called with the outcome of the operation
+func (i *instrumentation) start(ctx context.Context, operation string, agentIdentifier string) (context.Context, func(error)) {
+	ctx, span := i.tracer.Start(ctx, "wormhole."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("wormhole.operation", operation),
+			attribute.String("wormhole.agent.identifier", agentIdentifier),
+		),
+	)
+	start := time.Now()
+
+	return ctx, func(err error) {
+		defer span.End()
+		outcome := recordOutcome(span, err)
+		if i.ms != nil {
+			i.ms.TimerWithTags(requestsMetric, map[string]string{
+				"operation":       operation,
+				"agentIdentifier": agentIdentifier,
+				"outcome":         outcome,
+			}).Record(time.Since(start))
+		}
+	}
+}
+
+// dialer wraps dial to time the connections to the SOCKS proxy made on behalf of the agent
+func (i *instrumentation) dialer(agentIdentifier string, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, span := i.tracer.Start(ctx, "wormhole.proxyDial",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("wormhole.agent.identifier", agentIdentifier),
+				attribute.String("net.peer.name", address),
+			),
+		)
+		defer span.End()
+
+		start := time.Now()
+		conn, err := dial(ctx, network, address)
+		outcome := recordOutcome(span, err)
+		if i.ms != nil {
+			i.ms.TimerWithTags(dialsMetric, map[string]string{
+				"agentIdentifier": agentIdentifier,
+				"outcome":         outcome,
+			}).Record(time.Since(start))
+		}
+		return conn, err
+	}
+}
+
+func recordOutcome(span trace.Span, err error) string {
+	if err == nil {
+		return "SUCCESS"
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return "ERROR"
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/armory-io/go-commons/clock"
+	"golang.org/x/net/http/httpproxy"
+	"k8s.io/client-go/rest"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshBefore = time.Minute
+	defaultRefreshJitter = 30 * time.Second
+	refreshRetryInterval = 10 * time.Second
+)
+
+type (
+	// RotatingSessionOptions how a RotatingSession refreshes its credentials
+	RotatingSessionOptions struct {
+		// RefreshBefore how long before the credentials expire they are proactively refreshed, defaults to 1 minute
+		RefreshBefore time.Duration
+		// Jitter the maximum random amount of time the refresh is brought forward by, so that sessions created together don't refresh together. Defaults to 30 seconds
+		Jitter time.Duration
+		// OnRotate is called with the new credentials every time they are refreshed
+		OnRotate func(credentials *SessionCredentials)
+		// Clock defaults to the real clock
+		Clock clock.Clock
+	}
+
+	// RotatingSession SOCKS session credentials for an agent group that are refreshed before they expire, and whenever the proxy rejects them.
+	// Transports and rest.Configs built from a RotatingSession always use the current credentials, holders of anything built from
+	// the credentials themselves can subscribe to Rotations to rebuild it
+	RotatingSession struct {
+		ws         *WormholeService
+		agentGroup *AgentGroup
+		options    RotatingSessionOptions
+		clock      clock.Clock
+		rotations  chan *SessionCredentials
+		stop       chan struct{}
+		stopOnce   sync.Once
+
+		mu          sync.RWMutex
+		refreshMu   sync.Mutex
+		generation  uint64
+		credentials *SessionCredentials
+		proxyConfig *httpproxy.Config
+		refresh     clock.Timer
+	}
+
+	rotatingTransport struct {
+		session *RotatingSession
+		base    *http.Transport
+	}
+)
+
+// NewRotatingSession fetches session credentials for the agent group and keeps them fresh until the session is closed
+func (ws *WormholeService) NewRotatingSession(ctx context.Context, agentGroup *AgentGroup, options RotatingSessionOptions) (*RotatingSession, error) {
+	if options.RefreshBefore <= 0 {
+		options.RefreshBefore = defaultRefreshBefore
+	}
+	if options.Jitter < 0 {
+		options.Jitter = 0
+	} else if options.Jitter == 0 {
+		options.Jitter = defaultRefreshJitter
+	}
+	s := &RotatingSession{
+		ws:         ws,
+		agentGroup: agentGroup,
+		options:    options,
+		clock:      clock.OrDefault(options.Clock),
+		rotations:  make(chan *SessionCredentials, 1),
+		stop:       make(chan struct{}),
+	}
+	s.refresh = s.clock.NewTimer(time.Hour)
+	s.refresh.Stop()
+	credentials, err := ws.getSessionCredentialsForAgentGroup(ctx, agentGroup)
+	if err != nil {
+		return nil, err
+	}
+	s.rotate(credentials)
+	go s.refreshLoop()
+	return s, nil
+}
+
+// Credentials the current session credentials
+func (s *RotatingSession) Credentials() *SessionCredentials {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.credentials
+}
+
+// Rotations receives the new credentials after every refresh. Only the latest credentials are kept,
+// so a slow reader skips intermediate rotations instead of blocking the refresh
+func (s *RotatingSession) Rotations() <-chan *SessionCredentials {
+	return s.rotations
+}
+
+// Refresh fetches new credentials from wormhole right away
+func (s *RotatingSession) Refresh(ctx context.Context) error {
+	return s.refreshIfStale(ctx, s.currentGeneration())
+}
+
+// Close stops the proactive refresh of the credentials
+func (s *RotatingSession) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// ProxyFunction see WormholeService.GetProxyFunction, the returned function always proxies through the current credentials
+func (s *RotatingSession) ProxyFunction() func(*http.Request) (*url.URL, error) {
+	return func(request *http.Request) (*url.URL, error) {
+		s.mu.RLock()
+		proxyConfig := s.proxyConfig
+		s.mu.RUnlock()
+		return proxyConfig.ProxyFunc()(request.URL)
+	}
+}
+
+// Transport a transport that proxies through the current credentials. When the proxy rejects the credentials they are refreshed
+// and the request is retried once, provided its body can be replayed
+func (s *RotatingSession) Transport() http.RoundTripper {
+	return &rotatingTransport{
+		session: s,
+		base:    &http.Transport{Proxy: s.ProxyFunction(), DialContext: s.ws.proxyDialer(s.agentGroup)},
+	}
+}
+
+// ClusterConfig see WormholeService.GetProxyEnabledClusterConfig, the returned config always proxies through the current credentials
+func (s *RotatingSession) ClusterConfig(ctx context.Context) (*rest.Config, error) {
+	credentials, err := s.ws.GetKubernetesClusterCredentialsFromAgent(ctx, s.agentGroup)
+	if err != nil {
+		return nil, err
+	}
+	config, err := clusterConfig(credentials, s.ProxyFunction())
+	if err != nil {
+		return nil, err
+	}
+	config.Dial = s.ws.proxyDialer(s.agentGroup)
+	return config, nil
+}
+
+func (s *RotatingSession) currentGeneration() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.generation
+}
+
+// refreshIfStale refreshes the credentials unless they have been rotated since generation was read,
+// so that concurrent auth failures with the same credentials only refresh them once
+func (s *RotatingSession) refreshIfStale(ctx context.Context, generation uint64) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if s.currentGeneration() != generation {
+		return nil
+	}
+	credentials, err := s.ws.getSessionCredentialsForAgentGroup(ctx, s.agentGroup)
+	if err != nil {
+		return err
+	}
+	s.rotate(credentials)
+	return nil
+}
+
+func (s *RotatingSession) rotate(credentials *SessionCredentials) {
+	proxyConfig := s.ws.proxyConfig(credentials)
+	s.mu.Lock()
+	first := s.credentials == nil
+	s.credentials = credentials
+	s.proxyConfig = proxyConfig
+	s.generation++
+	s.scheduleLocked(s.refreshDelay(credentials))
+	s.mu.Unlock()
+
+	if first {
+		return
+	}
+	if s.options.OnRotate != nil {
+		s.options.OnRotate(credentials)
+	}
+	// drop credentials nobody has read yet in favour of the new ones
+	select {
+	case <-s.rotations:
+	default:
+	}
+	s.rotations <- credentials
+}
+
+// refreshDelay how long until the credentials should be refreshed, a negative delay disables the proactive refresh
+func (s *RotatingSession) refreshDelay(credentials *SessionCredentials) time.Duration {
+	if credentials.ExpiresAt.IsZero() {
+		return -1
+	}
+	delay := s.clock.Until(credentials.ExpiresAt) - s.options.RefreshBefore
+	if s.options.Jitter > 0 {
+		delay -= time.Duration(rand.Int63n(int64(s.options.Jitter)))
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// scheduleLocked moves the proactive refresh to after delay, a negative delay disables it
+func (s *RotatingSession) scheduleLocked(delay time.Duration) {
+	s.refresh.Stop()
+	if delay >= 0 {
+		s.refresh.Reset(delay)
+	}
+}
+
+func (s *RotatingSession) refreshLoop() {
+	defer s.refresh.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.refresh.C():
+			if err := s.Refresh(context.Background()); err != nil {
+				s.ws.logger.Warnf("failed to refresh wormhole session credentials for agent %q, retrying in %s: %s", s.agentGroup.AgentIdentifier, refreshRetryInterval, err)
+				s.mu.Lock()
+				s.scheduleLocked(refreshRetryInterval)
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (t *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	generation := t.session.currentGeneration()
+	res, err := t.base.RoundTrip(req)
+	if !isProxyAuthFailure(res, err) || (req.Body != nil && req.GetBody == nil) {
+		return res, err
+	}
+	if res != nil {
+		_ = res.Body.Close()
+	}
+	if err := t.session.refreshIfStale(req.Context(), generation); err != nil {
+		return nil, err
+	}
+	// connections to the proxy were authenticated with the old credentials
+	t.base.CloseIdleConnections()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// isProxyAuthFailure whether the proxy rejected the session credentials, SOCKS proxies fail the dial
+// while HTTP proxies respond with 407
+func isProxyAuthFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return strings.Contains(err.Error(), "authentication failed")
+	}
+	return res.StatusCode == http.StatusProxyAuthRequired
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/armory-io/go-commons/clock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRotatingSessionRefreshesBeforeExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	var issued atomic.Int32
+	wormhole := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		n := issued.Add(1)
+		_ = json.NewEncoder(writer).Encode(&SessionCredentials{
+			User:      fmt.Sprintf("user-%d", n),
+			Host:      "wormhole",
+			Port:      1080,
+			ExpiresAt: fake.Now().Add(10 * time.Minute),
+		})
+	}))
+	defer wormhole.Close()
+
+	var rotated atomic.Int32
+	session, err := newTestService(wormhole.URL).NewRotatingSession(context.Background(), &AgentGroup{AgentIdentifier: "my-agent"}, RotatingSessionOptions{
+		RefreshBefore: time.Minute,
+		Jitter:        -1,
+		Clock:         fake,
+		OnRotate: func(credentials *SessionCredentials) {
+			rotated.Add(1)
+		},
+	})
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.Equal(t, "user-1", session.Credentials().User)
+
+	fake.BlockUntil(1)
+	fake.Advance(9 * time.Minute)
+
+	select {
+	case credentials := <-session.Rotations():
+		assert.Equal(t, "user-2", credentials.User)
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not rotated")
+	}
+	assert.Equal(t, "user-2", session.Credentials().User)
+	assert.Equal(t, int32(1), rotated.Load())
+
+	proxyURL, err := session.ProxyFunction()(httptest.NewRequest(http.MethodGet, "https://kubernetes", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "user-2", proxyURL.User.Username())
+}
+
+func TestRotatingSessionRefreshIfStale(t *testing.T) {
+	var issued atomic.Int32
+	wormhole := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		n := issued.Add(1)
+		_ = json.NewEncoder(writer).Encode(&SessionCredentials{User: fmt.Sprintf("user-%d", n)})
+	}))
+	defer wormhole.Close()
+
+	session, err := newTestService(wormhole.URL).NewRotatingSession(context.Background(), &AgentGroup{AgentIdentifier: "my-agent"}, RotatingSessionOptions{})
+	assert.NoError(t, err)
+	defer session.Close()
+
+	generation := session.currentGeneration()
+	assert.NoError(t, session.refreshIfStale(context.Background(), generation))
+	// a second failure with the same credentials must not refresh them again
+	assert.NoError(t, session.refreshIfStale(context.Background(), generation))
+	assert.Equal(t, int32(2), issued.Load())
+	assert.Equal(t, "user-2", session.Credentials().User)
+}
+
+func TestIsProxyAuthFailure(t *testing.T) {
+	assert.True(t, isProxyAuthFailure(nil, errors.New("socks connect tcp wormhole:1080->kubernetes:443: username/password authentication failed")))
+	assert.True(t, isProxyAuthFailure(&http.Response{StatusCode: http.StatusProxyAuthRequired}, nil))
+	assert.False(t, isProxyAuthFailure(&http.Response{StatusCode: http.StatusUnauthorized}, nil))
+	assert.False(t, isProxyAuthFailure(nil, errors.New("connection refused")))
+}
+
+func newTestService(baseURL string) *WormholeService {
+	return New(WormholeServiceParameters{
+		Client:    &http.Client{},
+		BaseURL:   baseURL,
+		Overrides: &SessionOverrides{},
+		Logger:    zap.S(),
+	})
+}
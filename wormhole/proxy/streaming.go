@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"golang.org/x/net/proxy"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// dialerFunc adapts a dial function to proxy.Dialer and proxy.ContextDialer
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (d dialerFunc) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// GetStreamingTransport a transport for the streaming APIs of the agent's cluster, i.e. exec, attach, logs and port-forward.
+// Unlike the transport of GetProxyConfiguredTransport it can upgrade connections to SPDY through the SOCKS session, the returned
+// transport and upgrader can be passed to client-go's remotecommand.NewSPDYExecutorForTransports or spdy.NewDialer
+func (ws *WormholeService) GetStreamingTransport(ctx context.Context, agentGroup *AgentGroup) (http.RoundTripper, spdy.Upgrader, error) {
+	config, err := ws.GetProxyEnabledClusterConfig(ctx, agentGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	return spdy.RoundTripperFor(config)
+}
+
+// NewExecutor an executor of kubectl exec and attach style commands in the agent's cluster,
+// url is the exec or attach subresource of the pod, see remotecommand.NewSPDYExecutor
+func (ws *WormholeService) NewExecutor(ctx context.Context, agentGroup *AgentGroup, method string, url *url.URL) (remotecommand.Executor, error) {
+	transport, upgrader, err := ws.GetStreamingTransport(ctx, agentGroup)
+	if err != nil {
+		return nil, err
+	}
+	return remotecommand.NewSPDYExecutorForTransports(transport, upgrader, method, url)
+}
+
+// NewStreamDialer a dialer of SPDY streams to the agent's cluster, i.e. for portforward.New with the portforward subresource of the pod
+func (ws *WormholeService) NewStreamDialer(ctx context.Context, agentGroup *AgentGroup, method string, url *url.URL) (httpstream.Dialer, error) {
+	transport, upgrader, err := ws.GetStreamingTransport(ctx, agentGroup)
+	if err != nil {
+		return nil, err
+	}
+	return spdy.NewDialer(upgrader, &http.Client{Transport: transport}, method, url), nil
+}
+
+// GetProxyDialer dials through the SOCKS session of the agent, for protocols that can't go through an http.Transport such as WebSockets,
+// i.e. as the NetDialContext of a websocket dialer
+func (ws *WormholeService) GetProxyDialer(ctx context.Context, agentGroup *AgentGroup) (proxy.ContextDialer, error) {
+	sessionCredentials, err := ws.getSessionCredentialsForAgentGroup(ctx, agentGroup)
+	if err != nil {
+		return nil, err
+	}
+	return ws.socksDialer(sessionCredentials, agentGroup)
+}
+
+func (ws *WormholeService) socksDialer(sessionCredentials *SessionCredentials, agentGroup *AgentGroup) (proxy.ContextDialer, error) {
+	proxyURL, err := url.Parse(ws.proxyURL(sessionCredentials))
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.FromURL(proxyURL, dialerFunc(ws.proxyDialer(agentGroup)))
+	if err != nil {
+		return nil, err
+	}
+	// the SOCKS5 dialer always implements ContextDialer
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// StreamingTransport see WormholeService.GetStreamingTransport, the returned transport always proxies through the current credentials
+func (s *RotatingSession) StreamingTransport(ctx context.Context) (http.RoundTripper, spdy.Upgrader, error) {
+	config, err := s.ClusterConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return spdy.RoundTripperFor(config)
+}
+
+// Dialer see WormholeService.GetProxyDialer, every dial goes through the current credentials
+func (s *RotatingSession) Dialer() proxy.ContextDialer {
+	return dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer, err := s.ws.socksDialer(s.Credentials(), s.agentGroup)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	})
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2022 Armory, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGetProxyDialerDialsTheSessionProxy(t *testing.T) {
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer socks.Close()
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := socks.Accept()
+		if err != nil {
+			return
+		}
+		close(accepted)
+		_ = conn.Close()
+	}()
+
+	wormhole := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(&SessionCredentials{
+			User:     "user",
+			Password: "password",
+			Host:     "127.0.0.1",
+			Port:     socks.Addr().(*net.TCPAddr).Port,
+		})
+	}))
+	defer wormhole.Close()
+
+	dialer, err := newTestService(wormhole.URL).GetProxyDialer(context.Background(), &AgentGroup{AgentIdentifier: "my-agent"})
+	assert.NoError(t, err)
+
+	// the fake proxy hangs up before the SOCKS handshake
+	_, err = dialer.DialContext(context.Background(), "tcp", "kubernetes.default:443")
+	assert.Error(t, err)
+	<-accepted
+}
+
+func TestNewExecutorRequiresKubernetesCredentials(t *testing.T) {
+	wormhole := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer wormhole.Close()
+
+	_, err := newTestService(wormhole.URL).NewExecutor(context.Background(), &AgentGroup{AgentIdentifier: "my-agent"}, http.MethodPost, &url.URL{})
+	assert.ErrorIs(t, err, ErrCredentialFetchNotSupportedByAgent)
+}
@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/armory-io/go-commons/metrics"
 	"github.com/hashicorp/go-retryablehttp"
 	"go.uber.org/zap"
 	"golang.org/x/net/http/httpproxy"
@@ -45,6 +46,8 @@ type WormholeServiceParameters struct {
 	BaseURL   string
 	Overrides *SessionOverrides
 	Logger    *zap.SugaredLogger
+	// Metrics optional, records the duration and outcome of calls to wormhole and dials to the proxy
+	Metrics metrics.MetricsSvc
 }
 
 func New(params WormholeServiceParameters) *WormholeService {
@@ -61,6 +64,8 @@ func New(params WormholeServiceParameters) *WormholeService {
 		WormholeBaseURL:  params.BaseURL,
 		SessionOverrides: params.Overrides,
 		client:           rc.StandardClient(),
+		logger:           params.Logger,
+		instrumentation:  newInstrumentation(params.Metrics),
 	}
 }
 
@@ -68,6 +73,8 @@ type WormholeService struct {
 	WormholeBaseURL  string
 	SessionOverrides *SessionOverrides
 	client           *http.Client
+	logger           *zap.SugaredLogger
+	instrumentation  *instrumentation
 }
 
 type AgentGroup struct {
@@ -113,7 +120,10 @@ type Agent struct {
 	StreamID               string `json:"streamId,omitempty"`
 }
 
-func (ws *WormholeService) getSessionCredentialsForAgentGroup(ctx context.Context, agentGroup *AgentGroup) (*SessionCredentials, error) {
+func (ws *WormholeService) getSessionCredentialsForAgentGroup(ctx context.Context, agentGroup *AgentGroup) (_ *SessionCredentials, err error) {
+	ctx, done := ws.instrument().start(ctx, operationCreateSession, agentGroup.AgentIdentifier)
+	defer func() { done(err) }()
+
 	agentGroupJson, err := json.Marshal(&agentGroup)
 	if err != nil {
 		return nil, err
@@ -150,12 +160,8 @@ func (ws *WormholeService) getSessionCredentialsForAgentGroup(ctx context.Contex
 	return sessionCredentials, nil
 }
 
-func (ws *WormholeService) getProxyURL(ctx context.Context, agentGroup *AgentGroup) (string, error) {
-	sessionCredentials, err := ws.getSessionCredentialsForAgentGroup(ctx, agentGroup)
-	if err != nil {
-		return "", err
-	}
-
+// proxyURL the SOCKS URL of the session credentials with the session overrides applied
+func (ws *WormholeService) proxyURL(sessionCredentials *SessionCredentials) string {
 	user := sessionCredentials.User
 	if ws.SessionOverrides.User != "" {
 		user = ws.SessionOverrides.User
@@ -170,18 +176,23 @@ func (ws *WormholeService) getProxyURL(ctx context.Context, agentGroup *AgentGro
 		port = ws.SessionOverrides.Port
 	}
 
-	return fmt.Sprintf("socks5://%s:%s@%s:%d", user, password, host, port), nil
+	return fmt.Sprintf("socks5://%s:%s@%s:%d", user, password, host, port)
 }
 
 func (ws *WormholeService) getProxyConfig(ctx context.Context, agentGroup *AgentGroup) (*httpproxy.Config, error) {
-	proxyURL, err := ws.getProxyURL(ctx, agentGroup)
+	sessionCredentials, err := ws.getSessionCredentialsForAgentGroup(ctx, agentGroup)
 	if err != nil {
 		return nil, err
 	}
+	return ws.proxyConfig(sessionCredentials), nil
+}
+
+func (ws *WormholeService) proxyConfig(sessionCredentials *SessionCredentials) *httpproxy.Config {
+	proxyURL := ws.proxyURL(sessionCredentials)
 	return &httpproxy.Config{
 		HTTPProxy:  proxyURL,
 		HTTPSProxy: proxyURL,
-	}, nil
+	}
 }
 
 func (ws *WormholeService) GetProxyFunction(ctx context.Context, agentGroup *AgentGroup) (func(*http.Request) (*url.URL, error), error) {
@@ -199,10 +210,13 @@ func (ws *WormholeService) GetProxyConfiguredTransport(ctx context.Context, agen
 	if err != nil {
 		return nil, err
 	}
-	return &http.Transport{Proxy: proxyFunction}, nil
+	return &http.Transport{Proxy: proxyFunction, DialContext: ws.proxyDialer(agentGroup)}, nil
 }
 
-func (ws *WormholeService) GetKubernetesClusterCredentialsFromAgent(ctx context.Context, agentGroup *AgentGroup) (*KubernetesCredentials, error) {
+func (ws *WormholeService) GetKubernetesClusterCredentialsFromAgent(ctx context.Context, agentGroup *AgentGroup) (_ *KubernetesCredentials, err error) {
+	ctx, done := ws.instrument().start(ctx, operationFetchK8sCredentials, agentGroup.AgentIdentifier)
+	defer func() { done(err) }()
+
 	agentGroupJson, err := json.Marshal(&agentGroup)
 	if err != nil {
 		return nil, err
@@ -263,6 +277,15 @@ func (ws *WormholeService) GetProxyEnabledClusterConfig(ctx context.Context, age
 		return nil, err
 	}
 
+	config, err := clusterConfig(credentials, proxyFunction)
+	if err != nil {
+		return nil, err
+	}
+	config.Dial = ws.proxyDialer(agentGroup)
+	return config, nil
+}
+
+func clusterConfig(credentials *KubernetesCredentials, proxyFunction func(*http.Request) (*url.URL, error)) (*rest.Config, error) {
 	caData, err := base64.StdEncoding.DecodeString(credentials.RootCaBase64EncodedByteArray)
 	if err != nil {
 		return nil, err
@@ -285,7 +308,10 @@ func (ws *WormholeService) GetProxyEnabledClusterConfig(ctx context.Context, age
 	return config, nil
 }
 
-func (ws *WormholeService) ListAgents(ctx context.Context, orgID, envID string) ([]*Agent, error) {
+func (ws *WormholeService) ListAgents(ctx context.Context, orgID, envID string) (_ []*Agent, err error) {
+	ctx, done := ws.instrument().start(ctx, operationListAgents, "")
+	defer func() { done(err) }()
+
 	if strings.TrimSpace(orgID) == "" || strings.TrimSpace(envID) == "" {
 		return nil, fmt.Errorf("must provide orgID and envID")
 	}
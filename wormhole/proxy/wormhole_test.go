@@ -19,7 +19,10 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"github.com/armory-io/go-commons/metrics"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally/v4"
 	"go.uber.org/zap"
 	"net/http"
 	"net/http/httptest"
@@ -57,3 +60,28 @@ func TestClientRetry(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "success", creds.Host)
 }
+
+func TestClientMetrics(t *testing.T) {
+	wormhole := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNotFound)
+	}))
+	defer wormhole.Close()
+
+	ms := metrics.NewMockMetricsSvc(gomock.NewController(t))
+	ms.EXPECT().TimerWithTags(requestsMetric, map[string]string{
+		"operation":       operationCreateSession,
+		"agentIdentifier": "my-agent",
+		"outcome":         "ERROR",
+	}).Return(tally.NoopScope.Timer(""))
+
+	client := New(WormholeServiceParameters{
+		Client:    &http.Client{},
+		BaseURL:   wormhole.URL,
+		Overrides: &SessionOverrides{},
+		Logger:    zap.S(),
+		Metrics:   ms,
+	})
+
+	_, err := client.GetProxyConfiguredTransport(context.Background(), &AgentGroup{AgentIdentifier: "my-agent"})
+	assert.ErrorIs(t, err, ErrAgentNotFound)
+}